@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// adaptivePollLagThreshold is how far behind the tip a shard polls again
+// right away
+const adaptivePollLagThreshold = 10 * time.Second
+
+// validateAdaptivePoll checks consumer.min_poll_interval_ms and max_poll_interval_ms
+func validateAdaptivePoll(cfg *Config) error {
+	c := cfg.Consumer
+	if c.MaxPollIntervalMs <= 0 {
+		if c.MinPollIntervalMs > 0 {
+			return fmt.Errorf("consumer.min_poll_interval_ms requires max_poll_interval_ms")
+		}
+		return nil
+	}
+	if c.MinPollIntervalMs > c.MaxPollIntervalMs {
+		return fmt.Errorf("consumer.min_poll_interval_ms (%d) must not exceed max_poll_interval_ms (%d)",
+			c.MinPollIntervalMs, c.MaxPollIntervalMs)
+	}
+	return nil
+}
+
+// adaptivePoll adjusts the wait between a manual-mode shard's GetRecords
+// calls to how far behind it is. A shard more than adaptivePollLagThreshold
+// behind the tip, or handed a full batch, polls again after the minimum
+// interval to catch up. A caught-up shard handed an empty batch doubles its
+// wait, up to the maximum, to save calls. Anything in between polls at the
+// shard's poll interval. The read budget still spaces the calls. A nil
+// *adaptivePoll keeps the poll interval.
+type adaptivePoll struct {
+	min, max time.Duration
+	base     time.Duration // the shard's poll interval, within min and max
+	current  time.Duration
+}
+
+// newAdaptivePoll returns nil unless consumer.max_poll_interval_ms is set.
+// pollInterval is the shard's own, after its priority.
+func newAdaptivePoll(cfg *Config, pollInterval time.Duration) *adaptivePoll {
+	if cfg.Consumer.MaxPollIntervalMs <= 0 {
+		return nil
+	}
+	a := &adaptivePoll{
+		min: time.Duration(cfg.Consumer.MinPollIntervalMs) * time.Millisecond,
+		max: time.Duration(cfg.Consumer.MaxPollIntervalMs) * time.Millisecond,
+	}
+	a.base = min(max(pollInterval, a.min), a.max)
+	a.current = a.base
+	return a
+}
+
+// observe sets the wait before the next call from the last batch
+func (a *adaptivePoll) observe(records int, maxRecords int64, millisBehindLatest int64) {
+	if a == nil {
+		return
+	}
+	switch {
+	case time.Duration(millisBehindLatest)*time.Millisecond > adaptivePollLagThreshold || int64(records) >= maxRecords:
+		a.current = a.min
+	case records == 0 && millisBehindLatest == 0:
+		a.current = min(max(a.current*2, a.base), a.max)
+	default:
+		a.current = a.base
+	}
+}
+
+// pollDelay is how long after a GetRecords call the next one is due, before
+// the read budget
+func (msp *ManualShardProcessor) pollDelay() time.Duration {
+	if msp.adaptivePoll == nil {
+		return msp.pollInterval
+	}
+	return msp.adaptivePoll.current
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	chk "github.com/vmware/vmware-go-kcl/clientlibrary/checkpoint"
+	par "github.com/vmware/vmware-go-kcl/clientlibrary/partition"
+)
+
+// Extra lease table attributes written by the affinity layer
+const (
+	PreviousOwnerKey = "PreviousOwner"
+	ReleasedAtKey    = "ReleasedAt"
+)
+
+const (
+	defaultAffinityGrace              = 30 * time.Second
+	defaultAffinityImbalanceThreshold = 2
+
+	// liveLeaseCacheTTL bounds how often the lease table is scanned to judge worker health
+	liveLeaseCacheTTL = 5 * time.Second
+)
+
+// AffinityCheckpointer wraps the KCL checkpointer so that a shard whose lease
+// lapsed or was released is left for its previous owner to pick back up,
+// as long as that owner still holds live leases (it is healthy) and taking
+// the shard would not fix a clear imbalance. Other workers only take the
+// shard after the grace period. This stops shards ping-ponging between
+// workers and the checkpoint reloads that come with every move.
+type AffinityCheckpointer struct {
+	chk.Checkpointer
+	svc                dynamodbiface.DynamoDBAPI
+	tableName          string
+	labels             shardLabeler
+	workerID           string
+	grace              time.Duration
+	imbalanceThreshold int
+
+	mu         sync.Mutex
+	liveLeases map[string]int
+	liveAt     time.Time
+}
+
+// NewAffinityCheckpointer wraps inner using consumer.affinity settings
+func NewAffinityCheckpointer(inner chk.Checkpointer, svc dynamodbiface.DynamoDBAPI, tableName string, cfg *Config) *AffinityCheckpointer {
+	grace := time.Duration(cfg.Consumer.Affinity.GraceMs) * time.Millisecond
+	if grace <= 0 {
+		grace = defaultAffinityGrace
+	}
+	threshold := cfg.Consumer.Affinity.ImbalanceThreshold
+	if threshold <= 0 {
+		threshold = defaultAffinityImbalanceThreshold
+	}
+
+	return &AffinityCheckpointer{
+		Checkpointer:       inner,
+		svc:                svc,
+		tableName:          tableName,
+		labels:             newShardLabeler(cfg),
+		workerID:           cfg.Consumer.WorkerID,
+		grace:              grace,
+		imbalanceThreshold: threshold,
+	}
+}
+
+// GetLease defers to the previous owner where affinity applies, otherwise delegates to KCL
+func (a *AffinityCheckpointer) GetLease(shard *par.ShardStatus, newAssignTo string) error {
+	deferTo, err := a.previousOwnerToDeferTo(shard.ID, newAssignTo)
+	if err != nil {
+		log.Printf("[%s] Affinity check failed, falling back to default lease taking: %v", a.labels.logLabel(shard.ID), err)
+	} else if deferTo != "" {
+		log.Printf("[%s] Affinity: leaving shard for previous owner %s", a.labels.logLabel(shard.ID), deferTo)
+		return chk.ErrLeaseNotAcquired{}
+	}
+	return a.Checkpointer.GetLease(shard, newAssignTo)
+}
+
+// RemoveLeaseOwner releases the lease while remembering who held it and when
+func (a *AffinityCheckpointer) RemoveLeaseOwner(shardID string) error {
+	_, err := a.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(a.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			chk.LeaseKeyKey: {S: aws.String(shardID)},
+		},
+		UpdateExpression:    aws.String(fmt.Sprintf("SET %s = :owner, %s = :released REMOVE %s", PreviousOwnerKey, ReleasedAtKey, chk.LeaseOwnerKey)),
+		ConditionExpression: aws.String(chk.LeaseOwnerKey + " = :owner"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner":    {S: aws.String(a.workerID)},
+			":released": {S: aws.String(time.Now().UTC().Format(time.RFC3339))},
+		},
+	})
+	return err
+}
+
+// previousOwnerToDeferTo returns the worker the shard should be left for, or "" if newAssignTo may take it
+func (a *AffinityCheckpointer) previousOwnerToDeferTo(shardID, newAssignTo string) (string, error) {
+	output, err := a.svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(a.tableName),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			chk.LeaseKeyKey: {S: aws.String(shardID)},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if output.Item == nil {
+		return "", nil
+	}
+
+	owner := stringAttr(output.Item, chk.LeaseOwnerKey)
+	if owner == newAssignTo {
+		return "", nil
+	}
+
+	var previousOwner string
+	var since time.Time
+	if owner != "" {
+		leaseTimeout, err := time.Parse(time.RFC3339, stringAttr(output.Item, chk.LeaseTimeoutKey))
+		if err != nil || time.Now().Before(leaseTimeout) {
+			// Live (or unreadable) lease: KCL's own checks handle it
+			return "", nil
+		}
+		previousOwner, since = owner, leaseTimeout
+	} else {
+		previousOwner = stringAttr(output.Item, PreviousOwnerKey)
+		since, _ = time.Parse(time.RFC3339, stringAttr(output.Item, ReleasedAtKey))
+	}
+
+	if previousOwner == "" || previousOwner == newAssignTo || time.Since(since) > a.grace {
+		return "", nil
+	}
+
+	live, err := a.liveLeaseCounts()
+	if err != nil {
+		return "", err
+	}
+	if live[previousOwner] == 0 {
+		// Previous owner holds nothing, so treat it as gone
+		return "", nil
+	}
+	if live[previousOwner]-live[newAssignTo] >= a.imbalanceThreshold {
+		return "", nil
+	}
+	return previousOwner, nil
+}
+
+// liveLeaseCounts returns the number of unexpired leases per worker, cached briefly
+func (a *AffinityCheckpointer) liveLeaseCounts() (map[string]int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.liveLeases != nil && time.Since(a.liveAt) < liveLeaseCacheTTL {
+		return a.liveLeases, nil
+	}
+
+	counts := make(map[string]int)
+	now := time.Now()
+	err := a.svc.ScanPages(&dynamodb.ScanInput{TableName: aws.String(a.tableName)},
+		func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				owner := stringAttr(item, chk.LeaseOwnerKey)
+				if owner == "" || stringAttr(item, chk.SequenceNumberKey) == chk.ShardEnd {
+					continue
+				}
+				leaseTimeout, err := time.Parse(time.RFC3339, stringAttr(item, chk.LeaseTimeoutKey))
+				if err == nil && now.Before(leaseTimeout) {
+					counts[owner]++
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan lease table: %w", err)
+	}
+
+	a.liveLeases, a.liveAt = counts, now
+	return counts, nil
+}
+
+func stringAttr(item map[string]*dynamodb.AttributeValue, key string) string {
+	if value, ok := item[key]; ok && value != nil {
+		return aws.StringValue(value.S)
+	}
+	return ""
+}
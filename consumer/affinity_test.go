@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	chk "github.com/vmware/vmware-go-kcl/clientlibrary/checkpoint"
+	par "github.com/vmware/vmware-go-kcl/clientlibrary/partition"
+)
+
+// fakeAffinityTable is a KCL lease table keyed by shard ID, applying the
+// conditional release of RemoveLeaseOwner. With unavailable set every call fails.
+type fakeAffinityTable struct {
+	dynamodbiface.DynamoDBAPI
+	mu          sync.Mutex
+	rows        map[string]map[string]*dynamodb.AttributeValue
+	unavailable bool
+}
+
+func (f *fakeAffinityTable) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.unavailable {
+		return nil, awserr.New("ServiceUnavailable", "try again", nil)
+	}
+	return &dynamodb.GetItemOutput{Item: f.rows[aws.StringValue(input.Key[chk.LeaseKeyKey].S)]}, nil
+}
+
+func (f *fakeAffinityTable) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	row := f.rows[aws.StringValue(input.Key[chk.LeaseKeyKey].S)]
+	owner := input.ExpressionAttributeValues[":owner"]
+	if row == nil || stringAttr(row, chk.LeaseOwnerKey) != aws.StringValue(owner.S) {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+	}
+	row[PreviousOwnerKey] = owner
+	row[ReleasedAtKey] = input.ExpressionAttributeValues[":released"]
+	delete(row, chk.LeaseOwnerKey)
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeAffinityTable) ScanPages(input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	page := &dynamodb.ScanOutput{}
+	for _, row := range f.rows {
+		page.Items = append(page.Items, row)
+	}
+	fn(page, true)
+	return nil
+}
+
+// testLease is a lease table row for shardID held by owner until expiresIn from now
+func testLease(shardID, owner string, expiresIn time.Duration) map[string]*dynamodb.AttributeValue {
+	row := map[string]*dynamodb.AttributeValue{
+		chk.LeaseKeyKey:       {S: aws.String(shardID)},
+		chk.SequenceNumberKey: {S: aws.String("49590338271490256608559692538361571095921575989136588802")},
+	}
+	if owner != "" {
+		row[chk.LeaseOwnerKey] = &dynamodb.AttributeValue{S: aws.String(owner)}
+		row[chk.LeaseTimeoutKey] = &dynamodb.AttributeValue{S: aws.String(time.Now().Add(expiresIn).UTC().Format(time.RFC3339))}
+	}
+	return row
+}
+
+// releasedLease is a lease table row for shardID released by previousOwner releasedAgo
+func releasedLease(shardID, previousOwner string, releasedAgo time.Duration) map[string]*dynamodb.AttributeValue {
+	row := testLease(shardID, "", 0)
+	row[PreviousOwnerKey] = &dynamodb.AttributeValue{S: aws.String(previousOwner)}
+	row[ReleasedAtKey] = &dynamodb.AttributeValue{S: aws.String(time.Now().Add(-releasedAgo).UTC().Format(time.RFC3339))}
+	return row
+}
+
+// leaseTaker is the wrapped KCL checkpointer, recording the leases it was asked to take
+type leaseTaker struct {
+	chk.Checkpointer
+	taken []string
+}
+
+func (l *leaseTaker) GetLease(shard *par.ShardStatus, newAssignTo string) error {
+	l.taken = append(l.taken, newAssignTo)
+	return nil
+}
+
+func TestAffinityGetLease(t *testing.T) {
+	const shard = "shardId-000000000000"
+	tests := []struct {
+		name         string
+		shard        map[string]*dynamodb.AttributeValue
+		others       []map[string]*dynamodb.AttributeValue // the other leases in the table
+		worker       string
+		unavailable  bool
+		wantDeferred bool
+	}{
+		{
+			name:         "released by a healthy owner within the grace period",
+			shard:        releasedLease(shard, "worker-1", time.Second),
+			others:       []map[string]*dynamodb.AttributeValue{testLease("shardId-000000000001", "worker-1", time.Minute), testLease("shardId-000000000002", "worker-2", time.Minute)},
+			worker:       "worker-2",
+			wantDeferred: true,
+		},
+		{
+			name:   "previous owner takes it back",
+			shard:  releasedLease(shard, "worker-1", time.Second),
+			others: []map[string]*dynamodb.AttributeValue{testLease("shardId-000000000001", "worker-1", time.Minute)},
+			worker: "worker-1",
+		},
+		{
+			name:   "grace period over",
+			shard:  releasedLease(shard, "worker-1", time.Minute),
+			others: []map[string]*dynamodb.AttributeValue{testLease("shardId-000000000001", "worker-1", time.Minute)},
+			worker: "worker-2",
+		},
+		{
+			name:   "previous owner holds no live leases",
+			shard:  releasedLease(shard, "worker-1", time.Second),
+			others: []map[string]*dynamodb.AttributeValue{testLease("shardId-000000000001", "worker-1", -time.Minute)},
+			worker: "worker-2",
+		},
+		{
+			name:  "previous owner holds only finished shards",
+			shard: releasedLease(shard, "worker-1", time.Second),
+			others: []map[string]*dynamodb.AttributeValue{func() map[string]*dynamodb.AttributeValue {
+				row := testLease("shardId-000000000001", "worker-1", time.Minute)
+				row[chk.SequenceNumberKey] = &dynamodb.AttributeValue{S: aws.String(chk.ShardEnd)}
+				return row
+			}()},
+			worker: "worker-2",
+		},
+		{
+			name:         "lapsed lease of a healthy owner",
+			shard:        testLease(shard, "worker-1", -time.Second),
+			others:       []map[string]*dynamodb.AttributeValue{testLease("shardId-000000000001", "worker-1", time.Minute)},
+			worker:       "worker-2",
+			wantDeferred: true,
+		},
+		{
+			name:   "live lease left to KCL",
+			shard:  testLease(shard, "worker-1", time.Minute),
+			worker: "worker-2",
+		},
+		{
+			name:  "clear imbalance",
+			shard: releasedLease(shard, "worker-1", time.Second),
+			others: []map[string]*dynamodb.AttributeValue{
+				testLease("shardId-000000000001", "worker-1", time.Minute),
+				testLease("shardId-000000000002", "worker-1", time.Minute),
+			},
+			worker: "worker-2",
+		},
+		{
+			name:  "imbalance under the threshold",
+			shard: releasedLease(shard, "worker-1", time.Second),
+			others: []map[string]*dynamodb.AttributeValue{
+				testLease("shardId-000000000001", "worker-1", time.Minute),
+				testLease("shardId-000000000002", "worker-1", time.Minute),
+				testLease("shardId-000000000003", "worker-2", time.Minute),
+			},
+			worker:       "worker-2",
+			wantDeferred: true,
+		},
+		{
+			name:   "new shard",
+			shard:  testLease(shard, "", 0),
+			worker: "worker-2",
+		},
+		{
+			name:        "table unavailable falls back to KCL",
+			shard:       releasedLease(shard, "worker-1", time.Second),
+			worker:      "worker-2",
+			unavailable: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &fakeAffinityTable{rows: map[string]map[string]*dynamodb.AttributeValue{shard: tt.shard}, unavailable: tt.unavailable}
+			for _, row := range tt.others {
+				table.rows[aws.StringValue(row[chk.LeaseKeyKey].S)] = row
+			}
+			cfg := &Config{}
+			cfg.Consumer.Affinity.GraceMs = 10000
+			inner := &leaseTaker{}
+			affinity := NewAffinityCheckpointer(inner, table, "leases", cfg)
+
+			err := affinity.GetLease(&par.ShardStatus{ID: shard}, tt.worker)
+			var notAcquired chk.ErrLeaseNotAcquired
+			if deferred := errors.As(err, &notAcquired); deferred != tt.wantDeferred || (!deferred && err != nil) {
+				t.Fatalf("GetLease(%s) = %v, want deferred %t", tt.worker, err, tt.wantDeferred)
+			}
+			if wantTaken := !tt.wantDeferred; (len(inner.taken) == 1) != wantTaken {
+				t.Errorf("KCL asked to take the lease for %v, want taken %t", inner.taken, wantTaken)
+			}
+		})
+	}
+}
+
+func TestAffinityRemoveLeaseOwner(t *testing.T) {
+	const shard = "shardId-000000000000"
+	table := &fakeAffinityTable{rows: map[string]map[string]*dynamodb.AttributeValue{
+		shard:                  testLease(shard, "worker-1", time.Minute),
+		"shardId-000000000001": testLease("shardId-000000000001", "worker-1", time.Minute),
+	}}
+	owner, other := &Config{}, &Config{}
+	owner.Consumer.WorkerID, other.Consumer.WorkerID = "worker-1", "worker-2"
+
+	if err := NewAffinityCheckpointer(&leaseTaker{}, table, "leases", other).RemoveLeaseOwner(shard); err == nil {
+		t.Error("RemoveLeaseOwner() by another worker succeeded")
+	}
+	if err := NewAffinityCheckpointer(&leaseTaker{}, table, "leases", owner).RemoveLeaseOwner(shard); err != nil {
+		t.Fatalf("RemoveLeaseOwner() = %v", err)
+	}
+	if row := table.rows[shard]; stringAttr(row, chk.LeaseOwnerKey) != "" || stringAttr(row, PreviousOwnerKey) != "worker-1" {
+		t.Fatalf("released lease has owner %q and previous owner %q, want none and worker-1",
+			stringAttr(row, chk.LeaseOwnerKey), stringAttr(row, PreviousOwnerKey))
+	}
+
+	// The released shard is left for its owner rather than taken by the next worker
+	inner := &leaseTaker{}
+	if err := NewAffinityCheckpointer(inner, table, "leases", other).GetLease(&par.ShardStatus{ID: shard}, "worker-2"); err == nil {
+		t.Error("worker-2 took the released shard while worker-1 is healthy")
+	}
+	if err := NewAffinityCheckpointer(inner, table, "leases", owner).GetLease(&par.ShardStatus{ID: shard}, "worker-1"); err != nil {
+		t.Errorf("worker-1 could not take its released shard back: %v", err)
+	}
+	if len(inner.taken) != 1 || inner.taken[0] != "worker-1" {
+		t.Errorf("KCL asked to take the lease for %v, want [worker-1]", inner.taken)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Defaults of consumer.sink.aggregates
+const (
+	DefaultAggregatesWindowMs   = 300000
+	DefaultAggregatesBucketMs   = 10000
+	DefaultAggregatesMaxActions = 100
+)
+
+// aggregatesOtherAction collects the actions beyond consumer.sink.aggregates.max_actions
+const aggregatesOtherAction = "other"
+
+// addAggregate adds other into a
+func addAggregate(a *ActionAggregate, other ActionAggregate) {
+	a.Count += other.Count
+	a.ValueSum += other.ValueSum
+}
+
+// AggregatesSnapshot is the body of GET /aggregates
+type AggregatesSnapshot struct {
+	WindowMs int64                      `json:"window_ms"`
+	From     time.Time                  `json:"from"`
+	To       time.Time                  `json:"to"`
+	Actions  map[string]ActionAggregate `json:"actions"`
+	Total    ActionAggregate            `json:"total"`
+}
+
+// aggregateBucket holds the events written during one bucket_ms slice
+type aggregateBucket struct {
+	index   int64 // start of the slice in bucket_ms units since the epoch
+	actions map[string]ActionAggregate
+}
+
+// RollingAggregates keeps per-action event counts and value sums over the
+// last window_ms, for live dashboards without a metrics backend. The window
+// is a ring of bucket_ms slices of processing time that are reset as the
+// window moves past them, and each slice tracks at most max_actions actions,
+// so memory stays bounded however long the consumer runs. It is shared by
+// every stream and shard. A nil *RollingAggregates is valid and records
+// nothing.
+type RollingAggregates struct {
+	mu         sync.Mutex
+	bucket     time.Duration
+	buckets    []aggregateBucket
+	maxActions int
+}
+
+// NewRollingAggregates returns the store behind the "aggregates" sink, or nil
+// if neither consumer.sink.type nor a multi destination is "aggregates"
+func NewRollingAggregates(cfg *Config) *RollingAggregates {
+	enabled := cfg.Consumer.Sink.Type == "aggregates"
+	for _, dest := range cfg.Consumer.Sink.Multi.Sinks {
+		enabled = enabled || dest.Type == "aggregates"
+	}
+	if !enabled {
+		return nil
+	}
+
+	aggCfg := cfg.Consumer.Sink.Aggregates
+	bucket := time.Duration(aggCfg.BucketMs) * time.Millisecond
+	count := max(aggCfg.WindowMs/aggCfg.BucketMs, 1)
+	return &RollingAggregates{
+		bucket:     bucket,
+		buckets:    make([]aggregateBucket, count),
+		maxActions: aggCfg.MaxActions,
+	}
+}
+
+// Write adds the record's event to the current slice
+func (ra *RollingAggregates) Write(record *SinkRecord) error {
+	if ra == nil {
+		return nil
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	index := time.Now().UnixNano() / int64(ra.bucket)
+	b := &ra.buckets[index%int64(len(ra.buckets))]
+	if b.index != index || b.actions == nil {
+		// The slot last held a slice that has left the window
+		*b = aggregateBucket{index: index, actions: make(map[string]ActionAggregate)}
+	}
+
+	action := record.Event.Action
+	if _, ok := b.actions[action]; !ok && len(b.actions) >= ra.maxActions {
+		action = aggregatesOtherAction
+	}
+	agg := b.actions[action]
+	agg.Count++
+	agg.ValueSum += record.Event.Value
+	b.actions[action] = agg
+	return nil
+}
+
+// Close does nothing: the aggregates stay readable until the process exits
+func (ra *RollingAggregates) Close() error {
+	return nil
+}
+
+// Snapshot sums the slices still inside the window
+func (ra *RollingAggregates) Snapshot() AggregatesSnapshot {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	now := time.Now()
+	current := now.UnixNano() / int64(ra.bucket)
+	oldest := current - int64(len(ra.buckets)) + 1
+	snapshot := AggregatesSnapshot{
+		WindowMs: int64(len(ra.buckets)) * ra.bucket.Milliseconds(),
+		From:     time.Unix(0, oldest*int64(ra.bucket)).UTC(),
+		To:       now.UTC(),
+		Actions:  make(map[string]ActionAggregate),
+	}
+	for _, b := range ra.buckets {
+		if b.actions == nil || b.index < oldest || b.index > current {
+			continue
+		}
+		for action, agg := range b.actions {
+			total := snapshot.Actions[action]
+			addAggregate(&total, agg)
+			snapshot.Actions[action] = total
+			addAggregate(&snapshot.Total, agg)
+		}
+	}
+	return snapshot
+}
+
+// handleAggregates serves the rolling aggregates as JSON
+func handleAggregates(aggregates *RollingAggregates) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if aggregates == nil {
+			http.Error(w, "aggregates are disabled, set consumer.sink.type to aggregates", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(aggregates.Snapshot())
+	}
+}
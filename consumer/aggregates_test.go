@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// aggregateRecord is a record of an event with the given action and value
+func aggregateRecord(action string, value float64) *SinkRecord {
+	return &SinkRecord{ShardID: testShard, Event: Event{Action: action, Value: value}}
+}
+
+func TestRollingAggregates(t *testing.T) {
+	const bucket, window = 20 * time.Millisecond, 60 * time.Millisecond
+	cfg := &Config{}
+	cfg.Consumer.Sink.Type = "aggregates"
+	cfg.Consumer.Sink.Aggregates.BucketMs = int(bucket / time.Millisecond)
+	cfg.Consumer.Sink.Aggregates.WindowMs = int(window / time.Millisecond)
+	cfg.Consumer.Sink.Aggregates.MaxActions = 2
+	aggregates := NewRollingAggregates(cfg)
+
+	for _, record := range []*SinkRecord{
+		aggregateRecord("purchase", 10),
+		aggregateRecord("purchase", 5.5),
+		aggregateRecord("view", 0),
+		// Beyond max_actions, so counted as other
+		aggregateRecord("click", 1),
+	} {
+		if err := aggregates.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := aggregates.Snapshot()
+	want := map[string]ActionAggregate{
+		"purchase":            {Count: 2, ValueSum: 15.5},
+		"view":                {Count: 1},
+		aggregatesOtherAction: {Count: 1, ValueSum: 1},
+	}
+	for action, agg := range want {
+		if snapshot.Actions[action] != agg {
+			t.Errorf("%s: %+v, want %+v", action, snapshot.Actions[action], agg)
+		}
+	}
+	if len(snapshot.Actions) != len(want) || snapshot.Total != (ActionAggregate{Count: 4, ValueSum: 16.5}) {
+		t.Errorf("snapshot %+v, want %v with a total of 4 events worth 16.5", snapshot, want)
+	}
+	if snapshot.WindowMs != window.Milliseconds() {
+		t.Errorf("window %dms, want %dms", snapshot.WindowMs, window.Milliseconds())
+	}
+
+	// Once the window has moved past them the events no longer count, and
+	// a newer event is counted alone
+	time.Sleep(window + bucket)
+	aggregates.Write(aggregateRecord("view", 2))
+	snapshot = aggregates.Snapshot()
+	if len(snapshot.Actions) != 1 || snapshot.Total != (ActionAggregate{Count: 1, ValueSum: 2}) {
+		t.Errorf("after the window passed: %+v, want only the new view", snapshot)
+	}
+}
+
+func TestHandleAggregates(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleAggregates(nil)(w, httptest.NewRequest(http.MethodGet, "/aggregates", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET /aggregates without the sink answered %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	cfg := &Config{}
+	cfg.Consumer.Sink.Type = "aggregates"
+	cfg.Consumer.Sink.Aggregates.BucketMs = DefaultAggregatesBucketMs
+	cfg.Consumer.Sink.Aggregates.WindowMs = DefaultAggregatesWindowMs
+	cfg.Consumer.Sink.Aggregates.MaxActions = DefaultAggregatesMaxActions
+	aggregates := NewRollingAggregates(cfg)
+	aggregates.Write(aggregateRecord("purchase", 10))
+
+	w = httptest.NewRecorder()
+	handleAggregates(aggregates)(w, httptest.NewRequest(http.MethodGet, "/aggregates", nil))
+	var snapshot AggregatesSnapshot
+	if err := json.NewDecoder(w.Body).Decode(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Actions["purchase"] != (ActionAggregate{Count: 1, ValueSum: 10}) {
+		t.Errorf("GET /aggregates returned %+v, want the purchase", snapshot)
+	}
+
+	if NewRollingAggregates(&Config{}) != nil {
+		t.Error("NewRollingAggregates() without an aggregates sink returned a store")
+	}
+}
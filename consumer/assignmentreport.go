@@ -0,0 +1,386 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Strategies compared by the assignment-report command
+const (
+	StrategyKCL            = "kcl"
+	StrategyConsistentHash = "consistent_hash"
+)
+
+// ringPoint is one virtual node of a worker on the hash ring
+type ringPoint struct {
+	hash   uint64
+	worker string
+}
+
+// ringHash places a name on the ring. MD5 spreads similar names like
+// worker-1#0 and worker-1#1 far better than a fast non-cryptographic hash.
+func ringHash(name string) uint64 {
+	sum := md5.Sum([]byte(name))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// ringAssignment is a manual assignment by consistent hashing: every worker
+// owns virtualNodes points on a 64-bit ring and a shard goes to the worker
+// owning the first point at or after the shard's hash. A worker joining or
+// leaving only moves the shards next to its own points, which is what keeps
+// the churn of a static assigned_shards rollout low.
+func ringAssignment(shards, workers []string, virtualNodes int) map[string]string {
+	var ring []ringPoint
+	for _, worker := range workers {
+		for i := 0; i < virtualNodes; i++ {
+			ring = append(ring, ringPoint{hash: ringHash(fmt.Sprintf("%s#%d", worker, i)), worker: worker})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	owners := make(map[string]string, len(shards))
+	for _, shardID := range shards {
+		owners[shardID] = ""
+		if len(ring) == 0 {
+			continue
+		}
+		h := ringHash(shardID)
+		i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+		owners[shardID] = ring[i%len(ring)].worker
+	}
+	return owners
+}
+
+// AssignmentReport is the side-by-side comparison written by the
+// assignment-report command
+type AssignmentReport struct {
+	Shards            int              `json:"shards"`
+	Workers           int              `json:"workers"`
+	ShardRPS          []float64        `json:"shard_rps"`
+	WorkerCapacityRPS float64          `json:"worker_capacity_rps"` // 0 is unlimited
+	HorizonMs         int64            `json:"horizon_ms"`
+	Strategies        []StrategyReport `json:"strategies"`
+}
+
+// StrategyReport is how one assignment strategy handles each scenario
+type StrategyReport struct {
+	Strategy  string           `json:"strategy"`
+	Scenarios []ScenarioReport `json:"scenarios"`
+}
+
+// ScenarioReport is the assignment a strategy settles on after a membership
+// change, how even it is, how much it churned and the lag it predicts
+type ScenarioReport struct {
+	Scenario       string              `json:"scenario"`
+	Workers        int                 `json:"workers"`
+	Assignment     map[string][]string `json:"assignment"`
+	WorkerRPS      map[string]float64  `json:"worker_rps"`
+	Unowned        []string            `json:"unowned,omitempty"`
+	MinShards      int                 `json:"min_shards"`
+	MaxShards      int                 `json:"max_shards"`
+	StdDevShards   float64             `json:"stddev_shards"`
+	Imbalance      float64             `json:"imbalance"` // busiest worker's load over the mean, 1 is perfectly even
+	LeasesMoved    int                 `json:"leases_moved"`
+	Rounds         int                 `json:"rounds,omitempty"` // kcl: shard-sync rounds until the leases settled
+	HandoverMs     int64               `json:"handover_ms"`
+	PredictedLagMs int64               `json:"predicted_lag_ms"`
+}
+
+// reportModel is the load and timing the predicted lag is computed from
+type reportModel struct {
+	shards     []string
+	shardRPS   map[string]float64
+	capacity   float64       // records/sec one worker drains, 0 for unlimited
+	horizon    time.Duration // how long the load runs after the change
+	shardSync  time.Duration // kcl: time per shard-sync round
+	restart    time.Duration // consistent_hash: time to roll out new assigned_shards
+	maxRounds  int
+	vnodes     int
+	seed       int64
+	maxLeases  int
+	leaseSteal bool
+}
+
+// scenario builds the report of an assignment, given the owners before the
+// change. The predicted lag is the worst of any worker: a worker that gained
+// shards leaves them unread for the handover, and a worker whose load
+// exceeds its capacity falls behind by horizon * (1 - capacity/load), the age
+// of the records it reaches at the end of the horizon. Unowned shards are
+// never read, so they lag by the whole horizon.
+func (m *reportModel) scenario(name string, workers []string, before, after map[string]string, handover time.Duration) ScenarioReport {
+	report := ScenarioReport{
+		Scenario:   name,
+		Workers:    len(workers),
+		Assignment: make(map[string][]string, len(workers)),
+		WorkerRPS:  make(map[string]float64, len(workers)),
+		HandoverMs: handover.Milliseconds(),
+	}
+	gained := make(map[string]bool)
+	for _, shardID := range m.shards {
+		owner := after[shardID]
+		if owner == "" {
+			report.Unowned = append(report.Unowned, shardID)
+			continue
+		}
+		report.Assignment[owner] = append(report.Assignment[owner], shardID)
+		report.WorkerRPS[owner] += m.shardRPS[shardID]
+		if before[shardID] != owner {
+			gained[owner] = true
+			if before[shardID] != "" {
+				report.LeasesMoved++
+			}
+		}
+	}
+
+	var lag time.Duration
+	if len(report.Unowned) > 0 {
+		lag = m.horizon
+	}
+	counts := make([]float64, 0, len(workers))
+	totalRPS, maxRPS := 0.0, 0.0
+	report.MinShards = math.MaxInt
+	for _, worker := range workers {
+		count := len(report.Assignment[worker])
+		counts = append(counts, float64(count))
+		report.MinShards = min(report.MinShards, count)
+		report.MaxShards = max(report.MaxShards, count)
+
+		load := report.WorkerRPS[worker]
+		totalRPS += load
+		maxRPS = max(maxRPS, load)
+		var workerLag time.Duration
+		if gained[worker] {
+			workerLag = handover
+		}
+		if m.capacity > 0 && load > m.capacity {
+			workerLag += time.Duration(float64(m.horizon) * (1 - m.capacity/load))
+		}
+		lag = max(lag, workerLag)
+	}
+	if len(workers) == 0 {
+		report.MinShards = 0
+	}
+	report.StdDevShards = stdDev(counts)
+	if totalRPS > 0 {
+		report.Imbalance = maxRPS / (totalRPS / float64(len(workers)))
+	}
+	report.PredictedLagMs = lag.Milliseconds()
+	return report
+}
+
+func stdDev(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	mean := 0.0
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(variance / float64(len(values)))
+}
+
+func copyOwners(owners map[string]string) map[string]string {
+	copied := make(map[string]string, len(owners))
+	for shardID, owner := range owners {
+		copied[shardID] = owner
+	}
+	return copied
+}
+
+func workerNames(n int) []string {
+	workers := make([]string, n)
+	for i := range workers {
+		workers[i] = fmt.Sprintf("worker-%d", i+1)
+	}
+	return workers
+}
+
+// kclStrategy runs the scenarios on the KCL lease simulation. Leases move one
+// shard-sync round at a time, so the handover is the rounds it takes to settle.
+func (m *reportModel) kclStrategy(numWorkers int) StrategyReport {
+	strategy := StrategyReport{Strategy: StrategyKCL}
+	run := func(name string, sim *simulation, change func(*simulation)) {
+		before := copyOwners(sim.owners)
+		rounds, _ := sim.apply(change, m.maxRounds)
+		// The last two rounds of a converged simulation changed nothing
+		handover := time.Duration(max(rounds-2, 0)) * m.shardSync
+		report := m.scenario(name, sim.workers, before, sim.owners, handover)
+		report.Rounds = rounds
+		strategy.Scenarios = append(strategy.Scenarios, report)
+	}
+
+	// The simulation names its shards the way m.shards does
+	base := newSimulation(len(m.shards), m.maxLeases, m.leaseSteal, m.seed)
+	run("initial assignment", base, func(sim *simulation) {
+		for _, worker := range workerNames(numWorkers) {
+			sim.addWorker(worker)
+		}
+	})
+	joiner := fmt.Sprintf("worker-%d", numWorkers+1)
+	run(joiner+" joins", base.clone(m.seed+1), func(sim *simulation) {
+		sim.addWorker(joiner)
+	})
+	if numWorkers > 1 {
+		run("worker-1 leaves", base.clone(m.seed+2), func(sim *simulation) {
+			sim.removeWorker("worker-1")
+		})
+	}
+	return strategy
+}
+
+// consistentHashStrategy runs the scenarios on a consistent-hashing manual
+// assignment. Every change is a rollout of new assigned_shards, so the
+// handover is the restart time.
+func (m *reportModel) consistentHashStrategy(numWorkers int) StrategyReport {
+	strategy := StrategyReport{Strategy: StrategyConsistentHash}
+	unowned := ringAssignment(m.shards, nil, m.vnodes)
+	workers := workerNames(numWorkers)
+	initial := ringAssignment(m.shards, workers, m.vnodes)
+	strategy.Scenarios = append(strategy.Scenarios, m.scenario("initial assignment", workers, unowned, initial, m.restart))
+
+	joined := append(workerNames(numWorkers), fmt.Sprintf("worker-%d", numWorkers+1))
+	strategy.Scenarios = append(strategy.Scenarios,
+		m.scenario(joined[numWorkers]+" joins", joined, initial, ringAssignment(m.shards, joined, m.vnodes), m.restart))
+
+	if numWorkers > 1 {
+		left := workers[1:]
+		strategy.Scenarios = append(strategy.Scenarios,
+			m.scenario("worker-1 leaves", left, initial, ringAssignment(m.shards, left, m.vnodes), m.restart))
+	}
+	return strategy
+}
+
+// parseShardRPS reads -shard-rps: a single rate for every shard, or one per shard
+func parseShardRPS(value string, shards []string) (map[string]float64, []float64, error) {
+	var rates []float64
+	for _, field := range strings.Split(value, ",") {
+		rate, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || rate < 0 {
+			return nil, nil, fmt.Errorf("invalid -shard-rps value: %q", field)
+		}
+		rates = append(rates, rate)
+	}
+	if len(rates) == 1 {
+		for len(rates) < len(shards) {
+			rates = append(rates, rates[0])
+		}
+	}
+	if len(rates) != len(shards) {
+		return nil, nil, fmt.Errorf("-shard-rps has %d rates for %d shards. Must be one rate or one per shard", len(rates), len(shards))
+	}
+	byShard := make(map[string]float64, len(shards))
+	for i, shardID := range shards {
+		byShard[shardID] = rates[i]
+	}
+	return byShard, rates, nil
+}
+
+// printAssignmentReport prints the summary table of the report
+func printAssignmentReport(report *AssignmentReport) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STRATEGY\tSCENARIO\tWORKERS\tSHARDS/WORKER\tSTDDEV\tIMBALANCE\tMOVED\tHANDOVER\tPREDICTED LAG")
+	for _, strategy := range report.Strategies {
+		for _, s := range strategy.Scenarios {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d-%d\t%.2f\t%.2f\t%d\t%v\t%v\n",
+				strategy.Strategy, s.Scenario, s.Workers, s.MinShards, s.MaxShards, s.StdDevShards, s.Imbalance,
+				s.LeasesMoved, time.Duration(s.HandoverMs)*time.Millisecond, time.Duration(s.PredictedLagMs)*time.Millisecond)
+		}
+	}
+	return w.Flush()
+}
+
+// runAssignmentReportCommand compares KCL lease assignment with a manual
+// consistent-hashing assignment for the same shards, workers and load: how
+// evenly each spreads the shards, how many move when a worker joins or
+// leaves, and the lag each predicts. The table is printed and the full
+// report, with every assignment, is written as JSON to -out.
+func runAssignmentReportCommand(args []string) error {
+	fs := flag.NewFlagSet("assignment-report", flag.ContinueOnError)
+	numShards := fs.Int("shards", 4, "number of shards in the stream")
+	numWorkers := fs.Int("workers", 2, "number of workers initially running")
+	maxLeases := fs.Int("max-leases", 0, "kcl: maximum leases per worker (0 for unlimited)")
+	leaseStealing := fs.Bool("lease-stealing", true, "kcl: model lease stealing")
+	seed := fs.Int64("seed", 1, "kcl: random seed for worker ordering and stolen shard choice")
+	maxRounds := fs.Int("rounds", 1000, "kcl: maximum shard-sync rounds per scenario")
+	shardSyncMs := fs.Int("shard-sync-ms", 60000, "kcl: shard-sync interval, the time one round takes")
+	virtualNodes := fs.Int("virtual-nodes", 100, "consistent_hash: points per worker on the hash ring")
+	restartMs := fs.Int("restart-ms", 30000, "consistent_hash: time to roll out new assigned_shards to the workers")
+	shardRPS := fs.String("shard-rps", "100", "records/sec per shard: one rate for all, or comma-separated per shard")
+	capacity := fs.Float64("worker-capacity-rps", 0, "records/sec one worker drains (0 for unlimited)")
+	horizonMs := fs.Int("horizon-ms", 60000, "how long the load runs after each change, for the predicted lag")
+	out := fs.String("out", "assignment-report.json", "file the JSON report is written to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *numShards <= 0 || *numWorkers <= 0 {
+		return fmt.Errorf("-shards and -workers must be positive")
+	}
+	if *virtualNodes <= 0 {
+		return fmt.Errorf("-virtual-nodes must be positive")
+	}
+	if *maxLeases <= 0 {
+		*maxLeases = *numShards
+	}
+
+	shards := make([]string, *numShards)
+	for i := range shards {
+		shards[i] = fmt.Sprintf("shardId-%012d", i)
+	}
+	byShard, rates, err := parseShardRPS(*shardRPS, shards)
+	if err != nil {
+		return err
+	}
+
+	model := &reportModel{
+		shards:     shards,
+		shardRPS:   byShard,
+		capacity:   *capacity,
+		horizon:    time.Duration(*horizonMs) * time.Millisecond,
+		shardSync:  time.Duration(*shardSyncMs) * time.Millisecond,
+		restart:    time.Duration(*restartMs) * time.Millisecond,
+		maxRounds:  *maxRounds,
+		vnodes:     *virtualNodes,
+		seed:       *seed,
+		maxLeases:  *maxLeases,
+		leaseSteal: *leaseStealing,
+	}
+	report := &AssignmentReport{
+		Shards:            *numShards,
+		Workers:           *numWorkers,
+		ShardRPS:          rates,
+		WorkerCapacityRPS: *capacity,
+		HorizonMs:         model.horizon.Milliseconds(),
+		Strategies: []StrategyReport{
+			model.kclStrategy(*numWorkers),
+			model.consistentHashStrategy(*numWorkers),
+		},
+	}
+
+	if err := printAssignmentReport(report); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	fmt.Printf("\nReport written to %s\n", *out)
+	return nil
+}
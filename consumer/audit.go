@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit outcomes of a record
+const (
+	AuditOutcomeOK      = "ok"
+	AuditOutcomeError   = "error"
+	AuditOutcomeSkipped = "skipped"
+	AuditOutcomeDLQ     = "dlq"
+)
+
+// consumer.audit.when_full values
+const (
+	AuditWhenFullDrop  = "drop"
+	AuditWhenFullBlock = "block"
+)
+
+// Defaults for consumer.audit
+const (
+	DefaultAuditMaxFileMB = 100
+	DefaultAuditBuffer    = 10000
+)
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Stream         string    `json:"stream,omitempty"`
+	ShardID        string    `json:"shard_id"`
+	SequenceNumber string    `json:"sequence_number"`
+	EventID        string    `json:"event_id"`
+	Outcome        string    `json:"outcome"`
+	Error          string    `json:"error,omitempty"`
+	At             time.Time `json:"at"`
+}
+
+// auditStore is the audit file shared by every stream in the process
+type auditStore struct {
+	path     string
+	maxBytes int64
+	block    bool
+
+	// closeMu guards entries against sends after Close
+	closeMu sync.RWMutex
+	closed  bool
+	entries chan *AuditEntry
+	done    chan struct{}
+
+	mu       sync.Mutex
+	inFlight map[*SinkRecord]bool // records being handled; true once dead-lettered
+	dropped  int
+
+	// Owned by the writer goroutine
+	file    *os.File
+	writer  *bufio.Writer
+	written int64
+}
+
+// AuditLog writes the outcome of every handled record as a JSON line to
+// consumer.audit.path, as a processing trail independent of the sink. The
+// file is rotated to a timestamped name once it reaches max_file_mb.
+//
+// Entries are queued for a background writer so the record path never waits
+// on the file. When the queue is full, when_full "drop" drops the entry and
+// counts it, and "block" holds the shard until there is room.
+//
+// A record dead-lettered by the consumer.sink.errors policy while its handler
+// runs is recorded once, as dlq. A buffering sink may dead-letter it after
+// the handler returned, in which case a dlq entry follows its ok entry. Like
+// Metrics, each stream writes through its own view from ForStream. A nil
+// *AuditLog is valid and records nothing.
+type AuditLog struct {
+	stream string
+	store  *auditStore
+}
+
+// NewAuditLog opens the audit log for consumer.audit, or returns nil when it
+// is disabled
+func NewAuditLog(cfg *Config) (*AuditLog, error) {
+	auditCfg := cfg.Consumer.Audit
+	if auditCfg.Path == "" {
+		return nil, nil
+	}
+	switch auditCfg.WhenFull {
+	case AuditWhenFullDrop, AuditWhenFullBlock:
+	default:
+		return nil, fmt.Errorf("invalid audit when_full: %s. Must be '%s' or '%s'", auditCfg.WhenFull, AuditWhenFullDrop, AuditWhenFullBlock)
+	}
+
+	store := &auditStore{
+		path:     auditCfg.Path,
+		maxBytes: int64(auditCfg.MaxFileMB) << 20,
+		block:    auditCfg.WhenFull == AuditWhenFullBlock,
+		entries:  make(chan *AuditEntry, auditCfg.Buffer),
+		done:     make(chan struct{}),
+		inFlight: make(map[*SinkRecord]bool),
+	}
+	if err := store.open(); err != nil {
+		return nil, err
+	}
+	go store.run()
+	log.Printf("Audit log writing to %s (rotating at %d MB, %s when %d entries are queued)",
+		auditCfg.Path, auditCfg.MaxFileMB, auditCfg.WhenFull, auditCfg.Buffer)
+	return &AuditLog{store: store}, nil
+}
+
+// ForStream returns a view that writes into the same log, labelled with the stream
+func (a *AuditLog) ForStream(stream string) *AuditLog {
+	if a == nil {
+		return nil
+	}
+	return &AuditLog{stream: stream, store: a.store}
+}
+
+// Start marks a record as being handled, so a dead-letter during the
+// handler becomes its outcome
+func (a *AuditLog) Start(record *SinkRecord) {
+	if a == nil {
+		return
+	}
+	a.store.mu.Lock()
+	a.store.inFlight[record] = false
+	a.store.mu.Unlock()
+}
+
+// Handled records the outcome of the handler for a record. A timed-out
+// record is skipped by the consumer, so it is recorded as skipped.
+func (a *AuditLog) Handled(record *SinkRecord, err error) {
+	if a == nil {
+		return
+	}
+	a.store.mu.Lock()
+	deadLettered := a.store.inFlight[record]
+	delete(a.store.inFlight, record)
+	a.store.mu.Unlock()
+
+	switch {
+	case deadLettered:
+		// Recorded by DeadLettered already
+	case err == ErrHandlerTimeout:
+		a.record(record, AuditOutcomeSkipped, err)
+	case err != nil:
+		a.record(record, AuditOutcomeError, err)
+	default:
+		a.record(record, AuditOutcomeOK, nil)
+	}
+}
+
+// Skipped records a record the consumer did not hand to the handler
+func (a *AuditLog) Skipped(record *SinkRecord, reason error) {
+	a.record(record, AuditOutcomeSkipped, reason)
+}
+
+// DeadLettered records a record the sink error policy or a handler timeout
+// wrote to a dead-letter file
+func (a *AuditLog) DeadLettered(record *SinkRecord, err error) {
+	if a == nil {
+		return
+	}
+	a.store.mu.Lock()
+	if _, ok := a.store.inFlight[record]; ok {
+		a.store.inFlight[record] = true
+	}
+	a.store.mu.Unlock()
+	a.record(record, AuditOutcomeDLQ, err)
+}
+
+// record queues an entry for the writer
+func (a *AuditLog) record(record *SinkRecord, outcome string, err error) {
+	if a == nil {
+		return
+	}
+	entry := &AuditEntry{
+		Stream:         a.stream,
+		ShardID:        record.ShardID,
+		SequenceNumber: record.SequenceNumber,
+		EventID:        record.Event.EventID,
+		Outcome:        outcome,
+		At:             time.Now().UTC(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	s := a.store
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if s.closed {
+		// A timed-out handler finishing after shutdown
+		return
+	}
+	if s.block {
+		s.entries <- entry
+		return
+	}
+	select {
+	case s.entries <- entry:
+	default:
+		s.mu.Lock()
+		s.dropped++
+		first := s.dropped == 1
+		s.mu.Unlock()
+		if first {
+			log.Printf("WARNING: audit log queue is full, dropping entries")
+		}
+	}
+}
+
+// Close writes the queued entries and closes the file
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	s := a.store
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.entries)
+	s.closeMu.Unlock()
+	<-s.done
+
+	if s.dropped > 0 {
+		log.Printf("Audit log dropped %d entries while its queue was full", s.dropped)
+	}
+	if err := s.writer.Flush(); err != nil {
+		s.file.Close()
+		return fmt.Errorf("failed to flush audit log: %w", err)
+	}
+	return s.file.Close()
+}
+
+// open opens the audit file for appending
+func (s *auditStore) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %s: %w", s.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log %s: %w", s.path, err)
+	}
+	s.file = file
+	s.writer = bufio.NewWriter(file)
+	s.written = info.Size()
+	return nil
+}
+
+// run writes queued entries until the queue is closed, flushing whenever it
+// runs empty
+func (s *auditStore) run() {
+	defer close(s.done)
+	for entry := range s.entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			log.Printf("Failed to encode audit entry: %v", err)
+			continue
+		}
+		if s.maxBytes > 0 && s.written > 0 && s.written+int64(len(data))+1 > s.maxBytes {
+			if err := s.rotate(); err != nil {
+				log.Printf("Failed to rotate audit log: %v", err)
+			}
+		}
+		s.writer.Write(append(data, '\n'))
+		s.written += int64(len(data)) + 1
+		if len(s.entries) == 0 {
+			if err := s.writer.Flush(); err != nil {
+				log.Printf("Failed to write audit log: %v", err)
+			}
+		}
+	}
+}
+
+// rotate renames the full file aside with a timestamp and starts a new one
+func (s *auditStore) rotate() error {
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", s.path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(s.path, rotated); err != nil {
+		// Keep appending to the same file rather than losing entries
+		log.Printf("Failed to rename audit log to %s: %v", rotated, err)
+	}
+	return s.open()
+}
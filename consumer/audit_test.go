@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// readAuditLog returns the outcomes recorded for each event ID, in order
+func readAuditLog(t *testing.T, path string) map[string][]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	outcomes := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("audit line %q: %v", scanner.Text(), err)
+		}
+		if entry.ShardID != testShard || entry.Stream != testStream || entry.At.IsZero() {
+			t.Errorf("audit entry %+v, want the shard, stream and time recorded", entry)
+		}
+		outcomes[entry.EventID] = append(outcomes[entry.EventID], entry.Outcome)
+	}
+	return outcomes
+}
+
+func TestAuditLogOutcomes(t *testing.T) {
+	tests := []struct {
+		name      string
+		handler   EventHandlerFunc
+		dlq       bool // a permanent sink error is dead-lettered
+		timeoutMs int
+		deliver   int // times the record is delivered, with idempotency claims
+		want      []string
+	}{
+		{
+			name:    "ok",
+			handler: func(ctx context.Context, record *SinkRecord) error { return nil },
+			want:    []string{AuditOutcomeOK},
+		},
+		{
+			name:    "error",
+			handler: func(ctx context.Context, record *SinkRecord) error { return errors.New("sink down") },
+			want:    []string{AuditOutcomeError},
+		},
+		{
+			name:    "dead-lettered",
+			handler: func(ctx context.Context, record *SinkRecord) error { return httpError(400) },
+			dlq:     true,
+			want:    []string{AuditOutcomeDLQ},
+		},
+		{
+			name: "timed out",
+			handler: func(ctx context.Context, record *SinkRecord) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			timeoutMs: 5,
+			want:      []string{AuditOutcomeSkipped},
+		},
+		{
+			name:    "duplicate",
+			handler: func(ctx context.Context, record *SinkRecord) error { return nil },
+			deliver: 2,
+			want:    []string{AuditOutcomeOK, AuditOutcomeSkipped},
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	cfg := &Config{}
+	cfg.Consumer.Audit.Path = path
+	cfg.Consumer.Audit.Buffer = 100
+	cfg.Consumer.Audit.WhenFull = AuditWhenFullBlock
+	audit, err := NewAuditLog(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		cfg := &Config{}
+		cfg.Consumer.HandlerTimeoutMs = tt.timeoutMs
+		pc := &ProcessorContext{Config: cfg, Audit: audit.ForStream(testStream)}
+		var handler EventHandler = tt.handler
+		if tt.dlq {
+			cfg.Consumer.Sink.Errors.Transient = SinkErrorActionRetry
+			cfg.Consumer.Sink.Errors.Permanent = SinkErrorActionDLQ
+			cfg.Consumer.Sink.Errors.DLQPath = filepath.Join(t.TempDir(), "dlq.jsonl")
+			policy, err := NewSinkErrorPolicy(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer policy.Close()
+			handler = newEventHandler(policy.Wrap(&flakySink{errs: []error{httpError(400)}}, func(error) {}, pc.Audit))
+		}
+		deliveries := 1
+		if tt.deliver > 0 {
+			pc.Idempotency = newIdempotencyStore(&fakeIdempotencyTable{rows: make(map[string]bool)}, "idempotency", time.Hour, shardLabeler{})
+			deliveries = tt.deliver
+		}
+
+		record := &SinkRecord{ShardID: testShard, SequenceNumber: "1", Event: Event{EventID: tt.name}}
+		for range deliveries {
+			pc.HandleRecord(handler, record)
+		}
+	}
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	outcomes := readAuditLog(t, path)
+	for _, tt := range tests {
+		if !slices.Equal(outcomes[tt.name], tt.want) {
+			t.Errorf("%s recorded %v, want %v", tt.name, outcomes[tt.name], tt.want)
+		}
+	}
+}
+
+func TestAuditLogWhenFull(t *testing.T) {
+	cfg := &Config{}
+	cfg.Consumer.Audit.Path = filepath.Join(t.TempDir(), "audit.jsonl")
+	cfg.Consumer.Audit.WhenFull = AuditWhenFullDrop
+	audit, err := NewAuditLog(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With no room in the queue, entries are dropped rather than waited on
+	done := make(chan struct{})
+	go func() {
+		for i := range 100 {
+			audit.Skipped(&SinkRecord{ShardID: testShard, Event: Event{EventID: string(rune('a' + i%26))}}, ErrDuplicateEvent)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recording blocked on a full queue with when_full drop")
+	}
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Consumer.Audit.WhenFull = "wait"
+	if _, err := NewAuditLog(cfg); err == nil {
+		t.Error("NewAuditLog() accepted an unknown when_full")
+	}
+}
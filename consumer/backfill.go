@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// Backfill start positions
+const (
+	BackfillStartBoundary    = "boundary"
+	BackfillStartTrimHorizon = "TRIM_HORIZON"
+	BackfillStartLatest      = "LATEST"
+)
+
+// DefaultBackfillOverlapMs covers clock skew between event timestamps and
+// Kinesis arrival times at the handoff from S3 to the stream
+const DefaultBackfillOverlapMs = 60000
+
+// backfillShardID stands in for the shard ID of records read from S3
+const backfillShardID = "backfill"
+
+// maxBackfillLineBytes bounds a single JSON line in a backfill object
+const maxBackfillLineBytes = 1 << 20
+
+// Backfill is the outcome of reading historical events from S3. It decides
+// where tailing the stream starts and which stream events were already
+// handled, so nothing is processed twice at the handoff. A nil *Backfill is
+// valid and covers nothing.
+type Backfill struct {
+	startPosition string
+	boundary      time.Time           // timestamp of the newest backfilled event
+	cutoff        time.Time           // events before this are covered by the backfill
+	seen          map[string]struct{} // IDs of backfilled events at or after cutoff
+	events        int
+}
+
+// Covers reports whether the event was already handled by the backfill:
+// either it is older than the overlap window, which S3 is authoritative for,
+// or its ID was read from S3 inside the overlap window.
+func (b *Backfill) Covers(event Event) bool {
+	if b == nil || b.boundary.IsZero() {
+		return false
+	}
+	if event.Timestamp.Before(b.cutoff) {
+		return true
+	}
+	_, ok := b.seen[event.EventID]
+	return ok
+}
+
+// startTimestamp returns the time tailing should start from, or nil when the
+// stream is read from the configured iterator type instead
+func (b *Backfill) startTimestamp() *time.Time {
+	if b == nil || b.startPosition != BackfillStartBoundary || b.boundary.IsZero() {
+		return nil
+	}
+	cutoff := b.cutoff
+	return &cutoff
+}
+
+// shardIteratorType returns the iterator type tailing starts with in manual mode
+func (b *Backfill) shardIteratorType() string {
+	switch {
+	case b == nil:
+		return kinesis.ShardIteratorTypeTrimHorizon
+	case b.startTimestamp() != nil:
+		return kinesis.ShardIteratorTypeAtTimestamp
+	case b.startPosition == BackfillStartLatest:
+		return kinesis.ShardIteratorTypeLatest
+	default:
+		return kinesis.ShardIteratorTypeTrimHorizon
+	}
+}
+
+// validateBackfill checks consumer.backfill before anything is read
+func validateBackfill(cfg *Config) error {
+	switch cfg.Consumer.Backfill.StartPosition {
+	case BackfillStartBoundary, BackfillStartTrimHorizon, BackfillStartLatest:
+		return nil
+	default:
+		return fmt.Errorf("invalid consumer.backfill.start_position: %s. Must be '%s', '%s' or '%s'",
+			cfg.Consumer.Backfill.StartPosition, BackfillStartBoundary, BackfillStartTrimHorizon, BackfillStartLatest)
+	}
+}
+
+// runBackfill reads every object under consumer.backfill.prefix in key order
+// and passes each event through the handler before the stream is tailed. It
+// returns nil when no backfill is configured.
+func runBackfill(cfg *Config, aggregates *RollingAggregates) (*Backfill, error) {
+	backfillCfg := cfg.Consumer.Backfill
+	if backfillCfg.Bucket == "" {
+		return nil, nil
+	}
+	if err := validateBackfill(cfg); err != nil {
+		return nil, err
+	}
+
+	sess, err := newAWSSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// Path-style addressing keeps LocalStack endpoints working
+	client := s3.New(sess, &aws.Config{S3ForcePathStyle: aws.Bool(true)})
+
+	sink, err := newSink(cfg, aggregates)
+	if err != nil {
+		return nil, err
+	}
+	if sink != nil {
+		defer sink.Close()
+	}
+	return backfillFrom(client, cfg, sink)
+}
+
+// backfillFrom handles the events of every object under
+// consumer.backfill.prefix with sink and returns where the stream takes over
+func backfillFrom(client s3iface.S3API, cfg *Config, sink Sink) (*Backfill, error) {
+	backfillCfg := cfg.Consumer.Backfill
+	log.Printf("Backfilling from s3://%s/%s", backfillCfg.Bucket, backfillCfg.Prefix)
+	start := time.Now()
+
+	fields, err := NewFieldMapping(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &backfillReader{
+		pc:      &ProcessorContext{Config: cfg, Fields: fields},
+		handler: newEventHandler(sink),
+		seen:    make(map[string]time.Time),
+	}
+	var readErr error
+	err = client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(backfillCfg.Bucket),
+		Prefix: aws.String(backfillCfg.Prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if readErr = reader.readObject(client, backfillCfg.Bucket, aws.StringValue(object.Key)); readErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("backfill from s3://%s/%s failed: %w", backfillCfg.Bucket, backfillCfg.Prefix, err)
+	}
+
+	backfill := reader.result(backfillCfg.StartPosition, time.Duration(backfillCfg.OverlapMs)*time.Millisecond)
+	log.Printf("Backfill finished: %d events from %d objects in %.2f seconds, %d unreadable lines",
+		backfill.events, reader.objects, time.Since(start).Seconds(), reader.failed)
+	if !backfill.boundary.IsZero() {
+		log.Printf("Backfill boundary %s, stream events before %s are skipped",
+			backfill.boundary.Format(time.RFC3339Nano), backfill.cutoff.Format(time.RFC3339Nano))
+	}
+	return backfill, nil
+}
+
+// backfillReader accumulates the state of a backfill while objects are read
+type backfillReader struct {
+	pc       *ProcessorContext
+	handler  EventHandler
+	seen     map[string]time.Time
+	boundary time.Time
+	events   int
+	objects  int
+	failed   int
+}
+
+// readObject handles every event in one JSON-lines object, gunzipping keys ending in .gz
+func (r *backfillReader) readObject(client s3iface.S3API, bucket, key string) error {
+	output, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	defer output.Body.Close()
+
+	var body io.Reader = output.Body
+	if strings.HasSuffix(key, ".gz") {
+		gz, err := gzip.NewReader(output.Body)
+		if err != nil {
+			return fmt.Errorf("failed to decompress %s: %w", key, err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	r.objects++
+	return r.readEvents(fmt.Sprintf("s3://%s/%s", bucket, key), body)
+}
+
+// readEvents handles each line of body as an Event. Lines that do not decode
+// are logged and skipped, matching how undecodable stream records are treated.
+func (r *backfillReader) readEvents(source string, body io.Reader) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBackfillLineBytes)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := scanner.Bytes()
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+
+		var event Event
+		if err := r.pc.Fields.Unmarshal(data, &event); err != nil {
+			r.failed++
+			log.Printf("[%s] Failed to unmarshal %s line %d: %v", backfillShardID, source, line, err)
+			continue
+		}
+
+		r.events++
+		r.seen[event.EventID] = event.Timestamp
+		if event.Timestamp.After(r.boundary) {
+			r.boundary = event.Timestamp
+		}
+
+		record := &SinkRecord{
+			ShardID:        backfillShardID,
+			SequenceNumber: fmt.Sprintf("%s:%d", source, line),
+			PartitionKey:   event.UserID,
+			Event:          event,
+		}
+		if err := r.pc.HandleRecord(r.handler, record); err != nil && err != ErrHandlerTimeout {
+			return fmt.Errorf("failed to handle %s line %d: %w", source, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", source, err)
+	}
+	return nil
+}
+
+// result fixes the handoff point once every object has been read. Only the
+// IDs inside the overlap window are kept; older stream events are skipped by
+// timestamp alone.
+func (r *backfillReader) result(startPosition string, overlap time.Duration) *Backfill {
+	backfill := &Backfill{
+		startPosition: startPosition,
+		boundary:      r.boundary,
+		cutoff:        r.boundary.Add(-overlap),
+		seen:          make(map[string]struct{}),
+		events:        r.events,
+	}
+	for id, timestamp := range r.seen {
+		if !timestamp.Before(backfill.cutoff) {
+			backfill.seen[id] = struct{}{}
+		}
+	}
+	return backfill
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeS3 serves the objects of a single bucket from memory
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	// One object per page, so paging is exercised too
+	for i, key := range keys {
+		page := &s3.ListObjectsV2Output{Contents: []*s3.Object{{Key: aws.String(key)}}}
+		if !fn(page, i == len(keys)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(f.objects[aws.StringValue(input.Key)]))}, nil
+}
+
+// eventIDSink records the IDs of the events written to it
+type eventIDSink struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (s *eventIDSink) Write(record *SinkRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids = append(s.ids, record.Event.EventID)
+	return nil
+}
+
+func (s *eventIDSink) Close() error { return nil }
+
+// backfillEvent returns the JSON of an event timestamped age ago
+func backfillEvent(t *testing.T, id string, age time.Duration) []byte {
+	t.Helper()
+	data, err := json.Marshal(Event{Version: 1, EventID: id, Timestamp: time.Now().Add(-age), Action: "view"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestBackfillHandoff(t *testing.T) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(bytes.Join([][]byte{backfillEvent(t, "evt_2", 30*time.Second), backfillEvent(t, "evt_3", 10*time.Second)}, []byte("\n")))
+	gz.Close()
+	objects := map[string][]byte{
+		"events/2024-01-01.json": bytes.Join([][]byte{
+			backfillEvent(t, "evt_0", 10*time.Minute),
+			[]byte("not json"),
+			backfillEvent(t, "evt_1", 5*time.Minute),
+		}, []byte("\n")),
+		"events/2024-01-02.json.gz": gzipped.Bytes(),
+		"other/ignored.json":        backfillEvent(t, "evt_ignored", time.Minute),
+	}
+
+	cfg := &Config{}
+	cfg.Consumer.Backfill.Bucket = "history"
+	cfg.Consumer.Backfill.Prefix = "events/"
+	cfg.Consumer.Backfill.StartPosition = BackfillStartBoundary
+	cfg.Consumer.Backfill.OverlapMs = 60000
+	sink := &eventIDSink{}
+	backfill, err := backfillFrom(&fakeS3{objects: objects}, cfg, sink)
+	if err != nil {
+		t.Fatalf("backfillFrom() = %v", err)
+	}
+
+	// The stream repeats the events of the overlap window and holds one
+	// older than the backfill boundary that S3 is authoritative for
+	client := newFakeKinesis(testStream, testShard)
+	client.AddRecords(t, testShard, "user_1",
+		backfillEvent(t, "evt_old", 2*time.Minute),
+		backfillEvent(t, "evt_2", 30*time.Second),
+		backfillEvent(t, "evt_3", 10*time.Second),
+		backfillEvent(t, "evt_4", 5*time.Second),
+		backfillEvent(t, "evt_5", 0),
+	)
+	client.CloseShard(testShard)
+	msp := newTestProcessor(client, cfg)
+	msp.pc = &ProcessorContext{Config: cfg, Sink: sink, Backfill: backfill}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	msp.ProcessShard(context.Background(), &wg)
+
+	want := "[evt_0 evt_1 evt_2 evt_3 evt_4 evt_5]"
+	if got := fmt.Sprint(sink.ids); got != want {
+		t.Errorf("handled %s, want %s", got, want)
+	}
+	if got := msp.pc.Backfill.shardIteratorType(); got != "AT_TIMESTAMP" {
+		t.Errorf("tailing starts at %s, want AT_TIMESTAMP", got)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultCheckpointIntervalMs is the default of consumer.checkpoint_interval_ms
+const DefaultCheckpointIntervalMs = 5000
+
+// CheckpointFileState is the content of consumer.checkpoint_file
+type CheckpointFileState struct {
+	WorkerID  string                       `json:"worker_id"`
+	WrittenAt time.Time                    `json:"written_at"`
+	Streams   map[string]map[string]string `json:"streams"` // stream name to shard ID to the sequence number of its last processed record
+}
+
+// checkpointFileStore holds the checkpoints of every stream in the process
+type checkpointFileStore struct {
+	path     string
+	workerID string
+	resume   map[ShardKey]string // the checkpoints loaded at startup
+
+	mu     sync.Mutex
+	shards map[ShardKey]string
+	dirty  bool
+
+	cancel func()
+	done   chan struct{}
+}
+
+// CheckpointFile gives manual mode checkpoints: the last processed record of
+// every shard is kept in memory, written to consumer.checkpoint_file every
+// checkpoint_interval_ms and on shutdown, and a restarted consumer
+// resumes every shard right after it. Shards of every stream in the process
+// share the file; each stream records through its own view from ForStream.
+// A nil *CheckpointFile is valid and checkpoints nothing.
+type CheckpointFile struct {
+	stream string
+	store  *checkpointFileStore
+}
+
+// NewCheckpointFile loads consumer.checkpoint_file, if it exists, and starts
+// flushing to it. It returns nil when the file is not set.
+func NewCheckpointFile(cfg *Config) (*CheckpointFile, error) {
+	path := cfg.Consumer.CheckpointFile
+	if path == "" {
+		return nil, nil
+	}
+	if cfg.Consumer.AssignmentMode != "manual" {
+		return nil, fmt.Errorf("consumer.checkpoint_file requires manual assignment_mode, kcl mode checkpoints to its lease table")
+	}
+
+	store := &checkpointFileStore{
+		path:     path,
+		workerID: cfg.Consumer.WorkerID,
+		resume:   make(map[ShardKey]string),
+		shards:   make(map[ShardKey]string),
+		done:     make(chan struct{}),
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		log.Printf("No checkpoint file at %s, shards start at their start position", path)
+	case err != nil:
+		return nil, fmt.Errorf("failed to read checkpoint file: %w", err)
+	default:
+		var state CheckpointFileState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("failed to parse checkpoint file %s: %w", path, err)
+		}
+		for stream, shards := range state.Streams {
+			for shardID, sequenceNumber := range shards {
+				store.resume[ShardKey{Stream: stream, ShardID: shardID}] = sequenceNumber
+				store.shards[ShardKey{Stream: stream, ShardID: shardID}] = sequenceNumber
+			}
+		}
+		log.Printf("Loaded checkpoints of %d shards from %s, written %v by %s",
+			len(store.resume), path, state.WrittenAt.Format(time.RFC3339), state.WorkerID)
+	}
+
+	ticker := time.NewTicker(time.Duration(cfg.Consumer.CheckpointIntervalMs) * time.Millisecond)
+	stop := make(chan struct{})
+	store.cancel = func() { close(stop) }
+	go func() {
+		defer close(store.done)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := store.flush(); err != nil {
+					log.Printf("Failed to write checkpoint file: %v", err)
+				}
+			}
+		}
+	}()
+	return &CheckpointFile{store: store}, nil
+}
+
+// ForStream returns a view that records into the same file, labelled with the stream
+func (c *CheckpointFile) ForStream(stream string) *CheckpointFile {
+	if c == nil {
+		return nil
+	}
+	return &CheckpointFile{stream: stream, store: c.store}
+}
+
+// Resume returns the sequence number the shard was checkpointed at when the
+// consumer started, or "" if it has none
+func (c *CheckpointFile) Resume(shardID string) string {
+	if c == nil {
+		return ""
+	}
+	return c.store.resume[ShardKey{Stream: c.stream, ShardID: shardID}]
+}
+
+// Processed checkpoints the shard at a processed record, to be written on the next flush
+func (c *CheckpointFile) Processed(shardID, sequenceNumber string) {
+	if c == nil || sequenceNumber == "" {
+		return
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	key := ShardKey{Stream: c.stream, ShardID: shardID}
+	if c.store.shards[key] != sequenceNumber {
+		c.store.shards[key] = sequenceNumber
+		c.store.dirty = true
+	}
+}
+
+// Flush writes the checkpoints now rather than on the next tick
+func (c *CheckpointFile) Flush() error {
+	if c == nil {
+		return nil
+	}
+	return c.store.flush()
+}
+
+// flush writes the checkpoints if any changed since the last write. The
+// file is replaced at once, so a crash mid-write leaves the previous one.
+func (s *checkpointFileStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+
+	state := CheckpointFileState{WorkerID: s.workerID, WrittenAt: time.Now().UTC(), Streams: map[string]map[string]string{}}
+	for key, sequenceNumber := range s.shards {
+		if state.Streams[key.Stream] == nil {
+			state.Streams[key.Stream] = map[string]string{}
+		}
+		state.Streams[key.Stream][key.ShardID] = sequenceNumber
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(state); err != nil {
+		return fmt.Errorf("failed to encode checkpoints: %w", err)
+	}
+
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(buf.Bytes())
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Close stops flushing and writes the final checkpoints
+func (c *CheckpointFile) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.store.cancel()
+	<-c.store.done
+	if err := c.store.flush(); err != nil {
+		return err
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	log.Printf("Checkpoints of %d shards saved to %s", len(c.store.shards), c.store.path)
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckpointFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+	cfg := &Config{}
+	cfg.Consumer.AssignmentMode = "manual"
+	cfg.Consumer.CheckpointFile = path
+	cfg.Consumer.CheckpointIntervalMs = 60000
+	cfg.Consumer.WorkerID = "worker-1"
+
+	first, err := NewCheckpointFile(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders, payments := first.ForStream("orders"), first.ForStream("payments")
+	orders.Processed(testShard, "100")
+	orders.Processed(testShard, "200")
+	orders.Processed("shardId-000000000001", "")
+	payments.Processed(testShard, "300")
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := os.Stat(path + ".tmp"); err == nil {
+		t.Error("temporary file left behind")
+	}
+
+	second, err := NewCheckpointFile(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	tests := []struct {
+		stream  string
+		shardID string
+		want    string
+	}{
+		{stream: "orders", shardID: testShard, want: "200"},
+		{stream: "orders", shardID: "shardId-000000000001", want: ""},
+		{stream: "payments", shardID: testShard, want: "300"},
+		{stream: "unknown", shardID: testShard, want: ""},
+	}
+	for _, tt := range tests {
+		if got := second.ForStream(tt.stream).Resume(tt.shardID); got != tt.want {
+			t.Errorf("%s/%s resumes at %q, want %q", tt.stream, tt.shardID, got, tt.want)
+		}
+	}
+
+	// Resume keeps the position loaded at startup as the shard moves on
+	second.ForStream("orders").Processed(testShard, "250")
+	if err := second.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := second.ForStream("orders").Resume(testShard); got != "200" {
+		t.Errorf("resumes at %q after processing, want the loaded 200", got)
+	}
+}
+
+func TestNewCheckpointFile(t *testing.T) {
+	dir := t.TempDir()
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corrupt, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		mode    string
+		path    string
+		wantErr string
+		wantNil bool
+	}{
+		{name: "not set", mode: "manual", wantNil: true},
+		{name: "missing file", mode: "manual", path: filepath.Join(dir, "missing.json")},
+		{name: "kcl mode", mode: "kcl", path: filepath.Join(dir, "missing.json"), wantErr: "requires manual assignment_mode"},
+		{name: "corrupt file", mode: "manual", path: corrupt, wantErr: "failed to parse checkpoint file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.AssignmentMode = tt.mode
+			cfg.Consumer.CheckpointFile = tt.path
+			cfg.Consumer.CheckpointIntervalMs = 60000
+			c, err := NewCheckpointFile(cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("NewCheckpointFile() = %v, want an error with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if (c == nil) != tt.wantNil {
+				t.Errorf("NewCheckpointFile() = %v, want nil %t", c, tt.wantNil)
+			}
+			if c.ForStream(testStream).Resume(testShard) != "" {
+				t.Error("resumes without a checkpoint")
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	chk "github.com/vmware/vmware-go-kcl/clientlibrary/checkpoint"
+)
+
+// ErrNoCheckpointHistory is returned for a shard with no recorded checkpoints
+var ErrNoCheckpointHistory = errors.New("no checkpoints recorded for this shard")
+
+// CheckpointEntry is one checkpoint attempt of a shard
+type CheckpointEntry struct {
+	SequenceNumber string    `json:"sequence_number"` // SHARD_END once the shard was finished
+	At             time.Time `json:"at"`
+	Error          string    `json:"error,omitempty"` // set when the checkpoint failed
+}
+
+// checkpointHistoryStore holds the history of every stream in the process
+type checkpointHistoryStore struct {
+	mu     sync.Mutex
+	size   int
+	shards map[ShardKey][]CheckpointEntry // oldest first, at most size entries
+}
+
+// CheckpointHistory keeps the last consumer.checkpoint_history.size
+// checkpoint attempts of every shard, to explain after the fact why a shard
+// stalled or went back: a rewind shows up as a checkpoint behind the one
+// before it, a stall as a gap in time. Like Metrics, each stream records
+// through its own view from ForStream. A nil *CheckpointHistory is valid and
+// records nothing.
+type CheckpointHistory struct {
+	stream string
+	store  *checkpointHistoryStore
+}
+
+// NewCheckpointHistory returns the history for consumer.checkpoint_history,
+// or nil when it is disabled
+func NewCheckpointHistory(cfg *Config) *CheckpointHistory {
+	size := cfg.Consumer.CheckpointHistory.Size
+	if size <= 0 {
+		return nil
+	}
+	return &CheckpointHistory{store: &checkpointHistoryStore{
+		size:   size,
+		shards: make(map[ShardKey][]CheckpointEntry),
+	}}
+}
+
+// ForStream returns a view that records into the same store, labelled with the stream
+func (h *CheckpointHistory) ForStream(stream string) *CheckpointHistory {
+	if h == nil {
+		return nil
+	}
+	return &CheckpointHistory{stream: stream, store: h.store}
+}
+
+// Record adds a checkpoint attempt of a shard, dropping the oldest entry
+// once the shard has size of them
+func (h *CheckpointHistory) Record(shardID string, sequenceNumber *string, err error) {
+	if h == nil {
+		return
+	}
+	entry := CheckpointEntry{SequenceNumber: chk.ShardEnd, At: time.Now().UTC()}
+	if sequenceNumber != nil {
+		entry.SequenceNumber = *sequenceNumber
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	h.store.mu.Lock()
+	defer h.store.mu.Unlock()
+	key := ShardKey{Stream: h.stream, ShardID: shardID}
+	entries := h.store.shards[key]
+	if len(entries) >= h.store.size {
+		// Copy rather than reslice so the dropped entries can be freed
+		entries = append(make([]CheckpointEntry, 0, h.store.size), entries[len(entries)-h.store.size+1:]...)
+	}
+	h.store.shards[key] = append(entries, entry)
+}
+
+// History returns a copy of the recorded checkpoints of a shard, oldest
+// first. An empty stream matches the shard in any stream.
+func (h *CheckpointHistory) History(stream, shardID string) ([]CheckpointEntry, error) {
+	if h == nil {
+		return nil, ErrNoCheckpointHistory
+	}
+	h.store.mu.Lock()
+	defer h.store.mu.Unlock()
+
+	var found []CheckpointEntry
+	matches := 0
+	for key, entries := range h.store.shards {
+		if key.ShardID == shardID && (stream == "" || key.Stream == stream) {
+			found = entries
+			matches++
+		}
+	}
+	switch matches {
+	case 0:
+		return nil, ErrNoCheckpointHistory
+	case 1:
+		return append([]CheckpointEntry(nil), found...), nil
+	default:
+		return nil, ErrShardAmbiguous
+	}
+}
+
+// Save writes the history of every shard to a JSON file, keyed by stream/shard
+func (h *CheckpointHistory) Save(path string) error {
+	if h == nil || path == "" {
+		return nil
+	}
+	h.store.mu.Lock()
+	byShard := make(map[string][]CheckpointEntry, len(h.store.shards))
+	for key, entries := range h.store.shards {
+		byShard[shardLabel(key)] = entries
+	}
+	data, err := json.MarshalIndent(byShard, "", "  ")
+	h.store.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint history: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write checkpoint history: %w", err)
+	}
+	log.Printf("Checkpoint history of %d shards saved to %s", len(byShard), path)
+	return nil
+}
+
+// handleCheckpointHistory serves GET /checkpoints/{shard}/history[?stream=name]
+func handleCheckpointHistory(history *CheckpointHistory) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		shardID := r.PathValue("shard")
+		entries, err := history.History(r.URL.Query().Get("stream"), shardID)
+		switch {
+		case errors.Is(err, ErrShardAmbiguous):
+			http.Error(w, fmt.Sprintf("%s: %v", shardID, err), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("%s: %v", shardID, err), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	chk "github.com/vmware/vmware-go-kcl/clientlibrary/checkpoint"
+)
+
+func TestCheckpointHistory(t *testing.T) {
+	cfg := &Config{}
+	cfg.Consumer.CheckpointHistory.Size = 3
+	cfg.Consumer.CheckpointRetry.MaxAttempts = 1
+	history := NewCheckpointHistory(cfg)
+	pc := &ProcessorContext{Config: cfg, Metrics: NewMetrics(), History: history.ForStream(testStream)}
+
+	for _, seq := range []string{"100", "200", "300"} {
+		if err := pc.Checkpoint(testShard, &recordingCheckpointer{}, aws.String(seq)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pc.Checkpoint(testShard, failingCheckpointer{}, aws.String("400"))
+	pc.Checkpoint(testShard, &recordingCheckpointer{}, nil)
+
+	// Only the last three are kept, oldest first
+	entries, err := history.History("", testShard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CheckpointEntry{{SequenceNumber: "300"}, {SequenceNumber: "400", Error: "lease table unavailable"}, {SequenceNumber: chk.ShardEnd}}
+	if len(entries) != len(want) {
+		t.Fatalf("history holds %d checkpoints, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, entry := range entries {
+		if entry.SequenceNumber != want[i].SequenceNumber || entry.Error != want[i].Error {
+			t.Errorf("checkpoint %d is %s (error %q), want %s (error %q)", i, entry.SequenceNumber, entry.Error, want[i].SequenceNumber, want[i].Error)
+		}
+		if i > 0 && entry.At.Before(entries[i-1].At) {
+			t.Errorf("checkpoint %d at %v, before the one preceding it at %v", i, entry.At, entries[i-1].At)
+		}
+	}
+
+	// The copy returned is the caller's own
+	entries[0].SequenceNumber = "changed"
+	if again, _ := history.History(testStream, testShard); again[0].SequenceNumber != "300" {
+		t.Error("History() returned the stored entries rather than a copy")
+	}
+
+	if _, err := history.History("", "shardId-000000000009"); err != ErrNoCheckpointHistory {
+		t.Errorf("History() of an unknown shard = %v, want %v", err, ErrNoCheckpointHistory)
+	}
+	history.ForStream("other-stream").Record(testShard, aws.String("1"), nil)
+	if _, err := history.History("", testShard); err != ErrShardAmbiguous {
+		t.Errorf("History() of a shard in two streams = %v, want %v", err, ErrShardAmbiguous)
+	}
+
+	path := filepath.Join(t.TempDir(), "history.json")
+	if err := history.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string][]CheckpointEntry
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved[testStream+"/"+testShard]) != 3 || len(saved["other-stream/"+testShard]) != 1 {
+		t.Errorf("saved history %v, want both streams' checkpoints", saved)
+	}
+}
+
+func TestCheckpointHistoryDisabled(t *testing.T) {
+	history := NewCheckpointHistory(&Config{})
+	if history != nil {
+		t.Fatal("NewCheckpointHistory() without a size returned a history")
+	}
+	history.ForStream(testStream).Record(testShard, aws.String("1"), nil)
+	if _, err := history.History("", testShard); err != ErrNoCheckpointHistory {
+		t.Errorf("History() = %v, want %v", err, ErrNoCheckpointHistory)
+	}
+}
+
+func TestHandleCheckpointHistory(t *testing.T) {
+	cfg := &Config{}
+	cfg.Consumer.CheckpointHistory.Size = 10
+	history := NewCheckpointHistory(cfg)
+	history.ForStream(testStream).Record(testShard, aws.String("100"), nil)
+	history.ForStream("other-stream").Record(testShard, aws.String("200"), nil)
+	handler := handleCheckpointHistory(history)
+
+	tests := []struct {
+		path     string
+		wantCode int
+		wantSeq  string
+	}{
+		{path: "/checkpoints/" + testShard + "/history?stream=" + testStream, wantCode: http.StatusOK, wantSeq: "100"},
+		{path: "/checkpoints/" + testShard + "/history", wantCode: http.StatusConflict},
+		{path: "/checkpoints/shardId-000000000009/history", wantCode: http.StatusNotFound},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /checkpoints/{shard}/history", handler)
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.wantCode {
+			t.Errorf("GET %s answered %d, want %d", tt.path, w.Code, tt.wantCode)
+			continue
+		}
+		if tt.wantSeq == "" {
+			continue
+		}
+		var entries []CheckpointEntry
+		if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].SequenceNumber != tt.wantSeq {
+			t.Errorf("GET %s returned %+v, want checkpoint %s", tt.path, entries, tt.wantSeq)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
+)
+
+// checkpointWriteBuckets are the upper bounds, in seconds, of the checkpoint write histogram
+var checkpointWriteBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// CheckpointWriteMetrics is the distribution of how long checkpoint writes
+// to the lease table took for one stream. Slow writes eat into the lease
+// renewal budget and are a suspect when leases are lost.
+type CheckpointWriteMetrics struct {
+	Writes       int64
+	Seconds      float64   // sum of all write durations
+	MaxSeconds   float64   // slowest write
+	Slow         int64     // writes over consumer.slow_checkpoint_ms
+	BucketCounts []uint64  // cumulative count of writes at or under each of Buckets
+	Buckets      []float64 // upper bounds of BucketCounts
+}
+
+func (m *Metrics) checkpointWrites() *CheckpointWriteMetrics {
+	cw, ok := m.store.checkpointWrites[m.stream]
+	if !ok {
+		cw = &CheckpointWriteMetrics{Buckets: checkpointWriteBuckets, BucketCounts: make([]uint64, len(checkpointWriteBuckets))}
+		m.store.checkpointWrites[m.stream] = cw
+	}
+	return cw
+}
+
+// CheckpointWrite records how long one checkpoint write took, and whether it counted as slow
+func (m *Metrics) CheckpointWrite(d time.Duration, slow bool) {
+	if m == nil {
+		return
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	cw := m.checkpointWrites()
+	seconds := d.Seconds()
+	cw.Writes++
+	cw.Seconds += seconds
+	cw.MaxSeconds = max(cw.MaxSeconds, seconds)
+	if slow {
+		cw.Slow++
+	}
+	for i, bound := range cw.Buckets {
+		if seconds <= bound {
+			cw.BucketCounts[i]++
+		}
+	}
+}
+
+// CheckpointWriteSnapshot returns a copy of the checkpoint write metrics of every stream
+func (m *Metrics) CheckpointWriteSnapshot() map[string]CheckpointWriteMetrics {
+	if m == nil {
+		return nil
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	snapshot := make(map[string]CheckpointWriteMetrics, len(m.store.checkpointWrites))
+	for stream, cw := range m.store.checkpointWrites {
+		copied := *cw
+		copied.BucketCounts = append([]uint64(nil), cw.BucketCounts...)
+		snapshot[stream] = copied
+	}
+	return snapshot
+}
+
+// writeCheckpoint makes one checkpoint write, timing it and warning when it
+// takes longer than consumer.slow_checkpoint_ms
+func (pc *ProcessorContext) writeCheckpoint(shardID string, checkpointer interfaces.IRecordProcessorCheckpointer, sequenceNumber *string) error {
+	start := time.Now()
+	err := checkpointer.Checkpoint(sequenceNumber)
+	took := time.Since(start)
+
+	threshold := time.Duration(pc.Config.Consumer.SlowCheckpointMs) * time.Millisecond
+	slow := threshold > 0 && took > threshold
+	if slow {
+		log.Printf("[%s] WARNING: checkpoint write took %v (consumer.slow_checkpoint_ms %v), slow lease table writes delay lease renewals",
+			pc.logLabel(shardID), took.Round(time.Millisecond), threshold)
+	}
+	pc.Metrics.CheckpointWrite(took, slow)
+	return err
+}
+
+// logCheckpointWriteSummary logs the checkpoint write latency distribution
+// of every stream, once the consumer has stopped
+func (m *Metrics) logCheckpointWriteSummary() {
+	snapshot := m.CheckpointWriteSnapshot()
+	streams := make([]string, 0, len(snapshot))
+	for stream := range snapshot {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+
+	for _, stream := range streams {
+		cw := snapshot[stream]
+		label := "Checkpoint write summary"
+		if stream != "" {
+			label = fmt.Sprintf("Checkpoint write summary [%s]", stream)
+		}
+
+		var buckets []string
+		for i, bound := range cw.Buckets {
+			buckets = append(buckets, fmt.Sprintf("<=%gs:%d", bound, cw.BucketCounts[i]))
+		}
+		log.Printf("%s: %d writes, mean %.3fs max %.3fs, %d slow (%s)",
+			label, cw.Writes, cw.Seconds/float64(cw.Writes), cw.MaxSeconds, cw.Slow, strings.Join(buckets, " "))
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
+)
+
+// slowCheckpointer takes delay to write a checkpoint
+type slowCheckpointer struct {
+	interfaces.IRecordProcessorCheckpointer
+	delay time.Duration
+}
+
+func (c slowCheckpointer) Checkpoint(sequenceNumber *string) error {
+	time.Sleep(c.delay)
+	return nil
+}
+
+func TestCheckpointWriteLatency(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := &Config{}
+	cfg.Consumer.SlowCheckpointMs = 20
+	metrics := NewMetrics()
+	pc := &ProcessorContext{Config: cfg, Metrics: metrics}
+
+	if err := pc.Checkpoint(testShard, slowCheckpointer{}, aws.String("100")); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logged.String(), "WARNING") {
+		t.Errorf("warned about a fast checkpoint write: %s", logged.String())
+	}
+	if err := pc.Checkpoint(testShard, slowCheckpointer{delay: 40 * time.Millisecond}, aws.String("200")); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logged.String(), "["+testShard+"] WARNING: checkpoint write took") {
+		t.Errorf("logged %q, want a warning about the slow checkpoint write", logged.String())
+	}
+
+	cw := metrics.CheckpointWriteSnapshot()[""]
+	if cw.Writes != 2 || cw.Slow != 1 {
+		t.Errorf("measured %d writes with %d slow, want 2 with 1 slow", cw.Writes, cw.Slow)
+	}
+	if cw.MaxSeconds < 0.04 {
+		t.Errorf("slowest write %.3fs, want at least 0.04s", cw.MaxSeconds)
+	}
+	// Buckets under the slow write hold only the fast one
+	for i, bound := range cw.Buckets {
+		if want := uint64(1); bound < 0.04 && cw.BucketCounts[i] != want {
+			t.Errorf("bucket le=%g counts %d writes, want %d", bound, cw.BucketCounts[i], want)
+		}
+	}
+	if last := cw.BucketCounts[len(cw.BucketCounts)-1]; last != 2 {
+		t.Errorf("last bucket counts %d writes, want 2", last)
+	}
+
+	w := httptest.NewRecorder()
+	newMetricsHandler(cfg, metrics).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if want := `consumer_checkpoint_write_seconds_count{stream="",worker_id=""} 2`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("/metrics does not report %s", want)
+	}
+
+	logged.Reset()
+	metrics.logCheckpointWriteSummary()
+	if !strings.Contains(logged.String(), "Checkpoint write summary: 2 writes") || !strings.Contains(logged.String(), "1 slow") {
+		t.Errorf("summary %q, want the 2 writes with 1 slow", logged.String())
+	}
+}
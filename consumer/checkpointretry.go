@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
+)
+
+// Defaults for consumer.checkpoint_retry
+const (
+	DefaultCheckpointRetryAttempts    = 5
+	DefaultCheckpointRetryBaseDelayMs = 100
+
+	// maxCheckpointRetryDelay caps the doubling delay between checkpoint retries
+	maxCheckpointRetryDelay = 5 * time.Second
+)
+
+// retryableCheckpointError reports whether a failed checkpoint write may
+// succeed when made again: lease table throttling, such as
+// ProvisionedThroughputExceeded when many workers checkpoint at once during
+// a rebalance, and transient failures such as a 5xx or a dropped connection.
+// Anything else, such as a lost lease or a shut down processor, fails the
+// same way every time.
+func retryableCheckpointError(err error) bool {
+	if request.IsErrorThrottle(err) {
+		return true
+	}
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && failure.StatusCode() >= http.StatusInternalServerError {
+		return true
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && (aerr.Code() == request.ErrCodeRequestError || aerr.Code() == request.ErrCodeResponseTimeout) {
+		return request.IsErrorRetryable(aerr)
+	}
+	return false
+}
+
+// checkpointRetryDelay is the pause before retry number attempt (from 1): the
+// base delay doubled for every earlier retry, up to maxCheckpointRetryDelay,
+// with half of it jittered so workers throttled together don't retry together
+func checkpointRetryDelay(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < maxCheckpointRetryDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxCheckpointRetryDelay)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// checkpointWithRetry makes a checkpoint write, making it again with
+// exponential backoff while it fails with a retryable error, up to
+// consumer.checkpoint_retry.max_attempts writes in all. A non-retryable
+// error is returned at once.
+func (pc *ProcessorContext) checkpointWithRetry(shardID string, checkpointer interfaces.IRecordProcessorCheckpointer, sequenceNumber *string) error {
+	retryCfg := pc.Config.Consumer.CheckpointRetry
+	base := time.Duration(retryCfg.BaseDelayMs) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := pc.writeCheckpoint(shardID, checkpointer, sequenceNumber)
+		if err == nil || attempt >= retryCfg.MaxAttempts || !retryableCheckpointError(err) {
+			return err
+		}
+		delay := checkpointRetryDelay(base, attempt)
+		log.Printf("[%s] Checkpoint write failed (attempt %d/%d), retrying in %v: %v",
+			pc.logLabel(shardID), attempt, retryCfg.MaxAttempts, delay.Round(time.Millisecond), err)
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
+)
+
+// queuedCheckpointer fails its checkpoint writes with errs in turn, then succeeds
+type queuedCheckpointer struct {
+	interfaces.IRecordProcessorCheckpointer
+	errs  []error
+	calls int
+}
+
+func (c *queuedCheckpointer) Checkpoint(sequenceNumber *string) error {
+	c.calls++
+	if len(c.errs) == 0 {
+		return nil
+	}
+	err := c.errs[0]
+	c.errs = c.errs[1:]
+	return err
+}
+
+func TestCheckpointWithRetry(t *testing.T) {
+	throttled := awserr.NewRequestFailure(awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "Rate exceeded", nil), http.StatusBadRequest, "req-1")
+	serverError := awserr.NewRequestFailure(awserr.New(dynamodb.ErrCodeInternalServerError, "Internal error", nil), http.StatusInternalServerError, "req-2")
+	invalid := awserr.NewRequestFailure(awserr.New("ValidationException", "Invalid key", nil), http.StatusBadRequest, "req-3")
+	dropped := awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("connection reset by peer"))
+	cancelled := awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("net/http: request canceled"))
+	timedOut := awserr.New(request.ErrCodeResponseTimeout, "read on body has reached the timeout limit", nil)
+	leaseLost := errors.New("lease lost")
+
+	tests := []struct {
+		name         string
+		errs         []error
+		maxAttempts  int
+		wantAttempts int
+		wantErr      error
+	}{
+		{name: "written first time", maxAttempts: 3, wantAttempts: 1},
+		{name: "throttled", errs: []error{throttled, throttled}, maxAttempts: 5, wantAttempts: 3},
+		{name: "server error", errs: []error{serverError}, maxAttempts: 5, wantAttempts: 2},
+		{name: "dropped connection", errs: []error{dropped}, maxAttempts: 5, wantAttempts: 2},
+		{name: "response timeout", errs: []error{timedOut}, maxAttempts: 5, wantAttempts: 2},
+		{name: "gives up at the attempt cap", errs: []error{throttled, serverError, throttled, throttled}, maxAttempts: 3, wantAttempts: 3, wantErr: throttled},
+		{name: "single attempt", errs: []error{throttled}, maxAttempts: 1, wantAttempts: 1, wantErr: throttled},
+		{name: "lease lost", errs: []error{leaseLost}, maxAttempts: 5, wantAttempts: 1, wantErr: leaseLost},
+		{name: "client error", errs: []error{invalid}, maxAttempts: 5, wantAttempts: 1, wantErr: invalid},
+		{name: "cancelled request", errs: []error{cancelled}, maxAttempts: 5, wantAttempts: 1, wantErr: cancelled},
+		{name: "fatal after a retry", errs: []error{throttled, leaseLost}, maxAttempts: 5, wantAttempts: 2, wantErr: leaseLost},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.CheckpointRetry.MaxAttempts = tt.maxAttempts
+			cfg.Consumer.CheckpointRetry.BaseDelayMs = 1
+			pc := &ProcessorContext{Config: cfg, Metrics: NewMetrics()}
+			checkpointer := &queuedCheckpointer{errs: tt.errs}
+
+			err := pc.checkpointWithRetry(testShard, checkpointer, nil)
+			if err != tt.wantErr {
+				t.Errorf("checkpointWithRetry() = %v, want %v", err, tt.wantErr)
+			}
+			if checkpointer.calls != tt.wantAttempts {
+				t.Errorf("wrote the checkpoint %d times, want %d", checkpointer.calls, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestCheckpointRetryDelay(t *testing.T) {
+	const base = 100 * time.Millisecond
+	for attempt, want := range map[int]time.Duration{1: base, 2: 2 * base, 4: 8 * base, 10: maxCheckpointRetryDelay} {
+		for range 20 {
+			// Half of the delay is jitter
+			if delay := checkpointRetryDelay(base, attempt); delay < want/2 || delay > want {
+				t.Errorf("retry %d delayed %v, want within [%v, %v]", attempt, delay, want/2, want)
+			}
+		}
+	}
+}
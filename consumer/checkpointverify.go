@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	chk "github.com/vmware/vmware-go-kcl/clientlibrary/checkpoint"
+	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
+)
+
+const (
+	// checkpointVerifyAttempts is how many times a checkpoint is rewritten and re-read before alerting
+	checkpointVerifyAttempts = 3
+
+	// checkpointVerifyDelay is the pause between a mismatched read-back and the rewrite
+	checkpointVerifyDelay = 200 * time.Millisecond
+)
+
+// CheckpointVerifier reads checkpoints back from the KCL lease table to
+// confirm they were actually persisted
+type CheckpointVerifier struct {
+	client    dynamodbiface.DynamoDBAPI
+	tableName string
+}
+
+// NewCheckpointVerifier creates a verifier reading from the given lease table
+func NewCheckpointVerifier(client dynamodbiface.DynamoDBAPI, tableName string) *CheckpointVerifier {
+	return &CheckpointVerifier{client: client, tableName: tableName}
+}
+
+// StoredCheckpoint returns the checkpoint currently recorded in the lease table for a shard
+func (v *CheckpointVerifier) StoredCheckpoint(shardID string) (string, error) {
+	output, err := v.client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(v.tableName),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			chk.LeaseKeyKey: {S: aws.String(shardID)},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read lease row: %w", err)
+	}
+	if output.Item == nil {
+		return "", fmt.Errorf("no lease row for shard %s", shardID)
+	}
+	if value, ok := output.Item[chk.SequenceNumberKey]; ok {
+		return aws.StringValue(value.S), nil
+	}
+	return "", nil
+}
+
+// Verify checks that the lease table holds the expected checkpoint for a shard
+func (v *CheckpointVerifier) Verify(shardID, expected string) error {
+	stored, err := v.StoredCheckpoint(shardID)
+	if err != nil {
+		return err
+	}
+	if stored != expected {
+		return fmt.Errorf("lease table has checkpoint %q, expected %q", stored, expected)
+	}
+	return nil
+}
+
+// Checkpoint records progress for a shard. A nil sequence number marks the
+// shard as fully processed. When checkpoint verification is enabled the
+// write is read back from the lease table and retried if it did not land.
+func (pc *ProcessorContext) Checkpoint(shardID string, checkpointer interfaces.IRecordProcessorCheckpointer, sequenceNumber *string) error {
+	err := pc.checkpoint(shardID, checkpointer, sequenceNumber)
+	pc.Metrics.CheckpointResult(shardID, err)
+	pc.History.Record(shardID, sequenceNumber, err)
+	return err
+}
+
+func (pc *ProcessorContext) checkpoint(shardID string, checkpointer interfaces.IRecordProcessorCheckpointer, sequenceNumber *string) error {
+	if err := pc.checkpointWithRetry(shardID, checkpointer, sequenceNumber); err != nil {
+		return err
+	}
+	if pc.Verifier == nil {
+		return nil
+	}
+
+	expected := chk.ShardEnd
+	if sequenceNumber != nil {
+		expected = *sequenceNumber
+	}
+
+	var err error
+	for attempt := 1; attempt <= checkpointVerifyAttempts; attempt++ {
+		if err = pc.Verifier.Verify(shardID, expected); err == nil {
+			return nil
+		}
+		log.Printf("[%s] Checkpoint verification failed (attempt %d/%d): %v",
+			pc.logLabel(shardID), attempt, checkpointVerifyAttempts, err)
+
+		time.Sleep(checkpointVerifyDelay)
+		if err := pc.checkpointWithRetry(shardID, checkpointer, sequenceNumber); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("[%s] ALERT: checkpoint %s is not durable in lease table %s after %d attempts",
+		pc.logLabel(shardID), expected, pc.Verifier.tableName, checkpointVerifyAttempts)
+	return fmt.Errorf("checkpoint not durable: %w", err)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	chk "github.com/vmware/vmware-go-kcl/clientlibrary/checkpoint"
+	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
+)
+
+// fakeLeaseTable is a KCL lease table holding the checkpoint of each shard
+type fakeLeaseTable struct {
+	dynamodbiface.DynamoDBAPI
+	mu          sync.Mutex
+	checkpoints map[string]string
+}
+
+func (f *fakeLeaseTable) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	shardID := aws.StringValue(input.Key[chk.LeaseKeyKey].S)
+	checkpoint, ok := f.checkpoints[shardID]
+	if !ok {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+		chk.LeaseKeyKey:       {S: aws.String(shardID)},
+		chk.SequenceNumberKey: {S: aws.String(checkpoint)},
+	}}, nil
+}
+
+// lostWriteCheckpointer reports success for every checkpoint but only
+// writes it to the lease table once lose writes have been lost
+type lostWriteCheckpointer struct {
+	interfaces.IRecordProcessorCheckpointer
+	table  *fakeLeaseTable
+	shard  string
+	lose   int
+	writes int
+}
+
+func (c *lostWriteCheckpointer) Checkpoint(sequenceNumber *string) error {
+	c.writes++
+	if c.writes <= c.lose {
+		return nil
+	}
+	value := chk.ShardEnd
+	if sequenceNumber != nil {
+		value = *sequenceNumber
+	}
+	c.table.mu.Lock()
+	c.table.checkpoints[c.shard] = value
+	c.table.mu.Unlock()
+	return nil
+}
+
+func TestCheckpointVerification(t *testing.T) {
+	tests := []struct {
+		name       string
+		sequence   *string
+		lose       int
+		wantWrites int
+		wantErr    bool
+	}{
+		{name: "lands at once", sequence: aws.String("42"), wantWrites: 1},
+		{name: "shard end lands at once", wantWrites: 1},
+		{name: "lands on a rewrite", sequence: aws.String("42"), lose: 2, wantWrites: 3},
+		{name: "never lands", sequence: aws.String("42"), lose: checkpointVerifyAttempts + 1, wantWrites: checkpointVerifyAttempts + 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &fakeLeaseTable{checkpoints: map[string]string{testShard: "1"}}
+			checkpointer := &lostWriteCheckpointer{table: table, shard: testShard, lose: tt.lose}
+			cfg := &Config{}
+			cfg.Consumer.CheckpointRetry.MaxAttempts = 1
+			pc := &ProcessorContext{Config: cfg, Verifier: NewCheckpointVerifier(table, "leases")}
+
+			err := pc.Checkpoint(testShard, checkpointer, tt.sequence)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Checkpoint() = %v, want error %t", err, tt.wantErr)
+			}
+			if checkpointer.writes != tt.wantWrites {
+				t.Errorf("wrote the checkpoint %d times, want %d", checkpointer.writes, tt.wantWrites)
+			}
+		})
+	}
+}
+
+func TestCheckpointVerifierVerify(t *testing.T) {
+	table := &fakeLeaseTable{checkpoints: map[string]string{testShard: "42"}}
+	v := NewCheckpointVerifier(table, "leases")
+	tests := []struct {
+		name     string
+		shard    string
+		expected string
+		wantErr  string
+	}{
+		{name: "matches", shard: testShard, expected: "42"},
+		{name: "differs", shard: testShard, expected: "43", wantErr: `lease table has checkpoint "42", expected "43"`},
+		{name: "no lease row", shard: "shardId-000000000009", expected: "42", wantErr: "no lease row"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Verify(tt.shard, tt.expected)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Verify() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
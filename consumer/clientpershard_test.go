@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// testClientConfig points the Kinesis clients at endpoint with static credentials
+func testClientConfig(t testing.TB, endpoint string, perShard bool) *Config {
+	awsCredentials.mu.Lock()
+	previous := awsCredentials.creds
+	awsCredentials.creds = nil
+	awsCredentials.mu.Unlock()
+	t.Cleanup(func() {
+		awsCredentials.mu.Lock()
+		awsCredentials.creds = previous
+		awsCredentials.mu.Unlock()
+	})
+
+	cfg := &Config{}
+	cfg.AWS.Region = "us-east-1"
+	cfg.AWS.Endpoint = endpoint
+	cfg.AWS.AccessKey, cfg.AWS.SecretKey = "test", "test"
+	cfg.Consumer.ClientPerShard = perShard
+	return cfg
+}
+
+func TestShardKinesisClient(t *testing.T) {
+	for _, perShard := range []bool{false, true} {
+		t.Run(fmt.Sprintf("client_per_shard %t", perShard), func(t *testing.T) {
+			cfg := testClientConfig(t, "http://localhost:4566", perShard)
+			shared, err := newKinesisClient(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clients := make(map[KinesisAPI]bool)
+			transports := make(map[http.RoundTripper]bool)
+			for i := 0; i < 3; i++ {
+				client, err := shardKinesisClient(cfg, shared)
+				if err != nil {
+					t.Fatal(err)
+				}
+				clients[client] = true
+				transports[client.(*kinesis.Kinesis).Config.HTTPClient.Transport] = true
+			}
+
+			want := 1
+			if perShard {
+				want = 3
+			}
+			if len(clients) != want || len(transports) != want {
+				t.Errorf("3 shards got %d clients with %d connection pools, want %d", len(clients), len(transports), want)
+			}
+		})
+	}
+}
+
+// BenchmarkShardClients reads many shards at once through one shared client
+// and through a client per shard, from a server answering GetRecords after
+// a short delay as Kinesis would. The shared client's connection pool keeps
+// only a couple of idle connections to the endpoint, so most concurrent
+// calls open a new one.
+func BenchmarkShardClients(b *testing.B) {
+	const shards = 64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		fmt.Fprint(w, `{"Records":[{"Data":"e30=","PartitionKey":"user_1","SequenceNumber":"1"}],"NextShardIterator":"next","MillisBehindLatest":0}`)
+	}))
+	defer server.Close()
+
+	for _, perShard := range []bool{false, true} {
+		name := "shared"
+		if perShard {
+			name = "per_shard"
+		}
+		b.Run(name, func(b *testing.B) {
+			cfg := testClientConfig(b, server.URL, perShard)
+			shared, err := newKinesisClient(cfg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			clients := make([]KinesisAPI, shards)
+			for i := range clients {
+				if clients[i], err = shardKinesisClient(cfg, shared); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			start := time.Now()
+			for n := 0; n < b.N; n++ {
+				var wg sync.WaitGroup
+				for _, client := range clients {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						if _, err := client.GetRecords(&kinesis.GetRecordsInput{ShardIterator: aws.String("iterator")}); err != nil {
+							b.Error(err)
+						}
+					}()
+				}
+				wg.Wait()
+			}
+			b.ReportMetric(float64(b.N*shards)/time.Since(start).Seconds(), "records/s")
+		})
+	}
+}
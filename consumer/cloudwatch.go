@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+const (
+	defaultCloudWatchInterval = 60 * time.Second
+
+	// cloudWatchBatchSize keeps each PutMetricData call well under the API's datum limit
+	cloudWatchBatchSize = 20
+)
+
+// CloudWatchPublisher periodically publishes consumer metrics to CloudWatch
+// with StreamName, ShardId and WorkerId dimensions. Counters are sent as the delta since
+// the previous publish so CloudWatch sums line up with records processed.
+type CloudWatchPublisher struct {
+	client    cloudwatchiface.CloudWatchAPI
+	namespace string
+	workerID  string
+	interval  time.Duration
+	metrics   *Metrics
+	previous  map[ShardKey]ShardMetrics
+}
+
+// NewCloudWatchPublisher creates a publisher for the telemetry section of the config
+func NewCloudWatchPublisher(client cloudwatchiface.CloudWatchAPI, cfg *Config, metrics *Metrics) *CloudWatchPublisher {
+	interval := time.Duration(cfg.Telemetry.CloudWatchIntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultCloudWatchInterval
+	}
+	return &CloudWatchPublisher{
+		client:    client,
+		namespace: cfg.Telemetry.CloudWatchNamespace,
+		workerID:  cfg.Consumer.WorkerID,
+		interval:  interval,
+		metrics:   metrics,
+		previous:  make(map[ShardKey]ShardMetrics),
+	}
+}
+
+// Run publishes on every interval until ctx is cancelled, then publishes once more
+func (p *CloudWatchPublisher) Run(ctx context.Context) {
+	log.Printf("Publishing metrics to CloudWatch namespace %s every %v", p.namespace, p.interval)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := p.Publish(); err != nil {
+				log.Printf("Failed to publish final metrics to CloudWatch: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := p.Publish(); err != nil {
+				log.Printf("Failed to publish metrics to CloudWatch: %v", err)
+			}
+		}
+	}
+}
+
+// Publish sends one batch of metric data covering every known shard
+func (p *CloudWatchPublisher) Publish() error {
+	snapshot := p.metrics.Snapshot()
+	now := time.Now()
+
+	var data []*cloudwatch.MetricDatum
+	for _, key := range sortedShardKeys(snapshot) {
+		current := snapshot[key]
+		previous := p.previous[key]
+		dimensions := []*cloudwatch.Dimension{
+			{Name: aws.String("StreamName"), Value: aws.String(key.Stream)},
+			{Name: aws.String("ShardId"), Value: aws.String(key.ShardID)},
+			{Name: aws.String("WorkerId"), Value: aws.String(p.workerID)},
+		}
+
+		data = append(data,
+			p.datum("RecordsProcessed", float64(current.RecordsProcessed-previous.RecordsProcessed), cloudwatch.StandardUnitCount, dimensions, now),
+			p.datum("Checkpoints", float64(current.Checkpoints-previous.Checkpoints), cloudwatch.StandardUnitCount, dimensions, now),
+			p.datum("CheckpointFailures", float64(current.CheckpointFailures-previous.CheckpointFailures), cloudwatch.StandardUnitCount, dimensions, now),
+			p.datum("HandlerTimeouts", float64(current.HandlerTimeouts-previous.HandlerTimeouts), cloudwatch.StandardUnitCount, dimensions, now),
+			p.datum("ReprocessedOnRebalance", float64(current.Reprocessed-previous.Reprocessed), cloudwatch.StandardUnitCount, dimensions, now),
+			p.datum("FutureTimestamps", float64(current.FutureTimestamps-previous.FutureTimestamps), cloudwatch.StandardUnitCount, dimensions, now),
+			p.datum("RecordsShed", float64(current.Shed-previous.Shed), cloudwatch.StandardUnitCount, dimensions, now),
+			p.datum("IdleHeartbeats", float64(current.IdleHeartbeats-previous.IdleHeartbeats), cloudwatch.StandardUnitCount, dimensions, now),
+			p.datum("InvalidSignatures", float64(current.InvalidSignatures-previous.InvalidSignatures), cloudwatch.StandardUnitCount, dimensions, now),
+			p.datum("UnknownEventVersions", float64(current.UnknownVersions-previous.UnknownVersions), cloudwatch.StandardUnitCount, dimensions, now),
+			p.datum("CheckpointLagRecords", float64(current.CheckpointLagRecords), cloudwatch.StandardUnitCount, dimensions, now),
+		)
+		if calls := current.HandlerCalls - previous.HandlerCalls; calls > 0 {
+			data = append(data, p.datum("HandlerLatency", (current.HandlerMillis-previous.HandlerMillis)/float64(calls),
+				cloudwatch.StandardUnitMilliseconds, dimensions, now))
+		}
+		if current.HasLag {
+			data = append(data, p.datum("MillisBehindLatest", float64(current.MillisBehindLatest), cloudwatch.StandardUnitMilliseconds, dimensions, now))
+		}
+	}
+
+	for start := 0; start < len(data); start += cloudWatchBatchSize {
+		end := start + cloudWatchBatchSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := p.client.PutMetricData(&cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(p.namespace),
+			MetricData: data[start:end],
+		}); err != nil {
+			return err
+		}
+	}
+
+	p.previous = snapshot
+	return nil
+}
+
+func (p *CloudWatchPublisher) datum(name string, value float64, unit string, dimensions []*cloudwatch.Dimension, timestamp time.Time) *cloudwatch.MetricDatum {
+	return &cloudwatch.MetricDatum{
+		MetricName: aws.String(name),
+		Value:      aws.Float64(value),
+		Unit:       aws.String(unit),
+		Dimensions: dimensions,
+		Timestamp:  aws.Time(timestamp),
+	}
+}
+
+// startTelemetry starts any configured metrics exporters and returns a function
+// that stops them, flushing a final batch
+func startTelemetry(cfg *Config, metrics *Metrics) (func(), error) {
+	if cfg.Telemetry.CloudWatchNamespace == "" {
+		return func() {}, nil
+	}
+
+	sess, err := newAWSSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	publisher := NewCloudWatchPublisher(cloudwatch.New(sess), cfg, metrics)
+	go func() {
+		defer close(done)
+		publisher.Run(ctx)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+// fakeCloudWatch records the PutMetricData calls made to it, failing the
+// next failures calls
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	inputs   []*cloudwatch.PutMetricDataInput
+	failures int
+}
+
+func (f *fakeCloudWatch) PutMetricData(input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("throttled")
+	}
+	f.inputs = append(f.inputs, input)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+// published returns the values sent for metric since the last call, keyed
+// by the datum's dimensions
+func (f *fakeCloudWatch) published(t *testing.T, metric string) map[string]float64 {
+	t.Helper()
+	values := make(map[string]float64)
+	for _, input := range f.inputs {
+		if aws.StringValue(input.Namespace) != "kds-rebalance" {
+			t.Errorf("published to namespace %q", aws.StringValue(input.Namespace))
+		}
+		if len(input.MetricData) > cloudWatchBatchSize {
+			t.Errorf("published %d data in one call, want at most %d", len(input.MetricData), cloudWatchBatchSize)
+		}
+		for _, datum := range input.MetricData {
+			if aws.StringValue(datum.MetricName) != metric {
+				continue
+			}
+			var dimensions []string
+			for _, dimension := range datum.Dimensions {
+				dimensions = append(dimensions, aws.StringValue(dimension.Name)+"="+aws.StringValue(dimension.Value))
+			}
+			values[strings.Join(dimensions, ",")] = aws.Float64Value(datum.Value)
+		}
+	}
+	f.inputs = nil
+	return values
+}
+
+func TestCloudWatchPublisher(t *testing.T) {
+	cfg := &Config{}
+	cfg.Consumer.WorkerID = "worker-1"
+	cfg.Telemetry.CloudWatchNamespace = "kds-rebalance"
+	metrics := NewMetrics()
+	client := &fakeCloudWatch{}
+	publisher := NewCloudWatchPublisher(client, cfg, metrics)
+
+	orders, payments := metrics.ForStream("orders"), metrics.ForStream("payments")
+	orders.RecordsProcessed("shardId-000000000000", 3)
+	orders.RecordsProcessed("shardId-000000000001", 2)
+	payments.RecordsProcessed("shardId-000000000000", 5)
+
+	const (
+		orders0   = "StreamName=orders,ShardId=shardId-000000000000,WorkerId=worker-1"
+		orders1   = "StreamName=orders,ShardId=shardId-000000000001,WorkerId=worker-1"
+		payments0 = "StreamName=payments,ShardId=shardId-000000000000,WorkerId=worker-1"
+	)
+	publishes := []struct {
+		name     string
+		record   func()
+		failures int
+		want     map[string]float64
+	}{
+		{
+			name: "first publish",
+			want: map[string]float64{orders0: 3, orders1: 2, payments0: 5},
+		},
+		{
+			name:   "counters sent as deltas",
+			record: func() { orders.RecordsProcessed("shardId-000000000000", 4) },
+			want:   map[string]float64{orders0: 4, orders1: 0, payments0: 0},
+		},
+		{
+			name:     "failed publish",
+			record:   func() { payments.RecordsProcessed("shardId-000000000000", 1) },
+			failures: 1,
+			want:     map[string]float64{},
+		},
+		{
+			name:   "failed delta sent with the next publish",
+			record: func() { payments.RecordsProcessed("shardId-000000000000", 2) },
+			want:   map[string]float64{orders0: 0, orders1: 0, payments0: 3},
+		},
+	}
+	for _, p := range publishes {
+		if p.record != nil {
+			p.record()
+		}
+		client.failures = p.failures
+		if err := publisher.Publish(); (err != nil) != (p.failures > 0) {
+			t.Errorf("%s: Publish() = %v", p.name, err)
+		}
+		if got := client.published(t, "RecordsProcessed"); fmt.Sprint(got) != fmt.Sprint(p.want) {
+			t.Errorf("%s: published RecordsProcessed %v, want %v", p.name, got, p.want)
+		}
+	}
+
+	// Every datum carries the stream, shard and worker dimensions
+	orders.CheckpointResult("shardId-000000000000", nil)
+	if err := publisher.Publish(); err != nil {
+		t.Fatal(err)
+	}
+	for _, input := range client.inputs {
+		for _, datum := range input.MetricData {
+			if len(datum.Dimensions) != 3 || aws.StringValue(datum.Dimensions[2].Value) != "worker-1" {
+				t.Errorf("%s has dimensions %v", aws.StringValue(datum.MetricName), datum.Dimensions)
+			}
+		}
+	}
+	if got := client.published(t, "Checkpoints"); got[orders0] != 1 || got[orders1] != 0 || got[payments0] != 0 {
+		t.Errorf("published Checkpoints %v, want 1 for %s only", got, orders0)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// gzipMagic starts the frame of a record compressed by the producer's
+// producer.compress gzip: the magic, then the gzip stream of the JSON
+// event. JSON never starts with a NUL byte, so plain records are told apart
+// by it and read as they are.
+const gzipMagic = "\x00GZ1"
+
+// maxDecompressedBytes bounds a decompressed record, well above any event
+// a 1 MiB Kinesis record compresses, so a corrupt or hostile stream can't
+// exhaust memory
+const maxDecompressedBytes = 16 << 20
+
+// decompressPayload returns the JSON of a compressed record, or the payload
+// unchanged when it is not compressed
+func decompressPayload(payload []byte) ([]byte, error) {
+	if !bytes.HasPrefix(payload, []byte(gzipMagic)) {
+		return payload, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(payload[len(gzipMagic):]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress record: %w", err)
+	}
+	data, err := io.ReadAll(io.LimitReader(gz, maxDecompressedBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress record: %w", err)
+	}
+	if len(data) > maxDecompressedBytes {
+		return nil, fmt.Errorf("failed to decompress record: more than %d bytes", maxDecompressedBytes)
+	}
+	return data, nil
+}
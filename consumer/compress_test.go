@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+)
+
+// testGzipFrame frames data the way producer.compress gzip does
+func testGzipFrame(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	buf.WriteString(gzipMagic)
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressPayload(t *testing.T) {
+	event := []byte(`{"version":1,"event_id":"evt_1","action":"view"}`)
+	compressed := testGzipFrame(t, event)
+	atLimit := bytes.Repeat([]byte{' '}, maxDecompressedBytes)
+
+	tests := []struct {
+		name    string
+		payload []byte
+		want    []byte
+		wantErr string
+	}{
+		{name: "plain", payload: event, want: event},
+		{name: "compressed", payload: compressed, want: event},
+		{name: "at the size limit", payload: testGzipFrame(t, atLimit), want: atLimit},
+		{name: "above the size limit", payload: testGzipFrame(t, append(atLimit, ' ')), wantErr: "more than 16777216 bytes"},
+		{name: "not gzip after the magic", payload: []byte(gzipMagic + "{}"), wantErr: "failed to decompress record"},
+		{name: "truncated", payload: compressed[:len(compressed)-6], wantErr: "failed to decompress record"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decompressPayload(tt.payload)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("decompressPayload() = %v, want an error with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(got, tt.want) {
+				t.Errorf("decompressPayload() = %.40q, %v; want %.40q", got, err, tt.want)
+			}
+		})
+	}
+}
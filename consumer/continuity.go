@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Kinds of ContinuityEvent
+const (
+	ContinuityReleased = "released"
+	ContinuityAcquired = "acquired"
+)
+
+// ContinuityEvent is a shard changing hands, as kept in memory and appended
+// to consumer.continuity_log_path
+type ContinuityEvent struct {
+	Kind     string    `json:"kind"`
+	Stream   string    `json:"stream"`
+	ShardID  string    `json:"shard_id"`
+	WorkerID string    `json:"worker_id"`
+	Time     time.Time `json:"time"`
+
+	// Released: why, the last record handled and the checkpoint left behind
+	Reason       string `json:"reason,omitempty"`
+	LastSequence string `json:"last_sequence,omitempty"`
+	Checkpoint   string `json:"checkpoint,omitempty"`
+
+	// Acquired: the checkpoint reading resumed after (empty for the initial
+	// position), and whether records were skipped since the last release
+	ResumedAfter string `json:"resumed_after,omitempty"`
+	Gap          bool   `json:"gap,omitempty"`
+}
+
+// Continuity checks that no records are lost across a rebalance. When this
+// worker releases a shard it records the last record it handled and its
+// checkpoint; when a worker acquires the shard again it checks reading
+// resumes at or before them. With continuity_log_path on a volume the
+// workers share, the check also covers a shard moving to another worker. A
+// nil *Continuity checks nothing.
+type Continuity struct {
+	stream   string
+	labels   shardLabeler
+	workerID string
+	atLatest bool // a shard without a checkpoint starts at the tip, not the horizon
+	path     string
+
+	mu       sync.Mutex
+	released map[string]ContinuityEvent // last release of every shard, by shard ID
+	file     *os.File
+}
+
+// NewContinuity returns nil unless consumer.continuity_check is set.
+// atLatest tells whether shards without a checkpoint start at LATEST.
+func NewContinuity(cfg *Config, atLatest bool) (*Continuity, error) {
+	if !cfg.Consumer.ContinuityCheck {
+		if cfg.Consumer.ContinuityLogPath != "" {
+			return nil, fmt.Errorf("consumer.continuity_log_path requires continuity_check")
+		}
+		return nil, nil
+	}
+	c := &Continuity{
+		stream:   cfg.Kinesis.StreamName,
+		labels:   newShardLabeler(cfg),
+		workerID: cfg.Consumer.WorkerID,
+		atLatest: atLatest,
+		path:     cfg.Consumer.ContinuityLogPath,
+		released: make(map[string]ContinuityEvent),
+	}
+	if c.path != "" {
+		file, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open continuity log: %w", err)
+		}
+		c.file = file
+	}
+	return c, nil
+}
+
+// Released records that this worker gave up the shard
+func (c *Continuity) Released(shardID, reason, lastSequence, checkpoint string) {
+	if c == nil {
+		return
+	}
+	event := ContinuityEvent{
+		Kind:         ContinuityReleased,
+		Stream:       c.stream,
+		ShardID:      shardID,
+		WorkerID:     c.workerID,
+		Time:         time.Now(),
+		Reason:       reason,
+		LastSequence: lastSequence,
+		Checkpoint:   checkpoint,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.released[shardID] = event
+	c.append(event)
+}
+
+// Acquired checks the shard resumes without a gap after its last release,
+// by this worker or, through the shared log, any other, and logs an alert
+// when it doesn't. It returns whether there is a gap.
+func (c *Continuity) Acquired(shardID, resumedAfter string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous, ok := c.released[shardID]
+	if logged, found := c.lastLoggedRelease(shardID); found && (!ok || logged.Time.After(previous.Time)) {
+		previous, ok = logged, true
+	}
+
+	event := ContinuityEvent{
+		Kind:         ContinuityAcquired,
+		Stream:       c.stream,
+		ShardID:      shardID,
+		WorkerID:     c.workerID,
+		Time:         time.Now(),
+		ResumedAfter: resumedAfter,
+	}
+	if ok {
+		event.Gap = continuityGap(previous, resumedAfter, c.atLatest)
+		if event.Gap {
+			log.Printf("[%s] ALERT: records lost across a rebalance: %s released the shard (%s) having handled up to %s with checkpoint %s, but reading resumes from %s",
+				c.labels.logLabel(shardID), previous.WorkerID, previous.Reason, orNone(previous.LastSequence), orNone(previous.Checkpoint), c.resumePosition(resumedAfter))
+		} else {
+			log.Printf("[%s] No gap across the rebalance: resuming from %s, %s handled up to %s",
+				c.labels.logLabel(shardID), c.resumePosition(resumedAfter), previous.WorkerID, orNone(previous.LastSequence))
+		}
+	}
+	c.append(event)
+	return event.Gap
+}
+
+// continuityGap reports whether resuming after resumedAfter skips records
+// past the last release: the new position must be at or before the last
+// record handled or the checkpoint left behind, whichever is later. A shard
+// resuming without a checkpoint skips records only when it starts at LATEST.
+func continuityGap(previous ContinuityEvent, resumedAfter string, atLatest bool) bool {
+	if previous.LastSequence == "" && previous.Checkpoint == "" {
+		return false
+	}
+	if resumedAfter == "" {
+		return atLatest
+	}
+	return !sequenceAtOrBefore(resumedAfter, previous.LastSequence) &&
+		!sequenceAtOrBefore(resumedAfter, previous.Checkpoint)
+}
+
+// lastLoggedRelease reads the shared log for the latest release of the shard
+func (c *Continuity) lastLoggedRelease(shardID string) (ContinuityEvent, bool) {
+	var latest ContinuityEvent
+	found := false
+	if c.path == "" {
+		return latest, false
+	}
+	file, err := os.Open(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return latest, false
+	}
+	if err != nil {
+		log.Printf("[%s] Failed to read continuity log: %v", c.labels.logLabel(shardID), err)
+		return latest, false
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event ContinuityEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		if event.Kind == ContinuityReleased && event.Stream == c.stream && event.ShardID == shardID &&
+			(!found || !event.Time.Before(latest.Time)) {
+			latest, found = event, true
+		}
+	}
+	return latest, found
+}
+
+// append writes the event to the shared log, if any. Each event is a single
+// write to a file opened for appending, so workers don't interleave lines.
+func (c *Continuity) append(event ContinuityEvent) {
+	if c.file == nil {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	if _, err := c.file.Write(append(data, '\n')); err != nil {
+		log.Printf("[%s] Failed to write continuity log: %v", c.labels.logLabel(event.ShardID), err)
+	}
+}
+
+// Close closes the shared log
+func (c *Continuity) Close() error {
+	if c == nil || c.file == nil {
+		return nil
+	}
+	return c.file.Close()
+}
+
+func orNone(sequence string) string {
+	if sequence == "" {
+		return "none"
+	}
+	return sequence
+}
+
+// resumePosition describes where a shard resuming after resumedAfter starts
+func (c *Continuity) resumePosition(resumedAfter string) string {
+	switch {
+	case resumedAfter != "":
+		return "after " + resumedAfter
+	case c.atLatest:
+		return "LATEST"
+	default:
+		return "TRIM_HORIZON"
+	}
+}
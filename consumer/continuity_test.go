@@ -0,0 +1,98 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestContinuityGap(t *testing.T) {
+	tests := []struct {
+		name         string
+		lastSequence string
+		checkpoint   string
+		resumedAfter string
+		atLatest     bool
+		want         bool
+	}{
+		{name: "nothing handled before", resumedAfter: "900", want: false},
+		{name: "resumes after the last record handled", lastSequence: "500", checkpoint: "400", resumedAfter: "500", want: false},
+		{name: "resumes after the checkpoint", lastSequence: "500", checkpoint: "400", resumedAfter: "400", want: false},
+		{name: "resumes before the checkpoint", lastSequence: "500", checkpoint: "400", resumedAfter: "100", want: false},
+		{name: "resumes past the last record handled", lastSequence: "500", checkpoint: "400", resumedAfter: "600", want: true},
+		{name: "numeric, not lexical, comparison", lastSequence: "1000", resumedAfter: "999", want: false},
+		{name: "checkpoint later than the last record", lastSequence: "500", checkpoint: "700", resumedAfter: "700", want: false},
+		{name: "no checkpoint from the horizon", lastSequence: "500", want: false},
+		{name: "no checkpoint from latest", lastSequence: "500", atLatest: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := ContinuityEvent{Kind: ContinuityReleased, LastSequence: tt.lastSequence, Checkpoint: tt.checkpoint}
+			if got := continuityGap(previous, tt.resumedAfter, tt.atLatest); got != tt.want {
+				t.Errorf("continuityGap() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContinuity(t *testing.T) {
+	tests := []struct {
+		name         string
+		shared       bool // the workers share a continuity log
+		resumedAfter string
+		want         bool
+	}{
+		{name: "same worker without a gap", resumedAfter: "500", want: false},
+		{name: "same worker with a gap", resumedAfter: "600", want: true},
+		{name: "other worker without a gap", shared: true, resumedAfter: "500", want: false},
+		{name: "other worker with a gap", shared: true, resumedAfter: "600", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			newWorker := func(workerID string) *Continuity {
+				cfg := &Config{}
+				cfg.Kinesis.StreamName = testStream
+				cfg.Consumer.WorkerID = workerID
+				cfg.Consumer.ContinuityCheck = true
+				cfg.Consumer.ContinuityLogPath = filepath.Join(dir, workerID+".jsonl")
+				if tt.shared {
+					cfg.Consumer.ContinuityLogPath = filepath.Join(dir, "continuity.jsonl")
+				}
+				c, err := NewContinuity(cfg, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { c.Close() })
+				return c
+			}
+			releasing := newWorker("worker-1")
+			acquiring := releasing
+			if tt.shared {
+				acquiring = newWorker("worker-2")
+			}
+
+			releasing.Released(testShard, "ZOMBIE", "500", "400")
+			if got := acquiring.Acquired(testShard, tt.resumedAfter); got != tt.want {
+				t.Errorf("Acquired() = %t, want %t", got, tt.want)
+			}
+			if acquiring.Acquired("shardId-000000000001", "600") {
+				t.Error("a shard never released reported a gap")
+			}
+		})
+	}
+}
+
+func TestNewContinuity(t *testing.T) {
+	cfg := &Config{}
+	cfg.Consumer.ContinuityLogPath = filepath.Join(t.TempDir(), "continuity.jsonl")
+	if _, err := NewContinuity(cfg, false); err == nil || !strings.Contains(err.Error(), "requires continuity_check") {
+		t.Errorf("NewContinuity() = %v, want an error for a log without the check", err)
+	}
+
+	var c *Continuity
+	c.Released(testShard, "REQUESTED", "1", "1")
+	if c.Acquired(testShard, "9") || c.Close() != nil {
+		t.Error("a nil *Continuity did something")
+	}
+}
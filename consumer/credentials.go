@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// assumeRoleExpiryWindow is how long before assumed role credentials expire
+// that they are refreshed
+const assumeRoleExpiryWindow = 5 * time.Minute
+
+// awsCredentials is shared by every AWS client and KCL worker of the
+// process, so temporary credentials are refreshed once for all of them
+var awsCredentials struct {
+	mu    sync.Mutex
+	creds *credentials.Credentials
+}
+
+// newCredentials returns the credentials described by the AWS section of the
+// config: the static access_key and secret_key when set (LocalStack), else
+// role_arn assumed through STS, else the SDK's default chain (environment,
+// shared config, ECS or EC2 role). Everything but static keys is temporary
+// and refreshed before it expires.
+func newCredentials(cfg *Config) (*credentials.Credentials, error) {
+	awsCredentials.mu.Lock()
+	defer awsCredentials.mu.Unlock()
+	if awsCredentials.creds != nil {
+		return awsCredentials.creds, nil
+	}
+
+	var provider credentials.Provider
+	switch {
+	case cfg.AWS.AccessKey != "":
+		provider = &credentials.StaticProvider{Value: credentials.Value{
+			AccessKeyID:     cfg.AWS.AccessKey,
+			SecretAccessKey: cfg.AWS.SecretKey,
+		}}
+	case cfg.AWS.RoleARN != "":
+		sess, err := session.NewSession(&aws.Config{
+			Region:   aws.String(cfg.AWS.Region),
+			Endpoint: aws.String(cfg.AWS.Endpoint),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create STS session: %w", err)
+		}
+		provider = &stscreds.AssumeRoleProvider{
+			Client:          sts.New(sess),
+			RoleARN:         cfg.AWS.RoleARN,
+			RoleSessionName: fmt.Sprintf("kds-consumer-%s", cfg.Consumer.WorkerID),
+			Duration:        stscreds.DefaultDuration,
+			ExpiryWindow:    assumeRoleExpiryWindow,
+		}
+	default:
+		provider = &credentials.ChainProvider{
+			Providers:     defaults.CredProviders(defaults.Config(), defaults.Handlers()),
+			VerboseErrors: true,
+		}
+	}
+	awsCredentials.creds = credentials.NewCredentials(&refreshLogger{Provider: provider})
+	return awsCredentials.creds, nil
+}
+
+// refreshLogger logs every time the credentials are fetched. A fetch before
+// the provider considers them expired was forced by a call the service
+// rejected with expired credentials.
+type refreshLogger struct {
+	credentials.Provider
+	mu        sync.Mutex
+	retrieved bool
+}
+
+// Retrieve fetches the credentials from the wrapped provider
+func (p *refreshLogger) Retrieve() (credentials.Value, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	forced := p.retrieved && !p.Provider.IsExpired()
+	value, err := p.Provider.Retrieve()
+	if err != nil {
+		log.Printf("Failed to refresh AWS credentials: %v", err)
+		return value, err
+	}
+
+	validity := ""
+	if expirer, ok := p.Provider.(credentials.Expirer); ok {
+		validity = fmt.Sprintf(", valid until %s", expirer.ExpiresAt().Format(time.RFC3339))
+	}
+	switch {
+	case forced && value.ProviderName == credentials.StaticProviderName:
+		log.Printf("WARNING: AWS rejected the static aws.access_key as expired and it can't be refreshed; " +
+			"leave access_key empty or set aws.role_arn to use temporary credentials that are")
+	case forced:
+		log.Printf("Refreshed AWS credentials from %s early after a call was rejected with expired credentials%s", value.ProviderName, validity)
+	case p.retrieved:
+		log.Printf("Refreshed expiring AWS credentials from %s%s", value.ProviderName, validity)
+	default:
+		log.Printf("Using AWS credentials from %s%s", value.ProviderName, validity)
+	}
+	p.retrieved = true
+	return value, nil
+}
+
+// expiredCredentialsHandler retries calls rejected with expired credentials
+// after forcing a refresh, so the retry is signed with new credentials
+var expiredCredentialsHandler = request.NamedHandler{
+	Name: "consumer.ExpiredCredentialsHandler",
+	Fn: func(r *request.Request) {
+		if !request.IsErrorExpiredCreds(r.Error) {
+			return
+		}
+		log.Printf("AWS %s %s was rejected with expired credentials, refreshing them and retrying: %v",
+			r.ClientInfo.ServiceName, r.Operation.Name, r.Error)
+		r.Config.Credentials.Expire()
+		r.Retryable = aws.Bool(true)
+	},
+}
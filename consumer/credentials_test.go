@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// rotatingProvider hands out a new access key on every retrieval and never
+// expires on its own, so only a forced refresh fetches another
+type rotatingProvider struct {
+	mu        sync.Mutex
+	retrieved int
+}
+
+func (p *rotatingProvider) Retrieve() (credentials.Value, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retrieved++
+	return credentials.Value{
+		AccessKeyID:     fmt.Sprintf("AKID%d", p.retrieved),
+		SecretAccessKey: "secret",
+		ProviderName:    "rotatingProvider",
+	}, nil
+}
+
+func (p *rotatingProvider) IsExpired() bool { return false }
+
+func TestExpiredCredentialsRetry(t *testing.T) {
+	tests := []struct {
+		name          string
+		rejectedCode  string // error returned to calls signed with the first key
+		wantErr       bool
+		wantRetrieved int
+		wantKeys      string // access keys the calls were signed with
+	}{
+		{name: "retried with refreshed credentials", rejectedCode: "ExpiredTokenException", wantRetrieved: 2, wantKeys: "AKID1 AKID2"},
+		{name: "other errors not refreshed", rejectedCode: kinesis.ErrCodeResourceNotFoundException, wantErr: true, wantRetrieved: 1, wantKeys: "AKID1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var keys []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				auth := r.Header.Get("Authorization")
+				key := strings.SplitN(strings.TrimPrefix(auth[strings.Index(auth, "Credential="):], "Credential="), "/", 2)[0]
+				mu.Lock()
+				keys = append(keys, key)
+				mu.Unlock()
+				w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+				if key == "AKID1" {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, `{"__type":%q,"message":"rejected"}`, tt.rejectedCode)
+					return
+				}
+				fmt.Fprint(w, `{"Shards":[]}`)
+			}))
+			defer server.Close()
+
+			provider := &rotatingProvider{}
+			awsCredentials.mu.Lock()
+			previous := awsCredentials.creds
+			awsCredentials.creds = credentials.NewCredentials(&refreshLogger{Provider: provider})
+			awsCredentials.mu.Unlock()
+			defer func() {
+				awsCredentials.mu.Lock()
+				awsCredentials.creds = previous
+				awsCredentials.mu.Unlock()
+			}()
+
+			cfg := &Config{}
+			cfg.AWS.Region = "us-east-1"
+			cfg.AWS.Endpoint = server.URL
+			client, err := newKinesisClient(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = client.ListShards(&kinesis.ListShardsInput{StreamName: aws.String(testStream)})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ListShards() = %v, want an error %t", err, tt.wantErr)
+			}
+			if provider.retrieved != tt.wantRetrieved {
+				t.Errorf("credentials retrieved %d times, want %d", provider.retrieved, tt.wantRetrieved)
+			}
+			if got := strings.Join(keys, " "); got != tt.wantKeys {
+				t.Errorf("calls signed with %s, want %s", got, tt.wantKeys)
+			}
+		})
+	}
+}
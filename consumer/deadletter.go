@@ -0,0 +1,33 @@
+package main
+
+import "fmt"
+
+// DeadLetterSink receives records that could not be decoded, so they can be
+// inspected and replayed instead of being lost. FileSink is the only
+// implementation; a Kinesis or SQS sink would implement it the same way.
+type DeadLetterSink interface {
+	WriteRecordDeadLetter(letter *RecordDeadLetter) error
+	Close() error
+}
+
+// NewDeadLetterSink opens consumer.dlq_file, which receives records that fail
+// to unmarshal into an Event and, with handler_timeout_dlq, records whose
+// handler timed out. It returns nil when the file is not set.
+func NewDeadLetterSink(cfg *Config) (DeadLetterSink, error) {
+	if cfg.Consumer.HandlerTimeoutDLQ {
+		if cfg.Consumer.HandlerTimeoutMs <= 0 {
+			return nil, fmt.Errorf("consumer.handler_timeout_dlq requires handler_timeout_ms")
+		}
+		if cfg.Consumer.DLQFile == "" {
+			return nil, fmt.Errorf("consumer.handler_timeout_dlq requires dlq_file")
+		}
+	}
+	if cfg.Consumer.DLQFile == "" {
+		return nil, nil
+	}
+	dlq, err := NewFileSink(cfg.Consumer.DLQFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open consumer.dlq_file: %w", err)
+	}
+	return dlq, nil
+}
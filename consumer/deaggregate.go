@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/awslabs/kinesis-aggregation/go/deaggregator"
+)
+
+// kplMagic starts the data of a record aggregated by the KPL, or by the
+// producer's producer.aggregate
+const kplMagic = "\xf3\x89\x9a\xc2"
+
+// deaggregate expands KPL aggregated records into the user records they
+// carry, the way the KCL does before handing records to a RecordProcessor,
+// so manual mode and replays see the same records as KCL mode. User records
+// keep the sequence number of the record that carried them, so checkpoints
+// stay at Kinesis records. Records without the magic, and aggregated records
+// that fail their digest, are kept as they are; one that fails to unpack is
+// kept too, to fail decoding and be dead-lettered rather than lost.
+func deaggregate(label string, records []*kinesis.Record) []*kinesis.Record {
+	aggregated := false
+	for _, record := range records {
+		if bytes.HasPrefix(record.Data, []byte(kplMagic)) {
+			aggregated = true
+			break
+		}
+	}
+	if !aggregated {
+		return records
+	}
+
+	expanded := make([]*kinesis.Record, 0, len(records))
+	for _, record := range records {
+		if !bytes.HasPrefix(record.Data, []byte(kplMagic)) {
+			expanded = append(expanded, record)
+			continue
+		}
+		userRecords, err := deaggregator.DeaggregateRecords([]*kinesis.Record{record})
+		if err != nil {
+			log.Printf("[%s] Failed to deaggregate record %s: %v", label, aws.StringValue(record.SequenceNumber), err)
+			expanded = append(expanded, record)
+			continue
+		}
+		expanded = append(expanded, userRecords...)
+	}
+	return expanded
+}
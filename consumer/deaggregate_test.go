@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testAggregatedData packs user records, alternating between two partition
+// keys, into a KPL aggregated record
+func testAggregatedData(data ...string) []byte {
+	var message []byte
+	for _, key := range []string{"user_1", "user_2"} {
+		message = protowire.AppendTag(message, 1, protowire.BytesType)
+		message = protowire.AppendString(message, key)
+	}
+	for i, d := range data {
+		var record []byte
+		record = protowire.AppendTag(record, 1, protowire.VarintType)
+		record = protowire.AppendVarint(record, uint64(i%2))
+		record = protowire.AppendTag(record, 3, protowire.BytesType)
+		record = protowire.AppendString(record, d)
+		message = protowire.AppendTag(message, 3, protowire.BytesType)
+		message = protowire.AppendBytes(message, record)
+	}
+	digest := md5.Sum(message)
+	return append(append([]byte(kplMagic), message...), digest[:]...)
+}
+
+func TestDeaggregate(t *testing.T) {
+	corrupt := testAggregatedData("a", "b")
+	corrupt[len(corrupt)-1]++
+	// A valid digest over a message that isn't an AggregatedRecord
+	garbage := []byte{0xff, 0xff}
+	digest := md5.Sum(garbage)
+	unpackable := append(append([]byte(kplMagic), garbage...), digest[:]...)
+
+	tests := []struct {
+		name    string
+		records [][]byte
+		want    []string // data:key@sequence of every record returned
+	}{
+		{
+			name:    "plain records",
+			records: [][]byte{[]byte("a"), []byte("b")},
+			want:    []string{"a:key@1", "b:key@2"},
+		},
+		{
+			name:    "aggregated record",
+			records: [][]byte{testAggregatedData("a", "b", "c")},
+			want:    []string{"a:user_1@1", "b:user_2@1", "c:user_1@1"},
+		},
+		{
+			name:    "mixed, in order",
+			records: [][]byte{[]byte("a"), testAggregatedData("b", "c"), []byte("d")},
+			want:    []string{"a:key@1", "b:user_1@2", "c:user_2@2", "d:key@3"},
+		},
+		{
+			name:    "digest mismatch kept as is",
+			records: [][]byte{corrupt},
+			want:    []string{string(corrupt) + ":key@1"},
+		},
+		{
+			name:    "unpackable kept as is",
+			records: [][]byte{unpackable, []byte("b")},
+			want:    []string{string(unpackable) + ":key@1", "b:key@2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var records []*kinesis.Record
+			for i, data := range tt.records {
+				records = append(records, &kinesis.Record{
+					Data:           data,
+					PartitionKey:   aws.String("key"),
+					SequenceNumber: aws.String(fmt.Sprint(i + 1)),
+				})
+			}
+			var got []string
+			for _, record := range deaggregate(testShard, records) {
+				got = append(got, fmt.Sprintf("%s:%s@%s", record.Data, aws.StringValue(record.PartitionKey), aws.StringValue(record.SequenceNumber)))
+			}
+			if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+				t.Errorf("deaggregate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// Defaults applied to unset consumer configuration fields
+const (
+	DefaultRegion          = "us-east-1"
+	DefaultAssignmentMode  = "kcl"
+	DefaultApplicationName = "kds-rebalance-consumer"
+	DefaultMaxRecords      = 10000
+	DefaultPollIntervalMs  = 1000
+)
+
+// ApplyDefaults fills sensible values into optional fields left unset in the
+// config file, so a minimal config cannot produce footguns such as a zero
+// poll interval hammering Kinesis. Every applied default is logged.
+func (c *Config) ApplyDefaults() {
+	var applied []string
+	setString := func(field *string, name, value string) {
+		if *field == "" {
+			*field = value
+			applied = append(applied, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+	setInt := func(field *int, name string, value int) {
+		if *field <= 0 {
+			*field = value
+			applied = append(applied, fmt.Sprintf("%s=%d", name, value))
+		}
+	}
+
+	setString(&c.AWS.Region, "aws.region", DefaultRegion)
+	setString(&c.Consumer.AssignmentMode, "consumer.assignment_mode", DefaultAssignmentMode)
+	setString(&c.Consumer.ApplicationName, "consumer.application_name", DefaultApplicationName)
+	if hostname, err := os.Hostname(); err == nil {
+		setString(&c.Consumer.WorkerID, "consumer.worker_id", hostname)
+	}
+	setInt(&c.Consumer.MaxRecords, "consumer.max_records", DefaultMaxRecords)
+	setInt(&c.Consumer.PollIntervalMs, "consumer.poll_interval_ms", DefaultPollIntervalMs)
+	setString(&c.Consumer.Processor, "consumer.processor", DefaultProcessor)
+	setString(&c.Consumer.OnStreamDeleted, "consumer.on_stream_deleted", OnStreamDeletedExit)
+	setInt(&c.Consumer.ReadBudget.CallsPerSec, "consumer.read_budget.calls_per_sec", DefaultReadCallsPerSec)
+	setInt(&c.Consumer.ReadBudget.BytesPerSec, "consumer.read_budget.bytes_per_sec", DefaultReadBytesPerSec)
+	setString(&c.Consumer.UnknownVersionAction, "consumer.unknown_version_action", UnknownVersionSkip)
+	if c.Consumer.SinkHealth.ProbeIntervalMs > 0 {
+		setInt(&c.Consumer.SinkHealth.FailureThreshold, "consumer.sink_health.failure_threshold", DefaultSinkHealthFailureThreshold)
+	}
+	setString(&c.Consumer.MetricsCardinality, "consumer.metrics_cardinality", MetricsCardinalityPerShard)
+	if c.Consumer.MetricsCardinality == MetricsCardinalityTopN {
+		setInt(&c.Consumer.MetricsTopN, "consumer.metrics_top_n", DefaultMetricsTopN)
+	}
+	setString(&c.Consumer.ShardStartOrder, "consumer.shard_start_order", ShardStartAsAssigned)
+	setString(&c.Consumer.ExecutionModel, "consumer.execution_model", ExecutionModelGoroutinePerShard)
+	if c.Consumer.ExecutionModel == ExecutionModelSharedPool {
+		setInt(&c.Consumer.SharedPoolSize, "consumer.shared_pool_size", DefaultSharedPoolSize)
+	}
+	if c.Consumer.ShardPromotionRPS > 0 {
+		setInt(&c.Consumer.ShardPromotionWindowMs, "consumer.shard_promotion_window_ms", DefaultShardPromotionWindowMs)
+	}
+	if c.Consumer.MaxParseErrorRate > 0 {
+		setInt(&c.Consumer.ParseErrorWindow, "consumer.parse_error_window", DefaultParseErrorWindow)
+		setString(&c.Consumer.ParseErrorAction, "consumer.parse_error_action", ParseErrorActionLog)
+		setInt(&c.Consumer.ParseErrorPauseMs, "consumer.parse_error_pause_ms", DefaultParseErrorPauseMs)
+	}
+	if c.Consumer.DetectOverlap != DetectOverlapOff {
+		setString(&c.Consumer.OverlapTable, "consumer.overlap_table", c.Consumer.ApplicationName+"-shard-claims")
+	}
+	if c.Consumer.Sink.Type == "parquet" {
+		setInt(&c.Consumer.Sink.Parquet.RotateIntervalMs, "consumer.sink.parquet.rotate_interval_ms", DefaultParquetRotateIntervalMs)
+	}
+	if c.Consumer.Sink.Type == "grpc" {
+		setInt(&c.Consumer.Sink.GRPC.MaxInFlight, "consumer.sink.grpc.max_in_flight", DefaultGRPCMaxInFlight)
+		setInt(&c.Consumer.Sink.GRPC.ReconnectBackoffMs, "consumer.sink.grpc.reconnect_backoff_ms", DefaultGRPCReconnectBackoffMs)
+	}
+	if c.Consumer.Sink.Type == "multi" {
+		setString(&c.Consumer.Sink.Multi.Ack, "consumer.sink.multi.ack", MultiSinkAckAll)
+	}
+	if c.Consumer.Sink.Type == "aggregates" {
+		setInt(&c.Consumer.Sink.Aggregates.WindowMs, "consumer.sink.aggregates.window_ms", DefaultAggregatesWindowMs)
+		setInt(&c.Consumer.Sink.Aggregates.BucketMs, "consumer.sink.aggregates.bucket_ms", DefaultAggregatesBucketMs)
+		setInt(&c.Consumer.Sink.Aggregates.MaxActions, "consumer.sink.aggregates.max_actions", DefaultAggregatesMaxActions)
+	}
+	for _, dest := range c.Consumer.Sink.Multi.Sinks {
+		if dest.Type == "parquet" {
+			setInt(&c.Consumer.Sink.Parquet.RotateIntervalMs, "consumer.sink.parquet.rotate_interval_ms", DefaultParquetRotateIntervalMs)
+		}
+		if dest.Type == "grpc" {
+			setInt(&c.Consumer.Sink.GRPC.MaxInFlight, "consumer.sink.grpc.max_in_flight", DefaultGRPCMaxInFlight)
+			setInt(&c.Consumer.Sink.GRPC.ReconnectBackoffMs, "consumer.sink.grpc.reconnect_backoff_ms", DefaultGRPCReconnectBackoffMs)
+		}
+		if dest.Type == "aggregates" {
+			setInt(&c.Consumer.Sink.Aggregates.WindowMs, "consumer.sink.aggregates.window_ms", DefaultAggregatesWindowMs)
+			setInt(&c.Consumer.Sink.Aggregates.BucketMs, "consumer.sink.aggregates.bucket_ms", DefaultAggregatesBucketMs)
+			setInt(&c.Consumer.Sink.Aggregates.MaxActions, "consumer.sink.aggregates.max_actions", DefaultAggregatesMaxActions)
+		}
+	}
+	setInt(&c.Consumer.CheckpointRetry.MaxAttempts, "consumer.checkpoint_retry.max_attempts", DefaultCheckpointRetryAttempts)
+	setInt(&c.Consumer.CheckpointRetry.BaseDelayMs, "consumer.checkpoint_retry.base_delay_ms", DefaultCheckpointRetryBaseDelayMs)
+	if errs := &c.Consumer.Sink.Errors; errs.Transient != "" || errs.Permanent != "" {
+		setString(&errs.Transient, "consumer.sink.errors.transient", SinkErrorActionRetry)
+		setString(&errs.Permanent, "consumer.sink.errors.permanent", SinkErrorActionSkip)
+		setInt(&errs.RetryAttempts, "consumer.sink.errors.retry_attempts", DefaultSinkRetryAttempts)
+		setInt(&errs.RetryBackoffMs, "consumer.sink.errors.retry_backoff_ms", DefaultSinkRetryBackoffMs)
+	}
+	if c.Consumer.Backfill.Bucket != "" {
+		setString(&c.Consumer.Backfill.StartPosition, "consumer.backfill.start_position", BackfillStartBoundary)
+		setInt(&c.Consumer.Backfill.OverlapMs, "consumer.backfill.overlap_ms", DefaultBackfillOverlapMs)
+	}
+	if c.Consumer.LiveView {
+		setInt(&c.Consumer.LiveViewIntervalMs, "consumer.live_view_interval_ms", DefaultLiveViewIntervalMs)
+	}
+	if c.Consumer.Audit.Path != "" {
+		setInt(&c.Consumer.Audit.MaxFileMB, "consumer.audit.max_file_mb", DefaultAuditMaxFileMB)
+		setInt(&c.Consumer.Audit.Buffer, "consumer.audit.buffer", DefaultAuditBuffer)
+		setString(&c.Consumer.Audit.WhenFull, "consumer.audit.when_full", AuditWhenFullDrop)
+	}
+	if c.Consumer.AssignmentMode == "manual" {
+		setInt(&c.Consumer.ShutdownTimeoutMs, "consumer.shutdown_timeout_ms", DefaultShutdownTimeoutMs)
+		setString(&c.Consumer.IteratorType, "consumer.iterator_type", kinesis.ShardIteratorTypeTrimHorizon)
+	}
+	if c.Consumer.ShardLeases.Table != "" {
+		setInt(&c.Consumer.ShardLeases.DurationMs, "consumer.shard_leases.duration_ms", DefaultShardLeaseDurationMs)
+		setInt(&c.Consumer.ShardLeases.RenewIntervalMs, "consumer.shard_leases.renew_interval_ms", DefaultShardLeaseRenewIntervalMs)
+	}
+	if c.Consumer.CheckpointFile != "" {
+		setInt(&c.Consumer.CheckpointIntervalMs, "consumer.checkpoint_interval_ms", DefaultCheckpointIntervalMs)
+	}
+	if c.Consumer.IdempotencyTable.Name != "" {
+		setInt(&c.Consumer.IdempotencyTable.TTLHours, "consumer.idempotency_table.ttl_hours", DefaultIdempotencyTTLHours)
+	}
+	if c.Consumer.InjectLatencyMs > 0 {
+		setString(&c.Consumer.InjectLatencyDistribution, "consumer.inject_latency_distribution", LatencyDistributionFixed)
+	}
+	setString(&c.Consumer.FutureTimestampPolicy, "consumer.future_timestamp_policy", FutureTimestampAccept)
+	setString(&c.Consumer.Ordering, "consumer.ordering", OrderingStrict)
+	setString(&c.Consumer.EmptyBatchAction, "consumer.empty_batch_action", EmptyBatchNone)
+	if c.Consumer.EmptyBatchAction != EmptyBatchNone {
+		setInt(&c.Consumer.EmptyBatchIntervalMs, "consumer.empty_batch_interval_ms", DefaultEmptyBatchIntervalMs)
+	}
+	if c.Consumer.Ordering == OrderingRelaxed {
+		setInt(&c.Consumer.OrderingConcurrency, "consumer.ordering_concurrency", DefaultOrderingConcurrency)
+	}
+	if c.Consumer.HTTPAddr != "" {
+		setInt(&c.Consumer.Scale.TargetLagMs, "consumer.scale.target_lag_ms", DefaultScaleTargetLagMs)
+		setInt(&c.Consumer.Scale.HorizonMs, "consumer.scale.horizon_ms", DefaultScaleHorizonMs)
+		setInt(&c.Consumer.Scale.WindowMs, "consumer.scale.window_ms", DefaultScaleWindowMs)
+	}
+	if c.Consumer.Processor == WindowedProcessorName {
+		setInt(&c.Consumer.WindowMs, "consumer.window_ms", DefaultWindowMs)
+	}
+
+	if len(applied) > 0 {
+		log.Printf("Applied config defaults: %s", strings.Join(applied, ", "))
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyDefaults(t *testing.T) {
+	for _, env := range []string{"AWS_REGION", "AWS_ENDPOINT", "KINESIS_STREAM_NAME"} {
+		t.Setenv(env, "")
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("kinesis:\n  stream_name: test-stream\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+
+	hostname, _ := os.Hostname()
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{name: "aws.region", got: cfg.AWS.Region, want: DefaultRegion},
+		{name: "consumer.assignment_mode", got: cfg.Consumer.AssignmentMode, want: DefaultAssignmentMode},
+		{name: "consumer.application_name", got: cfg.Consumer.ApplicationName, want: DefaultApplicationName},
+		{name: "consumer.worker_id", got: cfg.Consumer.WorkerID, want: hostname},
+		{name: "consumer.max_records", got: cfg.Consumer.MaxRecords, want: DefaultMaxRecords},
+		{name: "consumer.poll_interval_ms", got: cfg.Consumer.PollIntervalMs, want: DefaultPollIntervalMs},
+		{name: "consumer.processor", got: cfg.Consumer.Processor, want: DefaultProcessor},
+		{name: "consumer.ordering", got: cfg.Consumer.Ordering, want: OrderingStrict},
+		{name: "consumer.execution_model", got: cfg.Consumer.ExecutionModel, want: ExecutionModelGoroutinePerShard},
+		{name: "consumer.checkpoint_retry.max_attempts", got: cfg.Consumer.CheckpointRetry.MaxAttempts, want: DefaultCheckpointRetryAttempts},
+		// Only defaulted in manual mode
+		{name: "consumer.iterator_type", got: cfg.Consumer.IteratorType, want: ""},
+		{name: "consumer.shutdown_timeout_ms", got: cfg.Consumer.ShutdownTimeoutMs, want: 0},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
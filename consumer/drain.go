@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// DefaultShutdownTimeoutMs is the default of consumer.shutdown_timeout_ms
+const DefaultShutdownTimeoutMs = 10000
+
+// drain ends a shard stopped by shutdown the way KCL mode's TERMINATE
+// checkpoint does: one last GetRecords call picks up the records written
+// since the last poll, they are handled, the sink's buffer is made durable
+// and the checkpoint file is written, all within consumer.shutdown_timeout_ms.
+// Prefetched batches that were discarded were read past by the iterator, so
+// without shutdown_drain_prefetch the last call is skipped rather than
+// checkpointing over them. At the timeout the GetRecords call is cancelled
+// and handling stops before the next record, leaving that batch
+// uncheckpointed to be read again on restart, and the shard closes at its
+// last checkpoint. It runs on the shard's goroutine, so the
+// consumer waits for it before closing the sink and checkpoint file.
+func (msp *ManualShardProcessor) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), msp.shutdownTimeout)
+	defer cancel()
+
+	handled := msp.recordCount
+	if msp.prefetchBatches == 0 || msp.drainPrefetch {
+		if batch, ok := msp.fetchBatch(ctx); ok && batch != nil {
+			msp.handleBatch(ctx, batch)
+		}
+	}
+	handled = msp.recordCount - handled
+
+	// Closing makes the rest of the buffered records durable and
+	// checkpoints them, so the file is written after it
+	msp.close(ctx)
+	if ctx.Err() != nil {
+		log.Printf("[%s] ALERT: shard did not drain within consumer.shutdown_timeout_ms (%v), stopping at the last checkpointed record",
+			msp.label, msp.shutdownTimeout)
+		return
+	}
+	if err := msp.pc.Checkpoints.Flush(); err != nil {
+		log.Printf("[%s] Failed to write final checkpoint: %v", msp.label, err)
+	}
+	log.Printf("[%s] [Goroutine] Drained %d more records on shutdown. Processed %d records in %.2f seconds",
+		msp.label, handled, msp.recordCount, time.Since(msp.startTime).Seconds())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// hangingKinesis never answers GetRecords until the call is cancelled
+type hangingKinesis struct {
+	*fakeKinesis
+}
+
+func (h hangingKinesis) GetRecordsWithContext(ctx aws.Context, input *kinesis.GetRecordsInput, opts ...request.Option) (*kinesis.GetRecordsOutput, error) {
+	<-ctx.Done()
+	return h.fakeKinesis.GetRecordsWithContext(ctx, input, opts...)
+}
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name           string
+		hang           bool
+		prefetch       int
+		drainPrefetch  bool
+		wantCheckpoint int // index of the record checkpointed, -1 for the one before the drain
+	}{
+		{name: "reads the records written since the last poll", wantCheckpoint: 3},
+		{name: "skips the last read after discarded prefetched batches", prefetch: 2, wantCheckpoint: -1},
+		{name: "reads after prefetched batches it handled", prefetch: 2, drainPrefetch: true, wantCheckpoint: 3},
+		{name: "stops at the timeout", hang: true, wantCheckpoint: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeKinesis(testStream, testShard)
+			seq := fake.AddRecords(t, testShard, "user_1", testEvents(0, 2)...)
+			var client KinesisAPI = fake
+			if tt.hang {
+				client = hangingKinesis{fake}
+			}
+			msp := newTestProcessor(client, &Config{})
+			msp.shutdownTimeout = 50 * time.Millisecond
+			msp.prefetchBatches = tt.prefetch
+			msp.drainPrefetch = tt.drainPrefetch
+			checkpoints := testCheckpoints(testStream, nil)
+			checkpoints.store.path = filepath.Join(t.TempDir(), "checkpoints.json")
+			msp.pc.Checkpoints = checkpoints
+
+			iterator, err := fake.GetShardIterator(&kinesis.GetShardIteratorInput{
+				StreamName:        aws.String(testStream),
+				ShardId:           aws.String(testShard),
+				ShardIteratorType: aws.String(kinesis.ShardIteratorTypeTrimHorizon),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			batch, _ := fake.GetRecords(&kinesis.GetRecordsInput{ShardIterator: iterator.ShardIterator})
+			msp.shardIterator = batch.NextShardIterator
+			msp.handleBatch(context.Background(), &fetchedBatch{records: batch.Records})
+			seq = append(seq, fake.AddRecords(t, testShard, "user_1", testEvents(2, 2)...)...)
+
+			start := time.Now()
+			msp.drain()
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("drain took %v with a %v timeout", elapsed, msp.shutdownTimeout)
+			}
+
+			want := seq[1]
+			if tt.wantCheckpoint >= 0 {
+				want = seq[tt.wantCheckpoint]
+			}
+			if got := checkpoints.store.shards[ShardKey{Stream: testStream, ShardID: testShard}]; got != want {
+				t.Errorf("checkpointed at %s, want %s", got, want)
+			}
+			_, err = os.Stat(checkpoints.store.path)
+			if written := err == nil; written == tt.hang {
+				t.Errorf("checkpoint file written %t, want %t", written, !tt.hang)
+			}
+			if !tt.hang {
+				var state CheckpointFileState
+				data, _ := os.ReadFile(checkpoints.store.path)
+				if err := json.Unmarshal(data, &state); err != nil || state.Streams[testStream][testShard] != want {
+					t.Errorf("checkpoint file holds %v (%v), want %s", state.Streams, err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// tableNamePattern matches the characters DynamoDB allows in table names
+var tableNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// validateTableName checks a DynamoDB table name: 3-255 characters of
+// letters, digits, underscore, hyphen and dot
+func validateTableName(name string) error {
+	if len(name) < 3 || len(name) > 255 {
+		return fmt.Errorf("invalid DynamoDB table name %q: must be 3-255 characters", name)
+	}
+	if !tableNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid DynamoDB table name %q: only letters, digits, '_', '-' and '.' are allowed", name)
+	}
+	return nil
+}
+
+// ensureTable creates a pay-per-request table keyed by a single string
+// attribute if it does not already exist, and waits for it to become active
+func ensureTable(client dynamodbiface.DynamoDBAPI, tableName, hashKey string) error {
+	_, err := client.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if err == nil {
+		return nil
+	}
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeResourceNotFoundException {
+		return fmt.Errorf("failed to describe table %s: %w", tableName, err)
+	}
+
+	log.Printf("Creating DynamoDB table %s", tableName)
+	_, err = client.CreateTable(&dynamodb.CreateTableInput{
+		TableName:   aws.String(tableName),
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String(hashKey), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String(hashKey), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeResourceInUseException {
+			return fmt.Errorf("failed to create table %s: %w", tableName, err)
+		}
+	}
+	return client.WaitUntilTableExists(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+}
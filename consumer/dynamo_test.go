@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vmware/vmware-go-kcl/clientlibrary/config"
+)
+
+func TestApplyLeaseTableName(t *testing.T) {
+	tests := []struct {
+		name      string
+		leases    string
+		wantTable string
+		wantErr   string
+	}{
+		{name: "defaults to the application name", wantTable: "app"},
+		{name: "override", leases: "kds-rebalance.leases_v2", wantTable: "kds-rebalance.leases_v2"},
+		{name: "too short", leases: "ab", wantTable: "app", wantErr: "must be 3-255 characters"},
+		{name: "too long", leases: strings.Repeat("a", 256), wantTable: "app", wantErr: "must be 3-255 characters"},
+		{name: "illegal characters", leases: "leases/prod", wantTable: "app", wantErr: "only letters, digits"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.LeaseTableName = tt.leases
+			kclConfig := config.NewKinesisClientLibConfig("app", testStream, "us-east-1", "worker-1")
+
+			err := applyLeaseTableName(kclConfig, cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("applyLeaseTableName() = %v, want an error with %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Errorf("applyLeaseTableName() = %v", err)
+			}
+			if kclConfig.TableName != tt.wantTable {
+				t.Errorf("lease table %q, want %q", kclConfig.TableName, tt.wantTable)
+			}
+		})
+	}
+}
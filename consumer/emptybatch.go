@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
+)
+
+// consumer.empty_batch_action values. Each action also does the ones before it.
+const (
+	EmptyBatchNone       = "none"
+	EmptyBatchHeartbeat  = "heartbeat"
+	EmptyBatchFlush      = "flush"
+	EmptyBatchCheckpoint = "checkpoint"
+)
+
+// DefaultEmptyBatchIntervalMs is how long a shard stays idle before the empty batch action runs
+const DefaultEmptyBatchIntervalMs = 10000
+
+// emptyBatchFlushTimeout bounds how long an idle shard waits for its buffered sink records
+const emptyBatchFlushTimeout = 5 * time.Second
+
+// validateEmptyBatchAction checks consumer.empty_batch_action. KCL only hands
+// empty batches to the processor with call_process_records_even_for_empty_list,
+// so any action but none needs it.
+func validateEmptyBatchAction(cfg *Config) error {
+	switch cfg.Consumer.EmptyBatchAction {
+	case EmptyBatchNone:
+		return nil
+	case EmptyBatchHeartbeat, EmptyBatchFlush, EmptyBatchCheckpoint:
+	default:
+		return fmt.Errorf("invalid empty_batch_action: %s. Must be '%s', '%s', '%s' or '%s'",
+			cfg.Consumer.EmptyBatchAction, EmptyBatchNone, EmptyBatchHeartbeat, EmptyBatchFlush, EmptyBatchCheckpoint)
+	}
+	if !cfg.Consumer.CallProcessRecordsEvenForEmptyRecordList {
+		return fmt.Errorf("empty_batch_action %q requires call_process_records_even_for_empty_list", cfg.Consumer.EmptyBatchAction)
+	}
+	return nil
+}
+
+// idle runs consumer.empty_batch_action for an empty batch, once the shard has
+// had no records for empty_batch_interval_ms and then again every interval
+// while it stays idle. Without it, records a buffered or Parquet sink only
+// makes durable after the last batch are not checkpointed until more records
+// arrive, and an idle shard looks the same as a stuck one.
+func (rp *RecordProcessor) idle(checkpointer interfaces.IRecordProcessorCheckpointer) {
+	action := rp.pc.Config.Consumer.EmptyBatchAction
+	interval := time.Duration(rp.pc.Config.Consumer.EmptyBatchIntervalMs) * time.Millisecond
+	if action == EmptyBatchNone || time.Since(rp.lastActive) < interval {
+		return
+	}
+	rp.lastActive = time.Now()
+
+	rp.pc.Metrics.IdleHeartbeat(rp.shardID)
+	if action == EmptyBatchHeartbeat {
+		return
+	}
+
+	if rp.delivery != nil && !rp.delivery.WaitDrained(emptyBatchFlushTimeout) {
+		log.Printf("[%s] Idle flush left %d buffered records undelivered", rp.label, rp.delivery.Pending())
+	}
+	if action == EmptyBatchFlush {
+		return
+	}
+
+	// Only what was handled and, with a buffered or Parquet sink, delivered
+	// since the last checkpoint is new
+	sequenceNumber := rp.lastSeen
+	if rp.pool != nil {
+		sequenceNumber = rp.pool.completed()
+	}
+	if rp.delivery != nil {
+		sequenceNumber = rp.delivery.Delivered()
+	}
+	if sequenceNumber == "" || sequenceAtOrBefore(sequenceNumber, rp.lastCheckpoint) {
+		return
+	}
+	if err := rp.pc.Checkpoint(rp.shardID, checkpointer, &sequenceNumber); err != nil {
+		log.Printf("[%s] Failed to checkpoint idle shard: %v", rp.label, err)
+		return
+	}
+	log.Printf("[%s] Checkpointed idle shard at %s", rp.label, sequenceNumber)
+	rp.lastCheckpoint = sequenceNumber
+	rp.rewind.checkpointed(rp.lastCheckpoint)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
+)
+
+func TestEmptyBatchAction(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	tests := []struct {
+		action         string
+		wantHeartbeats int64
+		wantCheckpoint bool
+	}{
+		{action: EmptyBatchNone},
+		{action: EmptyBatchHeartbeat, wantHeartbeats: 1},
+		{action: EmptyBatchFlush, wantHeartbeats: 1},
+		{action: EmptyBatchCheckpoint, wantHeartbeats: 1, wantCheckpoint: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			client := newFakeKinesis(testStream, testShard)
+			sequenceNumbers := client.AddRecords(t, testShard, "user_1", testEvents(0, 3)...)
+			cfg := &Config{}
+			cfg.Kinesis.StreamName = testStream
+			cfg.Consumer.CallProcessRecordsEvenForEmptyRecordList = true
+			cfg.Consumer.EmptyBatchAction = tt.action
+			cfg.Consumer.EmptyBatchIntervalMs = int(interval / time.Millisecond)
+			metrics := NewMetrics()
+			rp := &RecordProcessor{pc: &ProcessorContext{Config: cfg, Sink: discardSink{}, Kinesis: client, Metrics: metrics}}
+			rp.Initialize(&interfaces.InitializationInput{ShardId: testShard})
+
+			// The batch's own checkpoint fails, leaving its records to the idle checkpoint
+			rp.ProcessRecords(&interfaces.ProcessRecordsInput{Records: testKinesisRecords(t, client, 0, 1, 2), Checkpointer: failingCheckpointer{}})
+			checkpointer := &recordingCheckpointer{}
+			empty := &interfaces.ProcessRecordsInput{Checkpointer: checkpointer}
+
+			// Not idle for long enough yet
+			rp.ProcessRecords(empty)
+			if got := metrics.Snapshot()[ShardKey{ShardID: testShard}].IdleHeartbeats; got != 0 {
+				t.Fatalf("ran the action %d times before the shard was idle for the interval", got)
+			}
+
+			time.Sleep(interval + 5*time.Millisecond)
+			rp.ProcessRecords(empty)
+			// The next empty batch comes before another interval has passed
+			rp.ProcessRecords(empty)
+
+			if got := metrics.Snapshot()[ShardKey{ShardID: testShard}].IdleHeartbeats; got != tt.wantHeartbeats {
+				t.Errorf("ran the action %d times, want %d", got, tt.wantHeartbeats)
+			}
+			var want []string
+			if tt.wantCheckpoint {
+				want = []string{sequenceNumbers[2]}
+			}
+			if !slices.Equal(checkpointer.checkpoints, want) {
+				t.Errorf("idle shard checkpointed %v, want %v", checkpointer.checkpoints, want)
+			}
+		})
+	}
+}
+
+func TestValidateEmptyBatchAction(t *testing.T) {
+	tests := []struct {
+		action      string
+		callOnEmpty bool
+		wantErr     string
+	}{
+		{action: EmptyBatchNone},
+		{action: EmptyBatchCheckpoint, callOnEmpty: true},
+		{action: EmptyBatchHeartbeat, wantErr: "requires call_process_records_even_for_empty_list"},
+		{action: "sleep", callOnEmpty: true, wantErr: "invalid empty_batch_action: sleep"},
+	}
+	for _, tt := range tests {
+		cfg := &Config{}
+		cfg.Consumer.EmptyBatchAction = tt.action
+		cfg.Consumer.CallProcessRecordsEvenForEmptyRecordList = tt.callOnEmpty
+		err := validateEmptyBatchAction(cfg)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: validateEmptyBatchAction() = %v", tt.action, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: validateEmptyBatchAction() = %v, want an error with %q", tt.action, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// EndMarkerAction is the action of the sentinel event the producer sends to
+// every shard with producer.end_marker once it has sent all records
+const EndMarkerAction = "__END__"
+
+// EndMarkers implements consumer.stop_on_marker: it stops the consumer once
+// every shard this worker is processing has delivered the producer's end
+// marker, so a test run ends when the data does instead of on a timeout. A
+// nil *EndMarkers never stops anything.
+type EndMarkers struct {
+	shards *ShardRegistry
+	stop   func()
+
+	mu      sync.Mutex
+	seen    map[string]bool
+	stopped bool
+}
+
+// NewEndMarkers returns a tracker calling stop once the end marker was seen
+// on all shards in the registry, or nil unless consumer.stop_on_marker is set
+func NewEndMarkers(cfg *Config, shards *ShardRegistry, stop func()) *EndMarkers {
+	if !cfg.Consumer.StopOnMarker {
+		return nil
+	}
+	return &EndMarkers{shards: shards, stop: stop, seen: make(map[string]bool)}
+}
+
+// Seen records the end marker on a shard
+func (em *EndMarkers) Seen(shardID string) {
+	if em == nil {
+		return
+	}
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	em.seen[shardID] = true
+	em.check("")
+}
+
+// Released rechecks once a shard is no longer processed here, as a parent
+// shard read to its end never receives a marker itself
+func (em *EndMarkers) Released(shardID string) {
+	if em == nil {
+		return
+	}
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	delete(em.seen, shardID)
+	if len(em.seen) > 0 {
+		em.check(shardID)
+	}
+}
+
+// check stops the consumer if every processed shard but the excluded one has seen the marker
+func (em *EndMarkers) check(excluded string) {
+	if em.stopped {
+		return
+	}
+	waiting := 0
+	for _, shardID := range em.shards.Active() {
+		if shardID != excluded && !em.seen[shardID] {
+			waiting++
+		}
+	}
+	if waiting > 0 {
+		log.Printf("End marker seen on %d shards, waiting for %d more", len(em.seen), waiting)
+		return
+	}
+
+	em.stopped = true
+	log.Printf("End marker seen on all %d shards, stopping consumer", len(em.seen))
+	em.stop()
+}
+
+// EndMarker reports whether the event is the producer's end marker, which is
+// not a real event and must not be processed. The marker is recorded for
+// consumer.stop_on_marker.
+func (pc *ProcessorContext) EndMarker(shardID string, event Event) bool {
+	if event.Action != EndMarkerAction {
+		return false
+	}
+	log.Printf("[%s] End marker received", pc.logLabel(shardID))
+	pc.EndMarkers.Seen(shardID)
+	return true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEndMarkers(t *testing.T) {
+	const first, second = "shardId-000000000000", "shardId-000000000001"
+	type step struct {
+		seen, released string
+	}
+	tests := []struct {
+		name      string
+		steps     []step
+		wantStops int
+	}{
+		{name: "waits for every shard", steps: []step{{seen: first}, {seen: first}}},
+		{name: "stops once all shards have seen it", steps: []step{{seen: first}, {seen: second}}, wantStops: 1},
+		{name: "stops once", steps: []step{{seen: first}, {seen: second}, {seen: second}}, wantStops: 1},
+		{name: "a finished parent needs no marker", steps: []step{{seen: first}, {released: second}}, wantStops: 1},
+		{name: "released before any marker", steps: []step{{released: second}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.StopOnMarker = true
+			shards := NewShardRegistry().ForStream(testStream)
+			shards.Register(first, &testRewinder{})
+			shards.Register(second, &testRewinder{})
+			stops := 0
+			markers := NewEndMarkers(cfg, shards, func() { stops++ })
+
+			for _, s := range tt.steps {
+				if s.seen != "" {
+					markers.Seen(s.seen)
+				} else {
+					markers.Released(s.released)
+				}
+			}
+			if stops != tt.wantStops {
+				t.Errorf("stopped %d times, want %d", stops, tt.wantStops)
+			}
+		})
+	}
+
+	if NewEndMarkers(&Config{}, NewShardRegistry(), func() { t.Error("stopped without stop_on_marker") }) != nil {
+		t.Error("NewEndMarkers() without stop_on_marker returned a tracker")
+	}
+}
+
+func TestStopOnMarker(t *testing.T) {
+	shardIDs := []string{"shardId-000000000000", "shardId-000000000001"}
+	client := newFakeKinesis(testStream, shardIDs...)
+	cfg := &Config{}
+	cfg.Kinesis.StreamName = testStream
+	cfg.Consumer.StopOnMarker = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sink := &collectingSink{}
+	pc := &ProcessorContext{Config: cfg, Sink: sink, Shards: NewShardRegistry().ForStream(testStream)}
+	pc.Stop = cancel
+	pc.EndMarkers = NewEndMarkers(cfg, pc.Shards, pc.Stop)
+
+	marker := []byte(fmt.Sprintf(`{"version":1,"event_id":"end","action":%q}`, EndMarkerAction))
+	var want []string
+	want = append(want, client.AddRecords(t, shardIDs[0], "user_1", testEvents(0, 3)...)...)
+	client.AddRecords(t, shardIDs[0], EndMarkerAction, marker)
+	want = append(want, client.AddRecords(t, shardIDs[1], "user_2", testEvents(3, 3)...)...)
+
+	var wg sync.WaitGroup
+	for _, shardID := range shardIDs {
+		msp := newTestProcessor(client, cfg)
+		msp.shardID, msp.label = shardID, shardID
+		msp.pc = pc
+		wg.Add(1)
+		go msp.ProcessShard(ctx, &wg)
+	}
+
+	// Only one shard has delivered the marker, so the consumer keeps running
+	waitFor(t, func() bool { return len(sink.records()) == len(want) })
+	time.Sleep(20 * time.Millisecond)
+	if ctx.Err() != nil {
+		t.Fatal("stopped before every shard delivered the end marker")
+	}
+
+	client.AddRecords(t, shardIDs[1], EndMarkerAction, marker)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer did not stop after the last end marker")
+	}
+	// The markers themselves are not events
+	if got := sink.records(); len(got) != len(want) {
+		t.Errorf("sink received %d records, want the %d events", len(got), len(want))
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/hex"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// TraceparentKey is the event metadata key carrying the W3C trace context
+// the producer's tracer injected
+const TraceparentKey = "traceparent"
+
+// recordLatencyBuckets are the upper bounds, in seconds, of the record
+// latency histogram. The last one catches everything, so even the slowest
+// records keep an exemplar.
+var recordLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, math.Inf(1)}
+
+// traceID returns the trace ID of the event's traceparent metadata, if it
+// holds a valid W3C trace context (version-traceid-parentid-flags)
+func traceID(event *Event) (string, bool) {
+	value, ok := event.Metadata[TraceparentKey].(string)
+	if !ok {
+		return "", false
+	}
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 {
+		return "", false
+	}
+	id, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+	for _, b := range id {
+		if b != 0 {
+			return strings.ToLower(parts[1]), true
+		}
+	}
+	// An all-zero trace ID is invalid
+	return "", false
+}
+
+// Exemplar is the last traced record observed in a histogram bucket
+type Exemplar struct {
+	TraceID string
+	Value   float64
+	Time    time.Time
+}
+
+// LatencyMetrics is the distribution of how long records of one stream took
+// from their event timestamp until their handler finished. Each bucket keeps
+// the last record that carried a trace context as an exemplar, so a latency
+// spike links straight to a trace of one of the slow records.
+type LatencyMetrics struct {
+	Records      int64
+	Seconds      float64    // sum of all record latencies
+	BucketCounts []uint64   // cumulative count of records at or under each of Buckets
+	Buckets      []float64  // upper bounds of BucketCounts
+	Exemplars    []Exemplar // per bucket; a zero Exemplar has no trace
+}
+
+// observe adds one record to the histogram, as the exemplar of its bucket
+// when traceID is set
+func (lm *LatencyMetrics) observe(seconds float64, traceID string, now time.Time) {
+	lm.Records++
+	lm.Seconds += seconds
+	exemplified := false
+	for i, bound := range lm.Buckets {
+		if seconds > bound {
+			continue
+		}
+		lm.BucketCounts[i]++
+		if traceID != "" && !exemplified {
+			lm.Exemplars[i] = Exemplar{TraceID: traceID, Value: seconds, Time: now}
+			exemplified = true
+		}
+	}
+}
+
+func (m *Metrics) latency() *LatencyMetrics {
+	lm, ok := m.store.latencies[m.stream]
+	if !ok {
+		lm = &LatencyMetrics{
+			Buckets:      recordLatencyBuckets,
+			BucketCounts: make([]uint64, len(recordLatencyBuckets)),
+			Exemplars:    make([]Exemplar, len(recordLatencyBuckets)),
+		}
+		m.store.latencies[m.stream] = lm
+	}
+	return lm
+}
+
+// RecordHandled observes the latency of a handled record, with the trace ID
+// of its traceparent metadata as the exemplar
+func (m *Metrics) RecordHandled(event *Event) {
+	if m == nil {
+		return
+	}
+	now := time.Now()
+	// Events timestamped in the future count as no latency
+	seconds := max(now.Sub(event.Timestamp).Seconds(), 0)
+	id, _ := traceID(event)
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.latency().observe(seconds, id, now)
+}
+
+// LatencySnapshot returns a copy of the record latency metrics of every stream
+func (m *Metrics) LatencySnapshot() map[string]LatencyMetrics {
+	if m == nil {
+		return nil
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	snapshot := make(map[string]LatencyMetrics, len(m.store.latencies))
+	for stream, lm := range m.store.latencies {
+		copied := *lm
+		copied.BucketCounts = append([]uint64(nil), lm.BucketCounts...)
+		copied.Exemplars = append([]Exemplar(nil), lm.Exemplars...)
+		snapshot[stream] = copied
+	}
+	return snapshot
+}
+
+// histogramWithExemplars attaches exemplars to the buckets of a constant
+// histogram, which client_golang can't do by itself for collected metrics.
+// Exemplars are only exposed in the OpenMetrics format.
+type histogramWithExemplars struct {
+	prometheus.Metric
+	exemplars []Exemplar // per bucket, in the order of the histogram's buckets
+}
+
+// Write encodes the histogram, adding the exemplar of every bucket that has one
+func (h *histogramWithExemplars) Write(out *dto.Metric) error {
+	if err := h.Metric.Write(out); err != nil {
+		return err
+	}
+	for i, bucket := range out.GetHistogram().GetBucket() {
+		if i >= len(h.exemplars) || h.exemplars[i].TraceID == "" {
+			continue
+		}
+		e := h.exemplars[i]
+		bucket.Exemplar = &dto.Exemplar{
+			Label:     []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String(e.TraceID)}},
+			Value:     proto.Float64(e.Value),
+			Timestamp: timestamppb.New(e.Time),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceID(t *testing.T) {
+	const id = "4bf92f3577b34da6a3ce929d0e0e4736"
+	tests := []struct {
+		name   string
+		value  any
+		want   string
+		wantOK bool
+	}{
+		{name: "valid", value: "00-" + id + "-00f067aa0ba902b7-01", want: id, wantOK: true},
+		{name: "upper case", value: "00-" + strings.ToUpper(id) + "-00f067aa0ba902b7-01", want: id, wantOK: true},
+		{name: "missing"},
+		{name: "not a string", value: 42},
+		{name: "too few parts", value: "00-" + id},
+		{name: "short trace ID", value: "00-4bf92f35-00f067aa0ba902b7-01"},
+		{name: "not hex", value: "00-" + strings.Repeat("z", 32) + "-00f067aa0ba902b7-01"},
+		{name: "all zero", value: "00-" + strings.Repeat("0", 32) + "-00f067aa0ba902b7-01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := &Event{Metadata: map[string]interface{}{}}
+			if tt.value != nil {
+				event.Metadata[TraceparentKey] = tt.value
+			}
+			got, ok := traceID(event)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("traceID() = %q, %t; want %q, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRecordLatencyExemplars(t *testing.T) {
+	const traced = "4bf92f3577b34da6a3ce929d0e0e4736"
+	cfg := &Config{}
+	metrics := NewMetrics()
+	pc := &ProcessorContext{Config: cfg, Metrics: metrics}
+	handler := pc.ShardHandler(discardSink{})
+
+	// A traced record about 2s old and an untraced one just written
+	records := testSinkRecords(0, 2)
+	records[0].Event.Timestamp = time.Now().Add(-2 * time.Second)
+	records[0].Event.Metadata = map[string]interface{}{TraceparentKey: "00-" + traced + "-00f067aa0ba902b7-01"}
+	records[1].Event.Timestamp = time.Now()
+	for _, record := range records {
+		if err := pc.HandleRecord(handler, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lm := metrics.LatencySnapshot()[""]
+	if lm.Records != 2 {
+		t.Fatalf("observed %d records, want 2", lm.Records)
+	}
+	for i, bound := range lm.Buckets {
+		wantTrace := ""
+		if bound == 2.5 {
+			wantTrace = traced
+		}
+		if lm.Exemplars[i].TraceID != wantTrace {
+			t.Errorf("bucket le=%g has exemplar %q, want %q", bound, lm.Exemplars[i].TraceID, wantTrace)
+		}
+	}
+
+	// Exemplars are exposed to scrapers asking for OpenMetrics
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	w := httptest.NewRecorder()
+	newMetricsHandler(cfg, metrics).ServeHTTP(w, r)
+	want := `consumer_record_latency_seconds_bucket{stream="",worker_id="",le="2.5"} 2 # {trace_id="` + traced + `"}`
+	if !strings.Contains(w.Body.String(), want) {
+		t.Errorf("/metrics does not expose %s:\n%s", want, w.Body.String())
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// eventFields lists the JSON keys of Event in declaration order
+var eventFields = func() []string {
+	t := reflect.TypeOf(Event{})
+	fields := make([]string, t.NumField())
+	for i := range fields {
+		fields[i], _, _ = strings.Cut(t.Field(i).Tag.Get("json"), ",")
+	}
+	return fields
+}()
+
+// FieldMapping decodes events whose JSON keys were renamed by the
+// producer's producer.field_mapping, given the same mapping. Keys not in
+// the mapping decode as usual. A nil *FieldMapping decodes events unchanged.
+type FieldMapping struct {
+	fields map[string]string // renamed key -> Event JSON key
+}
+
+// NewFieldMapping validates consumer.field_mapping, returning nil when it
+// is empty: every key must be an Event field and no two fields may be read
+// from the same name
+func NewFieldMapping(cfg *Config) (*FieldMapping, error) {
+	mapping := cfg.Consumer.FieldMapping
+	if len(mapping) == 0 {
+		return nil, nil
+	}
+
+	fields := make(map[string]string, len(eventFields))
+	for _, field := range eventFields {
+		name := field
+		if renamed, ok := mapping[field]; ok {
+			if renamed == "" {
+				return nil, fmt.Errorf("field_mapping for %s is empty", field)
+			}
+			name = renamed
+		}
+		if other, ok := fields[name]; ok {
+			return nil, fmt.Errorf("field_mapping maps both %s and %s to %s", other, field, name)
+		}
+		fields[name] = field
+	}
+	for field := range mapping {
+		if !slices.Contains(eventFields, field) {
+			return nil, fmt.Errorf("invalid field_mapping key: %s. Must be one of %s", field, strings.Join(eventFields, ", "))
+		}
+	}
+	return &FieldMapping{fields: fields}, nil
+}
+
+// Key returns the JSON key an Event field is read from
+func (m *FieldMapping) Key(field string) string {
+	if m == nil {
+		return field
+	}
+	for name, mapped := range m.fields {
+		if mapped == field {
+			return name
+		}
+	}
+	return field
+}
+
+// Unmarshal decodes data into event, reading each field from its mapped key
+func (m *FieldMapping) Unmarshal(data []byte, event *Event) error {
+	if m == nil {
+		return json.Unmarshal(data, event)
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	renamed := make(map[string]json.RawMessage, len(values))
+	for name, value := range values {
+		// Only the mapped names fill Event fields, so a stray original key
+		// can't shadow the renamed one
+		if field, ok := m.fields[name]; ok {
+			renamed[field] = value
+		}
+	}
+	data, err := json.Marshal(renamed)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, event)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// mappedEvent is an event as the producer writes it with user_id and
+// event_id renamed, matching the producer's TestFieldMappingMarshal
+const mappedEvent = `{"version":1,"id":"evt_1","uid":"user_7","timestamp":"2026-01-01T12:00:00Z","action":"purchase","value":12.5,"metadata":{"source":"web"}}`
+
+func TestFieldMappingRoundTrip(t *testing.T) {
+	want := Event{
+		Version:   EventVersion,
+		EventID:   "evt_1",
+		UserID:    "user_7",
+		Timestamp: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC),
+		Action:    "purchase",
+		Value:     12.5,
+		Metadata:  map[string]interface{}{"source": "web"},
+	}
+	tests := []struct {
+		name    string
+		mapping map[string]string
+		want    Event
+	}{
+		{name: "matching mapping", mapping: map[string]string{"user_id": "uid", "event_id": "id"}, want: want},
+		// The renamed keys are not read without the mapping
+		{name: "no mapping", want: Event{Version: want.Version, Timestamp: want.Timestamp, Action: want.Action, Value: want.Value, Metadata: want.Metadata}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.FieldMapping = tt.mapping
+			fields, err := NewFieldMapping(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pc := &ProcessorContext{Config: cfg, Fields: fields}
+			event, err := pc.DecodeEvent(testShard, &kinesis.Record{Data: []byte(mappedEvent)})
+			if err != nil {
+				t.Fatalf("DecodeEvent() = %v", err)
+			}
+			if !reflect.DeepEqual(event, tt.want) {
+				t.Errorf("decoded %+v, want %+v", event, tt.want)
+			}
+		})
+	}
+}
+
+func TestFieldMappingKey(t *testing.T) {
+	cfg := &Config{}
+	cfg.Consumer.FieldMapping = map[string]string{"user_id": "uid"}
+	fields, err := NewFieldMapping(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for field, want := range map[string]string{"user_id": "uid", "action": "action"} {
+		if got := fields.Key(field); got != want {
+			t.Errorf("Key(%s) = %s, want %s", field, got, want)
+		}
+	}
+	if got := (*FieldMapping)(nil).Key("user_id"); got != "user_id" {
+		t.Errorf("Key(user_id) without a mapping = %s", got)
+	}
+
+	cfg.Consumer.FieldMapping = map[string]string{"user_id": "action"}
+	if _, err := NewFieldMapping(cfg); err == nil {
+		t.Error("NewFieldMapping() accepted two fields read from one key")
+	}
+}
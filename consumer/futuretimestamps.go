@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// consumer.future_timestamp_policy values
+const (
+	FutureTimestampAccept     = "accept"
+	FutureTimestampClampToNow = "clamp_to_now"
+	FutureTimestampDrop       = "drop"
+)
+
+// ErrFutureTimestamp is returned by DecodeEvent for an event dropped by the
+// "drop" future timestamp policy
+var ErrFutureTimestamp = errors.New("event timestamp is in the future")
+
+// FutureTimestampPolicy handles events whose timestamp is ahead of the
+// consumer's clock by more than the tolerance, from producer clock skew or
+// deliberately injected: they would show negative lag and open windows
+// ahead of the watermark. Every such event is counted; "accept" keeps it
+// as is, "clamp_to_now" replaces its timestamp with the current time and
+// "drop" skips the record. A nil *FutureTimestampPolicy accepts everything
+// without counting.
+type FutureTimestampPolicy struct {
+	labels    shardLabeler
+	policy    string
+	tolerance time.Duration
+	metrics   *Metrics
+}
+
+// NewFutureTimestampPolicy returns the policy for consumer.future_timestamp_policy
+func NewFutureTimestampPolicy(cfg *Config, metrics *Metrics) (*FutureTimestampPolicy, error) {
+	policy := cfg.Consumer.FutureTimestampPolicy
+	switch policy {
+	case FutureTimestampAccept, FutureTimestampClampToNow, FutureTimestampDrop:
+	default:
+		return nil, fmt.Errorf("invalid future_timestamp_policy: %s. Must be '%s', '%s' or '%s'",
+			policy, FutureTimestampAccept, FutureTimestampClampToNow, FutureTimestampDrop)
+	}
+	return &FutureTimestampPolicy{
+		labels:    newShardLabeler(cfg),
+		policy:    policy,
+		tolerance: time.Duration(cfg.Consumer.FutureTimestampSkewMs) * time.Millisecond,
+		metrics:   metrics,
+	}, nil
+}
+
+// Apply checks the event's timestamp against now, clamping it under
+// "clamp_to_now", and returns ErrFutureTimestamp if the record is dropped
+func (p *FutureTimestampPolicy) Apply(shardID string, event *Event, now time.Time) error {
+	if p == nil || !event.Timestamp.After(now.Add(p.tolerance)) {
+		return nil
+	}
+	p.metrics.FutureTimestamp(shardID)
+	ahead := event.Timestamp.Sub(now).Round(time.Millisecond)
+
+	switch p.policy {
+	case FutureTimestampClampToNow:
+		log.Printf("[%s] Event %s timestamp is %v in the future, clamping it to now", p.labels.logLabel(shardID), event.EventID, ahead)
+		event.Timestamp = now
+	case FutureTimestampDrop:
+		log.Printf("[%s] Event %s timestamp is %v in the future, dropping it", p.labels.logLabel(shardID), event.EventID, ahead)
+		return ErrFutureTimestamp
+	default:
+		log.Printf("[%s] Event %s timestamp is %v in the future, accepting it", p.labels.logLabel(shardID), event.EventID, ahead)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestFutureTimestampPolicy(t *testing.T) {
+	const skew = time.Minute
+	tests := []struct {
+		name        string
+		policy      string
+		ahead       time.Duration
+		wantErr     error
+		wantClamped bool
+		wantCounted int64
+	}{
+		{name: "past timestamp", policy: FutureTimestampDrop, ahead: -time.Hour},
+		{name: "within the skew", policy: FutureTimestampDrop, ahead: skew / 2},
+		{name: "accepted", policy: FutureTimestampAccept, ahead: time.Hour, wantCounted: 1},
+		{name: "clamped to now", policy: FutureTimestampClampToNow, ahead: time.Hour, wantClamped: true, wantCounted: 1},
+		{name: "dropped", policy: FutureTimestampDrop, ahead: time.Hour, wantErr: ErrFutureTimestamp, wantCounted: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.FutureTimestampPolicy = tt.policy
+			cfg.Consumer.FutureTimestampSkewMs = int(skew / time.Millisecond)
+			metrics := NewMetrics()
+			policy, err := NewFutureTimestampPolicy(cfg, metrics)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pc := &ProcessorContext{Config: cfg, FutureTimestamps: policy}
+
+			stamped := time.Now().Add(tt.ahead).Truncate(time.Millisecond)
+			data, err := json.Marshal(Event{Version: EventVersion, EventID: "evt_0", Timestamp: stamped})
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := time.Now()
+			event, err := pc.DecodeEvent(testShard, &kinesis.Record{Data: data})
+			if err != tt.wantErr {
+				t.Fatalf("DecodeEvent() = %v, want %v", err, tt.wantErr)
+			}
+
+			switch {
+			case tt.wantErr != nil:
+			case tt.wantClamped:
+				if event.Timestamp.Before(before) || event.Timestamp.After(time.Now()) {
+					t.Errorf("timestamp %v, want it clamped to now", event.Timestamp)
+				}
+			case !event.Timestamp.Equal(stamped):
+				t.Errorf("timestamp %v, want it kept at %v", event.Timestamp, stamped)
+			}
+			if got := metrics.Snapshot()[ShardKey{ShardID: testShard}].FutureTimestamps; got != tt.wantCounted {
+				t.Errorf("counted %d future timestamps, want %d", got, tt.wantCounted)
+			}
+		})
+	}
+
+	cfg := &Config{}
+	cfg.Consumer.FutureTimestampPolicy = "reject"
+	if _, err := NewFutureTimestampPolicy(cfg, nil); err == nil {
+		t.Error("NewFutureTimestampPolicy() accepted an unknown policy")
+	}
+}
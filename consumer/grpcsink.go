@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Defaults for the gRPC sink
+const (
+	DefaultGRPCMaxInFlight        = 1000
+	DefaultGRPCReconnectBackoffMs = 500
+
+	// maxGRPCReconnectBackoff caps the doubling backoff between reconnects
+	maxGRPCReconnectBackoff = 30 * time.Second
+)
+
+// grpcStreamEventsMethod is EventService.StreamEvents from events.proto
+const grpcStreamEventsMethod = "/kdsrebalance.events.v1.EventService/StreamEvents"
+
+var grpcStreamEventsDesc = &grpc.StreamDesc{
+	StreamName:    "StreamEvents",
+	ClientStreams: true,
+	ServerStreams: true,
+}
+
+// ErrSinkClosed is returned for a write to a shard writer that has been closed
+var ErrSinkClosed = errors.New("sink is closed")
+
+// GRPCSink streams events to an EventService (see events.proto) with one
+// StreamEvents call per shard. Events are sent in sequence order and only
+// count as delivered once the server acknowledges them, so processors
+// checkpoint behind the acknowledgements. A broken stream is reopened with
+// backoff and every unacknowledged event is sent again, in order.
+type GRPCSink struct {
+	conn        *grpc.ClientConn
+	stream      string
+	labels      shardLabeler
+	maxInFlight int
+	backoff     time.Duration
+
+	mu     sync.Mutex
+	shards map[string]*GRPCShardWriter
+}
+
+// NewGRPCSink creates the client connection; streams are opened per shard on first use
+func NewGRPCSink(cfg *Config) (*GRPCSink, error) {
+	grpcCfg := cfg.Consumer.Sink.GRPC
+	if grpcCfg.Address == "" {
+		return nil, fmt.Errorf("grpc sink requires consumer.sink.grpc.address")
+	}
+
+	transport := insecure.NewCredentials()
+	if grpcCfg.TLS {
+		transport = credentials.NewClientTLSFromCert(nil, "")
+	}
+	conn, err := grpc.NewClient(grpcCfg.Address,
+		grpc.WithTransportCredentials(transport),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(eventCodec{})))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create grpc client for %s: %w", grpcCfg.Address, err)
+	}
+
+	return &GRPCSink{
+		conn:        conn,
+		stream:      cfg.Kinesis.StreamName,
+		labels:      newShardLabeler(cfg),
+		maxInFlight: grpcCfg.MaxInFlight,
+		backoff:     time.Duration(grpcCfg.ReconnectBackoffMs) * time.Millisecond,
+		shards:      make(map[string]*GRPCShardWriter),
+	}, nil
+}
+
+// ShardWriter returns the writer streaming a shard's events, starting it if needed
+func (gs *GRPCSink) ShardWriter(shardID string) ShardWriter {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	writer, ok := gs.shards[shardID]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		writer = &GRPCShardWriter{sink: gs, shardID: shardID, label: gs.labels.logLabel(shardID), cancel: cancel, done: make(chan struct{})}
+		writer.changed = sync.NewCond(&writer.mu)
+		gs.shards[shardID] = writer
+		go writer.run(ctx)
+	}
+	return writer
+}
+
+// Write queues the record on the stream of its shard
+func (gs *GRPCSink) Write(record *SinkRecord) error {
+	return gs.ShardWriter(record.ShardID).Write(record)
+}
+
+// Probe reports whether the connection to the server is up, connecting it if it is idle
+func (gs *GRPCSink) Probe(ctx context.Context) error {
+	for {
+		state := gs.conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.Idle:
+			gs.conn.Connect()
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			return fmt.Errorf("grpc connection is %s", state)
+		}
+		if !gs.conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("grpc connection still %s: %w", state, ctx.Err())
+		}
+	}
+}
+
+// Close stops every shard stream and closes the connection
+func (gs *GRPCSink) Close() error {
+	gs.mu.Lock()
+	writers := make([]*GRPCShardWriter, 0, len(gs.shards))
+	for _, writer := range gs.shards {
+		writers = append(writers, writer)
+	}
+	gs.mu.Unlock()
+
+	for _, writer := range writers {
+		writer.Close()
+	}
+	return gs.conn.Close()
+}
+
+// GRPCShardWriter streams one shard's events. Events stay queued from Write
+// until the server acknowledges them.
+type GRPCShardWriter struct {
+	sink    *GRPCSink
+	shardID string
+	label   string // shardID as logged
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	mu        sync.Mutex
+	changed   *sync.Cond   // signalled on new events, acks, a broken stream and close
+	pending   []*grpcEvent // unacknowledged events in sequence order
+	sent      int          // how many of pending went out on the current stream
+	attempt   int          // counts streams, so a stale stream cannot break its successor
+	broken    error        // error that ended the current stream
+	delivered string
+	closed    bool
+}
+
+// Write queues the record, blocking while max_in_flight events are unacknowledged
+func (gw *GRPCShardWriter) Write(record *SinkRecord) error {
+	event, err := newGRPCEvent(gw.sink.stream, record)
+	if err != nil {
+		return err
+	}
+
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	for len(gw.pending) >= gw.sink.maxInFlight && !gw.closed {
+		gw.changed.Wait()
+	}
+	if gw.closed {
+		return ErrSinkClosed
+	}
+	gw.pending = append(gw.pending, event)
+	gw.changed.Broadcast()
+	return nil
+}
+
+// run keeps a stream open for the shard until the writer is closed
+func (gw *GRPCShardWriter) run(ctx context.Context) {
+	defer close(gw.done)
+	backoff := gw.sink.backoff
+	for ctx.Err() == nil {
+		err := gw.stream(ctx)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+
+		gw.mu.Lock()
+		unacked := len(gw.pending)
+		gw.mu.Unlock()
+		log.Printf("[%s] gRPC stream failed, reconnecting in %v with %d unacknowledged events: %v",
+			gw.label, backoff, unacked, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxGRPCReconnectBackoff)
+	}
+}
+
+// stream sends the shard's events on one StreamEvents call, starting over
+// from the first unacknowledged event. It returns nil once the writer is
+// closed and the error that broke the stream otherwise.
+func (gw *GRPCShardWriter) stream(ctx context.Context) error {
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := gw.sink.conn.NewStream(streamCtx, grpcStreamEventsDesc, grpcStreamEventsMethod)
+	if err != nil {
+		return err
+	}
+
+	gw.mu.Lock()
+	gw.attempt++
+	attempt := gw.attempt
+	gw.sent = 0
+	gw.broken = nil
+	gw.mu.Unlock()
+
+	go gw.receiveAcks(stream, attempt)
+
+	for {
+		gw.mu.Lock()
+		for gw.sent == len(gw.pending) && gw.broken == nil && !gw.closed {
+			gw.changed.Wait()
+		}
+		if gw.closed {
+			gw.mu.Unlock()
+			return nil
+		}
+		if gw.broken != nil {
+			err := gw.broken
+			gw.mu.Unlock()
+			return err
+		}
+		event := gw.pending[gw.sent]
+		gw.sent++
+		gw.mu.Unlock()
+
+		if err := stream.SendMsg(event); err != nil {
+			gw.breakStream(attempt, err)
+		}
+	}
+}
+
+// receiveAcks applies the server's acknowledgements until the stream ends
+func (gw *GRPCShardWriter) receiveAcks(stream grpc.ClientStream, attempt int) {
+	for {
+		var ack grpcAck
+		if err := stream.RecvMsg(&ack); err != nil {
+			gw.breakStream(attempt, err)
+			return
+		}
+		gw.acknowledge(ack.SequenceNumber)
+	}
+}
+
+// acknowledge drops every pending event up to and including the sequence number
+func (gw *GRPCShardWriter) acknowledge(sequenceNumber string) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	for i, event := range gw.pending {
+		if event.SequenceNumber != sequenceNumber {
+			continue
+		}
+		clear(gw.pending[:i+1])
+		gw.pending = gw.pending[i+1:]
+		gw.sent = max(gw.sent-(i+1), 0)
+		gw.delivered = sequenceNumber
+		gw.changed.Broadcast()
+		return
+	}
+	log.Printf("[%s] gRPC server acknowledged unknown sequence number %s", gw.label, sequenceNumber)
+}
+
+// breakStream ends the stream of the given attempt with err
+func (gw *GRPCShardWriter) breakStream(attempt int, err error) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	if attempt == gw.attempt && gw.broken == nil {
+		gw.broken = err
+		gw.changed.Broadcast()
+	}
+}
+
+// Delivered returns the sequence number of the last acknowledged event
+func (gw *GRPCShardWriter) Delivered() string {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return gw.delivered
+}
+
+// Pending returns the number of unacknowledged events
+func (gw *GRPCShardWriter) Pending() int {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return len(gw.pending)
+}
+
+// WaitDrained blocks until every event is acknowledged or the timeout expires
+func (gw *GRPCShardWriter) WaitDrained(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for gw.Pending() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+// Close ends the shard's stream and detaches the writer from the sink.
+// Unacknowledged events were never checkpointed and are sent again by
+// whoever owns the shard next.
+func (gw *GRPCShardWriter) Close() error {
+	gw.sink.mu.Lock()
+	if gw.sink.shards[gw.shardID] == gw {
+		delete(gw.sink.shards, gw.shardID)
+	}
+	gw.sink.mu.Unlock()
+
+	gw.mu.Lock()
+	gw.closed = true
+	gw.changed.Broadcast()
+	gw.mu.Unlock()
+
+	gw.cancel()
+	<-gw.done
+	return nil
+}
+
+// grpcEvent is the Event message of events.proto
+type grpcEvent struct {
+	Stream          string
+	ShardID         string
+	SequenceNumber  string
+	PartitionKey    string
+	EventID         string
+	UserID          string
+	TimestampUnixMs int64
+	Action          string
+	Value           float64
+	MetadataJSON    string
+}
+
+func newGRPCEvent(stream string, record *SinkRecord) (*grpcEvent, error) {
+	metadata, err := json.Marshal(record.Event.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	return &grpcEvent{
+		Stream:          stream,
+		ShardID:         record.ShardID,
+		SequenceNumber:  record.SequenceNumber,
+		PartitionKey:    record.PartitionKey,
+		EventID:         record.Event.EventID,
+		UserID:          record.Event.UserID,
+		TimestampUnixMs: record.Event.Timestamp.UnixMilli(),
+		Action:          record.Event.Action,
+		Value:           record.Event.Value,
+		MetadataJSON:    string(metadata),
+	}, nil
+}
+
+// grpcAck is the Ack message of events.proto
+type grpcAck struct {
+	SequenceNumber string
+}
+
+// eventCodec encodes the events.proto messages in the protobuf wire format
+// by hand, so the sink needs no generated code
+type eventCodec struct{}
+
+// Name is "proto" so servers see a regular protobuf content type
+func (eventCodec) Name() string {
+	return "proto"
+}
+
+// Marshal encodes an Event or an Ack
+func (eventCodec) Marshal(v any) ([]byte, error) {
+	appendString := func(b []byte, num protowire.Number, s string) []byte {
+		if s == "" {
+			return b
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendString(b, s)
+	}
+
+	switch m := v.(type) {
+	case *grpcEvent:
+		var b []byte
+		b = appendString(b, 1, m.Stream)
+		b = appendString(b, 2, m.ShardID)
+		b = appendString(b, 3, m.SequenceNumber)
+		b = appendString(b, 4, m.PartitionKey)
+		b = appendString(b, 5, m.EventID)
+		b = appendString(b, 6, m.UserID)
+		if m.TimestampUnixMs != 0 {
+			b = protowire.AppendTag(b, 7, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(m.TimestampUnixMs))
+		}
+		b = appendString(b, 8, m.Action)
+		if m.Value != 0 {
+			b = protowire.AppendTag(b, 9, protowire.Fixed64Type)
+			b = protowire.AppendFixed64(b, math.Float64bits(m.Value))
+		}
+		b = appendString(b, 10, m.MetadataJSON)
+		return b, nil
+	case *grpcAck:
+		return appendString(nil, 1, m.SequenceNumber), nil
+	default:
+		return nil, fmt.Errorf("cannot encode %T", v)
+	}
+}
+
+// Unmarshal decodes an Ack; the consumer never receives Events
+func (eventCodec) Unmarshal(data []byte, v any) error {
+	ack, ok := v.(*grpcAck)
+	if !ok {
+		return fmt.Errorf("cannot decode %T", v)
+	}
+	*ack = grpcAck{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if num == 1 && typ == protowire.BytesType {
+			s, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			ack.SequenceNumber = s
+			data = data[n:]
+			continue
+		}
+		// Skip fields added to Ack later
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeGRPCEvent decodes an Event message as a server would
+func decodeGRPCEvent(data []byte) (*grpcEvent, error) {
+	event := &grpcEvent{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+		switch typ {
+		case protowire.BytesType:
+			s, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			fields := map[protowire.Number]*string{1: &event.Stream, 2: &event.ShardID, 3: &event.SequenceNumber,
+				4: &event.PartitionKey, 5: &event.EventID, 6: &event.UserID, 8: &event.Action, 10: &event.MetadataJSON}
+			if field, ok := fields[num]; ok {
+				*field = s
+			}
+			data = data[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			event.TimestampUnixMs = int64(v)
+			data = data[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(data)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			event.Value = math.Float64frombits(v)
+			data = data[n:]
+		default:
+			return nil, fmt.Errorf("unexpected wire type %d", typ)
+		}
+	}
+	return event, nil
+}
+
+func TestEventCodec(t *testing.T) {
+	record := testSinkRecords(7, 1)[0]
+	record.Event.UserID = "user_1"
+	record.Event.Value = 12.5
+	record.Event.Timestamp = time.UnixMilli(1700000000123)
+	record.Event.Metadata = map[string]interface{}{"device": "mobile"}
+	event, err := newGRPCEvent(testStream, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := eventCodec{}.Marshal(event)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	decoded, err := decodeGRPCEvent(data)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if *decoded != *event {
+		t.Errorf("decoded %+v, want %+v", *decoded, *event)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "ack", data: protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), "42"), want: "42"},
+		{name: "empty ack", data: nil, want: ""},
+		{name: "unknown fields skipped", data: protowire.AppendString(protowire.AppendTag(
+			protowire.AppendVarint(protowire.AppendTag(nil, 2, protowire.VarintType), 9), 1, protowire.BytesType), "42"), want: "42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ack := grpcAck{SequenceNumber: "stale"}
+			if err := (eventCodec{}).Unmarshal(tt.data, &ack); err != nil || ack.SequenceNumber != tt.want {
+				t.Errorf("Unmarshal = %q, %v; want %q", ack.SequenceNumber, err, tt.want)
+			}
+			encoded, _ := eventCodec{}.Marshal(&grpcAck{SequenceNumber: tt.want})
+			if err := (eventCodec{}).Unmarshal(encoded, &ack); err != nil || ack.SequenceNumber != tt.want {
+				t.Errorf("round trip = %q, %v; want %q", ack.SequenceNumber, err, tt.want)
+			}
+		})
+	}
+}
+
+// rawFrame is a message the test server passes through undecoded
+type rawFrame []byte
+
+// testServerCodec lets the test server read Events and write Acks
+type testServerCodec struct{}
+
+func (testServerCodec) Name() string { return "proto" }
+
+func (testServerCodec) Marshal(v any) ([]byte, error) {
+	return eventCodec{}.Marshal(v)
+}
+
+func (testServerCodec) Unmarshal(data []byte, v any) error {
+	*v.(*rawFrame) = append(rawFrame(nil), data...)
+	return nil
+}
+
+// testEventServer serves StreamEvents, acknowledging every event. The
+// first stream breaks after breakAfter events, leaving the last unacknowledged.
+type testEventServer struct {
+	breakAfter int
+
+	mu       sync.Mutex
+	streams  int
+	received []string // sequence numbers in the order they arrived
+}
+
+func (s *testEventServer) streamEvents(_ any, stream grpc.ServerStream) error {
+	s.mu.Lock()
+	s.streams++
+	first := s.streams == 1
+	s.mu.Unlock()
+
+	for n := 1; ; n++ {
+		var frame rawFrame
+		if err := stream.RecvMsg(&frame); err != nil {
+			return nil
+		}
+		event, err := decodeGRPCEvent(frame)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.received = append(s.received, event.SequenceNumber)
+		s.mu.Unlock()
+		if first && n == s.breakAfter {
+			return fmt.Errorf("stream broken by the test")
+		}
+		if err := stream.SendMsg(&grpcAck{SequenceNumber: event.SequenceNumber}); err != nil {
+			return err
+		}
+	}
+}
+
+// start serves on a loopback port and returns its address
+func (s *testEventServer) start(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.ForceServerCodec(testServerCodec{}))
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "kdsrebalance.events.v1.EventService",
+		HandlerType: (*any)(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "StreamEvents",
+			Handler:       s.streamEvents,
+			ServerStreams: true,
+			ClientStreams: true,
+		}},
+	}, s)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func TestGRPCSink(t *testing.T) {
+	tests := []struct {
+		name         string
+		breakAfter   int
+		wantReceived []string
+	}{
+		{name: "acknowledged in order", wantReceived: []string{"0", "1", "2", "3", "4"}},
+		{name: "unacknowledged events resent after a reconnect", breakAfter: 3,
+			wantReceived: []string{"0", "1", "2", "2", "3", "4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &testEventServer{breakAfter: tt.breakAfter}
+			cfg := &Config{}
+			cfg.Kinesis.StreamName = testStream
+			cfg.Consumer.Sink.GRPC.Address = server.start(t)
+			cfg.Consumer.Sink.GRPC.MaxInFlight = 1
+			cfg.Consumer.Sink.GRPC.ReconnectBackoffMs = 1
+			sink, err := NewGRPCSink(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sink.Close()
+
+			writer := sink.ShardWriter(testShard).(*GRPCShardWriter)
+			for _, record := range testSinkRecords(0, 5) {
+				if err := writer.Write(record); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+			}
+			if !writer.WaitDrained(5 * time.Second) {
+				t.Fatalf("%d events still unacknowledged", writer.Pending())
+			}
+			if writer.Delivered() != "4" {
+				t.Errorf("delivered up to %q, want 4", writer.Delivered())
+			}
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			if fmt.Sprint(server.received) != fmt.Sprint(tt.wantReceived) {
+				t.Errorf("server received %v, want %v", server.received, tt.wantReceived)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrHandlerTimeout is returned when an event handler exceeds consumer.handler_timeout_ms
+var ErrHandlerTimeout = errors.New("handler timed out")
+
+// ErrDuplicateEvent is the reason a record whose event ID was already handled is skipped
+var ErrDuplicateEvent = errors.New("event ID already handled")
+
+// EventHandler does the per-record work for a shard once the record has been
+// decoded. Handlers must return promptly once ctx is cancelled: a timed-out
+// handler is abandoned rather than killed, so one that ignores its context
+// keeps running in the background after the record has been skipped. Its
+// sink write is dropped once the record has been skipped, so the sink never
+// receives a record the consumer moved past.
+type EventHandler interface {
+	Handle(ctx context.Context, record *SinkRecord) error
+}
+
+// EventHandlerFunc adapts a function to the EventHandler interface
+type EventHandlerFunc func(ctx context.Context, record *SinkRecord) error
+
+// Handle calls f(ctx, record)
+func (f EventHandlerFunc) Handle(ctx context.Context, record *SinkRecord) error {
+	return f(ctx, record)
+}
+
+var (
+	streamHandlerMu sync.RWMutex
+	streamHandler   EventHandler
+)
+
+// SetStreamHandler routes the records of every consumed stream through one
+// handler, ahead of the sink, for logic spanning streams such as
+// cross-stream aggregation. Each record carries its stream in
+// SinkRecord.Stream next to its shard and sequence number. Shards of
+// different streams call it concurrently. Checkpoints stay per stream and
+// shard: a record is checkpointed once the handler and the sink are done with
+// it, and an error from the handler fails the record as a sink error would.
+// Call it before the consumer starts.
+func SetStreamHandler(handler EventHandler) {
+	streamHandlerMu.Lock()
+	defer streamHandlerMu.Unlock()
+	streamHandler = handler
+}
+
+func registeredStreamHandler() EventHandler {
+	streamHandlerMu.RLock()
+	defer streamHandlerMu.RUnlock()
+	return streamHandler
+}
+
+// ShardHandler returns the handler of a shard: the stream handler, if any,
+// then the shard's sink
+func (pc *ProcessorContext) ShardHandler(sink Sink) EventHandler {
+	shared, handler := pc.StreamHandler, newEventHandler(sink)
+	switch {
+	case shared == nil:
+		return handler
+	case handler == nil:
+		return shared
+	}
+	return EventHandlerFunc(func(ctx context.Context, record *SinkRecord) error {
+		if err := shared.Handle(ctx, record); err != nil {
+			return err
+		}
+		return handler.Handle(ctx, record)
+	})
+}
+
+// newEventHandler returns the handler writing records to a shard's sink,
+// or nil if there is nothing to do per record
+func newEventHandler(sink Sink) EventHandler {
+	if sink == nil {
+		return nil
+	}
+	return EventHandlerFunc(func(ctx context.Context, record *SinkRecord) error {
+		call, _ := ctx.Value(handlerCallKey{}).(*handlerCall)
+		if call == nil {
+			return sink.Write(record)
+		}
+		call.mu.Lock()
+		defer call.mu.Unlock()
+		if call.abandoned {
+			return ErrHandlerTimeout
+		}
+		call.written = true
+		return sink.Write(record)
+	})
+}
+
+// handlerCall is a handler call bounded by consumer.handler_timeout_ms. Its
+// sink write holds mu, so once the call is abandoned no write of the record
+// is under way or can still start.
+type handlerCall struct {
+	mu        sync.Mutex
+	abandoned bool
+	written   bool
+}
+
+type handlerCallKey struct{}
+
+// abandon stops the call from writing to the sink, waiting for a write
+// already under way. It returns false if the record was written, as the
+// timeout came too late to skip it.
+func (c *handlerCall) abandon() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.abandoned = true
+	return !c.written
+}
+
+// HandleRecord runs the handler for one record, after any injected latency,
+// bounded by consumer.handler_timeout_ms when set. On timeout the handler's context is
+// cancelled, the timeout is counted, the record is written to
+// consumer.dlq_file if handler_timeout_dlq is set, and ErrHandlerTimeout is
+// returned so the caller can skip the record instead of blocking the shard. With
+// consumer.idempotency_table set, a record whose event ID was already
+// handled is skipped, and a failed record's ID is released for redelivery.
+// The outcome goes to the audit log, if any, and the record's latency to
+// the metrics.
+func (pc *ProcessorContext) HandleRecord(handler EventHandler, record *SinkRecord) error {
+	// Claimed even without a handler, so the table also deduplicates what
+	// a processor counts and checkpoints when no sink is configured
+	if !pc.Idempotency.Claim(record) {
+		pc.Audit.Skipped(record, ErrDuplicateEvent)
+		return nil
+	}
+	handler = pc.Latency.Wrap(handler)
+	if handler == nil {
+		pc.Audit.Handled(record, nil)
+		pc.Metrics.RecordHandled(&record.Event)
+		return nil
+	}
+	pc.Audit.Start(record)
+	err := pc.runHandler(handler, record)
+	if err == ErrHandlerTimeout && pc.Config.Consumer.HandlerTimeoutDLQ && pc.DeadLetters != nil {
+		deadLetterTimedOut(pc.DeadLetters, record)
+		pc.Audit.DeadLettered(record, err)
+	}
+	pc.Audit.Handled(record, err)
+	pc.Metrics.RecordHandled(&record.Event)
+	if err != nil && err != ErrHandlerTimeout {
+		pc.Idempotency.Release(record)
+	}
+	return err
+}
+
+// runHandler runs the handler, timing it and bounding it by consumer.handler_timeout_ms
+func (pc *ProcessorContext) runHandler(handler EventHandler, record *SinkRecord) error {
+	start := time.Now()
+	defer func() { pc.Metrics.HandlerDuration(record.ShardID, time.Since(start)) }()
+
+	timeout := time.Duration(pc.Config.Consumer.HandlerTimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		return handler.Handle(context.Background(), record)
+	}
+
+	call := &handlerCall{}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), handlerCallKey{}, call), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- handler.Handle(ctx, record)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if !call.abandon() {
+			// The sink write is the handler's last step, so it returns
+			// right after it
+			return <-done
+		}
+		pc.Metrics.HandlerTimeout(record.ShardID)
+		log.Printf("[%s] Handler exceeded %v on record %s, skipping it",
+			pc.logLabel(record.ShardID), timeout, record.SequenceNumber)
+		return ErrHandlerTimeout
+	}
+}
+
+// deadLetterTimedOut writes a record whose handler timed out to dlq, with
+// its event encoded as the data, logging rather than returning a failed write
+func deadLetterTimedOut(dlq DeadLetterSink, record *SinkRecord) {
+	data, err := json.Marshal(record.Event)
+	if err != nil {
+		log.Printf("[%s] Failed to dead-letter record %s: %v", record.ShardID, record.SequenceNumber, err)
+		return
+	}
+	letter := &RecordDeadLetter{
+		ShardID:        record.ShardID,
+		SequenceNumber: record.SequenceNumber,
+		PartitionKey:   record.PartitionKey,
+		Data:           data,
+		Error:          ErrHandlerTimeout.Error(),
+		FailedAt:       time.Now().UTC(),
+	}
+	if err := dlq.WriteRecordDeadLetter(letter); err != nil {
+		log.Printf("[%s] Failed to dead-letter record %s: %v", record.ShardID, record.SequenceNumber, err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collectingSink records the sequence numbers written to it
+type collectingSink struct {
+	mu      sync.Mutex
+	written []string
+}
+
+func (s *collectingSink) Write(record *SinkRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written = append(s.written, record.SequenceNumber)
+	return nil
+}
+
+func (s *collectingSink) Close() error { return nil }
+
+func (s *collectingSink) records() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.written...)
+}
+
+// fakeDeadLetters records the letters written to it
+type fakeDeadLetters struct {
+	mu      sync.Mutex
+	letters []*RecordDeadLetter
+}
+
+func (d *fakeDeadLetters) WriteRecordDeadLetter(letter *RecordDeadLetter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.letters = append(d.letters, letter)
+	return nil
+}
+
+func (d *fakeDeadLetters) Close() error { return nil }
+
+func TestHandlerTimeout(t *testing.T) {
+	const timeout = 20 * time.Millisecond
+	tests := []struct {
+		name        string
+		work        time.Duration // how long the stream handler runs, ignoring its context
+		dlq         bool
+		wantErr     error
+		wantWritten int
+		wantLetters int
+	}{
+		{name: "handler finishing in time", work: 0, wantWritten: 1},
+		{name: "handler ignoring its context skipped", work: 10 * timeout, wantErr: ErrHandlerTimeout},
+		{name: "skipped record dead-lettered", work: 10 * timeout, dlq: true, wantErr: ErrHandlerTimeout, wantLetters: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.HandlerTimeoutMs = int(timeout / time.Millisecond)
+			cfg.Consumer.HandlerTimeoutDLQ = tt.dlq
+			sink := &collectingSink{}
+			deadLetters := &fakeDeadLetters{}
+			pc := &ProcessorContext{Config: cfg, Metrics: NewMetrics(), DeadLetters: deadLetters}
+
+			finished := make(chan struct{})
+			pc.StreamHandler = EventHandlerFunc(func(ctx context.Context, record *SinkRecord) error {
+				defer close(finished)
+				time.Sleep(tt.work)
+				return nil
+			})
+			record := &SinkRecord{ShardID: testShard, SequenceNumber: "1", Event: Event{EventID: "evt_1"}}
+
+			start := time.Now()
+			err := pc.HandleRecord(pc.ShardHandler(sink), record)
+			if elapsed := time.Since(start); tt.wantErr == ErrHandlerTimeout && elapsed >= tt.work {
+				t.Errorf("HandleRecord() took %v, want it back after the %v timeout", elapsed, timeout)
+			}
+			if err != tt.wantErr {
+				t.Fatalf("HandleRecord() = %v, want %v", err, tt.wantErr)
+			}
+
+			// The abandoned handler goes on to the sink once it returns
+			<-finished
+			time.Sleep(timeout)
+			if got := len(sink.records()); got != tt.wantWritten {
+				t.Errorf("sink received %d records, want %d", got, tt.wantWritten)
+			}
+			if got := len(deadLetters.letters); got != tt.wantLetters {
+				t.Errorf("dead-lettered %d records, want %d", got, tt.wantLetters)
+			}
+			wantTimeouts := int64(0)
+			if tt.wantErr == ErrHandlerTimeout {
+				wantTimeouts = 1
+			}
+			if got := pc.Metrics.Snapshot()[ShardKey{ShardID: testShard}].HandlerTimeouts; got != wantTimeouts {
+				t.Errorf("counted %d handler timeouts, want %d", got, wantTimeouts)
+			}
+		})
+	}
+}
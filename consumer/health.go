@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Health tracks named readiness checks. The consumer is ready while every
+// check is passing; /readyz reports the failing ones. A nil *Health is
+// valid and ignores updates.
+type Health struct {
+	mu     sync.Mutex
+	failed map[string]string
+}
+
+// NewHealth creates a Health with every check passing
+func NewHealth() *Health {
+	return &Health{failed: make(map[string]string)}
+}
+
+// Set marks a check as failing with err, or passing when err is nil
+func (h *Health) Set(check string, err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.failed[check] = err.Error()
+	} else {
+		delete(h.failed, check)
+	}
+}
+
+// Ready reports whether all checks pass, and describes the failing ones if not
+func (h *Health) Ready() (bool, string) {
+	if h == nil {
+		return true, ""
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.failed) == 0 {
+		return true, ""
+	}
+	reasons := make([]string, 0, len(h.failed))
+	for check, reason := range h.failed {
+		reasons = append(reasons, check+": "+reason)
+	}
+	sort.Strings(reasons)
+	return false, strings.Join(reasons, "; ")
+}
+
+// newHTTPMux serves the consumer's operational endpoints:
+//
+//	GET  /healthz                       200 while the process is running
+//	GET  /readyz                        200 when every readiness check passes, 503 otherwise
+//	GET  /metrics                       consumer metrics in the Prometheus text format
+//	GET  /scale-recommendation          worker count that keeps lag under consumer.scale.target_lag_ms
+//	GET  /checkpoints/{shard}/history   recent checkpoints of a shard, with consumer.checkpoint_history
+//	POST /shards/{id}/rewind            reprocess a shard from its last checkpoint
+//	GET  /aggregates                    rolling per-action counts and value sums of the "aggregates" sink
+func newHTTPMux(cfg *Config, health *Health, metrics *Metrics, shards *ShardRegistry, history *CheckpointHistory, aggregates *RollingAggregates) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", newMetricsHandler(cfg, metrics))
+	mux.HandleFunc("GET /scale-recommendation", handleScaleRecommendation(NewScaleAdvisor(cfg, metrics)))
+	mux.HandleFunc("GET /checkpoints/{shard}/history", handleCheckpointHistory(history))
+	mux.HandleFunc("POST /shards/{id}/rewind", handleRewind(shards))
+	mux.HandleFunc("GET /aggregates", handleAggregates(aggregates))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if ready, reason := health.Ready(); !ready {
+			http.Error(w, "not ready: "+reason, http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+	return mux
+}
+
+// startHTTPServer serves the operational endpoints on consumer.http_addr and
+// returns a function that shuts the server down
+func startHTTPServer(cfg *Config, health *Health, metrics *Metrics, shards *ShardRegistry, history *CheckpointHistory, aggregates *RollingAggregates) (func(), error) {
+	if cfg.Consumer.HTTPAddr == "" {
+		return func() {}, nil
+	}
+	if err := validateMetricsCardinality(cfg); err != nil {
+		return nil, err
+	}
+
+	stop, err := serveHTTP(cfg.Consumer.HTTPAddr, newHTTPMux(cfg, health, metrics, shards, history, aggregates))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Serving operational endpoints on %s", cfg.Consumer.HTTPAddr)
+	return stop, nil
+}
+
+// startMetricsServer serves only GET /metrics on consumer.metrics_addr, so
+// metrics can be scraped on their own port without exposing the control
+// endpoints of http_addr, and returns a function that shuts the server down
+func startMetricsServer(cfg *Config, metrics *Metrics) (func(), error) {
+	if cfg.Consumer.MetricsAddr == "" {
+		return func() {}, nil
+	}
+	if err := validateMetricsCardinality(cfg); err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", newMetricsHandler(cfg, metrics))
+	stop, err := serveHTTP(cfg.Consumer.MetricsAddr, mux)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Serving Prometheus metrics on %s/metrics", cfg.Consumer.MetricsAddr)
+	return stop, nil
+}
+
+// serveHTTP serves handler on addr in the background and returns a function
+// that shuts the server down
+func serveHTTP(addr string, handler http.Handler) (func(), error) {
+	server := &http.Server{Addr: addr, Handler: handler}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.ListenAndServe()
+	}()
+
+	// Surface bind errors immediately instead of from the background
+	select {
+	case err := <-errChan:
+		return nil, fmt.Errorf("failed to start HTTP server on %s: %w", addr, err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("HTTP server shutdown: %v", err)
+		}
+	}, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Rebalance hook events
+const (
+	HookEventAssigned = "assigned"
+	HookEventReleased = "released"
+)
+
+// defaultHookTimeout bounds a single hook invocation when timeout_ms is unset
+const defaultHookTimeout = 5 * time.Second
+
+// RebalanceHookPayload is the JSON body posted to the webhook
+type RebalanceHookPayload struct {
+	Event     string    `json:"event"`
+	Stream    string    `json:"stream"`
+	ShardID   string    `json:"shard_id"`
+	WorkerID  string    `json:"worker_id"`
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// RebalanceHooks notifies external systems when this worker gains or loses a shard.
+// Hooks run asynchronously so a slow or failing hook never blocks record processing.
+// A nil *RebalanceHooks is valid and does nothing.
+type RebalanceHooks struct {
+	stream     string
+	labels     shardLabeler
+	workerID   string
+	command    string
+	webhookURL string
+	timeout    time.Duration
+	client     *http.Client
+}
+
+// NewRebalanceHooks builds hooks from consumer.rebalance_hooks, or returns nil if none are configured
+func NewRebalanceHooks(cfg *Config) *RebalanceHooks {
+	hooksCfg := cfg.Consumer.RebalanceHooks
+	if hooksCfg.Command == "" && hooksCfg.WebhookURL == "" {
+		return nil
+	}
+
+	timeout := time.Duration(hooksCfg.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+
+	return &RebalanceHooks{
+		stream:     cfg.Kinesis.StreamName,
+		labels:     newShardLabeler(cfg),
+		workerID:   cfg.Consumer.WorkerID,
+		command:    hooksCfg.Command,
+		webhookURL: hooksCfg.WebhookURL,
+		timeout:    timeout,
+		client:     &http.Client{Timeout: timeout},
+	}
+}
+
+// OnShardAssigned is called when this worker starts processing a shard
+func (h *RebalanceHooks) OnShardAssigned(shardID string) {
+	h.fire(HookEventAssigned, shardID, "")
+}
+
+// OnShardReleased is called when this worker stops processing a shard
+func (h *RebalanceHooks) OnShardReleased(shardID string, reason string) {
+	h.fire(HookEventReleased, shardID, reason)
+}
+
+func (h *RebalanceHooks) fire(event, shardID, reason string) {
+	if h == nil {
+		return
+	}
+
+	payload := RebalanceHookPayload{
+		Event:     event,
+		Stream:    h.stream,
+		ShardID:   shardID,
+		WorkerID:  h.workerID,
+		Reason:    reason,
+		Timestamp: time.Now(),
+	}
+
+	go func() {
+		if h.command != "" {
+			if err := h.runCommand(payload); err != nil {
+				log.Printf("[%s] Rebalance hook command failed (%s): %v", h.labels.logLabel(shardID), event, err)
+			}
+		}
+		if h.webhookURL != "" {
+			if err := h.postWebhook(payload); err != nil {
+				log.Printf("[%s] Rebalance hook webhook failed (%s): %v", h.labels.logLabel(shardID), event, err)
+			}
+		}
+	}()
+}
+
+// runCommand runs the hook command through the shell with the event passed as environment variables
+func (h *RebalanceHooks) runCommand(payload RebalanceHookPayload) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.command)
+	cmd.Env = append(os.Environ(),
+		"KDS_HOOK_EVENT="+payload.Event,
+		"KDS_STREAM_NAME="+payload.Stream,
+		"KDS_SHARD_ID="+payload.ShardID,
+		"KDS_WORKER_ID="+payload.WorkerID,
+		"KDS_REASON="+payload.Reason,
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// postWebhook POSTs the event as JSON, treating any non-2xx response as a failure
+func (h *RebalanceHooks) postWebhook(payload RebalanceHookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := h.client.Post(h.webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
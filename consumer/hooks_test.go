@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hookReceiver collects the payloads posted to a webhook, answering with status
+type hookReceiver struct {
+	mu       sync.Mutex
+	payloads []RebalanceHookPayload
+	status   int
+}
+
+func (h *hookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var payload RebalanceHookPayload
+	json.NewDecoder(r.Body).Decode(&payload)
+	h.mu.Lock()
+	h.payloads = append(h.payloads, payload)
+	h.mu.Unlock()
+	w.WriteHeader(h.status)
+}
+
+func (h *hookReceiver) events() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var events []string
+	for _, p := range h.payloads {
+		events = append(events, fmt.Sprintf("%s %s/%s %s %s", p.Event, p.Stream, p.ShardID, p.WorkerID, p.Reason))
+	}
+	return events
+}
+
+func TestRebalanceHooks(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string // appends the event to $OUT, or fails
+		status  int
+	}{
+		{name: "command and webhook", command: `echo "$KDS_HOOK_EVENT $KDS_STREAM_NAME/$KDS_SHARD_ID $KDS_WORKER_ID $KDS_REASON" >> "$OUT"`, status: http.StatusOK},
+		{name: "failing hooks don't block processing", command: "sleep 1; exit 1", status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "hooks.log")
+			t.Setenv("OUT", out)
+			receiver := &hookReceiver{status: tt.status}
+			server := httptest.NewServer(receiver)
+			defer server.Close()
+
+			client := newFakeKinesis(testStream, testShard)
+			client.AddRecords(t, testShard, "user_1", testEvents(0, 2)...)
+			client.CloseShard(testShard)
+			cfg := &Config{}
+			cfg.Consumer.WorkerID = "worker-1"
+			cfg.Consumer.RebalanceHooks.Command = tt.command
+			cfg.Consumer.RebalanceHooks.WebhookURL = server.URL
+			msp := newTestProcessor(client, cfg)
+			sink := &collectingSink{}
+			msp.pc.Sink = sink
+			msp.pc.Hooks = NewRebalanceHooks(cfg)
+
+			start := time.Now()
+			var wg sync.WaitGroup
+			wg.Add(1)
+			msp.ProcessShard(context.Background(), &wg)
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("processing took %v, want it not to wait for the hooks", elapsed)
+			}
+			if got := len(sink.records()); got != 2 {
+				t.Errorf("handled %d records, want 2", got)
+			}
+
+			// Both events reach the webhook whether or not it accepts them
+			want := []string{
+				"assigned test-stream/shardId-000000000000 worker-1 ",
+				"released test-stream/shardId-000000000000 worker-1 TERMINATE",
+			}
+			waitFor(t, func() bool { return len(receiver.events()) == len(want) })
+			got := receiver.events()
+			// Hooks run in the background, so the two may arrive in either order
+			if strings.HasPrefix(got[0], HookEventReleased) {
+				got[0], got[1] = got[1], got[0]
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("webhook received %q, want %q", got, want)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			waitFor(t, func() bool {
+				data, _ := os.ReadFile(out)
+				return strings.Count(string(data), "\n") == len(want)
+			})
+			data, _ := os.ReadFile(out)
+			lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+			if strings.HasPrefix(lines[0], HookEventReleased) {
+				lines[0], lines[1] = lines[1], lines[0]
+			}
+			if fmt.Sprint(lines) != fmt.Sprint(want) {
+				t.Errorf("command ran with %q, want %q", lines, want)
+			}
+		})
+	}
+}
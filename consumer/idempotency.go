@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// Attributes of an idempotency row
+const (
+	idempotencyEventKey   = "EventID"
+	idempotencyShardKey   = "ShardID"
+	idempotencyExpiresKey = "ExpiresAt" // epoch seconds, the table's TTL attribute
+)
+
+// DefaultIdempotencyTTLHours is how long a processed event ID is remembered
+const DefaultIdempotencyTTLHours = 24
+
+// IdempotencyStore claims every event ID in a DynamoDB table before the
+// event is handled. The claim is a conditional put that fails when the ID is
+// already in the table, so an event redelivered after a restart, a rebalance
+// or by the producer retrying is handled once, whichever worker sees it.
+// Rows expire through DynamoDB TTL after consumer.idempotency_table.ttl_hours.
+// A nil *IdempotencyStore claims everything.
+type IdempotencyStore struct {
+	client    dynamodbiface.DynamoDBAPI
+	tableName string
+	ttl       time.Duration
+	labels    shardLabeler
+}
+
+// NewIdempotencyStore returns a store for consumer.idempotency_table, creating
+// the table if needed, or nil when no table is configured
+func NewIdempotencyStore(cfg *Config) (*IdempotencyStore, error) {
+	tableCfg := cfg.Consumer.IdempotencyTable
+	if tableCfg.Name == "" {
+		return nil, nil
+	}
+	if err := validateTableName(tableCfg.Name); err != nil {
+		return nil, err
+	}
+	sess, err := newAWSSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client := dynamodb.New(sess)
+	if err := ensureTable(client, tableCfg.Name, idempotencyEventKey); err != nil {
+		return nil, err
+	}
+	if err := ensureTTL(client, tableCfg.Name, idempotencyExpiresKey); err != nil {
+		// Without TTL rows are never removed, but deduplication still works
+		log.Printf("WARNING: %v", err)
+	}
+
+	ttl := time.Duration(tableCfg.TTLHours) * time.Hour
+	log.Printf("Idempotency keys recorded in table %s for %v", tableCfg.Name, ttl)
+	return newIdempotencyStore(client, tableCfg.Name, ttl, newShardLabeler(cfg)), nil
+}
+
+func newIdempotencyStore(client dynamodbiface.DynamoDBAPI, tableName string, ttl time.Duration, labels shardLabeler) *IdempotencyStore {
+	return &IdempotencyStore{client: client, tableName: tableName, ttl: ttl, labels: labels}
+}
+
+// ensureTTL enables DynamoDB TTL on the attribute unless it already is
+func ensureTTL(client dynamodbiface.DynamoDBAPI, tableName, attribute string) error {
+	output, err := client.DescribeTimeToLive(&dynamodb.DescribeTimeToLiveInput{TableName: aws.String(tableName)})
+	if err != nil {
+		return fmt.Errorf("failed to describe TTL of table %s: %w", tableName, err)
+	}
+	if desc := output.TimeToLiveDescription; desc != nil {
+		switch aws.StringValue(desc.TimeToLiveStatus) {
+		case dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling:
+			return nil
+		}
+	}
+
+	_, err = client.UpdateTimeToLive(&dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(tableName),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String(attribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enable TTL on table %s: %w", tableName, err)
+	}
+	return nil
+}
+
+// Claim records the event ID of the record and reports whether the record
+// should be handled: false means the ID was already recorded, so the record
+// is a duplicate. When DynamoDB cannot be reached the record is handled
+// anyway, as handling a duplicate is better than losing an event.
+func (s *IdempotencyStore) Claim(record *SinkRecord) bool {
+	if s == nil || record.Event.EventID == "" {
+		return true
+	}
+	expires := time.Now().Add(s.ttl).Unix()
+	_, err := s.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			idempotencyEventKey:   {S: aws.String(record.Event.EventID)},
+			idempotencyShardKey:   {S: aws.String(record.ShardID)},
+			idempotencyExpiresKey: {N: aws.String(strconv.FormatInt(expires, 10))},
+		},
+		ConditionExpression:      aws.String("attribute_not_exists(#id)"),
+		ExpressionAttributeNames: map[string]*string{"#id": aws.String(idempotencyEventKey)},
+	})
+	if err == nil {
+		return true
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		log.Printf("[%s] Skipping duplicate event %s at %s", s.labels.logLabel(record.ShardID), record.Event.EventID, record.SequenceNumber)
+		return false
+	}
+	log.Printf("[%s] Failed to record idempotency key %s, handling the event anyway: %v",
+		s.labels.logLabel(record.ShardID), record.Event.EventID, err)
+	return true
+}
+
+// Release forgets the event ID of a record whose handler failed, so a
+// redelivery of the event is handled again instead of skipped
+func (s *IdempotencyStore) Release(record *SinkRecord) {
+	if s == nil || record.Event.EventID == "" {
+		return
+	}
+	_, err := s.client.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			idempotencyEventKey: {S: aws.String(record.Event.EventID)},
+		},
+	})
+	if err != nil {
+		log.Printf("[%s] Failed to release idempotency key %s, a redelivery will be skipped: %v",
+			s.labels.logLabel(record.ShardID), record.Event.EventID, err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// fakeIdempotencyTable is an idempotency table applying the conditional
+// put of a claim. With unavailable set every call fails.
+type fakeIdempotencyTable struct {
+	dynamodbiface.DynamoDBAPI
+	mu          sync.Mutex
+	rows        map[string]bool
+	duplicates  int
+	unavailable bool
+}
+
+func (f *fakeIdempotencyTable) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.unavailable {
+		return nil, awserr.New("ServiceUnavailable", "try again", nil)
+	}
+	id := aws.StringValue(input.Item[idempotencyEventKey].S)
+	if f.rows[id] {
+		f.duplicates++
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+	}
+	f.rows[id] = true
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeIdempotencyTable) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.rows, aws.StringValue(input.Key[idempotencyEventKey].S))
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func TestHandleRecordIdempotency(t *testing.T) {
+	tests := []struct {
+		name        string
+		noSink      bool
+		failFirst   bool // the handler fails the first delivery
+		unavailable bool
+		noEventID   bool
+		wantHandled int // handler calls over two deliveries of the record
+		wantDups    int // deliveries the table rejected
+	}{
+		{name: "redelivery skipped", wantHandled: 1, wantDups: 1},
+		{name: "redelivery skipped without a sink", noSink: true, wantDups: 1},
+		{name: "failed record released for redelivery", failFirst: true, wantHandled: 2},
+		{name: "table unavailable handles anyway", unavailable: true, wantHandled: 2},
+		{name: "event without an ID not claimed", noEventID: true, wantHandled: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &fakeIdempotencyTable{rows: make(map[string]bool), unavailable: tt.unavailable}
+			cfg := &Config{}
+			pc := &ProcessorContext{Config: cfg, Idempotency: newIdempotencyStore(table, "idempotency", time.Hour, shardLabeler{})}
+
+			handled := 0
+			var handler EventHandler
+			if !tt.noSink {
+				handler = EventHandlerFunc(func(ctx context.Context, record *SinkRecord) error {
+					handled++
+					if tt.failFirst && handled == 1 {
+						return errors.New("sink down")
+					}
+					return nil
+				})
+			}
+			record := testSinkRecords(0, 1)[0]
+			if tt.noEventID {
+				record.Event.EventID = ""
+			}
+			for range 2 {
+				pc.HandleRecord(handler, record)
+			}
+
+			if handled != tt.wantHandled || table.duplicates != tt.wantDups {
+				t.Errorf("handled %d times with %d duplicates rejected, want %d and %d",
+					handled, table.duplicates, tt.wantHandled, tt.wantDups)
+			}
+			if want := !tt.unavailable && !tt.noEventID; table.rows[record.Event.EventID] != want {
+				t.Errorf("event ID recorded %t, want %t", table.rows[record.Event.EventID], want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// validateIteratorStart checks consumer.iterator_type and that the field its
+// type reads is set, before any shard is opened. A sequence number belongs to
+// one shard, so the sequence number types need exactly one assigned shard;
+// it runs once assigned_shards holds the shards assignShards resolved.
+func validateIteratorStart(cfg *Config) error {
+	c := cfg.Consumer
+	switch c.IteratorType {
+	case kinesis.ShardIteratorTypeTrimHorizon, kinesis.ShardIteratorTypeLatest:
+	case kinesis.ShardIteratorTypeAtTimestamp:
+		if c.IteratorTimestamp == "" {
+			return fmt.Errorf("consumer.iterator_type %s requires iterator_timestamp", c.IteratorType)
+		}
+		if _, err := time.Parse(time.RFC3339, c.IteratorTimestamp); err != nil {
+			return fmt.Errorf("invalid consumer.iterator_timestamp: %w", err)
+		}
+	case kinesis.ShardIteratorTypeAtSequenceNumber, kinesis.ShardIteratorTypeAfterSequenceNumber:
+		if c.IteratorSequenceNumber == "" {
+			return fmt.Errorf("consumer.iterator_type %s requires iterator_sequence_number", c.IteratorType)
+		}
+		if len(c.AssignedShards) != 1 {
+			return fmt.Errorf("consumer.iterator_type %s requires exactly one assigned shard, the one iterator_sequence_number belongs to, got %d",
+				c.IteratorType, len(c.AssignedShards))
+		}
+	default:
+		return fmt.Errorf("invalid iterator_type: %s. Must be '%s', '%s', '%s', '%s' or '%s'", c.IteratorType,
+			kinesis.ShardIteratorTypeTrimHorizon, kinesis.ShardIteratorTypeLatest, kinesis.ShardIteratorTypeAtTimestamp,
+			kinesis.ShardIteratorTypeAtSequenceNumber, kinesis.ShardIteratorTypeAfterSequenceNumber)
+	}
+	if c.Backfill.Bucket != "" && c.IteratorType != kinesis.ShardIteratorTypeTrimHorizon {
+		return fmt.Errorf("consumer.iterator_type can't be combined with backfill, whose start_position decides where tailing starts")
+	}
+	return nil
+}
+
+// setIteratorStart positions a GetShardIterator call at consumer.iterator_type,
+// with the timestamp or sequence number the type reads
+func setIteratorStart(input *kinesis.GetShardIteratorInput, cfg *Config) error {
+	c := cfg.Consumer
+	input.ShardIteratorType = aws.String(c.IteratorType)
+	switch c.IteratorType {
+	case kinesis.ShardIteratorTypeAtTimestamp:
+		start, err := time.Parse(time.RFC3339, c.IteratorTimestamp)
+		if err != nil {
+			return fmt.Errorf("invalid consumer.iterator_timestamp: %w", err)
+		}
+		input.Timestamp = aws.Time(start)
+	case kinesis.ShardIteratorTypeAtSequenceNumber, kinesis.ShardIteratorTypeAfterSequenceNumber:
+		input.StartingSequenceNumber = aws.String(c.IteratorSequenceNumber)
+	}
+	return nil
+}
+
+// isExpiredIterator reports whether GetRecords was called with an iterator
+// older than the five minutes Kinesis keeps one valid
+func isExpiredIterator(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == kinesis.ErrCodeExpiredIteratorException
+	}
+	return false
+}
+
+// renewIterator replaces an expired shard iterator with a fresh one right
+// after the last record read, or at the shard's start position when none
+// was read yet. With prefetch_batches the last record read can be ahead of
+// the last one handled; the batches in between are already fetched, so
+// reading resumes after them. It returns false when the renewal failed,
+// keeping the expired iterator to renew again on the next fetch.
+func (msp *ManualShardProcessor) renewIterator() bool {
+	input, err := msp.startPosition()
+	if err != nil {
+		log.Printf("[%s] Failed to renew expired shard iterator: %v", msp.label, err)
+		return false
+	}
+	from := "at the shard's start position"
+	if msp.lastFetched != "" {
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+		input.StartingSequenceNumber = aws.String(msp.lastFetched)
+		input.Timestamp = nil
+		from = "after sequence number " + msp.lastFetched
+	}
+	iteratorOutput, err := msp.kinesisClient.GetShardIterator(input)
+	if err != nil {
+		log.Printf("[%s] Failed to renew expired shard iterator: %v", msp.label, err)
+		return false
+	}
+	log.Printf("[%s] Shard iterator expired, renewed it %s", msp.label, from)
+	msp.shardIterator = iteratorOutput.ShardIterator
+	return true
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const (
+	testStream = "test-stream"
+	testShard  = "shardId-000000000000"
+)
+
+// newTestProcessor returns a processor reading testShard of the fake
+// stream with cfg, ready to fetch once opened
+func newTestProcessor(client KinesisAPI, cfg *Config) *ManualShardProcessor {
+	if cfg.Consumer.IteratorType == "" {
+		cfg.Consumer.IteratorType = kinesis.ShardIteratorTypeTrimHorizon
+	}
+	cfg.Kinesis.StreamName = testStream
+	return &ManualShardProcessor{
+		shardID:       testShard,
+		streamName:    testStream,
+		label:         testShard,
+		kinesisClient: client,
+		maxRecords:    100,
+		pollInterval:  time.Millisecond,
+		stopAll:       func() {},
+		pc:            &ProcessorContext{Config: cfg},
+		completion:    newShardCompletion([]string{testShard}),
+	}
+}
+
+// testEvents returns the JSON of n events with IDs from evt_<first>
+func testEvents(first, n int) [][]byte {
+	events := make([][]byte, n)
+	for i := range events {
+		events[i] = []byte(fmt.Sprintf(`{"version":1,"event_id":"evt_%d","action":"view"}`, first+i))
+	}
+	return events
+}
+
+// firstFetch opens an iterator at the processor's start position and
+// returns the sequence numbers of the records the first GetRecords reads
+func firstFetch(t *testing.T, msp *ManualShardProcessor) []string {
+	t.Helper()
+	iterator, err := msp.getShardIterator()
+	if err != nil {
+		t.Fatalf("getShardIterator: %v", err)
+	}
+	msp.shardIterator = iterator
+	batch, ok := msp.fetchBatch(context.Background())
+	if !ok || batch == nil {
+		t.Fatalf("fetchBatch returned %v, %t", batch, ok)
+	}
+	var sequenceNumbers []string
+	for _, record := range batch.records {
+		sequenceNumbers = append(sequenceNumbers, aws.StringValue(record.SequenceNumber))
+	}
+	return sequenceNumbers
+}
+
+func TestStartPosition(t *testing.T) {
+	fake := newFakeKinesis(testStream, testShard)
+	seq := fake.AddRecords(t, testShard, "user_1", testEvents(0, 4)...)
+	afterAdd := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	later := fake.AddRecords(t, testShard, "user_1", testEvents(4, 1)...)
+	all := append(append([]string{}, seq...), later...)
+
+	tests := []struct {
+		name       string
+		iterator   string
+		timestamp  string
+		sequence   string
+		checkpoint string
+		child      bool
+		want       []string
+	}{
+		{name: "trim horizon", iterator: kinesis.ShardIteratorTypeTrimHorizon, want: all},
+		{name: "latest", iterator: kinesis.ShardIteratorTypeLatest, want: nil},
+		{name: "at sequence number", iterator: kinesis.ShardIteratorTypeAtSequenceNumber, sequence: seq[2], want: all[2:]},
+		{name: "after sequence number", iterator: kinesis.ShardIteratorTypeAfterSequenceNumber, sequence: seq[2], want: all[3:]},
+		{name: "at timestamp", iterator: kinesis.ShardIteratorTypeAtTimestamp, timestamp: afterAdd.Add(time.Millisecond).Format(time.RFC3339Nano), want: later},
+		{name: "checkpoint overrides iterator type", iterator: kinesis.ShardIteratorTypeLatest, checkpoint: seq[1], want: all[2:]},
+		{name: "child shard reads from trim horizon", iterator: kinesis.ShardIteratorTypeLatest, child: true, want: all},
+		{name: "child shard resumes from checkpoint", iterator: kinesis.ShardIteratorTypeLatest, child: true, checkpoint: seq[3], want: later},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.IteratorType = tt.iterator
+			cfg.Consumer.IteratorTimestamp = tt.timestamp
+			cfg.Consumer.IteratorSequenceNumber = tt.sequence
+			msp := newTestProcessor(fake, cfg)
+			msp.child = tt.child
+			if tt.checkpoint != "" {
+				msp.pc.Checkpoints = testCheckpoints(testStream, map[string]string{testShard: tt.checkpoint})
+			}
+
+			got := firstFetch(t, msp)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("read %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testCheckpoints returns a checkpoint file view resuming shards of the
+// stream at the given sequence numbers, without a file behind it
+func testCheckpoints(stream string, resume map[string]string) *CheckpointFile {
+	store := &checkpointFileStore{resume: make(map[ShardKey]string), shards: make(map[ShardKey]string)}
+	for shardID, sequenceNumber := range resume {
+		store.resume[ShardKey{Stream: stream, ShardID: shardID}] = sequenceNumber
+	}
+	return &CheckpointFile{stream: stream, store: store}
+}
+
+func TestExpiredIteratorRenewal(t *testing.T) {
+	tests := []struct {
+		name       string
+		readFirst  bool
+		checkpoint bool
+		wantFrom   int // index of the first record read after the renewal
+	}{
+		{name: "resumes after the last record read", readFirst: true, wantFrom: 2},
+		{name: "restarts at the start position when nothing was read", wantFrom: 0},
+		{name: "restarts at the checkpoint when nothing was read", checkpoint: true, wantFrom: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeKinesis(testStream, testShard)
+			seq := fake.AddRecords(t, testShard, "user_1", testEvents(0, 2)...)
+			msp := newTestProcessor(fake, &Config{})
+			msp.maxRecords = 2
+			if tt.checkpoint {
+				msp.pc.Checkpoints = testCheckpoints(testStream, map[string]string{testShard: seq[0]})
+			}
+			if tt.readFirst {
+				firstFetch(t, msp)
+			} else {
+				iterator, err := msp.getShardIterator()
+				if err != nil {
+					t.Fatalf("getShardIterator: %v", err)
+				}
+				msp.shardIterator = iterator
+			}
+			seq = append(seq, fake.AddRecords(t, testShard, "user_1", testEvents(2, 2)...)...)
+			fake.ExpireIterators()
+
+			// The failed call renews the iterator and asks to be retried at once
+			batch, ok := msp.fetchBatch(context.Background())
+			if batch != nil || !ok {
+				t.Fatalf("fetch with an expired iterator returned %v, %t; want a retry", batch, ok)
+			}
+			if !msp.lastFetch.IsZero() {
+				t.Errorf("retry after renewal is delayed until %v", msp.nextFetch())
+			}
+			batch, ok = msp.fetchBatch(context.Background())
+			if !ok || batch == nil || len(batch.records) == 0 {
+				t.Fatalf("fetch after renewal returned %v, %t", batch, ok)
+			}
+			if got := aws.StringValue(batch.records[0].SequenceNumber); got != seq[tt.wantFrom] {
+				t.Errorf("read from %s after renewal, want %s", got, seq[tt.wantFrom])
+			}
+		})
+	}
+}
+
+func TestClosedShard(t *testing.T) {
+	tests := []struct {
+		name       string
+		records    int
+		maxRecords int64
+	}{
+		{name: "empty shard", records: 0, maxRecords: 10},
+		{name: "read in one batch", records: 3, maxRecords: 10},
+		{name: "read over several batches", records: 7, maxRecords: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeKinesis(testStream, testShard)
+			seq := fake.AddRecords(t, testShard, "user_1", testEvents(0, tt.records)...)
+			fake.CloseShard(testShard)
+			msp := newTestProcessor(fake, &Config{})
+			msp.maxRecords = tt.maxRecords
+			msp.pc.Checkpoints = testCheckpoints(testStream, nil)
+			iterator, err := msp.getShardIterator()
+			if err != nil {
+				t.Fatalf("getShardIterator: %v", err)
+			}
+			msp.shardIterator = iterator
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !msp.consume(ctx) {
+				t.Fatal("consume reported a halted sink")
+			}
+			if ctx.Err() != nil {
+				t.Fatal("consume did not return once the shard was read to its end")
+			}
+			if !msp.shardClosed || msp.releaseReason != "TERMINATE" {
+				t.Errorf("shardClosed %t, release reason %q; want a closed shard released with TERMINATE", msp.shardClosed, msp.releaseReason)
+			}
+			if msp.recordCount != tt.records {
+				t.Errorf("handled %d records, want %d", msp.recordCount, tt.records)
+			}
+			checkpoint := msp.pc.Checkpoints.store.shards[ShardKey{Stream: testStream, ShardID: testShard}]
+			if tt.records > 0 && checkpoint != seq[len(seq)-1] {
+				t.Errorf("checkpointed at %q, want the last record %s", checkpoint, seq[len(seq)-1])
+			}
+		})
+	}
+}
+
+func TestValidateIteratorStart(t *testing.T) {
+	tests := []struct {
+		name      string
+		iterator  string
+		timestamp string
+		sequence  string
+		assigned  []string
+		backfill  bool
+		wantErr   bool
+	}{
+		{name: "trim horizon", iterator: kinesis.ShardIteratorTypeTrimHorizon, assigned: []string{"a", "b"}},
+		{name: "latest", iterator: kinesis.ShardIteratorTypeLatest, assigned: []string{"a", "b"}},
+		{name: "at timestamp", iterator: kinesis.ShardIteratorTypeAtTimestamp, timestamp: "2024-01-01T00:00:00Z", assigned: []string{"a", "b"}},
+		{name: "at timestamp without a timestamp", iterator: kinesis.ShardIteratorTypeAtTimestamp, assigned: []string{"a"}, wantErr: true},
+		{name: "at timestamp not RFC 3339", iterator: kinesis.ShardIteratorTypeAtTimestamp, timestamp: "yesterday", assigned: []string{"a"}, wantErr: true},
+		{name: "at sequence number of the one assigned shard", iterator: kinesis.ShardIteratorTypeAtSequenceNumber, sequence: "49590", assigned: []string{"a"}},
+		{name: "after sequence number of the one assigned shard", iterator: kinesis.ShardIteratorTypeAfterSequenceNumber, sequence: "49590", assigned: []string{"a"}},
+		{name: "sequence number without a sequence number", iterator: kinesis.ShardIteratorTypeAtSequenceNumber, assigned: []string{"a"}, wantErr: true},
+		{name: "sequence number with several assigned shards", iterator: kinesis.ShardIteratorTypeAtSequenceNumber, sequence: "49590", assigned: []string{"a", "b"}, wantErr: true},
+		{name: "sequence number with no assigned shard", iterator: kinesis.ShardIteratorTypeAfterSequenceNumber, sequence: "49590", wantErr: true},
+		{name: "unknown type", iterator: "OLDEST", assigned: []string{"a"}, wantErr: true},
+		{name: "trim horizon with backfill", iterator: kinesis.ShardIteratorTypeTrimHorizon, backfill: true},
+		{name: "latest with backfill", iterator: kinesis.ShardIteratorTypeLatest, backfill: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.IteratorType = tt.iterator
+			cfg.Consumer.IteratorTimestamp = tt.timestamp
+			cfg.Consumer.IteratorSequenceNumber = tt.sequence
+			cfg.Consumer.AssignedShards = tt.assigned
+			if tt.backfill {
+				cfg.Consumer.Backfill.Bucket = "archive"
+			}
+			if err := validateIteratorStart(cfg); (err != nil) != tt.wantErr {
+				t.Errorf("validateIteratorStart() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIteratorTypeDefault(t *testing.T) {
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{mode: "manual", want: kinesis.ShardIteratorTypeTrimHorizon},
+		{mode: "kcl", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.AssignmentMode = tt.mode
+			cfg.ApplyDefaults()
+			if cfg.Consumer.IteratorType != tt.want {
+				t.Errorf("iterator_type defaults to %q, want %q", cfg.Consumer.IteratorType, tt.want)
+			}
+		})
+	}
+}
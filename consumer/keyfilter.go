@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/kds-rebalance/internal/hashrange"
+)
+
+// maxHashKey is the top of the Kinesis hash key space, 2^128 - 1
+var maxHashKey = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 128), big.NewInt(1))
+
+// KeyFilter restricts handling to records whose partition key hashes into
+// consumer.key_filter, the way Kinesis maps keys to shards: the key's MD5
+// digest read as a 128-bit integer. It simulates a consumer responsible for
+// a sub-range of a shard. Records outside the range are skipped but still
+// checkpointed. Records sent with an explicit hash key are filtered by their
+// partition key too, which Kinesis ignored when placing them. A nil
+// *KeyFilter handles every record.
+type KeyFilter struct {
+	start, end *big.Int
+}
+
+// parseHashKey parses a decimal hash key of consumer.key_filter, or returns
+// def if it is empty
+func parseHashKey(name, value string, def *big.Int) (*big.Int, error) {
+	if value == "" {
+		return def, nil
+	}
+	key, ok := new(big.Int).SetString(value, 10)
+	if !ok || key.Sign() < 0 || key.Cmp(maxHashKey) > 0 {
+		return nil, fmt.Errorf("invalid key_filter.%s: %s. Must be a decimal hash key from 0 to %s", name, value, maxHashKey)
+	}
+	return key, nil
+}
+
+// NewKeyFilter returns the filter for consumer.key_filter, or nil when
+// neither end of the range is set
+func NewKeyFilter(cfg *Config) (*KeyFilter, error) {
+	keyCfg := cfg.Consumer.KeyFilter
+	if keyCfg.StartHashKey == "" && keyCfg.EndHashKey == "" {
+		return nil, nil
+	}
+	start, err := parseHashKey("start_hash_key", keyCfg.StartHashKey, big.NewInt(0))
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseHashKey("end_hash_key", keyCfg.EndHashKey, maxHashKey)
+	if err != nil {
+		return nil, err
+	}
+	if start.Cmp(end) > 0 {
+		return nil, fmt.Errorf("invalid key_filter: start_hash_key %s is after end_hash_key %s", start, end)
+	}
+
+	width := new(big.Float).SetInt(new(big.Int).Sub(end, start))
+	share, _ := new(big.Float).Quo(width, new(big.Float).SetInt(maxHashKey)).Float64()
+	log.Printf("Key filter: handling partition keys hashing to %s-%s (%.1f%% of the hash key space)", start, end, share*100)
+	return &KeyFilter{start: start, end: end}, nil
+}
+
+// Skips reports whether the record's partition key hashes outside the range
+func (f *KeyFilter) Skips(record *kinesis.Record) bool {
+	if f == nil {
+		return false
+	}
+	hash := hashrange.HashKey(aws.StringValue(record.PartitionKey))
+	return hash.Cmp(f.start) < 0 || hash.Cmp(f.end) > 0
+}
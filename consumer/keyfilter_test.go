@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestKeyFilter(t *testing.T) {
+	// user_1 and user_2 hash into the lowest quarter of the hash key space,
+	// user_3 and user_4 into the third and "" into the fourth
+	tests := []struct {
+		name     string
+		start    string
+		end      string
+		wantErr  string
+		wantKeep []string
+		wantSkip []string
+	}{
+		{name: "unset handles every key", wantKeep: []string{"user_1", "user_3", ""}},
+		{
+			name:     "first quarter",
+			end:      "85070591730234615865843651857942052863",
+			wantKeep: []string{"user_1", "user_2"},
+			wantSkip: []string{"user_3", "user_4", ""},
+		},
+		{
+			name:     "upper half",
+			start:    "170141183460469231731687303715884105728",
+			wantKeep: []string{"user_3", "user_4", ""},
+			wantSkip: []string{"user_1", "user_2"},
+		},
+		{
+			name:     "bounds inclusive",
+			start:    "221929187170659709766161561396802381760", // user_3's hash key
+			end:      "221929187170659709766161561396802381760",
+			wantKeep: []string{"user_3"},
+			wantSkip: []string{"user_4"},
+		},
+		{name: "not a number", start: "half", wantErr: "invalid key_filter.start_hash_key: half. Must be a decimal hash key from 0 to 340282366920938463463374607431768211455"},
+		{name: "beyond the hash key space", end: "340282366920938463463374607431768211456", wantErr: "invalid key_filter.end_hash_key: 340282366920938463463374607431768211456. Must be a decimal hash key from 0 to 340282366920938463463374607431768211455"},
+		{name: "start after end", start: "2", end: "1", wantErr: "invalid key_filter: start_hash_key 2 is after end_hash_key 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.KeyFilter.StartHashKey = tt.start
+			cfg.Consumer.KeyFilter.EndHashKey = tt.end
+			filter, err := NewKeyFilter(cfg)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("NewKeyFilter() = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range tt.wantKeep {
+				if filter.Skips(&kinesis.Record{PartitionKey: aws.String(key)}) {
+					t.Errorf("Skips(%q) = true, want the record handled", key)
+				}
+			}
+			for _, key := range tt.wantSkip {
+				if !filter.Skips(&kinesis.Record{PartitionKey: aws.String(key)}) {
+					t.Errorf("Skips(%q) = false, want the record skipped", key)
+				}
+			}
+		})
+	}
+}
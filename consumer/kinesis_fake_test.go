@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// fakeKinesis is an in-memory KinesisAPI. It serves the records
+// added to each shard in order, with increasing sequence numbers, and
+// answers a shard closed with CloseShard with a nil NextShardIterator once
+// its records are read. ExpireIterators makes every iterator handed out so
+// far fail with ExpiredIteratorException, as Kinesis does five minutes
+// after an iterator was issued.
+type fakeKinesis struct {
+	mu         sync.Mutex
+	stream     string
+	shards     map[string]*fakeShard
+	sequence   int64
+	generation int // iterators from earlier generations have expired
+}
+
+type fakeShard struct {
+	records []*kinesis.Record
+	closed  bool
+	parents []string // the shard and adjacent shard it was created from, if any
+}
+
+// newFakeKinesis creates a fake stream with the given shards, all open and empty
+func newFakeKinesis(stream string, shardIDs ...string) *fakeKinesis {
+	f := &fakeKinesis{stream: stream, shards: make(map[string]*fakeShard, len(shardIDs))}
+	for _, shardID := range shardIDs {
+		f.shards[shardID] = &fakeShard{}
+	}
+	return f
+}
+
+// AddRecords appends records with the given data to an open shard and
+// returns their sequence numbers
+func (f *fakeKinesis) AddRecords(t testing.TB, shardID, partitionKey string, data ...[]byte) []string {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	shard := f.shards[shardID]
+	if shard == nil || shard.closed {
+		t.Fatalf("fake kinesis: shard %s is not open", shardID)
+	}
+	sequenceNumbers := make([]string, 0, len(data))
+	for _, d := range data {
+		f.sequence++
+		sequenceNumber := fmt.Sprintf("%056d", f.sequence)
+		shard.records = append(shard.records, &kinesis.Record{
+			Data:                        d,
+			PartitionKey:                aws.String(partitionKey),
+			SequenceNumber:              aws.String(sequenceNumber),
+			ApproximateArrivalTimestamp: aws.Time(time.Now()),
+		})
+		sequenceNumbers = append(sequenceNumbers, sequenceNumber)
+	}
+	return sequenceNumbers
+}
+
+// CloseShard closes a shard, as a split or merge does: its records can
+// still be read, then its iterator ends
+func (f *fakeKinesis) CloseShard(shardID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if shard := f.shards[shardID]; shard != nil {
+		shard.closed = true
+	}
+}
+
+// AddChildShard adds an open shard created from the given parents, by a
+// split with one parent or a merge with two
+func (f *fakeKinesis) AddChildShard(shardID string, parents ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.shards[shardID] = &fakeShard{parents: parents}
+}
+
+// ExpireIterators expires every iterator handed out so far
+func (f *fakeKinesis) ExpireIterators() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.generation++
+}
+
+// GetShardIterator returns an iterator at the requested position
+func (f *fakeKinesis) GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	shardID := aws.StringValue(input.ShardId)
+	shard, err := f.shard(aws.StringValue(input.StreamName), shardID)
+	if err != nil {
+		return nil, err
+	}
+
+	var position int
+	switch aws.StringValue(input.ShardIteratorType) {
+	case kinesis.ShardIteratorTypeTrimHorizon:
+		position = 0
+	case kinesis.ShardIteratorTypeLatest:
+		position = len(shard.records)
+	case kinesis.ShardIteratorTypeAtSequenceNumber, kinesis.ShardIteratorTypeAfterSequenceNumber:
+		target := aws.StringValue(input.StartingSequenceNumber)
+		position = len(shard.records)
+		for i, record := range shard.records {
+			if sequenceAtOrBefore(target, aws.StringValue(record.SequenceNumber)) {
+				position = i
+				break
+			}
+		}
+		if aws.StringValue(input.ShardIteratorType) == kinesis.ShardIteratorTypeAfterSequenceNumber &&
+			position < len(shard.records) && aws.StringValue(shard.records[position].SequenceNumber) == target {
+			position++
+		}
+	case kinesis.ShardIteratorTypeAtTimestamp:
+		position = len(shard.records)
+		for i, record := range shard.records {
+			if !record.ApproximateArrivalTimestamp.Before(aws.TimeValue(input.Timestamp)) {
+				position = i
+				break
+			}
+		}
+	default:
+		return nil, awserr.New(kinesis.ErrCodeInvalidArgumentException,
+			fmt.Sprintf("invalid shard iterator type %s", aws.StringValue(input.ShardIteratorType)), nil)
+	}
+	return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String(f.iterator(shardID, position))}, nil
+}
+
+// GetRecords returns up to Limit records from the iterator's position
+func (f *fakeKinesis) GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	shardID, position, generation, err := parseFakeIterator(aws.StringValue(input.ShardIterator))
+	if err != nil {
+		return nil, awserr.New(kinesis.ErrCodeInvalidArgumentException, err.Error(), nil)
+	}
+	if generation != f.generation {
+		return nil, awserr.New(kinesis.ErrCodeExpiredIteratorException, "Iterator expired", nil)
+	}
+	shard, err := f.shard(f.stream, shardID)
+	if err != nil {
+		return nil, err
+	}
+
+	end := len(shard.records)
+	if limit := int(aws.Int64Value(input.Limit)); limit > 0 && position+limit < end {
+		end = position + limit
+	}
+	output := &kinesis.GetRecordsOutput{Records: shard.records[position:end], MillisBehindLatest: aws.Int64(0)}
+	if end < len(shard.records) {
+		behind := time.Since(aws.TimeValue(shard.records[end].ApproximateArrivalTimestamp))
+		output.MillisBehindLatest = aws.Int64(behind.Milliseconds())
+	}
+	if !shard.closed || end < len(shard.records) {
+		output.NextShardIterator = aws.String(f.iterator(shardID, end))
+	}
+	return output, nil
+}
+
+// GetRecordsWithContext is GetRecords failing as a cancelled request once
+// ctx is done
+func (f *fakeKinesis) GetRecordsWithContext(ctx aws.Context, input *kinesis.GetRecordsInput, _ ...request.Option) (*kinesis.GetRecordsOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+	return f.GetRecords(input)
+}
+
+// DescribeStreamSummary describes the fake stream as ACTIVE
+func (f *fakeKinesis) DescribeStreamSummary(input *kinesis.DescribeStreamSummaryInput) (*kinesis.DescribeStreamSummaryOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if aws.StringValue(input.StreamName) != f.stream {
+		return nil, awserr.New(kinesis.ErrCodeResourceNotFoundException, "Stream not found", nil)
+	}
+	open := 0
+	for _, shard := range f.shards {
+		if !shard.closed {
+			open++
+		}
+	}
+	return &kinesis.DescribeStreamSummaryOutput{StreamDescriptionSummary: &kinesis.StreamDescriptionSummary{
+		StreamName:     aws.String(f.stream),
+		StreamStatus:   aws.String(kinesis.StreamStatusActive),
+		OpenShardCount: aws.Int64(int64(open)),
+	}}, nil
+}
+
+// ListShards lists the fake stream's shards in ID order, one per page, so
+// callers have to follow NextToken. A closed shard has an ending sequence
+// number, a child shard its parents.
+func (f *fakeKinesis) ListShards(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	shardIDs := make([]string, 0, len(f.shards))
+	for shardID := range f.shards {
+		shardIDs = append(shardIDs, shardID)
+	}
+	sort.Strings(shardIDs)
+
+	page := 0
+	if input.NextToken != nil {
+		var err error
+		if page, err = strconv.Atoi(aws.StringValue(input.NextToken)); err != nil || page >= len(shardIDs) {
+			return nil, awserr.New(kinesis.ErrCodeInvalidArgumentException, "Invalid NextToken", nil)
+		}
+	} else if aws.StringValue(input.StreamName) != f.stream {
+		return nil, awserr.New(kinesis.ErrCodeResourceNotFoundException, "Stream not found", nil)
+	}
+	output := &kinesis.ListShardsOutput{}
+	if page == len(shardIDs) {
+		return output, nil
+	}
+	shard := &kinesis.Shard{
+		ShardId:             aws.String(shardIDs[page]),
+		SequenceNumberRange: &kinesis.SequenceNumberRange{StartingSequenceNumber: aws.String(fmt.Sprintf("%056d", 0))},
+	}
+	if parents := f.shards[shardIDs[page]].parents; len(parents) > 0 {
+		shard.ParentShardId = aws.String(parents[0])
+		if len(parents) > 1 {
+			shard.AdjacentParentShardId = aws.String(parents[1])
+		}
+	}
+	if f.shards[shardIDs[page]].closed {
+		shard.SequenceNumberRange.EndingSequenceNumber = aws.String(fmt.Sprintf("%056d", f.sequence))
+	}
+	output.Shards = []*kinesis.Shard{shard}
+	if page+1 < len(shardIDs) {
+		output.NextToken = aws.String(strconv.Itoa(page + 1))
+	}
+	return output, nil
+}
+
+func (f *fakeKinesis) shard(stream, shardID string) (*fakeShard, error) {
+	shard := f.shards[shardID]
+	if stream != f.stream || shard == nil {
+		return nil, awserr.New(kinesis.ErrCodeResourceNotFoundException,
+			fmt.Sprintf("Shard %s in stream %s not found", shardID, stream), nil)
+	}
+	return shard, nil
+}
+
+// iterator encodes a position in a shard, stamped with the current generation
+func (f *fakeKinesis) iterator(shardID string, position int) string {
+	return fmt.Sprintf("%s/%d/%d", shardID, position, f.generation)
+}
+
+func parseFakeIterator(iterator string) (shardID string, position, generation int, err error) {
+	parts := strings.Split(iterator, "/")
+	if len(parts) == 3 {
+		position, err = strconv.Atoi(parts[1])
+		if err == nil {
+			generation, err = strconv.Atoi(parts[2])
+		}
+		if err == nil {
+			return parts[0], position, generation, nil
+		}
+	}
+	return "", 0, 0, fmt.Errorf("invalid shard iterator %q", iterator)
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// KinesisAPI is the part of the Kinesis client a ManualShardProcessor
+// reads a shard through and startup checks list shards with.
+// *kinesis.Kinesis implements it; tests stand an in-memory fake in for it.
+type KinesisAPI interface {
+	GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error)
+	GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error)
+	GetRecordsWithContext(ctx aws.Context, input *kinesis.GetRecordsInput, opts ...request.Option) (*kinesis.GetRecordsOutput, error)
+	DescribeStreamSummary(input *kinesis.DescribeStreamSummaryInput) (*kinesis.DescribeStreamSummaryOutput, error)
+	ListShards(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error)
+}
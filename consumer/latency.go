@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// consumer.inject_latency_distribution values
+const (
+	LatencyDistributionFixed       = "fixed"
+	LatencyDistributionUniform     = "uniform"
+	LatencyDistributionNormal      = "normal"
+	LatencyDistributionExponential = "exponential"
+)
+
+// LatencyInjector deliberately slows record handling by sleeping before
+// every record, to study how lag builds and how rebalancing reacts when some
+// workers are slow. The delay runs as part of the handler, so it counts
+// towards consumer.handler_timeout_ms and the handler time metrics. A nil
+// *LatencyInjector adds no delay.
+type LatencyInjector struct {
+	draw func() time.Duration
+}
+
+// NewLatencyInjector returns the injector for consumer.inject_latency_ms, or
+// nil when it is not set. inject_latency_ms is the fixed delay, or the mean
+// of the distribution:
+//
+//   - fixed: always inject_latency_ms
+//   - uniform: evenly spread over inject_latency_ms ± inject_latency_jitter_ms
+//   - normal: gaussian with inject_latency_jitter_ms as the standard deviation
+//   - exponential: exponential with mean inject_latency_ms, for a long tail of slow records
+func NewLatencyInjector(cfg *Config) (*LatencyInjector, error) {
+	c := cfg.Consumer
+	if c.InjectLatencyMs <= 0 {
+		return nil, nil
+	}
+	mean := float64(c.InjectLatencyMs)
+	jitter := float64(c.InjectLatencyJitterMs)
+
+	var draw func() float64
+	switch c.InjectLatencyDistribution {
+	case LatencyDistributionFixed:
+		draw = func() float64 { return mean }
+	case LatencyDistributionUniform:
+		draw = func() float64 { return mean - jitter + rand.Float64()*2*jitter }
+	case LatencyDistributionNormal:
+		draw = func() float64 { return mean + rand.NormFloat64()*jitter }
+	case LatencyDistributionExponential:
+		draw = func() float64 { return rand.ExpFloat64() * mean }
+	default:
+		return nil, fmt.Errorf("invalid inject_latency_distribution: %s. Must be '%s', '%s', '%s' or '%s'",
+			c.InjectLatencyDistribution, LatencyDistributionFixed, LatencyDistributionUniform,
+			LatencyDistributionNormal, LatencyDistributionExponential)
+	}
+
+	return &LatencyInjector{draw: func() time.Duration {
+		// Negative draws from a wide uniform or normal distribution mean no delay
+		return time.Duration(max(draw(), 0) * float64(time.Millisecond))
+	}}, nil
+}
+
+// Wrap returns a handler that sleeps for the injected delay before calling
+// handler. A nil handler is replaced by one that only sleeps, so the delay
+// applies even without a sink.
+func (li *LatencyInjector) Wrap(handler EventHandler) EventHandler {
+	if li == nil {
+		return handler
+	}
+	return EventHandlerFunc(func(ctx context.Context, record *SinkRecord) error {
+		timer := time.NewTimer(li.draw())
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if handler == nil {
+			return nil
+		}
+		return handler.Handle(ctx, record)
+	})
+}
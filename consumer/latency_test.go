@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLatencyInjectorHandleRecord(t *testing.T) {
+	const latency = 20 * time.Millisecond
+	tests := []struct {
+		name        string
+		noSink      bool
+		timeout     time.Duration
+		wantErr     error
+		wantWritten int
+	}{
+		{name: "delays every record", wantWritten: 3},
+		{name: "delays without a sink", noSink: true},
+		{name: "counts towards the handler timeout", timeout: latency / 4, wantErr: ErrHandlerTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.InjectLatencyMs = int(latency / time.Millisecond)
+			cfg.Consumer.InjectLatencyDistribution = LatencyDistributionFixed
+			cfg.Consumer.HandlerTimeoutMs = int(tt.timeout / time.Millisecond)
+			injector, err := NewLatencyInjector(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pc := &ProcessorContext{Config: cfg, Metrics: NewMetrics(), Latency: injector}
+			sink := &collectingSink{}
+			var handler EventHandler
+			if !tt.noSink {
+				handler = pc.ShardHandler(sink)
+			}
+
+			records := testSinkRecords(0, 3)
+			for _, record := range records {
+				start := time.Now()
+				err := pc.HandleRecord(handler, record)
+				if err != tt.wantErr {
+					t.Fatalf("HandleRecord() = %v, want %v", err, tt.wantErr)
+				}
+				if elapsed := time.Since(start); tt.wantErr == nil && elapsed < latency {
+					t.Errorf("HandleRecord() took %v, want at least %v", elapsed, latency)
+				}
+			}
+
+			if got := len(sink.records()); got != tt.wantWritten {
+				t.Errorf("sink received %d records, want %d", got, tt.wantWritten)
+			}
+			metrics := pc.Metrics.Snapshot()[ShardKey{ShardID: records[0].ShardID}]
+			if metrics.HandlerCalls != int64(len(records)) {
+				t.Errorf("counted %d handler calls, want %d", metrics.HandlerCalls, len(records))
+			}
+			minMillis := float64(len(records)) * float64(latency/time.Millisecond)
+			if tt.timeout > 0 {
+				minMillis = float64(len(records)) * float64(tt.timeout/time.Millisecond)
+			}
+			if metrics.HandlerMillis < minMillis {
+				t.Errorf("handler time %.1fms, want at least %.0fms", metrics.HandlerMillis, minMillis)
+			}
+		})
+	}
+}
+
+func TestLatencyInjectorDistributions(t *testing.T) {
+	const samples = 10000
+	tests := []struct {
+		name     string
+		dist     string
+		mean     int
+		jitter   int
+		min, max time.Duration
+	}{
+		{name: "fixed", dist: LatencyDistributionFixed, mean: 10, min: 10 * time.Millisecond, max: 10 * time.Millisecond},
+		{name: "uniform", dist: LatencyDistributionUniform, mean: 10, jitter: 5, min: 5 * time.Millisecond, max: 15 * time.Millisecond},
+		{name: "uniform clamped at zero", dist: LatencyDistributionUniform, mean: 10, jitter: 20, min: 0, max: 30 * time.Millisecond},
+		{name: "normal", dist: LatencyDistributionNormal, mean: 10, jitter: 2, min: 0, max: time.Second},
+		{name: "exponential", dist: LatencyDistributionExponential, mean: 10, min: 0, max: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.InjectLatencyMs = tt.mean
+			cfg.Consumer.InjectLatencyJitterMs = tt.jitter
+			cfg.Consumer.InjectLatencyDistribution = tt.dist
+			injector, err := NewLatencyInjector(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var sum time.Duration
+			for range samples {
+				d := injector.draw()
+				if d < tt.min || d > tt.max {
+					t.Fatalf("drew %v, want within [%v, %v]", d, tt.min, tt.max)
+				}
+				sum += d
+			}
+			// Without clamping at zero every distribution centres on the mean
+			if tt.jitter <= tt.mean {
+				mean := float64(sum/samples) / float64(time.Millisecond)
+				if math.Abs(mean-float64(tt.mean)) > 0.5 {
+					t.Errorf("mean delay %.2fms, want %dms", mean, tt.mean)
+				}
+			}
+		})
+	}
+
+	cfg := &Config{}
+	cfg.Consumer.InjectLatencyMs = 10
+	cfg.Consumer.InjectLatencyDistribution = "pareto"
+	if _, err := NewLatencyInjector(cfg); err == nil {
+		t.Error("NewLatencyInjector() accepted an unknown distribution")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	chk "github.com/vmware/vmware-go-kcl/clientlibrary/checkpoint"
+	par "github.com/vmware/vmware-go-kcl/clientlibrary/partition"
+)
+
+// LeaseRenewalLogger wraps the KCL checkpointer to log every lease renewal
+// and acquisition attempt: how long the lease table took to answer, how much
+// of the lease was left when the attempt started and whether it failed.
+// Slow renewals that finish after the lease ran out are how another worker
+// gets to take the shard, so this is the first place to look when leases are
+// lost without a worker going away.
+type LeaseRenewalLogger struct {
+	chk.Checkpointer
+	labels   shardLabeler
+	workerID string
+}
+
+// NewLeaseRenewalLogger wraps inner for consumer.log_lease_renewals
+func NewLeaseRenewalLogger(inner chk.Checkpointer, cfg *Config) *LeaseRenewalLogger {
+	return &LeaseRenewalLogger{Checkpointer: inner, labels: newShardLabeler(cfg), workerID: cfg.Consumer.WorkerID}
+}
+
+// GetLease times the inner GetLease. The attempt renews the lease when this
+// worker already owns the shard, and acquires it otherwise.
+func (l *LeaseRenewalLogger) GetLease(shard *par.ShardStatus, newAssignTo string) error {
+	attempt := "acquire"
+	if shard.GetLeaseOwner() == l.workerID {
+		attempt = "renewal"
+	}
+	previousTimeout := shard.GetLeaseTimeout()
+	start := time.Now()
+
+	err := l.Checkpointer.GetLease(shard, newAssignTo)
+	finished := time.Now()
+	took := finished.Sub(start).Round(time.Millisecond)
+
+	switch {
+	case errors.As(err, &chk.ErrLeaseNotAcquired{}):
+		log.Printf("[%s] Lease %s not acquired after %v, another worker holds the lease", l.labels.logLabel(shard.ID), attempt, took)
+	case err != nil:
+		log.Printf("[%s] Lease %s failed after %v: %v", l.labels.logLabel(shard.ID), attempt, took, err)
+	case attempt == "renewal" && finished.After(previousTimeout):
+		log.Printf("[%s] Lease renewal took %v and finished %v after the lease expired, another worker could have taken it",
+			l.labels.logLabel(shard.ID), took, finished.Sub(previousTimeout).Round(time.Millisecond))
+	case attempt == "renewal":
+		log.Printf("[%s] Lease renewal took %v with %v of the lease left, now held until %s",
+			l.labels.logLabel(shard.ID), took, previousTimeout.Sub(start).Round(time.Millisecond), shard.GetLeaseTimeout().Format(time.RFC3339))
+	default:
+		log.Printf("[%s] Lease acquired in %v, held until %s", l.labels.logLabel(shard.ID), took, shard.GetLeaseTimeout().Format(time.RFC3339))
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	chk "github.com/vmware/vmware-go-kcl/clientlibrary/checkpoint"
+	par "github.com/vmware/vmware-go-kcl/clientlibrary/partition"
+)
+
+// leaseRenewer is the wrapped KCL checkpointer, taking delay to answer and
+// extending the lease by a minute unless it fails with err
+type leaseRenewer struct {
+	chk.Checkpointer
+	delay time.Duration
+	err   error
+	calls int
+}
+
+func (l *leaseRenewer) GetLease(shard *par.ShardStatus, newAssignTo string) error {
+	l.calls++
+	time.Sleep(l.delay)
+	if l.err != nil {
+		return l.err
+	}
+	shard.SetLeaseOwner(newAssignTo)
+	shard.SetLeaseTimeout(time.Now().Add(time.Minute))
+	return nil
+}
+
+func TestLeaseRenewalLogger(t *testing.T) {
+	const worker = "worker-1"
+	tests := []struct {
+		name     string
+		owner    string
+		leftMs   int // of the lease when the attempt starts
+		delay    time.Duration
+		err      error
+		wantLog  string
+		wantFail bool
+	}{
+		{name: "renewed in time", owner: worker, leftMs: 5000, wantLog: "Lease renewal took"},
+		{name: "renewed after the lease expired", owner: worker, leftMs: 5, delay: 20 * time.Millisecond, wantLog: "after the lease expired"},
+		{name: "acquired", owner: "worker-2", leftMs: -1000, wantLog: "Lease acquired in"},
+		{name: "held by another worker", owner: "worker-2", leftMs: 5000, err: chk.ErrLeaseNotAcquired{}, wantLog: "Lease acquire not acquired", wantFail: true},
+		{name: "renewal failed", owner: worker, leftMs: 5000, err: errors.New("throttled"), wantLog: "Lease renewal failed after", wantFail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logged bytes.Buffer
+			log.SetOutput(&logged)
+			defer log.SetOutput(os.Stderr)
+
+			cfg := &Config{}
+			cfg.Consumer.WorkerID = worker
+			inner := &leaseRenewer{delay: tt.delay, err: tt.err}
+			shard := &par.ShardStatus{
+				ID:           testShard,
+				AssignedTo:   tt.owner,
+				Mux:          &sync.RWMutex{},
+				LeaseTimeout: time.Now().Add(time.Duration(tt.leftMs) * time.Millisecond),
+			}
+
+			err := NewLeaseRenewalLogger(inner, cfg).GetLease(shard, worker)
+			if (err != nil) != tt.wantFail || err != tt.err {
+				t.Errorf("GetLease() = %v, want %v", err, tt.err)
+			}
+			if inner.calls != 1 {
+				t.Errorf("wrapped GetLease called %d times, want 1", inner.calls)
+			}
+			if !strings.Contains(logged.String(), "["+testShard+"] Lease") || !strings.Contains(logged.String(), tt.wantLog) {
+				t.Errorf("logged %q, want the shard's lease logged with %q", logged.String(), tt.wantLog)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// LeaseAcquireLimiter caps how fast this worker takes on shards, so a worker
+// joining the group ramps up gradually instead of reloading many checkpoints
+// at once. Acquisitions are spaced at least 1/rate apart. An enforcing
+// limiter delays acquisitions through Wait; otherwise acquisitions are only
+// observed and logged when over the rate. A nil *LeaseAcquireLimiter is
+// valid and never limits.
+type LeaseAcquireLimiter struct {
+	mu       sync.Mutex
+	enforce  bool
+	rate     float64
+	interval time.Duration
+	next     time.Time // earliest time the next acquisition is within the rate
+}
+
+// NewLeaseAcquireLimiter returns a limiter for consumer.max_lease_acquire_per_sec,
+// or nil when it is not set
+func NewLeaseAcquireLimiter(cfg *Config, enforce bool) *LeaseAcquireLimiter {
+	rate := cfg.Consumer.MaxLeaseAcquirePerSec
+	if rate <= 0 {
+		return nil
+	}
+	return &LeaseAcquireLimiter{enforce: enforce, rate: rate, interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// reserve books the next acquisition slot and returns how long the caller is
+// ahead of it
+func (l *LeaseAcquireLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	return delay
+}
+
+// Wait blocks until the shard may be acquired within the rate. It returns
+// false if ctx is cancelled first.
+func (l *LeaseAcquireLimiter) Wait(ctx context.Context, label string) bool {
+	delay := l.Delay(label)
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Delay books an acquisition of the shard and returns how long the caller
+// must wait before taking it, for callers that cannot block in Wait
+func (l *LeaseAcquireLimiter) Delay(label string) time.Duration {
+	if l == nil || !l.enforce {
+		return 0
+	}
+	delay := l.reserve()
+	if delay > 0 {
+		log.Printf("[%s] Throttling lease acquisition to %.2f/sec, starting in %v", label, l.rate, delay.Round(time.Millisecond))
+	}
+	return delay
+}
+
+// Observe records an acquisition that cannot be delayed, as in KCL mode where
+// the worker takes leases itself, and logs when it exceeds the rate. It does
+// nothing for an enforcing limiter, whose acquisitions went through Wait.
+func (l *LeaseAcquireLimiter) Observe(label string) {
+	if l == nil || l.enforce {
+		return
+	}
+	if delay := l.reserve(); delay > 0 {
+		log.Printf("[%s] WARNING: lease acquired above consumer.max_lease_acquire_per_sec (%.2f/sec), %v early",
+			label, l.rate, delay.Round(time.Millisecond))
+	}
+}
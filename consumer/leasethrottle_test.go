@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// firstWriteSink records when each shard first wrote a record
+type firstWriteSink struct {
+	mu    sync.Mutex
+	first map[string]time.Time
+}
+
+func (s *firstWriteSink) Write(record *SinkRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.first[record.ShardID]; !ok {
+		s.first[record.ShardID] = time.Now()
+	}
+	return nil
+}
+
+func (s *firstWriteSink) Close() error { return nil }
+
+func TestLeaseAcquireLimiterScaleOut(t *testing.T) {
+	const shards, rate = 5, 40.0
+	interval := time.Duration(float64(time.Second) / rate)
+	for _, model := range []string{ExecutionModelGoroutinePerShard, ExecutionModelSharedPool} {
+		t.Run(model, func(t *testing.T) {
+			// A worker joining the group is handed every shard at once
+			shardIDs := make([]string, shards)
+			for i := range shardIDs {
+				shardIDs[i] = fmt.Sprintf("shardId-%012d", i)
+			}
+			fake := newFakeKinesis(testStream, shardIDs...)
+			cfg := &Config{}
+			cfg.Kinesis.StreamName = testStream
+			cfg.Consumer.MaxLeaseAcquirePerSec = rate
+			sink := &firstWriteSink{first: make(map[string]time.Time)}
+			pc := &ProcessorContext{Config: cfg, Sink: sink, LeaseLimiter: NewLeaseAcquireLimiter(cfg, true)}
+			completion := newShardCompletion(shardIDs)
+			processors := make([]*ManualShardProcessor, shards)
+			for i, shardID := range shardIDs {
+				fake.AddRecords(t, shardID, "user_1", testEvents(0, 1)...)
+				fake.CloseShard(shardID)
+				msp := newTestProcessor(fake, cfg)
+				msp.shardID, msp.label = shardID, shardID
+				msp.pc = pc
+				msp.completion = completion
+				processors[i] = msp
+			}
+
+			start := time.Now()
+			if model == ExecutionModelSharedPool {
+				runSharedPool(context.Background(), processors, shards)
+			} else {
+				var wg sync.WaitGroup
+				for _, msp := range processors {
+					wg.Add(1)
+					go msp.ProcessShard(context.Background(), &wg)
+				}
+				wg.Wait()
+			}
+
+			var started []time.Duration
+			for _, at := range sink.first {
+				started = append(started, at.Sub(start))
+			}
+			sort.Slice(started, func(i, j int) bool { return started[i] < started[j] })
+			if len(started) != shards {
+				t.Fatalf("%d shards started, want %d", len(started), shards)
+			}
+			// The nth shard starts no sooner than n intervals in
+			for i, at := range started {
+				if at < time.Duration(i)*interval {
+					t.Errorf("shard %d started after %v, want at least %v", i, at, time.Duration(i)*interval)
+				}
+			}
+		})
+	}
+}
+
+func TestLeaseAcquireLimiterDelay(t *testing.T) {
+	cfg := &Config{}
+	cfg.Consumer.MaxLeaseAcquirePerSec = 10
+	tests := []struct {
+		name    string
+		limiter *LeaseAcquireLimiter
+		want    []time.Duration // rounded delays of back-to-back acquisitions
+	}{
+		{name: "unset", limiter: NewLeaseAcquireLimiter(&Config{}, true), want: []time.Duration{0, 0, 0}},
+		{name: "enforcing", limiter: NewLeaseAcquireLimiter(cfg, true), want: []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond}},
+		{name: "observing only", limiter: NewLeaseAcquireLimiter(cfg, false), want: []time.Duration{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []time.Duration
+			for range tt.want {
+				tt.limiter.Observe(testShard)
+				got = append(got, tt.limiter.Delay(testShard).Round(10*time.Millisecond))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("delays %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
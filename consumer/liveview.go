@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultLiveViewIntervalMs is how often the live view refreshes
+const DefaultLiveViewIntervalMs = 1000
+
+// liveViewLogLines is how many recent log lines the terminal view keeps below the table
+const liveViewLogLines = 12
+
+// ANSI sequences moving the cursor home and clearing the screen
+const ansiClearScreen = "\x1b[H\x1b[2J"
+
+// LiveView renders a per-shard summary of the metrics every interval, for
+// demos: who owns each shard, records/sec, lag and the last event's action.
+// On a terminal the screen is redrawn in place and log output is kept in a
+// pane below the table instead of scrolling past. Anywhere else, such as a
+// pipe or a container log, it falls back to logging the summary.
+type LiveView struct {
+	out      io.Writer
+	tty      bool
+	metrics  *Metrics
+	workerID string
+
+	prev   map[ShardKey]ShardMetrics
+	prevAt time.Time
+
+	mu   sync.Mutex
+	logs []string // recent log lines, oldest first (terminal only)
+	part []byte   // log output not ending in a newline yet
+}
+
+// NewLiveView creates a view of the metrics written to out
+func NewLiveView(out io.Writer, tty bool, metrics *Metrics, workerID string) *LiveView {
+	return &LiveView{out: out, tty: tty, metrics: metrics, workerID: workerID}
+}
+
+// isTerminal reports whether f is a character device such as a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// startLiveView runs a LiveView on stdout when consumer.live_view is set and
+// returns a function that stops it. On a terminal, log output is captured
+// into the view until then.
+func startLiveView(cfg *Config, metrics *Metrics) func() {
+	if !cfg.Consumer.LiveView {
+		return func() {}
+	}
+
+	view := NewLiveView(os.Stdout, isTerminal(os.Stdout), metrics, cfg.Consumer.WorkerID)
+	if view.tty {
+		log.SetOutput(view)
+		logrus.SetOutput(view)
+	} else {
+		log.Println("Live view: stdout is not a terminal, logging shard summaries instead")
+	}
+
+	interval := time.Duration(cfg.Consumer.LiveViewIntervalMs) * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				view.Render(now)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+		if view.tty {
+			log.SetOutput(os.Stderr)
+			logrus.SetOutput(os.Stderr)
+		}
+	}
+}
+
+// Write captures log output for the terminal view, keeping the last lines
+func (lv *LiveView) Write(p []byte) (int, error) {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	lv.part = append(lv.part, p...)
+	for {
+		i := bytes.IndexByte(lv.part, '\n')
+		if i < 0 {
+			break
+		}
+		lv.logs = append(lv.logs, string(lv.part[:i]))
+		lv.part = lv.part[i+1:]
+	}
+	if len(lv.logs) > liveViewLogLines {
+		lv.logs = append([]string(nil), lv.logs[len(lv.logs)-liveViewLogLines:]...)
+	}
+	return len(p), nil
+}
+
+// liveViewRow is one shard's line in the view
+type liveViewRow struct {
+	key        ShardKey
+	owner      string
+	rate       float64
+	lag        string
+	lastAction string
+}
+
+// rows computes the view of every shard, with rates measured since the previous call
+func (lv *LiveView) rows(now time.Time) []liveViewRow {
+	snapshot := lv.metrics.Snapshot()
+	held := make(map[ShardKey]bool)
+	for _, key := range lv.metrics.HeldShards() {
+		held[key] = true
+	}
+	elapsed := now.Sub(lv.prevAt).Seconds()
+
+	rows := make([]liveViewRow, 0, len(snapshot))
+	for _, key := range sortedShardKeys(snapshot) {
+		sm := snapshot[key]
+		row := liveViewRow{key: key, owner: "released", lag: "-", lastAction: dashIfEmpty(sm.LastAction)}
+		if held[key] {
+			row.owner = lv.workerID
+		}
+		// A shard missing from the previous render started processing since
+		if !lv.prevAt.IsZero() && elapsed > 0 {
+			row.rate = float64(sm.RecordsProcessed-lv.prev[key].RecordsProcessed) / elapsed
+		}
+		if sm.HasLag {
+			row.lag = (time.Duration(sm.MillisBehindLatest) * time.Millisecond).String()
+		}
+		rows = append(rows, row)
+	}
+
+	lv.prev = snapshot
+	lv.prevAt = now
+	return rows
+}
+
+// Render draws the view once
+func (lv *LiveView) Render(now time.Time) {
+	rows := lv.rows(now)
+	if !lv.tty {
+		for _, row := range rows {
+			log.Printf("Live view: %s | owner %s | %.1f records/sec | lag %s | last action %s",
+				shardLabel(row.key), row.owner, row.rate, row.lag, row.lastAction)
+		}
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(ansiClearScreen)
+	fmt.Fprintf(&buf, "Worker %s | %s\n\n", lv.workerID, now.Format(time.TimeOnly))
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SHARD\tOWNER\tRECORDS/SEC\tLAG\tLAST ACTION")
+	for _, row := range rows {
+		fmt.Fprintf(w, "%s\t%s\t%.1f\t%s\t%s\n", shardLabel(row.key), row.owner, row.rate, row.lag, row.lastAction)
+	}
+	w.Flush()
+
+	lv.mu.Lock()
+	if len(lv.logs) > 0 {
+		fmt.Fprintf(&buf, "\nRecent log:\n%s\n", strings.Join(lv.logs, "\n"))
+	}
+	lv.mu.Unlock()
+	lv.out.Write(buf.Bytes())
+}
+
+// shardLabel names a shard, prefixed with its stream when it has one
+func shardLabel(key ShardKey) string {
+	if key.Stream == "" {
+		return key.ShardID
+	}
+	return key.Stream + "/" + key.ShardID
+}
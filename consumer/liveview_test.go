@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLiveViewRender(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.LeaseAcquired(testShard)
+	metrics.RecordsProcessed(testShard, 10)
+	metrics.SetMillisBehindLatest(testShard, 1500)
+	metrics.SetLastAction(testShard, "purchase")
+	start := time.Now()
+
+	tests := []struct {
+		name    string
+		tty     bool
+		wantOut []string // on the view's output
+		wantLog []string // in the log
+	}{
+		{
+			name:    "terminal",
+			tty:     true,
+			wantOut: []string{ansiClearScreen, "Worker worker-1", "SHARD", testShard, "worker-1", "1.5s", "purchase"},
+		},
+		{
+			name:    "not a terminal",
+			wantLog: []string{"Live view: " + testShard + " | owner worker-1 | 0.0 records/sec | lag 1.5s | last action purchase"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logged bytes.Buffer
+			log.SetOutput(&logged)
+			defer log.SetOutput(os.Stderr)
+
+			var out bytes.Buffer
+			NewLiveView(&out, tt.tty, metrics, "worker-1").Render(start)
+
+			for _, want := range tt.wantOut {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("view shows %q, want it to contain %q", out.String(), want)
+				}
+			}
+			for _, want := range tt.wantLog {
+				if !strings.Contains(logged.String(), want) {
+					t.Errorf("logged %q, want it to contain %q", logged.String(), want)
+				}
+			}
+			// Without a terminal nothing is redrawn, the summary goes to the log
+			if !tt.tty && out.Len() != 0 {
+				t.Errorf("view wrote %q off a terminal, want nothing", out.String())
+			}
+		})
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if isTerminal(f) {
+		t.Error("isTerminal() reported a regular file as a terminal")
+	}
+}
@@ -2,20 +2,28 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/kds-rebalance/internal/envconfig"
 	"github.com/sirupsen/logrus"
+	chk "github.com/vmware/vmware-go-kcl/clientlibrary/checkpoint"
 	"github.com/vmware/vmware-go-kcl/clientlibrary/config"
 	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
 	"github.com/vmware/vmware-go-kcl/clientlibrary/worker"
@@ -29,9 +37,15 @@ type Config struct {
 		Endpoint  string `yaml:"endpoint"`
 		AccessKey string `yaml:"access_key"`
 		SecretKey string `yaml:"secret_key"`
+		RoleARN   string `yaml:"role_arn"` // assume this role when access_key is empty
 	} `yaml:"aws"`
 	Kinesis struct {
-		StreamName string `yaml:"stream_name"`
+		StreamName  string   `yaml:"stream_name"`
+		StreamNames []string `yaml:"stream_names"` // consume several streams at once (overrides stream_name)
+
+		// MultipleStreams is set by configForStream on the config of each of
+		// several streams consumed at once
+		MultipleStreams bool `yaml:"-"`
 	} `yaml:"kinesis"`
 	Consumer struct {
 		AssignmentMode                           string   `yaml:"assignment_mode"` // "kcl" or "manual"
@@ -41,11 +55,185 @@ type Config struct {
 		CallProcessRecordsEvenForEmptyRecordList bool     `yaml:"call_process_records_even_for_empty_list"`
 		AssignedShards                           []string `yaml:"assigned_shards"`
 		PollIntervalMs                           int      `yaml:"poll_interval_ms"`
+		Processor                                string   `yaml:"processor"`         // registered processor name, defaults to "logging"
+		OnStreamDeleted                          string   `yaml:"on_stream_deleted"` // "exit" (default) or "wait_for_recreate"
+		Sink                                     struct {
+			Type    string `yaml:"type"` // "" (none), "file", "parquet", "grpc", "aggregates" or "multi"
+			Path    string `yaml:"path"` // file: output file; parquet: output directory
+			Parquet struct {
+				RotateIntervalMs int      `yaml:"rotate_interval_ms"` // start a new file per shard this often
+				MetadataColumns  []string `yaml:"metadata_columns"`   // metadata keys also written as their own columns
+			} `yaml:"parquet"`
+			GRPC struct {
+				Address            string `yaml:"address"`              // host:port of the EventService in events.proto
+				TLS                bool   `yaml:"tls"`                  // use TLS with the system roots instead of plaintext
+				MaxInFlight        int    `yaml:"max_in_flight"`        // unacknowledged events per shard before writes block
+				ReconnectBackoffMs int    `yaml:"reconnect_backoff_ms"` // first reconnect delay, doubled on every failure
+			} `yaml:"grpc"`
+			Aggregates struct {
+				WindowMs   int `yaml:"window_ms"`   // how far back GET /aggregates covers
+				BucketMs   int `yaml:"bucket_ms"`   // resolution the window moves by
+				MaxActions int `yaml:"max_actions"` // distinct actions tracked per bucket, the rest count as "other"
+			} `yaml:"aggregates"`
+			Multi struct {
+				Sinks []SinkDestination `yaml:"sinks"` // destinations every record is written to, the first is the primary
+				Ack   string            `yaml:"ack"`   // checkpoint once "all" destinations have a record, or the "primary"
+			} `yaml:"multi"`
+			Errors struct {
+				Transient      string `yaml:"transient"`        // action for retryable failures: "retry", "dlq", "skip" or "halt"
+				Permanent      string `yaml:"permanent"`        // action for non-retryable failures: "dlq", "skip" or "halt"
+				RetryAttempts  int    `yaml:"retry_attempts"`   // retries of a transient failure before the permanent action applies
+				RetryBackoffMs int    `yaml:"retry_backoff_ms"` // first retry delay, doubled on every retry
+				DLQPath        string `yaml:"dlq_path"`         // JSON-lines file receiving dead-lettered records
+			} `yaml:"errors"`
+		} `yaml:"sink"`
+		BufferMemoryBytes int64              `yaml:"buffer_memory_bytes"` // spill sink records to disk beyond this many bytes (0 disables buffering)
+		BufferSpillBytes  int64              `yaml:"buffer_spill_bytes"`  // most bytes of records spilled to disk per shard before the buffer is full (0 is unbounded)
+		ShedWhenFull      bool               `yaml:"shed_when_full"`      // drop the oldest buffered records instead of blocking when the buffer is full
+		ShardPriorities   map[string]float64 `yaml:"shard_priorities"`    // manual mode: shard ID -> poll weight (default 1)
+		ShardStartOrder   string             `yaml:"shard_start_order"`   // manual mode: as_assigned, oldest_data_first or lexical
+		VerifyCheckpoints bool               `yaml:"verify_checkpoints"`  // kcl mode: read each checkpoint back from the lease table
+		Affinity          struct {
+			Enabled            bool `yaml:"enabled"`
+			GraceMs            int  `yaml:"grace_ms"`            // how long a lapsed shard is held for its previous owner
+			ImbalanceThreshold int  `yaml:"imbalance_threshold"` // lease-count gap that overrides affinity
+		} `yaml:"affinity"`
+		RebalanceHooks struct {
+			Command    string `yaml:"command"`     // shell command run on shard assign/release
+			WebhookURL string `yaml:"webhook_url"` // URL POSTed a JSON payload on shard assign/release
+			TimeoutMs  int    `yaml:"timeout_ms"`
+		} `yaml:"rebalance_hooks"`
+		Preload struct {
+			Command         string `yaml:"command"` // shell command that must exit 0 before processing starts
+			URL             string `yaml:"url"`     // URL that must return 2xx before processing starts
+			TimeoutMs       int    `yaml:"timeout_ms"`
+			RetryIntervalMs int    `yaml:"retry_interval_ms"`
+		} `yaml:"preload"`
+		WindowMs           int      `yaml:"window_ms"`            // tumbling window size for the windowed processor
+		WindowStateTable   string   `yaml:"window_state_table"`   // DynamoDB table persisting open windows across rebalances
+		PrefetchBatches    int      `yaml:"prefetch_batches"`     // manual mode: batches fetched ahead of processing
+		DetectOverlap      string   `yaml:"detect_overlap"`       // manual mode: "warn" or "fail" on shards claimed by another worker
+		OverlapTable       string   `yaml:"overlap_table"`        // DynamoDB table holding manual-mode shard claims
+		HandlerTimeoutMs   int      `yaml:"handler_timeout_ms"`   // skip a record whose handler runs longer than this (0 waits forever)
+		HandlerTimeoutDLQ  bool     `yaml:"handler_timeout_dlq"`  // also write a timed-out record to dlq_file
+		ClientPerShard     bool     `yaml:"client_per_shard"`     // manual mode: dedicated Kinesis client and connection pool per shard
+		EnforceParentOrder bool     `yaml:"enforce_parent_order"` // manual mode: start child shards only after their parents reach end-of-shard
+		ExecutionModel     string   `yaml:"execution_model"`      // manual mode: "goroutine_per_shard" or "shared_pool"
+		SharedPoolSize     int      `yaml:"shared_pool_size"`     // shared_pool: worker goroutines reading all the shards
+		LeaseTableName     string   `yaml:"lease_table_name"`     // kcl mode: override the lease table name (defaults to application_name)
+		HTTPAddr           string   `yaml:"http_addr"`            // serve /healthz and /readyz on this address (empty disables)
+		MetricsAddr        string   `yaml:"metrics_addr"`         // serve only /metrics on this address (empty disables)
+		HealthDegradedMs   int      `yaml:"health_degraded_ms"`   // mark not ready when the processing loop is delayed longer than this
+		MaxParseErrorRate  float64  `yaml:"max_parse_error_rate"` // fraction of undecodable records per shard that triggers parse_error_action (0 disables)
+		ParseErrorWindow   int      `yaml:"parse_error_window"`   // number of recent records the rate is measured over
+		ParseErrorAction   string   `yaml:"parse_error_action"`   // "log", "pause" or "exit"
+		ParseErrorPauseMs  int      `yaml:"parse_error_pause_ms"` // how long "pause" stops the shard
+		SamplingRate       *float64 `yaml:"sampling_rate"`        // fraction of events handed to the handler, chosen by event ID (unset keeps all)
+		Backfill           struct {
+			Bucket        string `yaml:"bucket"`         // S3 bucket of historical JSON-lines events read before tailing (empty disables backfill)
+			Prefix        string `yaml:"prefix"`         // only objects under this key prefix are read
+			StartPosition string `yaml:"start_position"` // where tailing starts afterwards: "boundary", "TRIM_HORIZON" or "LATEST"
+			OverlapMs     int    `yaml:"overlap_ms"`     // boundary: start tailing this long before the newest backfilled event
+		} `yaml:"backfill"`
+		MaxLeaseAcquirePerSec     float64 `yaml:"max_lease_acquire_per_sec"`   // cap on shards taken per second (manual mode delays, kcl mode logs; 0 disables)
+		Ordering                  string  `yaml:"ordering"`                    // kcl mode: "strict" (handle and checkpoint in sequence order) or "relaxed"
+		OrderingConcurrency       int     `yaml:"ordering_concurrency"`        // relaxed: records handled at once per shard
+		InjectLatencyMs           int     `yaml:"inject_latency_ms"`           // sleep before handling each record, or the mean of the distribution (0 disables)
+		InjectLatencyDistribution string  `yaml:"inject_latency_distribution"` // "fixed", "uniform", "normal" or "exponential"
+		InjectLatencyJitterMs     int     `yaml:"inject_latency_jitter_ms"`    // uniform: half-width; normal: standard deviation
+		StopOnMarker              bool    `yaml:"stop_on_marker"`              // stop once every processed shard has delivered the producer's end marker
+		LiveView                  bool    `yaml:"live_view"`                   // redraw a per-shard summary on the terminal instead of scrolling logs
+		LiveViewIntervalMs        int     `yaml:"live_view_interval_ms"`       // how often the live view refreshes
+		ShutdownDrainPrefetch     bool    `yaml:"shutdown_drain_prefetch"`     // prefetch_batches: handle prefetched batches on shutdown instead of discarding them
+		ShardPromotionRPS         float64 `yaml:"shard_promotion_rps"`         // manual mode: poll shards from one goroutine, giving one above this rate its own (0 disables)
+		ShardPromotionWindowMs    int     `yaml:"shard_promotion_window_ms"`   // how long a shard's rate is measured over for promotion
+		FutureTimestampPolicy     string  `yaml:"future_timestamp_policy"`     // "accept", "clamp_to_now" or "drop" events timestamped in the future
+		FutureTimestampSkewMs     int     `yaml:"future_timestamp_skew_ms"`    // how far ahead of the consumer's clock a timestamp may be before it counts as future
+		LogLeaseRenewals          bool    `yaml:"log_lease_renewals"`          // kcl mode: log the timing and outcome of every lease renewal and acquisition
+		SlowCheckpointMs          int     `yaml:"slow_checkpoint_ms"`          // kcl mode: warn about checkpoint writes slower than this (0 disables)
+		EmptyBatchAction          string  `yaml:"empty_batch_action"`          // kcl mode: "none", "heartbeat", "flush" or "checkpoint" on idle shards
+		EmptyBatchIntervalMs      int     `yaml:"empty_batch_interval_ms"`     // kcl mode: idle time before the empty batch action runs, and between runs
+		OffsetMapPath             string  `yaml:"offset_map_path"`             // file the last processed sequence number of every shard is written to on shutdown
+		HMACSecret                string  `yaml:"hmac_secret"`                 // verify the producer's record signatures with this secret (empty disables)
+		HMACDLQPath               string  `yaml:"hmac_dlq_path"`               // JSON-lines file receiving records that fail verification
+		UnknownVersionAction      string  `yaml:"unknown_version_action"`      // "skip", "current" or "dlq" for events of an unknown schema version
+		UnknownVersionDLQPath     string  `yaml:"unknown_version_dlq_path"`    // JSON-lines file receiving events of an unknown schema version
+		MetricsCardinality        string  `yaml:"metrics_cardinality"`         // "per_shard", "aggregate" or "top_n" shard labels on Prometheus metrics
+		MetricsTopN               int     `yaml:"metrics_top_n"`               // top_n: busiest shards per stream labeled on their own
+		ContinuityCheck           bool    `yaml:"continuity_check"`            // kcl mode: alert when a reacquired shard resumes past where it was released
+		ContinuityLogPath         string  `yaml:"continuity_log_path"`         // JSON-lines release/acquire log shared by workers for continuity_check
+		IteratorType              string  `yaml:"iterator_type"`               // manual mode: where shards start reading, a Kinesis shard iterator type
+		IteratorTimestamp         string  `yaml:"iterator_timestamp"`          // AT_TIMESTAMP: RFC 3339 time to start reading at
+		IteratorSequenceNumber    string  `yaml:"iterator_sequence_number"`    // AT_/AFTER_SEQUENCE_NUMBER: sequence number to start reading at or after
+		CheckpointFile            string  `yaml:"checkpoint_file"`             // manual mode: JSON file shards are checkpointed to and resumed from (empty disables)
+		CheckpointIntervalMs      int     `yaml:"checkpoint_interval_ms"`      // how often changed checkpoints are written to checkpoint_file
+		FollowChildShards         bool    `yaml:"follow_child_shards"`         // manual mode: start reading the children of an assigned shard once it is closed by a reshard
+		MinPollIntervalMs         int     `yaml:"min_poll_interval_ms"`        // manual mode: wait between polls of a shard far behind or handed a full batch
+		MaxPollIntervalMs         int     `yaml:"max_poll_interval_ms"`        // manual mode: longest wait a caught-up shard backs off to (0 disables adaptive polling)
+		DLQFile                   string  `yaml:"dlq_file"`                    // JSON-lines file receiving records that fail to unmarshal (empty drops them)
+		ShardScanIntervalMs       int     `yaml:"shard_scan_interval_ms"`      // manual mode: how often the stream is listed to start new shards this worker owns (0 disables)
+		ShutdownTimeoutMs         int     `yaml:"shutdown_timeout_ms"`         // manual mode: how long a shard may take to drain and checkpoint on shutdown
+		CheckpointHistory         struct {
+			Size int    `yaml:"size"` // checkpoints kept per shard for GET /checkpoints/{shard}/history (0 disables)
+			Path string `yaml:"path"` // JSON file the history is written to on shutdown (empty keeps it in memory only)
+		} `yaml:"checkpoint_history"`
+		CheckpointRetry struct {
+			MaxAttempts int `yaml:"max_attempts"`  // checkpoint writes made before a throttled or transient failure is returned (1 disables retries)
+			BaseDelayMs int `yaml:"base_delay_ms"` // delay before the first retry, doubled for each one after
+		} `yaml:"checkpoint_retry"`
+		KeyFilter struct {
+			StartHashKey string `yaml:"start_hash_key"` // lowest hash key handled, in decimal (default 0)
+			EndHashKey   string `yaml:"end_hash_key"`   // highest hash key handled, in decimal (default 2^128-1)
+		} `yaml:"key_filter"`
+		ReadBudget struct {
+			CallsPerSec int `yaml:"calls_per_sec"` // manual mode: GetRecords calls per shard per second
+			BytesPerSec int `yaml:"bytes_per_sec"` // manual mode: bytes read per shard per second
+		} `yaml:"read_budget"`
+		SinkHealth struct {
+			ProbeIntervalMs  int    `yaml:"probe_interval_ms"` // how often the sink is probed (0 disables)
+			FailureThreshold int    `yaml:"failure_threshold"` // failed probes in a row that pause polling
+			URL              string `yaml:"url"`               // probe this URL, 2xx is healthy, instead of the sink itself
+		} `yaml:"sink_health"`
+		Audit struct {
+			Path      string `yaml:"path"`        // JSON-lines file receiving every record's handler outcome (empty disables)
+			MaxFileMB int    `yaml:"max_file_mb"` // rotate the file to a timestamped name at this size
+			Buffer    int    `yaml:"buffer"`      // entries queued for the background writer
+			WhenFull  string `yaml:"when_full"`   // "drop" entries or "block" the shard when the queue is full
+		} `yaml:"audit"`
+		IdempotencyTable struct {
+			Name     string `yaml:"name"`      // DynamoDB table recording handled event IDs (empty disables)
+			TTLHours int    `yaml:"ttl_hours"` // how long an event ID is remembered
+		} `yaml:"idempotency_table"`
+		Scale struct {
+			TargetLagMs       int     `yaml:"target_lag_ms"`       // lag /scale-recommendation sizes the deployment to stay under
+			HorizonMs         int     `yaml:"horizon_ms"`          // how soon lag above the target should be drained
+			WindowMs          int     `yaml:"window_ms"`           // oldest sample rates are measured against
+			WorkerCapacityRps float64 `yaml:"worker_capacity_rps"` // records/sec one worker drains (0 measures this worker)
+		} `yaml:"scale"`
+		ShardLeases struct {
+			Table           string `yaml:"table"`             // manual mode: DynamoDB table workers lease shards from, instead of each reading all its assigned_shards (empty disables)
+			DurationMs      int    `yaml:"duration_ms"`       // how long a lease lasts without being renewed
+			RenewIntervalMs int    `yaml:"renew_interval_ms"` // how often leases are renewed and shards claimed or handed over
+		} `yaml:"shard_leases"`
+
+		// FieldMapping reads events whose JSON keys were renamed by
+		// producer.field_mapping (user_id: uid)
+		FieldMapping map[string]string `yaml:"field_mapping"`
+
+		// ManualShardMapping maps shard IDs to the worker ID that leases
+		// them in kcl mode, checked against the stream at startup (empty
+		// lets KCL balance the leases among workers)
+		ManualShardMapping map[string]string `yaml:"manual_shard_mapping"`
 	} `yaml:"consumer"`
+	Telemetry struct {
+		CloudWatchNamespace  string `yaml:"cloudwatch_namespace"` // publish metrics to CloudWatch when set
+		CloudWatchIntervalMs int    `yaml:"cloudwatch_interval_ms"`
+	} `yaml:"telemetry"`
 }
 
 // Event represents a sample data event
 type Event struct {
+	Version   int                    `json:"version"` // schema version, 0 for events from before versioning
 	EventID   string                 `json:"event_id"`
 	UserID    string                 `json:"user_id"`
 	Timestamp time.Time              `json:"timestamp"`
@@ -56,148 +244,572 @@ type Event struct {
 
 // RecordProcessor implements the KCL RecordProcessor interface
 type RecordProcessor struct {
-	shardID     string
-	recordCount int
-	startTime   time.Time
+	pc             *ProcessorContext
+	shardID        string
+	label          string // shardID as logged
+	recordCount    int
+	startTime      time.Time
+	delivery       ShardDelivery // nil when sink writes are durable immediately
+	handler        EventHandler
+	lastCheckpoint string
+	lastSeen       string // sequence number of the last record handled or held back
+	rewind         rewindRequest
+	owner          bool         // false while another processor in this process holds the shard
+	halted         atomic.Bool  // the sink failed under the "halt" action; nothing more is checkpointed
+	pool           *relaxedPool // nil unless consumer.ordering is relaxed
+	reprocessUntil time.Time    // while set, records that arrived before it count as reprocessed
+	reprocessed    int
+	lastActive     time.Time // when the shard last had records or ran its empty batch action
 }
 
 // Initialize is called once when the processor starts processing a shard
 func (rp *RecordProcessor) Initialize(input *interfaces.InitializationInput) {
 	rp.shardID = input.ShardId
+	rp.label = rp.pc.logLabel(rp.shardID)
 	rp.recordCount = 0
 	rp.startTime = time.Now()
-	log.Printf("[%s] Initializing record processor", rp.shardID)
+	rp.lastActive = rp.startTime
+	log.Printf("[%s] Initializing record processor", rp.label)
+
+	sink, delivery, err := rp.pc.ShardSink(rp.shardID)
+	if err != nil {
+		log.Printf("[%s] Failed to set up sink buffering, writing directly: %v", rp.label, err)
+	}
+	rp.delivery = delivery
+	rp.handler = rp.pc.ShardHandler(sink)
+	if rp.pc.Config.Consumer.Ordering == OrderingRelaxed {
+		rp.pool = newRelaxedPool(rp.pc.Config.Consumer.OrderingConcurrency, rp.handleRecord)
+	}
+
+	if input.ExtendedSequenceNumber != nil {
+		checkpoint := checkpointSequence(aws.StringValue(input.ExtendedSequenceNumber.SequenceNumber))
+		rp.rewind.checkpointed(checkpoint)
+		// Resuming from another owner's checkpoint: what it handled after
+		// checkpointing is read again
+		if checkpoint != "" {
+			rp.reprocessUntil = rp.startTime
+		}
+	}
+
+	if err := rp.pc.Shards.Register(rp.shardID, rp); err != nil {
+		log.Printf("[%s] ALERT: rejecting duplicate record processor: %v. Records are held back until it shuts down",
+			rp.label, err)
+		return
+	}
+	rp.owner = true
+	rp.pc.ShardAssigned(rp.shardID)
+	rp.pc.Continuity.Acquired(rp.shardID, rp.rewind.checkpointedAt())
+}
+
+// takeOver retries registering a rejected processor once the other processor
+// for the shard has gone, then replays the records held back meanwhile
+func (rp *RecordProcessor) takeOver() bool {
+	if err := rp.pc.Shards.Register(rp.shardID, rp); err != nil {
+		return false
+	}
+	log.Printf("[%s] Previous processor for the shard has shut down, taking over", rp.label)
+	rp.owner = true
+	rp.pc.ShardAssigned(rp.shardID)
+	rp.pc.Continuity.Acquired(rp.shardID, rp.rewind.checkpointedAt())
+	rp.replay(rp.rewind.checkpointedAt())
+	return true
 }
 
 // ProcessRecords is called to process a batch of records from the shard
 func (rp *RecordProcessor) ProcessRecords(input *interfaces.ProcessRecordsInput) {
+	if !rp.owner && !rp.takeOver() {
+		// Neither handled nor checkpointed; remembered so takeOver replays them
+		if len(input.Records) > 0 {
+			rp.lastSeen = aws.StringValue(input.Records[len(input.Records)-1].SequenceNumber)
+		}
+		return
+	}
+
+	rp.pc.Metrics.SetMillisBehindLatest(rp.shardID, input.MillisBehindLatest)
+
+	if !rp.waitForSink(len(input.Records)) {
+		return
+	}
+
+	if from, ok := rp.rewind.take(); ok {
+		rp.replay(from)
+	}
+
 	// Process each record
 	for _, record := range input.Records {
-		var event Event
-		if err := json.Unmarshal(record.Data, &event); err != nil {
-			log.Printf("[%s] Failed to unmarshal record: %v", rp.shardID, err)
-			continue
+		if rp.halted.Load() {
+			return
 		}
-
-		rp.recordCount++
-		log.Printf("[%s] Record #%d | EventID: %s | UserID: %s | Action: %s | Value: %.2f | SeqNum: %s",
-			rp.shardID, rp.recordCount, event.EventID, event.UserID, event.Action, event.Value, *record.SequenceNumber)
+		rp.countReprocessed(record)
+		if rp.pool != nil {
+			rp.pool.submit(aws.StringValue(record.SequenceNumber), rp.decodeRecord(record))
+		} else {
+			rp.processRecord(record)
+		}
+		rp.lastSeen = aws.StringValue(record.SequenceNumber)
+	}
+	if rp.halted.Load() {
+		return
+	}
+	if len(input.Records) == 0 {
+		rp.idle(input.Checkpointer)
+	} else {
+		rp.lastActive = time.Now()
 	}
 
 	// Checkpoint after processing records
-	if len(input.Records) > 0 {
-		lastRecord := input.Records[len(input.Records)-1]
-		if err := input.Checkpointer.Checkpoint(lastRecord.SequenceNumber); err != nil {
-			log.Printf("[%s] Failed to checkpoint: %v", rp.shardID, err)
+	if len(input.Records) > 0 || rp.pool != nil {
+		var sequenceNumber *string
+		if rp.pool != nil {
+			// Records may still be in flight, only the contiguous completed prefix is safe
+			completed := rp.pool.completed()
+			if completed == "" || sequenceAtOrBefore(completed, rp.lastCheckpoint) {
+				return
+			}
+			sequenceNumber = &completed
+		} else {
+			sequenceNumber = input.Records[len(input.Records)-1].SequenceNumber
+		}
+
+		// With a buffered or Parquet sink, only checkpoint what the sink has
+		// made durable. While replayed records are buffered after a rewind
+		// that is behind the last checkpoint, which is kept until the sink
+		// delivers past it: a checkpoint never moves back.
+		if rp.delivery != nil {
+			delivered := rp.delivery.Delivered()
+			if delivered == "" || sequenceAtOrBefore(delivered, rp.lastCheckpoint) {
+				return
+			}
+			sequenceNumber = &delivered
+		}
+
+		if err := rp.pc.Checkpoint(rp.shardID, input.Checkpointer, sequenceNumber); err != nil {
+			log.Printf("[%s] Failed to checkpoint: %v", rp.label, err)
+			return
+		}
+		rp.lastCheckpoint = *sequenceNumber
+		rp.rewind.checkpointed(rp.lastCheckpoint)
+	}
+}
+
+// countReprocessed counts the records read after resuming from a checkpoint
+// as reprocessed until the first one that arrived in the stream after the
+// shard was taken. Records before that were most likely handled by the
+// previous owner already, so the count approximates the duplication a
+// rebalance costs.
+func (rp *RecordProcessor) countReprocessed(record *kinesis.Record) {
+	if rp.reprocessUntil.IsZero() {
+		return
+	}
+	if aws.TimeValue(record.ApproximateArrivalTimestamp).Before(rp.reprocessUntil) {
+		rp.reprocessed++
+		rp.pc.Metrics.RecordsReprocessed(rp.shardID, 1)
+		return
+	}
+	log.Printf("[%s] Reached records newer than the takeover after reprocessing %d records", rp.label, rp.reprocessed)
+	rp.reprocessUntil = time.Time{}
+}
+
+// processRecord decodes and handles a single record
+func (rp *RecordProcessor) processRecord(record *kinesis.Record) {
+	if sinkRecord := rp.decodeRecord(record); sinkRecord != nil {
+		rp.handleRecord(sinkRecord)
+	}
+}
+
+// decodeRecord decodes and logs a record, returning nil for one that is not handled
+func (rp *RecordProcessor) decodeRecord(record *kinesis.Record) *SinkRecord {
+	event, err := rp.pc.DecodeEvent(rp.shardID, record)
+	if err != nil {
+		if !errors.Is(err, ErrFutureTimestamp) && !errors.Is(err, ErrInvalidSignature) && !errors.Is(err, ErrUnknownVersion) {
+			log.Printf("[%s] Failed to unmarshal record: %v", rp.label, err)
 		}
+		return nil
+	}
+	if rp.pc.Backfill.Covers(event) || rp.pc.EndMarker(rp.shardID, event) || rp.pc.KeyFilter.Skips(record) || rp.pc.Sampler.Skips(event) {
+		return nil
 	}
+
+	rp.recordCount++
+	rp.pc.Metrics.RecordsProcessed(rp.shardID, 1)
+	rp.pc.Metrics.SetLastAction(rp.shardID, event.Action)
+	log.Printf("[%s] Record #%d | EventID: %s | UserID: %s | Action: %s | Value: %.2f | SeqNum: %s",
+		rp.label, rp.recordCount, event.EventID, event.UserID, event.Action, event.Value, *record.SequenceNumber)
+
+	return newSinkRecord(rp.pc.Config.Kinesis.StreamName, rp.shardID, record, event)
+}
+
+// handleRecord runs the handler for a decoded record. It returns false if
+// the record may not be checkpointed.
+func (rp *RecordProcessor) handleRecord(sinkRecord *SinkRecord) bool {
+	err := rp.pc.HandleRecord(rp.handler, sinkRecord)
+	switch {
+	case errors.Is(err, ErrSinkHalted):
+		// The consumer is stopping; the checkpoint must stay before this record
+		rp.halted.Store(true)
+		return false
+	case err != nil && err != ErrHandlerTimeout:
+		log.Printf("[%s] Failed to handle record: %v", rp.label, err)
+	}
+	return true
 }
 
 // Shutdown is called when the processor is shutting down
 func (rp *RecordProcessor) Shutdown(input *interfaces.ShutdownInput) {
 	elapsed := time.Since(rp.startTime).Seconds()
 	log.Printf("[%s] Shutting down. Reason: %v. Processed %d records in %.2f seconds",
-		rp.shardID, input.ShutdownReason, rp.recordCount, elapsed)
+		rp.label, input.ShutdownReason, rp.recordCount, elapsed)
 
-	// Checkpoint on graceful shutdown
-	if input.ShutdownReason == interfaces.TERMINATE {
-		if err := input.Checkpointer.Checkpoint(nil); err != nil {
-			log.Printf("[%s] Failed to checkpoint on shutdown: %v", rp.shardID, err)
+	if rp.delivery != nil {
+		defer rp.delivery.Close()
+	}
+	// Let records still in flight finish before deciding how far to checkpoint
+	if rp.pool != nil {
+		rp.pool.close()
+	}
+
+	// A rejected duplicate never owned the shard, so it must not checkpoint it
+	if !rp.owner {
+		log.Printf("[%s] Rejected duplicate processor shut down without processing", rp.label)
+		return
+	}
+	reason := aws.StringValue(interfaces.ShutdownReasonMessage(input.ShutdownReason))
+	rp.pc.ShardReleased(rp.shardID, reason)
+	rp.pc.Continuity.Released(rp.shardID, reason, rp.lastSeen, rp.rewind.checkpointedAt())
+	rp.pc.Shards.Unregister(rp.shardID, rp)
+
+	// In relaxed ordering, records may have completed since the last batch was checkpointed
+	if rp.pool != nil && input.ShutdownReason == interfaces.REQUESTED {
+		if completed := rp.pool.completed(); completed != "" && !sequenceAtOrBefore(completed, rp.lastCheckpoint) {
+			if err := rp.pc.Checkpoint(rp.shardID, input.Checkpointer, &completed); err != nil {
+				log.Printf("[%s] Failed to checkpoint on shutdown: %v", rp.label, err)
+			}
+		}
+	}
+
+	// Checkpoint on graceful shutdown, unless a halted sink left records unwritten
+	if input.ShutdownReason == interfaces.TERMINATE && !rp.halted.Load() {
+		// Records still buffered have not reached the sink, so the shard
+		// must not be marked finished until they have
+		if rp.delivery != nil && !rp.delivery.WaitDrained(bufferDrainTimeout) {
+			log.Printf("[%s] %d buffered records not delivered, checkpointing delivered position only",
+				rp.label, rp.delivery.Pending())
+			if delivered := rp.delivery.Delivered(); delivered != "" {
+				if err := rp.pc.Checkpoint(rp.shardID, input.Checkpointer, &delivered); err != nil {
+					log.Printf("[%s] Failed to checkpoint on shutdown: %v", rp.label, err)
+				}
+			}
+			return
+		}
+		if err := rp.pc.Checkpoint(rp.shardID, input.Checkpointer, nil); err != nil {
+			log.Printf("[%s] Failed to checkpoint on shutdown: %v", rp.label, err)
 		}
 	}
 }
 
-// RecordProcessorFactory creates new RecordProcessor instances
-type RecordProcessorFactory struct{}
+// RecordProcessorFactory creates record processors using the configured constructor
+type RecordProcessorFactory struct {
+	pc          *ProcessorContext
+	constructor ProcessorConstructor
+}
 
-// CreateProcessor creates a new RecordProcessor for a shard
+// CreateProcessor creates a new record processor for a shard
 func (f *RecordProcessorFactory) CreateProcessor() interfaces.IRecordProcessor {
-	return &RecordProcessor{}
+	return f.constructor(f.pc)
 }
 
 // ManualShardProcessor processes records from a specific shard
 type ManualShardProcessor struct {
-	shardID       string
-	streamName    string
-	kinesisClient *kinesis.Kinesis
-	maxRecords    int64
-	pollInterval  time.Duration
-	recordCount   int
-	startTime     time.Time
+	shardID         string
+	streamName      string
+	label           string // shardID as logged
+	kinesisClient   KinesisAPI
+	maxRecords      int64
+	pollInterval    time.Duration
+	shutdownTimeout time.Duration // how long drain may take
+	onStreamDeleted string
+	stopAll         context.CancelFunc
+	pc              *ProcessorContext
+	handler         EventHandler
+	prefetchBatches int
+	drainPrefetch   bool     // handle prefetched batches on shutdown rather than discarding them
+	parents         []string // assigned parent shards that must finish before this one starts
+	completion      *shardCompletion
+	children        *childShards
+	child           bool // started while running for a shard a reshard created, so it reads from TRIM_HORIZON
+	rewind          rewindRequest
+	recordCount     int
+	startTime       time.Time
+
+	// Set by open and undone by close
+	registered    bool
+	assigned      bool
+	releaseReason string
+	delivery      ShardDelivery
+
+	// Fetch state, owned by whichever goroutine calls nextBatch
+	shardIterator *string
+	shardClosed   bool
+	lastFetch     time.Time
+	lastFetched   string // sequence number of the last record read with shardIterator
+	budget        *readBudget
+	adaptivePoll  *adaptivePoll
+}
+
+// startPosition returns the GetShardIterator call positioning a fresh
+// iterator right after the shard's checkpoint in its consumer.shard_leases
+// lease or in consumer.checkpoint_file, or without one at
+// consumer.iterator_type or where a backfill from S3 handed off. A shard
+// started while running for a reshard, by follow_child_shards, a shard scan
+// or a lease on a child shard, reads from TRIM_HORIZON instead, so none of
+// the records written since the reshard are skipped.
+func (msp *ManualShardProcessor) startPosition() (*kinesis.GetShardIteratorInput, error) {
+	input := &kinesis.GetShardIteratorInput{
+		StreamName:        aws.String(msp.streamName),
+		ShardId:           aws.String(msp.shardID),
+		ShardIteratorType: aws.String(msp.pc.Backfill.shardIteratorType()),
+		Timestamp:         msp.pc.Backfill.startTimestamp(),
+	}
+	if msp.pc.Backfill == nil && !msp.child {
+		if err := setIteratorStart(input, msp.pc.Config); err != nil {
+			return nil, err
+		}
+	}
+	from := msp.pc.Leases.Resume(msp.shardID)
+	if from == "" {
+		from = msp.pc.Checkpoints.Resume(msp.shardID)
+	}
+	if from != "" {
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+		input.StartingSequenceNumber = aws.String(from)
+		input.Timestamp = nil
+	}
+	return input, nil
+}
+
+// getShardIterator returns a fresh iterator at the shard's start position
+func (msp *ManualShardProcessor) getShardIterator() (*string, error) {
+	input, err := msp.startPosition()
+	if err != nil {
+		return nil, err
+	}
+	iteratorOutput, err := msp.kinesisClient.GetShardIterator(input)
+	if err != nil {
+		return nil, err
+	}
+	return iteratorOutput.ShardIterator, nil
+}
+
+// handleStreamDeleted applies the on_stream_deleted policy and returns a new
+// iterator to continue with, or nil if the processor should stop
+func (msp *ManualShardProcessor) handleStreamDeleted(ctx context.Context) *string {
+	if msp.onStreamDeleted != OnStreamDeletedWaitForRecreate {
+		log.Printf("[%s] Stream %s deleted, exiting", msp.label, msp.streamName)
+		msp.stopAll()
+		return nil
+	}
+
+	log.Printf("[%s] Stream %s deleted, waiting for it to be recreated", msp.label, msp.streamName)
+	if err := waitForStream(ctx, msp.kinesisClient, msp.streamName, msp.pollInterval); err != nil {
+		return nil
+	}
+
+	shardIterator, err := msp.getShardIterator()
+	if err != nil {
+		log.Printf("[%s] Failed to get shard iterator after stream recreation: %v", msp.label, err)
+		return nil
+	}
+	return shardIterator
 }
 
 // ProcessShard processes records from the assigned shard in a loop
 func (msp *ManualShardProcessor) ProcessShard(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
+	defer msp.pc.Leases.Finished(msp.shardID)
 
-	msp.startTime = time.Now()
-	log.Printf("[%s] [Goroutine] Starting manual processor for shard", msp.shardID)
+	if len(msp.parents) > 0 {
+		log.Printf("[%s] Waiting for parent shards %v to finish", msp.label, msp.parents)
+		if !msp.completion.wait(ctx, msp.parents) {
+			return
+		}
+		log.Printf("[%s] Parent shards finished", msp.label)
+	}
+	if !msp.pc.LeaseLimiter.Wait(ctx, msp.label) {
+		return
+	}
 
-	// Get shard iterator
-	iteratorOutput, err := msp.kinesisClient.GetShardIterator(&kinesis.GetShardIteratorInput{
-		StreamName:        aws.String(msp.streamName),
-		ShardId:           aws.String(msp.shardID),
-		ShardIteratorType: aws.String("TRIM_HORIZON"), // Start from beginning
-	})
-	if err != nil {
-		log.Printf("[%s] Failed to get shard iterator: %v", msp.shardID, err)
+	if !msp.open(ctx) {
+		msp.close(context.Background())
 		return
 	}
+	if msp.consume(ctx) && ctx.Err() != nil && !msp.shardClosed {
+		if !errors.Is(context.Cause(ctx), ErrLeaseLost) {
+			msp.drain()
+			return
+		}
+		// Another worker reads the shard now, so nothing more is handled
+		log.Printf("[%s] [Goroutine] Stopping, the shard lease was lost", msp.label)
+		msp.releaseReason = "ZOMBIE"
+	}
+	msp.close(context.Background())
+}
 
-	shardIterator := iteratorOutput.ShardIterator
+// consume reads the opened shard until it is closed, the sink halts or ctx
+// is cancelled, returning false if the sink halted
+func (msp *ManualShardProcessor) consume(ctx context.Context) bool {
+	next := batchSource(msp.nextBatch)
+	if msp.prefetchBatches > 0 {
+		next = msp.prefetch(ctx, msp.prefetchBatches)
+	}
 
 	for {
-		select {
-		case <-ctx.Done():
-			elapsed := time.Since(msp.startTime).Seconds()
-			log.Printf("[%s] [Goroutine] Stopping. Processed %d records in %.2f seconds",
-				msp.shardID, msp.recordCount, elapsed)
-			return
-		default:
-			if shardIterator == nil {
-				log.Printf("[%s] Shard iterator is nil, shard might be closed", msp.shardID)
-				return
-			}
+		batch, ok := next(ctx)
+		if !ok {
+			break
+		}
+		// A batch fetched before shutdown is handled whole; drain bounds
+		// what is read after it
+		if !msp.handleBatch(context.Background(), batch) {
+			return false
+		}
+	}
+	msp.stopped(ctx)
+	return true
+}
 
-			// Get records
-			getRecordsOutput, err := msp.kinesisClient.GetRecords(&kinesis.GetRecordsInput{
-				ShardIterator: shardIterator,
-				Limit:         aws.Int64(msp.maxRecords),
-			})
-			if err != nil {
-				log.Printf("[%s] Failed to get records: %v", msp.shardID, err)
-				time.Sleep(msp.pollInterval)
-				continue
-			}
+// open takes the shard and positions its iterator, returning false if it
+// cannot be read. Whatever it did is undone by close.
+func (msp *ManualShardProcessor) open(ctx context.Context) bool {
+	// A shard listed twice in assigned_shards must not be read twice
+	if err := msp.pc.Shards.Register(msp.shardID, msp); err != nil {
+		log.Printf("[%s] ALERT: rejecting duplicate shard processor: %v", msp.label, err)
+		return false
+	}
+	msp.registered = true
 
-			// Process records
-			for _, record := range getRecordsOutput.Records {
-				var event Event
-				if err := json.Unmarshal(record.Data, &event); err != nil {
-					log.Printf("[%s] Failed to unmarshal record: %v", msp.shardID, err)
-					continue
-				}
+	msp.startTime = time.Now()
+	log.Printf("[%s] [Goroutine] Starting manual processor for shard", msp.label)
+
+	msp.pc.ShardAssigned(msp.shardID)
+	msp.assigned = true
+	msp.releaseReason = "REQUESTED"
+
+	sink, delivery, err := msp.pc.ShardSink(msp.shardID)
+	if err != nil {
+		log.Printf("[%s] Failed to set up sink buffering, writing directly: %v", msp.label, err)
+	}
+	msp.handler = msp.pc.ShardHandler(sink)
+	msp.delivery = delivery
 
-				msp.recordCount++
-				log.Printf("[%s] [Goroutine] Record #%d | EventID: %s | UserID: %s | Action: %s | Value: %.2f | SeqNum: %s",
-					msp.shardID, msp.recordCount, event.EventID, event.UserID, event.Action, event.Value, *record.SequenceNumber)
+	// Get shard iterator
+	shardIterator, err := msp.getShardIterator()
+	if err != nil {
+		log.Printf("[%s] Failed to get shard iterator: %v", msp.label, err)
+		if !isStreamNotFound(err) {
+			return false
+		}
+		if shardIterator = msp.handleStreamDeleted(ctx); shardIterator == nil {
+			return false
+		}
+	}
+	msp.shardIterator = shardIterator
+	return true
+}
+
+// handleBatch processes the records of a batch in order, returning false if
+// the shard must stop. Once ctx is done it stops before the next record,
+// leaving the batch uncheckpointed.
+func (msp *ManualShardProcessor) handleBatch(ctx context.Context, batch *fetchedBatch) bool {
+	for _, record := range batch.records {
+		if ctx.Err() != nil {
+			return false
+		}
+		event, err := msp.pc.DecodeEvent(msp.shardID, record)
+		if err != nil {
+			if !errors.Is(err, ErrFutureTimestamp) && !errors.Is(err, ErrInvalidSignature) && !errors.Is(err, ErrUnknownVersion) {
+				log.Printf("[%s] Failed to unmarshal record: %v", msp.label, err)
 			}
+			continue
+		}
+		if msp.pc.Backfill.Covers(event) || msp.pc.EndMarker(msp.shardID, event) || msp.pc.KeyFilter.Skips(record) || msp.pc.Sampler.Skips(event) {
+			continue
+		}
 
-			// Update iterator for next fetch
-			shardIterator = getRecordsOutput.NextShardIterator
+		msp.recordCount++
+		msp.pc.Metrics.RecordsProcessed(msp.shardID, 1)
+		msp.pc.Metrics.SetLastAction(msp.shardID, event.Action)
+		log.Printf("[%s] [Goroutine] Record #%d | EventID: %s | UserID: %s | Action: %s | Value: %.2f | SeqNum: %s",
+			msp.label, msp.recordCount, event.EventID, event.UserID, event.Action, event.Value, *record.SequenceNumber)
 
-			// Wait before next poll
-			time.Sleep(msp.pollInterval)
+		err = msp.pc.HandleRecord(msp.handler, newSinkRecord(msp.streamName, msp.shardID, record, event))
+		switch {
+		case errors.Is(err, ErrSinkHalted):
+			log.Printf("[%s] [Goroutine] Stopping after sink failure on record %s", msp.label, *record.SequenceNumber)
+			return false
+		case err != nil && err != ErrHandlerTimeout:
+			log.Printf("[%s] Failed to handle record: %v", msp.label, err)
 		}
 	}
+
+	msp.pc.Metrics.SetMillisBehindLatest(msp.shardID, batch.millisBehindLatest)
+	msp.checkpoint(batch)
+	return true
+}
+
+// checkpoint records the shard's progress in consumer.checkpoint_file once a
+// batch is handled: its last record, or with a buffered or sharded sink the
+// last record the sink made durable
+func (msp *ManualShardProcessor) checkpoint(batch *fetchedBatch) {
+	if len(batch.records) == 0 {
+		return
+	}
+	position := aws.StringValue(batch.records[len(batch.records)-1].SequenceNumber)
+	if msp.delivery != nil {
+		position = msp.delivery.Delivered()
+	}
+	msp.pc.Checkpoints.Processed(msp.shardID, position)
+	msp.pc.Leases.Processed(msp.shardID, position)
+}
+
+// stopped logs why reading an opened shard ended
+func (msp *ManualShardProcessor) stopped(ctx context.Context) {
+	switch {
+	case msp.shardClosed:
+		log.Printf("[%s] Shard iterator is nil, shard might be closed", msp.label)
+		msp.releaseReason = "TERMINATE"
+		msp.completion.markFinished(msp.shardID)
+		msp.children.parentClosed(msp.shardID)
+	case ctx.Err() != nil:
+		elapsed := time.Since(msp.startTime).Seconds()
+		log.Printf("[%s] [Goroutine] Stopping. Processed %d records in %.2f seconds",
+			msp.label, msp.recordCount, elapsed)
+	}
+}
+
+// close releases what open took, in reverse order. With a deadline on ctx,
+// buffered records get until then to become durable before the sink is
+// closed.
+func (msp *ManualShardProcessor) close(ctx context.Context) {
+	if msp.delivery != nil {
+		if deadline, ok := ctx.Deadline(); ok {
+			msp.delivery.WaitDrained(max(time.Until(deadline), 0))
+		}
+		msp.delivery.Close()
+		// Closing made the rest of the buffered records durable
+		msp.pc.Checkpoints.Processed(msp.shardID, msp.delivery.Delivered())
+		msp.pc.Leases.Processed(msp.shardID, msp.delivery.Delivered())
+	}
+	if msp.assigned {
+		msp.pc.ShardReleased(msp.shardID, msp.releaseReason)
+	}
+	if msp.registered {
+		msp.pc.Shards.Unregister(msp.shardID, msp)
+	}
 }
 
 func loadConfig() (*Config, error) {
 	// Check for custom config file path from environment variable
-	configFile := os.Getenv("CONFIG_FILE")
-	if configFile == "" {
-		configFile = "../config.yaml"
-	}
+	configFile := envconfig.ConfigFile()
 
 	data, err := os.ReadFile(configFile)
 	if err != nil {
@@ -210,52 +822,257 @@ func loadConfig() (*Config, error) {
 	}
 
 	log.Printf("Loaded configuration from: %s", configFile)
+	applied, err := envconfig.Apply([]envconfig.Override{
+		{Env: "AWS_REGION", Field: &cfg.AWS.Region},
+		{Env: "AWS_ENDPOINT", Field: &cfg.AWS.Endpoint},
+		{Env: "KINESIS_STREAM_NAME", Field: &cfg.Kinesis.StreamName},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(applied) > 0 {
+		log.Printf("Applied environment overrides: %s", strings.Join(applied, ", "))
+	}
+	cfg.ApplyDefaults()
 	return &cfg, nil
 }
 
-func runManualMode(cfg *Config) error {
-	log.Println("Running in MANUAL assignment mode")
-	log.Printf("Worker ID: %s, Assigned Shards: %v", cfg.Consumer.WorkerID, cfg.Consumer.AssignedShards)
+// redactedSecret stands in for credentials in printed configuration
+const redactedSecret = "REDACTED"
 
-	// Create AWS session
+// printConfig writes the effective configuration, after defaults, as YAML
+// with credentials masked. The output can be used as a config file again.
+func printConfig(w io.Writer, cfg *Config) error {
+	redacted := *cfg
+	for _, secret := range []*string{&redacted.AWS.AccessKey, &redacted.AWS.SecretKey, &redacted.Consumer.HMACSecret} {
+		if *secret != "" {
+			*secret = redactedSecret
+		}
+	}
+	data, err := yaml.Marshal(&redacted)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// newAWSSession creates an AWS session from the AWS section of the config.
+// Its calls are retried with refreshed credentials when rejected as expired.
+func newAWSSession(cfg *Config) (*session.Session, error) {
+	creds, err := newCredentials(cfg)
+	if err != nil {
+		return nil, err
+	}
 	awsConfig := &aws.Config{
 		Region:      aws.String(cfg.AWS.Region),
 		Endpoint:    aws.String(cfg.AWS.Endpoint),
-		Credentials: credentials.NewStaticCredentials(cfg.AWS.AccessKey, cfg.AWS.SecretKey, ""),
+		Credentials: creds,
 	}
 	sess, err := session.NewSession(awsConfig)
 	if err != nil {
-		return fmt.Errorf("failed to create AWS session: %w", err)
+		return nil, fmt.Errorf("failed to create AWS session: %w", err)
+	}
+	sess.Handlers.Retry.PushBackNamed(expiredCredentialsHandler)
+	return sess, nil
+}
+
+// newKinesisClient creates a Kinesis client from the AWS section of the config
+func newKinesisClient(cfg *Config) (*kinesis.Kinesis, error) {
+	sess, err := newAWSSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return kinesis.New(sess), nil
+}
+
+// newDedicatedKinesisClient creates a Kinesis client with its own HTTP
+// connection pool instead of the process-wide default transport
+func newDedicatedKinesisClient(cfg *Config) (*kinesis.Kinesis, error) {
+	sess, err := newAWSSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	return kinesis.New(sess, &aws.Config{HTTPClient: &http.Client{Transport: transport}}), nil
+}
+
+// shardKinesisClient returns the client a shard is read with: the shared
+// client, or a dedicated one with consumer.client_per_shard
+func shardKinesisClient(cfg *Config, shared KinesisAPI) (KinesisAPI, error) {
+	if !cfg.Consumer.ClientPerShard {
+		return shared, nil
 	}
+	return newDedicatedKinesisClient(cfg)
+}
 
-	kinesisClient := kinesis.New(sess)
+func runManualMode(ctx context.Context, cfg *Config, rt *Runtime) error {
+	log.Println("Running in MANUAL assignment mode")
+	log.Printf("Stream: %s, Worker ID: %s, Assigned Shards: %v",
+		cfg.Kinesis.StreamName, cfg.Consumer.WorkerID, cfg.Consumer.AssignedShards)
+
+	onStreamDeleted, err := streamDeletedPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	model, err := executionModel(cfg)
+	if err != nil {
+		return err
+	}
+	if err := validateFollowChildShards(cfg, model); err != nil {
+		return err
+	}
+	if err := validateShardScan(cfg, model); err != nil {
+		return err
+	}
+	if err := validateShardLeases(cfg, model); err != nil {
+		return err
+	}
+	if err := validateAdaptivePoll(cfg); err != nil {
+		return err
+	}
+
+	// Create Kinesis client
+	kinesisClient, err := newKinesisClient(cfg)
+	if err != nil {
+		return err
+	}
 
 	// Validate assigned shards exist
-	describeOutput, err := kinesisClient.DescribeStream(&kinesis.DescribeStreamInput{
-		StreamName: aws.String(cfg.Kinesis.StreamName),
-	})
+	shards, err := listShards(kinesisClient, cfg.Kinesis.StreamName)
 	if err != nil {
-		return fmt.Errorf("failed to describe stream: %w", err)
+		return err
 	}
 
-	availableShards := make(map[string]bool)
-	for _, shard := range describeOutput.StreamDescription.Shards {
-		availableShards[*shard.ShardId] = true
+	assigned, owns, err := assignShards(cfg, shards)
+	if err != nil {
+		return err
 	}
+	// The validations and processors below read the shards to start from the config
+	cfg.Consumer.AssignedShards = assigned
 
-	// Validate configuration
-	for _, shardID := range cfg.Consumer.AssignedShards {
-		if !availableShards[shardID] {
-			return fmt.Errorf("assigned shard %s does not exist in stream", shardID)
-		}
+	if err := validateShardPriorities(cfg); err != nil {
+		return err
+	}
+	if err := validateShardStartOrder(cfg); err != nil {
+		return err
+	}
+	if err := validateIteratorStart(cfg); err != nil {
+		return err
+	}
+	if err := validateBuffer(cfg); err != nil {
+		return err
 	}
 
-	log.Printf("Validated %d assigned shards against stream", len(cfg.Consumer.AssignedShards))
+	sink, err := newSink(cfg, rt.Aggregates)
+	if err != nil {
+		return err
+	}
+	if sink != nil {
+		defer sink.Close()
+	}
+	sinkErrors, err := NewSinkErrorPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	defer sinkErrors.Close()
+	sinkHealth, err := NewSinkHealth(cfg, sink)
+	if err != nil {
+		return err
+	}
+	defer sinkHealth.Close()
+	parseErrors, err := NewParseErrorMonitor(cfg)
+	if err != nil {
+		return err
+	}
+	latency, err := NewLatencyInjector(cfg)
+	if err != nil {
+		return err
+	}
+	futureTimestamps, err := NewFutureTimestampPolicy(cfg, rt.Metrics)
+	if err != nil {
+		return err
+	}
+	fields, err := NewFieldMapping(cfg)
+	if err != nil {
+		return err
+	}
+	keyFilter, err := NewKeyFilter(cfg)
+	if err != nil {
+		return err
+	}
+	signatures, err := NewSignatureVerifier(cfg)
+	if err != nil {
+		return err
+	}
+	sampler, err := NewSampler(cfg)
+	if err != nil {
+		return err
+	}
+	defer signatures.Close()
+	versions, err := NewEventVersions(cfg)
+	if err != nil {
+		return err
+	}
+	defer versions.Close()
+	deadLetters, err := NewDeadLetterSink(cfg)
+	if err != nil {
+		return err
+	}
+	if deadLetters != nil {
+		defer deadLetters.Close()
+	}
+	idempotency, err := NewIdempotencyStore(cfg)
+	if err != nil {
+		return err
+	}
+	leases, err := NewShardLeases(cfg, kinesisClient, owns)
+	if err != nil {
+		return err
+	}
 
 	// Create context for graceful shutdown
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	var abortOnce sync.Once
+	var abortErr error
+	pc := &ProcessorContext{
+		Config:       cfg,
+		Sink:         sink,
+		SinkErrors:   sinkErrors,
+		Hooks:        NewRebalanceHooks(cfg),
+		Metrics:      rt.Metrics,
+		ParseErrors:  parseErrors,
+		Fields:       fields,
+		KeyFilter:    keyFilter,
+		Signatures:   signatures,
+		Versions:     versions,
+		SinkHealth:   sinkHealth,
+		Sampler:      sampler,
+		Latency:      latency,
+		Idempotency:  idempotency,
+		Audit:        rt.Audit,
+		Offsets:      rt.Offsets,
+		Backfill:     rt.Backfill,
+		Shards:       rt.Shards,
+		LeaseLimiter: NewLeaseAcquireLimiter(cfg, true),
+		Kinesis:      kinesisClient,
+		Abort: func(err error) {
+			abortOnce.Do(func() {
+				abortErr = err
+				cancel()
+			})
+		},
+		Stop: cancel,
+	}
+	pc.EndMarkers = NewEndMarkers(cfg, rt.Shards, pc.Stop)
+	pc.FutureTimestamps = futureTimestamps
+	pc.StreamHandler = rt.Handler
+	pc.Checkpoints = rt.Checkpoints
+	pc.DeadLetters = deadLetters
+	pc.Leases = leases
+
 	// Setup signal handling
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
@@ -266,33 +1083,145 @@ func runManualMode(cfg *Config) error {
 		cancel()
 	}()
 
-	// Start a goroutine for each assigned shard
+	releaseClaims, err := claimAssignedShards(cfg)
+	if err != nil {
+		return err
+	}
+	defer releaseClaims()
+
+	// Children of a split or merge wait for their parents to be read to the end
+	var parents map[string][]string
+	completion := newShardCompletion(cfg.Consumer.AssignedShards)
+	if cfg.Consumer.EnforceParentOrder {
+		parents = assignedParents(shards, cfg.Consumer.AssignedShards)
+	}
+
+	var processors []*ManualShardProcessor
 	var wg sync.WaitGroup
+	var children *childShards
 	pollInterval := time.Duration(cfg.Consumer.PollIntervalMs) * time.Millisecond
+	top := topPriority(cfg)
+
+	newProcessor := func(shardID string, parents []string) (*ManualShardProcessor, error) {
+		weight := shardPriority(cfg, shardID)
+		shardPollInterval, shardMaxRecords := prioritizedPolling(pollInterval, cfg.Consumer.MaxRecords, weight, top)
+		if weight != 1 || top != 1 {
+			log.Printf("[%s] Priority %.2f: polling every %v with up to %d records",
+				newShardLabeler(cfg).logLabel(shardID), weight, shardPollInterval, shardMaxRecords)
+		}
 
-	for _, shardID := range cfg.Consumer.AssignedShards {
+		shardClient, err := shardKinesisClient(cfg, kinesisClient)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ManualShardProcessor{
+			shardID:         shardID,
+			streamName:      cfg.Kinesis.StreamName,
+			label:           newShardLabeler(cfg).logLabel(shardID),
+			kinesisClient:   shardClient,
+			maxRecords:      shardMaxRecords,
+			pollInterval:    shardPollInterval,
+			onStreamDeleted: onStreamDeleted,
+			stopAll:         cancel,
+			pc:              pc,
+			prefetchBatches: cfg.Consumer.PrefetchBatches,
+			drainPrefetch:   cfg.Consumer.ShutdownDrainPrefetch,
+			shutdownTimeout: time.Duration(cfg.Consumer.ShutdownTimeoutMs) * time.Millisecond,
+			parents:         parents,
+			completion:      completion,
+			children:        children,
+			budget:          newReadBudget(cfg),
+			adaptivePoll:    newAdaptivePoll(cfg, shardPollInterval),
+		}, nil
+	}
+	// Shards started while running, children of closed shards and shards
+	// found by scans, run alongside the others, so wg.Wait also waits for them
+	starter := newShardStarter(cfg, completion, func(shardID string, parents []string) {
+		msp, err := newProcessor(shardID, parents)
+		if err != nil {
+			log.Printf("[%s] ALERT: failed to start shard, it is not read: %v", newShardLabeler(cfg).logLabel(shardID), err)
+			return
+		}
+		msp.child = true
 		wg.Add(1)
-		processor := &ManualShardProcessor{
-			shardID:       shardID,
-			streamName:    cfg.Kinesis.StreamName,
-			kinesisClient: kinesisClient,
-			maxRecords:    int64(cfg.Consumer.MaxRecords),
-			pollInterval:  pollInterval,
+		go msp.ProcessShard(ctx, &wg)
+	})
+	children = newChildShards(cfg, kinesisClient, starter)
+	scanner := newShardScanner(cfg, kinesisClient, owns, starter)
+
+	// With shard_leases, shards start as their leases are claimed instead
+	if leases == nil {
+		for _, shardID := range cfg.Consumer.AssignedShards {
+			msp, err := newProcessor(shardID, parents[shardID])
+			if err != nil {
+				return err
+			}
+			processors = append(processors, msp)
 		}
-		go processor.ProcessShard(ctx, &wg)
 	}
+	orderShardStart(cfg, processors)
 
-	log.Printf("Started %d goroutines (one per assigned shard)", len(cfg.Consumer.AssignedShards))
-	log.Println("Consumer is running. Press Ctrl+C to stop.")
+	if cfg.Consumer.ClientPerShard {
+		log.Println("Each shard uses its own Kinesis client and connection pool")
+	}
+	if cfg.Consumer.PrefetchBatches > 0 {
+		onShutdown := "discarded, to be read again on restart"
+		if cfg.Consumer.ShutdownDrainPrefetch {
+			onShutdown = "handled before stopping"
+		}
+		log.Printf("Prefetching up to %d batches per shard; on shutdown prefetched batches are %s",
+			cfg.Consumer.PrefetchBatches, onShutdown)
+	}
+	switch {
+	case model == ExecutionModelSharedPool:
+		log.Printf("Started a pool of %d goroutines for %d assigned shards",
+			min(cfg.Consumer.SharedPoolSize, len(processors)), len(processors))
+		log.Println("Consumer is running. Press Ctrl+C to stop.")
+		runSharedPool(ctx, processors, cfg.Consumer.SharedPoolSize)
+	case cfg.Consumer.ShardPromotionRPS > 0:
+		log.Printf("Reading %d assigned shards from one polling goroutine, promoting shards above %g records/sec to their own",
+			len(processors), cfg.Consumer.ShardPromotionRPS)
+		log.Println("Consumer is running. Press Ctrl+C to stop.")
+		runMergedShards(ctx, processors, cfg.Consumer.ShardPromotionRPS,
+			time.Duration(cfg.Consumer.ShardPromotionWindowMs)*time.Millisecond)
+	default:
+		// Start a goroutine for each assigned shard
+		for _, processor := range processors {
+			wg.Add(1)
+			go processor.ProcessShard(ctx, &wg)
+		}
+		log.Printf("Started %d goroutines (one per assigned shard)", len(processors))
+		if scanner != nil {
+			log.Printf("Scanning the stream for new shards every %v", scanner.interval)
+			wg.Add(1)
+			go scanner.run(ctx, &wg)
+		}
+		if leases != nil {
+			wg.Add(1)
+			go leases.run(ctx, &wg, func(shardCtx context.Context, shardID string, child bool) {
+				msp, err := newProcessor(shardID, nil)
+				if err != nil {
+					log.Printf("[%s] ALERT: failed to start leased shard, releasing it: %v", newShardLabeler(cfg).logLabel(shardID), err)
+					leases.Finished(shardID)
+					return
+				}
+				msp.child = child
+				wg.Add(1)
+				go msp.ProcessShard(shardCtx, &wg)
+			})
+		}
+		log.Println("Consumer is running. Press Ctrl+C to stop.")
 
-	// Wait for all goroutines to finish
-	wg.Wait()
+		// Wait for all goroutines to finish
+		wg.Wait()
+	}
 	log.Println("All shard processors stopped.")
-	return nil
+	return abortErr
 }
 
-func runKCLMode(cfg *Config) error {
-	log.Println("Running in KCL assignment mode (automatic rebalancing)")
+func runKCLMode(ctx context.Context, cfg *Config, rt *Runtime) error {
+	log.Println("Running in KCL assignment mode (automatic rebalancing unless manual_shard_mapping is set)")
 
 	// Enable debug logging for KCL library
 	logrus.SetLevel(logrus.DebugLevel)
@@ -312,74 +1241,439 @@ func runKCLMode(cfg *Config) error {
 	kclConfig.KinesisEndpoint = cfg.AWS.Endpoint
 	kclConfig.DynamoDBEndpoint = cfg.AWS.Endpoint
 
-	// Set credentials for LocalStack
-	kclConfig.KinesisCredentials = credentials.NewStaticCredentials(cfg.AWS.AccessKey, cfg.AWS.SecretKey, "")
-	kclConfig.DynamoDBCredentials = credentials.NewStaticCredentials(cfg.AWS.AccessKey, cfg.AWS.SecretKey, "")
+	// The KCL's clients share the process's credentials. The worker is
+	// given Kinesis and DynamoDB clients from newAWSSession, so their calls
+	// rejected with expired credentials are retried after a forced refresh,
+	// which refreshLogger reports.
+	creds, err := newCredentials(cfg)
+	if err != nil {
+		return err
+	}
+	kclConfig.KinesisCredentials = creds
+	kclConfig.DynamoDBCredentials = creds
 
 	// Set other configuration options
 	kclConfig.InitialPositionInStream = config.TRIM_HORIZON // Read from beginning of stream
+	if start := rt.Backfill.startTimestamp(); start != nil {
+		// Only applies to shards without a checkpoint yet
+		kclConfig.WithTimestampAtInitialPositionInStream(start)
+	} else if rt.Backfill != nil && cfg.Consumer.Backfill.StartPosition == BackfillStartLatest {
+		kclConfig.WithInitialPositionInStream(config.LATEST)
+	}
 	kclConfig.MaxRecords = cfg.Consumer.MaxRecords
 	kclConfig.CallProcessRecordsEvenForEmptyRecordList = cfg.Consumer.CallProcessRecordsEvenForEmptyRecordList
-	kclConfig.EnableManualShardMapping = true
-	kclConfig.WithManualShardMapping(map[string]string{
-		"shardId-000000000000": "worker-1",
-		"shardId-000000000001": "worker-2",
-		"shardId-000000000002": "worker-3",
-	})
+	if err := applyLeaseTableName(kclConfig, cfg); err != nil {
+		return err
+	}
 
-	log.Printf("Application: %s, Worker ID: %s", cfg.Consumer.ApplicationName, cfg.Consumer.WorkerID)
+	// Used to check the manual shard mapping, to notice the stream being
+	// deleted underneath the worker, and by rewinds
+	kinesisClient, err := newKinesisClient(cfg)
+	if err != nil {
+		return err
+	}
+	if mapping := cfg.Consumer.ManualShardMapping; len(mapping) > 0 {
+		if err := validateManualShardMapping(kinesisClient, cfg.Kinesis.StreamName, cfg.Consumer.WorkerID, mapping); err != nil {
+			return err
+		}
+		kclConfig.WithManualShardMapping(mapping)
+	}
+
+	log.Printf("Application: %s, Worker ID: %s, Lease table: %s",
+		cfg.Consumer.ApplicationName, cfg.Consumer.WorkerID, kclConfig.TableName)
 	log.Printf("Configuration: MaxRecords=%d", cfg.Consumer.MaxRecords)
 
+	sink, err := newSink(cfg, rt.Aggregates)
+	if err != nil {
+		return err
+	}
+	if sink != nil {
+		defer sink.Close()
+	}
+
+	sinkErrors, err := NewSinkErrorPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	defer sinkErrors.Close()
+	sinkHealth, err := NewSinkHealth(cfg, sink)
+	if err != nil {
+		return err
+	}
+	defer sinkHealth.Close()
+	parseErrors, err := NewParseErrorMonitor(cfg)
+	if err != nil {
+		return err
+	}
+	latency, err := NewLatencyInjector(cfg)
+	if err != nil {
+		return err
+	}
+	futureTimestamps, err := NewFutureTimestampPolicy(cfg, rt.Metrics)
+	if err != nil {
+		return err
+	}
+	fields, err := NewFieldMapping(cfg)
+	if err != nil {
+		return err
+	}
+	keyFilter, err := NewKeyFilter(cfg)
+	if err != nil {
+		return err
+	}
+	signatures, err := NewSignatureVerifier(cfg)
+	if err != nil {
+		return err
+	}
+	sampler, err := NewSampler(cfg)
+	if err != nil {
+		return err
+	}
+	defer signatures.Close()
+	versions, err := NewEventVersions(cfg)
+	if err != nil {
+		return err
+	}
+	defer versions.Close()
+	deadLetters, err := NewDeadLetterSink(cfg)
+	if err != nil {
+		return err
+	}
+	if deadLetters != nil {
+		defer deadLetters.Close()
+	}
+	idempotency, err := NewIdempotencyStore(cfg)
+	if err != nil {
+		return err
+	}
+	if err := validateOrdering(cfg); err != nil {
+		return err
+	}
+	if err := validateBuffer(cfg); err != nil {
+		return err
+	}
+	if err := validateEmptyBatchAction(cfg); err != nil {
+		return err
+	}
+	continuity, err := NewContinuity(cfg, kclConfig.InitialPositionInStream == config.LATEST)
+	if err != nil {
+		return err
+	}
+	defer continuity.Close()
+
+	abortChan := make(chan error, 1)
+	stopChan := make(chan struct{}, 1)
+	pc := &ProcessorContext{
+		Config:       cfg,
+		Sink:         sink,
+		SinkErrors:   sinkErrors,
+		Hooks:        NewRebalanceHooks(cfg),
+		Metrics:      rt.Metrics,
+		ParseErrors:  parseErrors,
+		Fields:       fields,
+		KeyFilter:    keyFilter,
+		Signatures:   signatures,
+		Versions:     versions,
+		SinkHealth:   sinkHealth,
+		Sampler:      sampler,
+		Latency:      latency,
+		Idempotency:  idempotency,
+		Audit:        rt.Audit,
+		Offsets:      rt.Offsets,
+		Backfill:     rt.Backfill,
+		Shards:       rt.Shards,
+		History:      rt.History,
+		LeaseLimiter: NewLeaseAcquireLimiter(cfg, false),
+		Abort: func(err error) {
+			select {
+			case abortChan <- err:
+			default:
+			}
+		},
+		Stop: func() {
+			select {
+			case stopChan <- struct{}{}:
+			default:
+			}
+		},
+	}
+	pc.EndMarkers = NewEndMarkers(cfg, rt.Shards, pc.Stop)
+	pc.FutureTimestamps = futureTimestamps
+	pc.StreamHandler = rt.Handler
+	pc.Continuity = continuity
+	pc.DeadLetters = deadLetters
+
+	if cfg.Consumer.VerifyCheckpoints {
+		sess, err := newAWSSession(cfg)
+		if err != nil {
+			return err
+		}
+		pc.Verifier = NewCheckpointVerifier(dynamodb.New(sess), kclConfig.TableName)
+		log.Printf("Checkpoint verification enabled against lease table %s", kclConfig.TableName)
+	}
+
+	if cfg.Consumer.WindowStateTable != "" {
+		sess, err := newAWSSession(cfg)
+		if err != nil {
+			return err
+		}
+		pc.WindowState, err = NewWindowStateStore(dynamodb.New(sess), cfg.Consumer.WindowStateTable, cfg.Kinesis.StreamName)
+		if err != nil {
+			return err
+		}
+		log.Printf("Window state persisted to table %s", cfg.Consumer.WindowStateTable)
+	}
+
 	// Create worker
-	recordProcessorFactory := &RecordProcessorFactory{}
-	kclWorker := worker.NewWorker(recordProcessorFactory, kclConfig)
+	recordProcessorFactory, err := NewRecordProcessorFactory(pc)
+	if err != nil {
+		return err
+	}
+
+	onStreamDeleted, err := streamDeletedPolicy(cfg)
+	if err != nil {
+		return err
+	}
+
+	pc.Kinesis = kinesisClient
 
 	// Setup graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
-	// Start the worker in a goroutine
-	log.Println("Consumer is running. Press Ctrl+C to stop.")
+	dynamoSess, err := newAWSSession(cfg)
+	if err != nil {
+		return err
+	}
+	// The lease table client keeps the retries the KCL gives its own
+	dynamoClient := dynamodb.New(dynamoSess, &aws.Config{Retryer: client.DefaultRetryer{
+		NumMaxRetries:    chk.NumMaxRetries,
+		MinRetryDelay:    client.DefaultRetryerMinRetryDelay,
+		MinThrottleDelay: client.DefaultRetryerMinThrottleDelay,
+		MaxRetryDelay:    client.DefaultRetryerMaxRetryDelay,
+		MaxThrottleDelay: client.DefaultRetryerMaxRetryDelay,
+	}})
+	if cfg.Consumer.Affinity.Enabled {
+		log.Printf("Lease affinity enabled for worker %s", cfg.Consumer.WorkerID)
+	}
 
-	errChan := make(chan error, 1)
-	go func() {
-		if err := kclWorker.Start(); err != nil {
-			errChan <- err
+	for {
+		kclWorker := worker.NewWorker(recordProcessorFactory, kclConfig).WithKinesis(kinesisClient)
+		var checkpointer chk.Checkpointer = chk.NewDynamoCheckpoint(kclConfig).WithDynamoDB(dynamoClient)
+		if cfg.Consumer.Affinity.Enabled {
+			checkpointer = NewAffinityCheckpointer(checkpointer, dynamoClient, kclConfig.TableName, cfg)
 		}
-	}()
+		if cfg.Consumer.LogLeaseRenewals {
+			checkpointer = NewLeaseRenewalLogger(checkpointer, cfg)
+		}
+		if pc.SinkHealth != nil {
+			// KCL renews leases between GetRecords calls, which a sink pause holds off
+			pc.LeaseKeeper = NewLeaseKeeper(checkpointer, kclConfig)
+			checkpointer = pc.LeaseKeeper
+		}
+		kclWorker.WithCheckpointer(checkpointer)
 
-	// Wait for either shutdown signal or error
-	select {
-	case <-sigChan:
-		log.Println("Received shutdown signal...")
-		kclWorker.Shutdown()
-	case err := <-errChan:
-		return fmt.Errorf("worker failed: %w", err)
+		// Shards held by a sink pause must let go for the worker to stop
+		pc.SinkHealth.Rearm()
+		shutdown := func() {
+			pc.SinkHealth.Release()
+			kclWorker.Shutdown()
+		}
+
+		// Start the worker in a goroutine
+		log.Println("Consumer is running. Press Ctrl+C to stop.")
+
+		errChan := make(chan error, 1)
+		go func() {
+			if err := kclWorker.Start(); err != nil {
+				errChan <- err
+			}
+		}()
+
+		watchCtx, stopWatch := context.WithCancel(context.Background())
+		streamDeleted := watchStream(watchCtx, kinesisClient, cfg.Kinesis.StreamName, streamWatchInterval)
+
+		// Wait for shutdown signal, error or stream deletion
+		select {
+		case <-sigChan:
+			stopWatch()
+			log.Println("Received shutdown signal...")
+			shutdown()
+			return nil
+		case <-ctx.Done():
+			stopWatch()
+			shutdown()
+			return nil
+		case <-stopChan:
+			stopWatch()
+			shutdown()
+			return nil
+		case err := <-errChan:
+			stopWatch()
+			return fmt.Errorf("worker failed: %w", err)
+		case err := <-abortChan:
+			stopWatch()
+			log.Printf("Stopping consumer: %v", err)
+			shutdown()
+			return err
+		case <-streamDeleted:
+			stopWatch()
+			shutdown()
+		}
+
+		if onStreamDeleted != OnStreamDeletedWaitForRecreate {
+			log.Printf("Stream %s deleted, exiting", cfg.Kinesis.StreamName)
+			return nil
+		}
+
+		log.Printf("Stream %s deleted, waiting for it to be recreated", cfg.Kinesis.StreamName)
+		waitCtx, stopWait := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-sigChan:
+				log.Println("Received shutdown signal...")
+				stopWait()
+			case <-ctx.Done():
+				stopWait()
+			case <-waitCtx.Done():
+			}
+		}()
+		err := waitForStream(waitCtx, kinesisClient, cfg.Kinesis.StreamName, streamWatchInterval)
+		stopWait()
+		if err != nil {
+			return nil
+		}
+		log.Println("Restarting KCL worker for recreated stream")
 	}
+}
 
+// applyLeaseTableName points KCL at consumer.lease_table_name when set,
+// instead of the table named after the application
+func applyLeaseTableName(kclConfig *config.KinesisClientLibConfiguration, cfg *Config) error {
+	if cfg.Consumer.LeaseTableName == "" {
+		return nil
+	}
+	if err := validateTableName(cfg.Consumer.LeaseTableName); err != nil {
+		return fmt.Errorf("consumer.lease_table_name: %w", err)
+	}
+	kclConfig.WithTableName(cfg.Consumer.LeaseTableName)
 	return nil
 }
 
 func main() {
+	printConfigFlag := flag.Bool("print-config", false, "print the effective configuration as YAML, with secrets redacted, and exit")
+	flag.Parse()
+	args := flag.Args()
+
 	log.Println("Starting Kinesis Consumer...")
 
+	// The simulator and the assignment report run entirely in memory and need
+	// no config or AWS access
+	if len(args) > 0 && args[0] == "simulate" {
+		if err := runSimulateCommand(args[1:]); err != nil {
+			log.Fatalf("simulate command failed: %v", err)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "assignment-report" {
+		if err := runAssignmentReportCommand(args[1:]); err != nil {
+			log.Fatalf("assignment-report command failed: %v", err)
+		}
+		return
+	}
+	// verify only reads the files of a finished run
+	if len(args) > 0 && args[0] == "verify" {
+		if err := runVerifyCommand(args[1:]); err != nil {
+			log.Fatalf("verify command failed: %v", err)
+		}
+		return
+	}
+
 	// Load configuration
 	cfg, err := loadConfig()
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	log.Printf("Connected to Kinesis stream: %s", cfg.Kinesis.StreamName)
+	if *printConfigFlag {
+		if err := printConfig(os.Stdout, cfg); err != nil {
+			log.Fatalf("Failed to print config: %v", err)
+		}
+		return
+	}
+
+	// Diagnostic subcommands
+	if len(args) > 0 && args[0] == "shards" {
+		if err := runShardsCommand(cfg, args[1:]); err != nil {
+			log.Fatalf("shards command failed: %v", err)
+		}
+		return
+	}
+
+	// Block until handler dependencies are ready
+	if err := runPreload(cfg); err != nil {
+		log.Fatalf("Preload failed, exiting: %v", err)
+	}
+
+	log.Printf("Connected to Kinesis streams: %v", streamNames(cfg))
+
+	// Metrics and health are shared by every stream and exported once
+	metrics := NewMetrics()
+	stopTelemetry, err := startTelemetry(cfg, metrics)
+	if err != nil {
+		log.Fatalf("Failed to start telemetry: %v", err)
+	}
+
+	health := NewHealth()
+	shards := NewShardRegistry()
+	history := NewCheckpointHistory(cfg)
+	audit, err := NewAuditLog(cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	aggregates := NewRollingAggregates(cfg)
+	offsets := NewOffsetMap(cfg)
+	checkpoints, err := NewCheckpointFile(cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	stopHTTP, err := startHTTPServer(cfg, health, metrics, shards, history, aggregates)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	stopMetrics, err := startMetricsServer(cfg, metrics)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	stopLatencyMonitor := startLatencyMonitor(cfg, health)
+	stopLiveView := startLiveView(cfg, metrics)
+
+	// Catch up from S3 before tailing, so the stream only supplies newer events
+	backfill, err := runBackfill(cfg, aggregates)
+	if err != nil {
+		log.Fatalf("Backfill failed, exiting: %v", err)
+	}
 
 	// Run in the configured assignment mode
-	var runErr error
-	switch cfg.Consumer.AssignmentMode {
-	case "manual":
-		runErr = runManualMode(cfg)
-	case "kcl":
-		runErr = runKCLMode(cfg)
-	default:
-		log.Fatalf("Invalid assignment_mode: %s. Must be 'manual' or 'kcl'", cfg.Consumer.AssignmentMode)
+	runErr := runStreams(cfg, &Runtime{Metrics: metrics, Shards: shards, Backfill: backfill, History: history, Audit: audit, Offsets: offsets, Checkpoints: checkpoints, Aggregates: aggregates, Handler: registeredStreamHandler()})
+	stopLiveView()
+	stopLatencyMonitor()
+	stopHTTP()
+	stopMetrics()
+	stopTelemetry()
+	metrics.logRebalanceSummary()
+	metrics.logCheckpointWriteSummary()
+	if err := history.Save(cfg.Consumer.CheckpointHistory.Path); err != nil {
+		log.Printf("Failed to save checkpoint history: %v", err)
+	}
+	if err := offsets.Save(cfg.Consumer.OffsetMapPath, streamNames(cfg), cfg.Consumer.WorkerID); err != nil {
+		log.Printf("Failed to save offset map: %v", err)
+	}
+	if err := checkpoints.Close(); err != nil {
+		log.Printf("Failed to save checkpoint file: %v", err)
+	}
+	if err := audit.Close(); err != nil {
+		log.Printf("Failed to close audit log: %v", err)
 	}
 
 	if runErr != nil {
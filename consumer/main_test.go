@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrintConfig(t *testing.T) {
+	for _, env := range []string{"AWS_REGION", "AWS_ENDPOINT", "KINESIS_STREAM_NAME"} {
+		t.Setenv(env, "")
+	}
+	secrets := []string{"AKIDEXAMPLE", "wJalrXUtnFEMI", "hmac-signing-key"}
+	load := func(data []byte) *Config {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("CONFIG_FILE", path)
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("loadConfig() = %v", err)
+		}
+		return cfg
+	}
+	cfg := load([]byte("aws:\n  access_key: " + secrets[0] + "\n  secret_key: " + secrets[1] +
+		"\nkinesis:\n  stream_name: test-stream\nconsumer:\n  hmac_secret: " + secrets[2] + "\n"))
+
+	var out bytes.Buffer
+	if err := printConfig(&out, cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range secrets {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("printed config shows secret %q", secret)
+		}
+	}
+	if cfg.AWS.SecretKey != secrets[1] {
+		t.Errorf("printConfig() changed the config it printed")
+	}
+
+	// Loading the printed config gives the same effective config, so it
+	// prints the same again
+	printed := load(out.Bytes())
+	if printed.AWS.AccessKey != redactedSecret || printed.Consumer.HMACSecret != redactedSecret {
+		t.Errorf("printed config loads with secrets %q and %q, want them redacted", printed.AWS.AccessKey, printed.Consumer.HMACSecret)
+	}
+	var again bytes.Buffer
+	if err := printConfig(&again, printed); err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != out.String() {
+		t.Errorf("printed config loads as\n%s\nwant\n%s", again.String(), out.String())
+	}
+}
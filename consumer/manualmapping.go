@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// validateManualShardMapping checks consumer.manual_shard_mapping against
+// the stream before KCL is handed it: KCL skips mapped shard IDs the stream
+// doesn't have and never leases open shards mapped to no worker, so a
+// mapping gone stale after a reshard would leave shards unread without a
+// word. Every mapped shard must exist and every open shard must be mapped
+// to a worker; closed shards may be left out.
+func validateManualShardMapping(client KinesisAPI, streamName, workerID string, mapping map[string]string) error {
+	shards, err := listShards(client, streamName)
+	if err != nil {
+		return fmt.Errorf("failed to check consumer.manual_shard_mapping: %w", err)
+	}
+
+	inStream := make(map[string]bool, len(shards))
+	var unmapped []string
+	for _, shard := range shards {
+		shardID := aws.StringValue(shard.ShardId)
+		inStream[shardID] = true
+		open := shard.SequenceNumberRange == nil || shard.SequenceNumberRange.EndingSequenceNumber == nil
+		if open && mapping[shardID] == "" {
+			unmapped = append(unmapped, shardID)
+		}
+	}
+	var missing, mine []string
+	for shardID, worker := range mapping {
+		if !inStream[shardID] {
+			missing = append(missing, shardID)
+		}
+		if worker == workerID {
+			mine = append(mine, shardID)
+		}
+	}
+	sort.Strings(unmapped)
+	sort.Strings(missing)
+	sort.Strings(mine)
+
+	var problems []string
+	if len(unmapped) > 0 {
+		problems = append(problems, fmt.Sprintf("open shards mapped to no worker: %s", strings.Join(unmapped, ", ")))
+	}
+	if len(missing) > 0 {
+		problems = append(problems, fmt.Sprintf("mapped shards not in the stream: %s", strings.Join(missing, ", ")))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("consumer.manual_shard_mapping doesn't match stream %s (%d shards), %s",
+			streamName, len(shards), strings.Join(problems, "; "))
+	}
+
+	if len(mine) == 0 {
+		log.Printf("Manual shard mapping checked against %s: no shard is mapped to worker %s, it stays idle", streamName, workerID)
+	} else {
+		log.Printf("Manual shard mapping checked against %s: worker %s reads %s", streamName, workerID, strings.Join(mine, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateManualShardMapping(t *testing.T) {
+	const (
+		shard0 = "shardId-000000000000"
+		shard1 = "shardId-000000000001"
+		shard2 = "shardId-000000000002"
+	)
+	tests := []struct {
+		name    string
+		closed  []string
+		mapping map[string]string
+		wantErr []string // substrings of the error, none for a valid mapping
+	}{
+		{
+			name:    "every open shard mapped",
+			mapping: map[string]string{shard0: "worker-1", shard1: "worker-2"},
+		},
+		{
+			name:    "no shard mapped to this worker",
+			mapping: map[string]string{shard0: "worker-2", shard1: "worker-2"},
+		},
+		{
+			name:    "closed shard left out",
+			closed:  []string{shard1},
+			mapping: map[string]string{shard0: "worker-1"},
+		},
+		{
+			name:    "open shard left out",
+			mapping: map[string]string{shard0: "worker-1"},
+			wantErr: []string{"open shards mapped to no worker: " + shard1},
+		},
+		{
+			name:    "open shard mapped to no worker",
+			mapping: map[string]string{shard0: "worker-1", shard1: ""},
+			wantErr: []string{"open shards mapped to no worker: " + shard1},
+		},
+		{
+			name:    "shard not in the stream",
+			mapping: map[string]string{shard0: "worker-1", shard1: "worker-1", shard2: "worker-2"},
+			wantErr: []string{"mapped shards not in the stream: " + shard2},
+		},
+		{
+			name:    "both problems reported",
+			mapping: map[string]string{shard0: "worker-1", shard2: "worker-2"},
+			wantErr: []string{"(2 shards)", "open shards mapped to no worker: " + shard1, "mapped shards not in the stream: " + shard2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeKinesis(testStream, shard0, shard1)
+			for _, shardID := range tt.closed {
+				fake.CloseShard(shardID)
+			}
+
+			err := validateManualShardMapping(fake, testStream, "worker-1", tt.mapping)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("validateManualShardMapping() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("validateManualShardMapping() = nil, want an error with %q", tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateManualShardMappingMissingStream(t *testing.T) {
+	fake := newFakeKinesis(testStream, testShard)
+	err := validateManualShardMapping(fake, "other-stream", "worker-1", map[string]string{testShard: "worker-1"})
+	if err == nil || !strings.Contains(err.Error(), "failed to check consumer.manual_shard_mapping") {
+		t.Errorf("validateManualShardMapping() = %v, want the listing failure", err)
+	}
+}
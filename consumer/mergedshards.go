@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultShardPromotionWindowMs is how long a merged shard's rate is measured over
+const DefaultShardPromotionWindowMs = 10000
+
+// mergedShard is a shard read by the shared poller of runMergedShards
+type mergedShard struct {
+	*pooledShard
+	due           time.Time // when the shard has more work
+	windowStart   time.Time
+	windowRecords int // the shard's record count at windowStart
+}
+
+// rate returns the shard's records/sec over the window ending now, once the
+// window is complete, and starts the next window
+func (ms *mergedShard) rate(now time.Time, window time.Duration) (float64, bool) {
+	if ms.windowStart.IsZero() {
+		ms.windowStart, ms.windowRecords = now, ms.msp.recordCount
+		return 0, false
+	}
+	elapsed := now.Sub(ms.windowStart)
+	if elapsed < window {
+		return 0, false
+	}
+	rate := float64(ms.msp.recordCount-ms.windowRecords) / elapsed.Seconds()
+	ms.windowStart, ms.windowRecords = now, ms.msp.recordCount
+	return rate, true
+}
+
+// runMergedShards reads every shard from a single polling goroutine that
+// takes them round-robin, each at its own poll interval, instead of a
+// goroutine per shard, which is wasteful for many low-traffic shards. A
+// shard whose handled records/sec over window rises above promotionRPS is
+// promoted to a goroutine of its own for the rest of the run, so it no
+// longer waits behind the others. It returns once every shard is done or
+// ctx is cancelled.
+func runMergedShards(ctx context.Context, processors []*ManualShardProcessor, promotionRPS float64, window time.Duration) {
+	var promoted sync.WaitGroup
+	defer promoted.Wait()
+
+	merged := make([]*mergedShard, len(processors))
+	for i, msp := range processors {
+		merged[i] = &mergedShard{pooledShard: &pooledShard{msp: msp}}
+	}
+
+	for len(merged) > 0 {
+		if ctx.Err() != nil {
+			// Release the shards that were still being read
+			for _, ms := range merged {
+				if ms.opened {
+					ms.msp.stopped(ctx)
+				}
+				ms.msp.close(context.Background())
+			}
+			return
+		}
+
+		var next time.Time
+		kept := merged[:0]
+		for _, ms := range merged {
+			now := time.Now()
+			if ms.due.After(now) {
+				kept = append(kept, ms)
+				if next.IsZero() || ms.due.Before(next) {
+					next = ms.due
+				}
+				continue
+			}
+
+			delay, more := ms.step(ctx)
+			if !more {
+				ms.msp.close(context.Background())
+				continue
+			}
+			ms.due = time.Now().Add(delay)
+			if ms.opened {
+				if rate, ok := ms.rate(now, window); ok && rate > promotionRPS {
+					log.Printf("[%s] Promoting shard to its own goroutine at %.1f records/sec (above consumer.shard_promotion_rps %g)",
+						ms.msp.label, rate, promotionRPS)
+					promoted.Add(1)
+					go func(msp *ManualShardProcessor) {
+						defer promoted.Done()
+						defer msp.close(context.Background())
+						msp.consume(ctx)
+					}(ms.msp)
+					continue
+				}
+			}
+			kept = append(kept, ms)
+			if next.IsZero() || ms.due.Before(next) {
+				next = ms.due
+			}
+		}
+		merged = kept
+
+		if len(merged) > 0 {
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+		}
+	}
+}
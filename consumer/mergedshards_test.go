@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer safe to log to from several goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestMergedShardRate(t *testing.T) {
+	const window = 10 * time.Second
+	start := time.Now()
+	ms := &mergedShard{pooledShard: &pooledShard{msp: &ManualShardProcessor{}}}
+	steps := []struct {
+		after   time.Duration
+		records int // handled by then
+		want    float64
+		wantOK  bool
+	}{
+		{after: 0, records: 0},
+		{after: 5 * time.Second, records: 50},
+		{after: window, records: 100, want: 10, wantOK: true},
+		// The next window starts where the last one ended
+		{after: window + 5*time.Second, records: 1000},
+		{after: 2 * window, records: 1100, want: 100, wantOK: true},
+	}
+	for _, step := range steps {
+		ms.msp.recordCount = step.records
+		rate, ok := ms.rate(start.Add(step.after), window)
+		if rate != step.want || ok != step.wantOK {
+			t.Errorf("rate after %v = %v, %t; want %v, %t", step.after, rate, ok, step.want, step.wantOK)
+		}
+	}
+}
+
+func TestMergedShardsPromotion(t *testing.T) {
+	const busy, quiet = "shardId-000000000000", "shardId-000000000001"
+	logged := &lockedBuffer{}
+	log.SetOutput(logged)
+	defer log.SetOutput(os.Stderr)
+
+	fake := newFakeKinesis(testStream, busy, quiet)
+	sink := &collectingSink{}
+	cfg := &Config{}
+	pc := &ProcessorContext{Config: cfg, Sink: sink}
+	completion := newShardCompletion([]string{busy, quiet})
+	want := len(fake.AddRecords(t, busy, "user_1", testEvents(0, 50)...)) + len(fake.AddRecords(t, quiet, "user_2", testEvents(50, 1)...))
+	var processors []*ManualShardProcessor
+	for _, shardID := range []string{busy, quiet} {
+		msp := newTestProcessor(fake, cfg)
+		msp.shardID, msp.label = shardID, shardID
+		msp.maxRecords = 5
+		msp.pc = pc
+		msp.completion = completion
+		processors = append(processors, msp)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		runMergedShards(ctx, processors, 100, 20*time.Millisecond)
+		close(done)
+	}()
+
+	// The busy shard handles 50 records in its first window, well above
+	// 100 records/sec, while the quiet one stays merged
+	waitFor(t, func() bool { return strings.Contains(logged.String(), "["+busy+"] Promoting shard") })
+	if strings.Contains(logged.String(), "["+quiet+"] Promoting shard") {
+		t.Error("promoted the quiet shard")
+	}
+
+	// Both keep being read, the promoted shard from its own goroutine
+	want += len(fake.AddRecords(t, busy, "user_1", testEvents(51, 3)...)) + len(fake.AddRecords(t, quiet, "user_2", testEvents(54, 1)...))
+	waitFor(t, func() bool { return len(sink.records()) == want })
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runMergedShards did not return")
+	}
+}
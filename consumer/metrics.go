@@ -0,0 +1,265 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ShardMetrics is a point-in-time copy of one shard's consumer metrics.
+// Counters are cumulative since the process started.
+//
+// CheckpointLagRecords approximates the data at risk if the process crashed
+// now: records processed since the last successful checkpoint, which would
+// be processed again by the shard's next owner. It counts whole batches, so
+// a checkpoint that stops short of the last record (buffered sink, windowed
+// processor) still resets it to zero.
+type ShardMetrics struct {
+	RecordsProcessed     int64
+	Checkpoints          int64
+	CheckpointFailures   int64
+	CheckpointLagRecords int64
+	HandlerTimeouts      int64
+	Reprocessed          int64 // records read again after resuming from a checkpoint on rebalance
+	FutureTimestamps     int64 // events timestamped ahead of the consumer's clock
+	Shed                 int64 // buffered records dropped by consumer.shed_when_full
+	IdleHeartbeats       int64 // empty batch actions run while the shard had no records
+	InvalidSignatures    int64 // records failing consumer.hmac_secret verification
+	UnknownVersions      int64 // events of a schema version without a decoder
+	UnmarshalErrors      int64 // records whose payload failed to decode into an event
+	HandlerCalls         int64
+	HandlerMillis        float64 // total time spent in the handler, including injected latency
+	MillisBehindLatest   int64
+	HasLag               bool
+	LastAction           string // action of the last event processed
+}
+
+// ShardKey identifies a shard across every stream the consumer reads
+type ShardKey struct {
+	Stream  string
+	ShardID string
+}
+
+// metricStore holds the metrics of every stream in the process
+type metricStore struct {
+	mu         sync.Mutex
+	shards     map[ShardKey]*ShardMetrics
+	leases     map[ShardKey]time.Time // when each currently held shard was acquired
+	rebalances map[string]*RebalanceMetrics
+	latencies  map[string]*LatencyMetrics
+
+	checkpointWrites map[string]*CheckpointWriteMetrics
+}
+
+// Metrics aggregates consumer metrics per shard. Both KCL and manual mode
+// update the same store so exporters see consistent numbers across modes.
+// Each stream records through its own view from ForStream so shards with
+// the same ID in different streams stay apart. A nil *Metrics is valid and
+// records nothing.
+type Metrics struct {
+	stream string
+	store  *metricStore
+}
+
+// NewMetrics creates an empty metrics aggregator
+func NewMetrics() *Metrics {
+	return &Metrics{store: &metricStore{
+		shards:     make(map[ShardKey]*ShardMetrics),
+		leases:     make(map[ShardKey]time.Time),
+		rebalances: make(map[string]*RebalanceMetrics),
+		latencies:  make(map[string]*LatencyMetrics),
+
+		checkpointWrites: make(map[string]*CheckpointWriteMetrics),
+	}}
+}
+
+// ForStream returns a view that records into the same store, labelled with the stream
+func (m *Metrics) ForStream(stream string) *Metrics {
+	if m == nil {
+		return nil
+	}
+	return &Metrics{stream: stream, store: m.store}
+}
+
+func (m *Metrics) shard(shardID string) *ShardMetrics {
+	key := ShardKey{Stream: m.stream, ShardID: shardID}
+	sm, ok := m.store.shards[key]
+	if !ok {
+		sm = &ShardMetrics{}
+		m.store.shards[key] = sm
+	}
+	return sm
+}
+
+// RecordsProcessed adds n successfully processed records for a shard
+func (m *Metrics) RecordsProcessed(shardID string, n int) {
+	if m == nil {
+		return
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	sm := m.shard(shardID)
+	sm.RecordsProcessed += int64(n)
+	sm.CheckpointLagRecords += int64(n)
+}
+
+// RecordsReprocessed adds n records a shard read again after resuming from
+// another owner's checkpoint
+func (m *Metrics) RecordsReprocessed(shardID string, n int) {
+	if m == nil {
+		return
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.shard(shardID).Reprocessed += int64(n)
+}
+
+// FutureTimestamp counts an event timestamped ahead of the consumer's clock
+func (m *Metrics) FutureTimestamp(shardID string) {
+	if m == nil {
+		return
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.shard(shardID).FutureTimestamps++
+}
+
+// RecordsShed adds n buffered records a shard dropped because its buffer was full
+func (m *Metrics) RecordsShed(shardID string, n int) {
+	if m == nil {
+		return
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.shard(shardID).Shed += int64(n)
+}
+
+// InvalidSignature records a record of a shard that failed signature verification
+func (m *Metrics) InvalidSignature(shardID string) {
+	if m == nil {
+		return
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.shard(shardID).InvalidSignatures++
+}
+
+// UnknownVersion records an event of a shard whose schema version has no decoder
+func (m *Metrics) UnknownVersion(shardID string) {
+	if m == nil {
+		return
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.shard(shardID).UnknownVersions++
+}
+
+// UnmarshalError records a record of a shard whose payload failed to decode
+func (m *Metrics) UnmarshalError(shardID string) {
+	if m == nil {
+		return
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.shard(shardID).UnmarshalErrors++
+}
+
+// IdleHeartbeat records that an idle shard ran its empty batch action
+func (m *Metrics) IdleHeartbeat(shardID string) {
+	if m == nil {
+		return
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.shard(shardID).IdleHeartbeats++
+}
+
+// SetLastAction records the action of the last event processed on a shard
+func (m *Metrics) SetLastAction(shardID string, action string) {
+	if m == nil {
+		return
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.shard(shardID).LastAction = action
+}
+
+// CheckpointResult counts a checkpoint attempt and whether it failed
+func (m *Metrics) CheckpointResult(shardID string, err error) {
+	if m == nil {
+		return
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	sm := m.shard(shardID)
+	if err != nil {
+		sm.CheckpointFailures++
+	} else {
+		sm.Checkpoints++
+		sm.CheckpointLagRecords = 0
+	}
+}
+
+// HandlerTimeout counts a record skipped because its handler timed out
+func (m *Metrics) HandlerTimeout(shardID string) {
+	if m == nil {
+		return
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.shard(shardID).HandlerTimeouts++
+}
+
+// HandlerDuration records how long one handler call took
+func (m *Metrics) HandlerDuration(shardID string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	sm := m.shard(shardID)
+	sm.HandlerCalls++
+	sm.HandlerMillis += float64(d) / float64(time.Millisecond)
+}
+
+// SetMillisBehindLatest records how far behind the tip the last fetch for a shard was
+func (m *Metrics) SetMillisBehindLatest(shardID string, millis int64) {
+	if m == nil {
+		return
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	sm := m.shard(shardID)
+	sm.MillisBehindLatest = millis
+	sm.HasLag = true
+}
+
+// Snapshot returns a copy of every shard's metrics across all streams
+func (m *Metrics) Snapshot() map[ShardKey]ShardMetrics {
+	if m == nil {
+		return nil
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	snapshot := make(map[ShardKey]ShardMetrics, len(m.store.shards))
+	for key, sm := range m.store.shards {
+		snapshot[key] = *sm
+	}
+	return snapshot
+}
+
+// sortedShardKeys returns the keys of a snapshot in a stable order
+func sortedShardKeys(snapshot map[ShardKey]ShardMetrics) []ShardKey {
+	keys := make([]ShardKey, 0, len(snapshot))
+	for key := range snapshot {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Stream != keys[j].Stream {
+			return keys[i].Stream < keys[j].Stream
+		}
+		return keys[i].ShardID < keys[j].ShardID
+	})
+	return keys
+}
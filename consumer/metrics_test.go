@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
+)
+
+func TestCheckpointLag(t *testing.T) {
+	// Each batch is processed and then checkpointed, successfully or not
+	batches := []struct {
+		records      int
+		checkpointOK bool
+		wantLag      int64
+	}{
+		{records: 3, checkpointOK: false, wantLag: 3},
+		{records: 2, checkpointOK: false, wantLag: 5},
+		{records: 1, checkpointOK: true, wantLag: 0},
+		{records: 2, checkpointOK: false, wantLag: 2},
+		{records: 0, checkpointOK: true, wantLag: 0}, // the idle checkpoint catches up
+		{records: 1, checkpointOK: false, wantLag: 1},
+	}
+	client := newFakeKinesis(testStream, testShard)
+	total := 0
+	for _, batch := range batches {
+		total += batch.records
+	}
+	client.AddRecords(t, testShard, "user_1", testEvents(0, total)...)
+	cfg := &Config{}
+	cfg.Kinesis.StreamName = testStream
+	metrics := NewMetrics()
+	rp := &RecordProcessor{pc: &ProcessorContext{Config: cfg, Sink: discardSink{}, Kinesis: client, Metrics: metrics}}
+	rp.Initialize(&interfaces.InitializationInput{ShardId: testShard})
+
+	next := 0
+	for i, batch := range batches {
+		var positions []int
+		for range batch.records {
+			positions = append(positions, next)
+			next++
+		}
+		var checkpointer interfaces.IRecordProcessorCheckpointer = failingCheckpointer{}
+		if batch.checkpointOK {
+			checkpointer = &recordingCheckpointer{}
+		}
+		rp.ProcessRecords(&interfaces.ProcessRecordsInput{Records: testKinesisRecords(t, client, positions...), Checkpointer: checkpointer})
+
+		if got := metrics.Snapshot()[ShardKey{ShardID: testShard}].CheckpointLagRecords; got != batch.wantLag {
+			t.Errorf("batch %d: checkpoint lag is %d records, want %d", i, got, batch.wantLag)
+		}
+	}
+}
+
+func TestReprocessedOnRebalance(t *testing.T) {
+	tests := []struct {
+		name       string
+		checkpoint int // position the previous owner checkpointed, -1 for none
+		want       int64
+	}{
+		// The previous owner handled up to position 5 but only checkpointed 1
+		{name: "resumed from a checkpoint", checkpoint: 1, want: 4},
+		{name: "started without a checkpoint", checkpoint: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeKinesis(testStream, testShard)
+			sequenceNumbers := client.AddRecords(t, testShard, "user_1", testEvents(0, 6)...)
+			time.Sleep(2 * time.Millisecond)
+			cfg := &Config{}
+			cfg.Kinesis.StreamName = testStream
+			metrics := NewMetrics()
+			rp := &RecordProcessor{pc: &ProcessorContext{Config: cfg, Sink: discardSink{}, Kinesis: client, Metrics: metrics}}
+			input := &interfaces.InitializationInput{ShardId: testShard}
+			if tt.checkpoint >= 0 {
+				input.ExtendedSequenceNumber = &interfaces.ExtendedSequenceNumber{SequenceNumber: aws.String(sequenceNumbers[tt.checkpoint])}
+			}
+			rp.Initialize(input)
+
+			// Records arriving after the takeover are new, as are any after them
+			time.Sleep(2 * time.Millisecond)
+			client.AddRecords(t, testShard, "user_1", testEvents(6, 3)...)
+			for _, positions := range [][]int{{2, 3, 4}, {5, 6, 7}, {8}} {
+				rp.ProcessRecords(&interfaces.ProcessRecordsInput{Records: testKinesisRecords(t, client, positions...), Checkpointer: &recordingCheckpointer{}})
+			}
+
+			if got := metrics.Snapshot()[ShardKey{ShardID: testShard}].Reprocessed; got != tt.want {
+				t.Errorf("counted %d records reprocessed, want %d", got, tt.want)
+			}
+			w := httptest.NewRecorder()
+			newMetricsHandler(cfg, metrics).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			wantLine := fmt.Sprintf(`consumer_reprocessed_on_rebalance_total{shard=%q,stream="",worker_id=""} %d`, testShard, tt.want)
+			if !strings.Contains(w.Body.String(), wantLine) {
+				t.Errorf("/metrics does not report %s:\n%s", wantLine, w.Body.String())
+			}
+		})
+	}
+}
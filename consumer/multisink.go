@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// consumer.sink.multi.ack values
+const (
+	MultiSinkAckAll     = "all"
+	MultiSinkAckPrimary = "primary"
+)
+
+// SinkDestination is one entry of consumer.sink.multi.sinks. Parquet and
+// gRPC destinations take the rest of their settings from consumer.sink.parquet
+// and consumer.sink.grpc.
+type SinkDestination struct {
+	Type string `yaml:"type"` // "file", "parquet", "grpc" or "aggregates"
+	Path string `yaml:"path"` // file: output file; parquet: output directory
+}
+
+// MultiSink writes every record to several sinks, the first of which is the
+// primary. With ack "all" a record counts as written, and is checkpointed,
+// once every sink has it; with ack "primary" only the primary is waited for
+// and failures of the others are logged and otherwise ignored. Each sink
+// gets the consumer.sink.errors policy of its own, so a retry only resends to
+// the sink that failed. A halt on any sink stops the consumer.
+type MultiSink struct {
+	sinks  []Sink
+	names  []string
+	ack    string
+	labels shardLabeler
+}
+
+// NewMultiSink creates every sink listed in consumer.sink.multi.sinks
+func NewMultiSink(cfg *Config, aggregates *RollingAggregates) (*MultiSink, error) {
+	multiCfg := cfg.Consumer.Sink.Multi
+	switch multiCfg.Ack {
+	case MultiSinkAckAll, MultiSinkAckPrimary:
+	default:
+		return nil, fmt.Errorf("invalid multi sink ack: %s. Must be '%s' or '%s'", multiCfg.Ack, MultiSinkAckAll, MultiSinkAckPrimary)
+	}
+	if len(multiCfg.Sinks) == 0 {
+		return nil, fmt.Errorf("multi sink requires consumer.sink.multi.sinks")
+	}
+
+	ms := &MultiSink{ack: multiCfg.Ack, labels: newShardLabeler(cfg)}
+	for i, dest := range multiCfg.Sinks {
+		if dest.Type == "multi" {
+			ms.Close()
+			return nil, fmt.Errorf("multi sink destination %d cannot be a multi sink", i)
+		}
+		// Every destination is built from the shared sink settings with its own type and path
+		destCfg := *cfg
+		destCfg.Consumer.Sink.Type = dest.Type
+		destCfg.Consumer.Sink.Path = dest.Path
+		sink, err := newSink(&destCfg, aggregates)
+		if err == nil && sink == nil {
+			err = fmt.Errorf("a type is required")
+		}
+		if err != nil {
+			ms.Close()
+			return nil, fmt.Errorf("multi sink destination %d: %w", i, err)
+		}
+		ms.sinks = append(ms.sinks, sink)
+		ms.names = append(ms.names, fmt.Sprintf("%s[%d]", dest.Type, i))
+	}
+	log.Printf("Multi sink writing to %v, checkpointing on %s ack", ms.names, ms.ack)
+	return ms, nil
+}
+
+// Write writes the record to every sink
+func (ms *MultiSink) Write(record *SinkRecord) error {
+	return fanOut(ms.ack, ms.names, ms.sinks, ms.labels, record)
+}
+
+// WriteAggregate writes a window aggregate to every sink that stores them
+func (ms *MultiSink) WriteAggregate(aggregate *WindowAggregate) error {
+	var errs []error
+	for i, sink := range ms.sinks {
+		if aggregateSink, ok := sink.(AggregateSink); ok {
+			if err := aggregateSink.WriteAggregate(aggregate); err != nil {
+				errs = append(errs, fmt.Errorf("%s sink: %w", ms.names[i], err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Probe probes every sink that can be probed, or with ack "primary" only the primary
+func (ms *MultiSink) Probe(ctx context.Context) error {
+	var errs []error
+	for i, sink := range ms.sinks {
+		if i > 0 && ms.ack == MultiSinkAckPrimary {
+			break
+		}
+		if prober, ok := sink.(SinkProber); ok {
+			if err := prober.Probe(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("%s sink: %w", ms.names[i], err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every sink
+func (ms *MultiSink) Close() error {
+	var errs []error
+	for i, sink := range ms.sinks {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s sink: %w", ms.names[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ShardWriter returns a shard's writer to every sink
+func (ms *MultiSink) ShardWriter(shardID string) ShardWriter {
+	return ms.shardWriter(shardID, func(sink Sink) Sink { return sink })
+}
+
+// shardWriter returns a shard's writer to every sink, sending the writes to
+// each through wrap, such as a SinkErrorPolicy
+func (ms *MultiSink) shardWriter(shardID string, wrap func(sink Sink) Sink) ShardWriter {
+	writer := &multiShardWriter{
+		ack:        ms.ack,
+		names:      ms.names,
+		writes:     make([]Sink, len(ms.sinks)),
+		deliveries: make([]ShardDelivery, len(ms.sinks)),
+		labels:     ms.labels,
+	}
+	for i, sink := range ms.sinks {
+		if sharded, ok := sink.(ShardedSink); ok {
+			shardWriter := sharded.ShardWriter(shardID)
+			writer.writes[i] = wrap(shardWriter)
+			writer.deliveries[i] = shardWriter
+		} else {
+			writer.writes[i] = wrap(sink)
+		}
+	}
+	return writer
+}
+
+// fanOut writes the record to every sink. Failures of a sink the ack policy
+// does not wait for are logged and dropped, except a halt.
+func fanOut(ack string, names []string, sinks []Sink, labels shardLabeler, record *SinkRecord) error {
+	var errs []error
+	for i, sink := range sinks {
+		err := sink.Write(record)
+		switch {
+		case err == nil:
+		case i == 0 || ack == MultiSinkAckAll || errors.Is(err, ErrSinkHalted):
+			errs = append(errs, fmt.Errorf("%s sink: %w", names[i], err))
+		default:
+			log.Printf("[%s] Secondary %s sink failed on record %s, not waiting for it: %v",
+				labels.logLabel(record.ShardID), names[i], record.SequenceNumber, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// multiShardWriter is a shard's writer to every sink of a MultiSink. A sink
+// without delivery tracking has a record as soon as its write returns.
+type multiShardWriter struct {
+	ack        string
+	names      []string
+	writes     []Sink
+	deliveries []ShardDelivery // nil for sinks that are durable on write
+	labels     shardLabeler
+
+	mu      sync.Mutex
+	written string // last record written to every sink
+}
+
+// Write writes the record to every sink
+func (mw *multiShardWriter) Write(record *SinkRecord) error {
+	err := fanOut(mw.ack, mw.names, mw.writes, mw.labels, record)
+	mw.mu.Lock()
+	mw.written = record.SequenceNumber
+	mw.mu.Unlock()
+	return err
+}
+
+// acked returns the indexes of the sinks the ack policy waits for
+func (mw *multiShardWriter) acked() []int {
+	if mw.ack == MultiSinkAckPrimary {
+		return []int{0}
+	}
+	indexes := make([]int, len(mw.writes))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	return indexes
+}
+
+// Delivered returns the last record every waited-for sink has made durable
+func (mw *multiShardWriter) Delivered() string {
+	mw.mu.Lock()
+	delivered := mw.written
+	mw.mu.Unlock()
+
+	for _, i := range mw.acked() {
+		if mw.deliveries[i] == nil {
+			continue
+		}
+		sinkDelivered := mw.deliveries[i].Delivered()
+		if sinkDelivered == "" {
+			return ""
+		}
+		if delivered == "" || sequenceAtOrBefore(sinkDelivered, delivered) {
+			delivered = sinkDelivered
+		}
+	}
+	return delivered
+}
+
+// Pending returns the most records any waited-for sink has not made durable yet
+func (mw *multiShardWriter) Pending() int {
+	pending := 0
+	for _, i := range mw.acked() {
+		if mw.deliveries[i] != nil {
+			pending = max(pending, mw.deliveries[i].Pending())
+		}
+	}
+	return pending
+}
+
+// WaitDrained drains every sink within the timeout, and reports whether the
+// waited-for ones drained
+func (mw *multiShardWriter) WaitDrained(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	drained := make([]bool, len(mw.deliveries))
+	for i, delivery := range mw.deliveries {
+		drained[i] = delivery == nil || delivery.WaitDrained(max(time.Until(deadline), 0))
+	}
+	for _, i := range mw.acked() {
+		if !drained[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Close closes the shard's writers; the sinks themselves are closed with the MultiSink
+func (mw *multiShardWriter) Close() error {
+	var errs []error
+	for i, delivery := range mw.deliveries {
+		if delivery == nil {
+			continue
+		}
+		if err := delivery.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s sink: %w", mw.names[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
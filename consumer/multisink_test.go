@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMultiSink(t *testing.T) {
+	tests := []struct {
+		name          string
+		ack           string
+		transient     string // consumer.sink.errors actions, none when empty
+		permanent     string
+		primaryErrs   []error
+		secondaryErrs []error
+		wantErr       error // nil, ErrSinkHalted, or errSinkFailed for a failure reported as is
+		wantWrites    [2]int
+		wantAborted   bool
+	}{
+		{name: "both acknowledge", ack: MultiSinkAckAll, wantWrites: [2]int{1, 1}},
+		{name: "all waits for the failing secondary", ack: MultiSinkAckAll,
+			secondaryErrs: []error{httpError(503)}, wantErr: errSinkFailed, wantWrites: [2]int{1, 1}},
+		{name: "primary ignores the failing secondary", ack: MultiSinkAckPrimary,
+			secondaryErrs: []error{httpError(503)}, wantWrites: [2]int{1, 1}},
+		{name: "primary waits for the failing primary", ack: MultiSinkAckPrimary,
+			primaryErrs: []error{httpError(503)}, wantErr: errSinkFailed, wantWrites: [2]int{1, 1}},
+		{name: "retry resends to the failing sink only", ack: MultiSinkAckAll, transient: "retry", permanent: "halt",
+			secondaryErrs: []error{httpError(503)}, wantWrites: [2]int{1, 2}},
+		{name: "failing secondary dead-lettered", ack: MultiSinkAckAll, transient: "dlq", permanent: "dlq",
+			secondaryErrs: []error{httpError(400)}, wantWrites: [2]int{1, 1}},
+		{name: "halt on the secondary stops the consumer", ack: MultiSinkAckAll, transient: "retry", permanent: "halt",
+			secondaryErrs: []error{httpError(400)}, wantErr: ErrSinkHalted, wantWrites: [2]int{1, 1}, wantAborted: true},
+		{name: "halt on an ignored secondary still stops the consumer", ack: MultiSinkAckPrimary, transient: "halt", permanent: "halt",
+			secondaryErrs: []error{httpError(503)}, wantErr: ErrSinkHalted, wantWrites: [2]int{1, 1}, wantAborted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.Sink.Errors.Transient = tt.transient
+			cfg.Consumer.Sink.Errors.Permanent = tt.permanent
+			cfg.Consumer.Sink.Errors.RetryAttempts = 2
+			cfg.Consumer.Sink.Errors.RetryBackoffMs = 1
+			cfg.Consumer.Sink.Errors.DLQPath = filepath.Join(t.TempDir(), "dlq.jsonl")
+			policy, err := NewSinkErrorPolicy(cfg)
+			if err != nil {
+				t.Fatalf("NewSinkErrorPolicy() = %v", err)
+			}
+			defer policy.Close()
+
+			primary, secondary := &flakySink{errs: tt.primaryErrs}, &flakySink{errs: tt.secondaryErrs}
+			multi := &MultiSink{sinks: []Sink{primary, secondary}, names: []string{"file[0]", "file[1]"}, ack: tt.ack}
+			aborted := false
+			pc := &ProcessorContext{Config: cfg, Sink: multi, SinkErrors: policy, Abort: func(error) { aborted = true }}
+			sink, _, err := pc.ShardSink(testShard)
+			if err != nil {
+				t.Fatalf("ShardSink() = %v", err)
+			}
+
+			err = sink.Write(&SinkRecord{ShardID: testShard, SequenceNumber: "1", Event: Event{EventID: "evt_1"}})
+			switch {
+			case tt.wantErr == errSinkFailed:
+				if err == nil || errors.Is(err, ErrSinkHalted) {
+					t.Errorf("Write() = %v, want the sink failure", err)
+				}
+			case !errors.Is(err, tt.wantErr):
+				t.Errorf("Write() = %v, want %v", err, tt.wantErr)
+			}
+			if writes := [2]int{primary.writes, secondary.writes}; writes != tt.wantWrites || aborted != tt.wantAborted {
+				t.Errorf("sinks written %v times with aborted %t, want %v and %t", writes, aborted, tt.wantWrites, tt.wantAborted)
+			}
+		})
+	}
+}
+
+func TestMultiSinkDelivered(t *testing.T) {
+	tests := []struct {
+		ack           string
+		wantBuffered  string // delivered while the Parquet file is still open
+		wantCompleted string // delivered once it is complete
+	}{
+		{ack: MultiSinkAckAll, wantBuffered: "", wantCompleted: "2"},
+		{ack: MultiSinkAckPrimary, wantBuffered: "2", wantCompleted: "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ack, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.Sink.Path = t.TempDir()
+			cfg.Consumer.Sink.Parquet.RotateIntervalMs = int(time.Hour / time.Millisecond)
+			parquetSink, err := NewParquetSink(cfg)
+			if err != nil {
+				t.Fatalf("NewParquetSink() = %v", err)
+			}
+			defer parquetSink.Close()
+
+			// The primary is durable on write; the Parquet secondary only once its file is complete
+			multi := &MultiSink{sinks: []Sink{&flakySink{}, parquetSink}, names: []string{"file[0]", "parquet[1]"}, ack: tt.ack}
+			pc := &ProcessorContext{Config: cfg, Sink: multi}
+			sink, delivery, err := pc.ShardSink(testShard)
+			if err != nil {
+				t.Fatalf("ShardSink() = %v", err)
+			}
+			for _, sequenceNumber := range []string{"1", "2"} {
+				if err := sink.Write(&SinkRecord{ShardID: testShard, SequenceNumber: sequenceNumber}); err != nil {
+					t.Fatalf("Write() = %v", err)
+				}
+			}
+
+			if got := delivery.Delivered(); got != tt.wantBuffered {
+				t.Errorf("Delivered() = %q with the Parquet file open, want %q", got, tt.wantBuffered)
+			}
+			if !delivery.WaitDrained(time.Second) {
+				t.Fatal("WaitDrained() failed")
+			}
+			if got := delivery.Delivered(); got != tt.wantCompleted {
+				t.Errorf("Delivered() = %q with the Parquet file complete, want %q", got, tt.wantCompleted)
+			}
+		})
+	}
+}
+
+// errSinkFailed stands for a sink failure reported without a policy action
+var errSinkFailed = errors.New("sink failed")
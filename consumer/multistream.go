@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// streamNames returns the streams to consume: kinesis.stream_names when set,
+// otherwise the single kinesis.stream_name
+func streamNames(cfg *Config) []string {
+	if len(cfg.Kinesis.StreamNames) > 0 {
+		return cfg.Kinesis.StreamNames
+	}
+	return []string{cfg.Kinesis.StreamName}
+}
+
+// shardLabeler names the shards of one stream in logs: by ID, prefixed with
+// the stream when several streams are consumed, since shard IDs repeat
+// across streams
+type shardLabeler struct {
+	stream   string
+	multiple bool
+}
+
+func newShardLabeler(cfg *Config) shardLabeler {
+	return shardLabeler{stream: cfg.Kinesis.StreamName, multiple: cfg.Kinesis.MultipleStreams}
+}
+
+// logLabel names a shard of the labeler's stream in logs
+func (l shardLabeler) logLabel(shardID string) string {
+	if !l.multiple {
+		return shardID
+	}
+	return l.stream + "/" + shardID
+}
+
+// logLabel names a shard of the context's stream in logs
+func (pc *ProcessorContext) logLabel(shardID string) string {
+	return newShardLabeler(pc.Config).logLabel(shardID)
+}
+
+// configForStream returns a copy of the config that targets a single stream.
+// With several streams each KCL worker gets its own application name and
+// lease table name, because shard IDs repeat across streams.
+func configForStream(cfg *Config, stream string, multiple bool) *Config {
+	streamCfg := *cfg
+	streamCfg.Kinesis.StreamName = stream
+	streamCfg.Kinesis.StreamNames = nil
+	streamCfg.Kinesis.MultipleStreams = multiple
+	if multiple {
+		streamCfg.Consumer.ApplicationName = cfg.Consumer.ApplicationName + "-" + stream
+		if cfg.Consumer.LeaseTableName != "" {
+			streamCfg.Consumer.LeaseTableName = cfg.Consumer.LeaseTableName + "-" + stream
+		}
+	}
+	return &streamCfg
+}
+
+// Runtime is the process-wide state shared by the consumers of every stream
+type Runtime struct {
+	Metrics  *Metrics
+	Shards   *ShardRegistry
+	Backfill *Backfill          // nil unless consumer.backfill is configured
+	History  *CheckpointHistory // nil unless consumer.checkpoint_history.size is set
+	Audit    *AuditLog          // nil unless consumer.audit.path is set
+	Offsets  *OffsetMap         // nil unless consumer.offset_map_path is set
+
+	// Checkpoints is nil unless consumer.checkpoint_file is set
+	Checkpoints *CheckpointFile
+
+	// Aggregates is nil unless an "aggregates" sink is configured
+	Aggregates *RollingAggregates
+
+	// Handler is nil unless SetStreamHandler was called
+	Handler EventHandler
+}
+
+// ForStream returns the runtime as seen by the consumer of one stream
+func (rt *Runtime) ForStream(stream string) *Runtime {
+	return &Runtime{
+		Metrics:  rt.Metrics.ForStream(stream),
+		Shards:   rt.Shards.ForStream(stream),
+		Backfill: rt.Backfill,
+		History:  rt.History.ForStream(stream),
+		Audit:    rt.Audit.ForStream(stream),
+		Offsets:  rt.Offsets.ForStream(stream),
+
+		Checkpoints: rt.Checkpoints.ForStream(stream),
+		Aggregates:  rt.Aggregates,
+		Handler:     rt.Handler,
+	}
+}
+
+// runStreams runs the configured assignment mode independently for every
+// stream, sharing one runtime, and returns once all of them have stopped. A
+// shutdown signal reaches every stream, so they all drain before this
+// returns. The first stream to fail stops the others the same way, so the
+// process exits instead of consuming part of its streams.
+func runStreams(cfg *Config, rt *Runtime) error {
+	var run func(context.Context, *Config, *Runtime) error
+	switch cfg.Consumer.AssignmentMode {
+	case "manual":
+		run = runManualMode
+	case "kcl":
+		run = runKCLMode
+	default:
+		return fmt.Errorf("invalid assignment_mode: %s. Must be 'manual' or 'kcl'", cfg.Consumer.AssignmentMode)
+	}
+
+	streams := streamNames(cfg)
+	if len(streams) == 1 {
+		return run(context.Background(), cfg, rt.ForStream(streams[0]))
+	}
+	return runEachStream(cfg, rt, streams, run)
+}
+
+// runEachStream runs run for every stream at once, each with its own copy
+// of the config, and cancels the others' context when one fails
+func runEachStream(cfg *Config, rt *Runtime, streams []string, run func(context.Context, *Config, *Runtime) error) error {
+	log.Printf("Consuming %d streams: %v", len(streams), streams)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	var failOnce sync.Once
+	errs := make([]error, len(streams))
+	for i, stream := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := run(ctx, configForStream(cfg, stream, true), rt.ForStream(stream)); err != nil {
+				errs[i] = fmt.Errorf("stream %s: %w", stream, err)
+				failOnce.Do(func() {
+					log.Printf("Stopping the other streams: %v", errs[i])
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigForStreamLabels(t *testing.T) {
+	tests := []struct {
+		name      string
+		multiple  bool
+		leases    string
+		wantLabel string
+		wantApp   string
+		wantTable string
+	}{
+		{name: "single stream", wantLabel: "shardId-000000000001", wantApp: "app"},
+		{name: "several streams", multiple: true, wantLabel: "orders/shardId-000000000001", wantApp: "app-orders"},
+		{name: "several streams with a lease table", multiple: true, leases: "leases", wantLabel: "orders/shardId-000000000001", wantApp: "app-orders", wantTable: "leases-orders"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Kinesis.StreamNames = []string{"orders", "payments"}
+			cfg.Consumer.ApplicationName = "app"
+			cfg.Consumer.LeaseTableName = tt.leases
+
+			streamCfg := configForStream(cfg, "orders", tt.multiple)
+			if got := newShardLabeler(streamCfg).logLabel("shardId-000000000001"); got != tt.wantLabel {
+				t.Errorf("label %q, want %q", got, tt.wantLabel)
+			}
+			if streamCfg.Consumer.ApplicationName != tt.wantApp || streamCfg.Consumer.LeaseTableName != tt.wantTable {
+				t.Errorf("application %q, lease table %q; want %q, %q",
+					streamCfg.Consumer.ApplicationName, streamCfg.Consumer.LeaseTableName, tt.wantApp, tt.wantTable)
+			}
+			if streamCfg.Kinesis.StreamName != "orders" || streamCfg.Kinesis.StreamNames != nil {
+				t.Errorf("stream %q, streams %v; want only orders", streamCfg.Kinesis.StreamName, streamCfg.Kinesis.StreamNames)
+			}
+			if newShardLabeler(cfg).logLabel("shardId-000000000001") != "shardId-000000000001" {
+				t.Error("the shared config's labels changed with a stream's copy")
+			}
+		})
+	}
+}
+
+func TestRunEachStreamStopsOnFailure(t *testing.T) {
+	cfg := &Config{}
+	cfg.Kinesis.StreamNames = []string{"orders", "payments", "refunds"}
+	failure := errors.New("stream deleted")
+	stopped := make(chan string, 2)
+
+	// orders fails once it has started; the others consume until they are stopped
+	done := make(chan error, 1)
+	go func() {
+		done <- runEachStream(cfg, &Runtime{}, cfg.Kinesis.StreamNames, func(ctx context.Context, streamCfg *Config, rt *Runtime) error {
+			if streamCfg.Kinesis.StreamName == "orders" {
+				time.Sleep(10 * time.Millisecond)
+				return failure
+			}
+			<-ctx.Done()
+			stopped <- streamCfg.Kinesis.StreamName
+			return nil
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, failure) || !strings.Contains(err.Error(), "stream orders") {
+			t.Errorf("runEachStream() = %v, want the failure of orders", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the other streams kept running after orders failed")
+	}
+	close(stopped)
+	var got []string
+	for stream := range stopped {
+		got = append(got, stream)
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"payments", "refunds"}) {
+		t.Errorf("stopped %v, want payments and refunds", got)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// OffsetMapEntry is one line of the offset map file: where every shard of a
+// stream stopped
+type OffsetMapEntry struct {
+	Stream    string            `json:"stream"`
+	WorkerID  string            `json:"worker_id"`
+	WrittenAt time.Time         `json:"written_at"`
+	Offsets   map[string]string `json:"offsets"` // shard ID to the sequence number of its last processed record
+}
+
+// offsetMapStore holds the offsets of every stream in the process
+type offsetMapStore struct {
+	mu     sync.Mutex
+	shards map[ShardKey]string
+}
+
+// OffsetMap tracks the last record processed on every shard and writes the
+// result to consumer.offset_map_path on shutdown, for test harnesses and
+// replay tools to see exactly where each shard stopped. Unlike checkpoints
+// it covers manual mode and records not checkpointed yet. Like Metrics,
+// each stream records through its own view from ForStream. A nil *OffsetMap
+// is valid and records nothing.
+type OffsetMap struct {
+	stream string
+	store  *offsetMapStore
+}
+
+// NewOffsetMap returns the offset map for consumer.offset_map_path, or nil
+// when it is not set
+func NewOffsetMap(cfg *Config) *OffsetMap {
+	if cfg.Consumer.OffsetMapPath == "" {
+		return nil
+	}
+	return &OffsetMap{store: &offsetMapStore{shards: make(map[ShardKey]string)}}
+}
+
+// ForStream returns a view that records into the same store, labelled with the stream
+func (o *OffsetMap) ForStream(stream string) *OffsetMap {
+	if o == nil {
+		return nil
+	}
+	return &OffsetMap{stream: stream, store: o.store}
+}
+
+// Processed records a processed record of a shard. Records arrive in order
+// per shard, except on a rewind, which moves the shard's offset back with it.
+func (o *OffsetMap) Processed(shardID, sequenceNumber string) {
+	if o == nil || sequenceNumber == "" {
+		return
+	}
+	o.store.mu.Lock()
+	defer o.store.mu.Unlock()
+	o.store.shards[ShardKey{Stream: o.stream, ShardID: shardID}] = sequenceNumber
+}
+
+// Save writes one JSON line per stream to path, replacing the file at once
+// so a reader never sees it half written. Every stream in streams gets a
+// line, with empty offsets if none of its records were processed.
+func (o *OffsetMap) Save(path string, streams []string, workerID string) error {
+	if o == nil || path == "" {
+		return nil
+	}
+	now := time.Now().UTC()
+	entries := make(map[string]*OffsetMapEntry, len(streams))
+	for _, stream := range streams {
+		entries[stream] = &OffsetMapEntry{Stream: stream, WorkerID: workerID, WrittenAt: now, Offsets: map[string]string{}}
+	}
+	o.store.mu.Lock()
+	shards := len(o.store.shards)
+	for key, sequenceNumber := range o.store.shards {
+		if entry, ok := entries[key.Stream]; ok {
+			entry.Offsets[key.ShardID] = sequenceNumber
+		}
+	}
+	o.store.mu.Unlock()
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, stream := range streams {
+		if err := encoder.Encode(entries[stream]); err != nil {
+			return fmt.Errorf("failed to encode offset map: %w", err)
+		}
+	}
+	if err := os.WriteFile(path+".tmp", buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write offset map: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write offset map: %w", err)
+	}
+	log.Printf("Offsets of %d shards saved to %s", shards, path)
+	return nil
+}
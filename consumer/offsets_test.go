@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestOffsetMap(t *testing.T) {
+	const other = "shardId-000000000001"
+	path := filepath.Join(t.TempDir(), "offsets.jsonl")
+	cfg := &Config{}
+	cfg.Consumer.OffsetMapPath = path
+	offsets := NewOffsetMap(cfg)
+	pc := &ProcessorContext{Config: cfg, Metrics: NewMetrics(), Offsets: offsets.ForStream(testStream)}
+
+	// decode decodes records with the given sequence numbers on a shard
+	decode := func(shardID string, data string, sequences ...int) {
+		for _, sequence := range sequences {
+			pc.DecodeEvent(shardID, &kinesis.Record{SequenceNumber: aws.String(fmt.Sprint(sequence)), Data: []byte(data)})
+		}
+	}
+	valid := `{"version":1,"event_id":"evt_1","action":"view"}`
+	decode(testShard, valid, 1, 2, 3)
+	// A record that fails to decode was still processed
+	decode(testShard, "not json", 4)
+	decode(other, valid, 10, 11, 12)
+	// A rewind moves the shard's offset back
+	decode(other, valid, 5)
+	// Another stream's shard of the same ID is kept apart
+	offsets.ForStream("other-stream").Processed(testShard, "99")
+
+	start := time.Now().UTC().Add(-time.Second)
+	if err := offsets.Save(path, []string{testStream, "other-stream", "idle-stream"}, "worker-1"); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var entries []OffsetMapEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry OffsetMapEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+
+	want := []OffsetMapEntry{
+		{Stream: testStream, Offsets: map[string]string{testShard: "4", other: "5"}},
+		{Stream: "other-stream", Offsets: map[string]string{testShard: "99"}},
+		{Stream: "idle-stream", Offsets: map[string]string{}},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("offset map has %d lines, want %d", len(entries), len(want))
+	}
+	for i, entry := range entries {
+		if entry.Stream != want[i].Stream || entry.WorkerID != "worker-1" || entry.WrittenAt.Before(start) {
+			t.Errorf("line %d is %s by %s at %v, want %s by worker-1 now", i, entry.Stream, entry.WorkerID, entry.WrittenAt, want[i].Stream)
+		}
+		if fmt.Sprint(entry.Offsets) != fmt.Sprint(want[i].Offsets) {
+			t.Errorf("%s offsets %v, want %v", entry.Stream, entry.Offsets, want[i].Offsets)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	if NewOffsetMap(&Config{}) != nil {
+		t.Error("NewOffsetMap() without offset_map_path returned a map")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// consumer.ordering values
+const (
+	OrderingStrict  = "strict"
+	OrderingRelaxed = "relaxed"
+)
+
+// DefaultOrderingConcurrency is how many records a shard handles at once in relaxed ordering
+const DefaultOrderingConcurrency = 8
+
+// validateOrdering checks consumer.ordering. Relaxed ordering checkpoints
+// against the records it has seen complete, which a buffered, Parquet, gRPC
+// or multi sink would then have to deliver in completion order, so it cannot
+// be combined with any of them.
+func validateOrdering(cfg *Config) error {
+	switch cfg.Consumer.Ordering {
+	case OrderingStrict:
+		return nil
+	case OrderingRelaxed:
+	default:
+		return fmt.Errorf("invalid ordering: %s. Must be '%s' or '%s'", cfg.Consumer.Ordering, OrderingStrict, OrderingRelaxed)
+	}
+	if cfg.Consumer.BufferMemoryBytes > 0 {
+		return fmt.Errorf("ordering %q cannot be combined with buffer_memory_bytes", OrderingRelaxed)
+	}
+	if sinkType := cfg.Consumer.Sink.Type; sinkType == "parquet" || sinkType == "grpc" || sinkType == "multi" {
+		return fmt.Errorf("ordering %q cannot be combined with a %s sink", OrderingRelaxed, sinkType)
+	}
+	return nil
+}
+
+// completionTracker follows records handled out of order and finds the
+// highest sequence number up to which every record has completed, which is
+// as far as a checkpoint may go without leaving a gap
+type completionTracker struct {
+	mu        sync.Mutex
+	pending   []*trackedRecord // in dispatch (sequence) order
+	completed string           // last sequence number of the contiguous completed prefix
+}
+
+type trackedRecord struct {
+	sequenceNumber string
+	done           bool
+}
+
+// dispatch starts tracking a record; records must be dispatched in sequence order
+func (ct *completionTracker) dispatch(sequenceNumber string) *trackedRecord {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	tracked := &trackedRecord{sequenceNumber: sequenceNumber}
+	ct.pending = append(ct.pending, tracked)
+	return tracked
+}
+
+// complete marks a record done and advances the contiguous prefix over it
+// and any completed records after it
+func (ct *completionTracker) complete(tracked *trackedRecord) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	tracked.done = true
+	for len(ct.pending) > 0 && ct.pending[0].done {
+		ct.completed = ct.pending[0].sequenceNumber
+		ct.pending[0] = nil
+		ct.pending = ct.pending[1:]
+	}
+}
+
+// contiguous returns the last sequence number of the contiguous completed
+// prefix, or an empty string if nothing has completed yet
+func (ct *completionTracker) contiguous() string {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.completed
+}
+
+// relaxedJob is a decoded record waiting for a handler goroutine
+type relaxedJob struct {
+	record  *SinkRecord
+	tracked *trackedRecord
+}
+
+// relaxedPool handles a shard's records on several goroutines for
+// consumer.ordering "relaxed". Records are dispatched in sequence order but
+// may complete in any order; the tracker tells how far the shard may be
+// checkpointed.
+type relaxedPool struct {
+	jobs    chan relaxedJob
+	wg      sync.WaitGroup
+	tracker completionTracker
+}
+
+// newRelaxedPool starts concurrency goroutines running handle. handle
+// returns false for a record that must not count as completed.
+func newRelaxedPool(concurrency int, handle func(record *SinkRecord) bool) *relaxedPool {
+	pool := &relaxedPool{jobs: make(chan relaxedJob, concurrency)}
+	for i := 0; i < concurrency; i++ {
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			for job := range pool.jobs {
+				if handle(job.record) {
+					pool.tracker.complete(job.tracked)
+				}
+			}
+		}()
+	}
+	return pool
+}
+
+// submit queues a record, blocking while every goroutine is busy and the
+// queue is full. A nil record is one with nothing to handle, which
+// completes at once.
+func (p *relaxedPool) submit(sequenceNumber string, record *SinkRecord) {
+	tracked := p.tracker.dispatch(sequenceNumber)
+	if record == nil {
+		p.tracker.complete(tracked)
+		return
+	}
+	p.jobs <- relaxedJob{record: record, tracked: tracked}
+}
+
+// completed returns how far the shard may be checkpointed
+func (p *relaxedPool) completed() string {
+	return p.tracker.contiguous()
+}
+
+// close waits for every queued record to be handled and stops the goroutines
+func (p *relaxedPool) close() {
+	close(p.jobs)
+	p.wg.Wait()
+}
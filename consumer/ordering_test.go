@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestValidateOrdering(t *testing.T) {
+	tests := []struct {
+		name     string
+		ordering string
+		buffer   int64
+		sink     string
+		wantErr  bool
+	}{
+		{name: "strict", ordering: OrderingStrict, buffer: 1024, sink: "parquet"},
+		{name: "relaxed", ordering: OrderingRelaxed, sink: "file"},
+		{name: "relaxed with buffering", ordering: OrderingRelaxed, buffer: 1024, wantErr: true},
+		{name: "relaxed with a parquet sink", ordering: OrderingRelaxed, sink: "parquet", wantErr: true},
+		{name: "relaxed with a grpc sink", ordering: OrderingRelaxed, sink: "grpc", wantErr: true},
+		{name: "relaxed with a multi sink", ordering: OrderingRelaxed, sink: "multi", wantErr: true},
+		{name: "unknown", ordering: "loose", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.Ordering = tt.ordering
+			cfg.Consumer.BufferMemoryBytes = tt.buffer
+			cfg.Consumer.Sink.Type = tt.sink
+			if err := validateOrdering(cfg); (err != nil) != tt.wantErr {
+				t.Errorf("validateOrdering() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCompletionTracker(t *testing.T) {
+	tests := []struct {
+		name     string
+		dispatch int
+		complete []int // indexes of the dispatched records, in completion order
+		want     []string
+	}{
+		{name: "in order", dispatch: 3, complete: []int{0, 1, 2}, want: []string{"0", "1", "2"}},
+		{name: "gap holds the prefix back", dispatch: 3, complete: []int{1, 2, 0}, want: []string{"", "", "2"}},
+		{name: "fills a gap in the middle", dispatch: 4, complete: []int{0, 2, 1, 3}, want: []string{"0", "0", "2", "3"}},
+		{name: "last record outstanding", dispatch: 3, complete: []int{0, 1}, want: []string{"0", "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ct completionTracker
+			tracked := make([]*trackedRecord, tt.dispatch)
+			for i := range tracked {
+				tracked[i] = ct.dispatch(fmt.Sprint(i))
+			}
+			if ct.contiguous() != "" {
+				t.Fatalf("contiguous() = %q before any completion", ct.contiguous())
+			}
+			for i, index := range tt.complete {
+				ct.complete(tracked[index])
+				if got := ct.contiguous(); got != tt.want[i] {
+					t.Errorf("after completing record %d, contiguous() = %q, want %q", index, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRelaxedPool(t *testing.T) {
+	tests := []struct {
+		name   string
+		failed map[string]bool // records whose handling fails
+		nils   map[string]bool // records with nothing to handle
+		want   string
+	}{
+		{name: "everything handled", want: "19"},
+		{name: "records with nothing to handle complete", nils: map[string]bool{"0": true, "19": true}, want: "19"},
+		{name: "failed record stops the checkpoint before it", failed: map[string]bool{"7": true}, want: "6"},
+		{name: "first record failed", failed: map[string]bool{"0": true}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			handled := make(map[string]bool)
+			pool := newRelaxedPool(4, func(record *SinkRecord) bool {
+				mu.Lock()
+				defer mu.Unlock()
+				handled[record.SequenceNumber] = true
+				return !tt.failed[record.SequenceNumber]
+			})
+			for _, record := range testSinkRecords(0, 20) {
+				if tt.nils[record.SequenceNumber] {
+					pool.submit(record.SequenceNumber, nil)
+					continue
+				}
+				pool.submit(record.SequenceNumber, record)
+			}
+			pool.close()
+
+			if got := pool.completed(); got != tt.want {
+				t.Errorf("completed() = %q, want %q", got, tt.want)
+			}
+			if want := 20 - len(tt.nils); len(handled) != want {
+				t.Errorf("handled %d records, want %d", len(handled), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// consumer.detect_overlap values
+const (
+	DetectOverlapOff  = ""
+	DetectOverlapWarn = "warn"
+	DetectOverlapFail = "fail"
+)
+
+// Attributes of a shard claim row
+const (
+	claimShardKey     = "ShardID"
+	claimOwnerKey     = "Owner"
+	claimHeartbeatKey = "Heartbeat"
+)
+
+const (
+	// claimHeartbeatInterval is how often a worker refreshes its shard claims
+	claimHeartbeatInterval = 10 * time.Second
+
+	// claimTTL is how long a claim stays live without a heartbeat, so a
+	// crashed worker does not block its shards forever
+	claimTTL = 3 * claimHeartbeatInterval
+)
+
+// ShardConflict is a shard already claimed by another live manual-mode worker
+type ShardConflict struct {
+	ShardID string
+	Owner   string
+}
+
+// ShardClaims registers the shards a manual-mode worker was assigned in a
+// shared DynamoDB table, so two workers mistakenly given the same shard
+// notice each other instead of silently processing it twice
+type ShardClaims struct {
+	client     dynamodbiface.DynamoDBAPI
+	tableName  string
+	streamName string
+	labels     shardLabeler
+	workerID   string
+}
+
+// NewShardClaims creates the claims table if it does not exist yet
+func NewShardClaims(client dynamodbiface.DynamoDBAPI, tableName string, cfg *Config) (*ShardClaims, error) {
+	if err := ensureTable(client, tableName, claimShardKey); err != nil {
+		return nil, err
+	}
+	return &ShardClaims{
+		client:     client,
+		tableName:  tableName,
+		streamName: cfg.Kinesis.StreamName,
+		labels:     newShardLabeler(cfg),
+		workerID:   cfg.Consumer.WorkerID,
+	}, nil
+}
+
+// key scopes a shard ID to the stream, since shard IDs repeat across streams
+func (sc *ShardClaims) key(shardID string) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{S: aws.String(sc.streamName + "/" + shardID)}
+}
+
+// Claim records this worker as the owner of each shard. A shard is only
+// taken over if it is unclaimed, already ours, or its claim has expired;
+// shards held by another live worker are returned as conflicts.
+func (sc *ShardClaims) Claim(shardIDs []string) ([]ShardConflict, error) {
+	var conflicts []ShardConflict
+	for _, shardID := range shardIDs {
+		owner, err := sc.claim(shardID)
+		if err != nil {
+			return nil, err
+		}
+		if owner != "" {
+			conflicts = append(conflicts, ShardConflict{ShardID: shardID, Owner: owner})
+		}
+	}
+	return conflicts, nil
+}
+
+// claim writes the claim for one shard, returning the other owner if it is held
+func (sc *ShardClaims) claim(shardID string) (string, error) {
+	now := time.Now().UTC()
+	_, err := sc.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(sc.tableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			claimShardKey:     sc.key(shardID),
+			claimOwnerKey:     {S: aws.String(sc.workerID)},
+			claimHeartbeatKey: {S: aws.String(now.Format(time.RFC3339))},
+		},
+		// RFC3339 timestamps in UTC compare correctly as strings
+		ConditionExpression: aws.String("attribute_not_exists(#shard) OR #owner = :me OR #heartbeat < :expired"),
+		ExpressionAttributeNames: map[string]*string{
+			"#shard":     aws.String(claimShardKey),
+			"#owner":     aws.String(claimOwnerKey),
+			"#heartbeat": aws.String(claimHeartbeatKey),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":me":      {S: aws.String(sc.workerID)},
+			":expired": {S: aws.String(now.Add(-claimTTL).Format(time.RFC3339))},
+		},
+	})
+	if err == nil {
+		return "", nil
+	}
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+		return "", fmt.Errorf("failed to claim shard %s: %w", shardID, err)
+	}
+
+	output, err := sc.client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(sc.tableName),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			claimShardKey: sc.key(shardID),
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read claim for shard %s: %w", shardID, err)
+	}
+	owner := stringAttr(output.Item, claimOwnerKey)
+	if owner == "" {
+		// The other claim was released in between; report it anyway so the
+		// operator still hears about the overlap
+		owner = "unknown"
+	}
+	return owner, nil
+}
+
+// Heartbeat refreshes this worker's claims until ctx is cancelled
+func (sc *ShardClaims) Heartbeat(ctx context.Context, shardIDs []string) {
+	ticker := time.NewTicker(claimHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			conflicts, err := sc.Claim(shardIDs)
+			if err != nil {
+				log.Printf("Failed to refresh shard claims: %v", err)
+				continue
+			}
+			logConflicts(conflicts)
+		}
+	}
+}
+
+// Release deletes the claims this worker still owns
+func (sc *ShardClaims) Release(shardIDs []string) {
+	for _, shardID := range shardIDs {
+		_, err := sc.client.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(sc.tableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				claimShardKey: sc.key(shardID),
+			},
+			ConditionExpression:      aws.String("#owner = :me"),
+			ExpressionAttributeNames: map[string]*string{"#owner": aws.String(claimOwnerKey)},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":me": {S: aws.String(sc.workerID)},
+			},
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+				continue
+			}
+			log.Printf("[%s] Failed to release shard claim: %v", sc.labels.logLabel(shardID), err)
+		}
+	}
+}
+
+func logConflicts(conflicts []ShardConflict) {
+	for _, conflict := range conflicts {
+		log.Printf("WARNING: shard %s is also claimed by live worker %s; both workers will process it",
+			conflict.ShardID, conflict.Owner)
+	}
+}
+
+// claimAssignedShards registers the worker's assigned shards when
+// consumer.detect_overlap is set and keeps the claims alive until the
+// returned release function is called. In "fail" mode any overlap is
+// returned as an error.
+func claimAssignedShards(cfg *Config) (func(), error) {
+	mode := cfg.Consumer.DetectOverlap
+	switch mode {
+	case DetectOverlapOff:
+		return func() {}, nil
+	case DetectOverlapWarn, DetectOverlapFail:
+	default:
+		return nil, fmt.Errorf("invalid detect_overlap: %s. Must be '%s' or '%s'", mode, DetectOverlapWarn, DetectOverlapFail)
+	}
+
+	sess, err := newAWSSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := NewShardClaims(dynamodb.New(sess), cfg.Consumer.OverlapTable, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	shardIDs := cfg.Consumer.AssignedShards
+	conflicts, err := claims.Claim(shardIDs)
+	if err != nil {
+		return nil, err
+	}
+	if len(conflicts) > 0 && mode == DetectOverlapFail {
+		overlapping := make([]string, 0, len(conflicts))
+		for _, conflict := range conflicts {
+			overlapping = append(overlapping, fmt.Sprintf("%s (claimed by %s)", conflict.ShardID, conflict.Owner))
+		}
+		// Give back the shards we did get so they are not blocked until the claims expire
+		claims.Release(shardIDs)
+		return nil, fmt.Errorf("assigned shards overlap with another live worker: %s", strings.Join(overlapping, ", "))
+	}
+	logConflicts(conflicts)
+	log.Printf("Registered claims for %d shards in %s", len(shardIDs), cfg.Consumer.OverlapTable)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		claims.Heartbeat(ctx, shardIDs)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+		claims.Release(shardIDs)
+	}, nil
+}
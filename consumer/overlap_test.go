@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// fakeClaimsTable keeps shard claims in memory and applies the claim and
+// release conditions the way DynamoDB would
+type fakeClaimsTable struct {
+	dynamodbiface.DynamoDBAPI
+	mu   sync.Mutex
+	rows map[string]map[string]*dynamodb.AttributeValue
+}
+
+func (f *fakeClaimsTable) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := aws.StringValue(input.Item[claimShardKey].S)
+	if row, ok := f.rows[key]; ok {
+		values := input.ExpressionAttributeValues
+		ours := stringAttr(row, claimOwnerKey) == aws.StringValue(values[":me"].S)
+		expired := stringAttr(row, claimHeartbeatKey) < aws.StringValue(values[":expired"].S)
+		if !ours && !expired {
+			return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "claimed", nil)
+		}
+	}
+	f.rows[key] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeClaimsTable) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &dynamodb.GetItemOutput{Item: f.rows[aws.StringValue(input.Key[claimShardKey].S)]}, nil
+}
+
+func (f *fakeClaimsTable) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := aws.StringValue(input.Key[claimShardKey].S)
+	if stringAttr(f.rows[key], claimOwnerKey) != aws.StringValue(input.ExpressionAttributeValues[":me"].S) {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "not ours", nil)
+	}
+	delete(f.rows, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// expire backdates every claim past claimTTL, as if its worker had crashed
+func (f *fakeClaimsTable) expire() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stale := time.Now().UTC().Add(-2 * claimTTL).Format(time.RFC3339)
+	for _, row := range f.rows {
+		row[claimHeartbeatKey] = &dynamodb.AttributeValue{S: aws.String(stale)}
+	}
+}
+
+// testShardClaims returns the claims of a worker on the stream
+func testShardClaims(table *fakeClaimsTable, workerID string) *ShardClaims {
+	cfg := &Config{}
+	cfg.Kinesis.StreamName = testStream
+	cfg.Consumer.WorkerID = workerID
+	return &ShardClaims{client: table, tableName: "claims", streamName: testStream, labels: newShardLabeler(cfg), workerID: workerID}
+}
+
+func TestShardClaims(t *testing.T) {
+	type step struct {
+		worker  string
+		release bool // release the shards instead of claiming them
+		expire  bool // expire every claim before the step
+		shards  []string
+		want    string // conflicts reported
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{name: "second worker detects the overlap", steps: []step{
+			{worker: "worker-1", shards: []string{"shard-a", "shard-b"}, want: "[]"},
+			{worker: "worker-2", shards: []string{"shard-b", "shard-c"}, want: "[{shard-b worker-1}]"},
+		}},
+		{name: "claiming again is not an overlap", steps: []step{
+			{worker: "worker-1", shards: []string{"shard-a"}, want: "[]"},
+			{worker: "worker-1", shards: []string{"shard-a"}, want: "[]"},
+		}},
+		{name: "expired claim is taken over", steps: []step{
+			{worker: "worker-1", shards: []string{"shard-a"}, want: "[]"},
+			{worker: "worker-2", expire: true, shards: []string{"shard-a"}, want: "[]"},
+			{worker: "worker-1", shards: []string{"shard-a"}, want: "[{shard-a worker-2}]"},
+		}},
+		{name: "released shard is free", steps: []step{
+			{worker: "worker-1", shards: []string{"shard-a"}, want: "[]"},
+			{worker: "worker-1", release: true, shards: []string{"shard-a"}},
+			{worker: "worker-2", shards: []string{"shard-a"}, want: "[]"},
+		}},
+		{name: "releasing another worker's claim keeps it", steps: []step{
+			{worker: "worker-1", shards: []string{"shard-a"}, want: "[]"},
+			{worker: "worker-2", release: true, shards: []string{"shard-a"}},
+			{worker: "worker-2", shards: []string{"shard-a"}, want: "[{shard-a worker-1}]"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &fakeClaimsTable{rows: make(map[string]map[string]*dynamodb.AttributeValue)}
+			for i, s := range tt.steps {
+				if s.expire {
+					table.expire()
+				}
+				claims := testShardClaims(table, s.worker)
+				if s.release {
+					claims.Release(s.shards)
+					continue
+				}
+				conflicts, err := claims.Claim(s.shards)
+				if err != nil {
+					t.Fatalf("step %d: Claim() = %v", i, err)
+				}
+				if got := fmt.Sprint(conflicts); got != s.want {
+					t.Errorf("step %d: %s claiming %v found conflicts %s, want %s", i, s.worker, s.shards, got, s.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// shardCompletion tracks which of this worker's shards have been read to
+// the end, so child shards created by a split or merge can wait for their
+// parents and records for a partition key are consumed in order
+type shardCompletion struct {
+	mu       sync.Mutex
+	finished map[string]chan struct{}
+}
+
+func newShardCompletion(shardIDs []string) *shardCompletion {
+	sc := &shardCompletion{finished: make(map[string]chan struct{}, len(shardIDs))}
+	for _, shardID := range shardIDs {
+		sc.finished[shardID] = make(chan struct{})
+	}
+	return sc
+}
+
+// add tracks a shard started after the others, such as a child shard
+func (sc *shardCompletion) add(shardID string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if _, ok := sc.finished[shardID]; !ok {
+		sc.finished[shardID] = make(chan struct{})
+	}
+}
+
+// markFinished records that a shard reached its end (nil iterator)
+func (sc *shardCompletion) markFinished(shardID string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if ch, ok := sc.finished[shardID]; ok {
+		select {
+		case <-ch:
+		default:
+			close(ch)
+		}
+	}
+}
+
+// wait blocks until every parent has finished, returning false if ctx is cancelled first
+func (sc *shardCompletion) wait(ctx context.Context, parents []string) bool {
+	for _, parent := range parents {
+		sc.mu.Lock()
+		ch := sc.finished[parent]
+		sc.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// finishedAll reports whether every parent has finished, without waiting
+func (sc *shardCompletion) finishedAll(parents []string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, parent := range parents {
+		select {
+		case <-sc.finished[parent]:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// assignedParents maps each assigned shard to its parents that are also
+// assigned to this worker. Parents owned by another worker, or already
+// trimmed from the stream, cannot be waited on and are logged instead.
+func assignedParents(shards []*kinesis.Shard, assigned []string) map[string][]string {
+	isAssigned := make(map[string]bool, len(assigned))
+	for _, shardID := range assigned {
+		isAssigned[shardID] = true
+	}
+	inStream := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		inStream[aws.StringValue(shard.ShardId)] = true
+	}
+
+	parents := make(map[string][]string)
+	for _, shard := range shards {
+		shardID := aws.StringValue(shard.ShardId)
+		if !isAssigned[shardID] {
+			continue
+		}
+		for _, parent := range []string{aws.StringValue(shard.ParentShardId), aws.StringValue(shard.AdjacentParentShardId)} {
+			switch {
+			case parent == "" || !inStream[parent]:
+			case isAssigned[parent]:
+				parents[shardID] = append(parents[shardID], parent)
+			default:
+				log.Printf("[%s] Parent shard %s is not assigned to this worker, parent-first order cannot be enforced",
+					shardID, parent)
+			}
+		}
+	}
+	return parents
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// testShardWithParents returns a shard with the given parents, empty for none
+func testShardWithParents(shardID, parent, adjacentParent string) *kinesis.Shard {
+	shard := &kinesis.Shard{ShardId: aws.String(shardID)}
+	if parent != "" {
+		shard.ParentShardId = aws.String(parent)
+	}
+	if adjacentParent != "" {
+		shard.AdjacentParentShardId = aws.String(adjacentParent)
+	}
+	return shard
+}
+
+func TestAssignedParents(t *testing.T) {
+	// shard 0 split into 2 and 3, and 1 and 2 merged into 4
+	stream := []*kinesis.Shard{
+		testShardWithParents("s0", "", ""),
+		testShardWithParents("s1", "", ""),
+		testShardWithParents("s2", "s0", ""),
+		testShardWithParents("s3", "s0", ""),
+		testShardWithParents("s4", "s1", "s2"),
+		testShardWithParents("s5", "trimmed", ""),
+	}
+	tests := []struct {
+		name     string
+		assigned []string
+		want     map[string][]string
+	}{
+		{name: "split children wait for their parent", assigned: []string{"s0", "s2", "s3"}, want: map[string][]string{"s2": {"s0"}, "s3": {"s0"}}},
+		{name: "merge waits for both parents", assigned: []string{"s1", "s2", "s4"}, want: map[string][]string{"s4": {"s1", "s2"}}},
+		{name: "parent of another worker is not waited on", assigned: []string{"s2", "s4"}, want: map[string][]string{"s4": {"s2"}}},
+		{name: "parent trimmed from the stream", assigned: []string{"s5"}, want: map[string][]string{}},
+		{name: "parents only", assigned: []string{"s0", "s1"}, want: map[string][]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := assignedParents(stream, tt.assigned)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("assignedParents() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShardCompletion(t *testing.T) {
+	tests := []struct {
+		name     string
+		finished []string
+		parents  []string
+		want     bool
+	}{
+		{name: "no parents", want: true},
+		{name: "parent finished", finished: []string{"s0"}, parents: []string{"s0"}, want: true},
+		{name: "parent not finished", parents: []string{"s0"}},
+		{name: "one of two parents finished", finished: []string{"s1"}, parents: []string{"s1", "s2"}},
+		{name: "both parents finished", finished: []string{"s2", "s1"}, parents: []string{"s1", "s2"}, want: true},
+		{name: "parent started later", finished: []string{"late"}, parents: []string{"late"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := newShardCompletion([]string{"s0", "s1", "s2"})
+			sc.add("late")
+			for _, shardID := range tt.finished {
+				sc.markFinished(shardID)
+				sc.markFinished(shardID) // finishing twice is harmless
+			}
+			if got := sc.finishedAll(tt.parents); got != tt.want {
+				t.Errorf("finishedAll() = %t, want %t", got, tt.want)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			if got := sc.wait(ctx, tt.parents); got != tt.want {
+				t.Errorf("wait() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShardCompletionWaitsForParent(t *testing.T) {
+	sc := newShardCompletion([]string{"s0"})
+	done := make(chan bool)
+	go func() { done <- sc.wait(context.Background(), []string{"s0"}) }()
+
+	select {
+	case <-done:
+		t.Fatal("child started before its parent finished")
+	case <-time.After(20 * time.Millisecond):
+	}
+	sc.markFinished("s0")
+	if !<-done {
+		t.Error("wait() = false once the parent finished")
+	}
+}
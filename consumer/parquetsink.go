@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// DefaultParquetRotateIntervalMs is how long a shard writes to one Parquet
+// file before closing it and starting the next
+const DefaultParquetRotateIntervalMs = 60000
+
+// parquetMetadataPrefix prefixes the columns flattened out of Event.Metadata
+const parquetMetadataPrefix = "metadata_"
+
+// ParquetSink writes events as columnar Parquet files in a directory, one
+// file per shard per rotation interval. Files are written under a .tmp name
+// and renamed once complete, so readers never see a partial file. Event
+// fields map to columns; Metadata is stored whole as a JSON string column,
+// and selected keys are also flattened into optional metadata_<key> columns.
+type ParquetSink struct {
+	dir             string
+	stream          string
+	labels          shardLabeler
+	rotate          time.Duration
+	metadataColumns []string
+	schema          *parquet.Schema
+
+	mu     sync.Mutex
+	shards map[string]*ParquetShardWriter
+}
+
+// NewParquetSink creates the output directory and the file schema
+func NewParquetSink(cfg *Config) (*ParquetSink, error) {
+	sinkCfg := cfg.Consumer.Sink
+	if sinkCfg.Path == "" {
+		return nil, fmt.Errorf("parquet sink requires consumer.sink.path (output directory)")
+	}
+	if err := os.MkdirAll(sinkCfg.Path, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create parquet sink directory %s: %w", sinkCfg.Path, err)
+	}
+
+	columns := parquet.Group{
+		"shard_id":        parquet.String(),
+		"sequence_number": parquet.String(),
+		"partition_key":   parquet.String(),
+		"event_id":        parquet.String(),
+		"user_id":         parquet.String(),
+		"timestamp":       parquet.Timestamp(parquet.Millisecond),
+		"action":          parquet.String(),
+		"value":           parquet.Leaf(parquet.DoubleType),
+		"metadata":        parquet.String(),
+	}
+	for _, key := range sinkCfg.Parquet.MetadataColumns {
+		name := parquetMetadataPrefix + key
+		if key == "" {
+			return nil, fmt.Errorf("consumer.sink.parquet.metadata_columns contains an empty key")
+		}
+		if _, exists := columns[name]; exists {
+			return nil, fmt.Errorf("consumer.sink.parquet.metadata_columns: duplicate column %s", name)
+		}
+		columns[name] = parquet.Optional(parquet.String())
+	}
+
+	return &ParquetSink{
+		dir:             sinkCfg.Path,
+		stream:          cfg.Kinesis.StreamName,
+		labels:          newShardLabeler(cfg),
+		rotate:          time.Duration(sinkCfg.Parquet.RotateIntervalMs) * time.Millisecond,
+		metadataColumns: sinkCfg.Parquet.MetadataColumns,
+		schema:          parquet.NewSchema("event", columns),
+		shards:          make(map[string]*ParquetShardWriter),
+	}, nil
+}
+
+// ShardWriter returns the writer for a shard's files, creating it if needed
+func (ps *ParquetSink) ShardWriter(shardID string) ShardWriter {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	writer, ok := ps.shards[shardID]
+	if !ok {
+		writer = &ParquetShardWriter{sink: ps, shardID: shardID, label: ps.labels.logLabel(shardID)}
+		ps.shards[shardID] = writer
+	}
+	return writer
+}
+
+// Write appends the record to the current file of its shard
+func (ps *ParquetSink) Write(record *SinkRecord) error {
+	return ps.ShardWriter(record.ShardID).Write(record)
+}
+
+// Close completes the open file of every shard
+func (ps *ParquetSink) Close() error {
+	ps.mu.Lock()
+	writers := make([]*ParquetShardWriter, 0, len(ps.shards))
+	for _, writer := range ps.shards {
+		writers = append(writers, writer)
+	}
+	ps.mu.Unlock()
+
+	var firstErr error
+	for _, writer := range writers {
+		if err := writer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// row maps a record onto the file schema
+func (ps *ParquetSink) row(record *SinkRecord) (map[string]any, error) {
+	event := record.Event
+	metadata, err := json.Marshal(event.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	row := map[string]any{
+		"shard_id":        record.ShardID,
+		"sequence_number": record.SequenceNumber,
+		"partition_key":   record.PartitionKey,
+		"event_id":        event.EventID,
+		"user_id":         event.UserID,
+		"timestamp":       event.Timestamp,
+		"action":          event.Action,
+		"value":           event.Value,
+		"metadata":        string(metadata),
+	}
+	for _, key := range ps.metadataColumns {
+		value, ok := event.Metadata[key]
+		if !ok || value == nil {
+			continue
+		}
+		if s, ok := value.(string); ok {
+			row[parquetMetadataPrefix+key] = s
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode metadata %s: %w", key, err)
+		}
+		row[parquetMetadataPrefix+key] = string(encoded)
+	}
+	return row, nil
+}
+
+// ParquetShardWriter writes one shard's records to rotating Parquet files.
+// Delivered only advances once a file is complete and renamed, so a
+// processor checkpointing against it never checkpoints a record that is
+// only in a file still being written.
+type ParquetShardWriter struct {
+	sink    *ParquetSink
+	shardID string
+	label   string // shardID as logged
+
+	mu        sync.Mutex
+	file      *os.File
+	writer    *parquet.Writer
+	path      string
+	opened    time.Time
+	rows      int
+	lastSeq   string // last sequence number in the open file
+	delivered string // last sequence number in a completed file
+	failed    error  // a file that could not be completed; nothing after it is delivered
+}
+
+// Write appends the record to the open file, rotating first if the file is due
+func (pw *ParquetShardWriter) Write(record *SinkRecord) error {
+	row, err := pw.sink.row(record)
+	if err != nil {
+		return err
+	}
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if pw.failed != nil {
+		return pw.failed
+	}
+	if pw.file != nil && time.Since(pw.opened) >= pw.sink.rotate {
+		if err := pw.finish(); err != nil {
+			return err
+		}
+	}
+	if pw.file == nil {
+		if err := pw.open(); err != nil {
+			return err
+		}
+	}
+
+	if err := pw.writer.Write(row); err != nil {
+		pw.failed = fmt.Errorf("failed to write %s: %w", pw.path, err)
+		return pw.failed
+	}
+	pw.rows++
+	pw.lastSeq = record.SequenceNumber
+	return nil
+}
+
+func (pw *ParquetShardWriter) open() error {
+	opened := time.Now().UTC()
+	name := fmt.Sprintf("%s_%s_%s.parquet", pw.sink.stream, pw.shardID, opened.Format("20060102T150405.000000000Z"))
+	path := filepath.Join(pw.sink.dir, name)
+
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create parquet file: %w", err)
+	}
+	pw.file = file
+	pw.writer = parquet.NewWriter(file, pw.sink.schema)
+	pw.path = path
+	pw.opened = opened
+	pw.rows = 0
+	return nil
+}
+
+// finish completes the open file and makes its records delivered
+func (pw *ParquetShardWriter) finish() error {
+	if pw.file == nil {
+		return nil
+	}
+
+	err := pw.writer.Close()
+	if closeErr := pw.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(pw.path+".tmp", pw.path)
+	}
+	pw.file = nil
+	pw.writer = nil
+	if err != nil {
+		pw.failed = fmt.Errorf("failed to complete %s: %w", pw.path, err)
+		return pw.failed
+	}
+
+	log.Printf("[%s] Wrote %d rows to %s", pw.label, pw.rows, pw.path)
+	pw.delivered = pw.lastSeq
+	pw.rows = 0
+	return nil
+}
+
+// Delivered returns the sequence number of the last record in a completed
+// file, completing the open file first if it is due for rotation
+func (pw *ParquetShardWriter) Delivered() string {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.file != nil && pw.failed == nil && time.Since(pw.opened) >= pw.sink.rotate {
+		if err := pw.finish(); err != nil {
+			log.Printf("[%s] %v", pw.label, err)
+		}
+	}
+	return pw.delivered
+}
+
+// Pending returns the number of records in the open file
+func (pw *ParquetShardWriter) Pending() int {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.rows
+}
+
+// WaitDrained completes the open file without waiting for its rotation
+func (pw *ParquetShardWriter) WaitDrained(timeout time.Duration) bool {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.failed != nil {
+		return false
+	}
+	if err := pw.finish(); err != nil {
+		log.Printf("[%s] %v", pw.label, err)
+		return false
+	}
+	return true
+}
+
+// Close completes the open file and detaches the writer from the sink, so a
+// later owner of the shard starts with nothing delivered. The records in the
+// last file were not checkpointed yet and the next owner writes them again;
+// Parquet output is at-least-once.
+func (pw *ParquetShardWriter) Close() error {
+	pw.sink.mu.Lock()
+	if pw.sink.shards[pw.shardID] == pw {
+		delete(pw.sink.shards, pw.shardID)
+	}
+	pw.sink.mu.Unlock()
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.finish()
+}
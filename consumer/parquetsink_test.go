@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// parquetRow is a row of a Parquet sink file as read back
+type parquetRow struct {
+	ShardID        string    `parquet:"shard_id"`
+	SequenceNumber string    `parquet:"sequence_number"`
+	PartitionKey   string    `parquet:"partition_key"`
+	EventID        string    `parquet:"event_id"`
+	UserID         string    `parquet:"user_id"`
+	Timestamp      time.Time `parquet:"timestamp,timestamp(millisecond)"`
+	Action         string    `parquet:"action"`
+	Value          float64   `parquet:"value"`
+	Metadata       string    `parquet:"metadata"`
+	Region         *string   `parquet:"metadata_region,optional"`
+	Attempts       *string   `parquet:"metadata_attempts,optional"`
+}
+
+func TestParquetSink(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{}
+	cfg.Kinesis.StreamName = testStream
+	cfg.Consumer.Sink.Path = dir
+	cfg.Consumer.Sink.Parquet.RotateIntervalMs = int(time.Hour / time.Millisecond)
+	cfg.Consumer.Sink.Parquet.MetadataColumns = []string{"region", "attempts"}
+	sink, err := NewParquetSink(cfg)
+	if err != nil {
+		t.Fatalf("NewParquetSink() = %v", err)
+	}
+
+	timestamp := time.Date(2024, 1, 2, 3, 4, 5, 6e6, time.UTC)
+	records := []*SinkRecord{
+		{ShardID: testShard, SequenceNumber: "1", PartitionKey: "user_1", Event: Event{
+			EventID: "evt_1", UserID: "user_1", Timestamp: timestamp, Action: "view", Value: 1.5,
+			Metadata: map[string]interface{}{"region": "eu-west-1", "attempts": 2.0},
+		}},
+		{ShardID: testShard, SequenceNumber: "2", PartitionKey: "user_2", Event: Event{
+			EventID: "evt_2", UserID: "user_2", Timestamp: timestamp, Action: "click", Value: 2,
+		}},
+	}
+	writer := sink.ShardWriter(testShard).(*ParquetShardWriter)
+	for _, record := range records {
+		if err := writer.Write(record); err != nil {
+			t.Fatalf("Write() = %v", err)
+		}
+	}
+
+	// Nothing may be checkpointed while the file is still being written
+	if delivered := writer.Delivered(); delivered != "" {
+		t.Errorf("Delivered() = %q before the file was complete, want none", delivered)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.parquet")); len(matches) != 0 {
+		t.Errorf("found complete files %v before the file was closed", matches)
+	}
+	if !writer.WaitDrained(time.Second) {
+		t.Fatal("WaitDrained() failed")
+	}
+	if delivered := writer.Delivered(); delivered != "2" {
+		t.Errorf("Delivered() = %q once the file was complete, want 2", delivered)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(matches) != 1 || !strings.HasPrefix(filepath.Base(matches[0]), testStream+"_"+testShard+"_") || !strings.HasSuffix(matches[0], ".parquet") {
+		t.Fatalf("wrote %v, want one complete file for the shard", matches)
+	}
+	rows, err := parquet.ReadFile[parquetRow](matches[0])
+	if err != nil {
+		t.Fatalf("reading %s: %v", matches[0], err)
+	}
+
+	region := "eu-west-1"
+	attempts := "2"
+	want := []parquetRow{
+		{ShardID: testShard, SequenceNumber: "1", PartitionKey: "user_1", EventID: "evt_1", UserID: "user_1", Timestamp: timestamp,
+			Action: "view", Value: 1.5, Metadata: `{"attempts":2,"region":"eu-west-1"}`, Region: &region, Attempts: &attempts},
+		{ShardID: testShard, SequenceNumber: "2", PartitionKey: "user_2", EventID: "evt_2", UserID: "user_2", Timestamp: timestamp,
+			Action: "click", Value: 2, Metadata: "null"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("read %d rows, want %d", len(rows), len(want))
+	}
+	for i := range want {
+		if got, w := formatParquetRow(rows[i]), formatParquetRow(want[i]); got != w {
+			t.Errorf("row %d = %s, want %s", i, got, w)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Close() left %d files, want the one already complete", len(entries))
+	}
+}
+
+// formatParquetRow prints a row with its optional columns dereferenced
+func formatParquetRow(row parquetRow) string {
+	optional := func(s *string) string {
+		if s == nil {
+			return "<null>"
+		}
+		return *s
+	}
+	return fmt.Sprintf("%s %s %s %s %s %s %s %v %s region=%s attempts=%s",
+		row.ShardID, row.SequenceNumber, row.PartitionKey, row.EventID, row.UserID, row.Timestamp.UTC().Format(time.RFC3339Nano),
+		row.Action, row.Value, row.Metadata, optional(row.Region), optional(row.Attempts))
+}
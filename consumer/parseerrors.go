@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// consumer.parse_error_action values
+const (
+	ParseErrorActionLog   = "log"
+	ParseErrorActionPause = "pause"
+	ParseErrorActionExit  = "exit"
+)
+
+// Defaults for the parse error monitor
+const (
+	DefaultParseErrorWindow  = 100
+	DefaultParseErrorPauseMs = 30000
+)
+
+// parseErrorWindow is a sliding window over the outcome of a shard's most recent decodes
+type parseErrorWindow struct {
+	outcomes []bool // true for a failed decode, used as a ring buffer
+	next     int
+	filled   bool
+	failures int
+	tripped  bool
+}
+
+// add records one decode outcome and returns the failure rate over the
+// window, or -1 until the window has filled
+func (w *parseErrorWindow) add(failed bool) float64 {
+	if w.outcomes[w.next] {
+		w.failures--
+	}
+	w.outcomes[w.next] = failed
+	if failed {
+		w.failures++
+	}
+	w.next = (w.next + 1) % len(w.outcomes)
+	if w.next == 0 {
+		w.filled = true
+	}
+	if !w.filled {
+		return -1
+	}
+	return float64(w.failures) / float64(len(w.outcomes))
+}
+
+// ParseErrorMonitor tracks the fraction of records failing to decode per
+// shard over a sliding window. Crossing consumer.max_parse_error_rate
+// usually means the consumer is pointed at a stream with a different
+// format, so the configured action fires instead of flooding the logs.
+type ParseErrorMonitor struct {
+	maxRate float64
+	size    int
+	action  string
+	pause   time.Duration
+
+	mu      sync.Mutex
+	windows map[string]*parseErrorWindow
+}
+
+// NewParseErrorMonitor returns a monitor for the config, or nil when max_parse_error_rate is unset
+func NewParseErrorMonitor(cfg *Config) (*ParseErrorMonitor, error) {
+	c := cfg.Consumer
+	if c.MaxParseErrorRate <= 0 {
+		return nil, nil
+	}
+	if c.MaxParseErrorRate > 1 {
+		return nil, fmt.Errorf("invalid max_parse_error_rate: %g. Must be between 0 and 1", c.MaxParseErrorRate)
+	}
+	switch c.ParseErrorAction {
+	case ParseErrorActionLog, ParseErrorActionPause, ParseErrorActionExit:
+	default:
+		return nil, fmt.Errorf("invalid parse_error_action: %s. Must be '%s', '%s' or '%s'",
+			c.ParseErrorAction, ParseErrorActionLog, ParseErrorActionPause, ParseErrorActionExit)
+	}
+
+	return &ParseErrorMonitor{
+		maxRate: c.MaxParseErrorRate,
+		size:    c.ParseErrorWindow,
+		action:  c.ParseErrorAction,
+		pause:   time.Duration(c.ParseErrorPauseMs) * time.Millisecond,
+		windows: make(map[string]*parseErrorWindow),
+	}, nil
+}
+
+// Observe records a decode outcome for a shard. It returns an error
+// describing the breach when the failure rate first goes over the limit,
+// and nil otherwise; the monitor re-arms once the rate drops back.
+func (m *ParseErrorMonitor) Observe(shardID string, failed bool) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, ok := m.windows[shardID]
+	if !ok {
+		w = &parseErrorWindow{outcomes: make([]bool, m.size)}
+		m.windows[shardID] = w
+	}
+
+	rate := w.add(failed)
+	if rate < 0 {
+		return nil
+	}
+	if rate <= m.maxRate {
+		w.tripped = false
+		return nil
+	}
+	if w.tripped {
+		return nil
+	}
+	w.tripped = true
+	return fmt.Errorf("%.0f%% of the last %d records failed to decode (limit %.0f%%), the stream likely has the wrong format",
+		rate*100, m.size, m.maxRate*100)
+}
+
+// DecodeEvent decodes a record into an Event, feeding the outcome to the
+// parse error monitor and applying its action when the error rate is
+// breached. The future timestamp policy is applied to the decoded event, so
+// a dropped event is returned with ErrFutureTimestamp. A record failing
+// consumer.hmac_secret verification is returned with ErrInvalidSignature,
+// and an event of an unknown schema version with ErrUnknownVersion. A
+// record compressed by producer.compress is decompressed first; one that
+// fails to decompress or unmarshal is written to consumer.dlq_file, if set.
+// The record counts as processed for the offset map whether or not it decodes.
+func (pc *ProcessorContext) DecodeEvent(shardID string, record *kinesis.Record) (Event, error) {
+	pc.Offsets.Processed(shardID, aws.StringValue(record.SequenceNumber))
+
+	var event Event
+	payload, err := pc.Signatures.Verify(record.Data)
+	if err != nil {
+		log.Printf("[%s] Skipping record %s: %v", pc.logLabel(shardID), aws.StringValue(record.SequenceNumber), err)
+		pc.Metrics.InvalidSignature(shardID)
+		pc.Signatures.DeadLetter(shardID, record, err)
+		return event, err
+	}
+	payload, err = decompressPayload(payload)
+	if err == nil {
+		err = pc.Versions.Decode(pc.Fields, payload, &event)
+	}
+	if errors.Is(err, ErrUnknownVersion) {
+		log.Printf("[%s] Skipping record %s: %v", pc.logLabel(shardID), aws.StringValue(record.SequenceNumber), err)
+		pc.Metrics.UnknownVersion(shardID)
+		pc.Versions.DeadLetter(shardID, record, err)
+		return event, err
+	}
+
+	if breach := pc.ParseErrors.Observe(shardID, err != nil); breach != nil {
+		log.Printf("[%s] ALERT: %v", pc.logLabel(shardID), breach)
+		switch pc.ParseErrors.action {
+		case ParseErrorActionPause:
+			log.Printf("[%s] Pausing shard for %v", pc.logLabel(shardID), pc.ParseErrors.pause)
+			time.Sleep(pc.ParseErrors.pause)
+		case ParseErrorActionExit:
+			pc.Abort(fmt.Errorf("shard %s: %w", shardID, breach))
+		}
+	}
+	if err != nil {
+		pc.Metrics.UnmarshalError(shardID)
+		if pc.DeadLetters != nil {
+			deadLetterRecord(pc.DeadLetters, shardID, record, err)
+		}
+		return event, err
+	}
+	return event, pc.FutureTimestamps.Apply(shardID, &event, time.Now())
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestParseErrorAction(t *testing.T) {
+	const pause = 50 * time.Millisecond
+	tests := []struct {
+		action     string
+		wantAborts int
+		wantPause  bool
+	}{
+		{action: ParseErrorActionLog},
+		{action: ParseErrorActionPause, wantPause: true},
+		{action: ParseErrorActionExit, wantAborts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.MaxParseErrorRate = 0.5
+			cfg.Consumer.ParseErrorWindow = 10
+			cfg.Consumer.ParseErrorAction = tt.action
+			cfg.Consumer.ParseErrorPauseMs = int(pause / time.Millisecond)
+			monitor, err := NewParseErrorMonitor(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var aborts []error
+			pc := &ProcessorContext{Config: cfg, Metrics: NewMetrics(), ParseErrors: monitor, Abort: func(err error) { aborts = append(aborts, err) }}
+
+			// feed decodes n records on a shard, every validEvery-th one
+			// valid and the rest garbage
+			sequence := 0
+			feed := func(shardID string, n, validEvery int) {
+				for i := range n {
+					sequence++
+					data := []byte("not json")
+					if i%validEvery == 0 {
+						data = []byte(fmt.Sprintf(`{"version":1,"event_id":"evt_%d","action":"view"}`, sequence))
+					}
+					pc.DecodeEvent(shardID, &kinesis.Record{SequenceNumber: aws.String(fmt.Sprint(sequence)), Data: data})
+				}
+			}
+
+			start := time.Now()
+			// A mostly valid shard stays under the limit
+			feed("shardId-000000000001", 20, 2)
+			if elapsed := time.Since(start); elapsed >= pause || len(aborts) > 0 {
+				t.Fatalf("a shard under the limit paused %v and aborted %d times", elapsed, len(aborts))
+			}
+			// Mostly garbage breaches it once, however long the garbage goes on
+			start = time.Now()
+			feed(testShard, 30, 5)
+			elapsed := time.Since(start)
+
+			if len(aborts) != tt.wantAborts {
+				t.Errorf("aborted %d times, want %d", len(aborts), tt.wantAborts)
+			}
+			for _, err := range aborts {
+				if !strings.Contains(err.Error(), "wrong format") || !strings.Contains(err.Error(), testShard) {
+					t.Errorf("aborted with %v", err)
+				}
+			}
+			if paused := elapsed >= pause; paused != tt.wantPause || elapsed >= 2*pause {
+				t.Errorf("decoding the garbage took %v, want a single pause %t", elapsed, tt.wantPause)
+			}
+			if got := pc.Metrics.Snapshot()[ShardKey{ShardID: testShard}].UnmarshalErrors; got != 24 {
+				t.Errorf("counted %d unmarshal errors, want 24", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// fetchedBatch is one GetRecords result waiting to be handled
+type fetchedBatch struct {
+	records            []*kinesis.Record
+	millisBehindLatest int64
+}
+
+// batchSource returns the next batch for the processing loop, or false once
+// the shard is closed, the stream is gone or the context is cancelled
+type batchSource func(ctx context.Context) (*fetchedBatch, bool)
+
+// nextBatch issues the next GetRecords call, waiting until nextFetch between
+// calls and retrying failures. It owns the shard iterator, so only one
+// goroutine may call it.
+func (msp *ManualShardProcessor) nextBatch(ctx context.Context) (*fetchedBatch, bool) {
+	for {
+		if !msp.lastFetch.IsZero() {
+			select {
+			case <-time.After(time.Until(msp.nextFetch())):
+			case <-ctx.Done():
+				return nil, false
+			}
+		}
+		if msp.pc.SinkHealth.Wait(ctx) != nil || ctx.Err() != nil {
+			return nil, false
+		}
+		batch, ok := msp.fetchBatch(ctx)
+		if !ok || batch != nil {
+			return batch, ok
+		}
+	}
+}
+
+// nextFetch returns when the next GetRecords call is due: pollDelay after
+// the last one, or later if the shard's read budget requires it
+func (msp *ManualShardProcessor) nextFetch() time.Time {
+	if msp.lastFetch.IsZero() {
+		return time.Time{}
+	}
+	next := msp.lastFetch.Add(msp.pollDelay())
+	if due := msp.budget.nextCall(msp.lastFetch); due.After(next) {
+		return due
+	}
+	return next
+}
+
+// fetchBatch makes one GetRecords call without waiting for it to be due. It
+// returns a nil batch and true when the call failed and should be retried
+// at nextFetch, and false once the shard is closed or the stream is gone.
+func (msp *ManualShardProcessor) fetchBatch(ctx context.Context) (*fetchedBatch, bool) {
+	if _, ok := msp.rewind.take(); ok {
+		if shardIterator, err := msp.getShardIterator(); err != nil {
+			log.Printf("[%s] Rewind failed to get shard iterator: %v", msp.label, err)
+		} else {
+			log.Printf("[%s] Rewound to the shard's start position", msp.label)
+			msp.shardIterator = shardIterator
+			msp.lastFetched = ""
+		}
+	}
+	if msp.shardIterator == nil {
+		msp.shardClosed = true
+		return nil, false
+	}
+
+	msp.lastFetch = time.Now()
+	output, err := msp.kinesisClient.GetRecordsWithContext(ctx, &kinesis.GetRecordsInput{
+		ShardIterator: msp.shardIterator,
+		Limit:         aws.Int64(msp.maxRecords),
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			// Cancelled mid-call; the iterator is kept for whoever reads on
+			return nil, true
+		}
+		if isStreamNotFound(err) {
+			if msp.shardIterator = msp.handleStreamDeleted(ctx); msp.shardIterator == nil {
+				return nil, false
+			}
+			msp.lastFetched = ""
+			msp.lastFetch = time.Time{}
+			return nil, true
+		}
+		if isExpiredIterator(err) {
+			if msp.renewIterator() {
+				msp.lastFetch = time.Time{}
+			}
+			return nil, true
+		}
+		log.Printf("[%s] Failed to get records: %v", msp.label, err)
+		return nil, true
+	}
+
+	msp.shardIterator = output.NextShardIterator
+	if len(output.Records) > 0 {
+		msp.lastFetched = aws.StringValue(output.Records[len(output.Records)-1].SequenceNumber)
+	}
+	msp.adaptivePoll.observe(len(output.Records), msp.maxRecords, aws.Int64Value(output.MillisBehindLatest))
+	if wait := msp.budget.read(output.Records); wait > msp.pollDelay() {
+		log.Printf("[%s] Read %d bytes, backing off %v to stay within consumer.read_budget.bytes_per_sec",
+			msp.label, batchBytes(output.Records), wait.Round(time.Millisecond))
+	}
+	return &fetchedBatch{
+		records:            deaggregate(msp.label, output.Records),
+		millisBehindLatest: aws.Int64Value(output.MillisBehindLatest),
+	}, true
+}
+
+// prefetch fetches ahead of the processing loop in a background goroutine,
+// holding up to depth fetched batches that have not been handled yet.
+// Batches are handed over through a FIFO channel, so they are handled in
+// the order they were fetched. On shutdown the batches still held are
+// handled when consumer.shutdown_drain_prefetch is set, and otherwise
+// discarded, to be read again on restart.
+func (msp *ManualShardProcessor) prefetch(ctx context.Context, depth int) batchSource {
+	batches := make(chan *fetchedBatch, depth)
+	// A batch fetched when shutdown found the channel full. The iterator
+	// has moved past it, so it is handed over last rather than lost; it is
+	// set before the channel is closed.
+	var leftover *fetchedBatch
+	go func() {
+		defer close(batches)
+		for {
+			batch, ok := msp.nextBatch(ctx)
+			if !ok {
+				return
+			}
+			select {
+			case batches <- batch:
+			case <-ctx.Done():
+				leftover = batch
+				return
+			}
+		}
+	}()
+
+	draining := false
+	return func(ctx context.Context) (*fetchedBatch, bool) {
+		batch, ok := <-batches
+		if !ok && leftover != nil {
+			batch, ok, leftover = leftover, true, nil
+		}
+		if !ok || ctx.Err() == nil {
+			return batch, ok
+		}
+
+		// Shutting down: the fetching goroutine stops and closes the channel
+		if msp.drainPrefetch {
+			if !draining {
+				log.Printf("[%s] Shutting down, handling %d prefetched batches first", msp.label, len(batches)+1)
+				draining = true
+			}
+			return batch, true
+		}
+		discarded, records := 0, 0
+		for ; ok; batch, ok = <-batches {
+			discarded++
+			records += len(batch.records)
+		}
+		if leftover != nil {
+			discarded++
+			records += len(leftover.records)
+		}
+		log.Printf("[%s] Shutting down, discarding %d prefetched batches (%d records) to be read again on restart",
+			msp.label, discarded, records)
+		return nil, false
+	}
+}
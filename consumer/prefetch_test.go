@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// readAll reads batches from source until it reports the end, returning
+// the sequence numbers in the order they came
+func readAll(t *testing.T, ctx context.Context, source batchSource) []string {
+	t.Helper()
+	var read []string
+	for {
+		batch, ok := source(ctx)
+		if !ok {
+			return read
+		}
+		if batch == nil {
+			t.Fatal("source returned a nil batch")
+		}
+		for _, record := range batch.records {
+			read = append(read, aws.StringValue(record.SequenceNumber))
+		}
+	}
+}
+
+func TestPrefetchOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		depth      int
+		records    int
+		maxRecords int64
+	}{
+		{name: "one batch ahead", depth: 1, records: 7, maxRecords: 2},
+		{name: "several batches ahead", depth: 3, records: 7, maxRecords: 2},
+		{name: "deeper than the shard", depth: 10, records: 3, maxRecords: 1},
+		{name: "empty shard", depth: 2, maxRecords: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeKinesis(testStream, testShard)
+			seq := fake.AddRecords(t, testShard, "user_1", testEvents(0, tt.records)...)
+			fake.CloseShard(testShard)
+			msp := newTestProcessor(fake, &Config{})
+			msp.maxRecords = tt.maxRecords
+			iterator, err := msp.getShardIterator()
+			if err != nil {
+				t.Fatalf("getShardIterator: %v", err)
+			}
+			msp.shardIterator = iterator
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			read := readAll(t, ctx, msp.prefetch(ctx, tt.depth))
+			if ctx.Err() != nil {
+				t.Fatal("prefetch did not end at the closed shard")
+			}
+			if len(read) != len(seq) {
+				t.Fatalf("read %d records, want %d", len(read), len(seq))
+			}
+			for i := range seq {
+				if read[i] != seq[i] {
+					t.Errorf("record %d is %s, want %s", i, read[i], seq[i])
+				}
+			}
+			if !msp.shardClosed {
+				t.Error("shard not marked closed")
+			}
+		})
+	}
+}
+
+func TestPrefetchShutdown(t *testing.T) {
+	tests := []struct {
+		name          string
+		drainPrefetch bool
+	}{
+		{name: "discards held batches"},
+		{name: "hands held batches over in order", drainPrefetch: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeKinesis(testStream, testShard)
+			seq := fake.AddRecords(t, testShard, "user_1", testEvents(0, 10)...)
+			msp := newTestProcessor(fake, &Config{})
+			msp.maxRecords = 1
+			msp.drainPrefetch = tt.drainPrefetch
+			iterator, err := msp.getShardIterator()
+			if err != nil {
+				t.Fatalf("getShardIterator: %v", err)
+			}
+			msp.shardIterator = iterator
+
+			ctx, cancel := context.WithCancel(context.Background())
+			source := msp.prefetch(ctx, 3)
+			first, ok := source(ctx)
+			if !ok || aws.StringValue(first.records[0].SequenceNumber) != seq[0] {
+				t.Fatalf("first batch %v, %t; want %s", first, ok, seq[0])
+			}
+			// Let the prefetcher fill up before shutting down
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+
+			read := readAll(t, ctx, source)
+			if !tt.drainPrefetch {
+				if len(read) != 0 {
+					t.Errorf("handed over %v after shutdown, want nothing", read)
+				}
+				return
+			}
+			if len(read) == 0 {
+				t.Fatal("handed nothing over after shutdown, want the held batches")
+			}
+			for i := range read {
+				if read[i] != seq[i+1] {
+					t.Errorf("record %d after shutdown is %s, want %s", i, read[i], seq[i+1])
+				}
+			}
+		})
+	}
+}
+
+// shutdownSink cancels the consumer while it writes the first record,
+// holding it long enough for the prefetcher to fill up
+type shutdownSink struct {
+	collectingSink
+	cancel context.CancelFunc
+}
+
+func (s *shutdownSink) Write(record *SinkRecord) error {
+	if len(s.records()) == 0 {
+		time.Sleep(50 * time.Millisecond)
+		s.cancel()
+	}
+	return s.collectingSink.Write(record)
+}
+
+func TestPrefetchShutdownCheckpoint(t *testing.T) {
+	tests := []struct {
+		name          string
+		drainPrefetch bool
+	}{
+		{name: "discarded batches left uncheckpointed"},
+		{name: "drained batches checkpointed", drainPrefetch: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeKinesis(testStream, testShard)
+			seq := fake.AddRecords(t, testShard, "user_1", testEvents(0, 10)...)
+			cfg := &Config{}
+			msp := newTestProcessor(fake, cfg)
+			msp.maxRecords = 1
+			msp.prefetchBatches = 3
+			msp.drainPrefetch = tt.drainPrefetch
+			msp.shutdownTimeout = time.Second
+			checkpoints := testCheckpoints(testStream, nil)
+			checkpoints.store.path = filepath.Join(t.TempDir(), "checkpoints.json")
+			msp.pc.Checkpoints = checkpoints
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			sink := &shutdownSink{cancel: cancel}
+			msp.pc.Sink = sink
+			var wg sync.WaitGroup
+			wg.Add(1)
+			msp.ProcessShard(ctx, &wg)
+
+			handled := sink.records()
+			for i := range handled {
+				if handled[i] != seq[i] {
+					t.Fatalf("handled %v, want a prefix of %v", handled, seq)
+				}
+			}
+			if tt.drainPrefetch && len(handled) < 2 {
+				t.Errorf("handled %v, want the prefetched batches handled too", handled)
+			}
+			if !tt.drainPrefetch && len(handled) != 1 {
+				t.Errorf("handled %v, want only the batch being handled at shutdown", handled)
+			}
+			// Everything handled is checkpointed and nothing more, so the
+			// discarded records are read again on restart
+			want := handled[len(handled)-1]
+			if got := checkpoints.store.shards[ShardKey{Stream: testStream, ShardID: testShard}]; got != want {
+				t.Errorf("checkpointed at %s, want %s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+const (
+	defaultPreloadTimeout       = 60 * time.Second
+	defaultPreloadRetryInterval = 2 * time.Second
+)
+
+// runPreload runs the consumer.preload hook before any shard is processed,
+// retrying until it succeeds or the timeout fires. It is a no-op when
+// neither a command nor a URL is configured.
+func runPreload(cfg *Config) error {
+	preload := cfg.Consumer.Preload
+	if preload.Command == "" && preload.URL == "" {
+		return nil
+	}
+
+	timeout := time.Duration(preload.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultPreloadTimeout
+	}
+	retryInterval := time.Duration(preload.RetryIntervalMs) * time.Millisecond
+	if retryInterval <= 0 {
+		retryInterval = defaultPreloadRetryInterval
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	log.Printf("Running preload (timeout %v)...", timeout)
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := preloadOnce(ctx, preload.Command, preload.URL)
+		if err == nil {
+			log.Printf("Preload completed in %.2f seconds", time.Since(start).Seconds())
+			return nil
+		}
+		log.Printf("Preload attempt %d failed: %v", attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("preload did not succeed within %v: %w", timeout, err)
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// preloadOnce runs the command and fetches the URL; both must succeed
+func preloadOnce(ctx context.Context, command, url string) error {
+	if command != "" {
+		output, err := exec.CommandContext(ctx, "sh", "-c", command).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("command failed: %w: %s", err, bytes.TrimSpace(output))
+		}
+	}
+
+	if url != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("fetch failed: %w", err)
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("fetch returned %s", resp.Status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunPreload(t *testing.T) {
+	const ready = 50 * time.Millisecond // when the dependency becomes ready
+	tests := []struct {
+		name        string
+		command     string // runs with $READY, the file created once the dependency is ready
+		url         bool   // fetch a server answering 503 until the dependency is ready
+		timeout     time.Duration
+		wantErr     bool
+		wantWaiting bool // runPreload returned no sooner than the dependency was ready
+	}{
+		{name: "nothing configured"},
+		{name: "command waits until ready", command: `test -f "$READY"`, timeout: time.Second, wantWaiting: true},
+		{name: "fetch waits until ready", url: true, timeout: time.Second, wantWaiting: true},
+		{name: "command and fetch", command: `test -f "$READY"`, url: true, timeout: time.Second, wantWaiting: true},
+		{name: "never ready", command: "exit 1", timeout: 3 * ready, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			marker := filepath.Join(t.TempDir(), "ready")
+			t.Setenv("READY", marker)
+			var isReady atomic.Bool
+			timer := time.AfterFunc(ready, func() {
+				os.WriteFile(marker, nil, 0o644)
+				isReady.Store(true)
+			})
+			defer timer.Stop()
+
+			cfg := &Config{}
+			cfg.Consumer.Preload.Command = tt.command
+			cfg.Consumer.Preload.TimeoutMs = int(tt.timeout / time.Millisecond)
+			cfg.Consumer.Preload.RetryIntervalMs = 5
+			if tt.url {
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if !isReady.Load() {
+						w.WriteHeader(http.StatusServiceUnavailable)
+					}
+				}))
+				defer server.Close()
+				cfg.Consumer.Preload.URL = server.URL
+			}
+
+			err := runPreload(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("runPreload() = %v, want error %t", err, tt.wantErr)
+			}
+			if waited := isReady.Load(); waited != tt.wantWaiting && !tt.wantErr {
+				t.Errorf("runPreload() returned with the dependency ready %t, want %t", waited, tt.wantWaiting)
+			}
+		})
+	}
+}
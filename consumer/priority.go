@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxGetRecordsLimit is the largest Limit GetRecords accepts
+const maxGetRecordsLimit = 10000
+
+// validateShardPriorities rejects non-positive weights in consumer.shard_priorities
+func validateShardPriorities(cfg *Config) error {
+	for shardID, weight := range cfg.Consumer.ShardPriorities {
+		if weight <= 0 {
+			return fmt.Errorf("invalid priority %v for shard %s: must be greater than 0", weight, shardID)
+		}
+	}
+	return nil
+}
+
+// shardPriority returns the configured weight for a shard, defaulting to 1
+func shardPriority(cfg *Config, shardID string) float64 {
+	if weight, ok := cfg.Consumer.ShardPriorities[shardID]; ok {
+		return weight
+	}
+	return 1
+}
+
+// topPriority returns the highest weight in consumer.shard_priorities, or 1
+// if no shard is weighted above the default
+func topPriority(cfg *Config) float64 {
+	top := 1.0
+	for _, weight := range cfg.Consumer.ShardPriorities {
+		top = max(top, weight)
+	}
+	return top
+}
+
+// prioritizedPolling scales the base poll interval by a shard's priority
+// weight and its batch size by the weight relative to the top priority: a
+// weight of 2 polls twice as often as the default, and fetches twice as many
+// records per call. max_records is the batch size of the top priority, as it
+// usually is the GetRecords limit already, and lower priorities fetch
+// proportionally fewer.
+func prioritizedPolling(pollInterval time.Duration, maxRecords int, weight, top float64) (time.Duration, int64) {
+	interval := time.Duration(float64(pollInterval) / weight)
+
+	limit := int64(float64(maxRecords) * weight / top)
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > maxGetRecordsLimit {
+		limit = maxGetRecordsLimit
+	}
+	return interval, limit
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// pollCountingKinesis counts the GetRecords calls made for each shard
+type pollCountingKinesis struct {
+	*fakeKinesis
+	mu    sync.Mutex
+	polls map[string]int
+}
+
+func (p *pollCountingKinesis) GetRecordsWithContext(ctx aws.Context, input *kinesis.GetRecordsInput, opts ...request.Option) (*kinesis.GetRecordsOutput, error) {
+	if shardID, _, _, err := parseFakeIterator(aws.StringValue(input.ShardIterator)); err == nil {
+		p.mu.Lock()
+		p.polls[shardID]++
+		p.mu.Unlock()
+	}
+	return p.fakeKinesis.GetRecordsWithContext(ctx, input, opts...)
+}
+
+func TestPrioritizedPolling(t *testing.T) {
+	tests := []struct {
+		name         string
+		weight       float64
+		top          float64
+		wantInterval time.Duration
+		wantLimit    int64
+	}{
+		{name: "default priority", weight: 1, top: 1, wantInterval: 100 * time.Millisecond, wantLimit: 10000},
+		{name: "top priority", weight: 2, top: 2, wantInterval: 50 * time.Millisecond, wantLimit: 10000},
+		{name: "default beside a higher priority", weight: 1, top: 2, wantInterval: 100 * time.Millisecond, wantLimit: 5000},
+		{name: "lower priority", weight: 0.5, top: 1, wantInterval: 200 * time.Millisecond, wantLimit: 5000},
+		{name: "at least one record", weight: 0.00001, top: 1, wantInterval: 10000 * time.Second, wantLimit: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interval, limit := prioritizedPolling(100*time.Millisecond, DefaultMaxRecords, tt.weight, tt.top)
+			if interval != tt.wantInterval || limit != tt.wantLimit {
+				t.Errorf("prioritizedPolling() = %v, %d; want %v, %d", interval, limit, tt.wantInterval, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestShardPriorityPollCycles(t *testing.T) {
+	const high, low = "shardId-000000000000", "shardId-000000000001"
+	client := &pollCountingKinesis{fakeKinesis: newFakeKinesis(testStream, high, low), polls: make(map[string]int)}
+	cfg := &Config{}
+	cfg.Consumer.ShardPriorities = map[string]float64{high: 2}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, shardID := range []string{high, low} {
+		msp := newTestProcessor(client, cfg)
+		msp.shardID, msp.label = shardID, shardID
+		msp.pollInterval, msp.maxRecords = prioritizedPolling(20*time.Millisecond, DefaultMaxRecords, shardPriority(cfg, shardID), topPriority(cfg))
+		iterator, err := msp.getShardIterator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msp.shardIterator = iterator
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if _, ok := msp.nextBatch(ctx); !ok {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	ratio := float64(client.polls[high]) / float64(client.polls[low])
+	if ratio < 1.5 || ratio > 2.5 {
+		t.Errorf("weight 2 shard polled %d times, default %d times; want about twice as often",
+			client.polls[high], client.polls[low])
+	}
+}
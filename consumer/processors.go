@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
+)
+
+// DefaultProcessor is the processor used when consumer.processor is not set
+const DefaultProcessor = "logging"
+
+// ProcessorContext carries the configuration and shared dependencies handed
+// to every processor constructor
+type ProcessorContext struct {
+	Config   *Config
+	Sink     Sink                // nil when no sink is configured
+	Hooks    *RebalanceHooks     // nil when no rebalance hooks are configured
+	Verifier *CheckpointVerifier // nil unless consumer.verify_checkpoints is set
+	Metrics  *Metrics            // shared across all shards in the process
+
+	// WindowState is nil unless consumer.window_state_table is set
+	WindowState *WindowStateStore
+
+	// ParseErrors is nil unless consumer.max_parse_error_rate is set
+	ParseErrors *ParseErrorMonitor
+
+	// Latency is nil unless consumer.inject_latency_ms is set
+	Latency *LatencyInjector
+
+	// Fields is nil unless consumer.field_mapping is set
+	Fields *FieldMapping
+
+	// KeyFilter is nil unless consumer.key_filter is set
+	KeyFilter *KeyFilter
+
+	// Signatures is nil unless consumer.hmac_secret is set
+	Signatures *SignatureVerifier
+
+	// Versions is nil unless consumer.unknown_version_action is current or dlq
+	Versions *EventVersions
+
+	// DeadLetters is nil unless consumer.dlq_file is set
+	DeadLetters DeadLetterSink
+
+	// SinkHealth is nil unless consumer.sink_health.probe_interval_ms is set
+	SinkHealth *SinkHealth
+
+	// LeaseKeeper renews the leases of KCL shards held by a sink pause. It is
+	// nil unless SinkHealth is set, and always in manual mode.
+	LeaseKeeper *LeaseKeeper
+
+	// Sampler is nil unless consumer.sampling_rate is set below 1
+	Sampler *Sampler
+
+	// FutureTimestamps applies consumer.future_timestamp_policy to decoded events
+	FutureTimestamps *FutureTimestampPolicy
+
+	// SinkErrors is nil unless consumer.sink.errors is set
+	SinkErrors *SinkErrorPolicy
+
+	// Idempotency is nil unless consumer.idempotency_table is set
+	Idempotency *IdempotencyStore
+
+	// Backfill is nil unless consumer.backfill.bucket is set; stream events
+	// it covers were already handled from S3 and are skipped
+	Backfill *Backfill
+
+	// LeaseLimiter is nil unless consumer.max_lease_acquire_per_sec is set.
+	// Manual mode waits on it before starting a shard; KCL mode only logs
+	// acquisitions over the rate.
+	LeaseLimiter *LeaseAcquireLimiter
+
+	// History is nil unless consumer.checkpoint_history.size is set
+	History *CheckpointHistory
+
+	// Audit is nil unless consumer.audit.path is set
+	Audit *AuditLog
+
+	// Offsets is nil unless consumer.offset_map_path is set
+	Offsets *OffsetMap
+
+	// Checkpoints is nil unless consumer.checkpoint_file is set, and always
+	// in KCL mode
+	Checkpoints *CheckpointFile
+
+	// Continuity is nil unless consumer.continuity_check is set, and always
+	// in manual mode
+	Continuity *Continuity
+
+	// Leases is nil unless consumer.shard_leases.table is set, and always in
+	// KCL mode
+	Leases *ShardLeases
+
+	// StreamHandler is nil unless SetStreamHandler was called. It is the
+	// same instance for every stream.
+	StreamHandler EventHandler
+
+	// Shards makes the running shard processors reachable from the control endpoints
+	Shards *ShardRegistry
+
+	// EndMarkers is nil unless consumer.stop_on_marker is set
+	EndMarkers *EndMarkers
+
+	// Kinesis is the client processors use for reads of their own, such as a rewind
+	Kinesis KinesisAPI
+
+	// Abort stops the whole consumer with an error, e.g. when a shard
+	// turns out to be unreadable. It must not block.
+	Abort func(err error)
+
+	// Stop shuts the consumer down gracefully, as on SIGTERM. It must not block.
+	Stop func()
+}
+
+// ShardSink returns the sink a single shard should write to. A ShardedSink,
+// such as the Parquet or gRPC sink, hands out the shard's own writer; otherwise, when
+// consumer.buffer_memory_bytes is set, the shared sink is wrapped in a
+// per-shard BufferedSink. Either is also returned as a ShardDelivery so the
+// caller can close it and checkpoint against its delivered position. Writes
+// go through the consumer.sink.errors policy, if any; a MultiSink applies it
+// to each of its sinks separately.
+func (pc *ProcessorContext) ShardSink(shardID string) (Sink, ShardDelivery, error) {
+	if multi, ok := pc.Sink.(*MultiSink); ok {
+		writer := multi.shardWriter(shardID, func(sink Sink) Sink { return pc.SinkErrors.Wrap(sink, pc.Abort, pc.Audit) })
+		return writer, writer, nil
+	}
+	if sharded, ok := pc.Sink.(ShardedSink); ok {
+		writer := sharded.ShardWriter(shardID)
+		return pc.SinkErrors.Wrap(writer, pc.Abort, pc.Audit), writer, nil
+	}
+	sink := pc.SinkErrors.Wrap(pc.Sink, pc.Abort, pc.Audit)
+	if sink == nil || pc.Config.Consumer.BufferMemoryBytes <= 0 {
+		return sink, nil, nil
+	}
+	buffered, err := NewBufferedSink(sink, pc.Config, pc.Metrics)
+	if err != nil {
+		return sink, nil, err
+	}
+	return buffered, buffered, nil
+}
+
+// ShardAssigned records that this worker started processing a shard and
+// fires the rebalance hooks
+func (pc *ProcessorContext) ShardAssigned(shardID string) {
+	pc.LeaseLimiter.Observe(pc.logLabel(shardID))
+	pc.Metrics.LeaseAcquired(shardID)
+	pc.Hooks.OnShardAssigned(shardID)
+}
+
+// ShardReleased records how long the shard was held, counting a lost lease
+// as a rebalance, and fires the rebalance hooks
+func (pc *ProcessorContext) ShardReleased(shardID string, reason string) {
+	pc.Metrics.LeaseReleased(shardID, reason)
+	pc.EndMarkers.Released(shardID)
+	pc.Hooks.OnShardReleased(shardID, reason)
+}
+
+// ProcessorConstructor builds a new record processor for a single shard
+type ProcessorConstructor func(pc *ProcessorContext) interfaces.IRecordProcessor
+
+var (
+	processorRegistryMu sync.RWMutex
+	processorRegistry   = make(map[string]ProcessorConstructor)
+)
+
+// RegisterProcessor makes a named processor available to consumer.processor.
+// Registering the same name twice replaces the earlier constructor.
+func RegisterProcessor(name string, constructor ProcessorConstructor) {
+	processorRegistryMu.Lock()
+	defer processorRegistryMu.Unlock()
+	processorRegistry[name] = constructor
+}
+
+// RegisteredProcessors returns the sorted names of all registered processors
+func RegisteredProcessors() []string {
+	processorRegistryMu.RLock()
+	defer processorRegistryMu.RUnlock()
+
+	names := make([]string, 0, len(processorRegistry))
+	for name := range processorRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewRecordProcessorFactory returns a factory for the processor selected in the config
+func NewRecordProcessorFactory(pc *ProcessorContext) (*RecordProcessorFactory, error) {
+	name := pc.Config.Consumer.Processor
+	if name == "" {
+		name = DefaultProcessor
+	}
+
+	processorRegistryMu.RLock()
+	constructor, ok := processorRegistry[name]
+	processorRegistryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown processor %q, registered processors: %v", name, RegisteredProcessors())
+	}
+
+	log.Printf("Using record processor: %s", name)
+	return &RecordProcessorFactory{pc: pc, constructor: constructor}, nil
+}
+
+func init() {
+	RegisterProcessor(DefaultProcessor, func(pc *ProcessorContext) interfaces.IRecordProcessor {
+		return &RecordProcessor{pc: pc}
+	})
+	RegisterProcessor("counting", func(pc *ProcessorContext) interfaces.IRecordProcessor {
+		return &CountingProcessor{pc: pc, reportInterval: 10 * time.Second}
+	})
+	RegisterProcessor(WindowedProcessorName, func(pc *ProcessorContext) interfaces.IRecordProcessor {
+		return &WindowedProcessor{pc: pc}
+	})
+}
+
+// CountingProcessor counts records without logging each one, reporting
+// throughput periodically. Useful when per-record logs would drown out KCL output.
+type CountingProcessor struct {
+	pc             *ProcessorContext
+	shardID        string
+	label          string // shardID as logged
+	recordCount    int
+	startTime      time.Time
+	lastReport     time.Time
+	reportInterval time.Duration
+}
+
+// Initialize is called once when the processor starts processing a shard
+func (cp *CountingProcessor) Initialize(input *interfaces.InitializationInput) {
+	cp.shardID = input.ShardId
+	cp.label = cp.pc.logLabel(cp.shardID)
+	cp.recordCount = 0
+	cp.startTime = time.Now()
+	cp.lastReport = cp.startTime
+	log.Printf("[%s] Initializing counting processor", cp.label)
+	cp.pc.ShardAssigned(cp.shardID)
+}
+
+// ProcessRecords counts the batch and checkpoints the last record
+func (cp *CountingProcessor) ProcessRecords(input *interfaces.ProcessRecordsInput) {
+	cp.recordCount += len(input.Records)
+	cp.pc.Metrics.RecordsProcessed(cp.shardID, len(input.Records))
+	cp.pc.Metrics.SetMillisBehindLatest(cp.shardID, input.MillisBehindLatest)
+
+	if time.Since(cp.lastReport) >= cp.reportInterval {
+		elapsed := time.Since(cp.startTime).Seconds()
+		log.Printf("[%s] Counted %d records (%.2f records/sec)", cp.label, cp.recordCount, float64(cp.recordCount)/elapsed)
+		cp.lastReport = time.Now()
+	}
+
+	if len(input.Records) > 0 {
+		lastRecord := input.Records[len(input.Records)-1]
+		cp.pc.Offsets.Processed(cp.shardID, aws.StringValue(lastRecord.SequenceNumber))
+		if err := cp.pc.Checkpoint(cp.shardID, input.Checkpointer, lastRecord.SequenceNumber); err != nil {
+			log.Printf("[%s] Failed to checkpoint: %v", cp.label, err)
+		}
+	}
+}
+
+// Shutdown is called when the processor is shutting down
+func (cp *CountingProcessor) Shutdown(input *interfaces.ShutdownInput) {
+	log.Printf("[%s] Shutting down. Reason: %v. Counted %d records",
+		cp.label, input.ShutdownReason, cp.recordCount)
+	cp.pc.ShardReleased(cp.shardID, aws.StringValue(interfaces.ShutdownReasonMessage(input.ShutdownReason)))
+
+	if input.ShutdownReason == interfaces.TERMINATE {
+		if err := cp.pc.Checkpoint(cp.shardID, input.Checkpointer, nil); err != nil {
+			log.Printf("[%s] Failed to checkpoint on shutdown: %v", cp.label, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
+)
+
+func TestNewRecordProcessorFactory(t *testing.T) {
+	tests := []struct {
+		name      string
+		processor string
+		want      string // type of the created processor, empty for an error
+	}{
+		{name: "default", processor: "", want: "*main.RecordProcessor"},
+		{name: "logging", processor: DefaultProcessor, want: "*main.RecordProcessor"},
+		{name: "counting", processor: "counting", want: "*main.CountingProcessor"},
+		{name: "windowed", processor: WindowedProcessorName, want: "*main.WindowedProcessor"},
+		{name: "unknown", processor: "nope"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.Processor = tt.processor
+			factory, err := NewRecordProcessorFactory(&ProcessorContext{Config: cfg})
+			if tt.want == "" {
+				if err == nil || !strings.Contains(err.Error(), strings.Join(RegisteredProcessors(), " ")) {
+					t.Errorf("NewRecordProcessorFactory() = %v, want an error listing the registered processors", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewRecordProcessorFactory() = %v", err)
+			}
+			if got := fmt.Sprintf("%T", factory.CreateProcessor()); got != tt.want {
+				t.Errorf("created a %s, want a %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// testProcessor is a processor registered by the tests
+type testProcessor struct {
+	interfaces.IRecordProcessor
+	version int
+}
+
+func TestRegisterProcessor(t *testing.T) {
+	const name = "test-registry"
+	for version := 1; version <= 2; version++ {
+		RegisterProcessor(name, func(pc *ProcessorContext) interfaces.IRecordProcessor {
+			return &testProcessor{version: version}
+		})
+	}
+	defer func() {
+		processorRegistryMu.Lock()
+		delete(processorRegistry, name)
+		processorRegistryMu.Unlock()
+	}()
+
+	names := RegisteredProcessors()
+	if !strings.Contains(fmt.Sprint(names), name) {
+		t.Errorf("registered processors %v don't include %s", names, name)
+	}
+	for i := 1; i < len(names); i++ {
+		if names[i-1] >= names[i] {
+			t.Errorf("registered processors %v are not sorted", names)
+		}
+	}
+
+	cfg := &Config{}
+	cfg.Consumer.Processor = name
+	factory, err := NewRecordProcessorFactory(&ProcessorContext{Config: cfg})
+	if err != nil {
+		t.Fatalf("NewRecordProcessorFactory() = %v", err)
+	}
+	if got := factory.CreateProcessor().(*testProcessor).version; got != 2 {
+		t.Errorf("created version %d, want the constructor registered last", got)
+	}
+}
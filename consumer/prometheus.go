@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	rebalanceTotalDesc = prometheus.NewDesc(
+		"consumer_rebalance_total",
+		"Leases lost to another worker (KCL ZOMBIE shutdowns).",
+		[]string{"stream", "worker_id"}, nil)
+	leaseHoldSecondsDesc = prometheus.NewDesc(
+		"consumer_lease_hold_seconds",
+		"How long each shard lease was held before it was released.",
+		[]string{"stream", "worker_id"}, nil)
+	checkpointWriteSecondsDesc = prometheus.NewDesc(
+		"consumer_checkpoint_write_seconds",
+		"How long each checkpoint write to the lease table took.",
+		[]string{"stream", "worker_id"}, nil)
+	recordLatencySecondsDesc = prometheus.NewDesc(
+		"consumer_record_latency_seconds",
+		"Time from each record's event timestamp until its handler finished, with the trace ID of its traceparent metadata as bucket exemplars.",
+		[]string{"stream", "worker_id"}, nil)
+)
+
+// shardCounter is a counter of ShardMetrics exported per shard, or per
+// group of shards under consumer.metrics_cardinality
+type shardCounter struct {
+	name  string
+	help  string
+	value func(sm ShardMetrics) int64
+}
+
+var shardCounters = []shardCounter{
+	{"consumer_records_processed_total",
+		"Records handed to the handler, in either assignment mode.",
+		func(sm ShardMetrics) int64 { return sm.RecordsProcessed }},
+	{"consumer_checkpoints_total",
+		"Successful checkpoint writes.",
+		func(sm ShardMetrics) int64 { return sm.Checkpoints }},
+	{"consumer_checkpoint_failures_total",
+		"Checkpoint writes that failed, after consumer.checkpoint_retry.",
+		func(sm ShardMetrics) int64 { return sm.CheckpointFailures }},
+	{"consumer_unmarshal_errors_total",
+		"Records skipped because their payload didn't decode into an event.",
+		func(sm ShardMetrics) int64 { return sm.UnmarshalErrors }},
+	{"consumer_reprocessed_on_rebalance_total",
+		"Records read again after resuming a shard from another owner's checkpoint, until the first record newer than the takeover.",
+		func(sm ShardMetrics) int64 { return sm.Reprocessed }},
+	{"consumer_future_timestamps_total",
+		"Events timestamped ahead of the consumer's clock by more than consumer.future_timestamp_skew_ms.",
+		func(sm ShardMetrics) int64 { return sm.FutureTimestamps }},
+	{"consumer_shed_total",
+		"Buffered records dropped unwritten because the shard's buffer was full (consumer.shed_when_full).",
+		func(sm ShardMetrics) int64 { return sm.Shed }},
+	{"consumer_idle_heartbeats_total",
+		"Times an idle shard ran consumer.empty_batch_action. Rising while records_processed stays flat means the shard is idle, not stuck.",
+		func(sm ShardMetrics) int64 { return sm.IdleHeartbeats }},
+	{"consumer_invalid_signatures_total",
+		"Records skipped because they were unsigned or their signature didn't match consumer.hmac_secret.",
+		func(sm ShardMetrics) int64 { return sm.InvalidSignatures }},
+	{"consumer_unknown_event_versions_total",
+		"Events skipped or dead-lettered because their schema version has no decoder.",
+		func(sm ShardMetrics) int64 { return sm.UnknownVersions }},
+}
+
+// consumer.metrics_cardinality values
+const (
+	MetricsCardinalityPerShard  = "per_shard"
+	MetricsCardinalityAggregate = "aggregate"
+	MetricsCardinalityTopN      = "top_n"
+)
+
+// DefaultMetricsTopN is the default of consumer.metrics_top_n
+const DefaultMetricsTopN = 10
+
+// metricsOtherShards is the shard label of the shards outside the top N
+const metricsOtherShards = "other"
+
+// validateMetricsCardinality checks consumer.metrics_cardinality
+func validateMetricsCardinality(cfg *Config) error {
+	switch cfg.Consumer.MetricsCardinality {
+	case MetricsCardinalityPerShard, MetricsCardinalityAggregate, MetricsCardinalityTopN:
+		return nil
+	default:
+		return fmt.Errorf("invalid metrics_cardinality: %s. Must be '%s', '%s' or '%s'", cfg.Consumer.MetricsCardinality,
+			MetricsCardinalityPerShard, MetricsCardinalityAggregate, MetricsCardinalityTopN)
+	}
+}
+
+// shardGroup is the labels one series of a shard counter is exported with
+type shardGroup struct {
+	stream string
+	shard  string // empty under the aggregate cardinality, which has no shard label
+}
+
+// shardGroups maps every shard of the snapshot to the series its counters
+// are added to: its own, its stream's under aggregate, or under top_n its own
+// when it is one of the topN shards of its stream that processed the most
+// records and "other" otherwise. A shard moving in or out of the top N moves
+// its count between series, so "other" can go down, which Prometheus reads
+// as a counter reset.
+func shardGroups(snapshot map[ShardKey]ShardMetrics, cardinality string, topN int) map[ShardKey]shardGroup {
+	groups := make(map[ShardKey]shardGroup, len(snapshot))
+	byStream := make(map[string][]ShardKey)
+	for key := range snapshot {
+		switch cardinality {
+		case MetricsCardinalityAggregate:
+			groups[key] = shardGroup{stream: key.Stream}
+		case MetricsCardinalityTopN:
+			groups[key] = shardGroup{stream: key.Stream, shard: metricsOtherShards}
+			byStream[key.Stream] = append(byStream[key.Stream], key)
+		default:
+			groups[key] = shardGroup{stream: key.Stream, shard: key.ShardID}
+		}
+	}
+	for _, keys := range byStream {
+		sort.Slice(keys, func(i, j int) bool {
+			a, b := snapshot[keys[i]].RecordsProcessed, snapshot[keys[j]].RecordsProcessed
+			if a != b {
+				return a > b
+			}
+			return keys[i].ShardID < keys[j].ShardID
+		})
+		for _, key := range keys[:min(topN, len(keys))] {
+			groups[key] = shardGroup{stream: key.Stream, shard: key.ShardID}
+		}
+	}
+	return groups
+}
+
+// metricsCollector exports the consumer's Metrics to Prometheus. It reads a
+// snapshot on every scrape, so the Metrics store stays the single source of
+// truth shared with the CloudWatch publisher.
+type metricsCollector struct {
+	metrics     *Metrics
+	workerID    string
+	cardinality string
+	topN        int
+	shardDescs  []*prometheus.Desc // per shardCounters entry
+	lagDesc     *prometheus.Desc
+}
+
+func newMetricsCollector(cfg *Config, metrics *Metrics) *metricsCollector {
+	labels := []string{"stream", "shard", "worker_id"}
+	if cfg.Consumer.MetricsCardinality == MetricsCardinalityAggregate {
+		labels = []string{"stream", "worker_id"}
+	}
+	c := &metricsCollector{
+		metrics:     metrics,
+		workerID:    cfg.Consumer.WorkerID,
+		cardinality: cfg.Consumer.MetricsCardinality,
+		topN:        cfg.Consumer.MetricsTopN,
+	}
+	for _, counter := range shardCounters {
+		c.shardDescs = append(c.shardDescs, prometheus.NewDesc(counter.name, counter.help, labels, nil))
+	}
+	c.lagDesc = prometheus.NewDesc("consumer_millis_behind_latest",
+		"How far behind the tip of the stream the last read of the shard was, the largest of the shards when summed.",
+		labels, nil)
+	return c
+}
+
+// Describe sends the descriptors of every exported metric
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rebalanceTotalDesc
+	ch <- leaseHoldSecondsDesc
+	ch <- checkpointWriteSecondsDesc
+	ch <- recordLatencySecondsDesc
+	for _, desc := range c.shardDescs {
+		ch <- desc
+	}
+	ch <- c.lagDesc
+}
+
+// Collect sends the current value of every exported metric
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	for stream, rm := range c.metrics.RebalanceSnapshot() {
+		ch <- prometheus.MustNewConstMetric(rebalanceTotalDesc, prometheus.CounterValue,
+			float64(rm.Rebalances), stream, c.workerID)
+
+		buckets := make(map[float64]uint64, len(rm.Buckets))
+		for i, bound := range rm.Buckets {
+			buckets[bound] = rm.BucketCounts[i]
+		}
+		ch <- prometheus.MustNewConstHistogram(leaseHoldSecondsDesc,
+			uint64(rm.LeaseHolds), rm.HoldSeconds, buckets, stream, c.workerID)
+	}
+	for stream, cw := range c.metrics.CheckpointWriteSnapshot() {
+		buckets := make(map[float64]uint64, len(cw.Buckets))
+		for i, bound := range cw.Buckets {
+			buckets[bound] = cw.BucketCounts[i]
+		}
+		ch <- prometheus.MustNewConstHistogram(checkpointWriteSecondsDesc,
+			uint64(cw.Writes), cw.Seconds, buckets, stream, c.workerID)
+	}
+	for stream, lm := range c.metrics.LatencySnapshot() {
+		buckets := make(map[float64]uint64, len(lm.Buckets))
+		for i, bound := range lm.Buckets {
+			buckets[bound] = lm.BucketCounts[i]
+		}
+		histogram := prometheus.MustNewConstHistogram(recordLatencySecondsDesc,
+			uint64(lm.Records), lm.Seconds, buckets, stream, c.workerID)
+		ch <- &histogramWithExemplars{Metric: histogram, exemplars: lm.Exemplars}
+	}
+
+	snapshot := c.metrics.Snapshot()
+	totals := make(map[shardGroup][]int64)
+	lags := make(map[shardGroup]int64) // only groups with a shard that has read
+	for key, group := range shardGroups(snapshot, c.cardinality, c.topN) {
+		sm := snapshot[key]
+		if totals[group] == nil {
+			totals[group] = make([]int64, len(shardCounters))
+		}
+		for i, counter := range shardCounters {
+			totals[group][i] += counter.value(sm)
+		}
+		if sm.HasLag {
+			lags[group] = max(lags[group], sm.MillisBehindLatest)
+		}
+	}
+	for group, values := range totals {
+		labels := c.groupLabels(group)
+		for i, value := range values {
+			ch <- prometheus.MustNewConstMetric(c.shardDescs[i], prometheus.CounterValue, float64(value), labels...)
+		}
+	}
+	for group, lag := range lags {
+		ch <- prometheus.MustNewConstMetric(c.lagDesc, prometheus.GaugeValue, float64(lag), c.groupLabels(group)...)
+	}
+}
+
+// groupLabels returns the label values of a shard series
+func (c *metricsCollector) groupLabels(group shardGroup) []string {
+	if c.cardinality == MetricsCardinalityAggregate {
+		return []string{group.stream, c.workerID}
+	}
+	return []string{group.stream, group.shard, c.workerID}
+}
+
+// newMetricsHandler serves the consumer's metrics in the Prometheus text
+// format, or OpenMetrics with exemplars to scrapers that ask for it
+func newMetricsHandler(cfg *Config, metrics *Metrics) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newMetricsCollector(cfg, metrics))
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+}
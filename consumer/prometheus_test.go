@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMetricsCardinality(t *testing.T) {
+	const (
+		orders = "orders"
+		clicks = "clicks"
+		shard0 = "shardId-000000000000"
+		shard1 = "shardId-000000000001"
+		shard2 = "shardId-000000000002"
+	)
+	series := func(stream, shard string, value int) string {
+		if shard == "" {
+			return fmt.Sprintf(`consumer_shed_total{stream=%q,worker_id="worker-1"} %d`, stream, value)
+		}
+		return fmt.Sprintf(`consumer_shed_total{shard=%q,stream=%q,worker_id="worker-1"} %d`, shard, stream, value)
+	}
+	tests := []struct {
+		cardinality string
+		topN        int
+		want        []string
+	}{
+		{
+			cardinality: MetricsCardinalityPerShard,
+			want: []string{
+				series(clicks, shard0, 4),
+				series(orders, shard0, 3),
+				series(orders, shard1, 2),
+				series(orders, shard2, 1),
+			},
+		},
+		{
+			cardinality: MetricsCardinalityAggregate,
+			want: []string{
+				series(clicks, "", 4),
+				series(orders, "", 6),
+			},
+		},
+		{
+			// The least busy shard of orders is counted as other; clicks has too
+			// few shards to need it
+			cardinality: MetricsCardinalityTopN,
+			topN:        2,
+			want: []string{
+				series(orders, metricsOtherShards, 1),
+				series(clicks, shard0, 4),
+				series(orders, shard0, 3),
+				series(orders, shard1, 2),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cardinality, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.WorkerID = "worker-1"
+			cfg.Consumer.MetricsCardinality = tt.cardinality
+			cfg.Consumer.MetricsTopN = tt.topN
+			metrics := NewMetrics()
+			// Busiest first: shard 0 processed the most records of orders
+			for i, shardID := range []string{shard0, shard1, shard2} {
+				metrics.ForStream(orders).RecordsProcessed(shardID, 30-10*i)
+				metrics.ForStream(orders).RecordsShed(shardID, 3-i)
+			}
+			metrics.ForStream(clicks).RecordsProcessed(shard0, 5)
+			metrics.ForStream(clicks).RecordsShed(shard0, 4)
+
+			w := httptest.NewRecorder()
+			newMetricsHandler(cfg, metrics).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			var got []string
+			for _, line := range strings.Split(w.Body.String(), "\n") {
+				if strings.HasPrefix(line, "consumer_shed_total{") {
+					got = append(got, line)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("/metrics reports\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+
+	cfg := &Config{}
+	cfg.Consumer.MetricsCardinality = "per_stream"
+	if err := validateMetricsCardinality(cfg); err == nil {
+		t.Error("validateMetricsCardinality() accepted per_stream")
+	}
+}
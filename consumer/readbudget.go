@@ -0,0 +1,90 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// Kinesis per-shard read limits, the defaults of consumer.read_budget
+const (
+	DefaultReadCallsPerSec = 5
+	DefaultReadBytesPerSec = 2 * 1024 * 1024
+)
+
+// readBudget keeps the GetRecords calls of one manual-mode shard within the
+// per-shard read limits, so the consumer slows itself down instead of being
+// throttled. Calls are spaced at least 1/calls_per_sec apart. Bytes read are
+// charged to a bucket that refills at bytes_per_sec and holds at most one
+// second's worth; a batch can overdraw it, as Kinesis lets a single call
+// return more than the limit, and the next call then waits until the debt is
+// paid back. A nil *readBudget imposes no limit.
+type readBudget struct {
+	spacing     time.Duration
+	bytesPerSec float64
+	available   float64 // bytes that may still be read, negative after a large batch
+	refilled    time.Time
+}
+
+func newReadBudget(cfg *Config) *readBudget {
+	budget := cfg.Consumer.ReadBudget
+	return &readBudget{
+		spacing:     time.Second / time.Duration(budget.CallsPerSec),
+		bytesPerSec: float64(budget.BytesPerSec),
+		available:   float64(budget.BytesPerSec),
+		refilled:    time.Now(),
+	}
+}
+
+// refill credits the bytes earned since the last refill
+func (b *readBudget) refill(now time.Time) {
+	earned := now.Sub(b.refilled).Seconds() * b.bytesPerSec
+	b.available = min(b.available+earned, b.bytesPerSec)
+	b.refilled = now
+}
+
+// read charges the records of a batch to the budget and returns how long it
+// takes to pay back the overdraft, if the batch caused one
+func (b *readBudget) read(records []*kinesis.Record) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(time.Now())
+	b.available -= float64(batchBytes(records))
+	return b.debt()
+}
+
+// debt is how long until the bucket is back at zero
+func (b *readBudget) debt() time.Duration {
+	if b.available >= 0 {
+		return 0
+	}
+	return time.Duration(-b.available / b.bytesPerSec * float64(time.Second))
+}
+
+// nextCall returns the earliest time a call after the one made at lastCall
+// stays within the budget
+func (b *readBudget) nextCall(lastCall time.Time) time.Time {
+	if b == nil {
+		return lastCall
+	}
+	next := lastCall.Add(b.spacing)
+	b.refill(time.Now())
+	if paid := b.refilled.Add(b.debt()); paid.After(next) {
+		next = paid
+	}
+	return next
+}
+
+// batchBytes is the size of the records as Kinesis counts it toward the
+// read limit: data plus partition keys
+func batchBytes(records []*kinesis.Record) int {
+	n := 0
+	for _, record := range records {
+		n += len(record.Data)
+		if record.PartitionKey != nil {
+			n += len(*record.PartitionKey)
+		}
+	}
+	return n
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// timedKinesis is a fakeKinesis recording when every GetRecords call was made
+type timedKinesis struct {
+	*fakeKinesis
+	mu    sync.Mutex
+	calls []time.Time
+}
+
+func (k *timedKinesis) GetRecordsWithContext(ctx aws.Context, input *kinesis.GetRecordsInput, opts ...request.Option) (*kinesis.GetRecordsOutput, error) {
+	k.mu.Lock()
+	k.calls = append(k.calls, time.Now())
+	k.mu.Unlock()
+	return k.fakeKinesis.GetRecordsWithContext(ctx, input, opts...)
+}
+
+func TestReadBudgetSpacing(t *testing.T) {
+	tests := []struct {
+		name        string
+		callsPerSec int
+		bytesPerSec int
+		sizes       []int           // data size of each record, read one per call
+		wantGaps    []time.Duration // least time between consecutive calls
+	}{
+		{
+			name:        "calls spaced at the call rate",
+			callsPerSec: 20,
+			bytesPerSec: DefaultReadBytesPerSec,
+			sizes:       []int{10, 10, 10, 10},
+			wantGaps:    []time.Duration{50 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond},
+		},
+		{
+			// 6006 bytes against a 5000 byte bucket is 1006 bytes, about
+			// 200ms, to pay back before the next call; then reads go on at
+			// the call rate
+			name:        "backs off after overdrawing the byte rate",
+			callsPerSec: 1000,
+			bytesPerSec: 5000,
+			sizes:       []int{6000, 10, 10},
+			wantGaps:    []time.Duration{200 * time.Millisecond, time.Millisecond},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &timedKinesis{fakeKinesis: newFakeKinesis(testStream, testShard)}
+			for _, size := range tt.sizes {
+				client.AddRecords(t, testShard, "user_1", bytes.Repeat([]byte("x"), size))
+			}
+			client.CloseShard(testShard)
+			cfg := &Config{}
+			cfg.Consumer.ReadBudget.CallsPerSec = tt.callsPerSec
+			cfg.Consumer.ReadBudget.BytesPerSec = tt.bytesPerSec
+			msp := newTestProcessor(client, cfg)
+			msp.maxRecords = 1
+			msp.budget = newReadBudget(cfg)
+			iterator, err := msp.getShardIterator()
+			if err != nil {
+				t.Fatal(err)
+			}
+			msp.shardIterator = iterator
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if read := readAll(t, ctx, msp.nextBatch); len(read) != len(tt.sizes) {
+				t.Fatalf("read %d records, want %d", len(read), len(tt.sizes))
+			}
+
+			if len(client.calls) != len(tt.wantGaps)+1 {
+				t.Fatalf("made %d GetRecords calls, want %d", len(client.calls), len(tt.wantGaps)+1)
+			}
+			for i, want := range tt.wantGaps {
+				// Allow for the call being timed just after the processor noted it
+				gap := client.calls[i+1].Sub(client.calls[i])
+				if gap < want-2*time.Millisecond {
+					t.Errorf("call %d came %v after the one before, want at least %v", i+2, gap, want)
+				}
+				if gap > want+150*time.Millisecond {
+					t.Errorf("call %d came %v after the one before, want close to %v", i+2, gap, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadBudgetNil(t *testing.T) {
+	var budget *readBudget
+	last := time.Now()
+	if next := budget.nextCall(last); !next.Equal(last) {
+		t.Errorf("nil budget delayed the next call to %v after the last", next.Sub(last))
+	}
+	if wait := budget.read([]*kinesis.Record{{Data: make([]byte, 1<<20)}}); wait != 0 {
+		t.Errorf("nil budget backed off %v", wait)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ShutdownReasonZombie is the KCL shutdown reason for a lease lost to another worker
+const ShutdownReasonZombie = "ZOMBIE"
+
+// leaseHoldBuckets are the upper bounds, in seconds, of the lease hold histogram
+var leaseHoldBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600, 7200}
+
+// RebalanceMetrics quantifies how stable shard ownership is for one stream:
+// how often leases were lost to another worker and how long leases were held
+// before they were released for any reason
+type RebalanceMetrics struct {
+	Rebalances   int64
+	LeaseHolds   int64
+	HoldSeconds  float64   // sum of all lease hold durations
+	MaxHold      float64   // longest lease hold in seconds
+	BucketCounts []uint64  // cumulative count of holds at or under each of leaseHoldBuckets
+	Buckets      []float64 // upper bounds of BucketCounts
+}
+
+// observeHold adds one released lease to the histogram
+func (rm *RebalanceMetrics) observeHold(seconds float64) {
+	rm.LeaseHolds++
+	rm.HoldSeconds += seconds
+	if seconds > rm.MaxHold {
+		rm.MaxHold = seconds
+	}
+	for i, bound := range rm.Buckets {
+		if seconds <= bound {
+			rm.BucketCounts[i]++
+		}
+	}
+}
+
+func (m *Metrics) rebalance() *RebalanceMetrics {
+	rm, ok := m.store.rebalances[m.stream]
+	if !ok {
+		rm = &RebalanceMetrics{Buckets: leaseHoldBuckets, BucketCounts: make([]uint64, len(leaseHoldBuckets))}
+		m.store.rebalances[m.stream] = rm
+	}
+	return rm
+}
+
+// LeaseAcquired starts timing how long this worker holds a shard
+func (m *Metrics) LeaseAcquired(shardID string) {
+	if m == nil {
+		return
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.store.leases[ShardKey{Stream: m.stream, ShardID: shardID}] = time.Now()
+	m.rebalance()
+}
+
+// LeaseReleased records how long a shard was held. A ZOMBIE release means
+// another worker took the lease and is counted as a rebalance.
+func (m *Metrics) LeaseReleased(shardID string, reason string) {
+	if m == nil {
+		return
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	rm := m.rebalance()
+	if reason == ShutdownReasonZombie {
+		rm.Rebalances++
+	}
+
+	key := ShardKey{Stream: m.stream, ShardID: shardID}
+	acquired, ok := m.store.leases[key]
+	if !ok {
+		return
+	}
+	delete(m.store.leases, key)
+	rm.observeHold(time.Since(acquired).Seconds())
+}
+
+// HeldShards returns the shards currently leased by this worker, across every stream
+func (m *Metrics) HeldShards() []ShardKey {
+	if m == nil {
+		return nil
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	held := make([]ShardKey, 0, len(m.store.leases))
+	for key := range m.store.leases {
+		held = append(held, key)
+	}
+	return held
+}
+
+// RebalanceSnapshot returns a copy of the rebalance metrics of every stream
+func (m *Metrics) RebalanceSnapshot() map[string]RebalanceMetrics {
+	if m == nil {
+		return nil
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	snapshot := make(map[string]RebalanceMetrics, len(m.store.rebalances))
+	for stream, rm := range m.store.rebalances {
+		copied := *rm
+		copied.BucketCounts = append([]uint64(nil), rm.BucketCounts...)
+		snapshot[stream] = copied
+	}
+	return snapshot
+}
+
+// logRebalanceSummary logs rebalance counts and the lease hold distribution
+// for every stream, once the consumer has stopped
+func (m *Metrics) logRebalanceSummary() {
+	snapshot := m.RebalanceSnapshot()
+	streams := make([]string, 0, len(snapshot))
+	for stream := range snapshot {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+
+	for _, stream := range streams {
+		rm := snapshot[stream]
+		label := "Rebalance summary"
+		if stream != "" {
+			label = fmt.Sprintf("Rebalance summary [%s]", stream)
+		}
+		if rm.LeaseHolds == 0 {
+			log.Printf("%s: %d rebalances, no leases released", label, rm.Rebalances)
+			continue
+		}
+
+		var buckets []string
+		for i, bound := range rm.Buckets {
+			buckets = append(buckets, fmt.Sprintf("<=%gs:%d", bound, rm.BucketCounts[i]))
+		}
+		log.Printf("%s: %d rebalances, %d leases released, hold mean %.1fs max %.1fs (%s)",
+			label, rm.Rebalances, rm.LeaseHolds, rm.HoldSeconds/float64(rm.LeaseHolds), rm.MaxHold,
+			strings.Join(buckets, " "))
+	}
+}
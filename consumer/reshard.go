@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// validateFollowChildShards checks consumer.follow_child_shards against the
+// execution model, since only a goroutine per shard can start shards while
+// running
+func validateFollowChildShards(cfg *Config, model string) error {
+	if !cfg.Consumer.FollowChildShards {
+		return nil
+	}
+	if model != ExecutionModelGoroutinePerShard || cfg.Consumer.ShardPromotionRPS > 0 {
+		return fmt.Errorf("consumer.follow_child_shards requires the %s execution model without shard_promotion_rps",
+			ExecutionModelGoroutinePerShard)
+	}
+	return nil
+}
+
+// shardStarter starts processors for shards found while running, the
+// children of a closed shard or shards a scan discovers, and keeps the set
+// of shards this worker has a processor for, so follow_child_shards and
+// shard_scan_interval_ms never start a shard twice. A shard started this
+// way was created by a reshard, and waits for those of its parents this
+// worker reads.
+type shardStarter struct {
+	completion *shardCompletion
+
+	// start launches a processor for a shard waiting for parents
+	start func(shardID string, parents []string)
+
+	mu      sync.Mutex
+	started map[string]bool // every shard this worker has a processor for
+}
+
+// newShardStarter returns nil unless follow_child_shards or
+// shard_scan_interval_ms is set
+func newShardStarter(cfg *Config, completion *shardCompletion, start func(shardID string, parents []string)) *shardStarter {
+	if !cfg.Consumer.FollowChildShards && cfg.Consumer.ShardScanIntervalMs <= 0 {
+		return nil
+	}
+	s := &shardStarter{
+		completion: completion,
+		start:      start,
+		started:    make(map[string]bool, len(cfg.Consumer.AssignedShards)),
+	}
+	for _, shardID := range cfg.Consumer.AssignedShards {
+		s.started[shardID] = true
+	}
+	return s
+}
+
+// startShard starts a processor for the shard unless it has one, and
+// returns whether it did
+func (s *shardStarter) startShard(shard *kinesis.Shard) bool {
+	shardID := aws.StringValue(shard.ShardId)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started[shardID] {
+		return false
+	}
+	var parents []string
+	for _, parent := range []string{aws.StringValue(shard.ParentShardId), aws.StringValue(shard.AdjacentParentShardId)} {
+		if parent != "" && s.started[parent] {
+			parents = append(parents, parent)
+		}
+	}
+	s.started[shardID] = true
+	s.completion.add(shardID)
+	s.start(shardID, parents)
+	return true
+}
+
+// childShards starts reading the children of a split or merge once their
+// parent is read to the end, so a resharded stream keeps being consumed in
+// manual mode. A child of two parents (a merge) is started once, by
+// whichever parent closes first, and waits for the other if this worker
+// reads it too. A nil *childShards starts nothing.
+type childShards struct {
+	client     KinesisAPI
+	streamName string
+	labels     shardLabeler
+	starter    *shardStarter
+}
+
+// newChildShards returns nil unless consumer.follow_child_shards is set
+func newChildShards(cfg *Config, client KinesisAPI, starter *shardStarter) *childShards {
+	if !cfg.Consumer.FollowChildShards {
+		return nil
+	}
+	return &childShards{client: client, streamName: cfg.Kinesis.StreamName, labels: newShardLabeler(cfg), starter: starter}
+}
+
+// parentClosed starts the children of a shard read to the end that this
+// worker doesn't read yet
+func (c *childShards) parentClosed(shardID string) {
+	if c == nil {
+		return
+	}
+	shards, err := listShards(c.client, c.streamName)
+	if err != nil {
+		log.Printf("[%s] ALERT: shard closed but its child shards can't be found, they are not read: %v", c.labels.logLabel(shardID), err)
+		return
+	}
+
+	for _, shard := range shards {
+		if aws.StringValue(shard.ParentShardId) != shardID && aws.StringValue(shard.AdjacentParentShardId) != shardID {
+			continue
+		}
+		if c.starter.startShard(shard) {
+			log.Printf("[%s] Shard closed, started its child shard %s", c.labels.logLabel(shardID), aws.StringValue(shard.ShardId))
+		}
+	}
+}
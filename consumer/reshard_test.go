@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestValidateFollowChildShards(t *testing.T) {
+	tests := []struct {
+		name      string
+		follow    bool
+		model     string
+		promotion float64
+		wantErr   bool
+	}{
+		{name: "not set", model: ExecutionModelSharedPool},
+		{name: "goroutine per shard", follow: true, model: ExecutionModelGoroutinePerShard},
+		{name: "shared pool", follow: true, model: ExecutionModelSharedPool, wantErr: true},
+		{name: "shard promotion", follow: true, model: ExecutionModelGoroutinePerShard, promotion: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.FollowChildShards = tt.follow
+			cfg.Consumer.ShardPromotionRPS = tt.promotion
+			err := validateFollowChildShards(cfg, tt.model)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateFollowChildShards() = %v, want an error %t", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "consumer.follow_child_shards requires") {
+				t.Errorf("unexpected error %q", err)
+			}
+		})
+	}
+}
+
+// startedShards records the shards a shardStarter starts, with their parents
+type startedShards []string
+
+func (s *startedShards) start(shardID string, parents []string) {
+	*s = append(*s, fmt.Sprintf("%s%v", shardID, parents))
+}
+
+func TestShardStarter(t *testing.T) {
+	cfg := &Config{}
+	cfg.Consumer.FollowChildShards = true
+	cfg.Consumer.AssignedShards = []string{"shard-a", "shard-b"}
+	var started startedShards
+	starter := newShardStarter(cfg, newShardCompletion(cfg.Consumer.AssignedShards), started.start)
+
+	tests := []struct {
+		name  string
+		shard *kinesis.Shard
+		want  bool
+	}{
+		{name: "assigned shard", shard: testShardWithParents("shard-a", "", ""), want: false},
+		{name: "child of a merge", shard: testShardWithParents("shard-c", "shard-a", "shard-b"), want: true},
+		{name: "started already", shard: testShardWithParents("shard-c", "shard-a", "shard-b"), want: false},
+		{name: "child of a shard read elsewhere", shard: testShardWithParents("shard-d", "shard-x", ""), want: true},
+		{name: "grandchild", shard: testShardWithParents("shard-e", "shard-c", ""), want: true},
+	}
+	for _, tt := range tests {
+		if got := starter.startShard(tt.shard); got != tt.want {
+			t.Errorf("%s: startShard() = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+	if want := "[shard-c[shard-a shard-b] shard-d[] shard-e[shard-c]]"; fmt.Sprint(started) != want {
+		t.Errorf("started %v, want %s", started, want)
+	}
+
+	if newShardStarter(&Config{}, nil, started.start) != nil {
+		t.Error("shard starter created without follow_child_shards or shard_scan_interval_ms")
+	}
+}
+
+func TestChildShards(t *testing.T) {
+	tests := []struct {
+		name     string
+		assigned []string
+		reshard  func(fake *fakeKinesis)
+		closed   []string // parents read to the end, in order
+		stream   string
+		want     string
+	}{
+		{
+			name:     "split",
+			assigned: []string{"shard-a"},
+			reshard: func(fake *fakeKinesis) {
+				fake.AddChildShard("shard-b", "shard-a")
+				fake.AddChildShard("shard-c", "shard-a")
+			},
+			closed: []string{"shard-a"},
+			want:   "[shard-b[shard-a] shard-c[shard-a]]",
+		},
+		{
+			name:     "merge started once, waiting for both parents",
+			assigned: []string{"shard-a", "shard-b"},
+			reshard:  func(fake *fakeKinesis) { fake.AddChildShard("shard-c", "shard-a", "shard-b") },
+			closed:   []string{"shard-a", "shard-b"},
+			want:     "[shard-c[shard-a shard-b]]",
+		},
+		{
+			name:     "children of other shards left alone",
+			assigned: []string{"shard-a", "shard-b"},
+			reshard:  func(fake *fakeKinesis) { fake.AddChildShard("shard-c", "shard-b") },
+			closed:   []string{"shard-a"},
+			want:     "[]",
+		},
+		{
+			name:     "shards can't be listed",
+			assigned: []string{"shard-a"},
+			reshard:  func(fake *fakeKinesis) { fake.AddChildShard("shard-b", "shard-a") },
+			closed:   []string{"shard-a"},
+			stream:   "other-stream",
+			want:     "[]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeKinesis(testStream, tt.assigned...)
+			tt.reshard(fake)
+			cfg := &Config{}
+			cfg.Kinesis.StreamName = testStream
+			if tt.stream != "" {
+				cfg.Kinesis.StreamName = tt.stream
+			}
+			cfg.Consumer.FollowChildShards = true
+			cfg.Consumer.AssignedShards = tt.assigned
+			var started startedShards
+			children := newChildShards(cfg, fake, newShardStarter(cfg, newShardCompletion(tt.assigned), started.start))
+
+			for _, shardID := range tt.closed {
+				fake.CloseShard(shardID)
+				children.parentClosed(shardID)
+			}
+			if fmt.Sprint([]string(started)) != tt.want {
+				t.Errorf("started %v, want %s", started, tt.want)
+			}
+		})
+	}
+
+	// A nil *childShards starts nothing
+	var children *childShards
+	children.parentClosed(testShard)
+}
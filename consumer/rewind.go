@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+var (
+	// ErrShardOwned is returned when another processor in this process is already active for the shard
+	ErrShardOwned = errors.New("another processor is already active for this shard")
+
+	// ErrShardNotActive is returned for a rewind of a shard this worker is not processing
+	ErrShardNotActive = errors.New("shard is not being processed by this worker")
+
+	// ErrShardAmbiguous is returned when a shard ID is active in several streams and no stream was given
+	ErrShardAmbiguous = errors.New("shard is active in several streams, pass ?stream=")
+)
+
+// RewindPosition is where a rewound shard reprocesses from
+type RewindPosition struct {
+	Stream         string     `json:"stream"`
+	ShardID        string     `json:"shard_id"`
+	IteratorType   string     `json:"iterator_type"`
+	SequenceNumber string     `json:"sequence_number,omitempty"`
+	Timestamp      *time.Time `json:"timestamp,omitempty"`
+}
+
+// Rewinder is a shard processor that can reprocess its shard from the last
+// checkpoint without giving up the lease
+type Rewinder interface {
+	Rewind() RewindPosition
+}
+
+// shardStore holds the active processors of every stream in the process
+type shardStore struct {
+	mu     sync.Mutex
+	active map[ShardKey]Rewinder
+}
+
+// ShardRegistry tracks the shard processors running in this process so the
+// control endpoints can reach them. Like Metrics, each stream registers
+// through its own view from ForStream. A nil *ShardRegistry is valid and
+// tracks nothing.
+type ShardRegistry struct {
+	stream string
+	store  *shardStore
+}
+
+// NewShardRegistry creates an empty registry
+func NewShardRegistry() *ShardRegistry {
+	return &ShardRegistry{store: &shardStore{active: make(map[ShardKey]Rewinder)}}
+}
+
+// ForStream returns a view that registers into the same store, labelled with the stream
+func (r *ShardRegistry) ForStream(stream string) *ShardRegistry {
+	if r == nil {
+		return nil
+	}
+	return &ShardRegistry{stream: stream, store: r.store}
+}
+
+// Register makes a processor reachable for its shard. It doubles as a
+// process-wide ownership guard: while one processor is registered for a
+// shard, registering another fails with ErrShardOwned, so two processors
+// never handle the same shard at once after a rebalance race.
+func (r *ShardRegistry) Register(shardID string, processor Rewinder) error {
+	if r == nil {
+		return nil
+	}
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	key := ShardKey{Stream: r.stream, ShardID: shardID}
+	if current, ok := r.store.active[key]; ok && current != processor {
+		return ErrShardOwned
+	}
+	r.store.active[key] = processor
+	return nil
+}
+
+// Unregister removes a processor, unless another one has since registered for the shard
+func (r *ShardRegistry) Unregister(shardID string, processor Rewinder) {
+	if r == nil {
+		return
+	}
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	key := ShardKey{Stream: r.stream, ShardID: shardID}
+	if r.store.active[key] == processor {
+		delete(r.store.active, key)
+	}
+}
+
+// Active returns the shards of this view's stream that have a registered processor
+func (r *ShardRegistry) Active() []string {
+	if r == nil {
+		return nil
+	}
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	var shardIDs []string
+	for key := range r.store.active {
+		if key.Stream == r.stream {
+			shardIDs = append(shardIDs, key.ShardID)
+		}
+	}
+	return shardIDs
+}
+
+// Rewind asks the processor of a shard to reprocess from its last checkpoint.
+// The stream may be empty when the shard ID is only active in one stream.
+func (r *ShardRegistry) Rewind(stream, shardID string) (RewindPosition, error) {
+	if r == nil {
+		return RewindPosition{}, ErrShardNotActive
+	}
+	r.store.mu.Lock()
+	var matches []Rewinder
+	for key, processor := range r.store.active {
+		if key.ShardID == shardID && (stream == "" || key.Stream == stream) {
+			matches = append(matches, processor)
+		}
+	}
+	r.store.mu.Unlock()
+
+	switch len(matches) {
+	case 0:
+		return RewindPosition{}, ErrShardNotActive
+	case 1:
+		return matches[0].Rewind(), nil
+	default:
+		return RewindPosition{}, ErrShardAmbiguous
+	}
+}
+
+// handleRewind serves POST /shards/{id}/rewind
+func handleRewind(shards *ShardRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stream, shardID := r.URL.Query().Get("stream"), r.PathValue("id")
+		position, err := shards.Rewind(stream, shardID)
+		switch {
+		case errors.Is(err, ErrShardNotActive):
+			http.Error(w, fmt.Sprintf("%s: %v", shardID, err), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("%s: %v", shardID, err), http.StatusConflict)
+			return
+		}
+
+		log.Printf("[%s] Rewind requested, reprocessing from %s %s", shardLabeler{stream: stream, multiple: stream != ""}.logLabel(shardID), position.IteratorType, position.SequenceNumber)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(position)
+	}
+}
+
+// rewindRequest hands a rewind from the HTTP server to the goroutine reading
+// the shard, which applies it before its next batch
+type rewindRequest struct {
+	mu         sync.Mutex
+	checkpoint string // last checkpointed sequence number, empty if none
+	pending    bool
+	from       string
+}
+
+// checkpointed records the sequence number the shard is checkpointed at
+func (rr *rewindRequest) checkpointed(sequenceNumber string) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.checkpoint = sequenceNumber
+}
+
+// checkpointedAt returns the sequence number the shard is checkpointed at
+func (rr *rewindRequest) checkpointedAt() string {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	return rr.checkpoint
+}
+
+// request asks for a rewind to the last checkpoint and returns that checkpoint
+func (rr *rewindRequest) request() string {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.pending = true
+	rr.from = rr.checkpoint
+	return rr.from
+}
+
+// take returns the checkpoint to rewind to if a rewind is pending, and clears it
+func (rr *rewindRequest) take() (string, bool) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if !rr.pending {
+		return "", false
+	}
+	rr.pending = false
+	return rr.from, true
+}
+
+// Rewind re-reads the shard from where it started: after the checkpoint it
+// resumed from, or consumer.iterator_type or the backfill handoff point.
+func (msp *ManualShardProcessor) Rewind() RewindPosition {
+	msp.rewind.request()
+	position := RewindPosition{Stream: msp.streamName, ShardID: msp.shardID}
+	// The start position was validated before the shard was opened
+	if input, err := msp.startPosition(); err == nil {
+		position.IteratorType = aws.StringValue(input.ShardIteratorType)
+		position.SequenceNumber = aws.StringValue(input.StartingSequenceNumber)
+		position.Timestamp = input.Timestamp
+	}
+	return position
+}
+
+// Rewind reprocesses the records between the last checkpoint and the current
+// position before the next batch. The KCL keeps reading from where it was,
+// so the checkpoint and the lease are left untouched.
+func (rp *RecordProcessor) Rewind() RewindPosition {
+	position := RewindPosition{
+		Stream:       rp.pc.Config.Kinesis.StreamName,
+		ShardID:      rp.shardID,
+		IteratorType: kinesis.ShardIteratorTypeTrimHorizon,
+	}
+	if from := rp.rewind.request(); from != "" {
+		position.IteratorType = kinesis.ShardIteratorTypeAfterSequenceNumber
+		position.SequenceNumber = from
+	}
+	return position
+}
+
+// replay handles the records after the checkpoint from up to and including
+// the last record this processor has already handled, reading them with its
+// own iterator alongside the KCL's
+func (rp *RecordProcessor) replay(from string) {
+	if rp.lastSeen == "" {
+		log.Printf("[%s] Nothing seen since the checkpoint, nothing to replay", rp.label)
+		return
+	}
+
+	input := &kinesis.GetShardIteratorInput{
+		StreamName:        aws.String(rp.pc.Config.Kinesis.StreamName),
+		ShardId:           aws.String(rp.shardID),
+		ShardIteratorType: aws.String(kinesis.ShardIteratorTypeTrimHorizon),
+	}
+	if from != "" {
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+		input.StartingSequenceNumber = aws.String(from)
+	}
+	iteratorOutput, err := rp.pc.Kinesis.GetShardIterator(input)
+	if err != nil {
+		log.Printf("[%s] Replay failed to get shard iterator: %v", rp.label, err)
+		return
+	}
+
+	replayed := 0
+	defer func() {
+		log.Printf("[%s] Replayed %d records up to %s", rp.label, replayed, rp.lastSeen)
+	}()
+
+	iterator := iteratorOutput.ShardIterator
+	for iterator != nil {
+		output, err := rp.pc.Kinesis.GetRecords(&kinesis.GetRecordsInput{
+			ShardIterator: iterator,
+			Limit:         aws.Int64(int64(rp.pc.Config.Consumer.MaxRecords)),
+		})
+		if err != nil {
+			log.Printf("[%s] Replay stopped early: %v", rp.label, err)
+			return
+		}
+		for _, record := range deaggregate(rp.label, output.Records) {
+			// Everything after lastSeen is still to come from the KCL
+			if !sequenceAtOrBefore(aws.StringValue(record.SequenceNumber), rp.lastSeen) {
+				return
+			}
+			rp.processRecord(record)
+			replayed++
+		}
+		if len(output.Records) == 0 && aws.Int64Value(output.MillisBehindLatest) == 0 {
+			return
+		}
+		iterator = output.NextShardIterator
+	}
+}
+
+// checkpointSequence returns the sequence number of a KCL checkpoint, or an
+// empty string for sentinel checkpoints such as TRIM_HORIZON
+func checkpointSequence(checkpoint string) string {
+	if _, ok := new(big.Int).SetString(checkpoint, 10); !ok {
+		return ""
+	}
+	return checkpoint
+}
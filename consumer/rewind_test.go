@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
+)
+
+// testRewinder is a processor registered by the tests
+type testRewinder struct{ name string }
+
+func (r *testRewinder) Rewind() RewindPosition {
+	return RewindPosition{ShardID: r.name}
+}
+
+func TestShardRegistryOwnership(t *testing.T) {
+	first, second := &testRewinder{"first"}, &testRewinder{"second"}
+	type step struct {
+		register   *testRewinder // registered, or unregistered when unregister is set
+		unregister bool
+		stream     string
+		wantErr    error
+	}
+	tests := []struct {
+		name       string
+		steps      []step
+		wantActive string // processor the test shard rewinds
+	}{
+		{name: "registers", steps: []step{{register: first}}, wantActive: "first"},
+		{name: "registering again is allowed", steps: []step{{register: first}, {register: first}}, wantActive: "first"},
+		{name: "second processor rejected", steps: []step{{register: first}, {register: second, wantErr: ErrShardOwned}}, wantActive: "first"},
+		{name: "second processor takes over after the first is gone", steps: []step{
+			{register: first}, {register: second, wantErr: ErrShardOwned}, {register: first, unregister: true}, {register: second},
+		}, wantActive: "second"},
+		{name: "rejected processor can't unregister the owner", steps: []step{
+			{register: first}, {register: second, unregister: true},
+		}, wantActive: "first"},
+		{name: "same shard ID in another stream", steps: []step{{register: first}, {register: second, stream: "other-stream"}}, wantActive: "first"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewShardRegistry()
+			for i, s := range tt.steps {
+				view := registry.ForStream(testStream)
+				if s.stream != "" {
+					view = registry.ForStream(s.stream)
+				}
+				if s.unregister {
+					view.Unregister(testShard, s.register)
+					continue
+				}
+				if err := view.Register(testShard, s.register); !errors.Is(err, s.wantErr) {
+					t.Errorf("step %d: Register(%s) = %v, want %v", i, s.register.name, err, s.wantErr)
+				}
+			}
+
+			position, err := registry.Rewind(testStream, testShard)
+			if err != nil || position.ShardID != tt.wantActive {
+				t.Errorf("Rewind() reached %q, %v; want %s", position.ShardID, err, tt.wantActive)
+			}
+		})
+	}
+}
+
+func TestShardRegistryActive(t *testing.T) {
+	registry := NewShardRegistry()
+	orders, payments := registry.ForStream("orders"), registry.ForStream("payments")
+	orders.Register("shardId-000000000000", &testRewinder{})
+	orders.Register("shardId-000000000001", &testRewinder{})
+	payments.Register("shardId-000000000000", &testRewinder{})
+
+	active := orders.Active()
+	sort.Strings(active)
+	if fmt.Sprint(active) != "[shardId-000000000000 shardId-000000000001]" {
+		t.Errorf("orders has active shards %v", active)
+	}
+	if _, err := registry.Rewind("", "shardId-000000000000"); !errors.Is(err, ErrShardAmbiguous) {
+		t.Errorf("Rewind of a shard ID active in two streams = %v, want ErrShardAmbiguous", err)
+	}
+
+	var none *ShardRegistry
+	if err := none.Register(testShard, &testRewinder{}); err != nil || none.Active() != nil {
+		t.Errorf("nil registry registered a processor: %v, %v", err, none.Active())
+	}
+}
+
+// failingCheckpointer rejects every checkpoint, as a throttled lease table
+// would, so the shard stays checkpointed where it resumed
+type failingCheckpointer struct {
+	interfaces.IRecordProcessorCheckpointer
+}
+
+func (failingCheckpointer) Checkpoint(sequenceNumber *string) error {
+	return errors.New("lease table unavailable")
+}
+
+// testKinesisRecords reads the records at the given positions of the test shard
+func testKinesisRecords(t *testing.T, client *fakeKinesis, positions ...int) []*kinesis.Record {
+	t.Helper()
+	iterator, err := client.GetShardIterator(&kinesis.GetShardIteratorInput{
+		StreamName:        aws.String(testStream),
+		ShardId:           aws.String(testShard),
+		ShardIteratorType: aws.String(kinesis.ShardIteratorTypeTrimHorizon),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := client.GetRecords(&kinesis.GetRecordsInput{ShardIterator: iterator.ShardIterator})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := make([]*kinesis.Record, len(positions))
+	for i, position := range positions {
+		records[i] = output.Records[position]
+	}
+	return records
+}
+
+func TestRecordProcessorRewind(t *testing.T) {
+	tests := []struct {
+		name         string
+		checkpoint   int // position of the record resumed after, -1 for none
+		wantPosition string
+		wantReplayed []int // positions of the records handled again, in order
+	}{
+		{name: "from the checkpoint", checkpoint: 1, wantPosition: "AFTER_SEQUENCE_NUMBER", wantReplayed: []int{2, 3, 4}},
+		{name: "from trim horizon without a checkpoint", checkpoint: -1, wantPosition: "TRIM_HORIZON", wantReplayed: []int{0, 1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeKinesis(testStream, testShard)
+			sequenceNumbers := client.AddRecords(t, testShard, "user_1", testEvents(0, 7)...)
+			cfg := &Config{}
+			cfg.Kinesis.StreamName = testStream
+			cfg.Consumer.MaxRecords = 100
+			sink := &collectingSink{}
+			rp := &RecordProcessor{pc: &ProcessorContext{Config: cfg, Sink: sink, Kinesis: client}}
+
+			input := &interfaces.InitializationInput{ShardId: testShard}
+			if tt.checkpoint >= 0 {
+				input.ExtendedSequenceNumber = &interfaces.ExtendedSequenceNumber{SequenceNumber: aws.String(sequenceNumbers[tt.checkpoint])}
+			}
+			rp.Initialize(input)
+			first := tt.checkpoint + 1
+			var positions []int
+			for i := first; i <= 4; i++ {
+				positions = append(positions, i)
+			}
+			rp.ProcessRecords(&interfaces.ProcessRecordsInput{Records: testKinesisRecords(t, client, positions...), Checkpointer: failingCheckpointer{}})
+
+			position := rp.Rewind()
+			wantSequence := ""
+			if tt.checkpoint >= 0 {
+				wantSequence = sequenceNumbers[tt.checkpoint]
+			}
+			if position.IteratorType != tt.wantPosition || position.SequenceNumber != wantSequence {
+				t.Errorf("Rewind() = %s %s, want %s %s", position.IteratorType, position.SequenceNumber, tt.wantPosition, wantSequence)
+			}
+
+			// The rewind applies before the next batch
+			rp.ProcessRecords(&interfaces.ProcessRecordsInput{Records: testKinesisRecords(t, client, 5, 6), Checkpointer: failingCheckpointer{}})
+
+			var want []string
+			for _, i := range positions {
+				want = append(want, sequenceNumbers[i])
+			}
+			for _, i := range tt.wantReplayed {
+				want = append(want, sequenceNumbers[i])
+			}
+			want = append(want, sequenceNumbers[5], sequenceNumbers[6])
+			if got := sink.records(); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("sink received %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestManualShardProcessorRewind(t *testing.T) {
+	client := newFakeKinesis(testStream, testShard)
+	sequenceNumbers := client.AddRecords(t, testShard, "user_1", testEvents(0, 5)...)
+	cfg := &Config{}
+	cfg.Consumer.IteratorType = kinesis.ShardIteratorTypeAfterSequenceNumber
+	cfg.Consumer.IteratorSequenceNumber = sequenceNumbers[1]
+	msp := newTestProcessor(client, cfg)
+	iterator, err := msp.getShardIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msp.shardIterator = iterator
+
+	read := func() []string {
+		batch, ok := msp.fetchBatch(context.Background())
+		if !ok || batch == nil {
+			t.Fatalf("fetchBatch() = %v, %t", batch, ok)
+		}
+		var sequences []string
+		for _, record := range batch.records {
+			sequences = append(sequences, aws.StringValue(record.SequenceNumber))
+		}
+		return sequences
+	}
+	want := fmt.Sprint(sequenceNumbers[2:])
+	if got := read(); fmt.Sprint(got) != want {
+		t.Fatalf("first read %v, want %s", got, want)
+	}
+
+	position := msp.Rewind()
+	if position.IteratorType != kinesis.ShardIteratorTypeAfterSequenceNumber || position.SequenceNumber != sequenceNumbers[1] {
+		t.Errorf("Rewind() = %s %s, want AFTER_SEQUENCE_NUMBER %s", position.IteratorType, position.SequenceNumber, sequenceNumbers[1])
+	}
+	if got := read(); fmt.Sprint(got) != want {
+		t.Errorf("read after the rewind %v, want %s re-delivered", got, want)
+	}
+}
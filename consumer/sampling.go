@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+)
+
+// Sampler hands only consumer.sampling_rate of the events to the handler,
+// choosing by a hash of the event ID rather than at random, so a restarted
+// or rebalanced consumer samples exactly the same events and results stay
+// reproducible. Events left out are skipped but still checkpointed. A nil
+// *Sampler keeps every event.
+type Sampler struct {
+	threshold uint64 // events whose hash is below it are kept
+}
+
+// NewSampler returns the sampler for consumer.sampling_rate, or nil when it
+// is unset or 1. A rate of 0 skips every event.
+func NewSampler(cfg *Config) (*Sampler, error) {
+	if cfg.Consumer.SamplingRate == nil {
+		return nil, nil
+	}
+	rate := *cfg.Consumer.SamplingRate
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("invalid sampling_rate: %g. Must be between 0 and 1", rate)
+	}
+	if rate == 1 {
+		return nil, nil
+	}
+	log.Printf("Sampling %.1f%% of events by event ID", rate*100)
+	return &Sampler{threshold: uint64(rate * math.MaxUint64)}, nil
+}
+
+// Skips reports whether the event is left out of the sample
+func (s *Sampler) Skips(event Event) bool {
+	if s == nil {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(event.EventID))
+	return mix64(h.Sum64()) >= s.threshold
+}
+
+// mix64 spreads the bits of an FNV hash over all 64 bits. Alone, FNV leaves
+// the high bits of sequential IDs such as evt_<n> clustered, so comparing
+// them with the threshold kept far more or fewer events than the rate.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
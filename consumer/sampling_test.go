@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSampler(t *testing.T) {
+	rate := func(r float64) *float64 { return &r }
+	tests := []struct {
+		name     string
+		rate     *float64
+		wantErr  bool
+		wantKept [2]int // range of events kept out of 1000
+	}{
+		{name: "unset keeps every event", wantKept: [2]int{1000, 1000}},
+		{name: "1 keeps every event", rate: rate(1), wantKept: [2]int{1000, 1000}},
+		{name: "0 skips every event", rate: rate(0), wantKept: [2]int{0, 0}},
+		{name: "a quarter", rate: rate(0.25), wantKept: [2]int{200, 300}},
+		{name: "negative", rate: rate(-0.1), wantErr: true},
+		{name: "above 1", rate: rate(1.5), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.SamplingRate = tt.rate
+			sampler, err := NewSampler(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewSampler() = %v, want an error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			kept := 0
+			for i := 0; i < 1000; i++ {
+				event := Event{EventID: fmt.Sprintf("evt_%d", i)}
+				skips := sampler.Skips(event)
+				if skips != sampler.Skips(event) {
+					t.Fatalf("event %s sampled differently twice", event.EventID)
+				}
+				if !skips {
+					kept++
+				}
+			}
+			if kept < tt.wantKept[0] || kept > tt.wantKept[1] {
+				t.Errorf("kept %d of 1000 events, want %d to %d", kept, tt.wantKept[0], tt.wantKept[1])
+			}
+		})
+	}
+}
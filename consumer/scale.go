@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults for the scale recommendation
+const (
+	DefaultScaleTargetLagMs = 60000
+	DefaultScaleHorizonMs   = 300000
+	DefaultScaleWindowMs    = 60000
+
+	// minScaleSampleInterval is the shortest span rates are measured over
+	minScaleSampleInterval = time.Second
+
+	// minCatchUp bounds the incoming rate estimate of a shard whose lag grows
+	// almost as fast as time passes, where the estimate diverges
+	minCatchUp = 0.05
+)
+
+// ScaleRecommendation is the body of GET /scale-recommendation. Rates are in
+// records per second and cover the shards this worker holds.
+type ScaleRecommendation struct {
+	WorkerID           string  `json:"worker_id"`
+	Workers            int     `json:"workers"`
+	RecommendedWorkers int     `json:"recommended_workers"`
+	Shards             int     `json:"shards"`
+	MaxLagMs           int64   `json:"max_lag_ms"`
+	TargetLagMs        int     `json:"target_lag_ms"`
+	ProcessingRate     float64 `json:"processing_rate"`
+	IncomingRate       float64 `json:"incoming_rate"`
+	RequiredRate       float64 `json:"required_rate"`
+	WorkerCapacity     float64 `json:"worker_capacity"`
+	SampleSeconds      float64 `json:"sample_seconds"`
+	Reason             string  `json:"reason"`
+}
+
+// scaleSample is the metrics of the held shards at one point in time
+type scaleSample struct {
+	at     time.Time
+	shards map[ShardKey]ShardMetrics
+}
+
+// ScaleAdvisor recommends a worker count that keeps lag under
+// consumer.scale.target_lag_ms, from how fast this worker processes records
+// and how fast the lag of its shards changes:
+//
+//   - a shard's position in the stream advances by processed/incoming
+//     seconds per second, so the incoming rate is the processing rate
+//     divided by one minus the lag growth in seconds per second
+//   - a shard needs its incoming rate, plus enough to drain the lag above
+//     the target within consumer.scale.horizon_ms
+//   - a worker drains consumer.scale.worker_capacity_rps, or what this
+//     worker processes now when that is not set
+//
+// Assuming shards are spread evenly, this worker's required rate is 1/workers
+// of the total, so the recommendation is workers * required / capacity. The
+// controller passes the current worker count with ?workers=. Rates are
+// measured between the current metrics and the oldest sample taken by a
+// previous request within consumer.scale.window_ms, so the endpoint is
+// expected to be polled.
+type ScaleAdvisor struct {
+	workerID    string
+	targetLagMs int
+	horizon     time.Duration
+	window      time.Duration
+	capacity    float64
+	metrics     *Metrics
+
+	mu      sync.Mutex
+	samples []scaleSample // oldest first
+}
+
+// NewScaleAdvisor returns an advisor reading the given metrics
+func NewScaleAdvisor(cfg *Config, metrics *Metrics) *ScaleAdvisor {
+	scaleCfg := cfg.Consumer.Scale
+	return &ScaleAdvisor{
+		workerID:    cfg.Consumer.WorkerID,
+		targetLagMs: scaleCfg.TargetLagMs,
+		horizon:     time.Duration(scaleCfg.HorizonMs) * time.Millisecond,
+		window:      time.Duration(scaleCfg.WindowMs) * time.Millisecond,
+		capacity:    scaleCfg.WorkerCapacityRps,
+		metrics:     metrics,
+	}
+}
+
+// sample takes the metrics of the shards currently held
+func (a *ScaleAdvisor) sample(now time.Time) scaleSample {
+	snapshot := a.metrics.Snapshot()
+	held := make(map[ShardKey]ShardMetrics)
+	for _, key := range a.metrics.HeldShards() {
+		if sm, ok := snapshot[key]; ok && sm.HasLag {
+			held[key] = sm
+		}
+	}
+	return scaleSample{at: now, shards: held}
+}
+
+// Recommend samples the metrics and recommends a worker count for a
+// deployment currently running the given number of workers
+func (a *ScaleAdvisor) Recommend(workers int, now time.Time) ScaleRecommendation {
+	current := a.sample(now)
+
+	a.mu.Lock()
+	kept := a.samples[:0]
+	for _, s := range a.samples {
+		if now.Sub(s.at) <= a.window {
+			kept = append(kept, s)
+		}
+	}
+	a.samples = kept
+	var base *scaleSample
+	if len(a.samples) > 0 && now.Sub(a.samples[0].at) >= minScaleSampleInterval {
+		base = &a.samples[0]
+	}
+	if len(a.samples) == 0 || now.Sub(a.samples[len(a.samples)-1].at) >= minScaleSampleInterval {
+		a.samples = append(a.samples, current)
+	}
+	a.mu.Unlock()
+
+	return a.recommend(workers, current, base)
+}
+
+// recommend applies the model to two samples. Without a base sample nothing
+// can be measured and the current worker count is kept.
+func (a *ScaleAdvisor) recommend(workers int, current scaleSample, base *scaleSample) ScaleRecommendation {
+	rec := ScaleRecommendation{
+		WorkerID:           a.workerID,
+		Workers:            workers,
+		RecommendedWorkers: workers,
+		Shards:             len(current.shards),
+		TargetLagMs:        a.targetLagMs,
+		WorkerCapacity:     a.capacity,
+	}
+	for _, sm := range current.shards {
+		rec.MaxLagMs = max(rec.MaxLagMs, sm.MillisBehindLatest)
+	}
+	if base == nil {
+		rec.Reason = "collecting samples, poll again to measure rates"
+		return rec
+	}
+
+	elapsed := current.at.Sub(base.at).Seconds()
+	rec.SampleSeconds = elapsed
+	for key, now := range current.shards {
+		then, ok := base.shards[key]
+		if !ok {
+			continue
+		}
+		processing := float64(now.RecordsProcessed-then.RecordsProcessed) / elapsed
+		growth := float64(now.MillisBehindLatest-then.MillisBehindLatest) / 1000 / elapsed
+		incoming := processing / math.Max(1-growth, minCatchUp)
+
+		required := incoming
+		if excess := float64(now.MillisBehindLatest - int64(a.targetLagMs)); excess > 0 {
+			required += incoming * excess / float64(a.horizon.Milliseconds())
+		}
+
+		rec.ProcessingRate += processing
+		rec.IncomingRate += incoming
+		rec.RequiredRate += required
+	}
+
+	if rec.WorkerCapacity <= 0 {
+		rec.WorkerCapacity = rec.ProcessingRate
+	}
+	if rec.WorkerCapacity <= 0 {
+		rec.Reason = "no records processed in the sample, worker capacity unknown"
+		return rec
+	}
+
+	recommended := int(math.Ceil(float64(workers) * rec.RequiredRate / rec.WorkerCapacity))
+	// A worker without a shard does nothing, so there is no point going past one per shard
+	recommended = min(max(recommended, 1), max(workers*rec.Shards, 1))
+	rec.RecommendedWorkers = recommended
+	switch {
+	case recommended > workers:
+		rec.Reason = fmt.Sprintf("need %.1f records/sec to keep lag under %dms, %d workers drain %.1f",
+			float64(workers)*rec.RequiredRate, a.targetLagMs, workers, float64(workers)*rec.WorkerCapacity)
+	case recommended < workers:
+		rec.Reason = fmt.Sprintf("%d workers drain %.1f records/sec, only %.1f needed",
+			workers, float64(workers)*rec.WorkerCapacity, float64(workers)*rec.RequiredRate)
+	default:
+		rec.Reason = "current worker count keeps lag under target"
+	}
+	return rec
+}
+
+// handleScaleRecommendation serves GET /scale-recommendation?workers=N
+func handleScaleRecommendation(advisor *ScaleAdvisor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		workers := 1
+		if value := r.URL.Query().Get("workers"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				http.Error(w, fmt.Sprintf("invalid workers: %q. Must be a positive integer", value), http.StatusBadRequest)
+				return
+			}
+			workers = n
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(advisor.Recommend(workers, time.Now()))
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testScaleSample is four held shards at, each having processed processed
+// records and lagging lagMs
+func testScaleSample(at time.Time, processed, lagMs int64) scaleSample {
+	sample := scaleSample{at: at, shards: make(map[ShardKey]ShardMetrics)}
+	for i := range 4 {
+		sample.shards[ShardKey{ShardID: fmt.Sprintf("shardId-%012d", i)}] = ShardMetrics{
+			RecordsProcessed:   processed,
+			MillisBehindLatest: lagMs,
+			HasLag:             true,
+		}
+	}
+	return sample
+}
+
+func TestScaleRecommendation(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	later := start.Add(10 * time.Second)
+	before := func(processed, lagMs int64) *scaleSample {
+		sample := testScaleSample(start, processed, lagMs)
+		return &sample
+	}
+	tests := []struct {
+		name       string
+		capacity   float64
+		base       *scaleSample
+		current    scaleSample
+		want       int
+		wantReason string
+	}{
+		{
+			name:       "no earlier sample",
+			current:    testScaleSample(later, 250, 1000),
+			want:       2,
+			wantReason: "collecting samples",
+		},
+		{
+			name:       "lag steady under target",
+			base:       before(0, 1000),
+			current:    testScaleSample(later, 250, 1000), // 100 records/sec in all
+			want:       2,
+			wantReason: "keeps lag under target",
+		},
+		{
+			// Half a second of lag per second means twice as many records arrive as are processed
+			name:       "lag growing",
+			base:       before(0, 0),
+			current:    testScaleSample(later, 250, 5000),
+			want:       4,
+			wantReason: "need 400.0 records/sec",
+		},
+		{
+			// 60s over target drained over the 300s horizon needs 20% more
+			name:    "lag over target",
+			base:    before(0, 120000),
+			current: testScaleSample(later, 250, 120000),
+			want:    3,
+		},
+		{
+			name:       "configured capacity to spare",
+			capacity:   300,
+			base:       before(0, 1000),
+			current:    testScaleSample(later, 250, 1000),
+			want:       1,
+			wantReason: "only 200.0 needed",
+		},
+		{
+			name:    "no more workers than shards",
+			base:    before(0, 0),
+			current: testScaleSample(later, 250, 10000),
+			want:    8,
+		},
+		{
+			name:       "nothing processed",
+			base:       before(0, 0),
+			current:    testScaleSample(later, 0, 10000),
+			want:       2,
+			wantReason: "capacity unknown",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.Scale.TargetLagMs = DefaultScaleTargetLagMs
+			cfg.Consumer.Scale.HorizonMs = DefaultScaleHorizonMs
+			cfg.Consumer.Scale.WindowMs = DefaultScaleWindowMs
+			cfg.Consumer.Scale.WorkerCapacityRps = tt.capacity
+
+			rec := NewScaleAdvisor(cfg, NewMetrics()).recommend(2, tt.current, tt.base)
+			if rec.RecommendedWorkers != tt.want {
+				t.Errorf("recommended %d workers, want %d (%+v)", rec.RecommendedWorkers, tt.want, rec)
+			}
+			if !strings.Contains(rec.Reason, tt.wantReason) {
+				t.Errorf("reason %q, want it to mention %q", rec.Reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestScaleAdvisorSamples(t *testing.T) {
+	cfg := &Config{}
+	cfg.Consumer.Scale.TargetLagMs = DefaultScaleTargetLagMs
+	cfg.Consumer.Scale.HorizonMs = DefaultScaleHorizonMs
+	cfg.Consumer.Scale.WindowMs = DefaultScaleWindowMs
+	metrics := NewMetrics()
+	metrics.LeaseAcquired(testShard)
+	advisor := NewScaleAdvisor(cfg, metrics)
+
+	start := time.Now()
+	metrics.SetMillisBehindLatest(testShard, 0)
+	if rec := advisor.Recommend(1, start); rec.SampleSeconds != 0 || rec.RecommendedWorkers != 1 {
+		t.Errorf("first request measured %+v, want nothing yet", rec)
+	}
+
+	// Ten seconds later the worker processed 100 records/sec while falling
+	// further behind at half a second per second
+	metrics.RecordsProcessed(testShard, 1000)
+	metrics.SetMillisBehindLatest(testShard, 5000)
+	rec := advisor.Recommend(1, start.Add(10*time.Second))
+	if rec.SampleSeconds != 10 || rec.ProcessingRate != 100 || rec.IncomingRate != 200 {
+		t.Errorf("measured %+v, want 100 processed and 200 incoming records/sec over 10s", rec)
+	}
+	if rec.Shards != 1 || rec.RecommendedWorkers != 1 {
+		t.Errorf("recommended %d workers for %d shards, want at most one per shard", rec.RecommendedWorkers, rec.Shards)
+	}
+
+	// Once the first sample is outside the window, rates start over
+	if rec := advisor.Recommend(1, start.Add(10*time.Second+time.Duration(DefaultScaleWindowMs)*time.Millisecond)); rec.SampleSeconds != float64(DefaultScaleWindowMs)/1000 {
+		t.Errorf("measured over %vs, want the window from the second sample", rec.SampleSeconds)
+	}
+}
+
+func TestHandleScaleRecommendation(t *testing.T) {
+	handler := handleScaleRecommendation(NewScaleAdvisor(&Config{}, NewMetrics()))
+	for query, want := range map[string]int{"": http.StatusOK, "?workers=3": http.StatusOK, "?workers=0": http.StatusBadRequest, "?workers=x": http.StatusBadRequest} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/scale-recommendation"+query, nil))
+		if w.Code != want {
+			t.Errorf("GET /scale-recommendation%s answered %d, want %d", query, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// Defaults for consumer.shard_leases
+const (
+	DefaultShardLeaseDurationMs      = 30000
+	DefaultShardLeaseRenewIntervalMs = 10000
+)
+
+// Attributes of a shard lease row
+const (
+	leaseShardKey      = "ShardID"
+	leaseOwnerKey      = "Owner"
+	leaseExpiryKey     = "LeaseExpiry" // Unix milliseconds
+	leaseCheckpointKey = "Checkpoint"
+)
+
+var (
+	// ErrLeaseLost stops a shard whose lease another worker took or that
+	// expired before it could be renewed: nothing more may be handled or
+	// checkpointed for it
+	ErrLeaseLost = errors.New("shard lease lost")
+
+	// errLeaseHandedOver stops a shard this worker gives up so a worker
+	// holding fewer shards can take it; it drains like on shutdown
+	errLeaseHandedOver = errors.New("shard lease handed over")
+)
+
+// validateShardLeases checks consumer.shard_leases against the rest of the
+// config, since leased shards start and stop while running
+func validateShardLeases(cfg *Config, model string) error {
+	leases := cfg.Consumer.ShardLeases
+	if leases.Table == "" {
+		return nil
+	}
+	switch {
+	case model != ExecutionModelGoroutinePerShard || cfg.Consumer.ShardPromotionRPS > 0:
+		return fmt.Errorf("consumer.shard_leases requires the %s execution model without shard_promotion_rps",
+			ExecutionModelGoroutinePerShard)
+	case cfg.Consumer.DetectOverlap != DetectOverlapOff:
+		return fmt.Errorf("consumer.shard_leases can't be combined with detect_overlap, leases already keep shards to one worker")
+	case cfg.Consumer.FollowChildShards || cfg.Consumer.ShardScanIntervalMs > 0:
+		return fmt.Errorf("consumer.shard_leases can't be combined with follow_child_shards or shard_scan_interval_ms, leasing finds new shards itself")
+	case leases.RenewIntervalMs >= leases.DurationMs:
+		return fmt.Errorf("consumer.shard_leases.renew_interval_ms (%d) must be below duration_ms (%d)",
+			leases.RenewIntervalMs, leases.DurationMs)
+	}
+	return nil
+}
+
+// shardLease is a shard this worker holds a lease on
+type shardLease struct {
+	expiry     time.Time
+	checkpoint string // last processed sequence number, written with every renewal
+	cancel     context.CancelCauseFunc
+	child      bool // created by a reshard whose parents are still in the stream
+	releasing  bool // handed over, the shard is draining
+	lost       bool
+}
+
+// leaseSurvey is the state of the lease table for one stream
+type leaseSurvey struct {
+	open     []*kinesis.Shard  // open shards this worker may lease, in shard ID order
+	parents  map[string]bool   // shards still in the stream, to tell children of a reshard
+	owners   map[string]string // live owner of each leased shard
+	held     map[string]int    // shards held by each live worker
+	previous map[string]string // owner in every shard row, live or expired
+}
+
+// ShardLeases shares a stream's shards among manual-mode workers through a
+// DynamoDB table holding, per shard, its owner, when its lease expires and
+// the sequence number it was checkpointed at, and a row per live worker.
+// Every renew_interval_ms a worker heartbeats its row, renews its leases,
+// claims unowned or expired shards up to its fair share of the open shards
+// among the live workers, and hands over shards above it to a worker holding
+// fewer, so adding or removing a worker rebalances the stream without
+// editing assigned_shards. A shard resumes after the checkpoint its previous
+// owner left in the table. A nil *ShardLeases leases nothing.
+type ShardLeases struct {
+	client     dynamodbiface.DynamoDBAPI
+	kinesis    *kinesis.Kinesis
+	tableName  string
+	streamName string
+	labels     shardLabeler
+	workerID   string
+	duration   time.Duration
+	interval   time.Duration
+	owns       func(shardID string) bool
+
+	last *leaseSurvey // the survey of the last claim, owned by run
+
+	mu   sync.Mutex
+	held map[string]*shardLease
+}
+
+// NewShardLeases returns nil unless consumer.shard_leases.table is set, and
+// creates the table if it does not exist yet. Only shards owns accepts are
+// leased.
+func NewShardLeases(cfg *Config, kinesisClient *kinesis.Kinesis, owns func(shardID string) bool) (*ShardLeases, error) {
+	leases := cfg.Consumer.ShardLeases
+	if leases.Table == "" {
+		return nil, nil
+	}
+	if err := validateTableName(leases.Table); err != nil {
+		return nil, err
+	}
+	sess, err := newAWSSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client := dynamodb.New(sess)
+	if err := ensureTable(client, leases.Table, leaseShardKey); err != nil {
+		return nil, err
+	}
+	log.Printf("Leasing shards from table %s: leases last %v, renewed every %v",
+		leases.Table, time.Duration(leases.DurationMs)*time.Millisecond, time.Duration(leases.RenewIntervalMs)*time.Millisecond)
+	return &ShardLeases{
+		client:     client,
+		kinesis:    kinesisClient,
+		tableName:  leases.Table,
+		streamName: cfg.Kinesis.StreamName,
+		labels:     newShardLabeler(cfg),
+		workerID:   cfg.Consumer.WorkerID,
+		duration:   time.Duration(leases.DurationMs) * time.Millisecond,
+		interval:   time.Duration(leases.RenewIntervalMs) * time.Millisecond,
+		owns:       owns,
+		held:       make(map[string]*shardLease),
+	}, nil
+}
+
+// key scopes a shard ID to the stream, since shard IDs repeat across streams
+func (sl *ShardLeases) key(shardID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{leaseShardKey: {S: aws.String(sl.streamName + "/" + shardID)}}
+}
+
+// workerPrefix starts the keys of the rows live workers of the stream keep
+// alive, so a worker holding no shards yet still counts towards the fair
+// share and is handed shards
+func (sl *ShardLeases) workerPrefix() string {
+	return "workers/" + sl.streamName + "/"
+}
+
+// heartbeat keeps this worker's row alive for another lease duration
+func (sl *ShardLeases) heartbeat() error {
+	_, err := sl.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(sl.tableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			leaseShardKey:  {S: aws.String(sl.workerPrefix() + sl.workerID)},
+			leaseOwnerKey:  {S: aws.String(sl.workerID)},
+			leaseExpiryKey: millisAttr(time.Now().Add(sl.duration)),
+		},
+	})
+	return err
+}
+
+// leave deletes this worker's row, so the others take its shards over
+// without waiting for it to expire
+func (sl *ShardLeases) leave() {
+	_, err := sl.client.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(sl.tableName),
+		Key:       map[string]*dynamodb.AttributeValue{leaseShardKey: {S: aws.String(sl.workerPrefix() + sl.workerID)}},
+	})
+	if err != nil {
+		log.Printf("Failed to remove worker %s from lease table: %v", sl.workerID, err)
+	}
+}
+
+// run renews, claims and hands over leases every renew_interval_ms until ctx
+// is cancelled, then leaves. start launches a processor for a newly claimed
+// shard under the given context, which is cancelled with ErrLeaseLost or
+// errLeaseHandedOver when the lease goes; the processor must call Finished
+// once it stops.
+func (sl *ShardLeases) run(ctx context.Context, wg *sync.WaitGroup, start func(ctx context.Context, shardID string, child bool)) {
+	defer wg.Done()
+	defer sl.leave()
+	ticker := time.NewTicker(sl.interval)
+	defer ticker.Stop()
+	for {
+		if err := sl.heartbeat(); err != nil {
+			log.Printf("Failed to heartbeat in lease table, retrying in %v: %v", sl.interval, err)
+		}
+		sl.renew()
+		if ctx.Err() != nil {
+			return
+		}
+		claimed, err := sl.claimShards(sl.workerID)
+		if err != nil {
+			log.Printf("Failed to claim shard leases, retrying in %v: %v", sl.interval, err)
+		}
+		for _, shardID := range claimed {
+			shardCtx, cancel := context.WithCancelCause(ctx)
+			sl.mu.Lock()
+			lease := sl.held[shardID]
+			lease.cancel = cancel
+			sl.mu.Unlock()
+			start(shardCtx, shardID, lease.child)
+		}
+		sl.handOver()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// claimShards claims, for workerID, unowned or expired shards up to its fair
+// share of the stream's open shards, and returns the shards it claimed
+func (sl *ShardLeases) claimShards(workerID string) ([]string, error) {
+	survey, err := sl.survey()
+	if err != nil {
+		return nil, err
+	}
+	sl.last = survey
+	return sl.claim(survey, workerID)
+}
+
+// survey lists the stream's open shards and reads the lease table
+func (sl *ShardLeases) survey() (*leaseSurvey, error) {
+	shards, err := listShards(sl.kinesis, sl.streamName)
+	if err != nil {
+		return nil, err
+	}
+	survey := &leaseSurvey{
+		parents:  make(map[string]bool),
+		owners:   make(map[string]string),
+		held:     map[string]int{sl.workerID: 0},
+		previous: make(map[string]string),
+	}
+	inStream := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		inStream[aws.StringValue(shard.ShardId)] = true
+	}
+	for _, shard := range shards {
+		shardID := aws.StringValue(shard.ShardId)
+		open := shard.SequenceNumberRange == nil || shard.SequenceNumberRange.EndingSequenceNumber == nil
+		if open && sl.owns(shardID) {
+			survey.open = append(survey.open, shard)
+			survey.parents[shardID] = inStream[aws.StringValue(shard.ParentShardId)] || inStream[aws.StringValue(shard.AdjacentParentShardId)]
+		}
+	}
+	sort.Slice(survey.open, func(i, j int) bool {
+		return aws.StringValue(survey.open[i].ShardId) < aws.StringValue(survey.open[j].ShardId)
+	})
+
+	prefix, workers := sl.streamName+"/", sl.workerPrefix()
+	now := time.Now()
+	err = sl.client.ScanPages(&dynamodb.ScanInput{
+		TableName:      aws.String(sl.tableName),
+		ConsistentRead: aws.Bool(true),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			key := stringAttr(item, leaseShardKey)
+			if strings.HasPrefix(key, workers) {
+				worker := stringAttr(item, leaseOwnerKey)
+				if _, counted := survey.held[worker]; !counted && leaseExpiry(item).After(now) {
+					survey.held[worker] = 0
+				}
+				continue
+			}
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			shardID, owner := strings.TrimPrefix(key, prefix), stringAttr(item, leaseOwnerKey)
+			survey.previous[shardID] = owner
+			if owner != "" && leaseExpiry(item).After(now) {
+				survey.owners[shardID] = owner
+				survey.held[owner]++
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan lease table %s: %w", sl.tableName, err)
+	}
+	return survey, nil
+}
+
+// fairShare returns the fewest and most shards a live worker should hold
+func (s *leaseSurvey) fairShare() (int, int) {
+	workers := len(s.held)
+	return len(s.open) / workers, (len(s.open) + workers - 1) / workers
+}
+
+// starved reports whether a live worker other than workerID holds fewer
+// than its fair share
+func (s *leaseSurvey) starved(workerID string) bool {
+	floor, _ := s.fairShare()
+	for owner, held := range s.held {
+		if owner != workerID && held < floor {
+			return true
+		}
+	}
+	return false
+}
+
+// claim takes unowned or expired shards for workerID, up to the most a
+// worker should hold, or only up to the fewest while another worker is
+// below it so the shards handed over reach that worker
+func (sl *ShardLeases) claim(survey *leaseSurvey, workerID string) ([]string, error) {
+	floor, ceiling := survey.fairShare()
+	limit := ceiling
+	if survey.starved(workerID) {
+		limit = floor
+	}
+
+	sl.mu.Lock()
+	holding := sl.holding()
+	sl.mu.Unlock()
+	var claimed []string
+	for _, shard := range survey.open {
+		if holding >= limit {
+			break
+		}
+		shardID := aws.StringValue(shard.ShardId)
+		sl.mu.Lock()
+		leased := sl.held[shardID] != nil
+		sl.mu.Unlock()
+		if leased {
+			continue
+		}
+		if owner, ok := survey.owners[shardID]; ok && owner != workerID {
+			continue
+		}
+
+		expiry := time.Now().Add(sl.duration)
+		output, err := sl.client.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:           aws.String(sl.tableName),
+			Key:                 sl.key(shardID),
+			UpdateExpression:    aws.String("SET #owner = :me, #expiry = :expiry"),
+			ConditionExpression: aws.String("attribute_not_exists(#owner) OR #owner = :me OR #expiry < :now"),
+			ExpressionAttributeNames: map[string]*string{
+				"#owner":  aws.String(leaseOwnerKey),
+				"#expiry": aws.String(leaseExpiryKey),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":me":     {S: aws.String(workerID)},
+				":expiry": millisAttr(expiry),
+				":now":    millisAttr(time.Now()),
+			},
+			ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+		})
+		if isConditionalCheckFailed(err) {
+			// Another worker claimed it since the survey
+			continue
+		}
+		if err != nil {
+			return claimed, fmt.Errorf("failed to claim shard %s: %w", shardID, err)
+		}
+
+		checkpoint := stringAttr(output.Attributes, leaseCheckpointKey)
+		sl.mu.Lock()
+		sl.held[shardID] = &shardLease{expiry: expiry, checkpoint: checkpoint, child: survey.parents[shardID]}
+		sl.mu.Unlock()
+		claimed = append(claimed, shardID)
+		holding++
+		if previous := survey.previous[shardID]; previous != "" && previous != workerID {
+			log.Printf("[%s] Claimed the expired shard lease of %s, resuming after %s",
+				sl.labels.logLabel(shardID), previous, orNone(checkpoint))
+		} else {
+			log.Printf("[%s] Claimed shard lease, resuming after %s", sl.labels.logLabel(shardID), orNone(checkpoint))
+		}
+	}
+	return claimed, nil
+}
+
+// holding counts the leases not being handed over; sl.mu must be held
+func (sl *ShardLeases) holding() int {
+	holding := 0
+	for _, lease := range sl.held {
+		if !lease.releasing && !lease.lost {
+			holding++
+		}
+	}
+	return holding
+}
+
+// handOver gives up the shards held above the fair share while another
+// worker is below it, or above the most a worker should hold, as of the
+// last claim. The shards drain and Finished releases their leases for the
+// other worker to claim.
+func (sl *ShardLeases) handOver() {
+	survey := sl.last
+	if survey == nil {
+		return
+	}
+	floor, ceiling := survey.fairShare()
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	excess := sl.holding() - ceiling
+	if survey.starved(sl.workerID) {
+		excess = sl.holding() - floor
+	}
+	if excess <= 0 {
+		return
+	}
+
+	shardIDs := make([]string, 0, len(sl.held))
+	for shardID, lease := range sl.held {
+		if !lease.releasing && !lease.lost && lease.cancel != nil {
+			shardIDs = append(shardIDs, shardID)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(shardIDs)))
+	for _, shardID := range shardIDs[:min(excess, len(shardIDs))] {
+		log.Printf("[%s] Handing the shard lease over to rebalance %d open shards among %d workers",
+			sl.labels.logLabel(shardID), len(survey.open), len(survey.held))
+		sl.held[shardID].releasing = true
+		sl.held[shardID].cancel(errLeaseHandedOver)
+	}
+}
+
+// renew extends every lease this worker holds, writing the checkpoint with
+// it. A lease another worker took, or one past its expiry, is lost and its
+// shard stopped.
+func (sl *ShardLeases) renew() {
+	sl.mu.Lock()
+	checkpoints := make(map[string]string, len(sl.held))
+	for shardID, lease := range sl.held {
+		if !lease.lost {
+			checkpoints[shardID] = lease.checkpoint
+		}
+	}
+	sl.mu.Unlock()
+
+	for shardID, checkpoint := range checkpoints {
+		expiry := time.Now().Add(sl.duration)
+		_, err := sl.client.UpdateItem(sl.leaseUpdate(shardID, "SET #expiry = :expiry", expiry, checkpoint))
+		sl.mu.Lock()
+		lease := sl.held[shardID]
+		switch {
+		case lease == nil:
+			// Finished while being renewed
+		case err == nil:
+			lease.expiry = expiry
+		case isConditionalCheckFailed(err):
+			log.Printf("[%s] ALERT: shard lease taken by another worker, stopping the shard", sl.labels.logLabel(shardID))
+			sl.lose(lease)
+		case time.Now().After(lease.expiry):
+			log.Printf("[%s] ALERT: shard lease expired before it could be renewed, stopping the shard: %v",
+				sl.labels.logLabel(shardID), err)
+			sl.lose(lease)
+		default:
+			log.Printf("[%s] Failed to renew shard lease, retrying in %v: %v", sl.labels.logLabel(shardID), sl.interval, err)
+		}
+		sl.mu.Unlock()
+	}
+}
+
+// leaseUpdate is an update of a lease this worker owns, setting its expiry
+// and, when there is one, its checkpoint
+func (sl *ShardLeases) leaseUpdate(shardID, update string, expiry time.Time, checkpoint string) *dynamodb.UpdateItemInput {
+	names := map[string]*string{"#owner": aws.String(leaseOwnerKey), "#expiry": aws.String(leaseExpiryKey)}
+	values := map[string]*dynamodb.AttributeValue{
+		":me":     {S: aws.String(sl.workerID)},
+		":expiry": millisAttr(expiry),
+	}
+	if checkpoint != "" {
+		update += ", #checkpoint = :checkpoint"
+		names["#checkpoint"] = aws.String(leaseCheckpointKey)
+		values[":checkpoint"] = &dynamodb.AttributeValue{S: aws.String(checkpoint)}
+	}
+	return &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(sl.tableName),
+		Key:                       sl.key(shardID),
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("#owner = :me"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}
+}
+
+// lose stops the shard of a lost lease; sl.mu must be held
+func (sl *ShardLeases) lose(lease *shardLease) {
+	lease.lost = true
+	if lease.cancel != nil {
+		lease.cancel(ErrLeaseLost)
+	}
+}
+
+// Resume returns the sequence number the shard was checkpointed at in the
+// lease table when this worker claimed it, or "" if it has none
+func (sl *ShardLeases) Resume(shardID string) string {
+	if sl == nil {
+		return ""
+	}
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if lease := sl.held[shardID]; lease != nil {
+		return lease.checkpoint
+	}
+	return ""
+}
+
+// Processed records the shard's checkpoint, written to the lease table with
+// the next renewal and when the lease is released
+func (sl *ShardLeases) Processed(shardID, sequenceNumber string) {
+	if sl == nil || sequenceNumber == "" {
+		return
+	}
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if lease := sl.held[shardID]; lease != nil {
+		lease.checkpoint = sequenceNumber
+	}
+}
+
+// Finished releases the lease of a shard whose processor stopped, leaving
+// its checkpoint for the next owner, unless the lease was lost
+func (sl *ShardLeases) Finished(shardID string) {
+	if sl == nil {
+		return
+	}
+	sl.mu.Lock()
+	lease := sl.held[shardID]
+	delete(sl.held, shardID)
+	sl.mu.Unlock()
+	if lease == nil {
+		return
+	}
+	if lease.cancel != nil {
+		lease.cancel(nil)
+	}
+	if lease.lost {
+		return
+	}
+
+	_, err := sl.client.UpdateItem(sl.leaseUpdate(shardID, "REMOVE #owner SET #expiry = :expiry", time.Time{}, lease.checkpoint))
+	switch {
+	case err == nil:
+		log.Printf("[%s] Released shard lease at %s", sl.labels.logLabel(shardID), orNone(lease.checkpoint))
+	case isConditionalCheckFailed(err):
+	default:
+		log.Printf("[%s] Failed to release shard lease, it expires in %v: %v",
+			sl.labels.logLabel(shardID), time.Until(lease.expiry).Round(time.Second), err)
+	}
+}
+
+func isConditionalCheckFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+func millisAttr(t time.Time) *dynamodb.AttributeValue {
+	var millis int64
+	if !t.IsZero() {
+		millis = t.UnixMilli()
+	}
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(millis, 10))}
+}
+
+func leaseExpiry(item map[string]*dynamodb.AttributeValue) time.Time {
+	value, ok := item[leaseExpiryKey]
+	if !ok || value == nil {
+		return time.Time{}
+	}
+	millis, err := strconv.ParseInt(aws.StringValue(value.N), 10, 64)
+	if err != nil || millis == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(millis)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// testLeaseSurvey returns a survey of n open shards, shard-0 to shard-<n-1>,
+// with the given live workers and the shards each holds
+func testLeaseSurvey(n int, held map[string]int, owners map[string]string) *leaseSurvey {
+	survey := &leaseSurvey{parents: map[string]bool{}, owners: owners, held: held, previous: map[string]string{}}
+	if survey.owners == nil {
+		survey.owners = map[string]string{}
+	}
+	for i := range n {
+		survey.open = append(survey.open, &kinesis.Shard{ShardId: aws.String(fmt.Sprintf("shard-%d", i))})
+	}
+	return survey
+}
+
+func TestLeaseFairShare(t *testing.T) {
+	tests := []struct {
+		name        string
+		open        int
+		held        map[string]int
+		wantFloor   int
+		wantCeiling int
+		wantStarved bool // whether a worker other than worker-1 is starved
+	}{
+		{name: "alone", open: 3, held: map[string]int{"worker-1": 0}, wantFloor: 3, wantCeiling: 3},
+		{name: "even split, other worker empty", open: 4, held: map[string]int{"worker-1": 4, "worker-2": 0}, wantFloor: 2, wantCeiling: 2, wantStarved: true},
+		{name: "even split, balanced", open: 4, held: map[string]int{"worker-1": 2, "worker-2": 2}, wantFloor: 2, wantCeiling: 2},
+		{name: "uneven split", open: 5, held: map[string]int{"worker-1": 3, "worker-2": 2}, wantFloor: 2, wantCeiling: 3},
+		{name: "uneven split, other worker below the floor", open: 5, held: map[string]int{"worker-1": 4, "worker-2": 1}, wantFloor: 2, wantCeiling: 3, wantStarved: true},
+		{name: "more workers than shards", open: 2, held: map[string]int{"worker-1": 1, "worker-2": 1, "worker-3": 0}, wantFloor: 0, wantCeiling: 1},
+		{name: "only this worker below the floor", open: 4, held: map[string]int{"worker-1": 0, "worker-2": 4}, wantFloor: 2, wantCeiling: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			survey := testLeaseSurvey(tt.open, tt.held, nil)
+			floor, ceiling := survey.fairShare()
+			if floor != tt.wantFloor || ceiling != tt.wantCeiling {
+				t.Errorf("fairShare() = %d, %d; want %d, %d", floor, ceiling, tt.wantFloor, tt.wantCeiling)
+			}
+			if got := survey.starved("worker-1"); got != tt.wantStarved {
+				t.Errorf("starved() = %t, want %t", got, tt.wantStarved)
+			}
+		})
+	}
+}
+
+// fakeShardLeaseTable is a shard lease table holding the owner of each
+// shard row, applying claims the way the conditional update does
+type fakeShardLeaseTable struct {
+	dynamodbiface.DynamoDBAPI
+	mu     sync.Mutex
+	owners map[string]string // owner of each row with a live lease
+}
+
+func (f *fakeShardLeaseTable) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := aws.StringValue(input.Key[leaseShardKey].S)
+	me := aws.StringValue(input.ExpressionAttributeValues[":me"].S)
+	if owner := f.owners[key]; owner != "" && owner != me {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+	}
+	f.owners[key] = me
+	return &dynamodb.UpdateItemOutput{Attributes: map[string]*dynamodb.AttributeValue{
+		leaseShardKey:      {S: aws.String(key)},
+		leaseCheckpointKey: {S: aws.String("checkpoint-of-" + key)},
+	}}, nil
+}
+
+// newTestShardLeases returns the leases of worker-1 on testStream, holding
+// the given shards
+func newTestShardLeases(client dynamodbiface.DynamoDBAPI, held ...string) *ShardLeases {
+	sl := &ShardLeases{
+		client:     client,
+		tableName:  "leases",
+		streamName: testStream,
+		workerID:   "worker-1",
+		duration:   time.Minute,
+		held:       make(map[string]*shardLease),
+	}
+	for _, shardID := range held {
+		_, cancel := context.WithCancelCause(context.Background())
+		sl.held[shardID] = &shardLease{expiry: time.Now().Add(time.Minute), cancel: cancel}
+	}
+	return sl
+}
+
+func TestShardLeasesClaim(t *testing.T) {
+	tests := []struct {
+		name    string
+		open    int
+		held    map[string]int    // live workers in the survey
+		owners  map[string]string // live owners in the survey
+		taken   []string          // shards another worker claimed since the survey
+		holding []string          // shards worker-1 holds already
+		want    []string
+	}{
+		{
+			name: "alone claims every shard",
+			open: 4, held: map[string]int{"worker-1": 0},
+			want: []string{"shard-0", "shard-1", "shard-2", "shard-3"},
+		},
+		{
+			name: "another worker below the floor leaves it room",
+			open: 5, held: map[string]int{"worker-1": 0, "worker-2": 0},
+			want: []string{"shard-0", "shard-1"},
+		},
+		{
+			name: "up to the ceiling once the others have their share",
+			open: 5, held: map[string]int{"worker-1": 0, "worker-2": 2},
+			owners: map[string]string{"shard-0": "worker-2", "shard-1": "worker-2"},
+			want:   []string{"shard-2", "shard-3", "shard-4"},
+		},
+		{
+			name: "shards held count towards the share",
+			open: 4, held: map[string]int{"worker-1": 1, "worker-2": 2},
+			owners:  map[string]string{"shard-0": "worker-1", "shard-1": "worker-2", "shard-2": "worker-2"},
+			holding: []string{"shard-0"},
+			want:    []string{"shard-3"},
+		},
+		{
+			name: "shard claimed by another worker since the survey skipped",
+			open: 4, held: map[string]int{"worker-1": 0},
+			taken: []string{"shard-1"},
+			want:  []string{"shard-0", "shard-2", "shard-3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &fakeShardLeaseTable{owners: make(map[string]string)}
+			for shardID, owner := range tt.owners {
+				table.owners[testStream+"/"+shardID] = owner
+			}
+			for _, shardID := range tt.taken {
+				table.owners[testStream+"/"+shardID] = "worker-3"
+			}
+			sl := newTestShardLeases(table, tt.holding...)
+
+			claimed, err := sl.claim(testLeaseSurvey(tt.open, tt.held, tt.owners), "worker-1")
+			if err != nil {
+				t.Fatalf("claim() = %v", err)
+			}
+			if fmt.Sprint(claimed) != fmt.Sprint(tt.want) {
+				t.Errorf("claimed %v, want %v", claimed, tt.want)
+			}
+			for _, shardID := range claimed {
+				if got := sl.held[shardID].checkpoint; got != "checkpoint-of-"+testStream+"/"+shardID {
+					t.Errorf("%s resumes after %q, want the checkpoint in the table", shardID, got)
+				}
+			}
+		})
+	}
+}
+
+func TestShardLeasesHandOver(t *testing.T) {
+	tests := []struct {
+		name      string
+		holding   []string
+		releasing []string // leases already being handed over
+		held      map[string]int
+		want      []string
+	}{
+		{
+			name:    "above the floor while another worker is starved",
+			holding: []string{"shard-0", "shard-1", "shard-2", "shard-3"},
+			held:    map[string]int{"worker-1": 4, "worker-2": 0},
+			want:    []string{"shard-2", "shard-3"},
+		},
+		{
+			name:    "at the ceiling with nobody starved",
+			holding: []string{"shard-0", "shard-1", "shard-2"},
+			held:    map[string]int{"worker-1": 3, "worker-2": 2},
+		},
+		{
+			name:    "above the ceiling",
+			holding: []string{"shard-0", "shard-1", "shard-2", "shard-3"},
+			held:    map[string]int{"worker-1": 4, "worker-2": 2, "worker-3": 2},
+			want:    []string{"shard-3"},
+		},
+		{
+			name:      "leases already handed over not counted",
+			holding:   []string{"shard-0", "shard-1", "shard-2", "shard-3"},
+			releasing: []string{"shard-2", "shard-3"},
+			held:      map[string]int{"worker-1": 4, "worker-2": 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sl := newTestShardLeases(nil)
+			contexts := make(map[string]context.Context)
+			for _, shardID := range tt.holding {
+				ctx, cancel := context.WithCancelCause(context.Background())
+				contexts[shardID] = ctx
+				sl.held[shardID] = &shardLease{cancel: cancel}
+			}
+			for _, shardID := range tt.releasing {
+				sl.held[shardID].releasing = true
+			}
+			open := 0
+			for _, held := range tt.held {
+				open += held
+			}
+			sl.last = testLeaseSurvey(open, tt.held, nil)
+
+			sl.handOver()
+			var handedOver []string
+			for shardID, ctx := range contexts {
+				if errors.Is(context.Cause(ctx), errLeaseHandedOver) {
+					handedOver = append(handedOver, shardID)
+				}
+			}
+			sort.Strings(handedOver)
+			if fmt.Sprint(handedOver) != fmt.Sprint(tt.want) {
+				t.Errorf("handed over %v, want %v", handedOver, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/kds-rebalance/internal/hashrange"
+)
+
+// ShardMap caches the hash key ranges of the stream's open shards to tell
+// which shard a partition key lands on, the way Kinesis does: the key's MD5
+// digest read as a 128-bit integer falls inside exactly one open shard's
+// range. At most every refresh interval the open shard count is compared
+// with the cached ranges, and the ranges are listed again after a split,
+// merge or scaling changed it.
+type ShardMap struct {
+	client     *kinesis.Kinesis
+	streamName string
+	refresh    time.Duration // 0 never checks once loaded
+
+	mu      sync.Mutex
+	ranges  hashrange.Ranges
+	checked time.Time
+}
+
+// NewShardMap creates a map of the stream, loaded on first use
+func NewShardMap(client *kinesis.Kinesis, streamName string, refresh time.Duration) *ShardMap {
+	return &ShardMap{client: client, streamName: streamName, refresh: refresh}
+}
+
+// ShardForKey returns the ID of the open shard the partition key maps to
+func (m *ShardMap) ShardForKey(partitionKey string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.check(); err != nil {
+		return "", err
+	}
+	hash := hashrange.HashKey(partitionKey)
+	if shardID, ok := m.ranges.Lookup(hash); ok {
+		return shardID, nil
+	}
+	// A gap in the ranges means they were listed mid-reshard
+	if err := m.load(); err != nil {
+		return "", err
+	}
+	if shardID, ok := m.ranges.Lookup(hash); ok {
+		return shardID, nil
+	}
+	return "", fmt.Errorf("no open shard of %s covers hash key %s", m.streamName, hash)
+}
+
+// check loads the ranges if they are not cached, and reloads them when the
+// refresh interval passed and the open shard count changed
+func (m *ShardMap) check() error {
+	if m.ranges == nil {
+		return m.load()
+	}
+	if m.refresh <= 0 || time.Since(m.checked) < m.refresh {
+		return nil
+	}
+	output, err := m.client.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(m.streamName),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe stream: %w", err)
+	}
+	m.checked = time.Now()
+	if int(aws.Int64Value(output.StreamDescriptionSummary.OpenShardCount)) == len(m.ranges) {
+		return nil
+	}
+	return m.load()
+}
+
+// load lists the open shards and caches their ranges
+func (m *ShardMap) load() error {
+	shards, err := listShards(m.client, m.streamName)
+	if err != nil {
+		return err
+	}
+	var open []hashrange.Shard
+	for _, shard := range shards {
+		info := newShardInfo(shard)
+		if info.Open {
+			open = append(open, hashrange.Shard{ShardID: info.ShardID, StartingHashKey: info.StartingHashKey, EndingHashKey: info.EndingHashKey})
+		}
+	}
+	ranges, err := hashrange.New(open)
+	if err != nil {
+		return err
+	}
+
+	m.ranges = ranges
+	m.checked = time.Now()
+	return nil
+}
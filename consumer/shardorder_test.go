@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestOrderShardStart(t *testing.T) {
+	shard := func(i int) string { return fmt.Sprintf("shardId-%012d", i) }
+	// Shard 1 has the oldest unread data and shard 0 the newest; shard 3
+	// is not in the stream, so its lag can't be measured
+	client := newFakeKinesis(testStream, shard(0), shard(1), shard(2))
+	for _, i := range []int{1, 2, 0} {
+		client.AddRecords(t, shard(i), "user_1", testEvents(0, 2)...)
+		time.Sleep(20 * time.Millisecond)
+	}
+	assigned := []string{shard(2), shard(3), shard(0), shard(1)}
+
+	tests := []struct {
+		order string
+		want  []string
+	}{
+		{order: ShardStartAsAssigned, want: assigned},
+		{order: ShardStartLexical, want: []string{shard(0), shard(1), shard(2), shard(3)}},
+		{order: ShardStartOldestDataFirst, want: []string{shard(1), shard(2), shard(0), shard(3)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.ShardStartOrder = tt.order
+			if err := validateShardStartOrder(cfg); err != nil {
+				t.Fatal(err)
+			}
+			var processors []*ManualShardProcessor
+			for _, shardID := range assigned {
+				msp := newTestProcessor(client, cfg)
+				msp.shardID, msp.label = shardID, shardID
+				processors = append(processors, msp)
+			}
+
+			orderShardStart(cfg, processors)
+			var got []string
+			for _, msp := range processors {
+				got = append(got, msp.shardID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("shards start in order %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	cfg := &Config{}
+	cfg.Consumer.ShardStartOrder = "newest_data_first"
+	if err := validateShardStartOrder(cfg); err == nil {
+		t.Error("validateShardStartOrder() accepted newest_data_first")
+	}
+}
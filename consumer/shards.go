@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/kds-rebalance/internal/hashrange"
+)
+
+// ShardInfo is the diagnostic view of a shard printed by the shards command
+type ShardInfo struct {
+	ShardID                string `json:"shard_id"`
+	ParentShardID          string `json:"parent_shard_id,omitempty"`
+	AdjacentParentShardID  string `json:"adjacent_parent_shard_id,omitempty"`
+	StartingHashKey        string `json:"starting_hash_key"`
+	EndingHashKey          string `json:"ending_hash_key"`
+	StartingSequenceNumber string `json:"starting_sequence_number"`
+	EndingSequenceNumber   string `json:"ending_sequence_number,omitempty"`
+	Open                   bool   `json:"open"`
+}
+
+// listShards returns every shard of the stream, following ListShards pagination
+func listShards(client KinesisAPI, streamName string) ([]*kinesis.Shard, error) {
+	var shards []*kinesis.Shard
+	input := &kinesis.ListShardsInput{StreamName: aws.String(streamName)}
+
+	for {
+		output, err := client.ListShards(input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list shards: %w", err)
+		}
+		shards = append(shards, output.Shards...)
+
+		if output.NextToken == nil {
+			return shards, nil
+		}
+		// NextToken and StreamName are mutually exclusive
+		input = &kinesis.ListShardsInput{NextToken: output.NextToken}
+	}
+}
+
+// newShardInfo converts a Kinesis shard into its diagnostic view
+func newShardInfo(shard *kinesis.Shard) ShardInfo {
+	info := ShardInfo{
+		ShardID:               aws.StringValue(shard.ShardId),
+		ParentShardID:         aws.StringValue(shard.ParentShardId),
+		AdjacentParentShardID: aws.StringValue(shard.AdjacentParentShardId),
+	}
+	if shard.HashKeyRange != nil {
+		info.StartingHashKey = aws.StringValue(shard.HashKeyRange.StartingHashKey)
+		info.EndingHashKey = aws.StringValue(shard.HashKeyRange.EndingHashKey)
+	}
+	if shard.SequenceNumberRange != nil {
+		info.StartingSequenceNumber = aws.StringValue(shard.SequenceNumberRange.StartingSequenceNumber)
+		info.EndingSequenceNumber = aws.StringValue(shard.SequenceNumberRange.EndingSequenceNumber)
+	}
+	info.Open = info.EndingSequenceNumber == ""
+	return info
+}
+
+// runShardsCommand prints the hash-key and sequence ranges of every shard in
+// the stream, or with partition keys as arguments the open shard each maps to
+func runShardsCommand(cfg *Config, args []string) error {
+	fs := flag.NewFlagSet("shards", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print shards as JSON instead of a table")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	kinesisClient, err := newKinesisClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() > 0 {
+		return printKeyShards(NewShardMap(kinesisClient, cfg.Kinesis.StreamName, 0), fs.Args(), *asJSON)
+	}
+
+	shards, err := listShards(kinesisClient, cfg.Kinesis.StreamName)
+	if err != nil {
+		return err
+	}
+
+	infos := make([]ShardInfo, 0, len(shards))
+	for _, shard := range shards {
+		infos = append(infos, newShardInfo(shard))
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(infos)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SHARD ID\tSTATE\tPARENT\tADJACENT PARENT\tSTARTING HASH KEY\tENDING HASH KEY\tSTARTING SEQ\tENDING SEQ")
+	for _, info := range infos {
+		state := "CLOSED"
+		if info.Open {
+			state = "OPEN"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			info.ShardID, state, dashIfEmpty(info.ParentShardID), dashIfEmpty(info.AdjacentParentShardID),
+			info.StartingHashKey, info.EndingHashKey, info.StartingSequenceNumber, dashIfEmpty(info.EndingSequenceNumber))
+	}
+	return w.Flush()
+}
+
+// KeyShard is the diagnostic view of where a partition key is placed
+type KeyShard struct {
+	PartitionKey string `json:"partition_key"`
+	HashKey      string `json:"hash_key"`
+	ShardID      string `json:"shard_id"`
+}
+
+// printKeyShards prints the hash key and open shard of each partition key
+func printKeyShards(shardMap *ShardMap, keys []string, asJSON bool) error {
+	placements := make([]KeyShard, 0, len(keys))
+	for _, key := range keys {
+		shardID, err := shardMap.ShardForKey(key)
+		if err != nil {
+			return err
+		}
+		placements = append(placements, KeyShard{PartitionKey: key, HashKey: hashrange.HashKey(key).String(), ShardID: shardID})
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(placements)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PARTITION KEY\tHASH KEY\tSHARD ID")
+	for _, placement := range placements {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", placement.PartitionKey, placement.HashKey, placement.ShardID)
+	}
+	return w.Flush()
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
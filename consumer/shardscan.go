@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// validateShardScan checks consumer.shard_scan_interval_ms against the
+// execution model, since only a goroutine per shard can start shards while
+// running
+func validateShardScan(cfg *Config, model string) error {
+	if cfg.Consumer.ShardScanIntervalMs <= 0 {
+		return nil
+	}
+	if model != ExecutionModelGoroutinePerShard || cfg.Consumer.ShardPromotionRPS > 0 {
+		return fmt.Errorf("consumer.shard_scan_interval_ms requires the %s execution model without shard_promotion_rps",
+			ExecutionModelGoroutinePerShard)
+	}
+	return nil
+}
+
+// assignShards resolves consumer.assigned_shards against the stream's
+// shards, returning the shards to read at startup and whether a shard
+// belongs to this worker. Empty assigned_shards means every open shard. An
+// assigned shard the stream doesn't have is an error, unless scans are on to
+// start it once a reshard creates it. With shard_leases, assigned_shards only
+// limits the shards the worker may lease.
+func assignShards(cfg *Config, shards []*kinesis.Shard) ([]string, func(shardID string) bool, error) {
+	leasing := cfg.Consumer.ShardLeases.Table != ""
+	if len(cfg.Consumer.AssignedShards) == 0 && leasing {
+		log.Printf("No assigned_shards, leasing from every open shard")
+		return nil, func(string) bool { return true }, nil
+	}
+	if len(cfg.Consumer.AssignedShards) == 0 {
+		var open []string
+		for _, shard := range shards {
+			if shard.SequenceNumberRange == nil || shard.SequenceNumberRange.EndingSequenceNumber == nil {
+				open = append(open, aws.StringValue(shard.ShardId))
+			}
+		}
+		log.Printf("No assigned_shards, reading all %d open shards: %v", len(open), open)
+		return open, func(string) bool { return true }, nil
+	}
+
+	availableShards := make(map[string]bool)
+	for _, shard := range shards {
+		availableShards[*shard.ShardId] = true
+	}
+	assigned := make(map[string]bool, len(cfg.Consumer.AssignedShards))
+	var present []string
+	for _, shardID := range cfg.Consumer.AssignedShards {
+		assigned[shardID] = true
+		switch {
+		case availableShards[shardID]:
+			present = append(present, shardID)
+		case cfg.Consumer.ShardScanIntervalMs > 0 || leasing:
+			log.Printf("[%s] Assigned shard does not exist in stream yet, it starts when a scan finds it", newShardLabeler(cfg).logLabel(shardID))
+		default:
+			return nil, nil, fmt.Errorf("assigned shard %s does not exist in stream", shardID)
+		}
+	}
+	log.Printf("Validated %d assigned shards against stream", len(present))
+	return present, func(shardID string) bool { return assigned[shardID] }, nil
+}
+
+// shardScanner lists the stream's shards every shard_scan_interval_ms and
+// starts the open shards this worker owns but doesn't read yet, such as
+// the shards an UpdateShardCount created after startup. A nil
+// *shardScanner scans nothing.
+type shardScanner struct {
+	client     KinesisAPI
+	streamName string
+	labels     shardLabeler
+	interval   time.Duration
+	owns       func(shardID string) bool
+	starter    *shardStarter
+}
+
+// newShardScanner returns nil unless consumer.shard_scan_interval_ms is set
+func newShardScanner(cfg *Config, client KinesisAPI, owns func(shardID string) bool, starter *shardStarter) *shardScanner {
+	if cfg.Consumer.ShardScanIntervalMs <= 0 {
+		return nil
+	}
+	return &shardScanner{
+		client:     client,
+		streamName: cfg.Kinesis.StreamName,
+		labels:     newShardLabeler(cfg),
+		interval:   time.Duration(cfg.Consumer.ShardScanIntervalMs) * time.Millisecond,
+		owns:       owns,
+		starter:    starter,
+	}
+}
+
+// run scans until ctx is cancelled
+func (s *shardScanner) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.scan()
+		}
+	}
+}
+
+// scan starts every open shard this worker owns and has no processor for
+func (s *shardScanner) scan() {
+	shards, err := listShards(s.client, s.streamName)
+	if err != nil {
+		log.Printf("Shard scan failed, retrying in %v: %v", s.interval, err)
+		return
+	}
+	for _, shard := range shards {
+		open := shard.SequenceNumberRange == nil || shard.SequenceNumberRange.EndingSequenceNumber == nil
+		if !open || !s.owns(aws.StringValue(shard.ShardId)) {
+			continue
+		}
+		if s.starter.startShard(shard) {
+			log.Printf("[%s] Shard scan found a new shard, started it", s.labels.logLabel(aws.StringValue(shard.ShardId)))
+		}
+	}
+}
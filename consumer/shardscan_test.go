@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAssignShards(t *testing.T) {
+	tests := []struct {
+		name         string
+		assigned     []string
+		scan         bool
+		leaseTable   string
+		wantErr      bool
+		wantAssigned string
+		wantOwns     string // shards owns reports true for among shard-a, shard-c and shard-x
+	}{
+		{name: "every open shard", wantAssigned: "[shard-a shard-c]", wantOwns: "[shard-a shard-c shard-x]"},
+		{name: "assigned shards", assigned: []string{"shard-c"}, wantAssigned: "[shard-c]", wantOwns: "[shard-c]"},
+		{name: "missing shard", assigned: []string{"shard-c", "shard-x"}, wantErr: true},
+		{name: "missing shard waits for a scan", assigned: []string{"shard-c", "shard-x"}, scan: true, wantAssigned: "[shard-c]", wantOwns: "[shard-c shard-x]"},
+		{name: "leasing every open shard", leaseTable: "leases", wantAssigned: "[]", wantOwns: "[shard-a shard-c shard-x]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeKinesis(testStream, "shard-a", "shard-b")
+			fake.CloseShard("shard-b")
+			fake.AddChildShard("shard-c", "shard-b")
+			shards, err := listShards(fake, testStream)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := &Config{}
+			cfg.Consumer.AssignedShards = tt.assigned
+			cfg.Consumer.ShardLeases.Table = tt.leaseTable
+			if tt.scan {
+				cfg.Consumer.ShardScanIntervalMs = 1000
+			}
+			assigned, owns, err := assignShards(cfg, shards)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("assignShards() = %v, want an error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if fmt.Sprint(assigned) != tt.wantAssigned {
+				t.Errorf("assignShards() = %v, want %s", assigned, tt.wantAssigned)
+			}
+			if fmt.Sprint(cfg.Consumer.AssignedShards) != fmt.Sprint(tt.assigned) {
+				t.Errorf("assigned_shards changed to %v", cfg.Consumer.AssignedShards)
+			}
+			var owned []string
+			for _, shardID := range []string{"shard-a", "shard-c", "shard-x"} {
+				if owns(shardID) {
+					owned = append(owned, shardID)
+				}
+			}
+			if fmt.Sprint(owned) != tt.wantOwns {
+				t.Errorf("owns %v, want %s", owned, tt.wantOwns)
+			}
+		})
+	}
+}
+
+func TestShardScanner(t *testing.T) {
+	fake := newFakeKinesis(testStream, "shard-a", "shard-b")
+	cfg := &Config{}
+	cfg.Kinesis.StreamName = testStream
+	cfg.Consumer.ShardScanIntervalMs = 1000
+	cfg.Consumer.AssignedShards = []string{"shard-a", "shard-b"}
+	owned := map[string]bool{"shard-a": true, "shard-b": true, "shard-c": true, "shard-d": true}
+	var started startedShards
+	starter := newShardStarter(cfg, newShardCompletion(cfg.Consumer.AssignedShards), started.start)
+	scanner := newShardScanner(cfg, fake, func(shardID string) bool { return owned[shardID] }, starter)
+
+	scans := []struct {
+		name    string
+		reshard func()
+		want    string
+	}{
+		{name: "nothing new", want: "[]"},
+		{name: "split creates owned and unowned children", reshard: func() {
+			fake.CloseShard("shard-b")
+			fake.AddChildShard("shard-c", "shard-b")
+			fake.AddChildShard("shard-e", "shard-b")
+		}, want: "[shard-c[shard-b]]"},
+		{name: "started shards are not started again", want: "[shard-c[shard-b]]"},
+		{name: "closed owned shard is not started", reshard: func() {
+			fake.AddChildShard("shard-d", "shard-c")
+			fake.CloseShard("shard-d")
+		}, want: "[shard-c[shard-b]]"},
+	}
+	for _, s := range scans {
+		if s.reshard != nil {
+			s.reshard()
+		}
+		scanner.scan()
+		if fmt.Sprint([]string(started)) != s.want {
+			t.Errorf("%s: started %v, want %s", s.name, started, s.want)
+		}
+	}
+
+	// Unset shard_scan_interval_ms scans nothing
+	cfg.Consumer.ShardScanIntervalMs = 0
+	if scanner := newShardScanner(cfg, fake, nil, starter); scanner != nil {
+		t.Errorf("newShardScanner() = %v without an interval, want nil", scanner)
+	}
+}
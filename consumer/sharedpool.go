@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// consumer.execution_model values
+const (
+	ExecutionModelGoroutinePerShard = "goroutine_per_shard"
+	ExecutionModelSharedPool        = "shared_pool"
+)
+
+// DefaultSharedPoolSize is how many workers the shared pool runs
+const DefaultSharedPoolSize = 16
+
+// executionModel validates consumer.execution_model for manual mode
+func executionModel(cfg *Config) (string, error) {
+	switch cfg.Consumer.ExecutionModel {
+	case "", ExecutionModelGoroutinePerShard:
+		return ExecutionModelGoroutinePerShard, nil
+	case ExecutionModelSharedPool:
+		// Prefetching needs a goroutine per shard, which the pool exists to avoid
+		if cfg.Consumer.PrefetchBatches > 0 {
+			return "", fmt.Errorf("consumer.prefetch_batches is not supported with the %s execution model", ExecutionModelSharedPool)
+		}
+		if cfg.Consumer.ShardPromotionRPS > 0 {
+			return "", fmt.Errorf("consumer.shard_promotion_rps is not supported with the %s execution model", ExecutionModelSharedPool)
+		}
+		return ExecutionModelSharedPool, nil
+	default:
+		return "", fmt.Errorf("invalid execution_model: %s. Must be '%s' or '%s'",
+			cfg.Consumer.ExecutionModel, ExecutionModelGoroutinePerShard, ExecutionModelSharedPool)
+	}
+}
+
+// pooledShard is a shard read by the shared pool, one step at a time
+type pooledShard struct {
+	msp         *ManualShardProcessor
+	waiting     bool // waiting for its parents to finish
+	leaseBooked bool
+	opened      bool
+	done        bool
+}
+
+// step does the next piece of work of the shard without blocking: wait for
+// its parents or its lease slot, open it, or fetch and handle one batch. It
+// returns how long until the shard has more work, or false once it is done.
+func (ps *pooledShard) step(ctx context.Context) (time.Duration, bool) {
+	msp := ps.msp
+	if !ps.opened {
+		if !msp.completion.finishedAll(msp.parents) {
+			if !ps.waiting {
+				log.Printf("[%s] Waiting for parent shards %v to finish", msp.label, msp.parents)
+				ps.waiting = true
+			}
+			return msp.pollInterval, true
+		}
+		if ps.waiting {
+			log.Printf("[%s] Parent shards finished", msp.label)
+			ps.waiting = false
+		}
+		if !ps.leaseBooked {
+			ps.leaseBooked = true
+			if delay := msp.pc.LeaseLimiter.Delay(msp.label); delay > 0 {
+				return delay, true
+			}
+		}
+		if !msp.open(ctx) {
+			return 0, false
+		}
+		ps.opened = true
+	}
+
+	if msp.pc.SinkHealth.Paused() {
+		return msp.pollInterval, true
+	}
+	batch, ok := msp.fetchBatch(ctx)
+	if !ok {
+		msp.stopped(ctx)
+		return 0, false
+	}
+	if batch != nil && !msp.handleBatch(context.Background(), batch) {
+		return 0, false
+	}
+	return time.Until(msp.nextFetch()), true
+}
+
+// runSharedPool reads every shard with a fixed number of worker goroutines
+// instead of one per shard, until every shard is done or ctx is cancelled.
+// Workers take shards whose next fetch is due from a ready queue. A shard is
+// queued again only after its step returns, so no two workers ever handle
+// the same shard and its batches are handled in order, as with a goroutine
+// of its own. A shard whose poll interval is running waits on a timer, not a
+// goroutine. The price is latency: a due shard waits for a free worker.
+func runSharedPool(ctx context.Context, processors []*ManualShardProcessor, size int) {
+	if len(processors) == 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Each shard is queued at most once, so queuing never blocks
+	ready := make(chan *pooledShard, len(processors))
+	shards := make([]*pooledShard, len(processors))
+	for i, msp := range processors {
+		shards[i] = &pooledShard{msp: msp}
+		ready <- shards[i]
+	}
+	var remaining atomic.Int64
+	remaining.Store(int64(len(shards)))
+
+	var wg sync.WaitGroup
+	for range min(size, len(shards)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var ps *pooledShard
+				select {
+				case <-ctx.Done():
+					return
+				case ps = <-ready:
+				}
+				if ctx.Err() != nil {
+					return
+				}
+
+				delay, more := ps.step(ctx)
+				switch {
+				case !more:
+					ps.done = true
+					ps.msp.close(context.Background())
+					if remaining.Add(-1) == 0 {
+						cancel()
+					}
+				case delay <= 0:
+					ready <- ps
+				default:
+					time.AfterFunc(delay, func() { ready <- ps })
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Release the shards that were still being read when the pool stopped
+	for _, ps := range shards {
+		if ps.done {
+			continue
+		}
+		if ps.opened {
+			ps.msp.stopped(ctx)
+		}
+		ps.msp.close(context.Background())
+	}
+}
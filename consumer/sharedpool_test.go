@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExecutionModel(t *testing.T) {
+	tests := []struct {
+		name      string
+		model     string
+		prefetch  int
+		promotion float64
+		want      string
+		wantErr   string
+	}{
+		{name: "default", want: ExecutionModelGoroutinePerShard},
+		{name: "goroutine per shard with prefetching", model: ExecutionModelGoroutinePerShard, prefetch: 2, want: ExecutionModelGoroutinePerShard},
+		{name: "shared pool", model: ExecutionModelSharedPool, want: ExecutionModelSharedPool},
+		{name: "shared pool with prefetching", model: ExecutionModelSharedPool, prefetch: 2, wantErr: "consumer.prefetch_batches"},
+		{name: "shared pool with shard promotion", model: ExecutionModelSharedPool, promotion: 1, wantErr: "consumer.shard_promotion_rps"},
+		{name: "unknown", model: "threads", wantErr: "invalid execution_model: threads"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.ExecutionModel = tt.model
+			cfg.Consumer.PrefetchBatches = tt.prefetch
+			cfg.Consumer.ShardPromotionRPS = tt.promotion
+			got, err := executionModel(cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("executionModel() = %q, %v; want an error with %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("executionModel() = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// poolSink records the records written per shard and how many writes ran at once
+type poolSink struct {
+	mu        sync.Mutex
+	written   map[string][]string
+	active    int
+	maxActive int
+}
+
+func (s *poolSink) Write(record *SinkRecord) error {
+	s.mu.Lock()
+	s.active++
+	s.maxActive = max(s.maxActive, s.active)
+	s.written[record.ShardID] = append(s.written[record.ShardID], record.SequenceNumber)
+	s.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *poolSink) Close() error { return nil }
+
+func TestSharedPool(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		closed bool // shards are closed, so the pool returns once they are read
+	}{
+		{name: "fewer workers than shards", size: 2, closed: true},
+		{name: "more workers than shards", size: 8, closed: true},
+		{name: "stops when cancelled", size: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shardIDs := []string{"shardId-000000000000", "shardId-000000000001", "shardId-000000000002", "shardId-000000000003"}
+			fake := newFakeKinesis(testStream, shardIDs...)
+			sink := &poolSink{written: make(map[string][]string)}
+			cfg := &Config{}
+			cfg.Kinesis.StreamName = testStream
+			pc := &ProcessorContext{Config: cfg, Sink: sink}
+			completion := newShardCompletion(shardIDs)
+
+			want := make(map[string][]string)
+			var processors []*ManualShardProcessor
+			for _, shardID := range shardIDs {
+				want[shardID] = fake.AddRecords(t, shardID, "user_1", testEvents(0, 5)...)
+				if tt.closed {
+					fake.CloseShard(shardID)
+				}
+				msp := newTestProcessor(fake, cfg)
+				msp.shardID, msp.label = shardID, shardID
+				msp.maxRecords = 2
+				msp.pc = pc
+				msp.completion = completion
+				processors = append(processors, msp)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan struct{})
+			go func() {
+				runSharedPool(ctx, processors, tt.size)
+				close(done)
+			}()
+			if !tt.closed {
+				waitFor(t, func() bool {
+					sink.mu.Lock()
+					defer sink.mu.Unlock()
+					return fmt.Sprint(sink.written) == fmt.Sprint(want)
+				})
+				cancel()
+			}
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("runSharedPool did not return")
+			}
+
+			sink.mu.Lock()
+			defer sink.mu.Unlock()
+			for _, shardID := range shardIDs {
+				if fmt.Sprint(sink.written[shardID]) != fmt.Sprint(want[shardID]) {
+					t.Errorf("%s: wrote %v, want %v", shardID, sink.written[shardID], want[shardID])
+				}
+			}
+			if sink.maxActive > tt.size {
+				t.Errorf("%d writes ran at once with %d workers", sink.maxActive, tt.size)
+			}
+			if finished := completion.finishedAll(shardIDs); finished != tt.closed {
+				t.Errorf("shards finished %t, want %t", finished, tt.closed)
+			}
+		})
+	}
+}
+
+// waitFor polls until ready returns true, failing the test after 5s
+func waitFor(t *testing.T, ready func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// discardSink drops every record
+type discardSink struct{}
+
+func (discardSink) Write(record *SinkRecord) error { return nil }
+
+func (discardSink) Close() error { return nil }
+
+// BenchmarkExecutionModel reads 128 closed shards to the end with a
+// goroutine per shard and with a shared pool, reporting the throughput and
+// the most goroutines running at once
+func BenchmarkExecutionModel(b *testing.B) {
+	const shards, records = 128, 20
+	for _, model := range []string{ExecutionModelGoroutinePerShard, ExecutionModelSharedPool} {
+		b.Run(model, func(b *testing.B) {
+			peak := 0
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				shardIDs := make([]string, shards)
+				for i := range shardIDs {
+					shardIDs[i] = fmt.Sprintf("shardId-%012d", i)
+				}
+				fake := newFakeKinesis(testStream, shardIDs...)
+				cfg := &Config{}
+				cfg.Kinesis.StreamName = testStream
+				pc := &ProcessorContext{Config: cfg, Sink: discardSink{}}
+				completion := newShardCompletion(shardIDs)
+				processors := make([]*ManualShardProcessor, shards)
+				for i, shardID := range shardIDs {
+					fake.AddRecords(b, shardID, "user_1", testEvents(0, records)...)
+					fake.CloseShard(shardID)
+					msp := newTestProcessor(fake, cfg)
+					msp.shardID, msp.label = shardID, shardID
+					msp.maxRecords = 5
+					msp.pc = pc
+					msp.completion = completion
+					processors[i] = msp
+				}
+
+				stop := make(chan struct{})
+				sampled := make(chan int)
+				go func() {
+					most := 0
+					ticker := time.NewTicker(time.Millisecond)
+					defer ticker.Stop()
+					for {
+						select {
+						case <-stop:
+							sampled <- most
+							return
+						case <-ticker.C:
+							most = max(most, runtime.NumGoroutine())
+						}
+					}
+				}()
+				b.StartTimer()
+
+				if model == ExecutionModelSharedPool {
+					runSharedPool(context.Background(), processors, 16)
+				} else {
+					var wg sync.WaitGroup
+					for _, msp := range processors {
+						wg.Add(1)
+						go msp.ProcessShard(context.Background(), &wg)
+					}
+					wg.Wait()
+				}
+
+				b.StopTimer()
+				close(stop)
+				peak = max(peak, <-sampled)
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(b.N*shards*records)/b.Elapsed().Seconds(), "records/s")
+			b.ReportMetric(float64(peak), "goroutines")
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// signedTestRecord frames an event signed with "test-secret" exactly as the
+// producer's signing test expects its signer to
+func signedTestRecord(t *testing.T) []byte {
+	t.Helper()
+	signature, err := hex.DecodeString("13ce0c70eea4be9bc5cbd2fb44c9ce0a5d363e5b2c62a59bc56276f27baa074a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := `{"version":1,"event_id":"evt_1","action":"view"}`
+	return []byte(signatureMagic + string(signature) + payload)
+}
+
+func TestSignatureVerification(t *testing.T) {
+	signed := signedTestRecord(t)
+	tampered := append([]byte(nil), signed...)
+	tampered[len(tampered)-3] = 'X' // "view" becomes "vXew"
+	tests := []struct {
+		name        string
+		secret      string
+		data        []byte
+		wantInvalid bool
+	}{
+		{name: "signed record verified", secret: "test-secret", data: signed},
+		{name: "tampered payload detected", secret: "test-secret", data: tampered, wantInvalid: true},
+		{name: "wrong secret detected", secret: "other-secret", data: signed, wantInvalid: true},
+		{name: "unsigned record rejected", secret: "test-secret", data: []byte(`{"version":1,"event_id":"evt_1","action":"view"}`), wantInvalid: true},
+		{name: "signature stripped without a secret", data: signed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dlqPath := filepath.Join(t.TempDir(), "dlq.jsonl")
+			cfg := &Config{}
+			cfg.Consumer.HMACSecret = tt.secret
+			if tt.secret != "" {
+				cfg.Consumer.HMACDLQPath = dlqPath
+			}
+			verifier, err := NewSignatureVerifier(cfg)
+			if err != nil {
+				t.Fatalf("NewSignatureVerifier() = %v", err)
+			}
+			pc := &ProcessorContext{Config: cfg, Metrics: NewMetrics(), Signatures: verifier}
+
+			event, err := pc.DecodeEvent(testShard, &kinesis.Record{SequenceNumber: aws.String("1"), Data: tt.data})
+			verifier.Close()
+			if invalid := errors.Is(err, ErrInvalidSignature); invalid != tt.wantInvalid {
+				t.Fatalf("DecodeEvent() = %v, want invalid signature %t", err, tt.wantInvalid)
+			}
+			if !tt.wantInvalid && (err != nil || event.EventID != "evt_1" || event.Action != "view") {
+				t.Errorf("DecodeEvent() = %+v, %v; want evt_1", event, err)
+			}
+
+			wantCount := int64(0)
+			if tt.wantInvalid {
+				wantCount = 1
+			}
+			if got := pc.Metrics.Snapshot()[ShardKey{ShardID: testShard}].InvalidSignatures; got != wantCount {
+				t.Errorf("counted %d invalid signatures, want %d", got, wantCount)
+			}
+			data, _ := os.ReadFile(dlqPath)
+			if letters := int64(strings.Count(string(data), "\n")); letters != wantCount {
+				t.Errorf("dead-lettered %d records, want %d", letters, wantCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// simulation is an in-memory model of KCL lease assignment. Each round is
+// one shard-sync interval in which every worker, in random order, does what
+// the KCL worker event loop does:
+//
+//   - take at most one unowned lease, if it holds fewer than maxLeases
+//   - with lease stealing enabled, if it holds fewer than
+//     shards/workers leases, claim one random lease from the worker holding
+//     the most; the claim is honoured at the start of the next round, when
+//     the victim's shard consumer notices it and releases the lease
+type simulation struct {
+	rng           *rand.Rand
+	shards        []string
+	owners        map[string]string // shard -> worker, "" if unowned
+	workers       []string
+	maxLeases     int
+	leaseStealing bool
+	claims        map[string]string // shard -> claiming worker
+	transfers     int
+}
+
+func newSimulation(numShards, maxLeases int, leaseStealing bool, seed int64) *simulation {
+	sim := &simulation{
+		rng:           rand.New(rand.NewSource(seed)),
+		owners:        make(map[string]string, numShards),
+		maxLeases:     maxLeases,
+		leaseStealing: leaseStealing,
+		claims:        make(map[string]string),
+	}
+	for i := 0; i < numShards; i++ {
+		shardID := fmt.Sprintf("shardId-%012d", i)
+		sim.shards = append(sim.shards, shardID)
+		sim.owners[shardID] = ""
+	}
+	return sim
+}
+
+// clone copies the simulation so several scenarios can start from the same state
+func (sim *simulation) clone(seed int64) *simulation {
+	c := &simulation{
+		rng:           rand.New(rand.NewSource(seed)),
+		shards:        sim.shards,
+		owners:        make(map[string]string, len(sim.owners)),
+		workers:       append([]string(nil), sim.workers...),
+		maxLeases:     sim.maxLeases,
+		leaseStealing: sim.leaseStealing,
+		claims:        make(map[string]string),
+	}
+	for shardID, owner := range sim.owners {
+		c.owners[shardID] = owner
+	}
+	return c
+}
+
+func (sim *simulation) addWorker(workerID string) {
+	sim.workers = append(sim.workers, workerID)
+}
+
+// removeWorker drops a worker; its leases expire and become unowned
+func (sim *simulation) removeWorker(workerID string) {
+	for i, w := range sim.workers {
+		if w == workerID {
+			sim.workers = append(sim.workers[:i], sim.workers[i+1:]...)
+			break
+		}
+	}
+	for shardID, owner := range sim.owners {
+		if owner == workerID {
+			sim.owners[shardID] = ""
+		}
+	}
+	for shardID, claimant := range sim.claims {
+		if claimant == workerID {
+			delete(sim.claims, shardID)
+		}
+	}
+}
+
+// leases returns the shards held by each worker that holds at least one,
+// which is what KCL's ListActiveWorkers sees
+func (sim *simulation) leases() map[string][]string {
+	held := make(map[string][]string)
+	for _, shardID := range sim.shards {
+		if owner := sim.owners[shardID]; owner != "" {
+			held[owner] = append(held[owner], shardID)
+		}
+	}
+	return held
+}
+
+// round runs one shard-sync interval and reports whether any lease changed hands
+func (sim *simulation) round() bool {
+	changed := false
+
+	// Honour the claims made last round
+	for shardID, claimant := range sim.claims {
+		sim.owners[shardID] = claimant
+		sim.transfers++
+		changed = true
+	}
+	sim.claims = make(map[string]string)
+
+	order := append([]string(nil), sim.workers...)
+	sim.rng.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+
+	for _, workerID := range order {
+		if sim.acquire(workerID) {
+			changed = true
+		}
+		if sim.leaseStealing && sim.steal(workerID) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// acquire takes the first unowned lease, as the KCL event loop takes one lease per pass
+func (sim *simulation) acquire(workerID string) bool {
+	if len(sim.leases()[workerID]) >= sim.maxLeases {
+		return false
+	}
+	for _, shardID := range sim.shards {
+		if sim.owners[shardID] == "" {
+			sim.owners[shardID] = workerID
+			return true
+		}
+	}
+	return false
+}
+
+// steal mirrors Worker.rebalance: claim one lease from the most loaded worker
+// if this worker is below the optimal shards-per-worker
+func (sim *simulation) steal(workerID string) bool {
+	for _, claimant := range sim.claims {
+		if claimant == workerID {
+			return false // one steal in flight at a time
+		}
+	}
+
+	held := sim.leases()
+	numShards := 0
+	for _, shards := range held {
+		numShards += len(shards)
+	}
+	numWorkers := len(held)
+	if numWorkers >= numShards {
+		return false
+	}
+	current, ok := held[workerID]
+	if !ok {
+		numWorkers++
+	}
+	optimal := numShards / numWorkers
+	if len(current) >= optimal || len(current) == sim.maxLeases {
+		return false
+	}
+
+	victim := ""
+	most := optimal
+	for _, w := range sortedKeys(held) {
+		if w != workerID && len(held[w]) > most {
+			victim, most = w, len(held[w])
+		}
+	}
+	if victim == "" {
+		return false
+	}
+
+	var candidates []string
+	for _, shardID := range held[victim] {
+		if _, claimed := sim.claims[shardID]; !claimed {
+			candidates = append(candidates, shardID)
+		}
+	}
+	if len(candidates) == 0 {
+		return false
+	}
+	sim.claims[candidates[sim.rng.Intn(len(candidates))]] = workerID
+	return true
+}
+
+// converge runs rounds until nothing changes for two rounds in a row
+func (sim *simulation) converge(maxRounds int) int {
+	quiet := 0
+	for round := 1; round <= maxRounds; round++ {
+		if sim.round() {
+			quiet = 0
+		} else if quiet++; quiet == 2 {
+			return round
+		}
+	}
+	return maxRounds
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// apply makes a membership change and converges the simulation, returning
+// the rounds it took and how many owned leases changed hands
+func (sim *simulation) apply(change func(*simulation), maxRounds int) (rounds, moved int) {
+	before := make(map[string]string, len(sim.owners))
+	for shardID, owner := range sim.owners {
+		before[shardID] = owner
+	}
+	change(sim)
+
+	rounds = sim.converge(maxRounds)
+	for shardID, owner := range before {
+		if owner != "" && sim.owners[shardID] != owner {
+			moved++
+		}
+	}
+	return rounds, moved
+}
+
+// runScenario applies a membership change, converges the simulation and
+// prints the resulting assignment and how many leases moved compared to
+// before the change
+func runScenario(name string, sim *simulation, change func(*simulation), maxRounds int) {
+	rounds, moved := sim.apply(change, maxRounds)
+
+	fmt.Printf("== %s: %d workers, converged after %d rounds, %d leases moved (%d steals)\n",
+		name, len(sim.workers), rounds, moved, sim.transfers)
+
+	held := sim.leases()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "WORKER\tLEASES\tSHARDS")
+	for _, workerID := range sim.workers {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", workerID, len(held[workerID]), dashIfEmpty(strings.Join(held[workerID], ",")))
+	}
+	var unowned []string
+	for _, shardID := range sim.shards {
+		if sim.owners[shardID] == "" {
+			unowned = append(unowned, shardID)
+		}
+	}
+	if len(unowned) > 0 {
+		fmt.Fprintf(w, "(unowned)\t%d\t%s\n", len(unowned), strings.Join(unowned, ","))
+	}
+	w.Flush()
+	fmt.Println()
+}
+
+// runSimulateCommand predicts how KCL distributes leases for a given shard
+// and worker count, and how many move when a worker joins or leaves
+func runSimulateCommand(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	numShards := fs.Int("shards", 4, "number of shards in the stream")
+	numWorkers := fs.Int("workers", 2, "number of workers initially running")
+	maxLeases := fs.Int("max-leases", 0, "maximum leases per worker (0 for unlimited)")
+	leaseStealing := fs.Bool("lease-stealing", true, "model KCL lease stealing (without it, new workers only pick up unowned leases)")
+	seed := fs.Int64("seed", 1, "random seed for worker ordering and stolen shard choice")
+	maxRounds := fs.Int("rounds", 1000, "maximum shard-sync rounds per scenario")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *numShards <= 0 || *numWorkers <= 0 {
+		return fmt.Errorf("-shards and -workers must be positive")
+	}
+	if *maxLeases <= 0 {
+		*maxLeases = *numShards
+	}
+
+	base := newSimulation(*numShards, *maxLeases, *leaseStealing, *seed)
+	runScenario("initial assignment", base, func(sim *simulation) {
+		for i := 1; i <= *numWorkers; i++ {
+			sim.addWorker(fmt.Sprintf("worker-%d", i))
+		}
+	}, *maxRounds)
+
+	joiner := fmt.Sprintf("worker-%d", *numWorkers+1)
+	runScenario(joiner+" joins", base.clone(*seed+1), func(sim *simulation) {
+		sim.addWorker(joiner)
+	}, *maxRounds)
+
+	if *numWorkers > 1 {
+		runScenario("worker-1 leaves", base.clone(*seed+2), func(sim *simulation) {
+			sim.removeWorker("worker-1")
+		}, *maxRounds)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// SinkRecord is a decoded event together with its position in the stream
+type SinkRecord struct {
+	Stream         string `json:"stream,omitempty"` // empty for records backfilled from S3
+	ShardID        string `json:"shard_id"`
+	SequenceNumber string `json:"sequence_number"`
+	PartitionKey   string `json:"partition_key"`
+	Event          Event  `json:"event"`
+}
+
+func newSinkRecord(stream, shardID string, record *kinesis.Record, event Event) *SinkRecord {
+	return &SinkRecord{
+		Stream:         stream,
+		ShardID:        shardID,
+		SequenceNumber: aws.StringValue(record.SequenceNumber),
+		PartitionKey:   aws.StringValue(record.PartitionKey),
+		Event:          event,
+	}
+}
+
+// Sink receives decoded events from the record processors.
+// Implementations must be safe for concurrent use by multiple shards.
+type Sink interface {
+	Write(record *SinkRecord) error
+	Close() error
+}
+
+// ShardDelivery is implemented by per-shard sinks that accept records before
+// they are durable, such as a buffered or file-rotating sink. Processors
+// checkpoint no further than Delivered.
+type ShardDelivery interface {
+	// Delivered returns the sequence number of the last durable record
+	Delivered() string
+	// Pending returns the number of accepted records that are not durable yet
+	Pending() int
+	// WaitDrained makes every accepted record durable, giving up after timeout
+	WaitDrained(timeout time.Duration) bool
+	Close() error
+}
+
+// ShardWriter is a shard's own writer in a ShardedSink
+type ShardWriter interface {
+	Sink
+	ShardDelivery
+}
+
+// ShardedSink is implemented by sinks that keep separate state per shard,
+// such as a file or a stream each, and track delivery per shard
+type ShardedSink interface {
+	Sink
+	ShardWriter(shardID string) ShardWriter
+}
+
+// newSink creates the sink described by consumer.sink, or nil if none is
+// configured. The "aggregates" sink writes into the shared aggregates store.
+func newSink(cfg *Config, aggregates *RollingAggregates) (Sink, error) {
+	switch cfg.Consumer.Sink.Type {
+	case "":
+		return nil, nil
+	case "file":
+		return NewFileSink(cfg.Consumer.Sink.Path)
+	case "parquet":
+		return NewParquetSink(cfg)
+	case "grpc":
+		return NewGRPCSink(cfg)
+	case "aggregates":
+		return aggregates, nil
+	case "multi":
+		return NewMultiSink(cfg, aggregates)
+	default:
+		return nil, fmt.Errorf("invalid sink type: %s. Must be 'file', 'parquet', 'grpc', 'aggregates' or 'multi'", cfg.Consumer.Sink.Type)
+	}
+}
+
+// FileSink appends every record as a JSON line to a local file
+type FileSink struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// NewFileSink opens (or creates) path for appending
+func NewFileSink(path string) (*FileSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file sink requires consumer.sink.path")
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sink file %s: %w", path, err)
+	}
+	return &FileSink{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// Write appends the record to the file
+func (fs *FileSink) Write(record *SinkRecord) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.encoder.Encode(record)
+}
+
+// WriteAggregate appends a window aggregate to the file
+func (fs *FileSink) WriteAggregate(aggregate *WindowAggregate) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.encoder.Encode(aggregate)
+}
+
+// WriteDeadLetter appends a record the sink rejected to the file
+func (fs *FileSink) WriteDeadLetter(letter *SinkDeadLetter) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.encoder.Encode(letter)
+}
+
+// RecordDeadLetter is a record that could not be decoded, as written to
+// consumer.hmac_dlq_path, unknown_version_dlq_path or dlq_file. Data is the record
+// exactly as read, base64 encoded. For a record whose handler timed out it
+// is the decoded event, JSON encoded.
+type RecordDeadLetter struct {
+	ShardID        string    `json:"shard_id"`
+	SequenceNumber string    `json:"sequence_number"`
+	PartitionKey   string    `json:"partition_key"`
+	Data           []byte    `json:"data"`
+	Error          string    `json:"error"`
+	FailedAt       time.Time `json:"failed_at"`
+}
+
+// WriteRecordDeadLetter appends a record that could not be decoded to the file
+func (fs *FileSink) WriteRecordDeadLetter(letter *RecordDeadLetter) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.encoder.Encode(letter)
+}
+
+// deadLetterRecord writes a record that failed to decode with err to dlq,
+// logging rather than returning a failed write
+func deadLetterRecord(dlq DeadLetterSink, shardID string, record *kinesis.Record, err error) {
+	letter := &RecordDeadLetter{
+		ShardID:        shardID,
+		SequenceNumber: aws.StringValue(record.SequenceNumber),
+		PartitionKey:   aws.StringValue(record.PartitionKey),
+		Data:           record.Data,
+		Error:          err.Error(),
+		FailedAt:       time.Now().UTC(),
+	}
+	if dlqErr := dlq.WriteRecordDeadLetter(letter); dlqErr != nil {
+		log.Printf("[%s] Failed to dead-letter record %s: %v", shardID, letter.SequenceNumber, dlqErr)
+	}
+}
+
+// Close closes the underlying file
+func (fs *FileSink) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.file.Close()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"time"
+)
+
+// consumer.sink.errors actions
+const (
+	SinkErrorActionRetry = "retry"
+	SinkErrorActionDLQ   = "dlq"
+	SinkErrorActionSkip  = "skip"
+	SinkErrorActionHalt  = "halt"
+)
+
+// Defaults for the sink error policy
+const (
+	DefaultSinkRetryAttempts  = 5
+	DefaultSinkRetryBackoffMs = 200
+
+	// maxSinkRetryBackoff caps the doubling backoff between retries
+	maxSinkRetryBackoff = 30 * time.Second
+)
+
+// ErrSinkHalted is returned for a sink write that failed under the "halt"
+// action. The consumer is stopping and the record must not be checkpointed.
+var ErrSinkHalted = errors.New("sink failed, halting consumer")
+
+// SinkErrorClass says whether a failed sink write is worth retrying
+type SinkErrorClass string
+
+const (
+	// SinkErrorTransient is a failure that may succeed when retried, such as a timeout or a 5xx
+	SinkErrorTransient SinkErrorClass = "transient"
+	// SinkErrorPermanent is a failure that fails the same way every time, such as a 4xx or an unencodable record
+	SinkErrorPermanent SinkErrorClass = "permanent"
+)
+
+// SinkErrorClassifier decides the class of a sink write error
+type SinkErrorClassifier interface {
+	Classify(err error) SinkErrorClass
+}
+
+// SinkErrorClassifierFunc adapts a function to the SinkErrorClassifier interface
+type SinkErrorClassifierFunc func(err error) SinkErrorClass
+
+// Classify calls f(err)
+func (f SinkErrorClassifierFunc) Classify(err error) SinkErrorClass {
+	return f(err)
+}
+
+// DefaultSinkErrorClassifier classifies errors carrying an HTTP status, as
+// AWS request failures do, by the status: 429 and 5xx are transient, other
+// 4xx permanent. Records that cannot be encoded and permission errors are
+// permanent. Anything else, including network errors and a full disk, is
+// treated as transient, so an unknown failure is retried before the
+// permanent action applies.
+var DefaultSinkErrorClassifier = SinkErrorClassifierFunc(func(err error) SinkErrorClass {
+	var status interface{ StatusCode() int }
+	if errors.As(err, &status) {
+		code := status.StatusCode()
+		if code >= 400 && code < 500 && code != http.StatusTooManyRequests {
+			return SinkErrorPermanent
+		}
+		return SinkErrorTransient
+	}
+
+	var (
+		unsupportedType  *json.UnsupportedTypeError
+		unsupportedValue *json.UnsupportedValueError
+		marshaler        *json.MarshalerError
+	)
+	switch {
+	case errors.As(err, &unsupportedType), errors.As(err, &unsupportedValue), errors.As(err, &marshaler),
+		errors.Is(err, fs.ErrPermission):
+		return SinkErrorPermanent
+	default:
+		return SinkErrorTransient
+	}
+})
+
+// SinkDeadLetter is a record the sink rejected, as written to the dead-letter file
+type SinkDeadLetter struct {
+	Record   *SinkRecord    `json:"record"`
+	Error    string         `json:"error"`
+	Class    SinkErrorClass `json:"class"`
+	FailedAt time.Time      `json:"failed_at"`
+}
+
+// SinkErrorPolicy applies the consumer.sink.errors action for the class of
+// every failed sink write. Transient errors are retried with a doubling
+// backoff when their action is "retry"; once the attempts run out they get
+// the permanent action. "dlq" writes the record to dlq_path and "skip" drops
+// it, both letting the checkpoint move past it; "halt" stops the consumer
+// before the record is checkpointed. A nil *SinkErrorPolicy leaves sink
+// errors to the caller.
+type SinkErrorPolicy struct {
+	// Classifier decides which action applies to an error; it defaults to DefaultSinkErrorClassifier
+	Classifier SinkErrorClassifier
+
+	transient string
+	permanent string
+	attempts  int
+	backoff   time.Duration
+	dlq       *FileSink
+	labels    shardLabeler
+}
+
+// NewSinkErrorPolicy returns the policy for consumer.sink.errors, or nil when
+// no action is configured
+func NewSinkErrorPolicy(cfg *Config) (*SinkErrorPolicy, error) {
+	c := cfg.Consumer.Sink.Errors
+	if c.Transient == "" && c.Permanent == "" {
+		return nil, nil
+	}
+
+	valid := func(name, action string, allowed ...string) error {
+		for _, a := range allowed {
+			if action == a {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid consumer.sink.errors.%s: %s. Must be one of %v", name, action, allowed)
+	}
+	if err := valid("transient", c.Transient, SinkErrorActionRetry, SinkErrorActionDLQ, SinkErrorActionSkip, SinkErrorActionHalt); err != nil {
+		return nil, err
+	}
+	// Permanent errors fail the same way on every attempt, so there is nothing to retry
+	if err := valid("permanent", c.Permanent, SinkErrorActionDLQ, SinkErrorActionSkip, SinkErrorActionHalt); err != nil {
+		return nil, err
+	}
+
+	policy := &SinkErrorPolicy{
+		Classifier: DefaultSinkErrorClassifier,
+		transient:  c.Transient,
+		permanent:  c.Permanent,
+		attempts:   c.RetryAttempts,
+		backoff:    time.Duration(c.RetryBackoffMs) * time.Millisecond,
+		labels:     newShardLabeler(cfg),
+	}
+	if c.Transient == SinkErrorActionDLQ || c.Permanent == SinkErrorActionDLQ {
+		if c.DLQPath == "" {
+			return nil, fmt.Errorf("consumer.sink.errors action %q requires consumer.sink.errors.dlq_path", SinkErrorActionDLQ)
+		}
+		dlq, err := NewFileSink(c.DLQPath)
+		if err != nil {
+			return nil, err
+		}
+		policy.dlq = dlq
+	}
+	return policy, nil
+}
+
+// Wrap returns next with the policy applied to its writes. abort is called
+// when a write fails under the "halt" action; dead-lettered records are
+// recorded in audit.
+func (p *SinkErrorPolicy) Wrap(next Sink, abort func(err error), audit *AuditLog) Sink {
+	if p == nil || next == nil {
+		return next
+	}
+	return &policySink{next: next, policy: p, abort: abort, audit: audit}
+}
+
+// Close closes the dead-letter file
+func (p *SinkErrorPolicy) Close() error {
+	if p == nil || p.dlq == nil {
+		return nil
+	}
+	return p.dlq.Close()
+}
+
+// policySink is a sink whose failed writes go through a SinkErrorPolicy
+type policySink struct {
+	next   Sink
+	policy *SinkErrorPolicy
+	abort  func(err error)
+	audit  *AuditLog
+}
+
+// Write writes the record, applying the policy if the write fails
+func (ps *policySink) Write(record *SinkRecord) error {
+	err := ps.next.Write(record)
+	if err == nil {
+		return nil
+	}
+
+	p := ps.policy
+	class := p.Classifier.Classify(err)
+	action := p.permanent
+	if class == SinkErrorTransient {
+		action = p.transient
+	}
+
+	if action == SinkErrorActionRetry {
+		backoff := p.backoff
+		for attempt := 1; attempt <= p.attempts; attempt++ {
+			log.Printf("[%s] Sink write of record %s failed (%s), retry %d/%d in %v: %v",
+				p.labels.logLabel(record.ShardID), record.SequenceNumber, class, attempt, p.attempts, backoff, err)
+			time.Sleep(backoff)
+			if err = ps.next.Write(record); err == nil {
+				return nil
+			}
+			backoff = min(backoff*2, maxSinkRetryBackoff)
+			if class = p.Classifier.Classify(err); class == SinkErrorPermanent {
+				break
+			}
+		}
+		// Retries exhausted, or the failure turned out to be permanent
+		action = p.permanent
+	}
+
+	switch action {
+	case SinkErrorActionDLQ:
+		letter := &SinkDeadLetter{Record: record, Error: err.Error(), Class: class, FailedAt: time.Now().UTC()}
+		if dlqErr := p.dlq.WriteDeadLetter(letter); dlqErr != nil {
+			// Not dead-lettered, so the caller handles the sink error as
+			// it would without a policy
+			log.Printf("[%s] Failed to dead-letter record %s: %v", p.labels.logLabel(record.ShardID), record.SequenceNumber, dlqErr)
+			return err
+		}
+		log.Printf("[%s] Sink write of record %s failed (%s), dead-lettered: %v",
+			p.labels.logLabel(record.ShardID), record.SequenceNumber, class, err)
+		ps.audit.DeadLettered(record, err)
+		return nil
+	case SinkErrorActionSkip:
+		log.Printf("[%s] Sink write of record %s failed (%s), skipping it: %v",
+			p.labels.logLabel(record.ShardID), record.SequenceNumber, class, err)
+		return nil
+	default: // halt
+		log.Printf("[%s] ALERT: sink write of record %s failed (%s), halting: %v",
+			p.labels.logLabel(record.ShardID), record.SequenceNumber, class, err)
+		ps.abort(fmt.Errorf("shard %s: sink write of record %s failed: %w", record.ShardID, record.SequenceNumber, err))
+		return fmt.Errorf("%w: %v", ErrSinkHalted, err)
+	}
+}
+
+// Close closes the wrapped sink
+func (ps *policySink) Close() error {
+	return ps.next.Close()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// httpError is a sink failure carrying an HTTP status
+func httpError(status int) error {
+	return awserr.NewRequestFailure(awserr.New("SinkError", "request failed", nil), status, "req-1")
+}
+
+func TestDefaultSinkErrorClassifier(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want SinkErrorClass
+	}{
+		{name: "5xx", err: httpError(503), want: SinkErrorTransient},
+		{name: "throttled", err: httpError(429), want: SinkErrorTransient},
+		{name: "4xx", err: httpError(400), want: SinkErrorPermanent},
+		{name: "wrapped 4xx", err: fmt.Errorf("write: %w", httpError(404)), want: SinkErrorPermanent},
+		{name: "unencodable record", err: &json.UnsupportedTypeError{}, want: SinkErrorPermanent},
+		{name: "permission denied", err: &fs.PathError{Op: "open", Path: "out.json", Err: fs.ErrPermission}, want: SinkErrorPermanent},
+		{name: "unknown", err: errors.New("connection reset"), want: SinkErrorTransient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DefaultSinkErrorClassifier.Classify(tt.err); got != tt.want {
+				t.Errorf("Classify(%v) = %s, want %s", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// flakySink fails its writes with errs in turn, then succeeds
+type flakySink struct {
+	errs   []error
+	writes int
+}
+
+func (s *flakySink) Write(record *SinkRecord) error {
+	s.writes++
+	if len(s.errs) == 0 {
+		return nil
+	}
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
+
+func (s *flakySink) Close() error { return nil }
+
+func TestSinkErrorPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		transient   string
+		permanent   string
+		errs        []error
+		wantErr     error
+		wantWrites  int
+		wantLetters int
+		wantAborted bool
+	}{
+		{name: "transient retried until it succeeds", transient: "retry", permanent: "dlq",
+			errs: []error{httpError(503), httpError(503)}, wantWrites: 3},
+		{name: "transient retries exhausted get the permanent action", transient: "retry", permanent: "dlq",
+			errs: []error{httpError(503), httpError(503), httpError(503), httpError(503)}, wantWrites: 3, wantLetters: 1},
+		{name: "retry turning permanent stops retrying", transient: "retry", permanent: "dlq",
+			errs: []error{httpError(503), httpError(400)}, wantWrites: 2, wantLetters: 1},
+		{name: "permanent dead-lettered", transient: "retry", permanent: "dlq",
+			errs: []error{httpError(400)}, wantWrites: 1, wantLetters: 1},
+		{name: "permanent skipped", transient: "retry", permanent: "skip",
+			errs: []error{httpError(400)}, wantWrites: 1},
+		{name: "permanent halts", transient: "retry", permanent: "halt",
+			errs: []error{httpError(400)}, wantErr: ErrSinkHalted, wantWrites: 1, wantAborted: true},
+		{name: "transient halts", transient: "halt", permanent: "skip",
+			errs: []error{httpError(503)}, wantErr: ErrSinkHalted, wantWrites: 1, wantAborted: true},
+		{name: "transient dead-lettered without retrying", transient: "dlq", permanent: "halt",
+			errs: []error{httpError(503)}, wantWrites: 1, wantLetters: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dlqPath := filepath.Join(t.TempDir(), "dlq.jsonl")
+			cfg := &Config{}
+			cfg.Consumer.Sink.Errors.Transient = tt.transient
+			cfg.Consumer.Sink.Errors.Permanent = tt.permanent
+			cfg.Consumer.Sink.Errors.RetryAttempts = 2
+			cfg.Consumer.Sink.Errors.RetryBackoffMs = 1
+			cfg.Consumer.Sink.Errors.DLQPath = dlqPath
+			policy, err := NewSinkErrorPolicy(cfg)
+			if err != nil {
+				t.Fatalf("NewSinkErrorPolicy() = %v", err)
+			}
+
+			next := &flakySink{errs: tt.errs}
+			aborted := false
+			sink := policy.Wrap(next, func(error) { aborted = true }, nil)
+			err = sink.Write(&SinkRecord{ShardID: testShard, SequenceNumber: "1", Event: Event{EventID: "evt_1"}})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Write() = %v, want %v", err, tt.wantErr)
+			}
+			if next.writes != tt.wantWrites || aborted != tt.wantAborted {
+				t.Errorf("wrote %d times with aborted %t, want %d and %t", next.writes, aborted, tt.wantWrites, tt.wantAborted)
+			}
+
+			policy.Close()
+			letters := 0
+			if data, err := os.ReadFile(dlqPath); err == nil {
+				letters = strings.Count(string(data), "\n")
+			}
+			if letters != tt.wantLetters {
+				t.Errorf("dead-lettered %d records, want %d", letters, tt.wantLetters)
+			}
+		})
+	}
+}
+
+func TestNewSinkErrorPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		transient string
+		permanent string
+		dlqPath   string
+		wantErr   string
+	}{
+		{name: "not configured"},
+		{name: "valid", transient: "retry", permanent: "skip"},
+		{name: "permanent retry", transient: "retry", permanent: "retry", wantErr: "invalid consumer.sink.errors.permanent: retry"},
+		{name: "unknown transient", transient: "ignore", permanent: "skip", wantErr: "invalid consumer.sink.errors.transient: ignore"},
+		{name: "dlq without a path", transient: "retry", permanent: "dlq", wantErr: "requires consumer.sink.errors.dlq_path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.Sink.Errors.Transient = tt.transient
+			cfg.Consumer.Sink.Errors.Permanent = tt.permanent
+			cfg.Consumer.Sink.Errors.DLQPath = tt.dlqPath
+			_, err := NewSinkErrorPolicy(cfg)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("NewSinkErrorPolicy() = %v, want an error with %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	chk "github.com/vmware/vmware-go-kcl/clientlibrary/checkpoint"
+	"github.com/vmware/vmware-go-kcl/clientlibrary/config"
+	par "github.com/vmware/vmware-go-kcl/clientlibrary/partition"
+)
+
+// DefaultSinkHealthFailureThreshold is the default of consumer.sink_health.failure_threshold
+const DefaultSinkHealthFailureThreshold = 3
+
+// sinkPauseLeaseCheck is how often a KCL shard held by a pause checks
+// whether its lease is due for renewal
+const sinkPauseLeaseCheck = time.Second
+
+// errSinkHealthReleased is returned by Wait once the consumer is shutting down
+var errSinkHealthReleased = errors.New("sink health pause released for shutdown")
+
+// SinkProber is implemented by sinks that can tell whether their destination
+// is reachable without writing a record
+type SinkProber interface {
+	Probe(ctx context.Context) error
+}
+
+// SinkHealth probes the sink every probe_interval_ms and pauses GetRecords
+// polling on every shard once failure_threshold probes in a row fail, so a
+// consumer whose sink is down stops spending read quota and filling
+// buffers. The first successful probe resumes polling. A nil *SinkHealth
+// never pauses.
+type SinkHealth struct {
+	probe     func(ctx context.Context) error
+	interval  time.Duration
+	threshold int
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	mu       sync.Mutex
+	failures int
+	paused   time.Time     // when polling was paused, zero while polling
+	resumed  chan struct{} // closed when polling resumes or the pause is released
+	released bool
+}
+
+// NewSinkHealth starts probing the sink, or the URL of consumer.sink_health
+// when set, and returns nil when consumer.sink_health.probe_interval_ms is unset
+func NewSinkHealth(cfg *Config, sink Sink) (*SinkHealth, error) {
+	healthCfg := cfg.Consumer.SinkHealth
+	if healthCfg.ProbeIntervalMs <= 0 {
+		return nil, nil
+	}
+
+	var probe func(ctx context.Context) error
+	if healthCfg.URL != "" {
+		probe = func(ctx context.Context) error {
+			return preloadOnce(ctx, "", healthCfg.URL)
+		}
+	} else if prober, ok := sink.(SinkProber); ok {
+		probe = prober.Probe
+	} else {
+		return nil, fmt.Errorf("consumer.sink_health requires url, or a grpc or multi sink that can be probed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &SinkHealth{
+		probe:     probe,
+		interval:  time.Duration(healthCfg.ProbeIntervalMs) * time.Millisecond,
+		threshold: healthCfg.FailureThreshold,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		resumed:   make(chan struct{}),
+	}
+	close(h.resumed)
+	go h.run(ctx)
+	log.Printf("Probing sink health every %v, pausing polling after %d failed probes", h.interval, h.threshold)
+	return h, nil
+}
+
+func (h *SinkHealth) run(ctx context.Context) {
+	defer close(h.done)
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		probeCtx, cancel := context.WithTimeout(ctx, h.interval)
+		err := h.probe(probeCtx)
+		cancel()
+		if ctx.Err() == nil {
+			h.observe(err)
+		}
+	}
+}
+
+// observe counts a probe outcome, pausing or resuming polling
+func (h *SinkHealth) observe(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		if !h.paused.IsZero() {
+			log.Printf("Sink healthy again, resuming polling after %v paused", time.Since(h.paused).Round(time.Millisecond))
+			h.paused = time.Time{}
+			if !h.released {
+				close(h.resumed)
+			}
+		}
+		h.failures = 0
+		return
+	}
+
+	h.failures++
+	if h.paused.IsZero() && h.failures >= h.threshold {
+		log.Printf("Sink unhealthy after %d failed probes (%v), pausing polling on every shard", h.failures, err)
+		h.paused = time.Now()
+		if !h.released {
+			h.resumed = make(chan struct{})
+		}
+	} else if h.paused.IsZero() {
+		log.Printf("Sink probe failed (%d of %d): %v", h.failures, h.threshold, err)
+	}
+}
+
+// Paused reports whether polling is paused
+func (h *SinkHealth) Paused() bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.paused.IsZero() && !h.released
+}
+
+// Wait blocks while polling is paused. It returns ctx's error if ctx is done
+// first, and errSinkHealthReleased once Release was called.
+func (h *SinkHealth) Wait(ctx context.Context) error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	resumed, released := h.resumed, h.released
+	h.mu.Unlock()
+	if released {
+		return errSinkHealthReleased
+	}
+	select {
+	case <-resumed:
+		if h.isReleased() {
+			return errSinkHealthReleased
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *SinkHealth) isReleased() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.released
+}
+
+// Release ends the running pause and makes Wait return at once, so a KCL
+// worker whose shards are held by the pause can shut down. Rearm undoes it.
+func (h *SinkHealth) Release() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.released {
+		return
+	}
+	h.released = true
+	if !h.paused.IsZero() {
+		close(h.resumed)
+	}
+}
+
+// Rearm lets probes pause polling again after Release, for a restarted worker
+func (h *SinkHealth) Rearm() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.released {
+		return
+	}
+	h.released = false
+	if !h.paused.IsZero() {
+		h.resumed = make(chan struct{})
+	}
+}
+
+// Close stops probing and releases any pause
+func (h *SinkHealth) Close() {
+	if h == nil {
+		return
+	}
+	h.cancel()
+	<-h.done
+	h.Release()
+}
+
+// LeaseKeeper wraps the KCL checkpointer to remember the status of every
+// shard whose lease KCL renews or acquires. KCL renews a lease in the same
+// loop that calls GetRecords, so a shard held in ProcessRecords by a sink
+// pause renews its own lease through it instead. A nil *LeaseKeeper renews
+// nothing.
+type LeaseKeeper struct {
+	chk.Checkpointer
+	workerID string
+	refresh  time.Duration // renew this long before the lease times out, as KCL does
+
+	mu     sync.Mutex
+	shards map[string]*par.ShardStatus
+}
+
+// NewLeaseKeeper wraps inner for consumer.sink_health
+func NewLeaseKeeper(inner chk.Checkpointer, kclConfig *config.KinesisClientLibConfiguration) *LeaseKeeper {
+	return &LeaseKeeper{
+		Checkpointer: inner,
+		workerID:     kclConfig.WorkerID,
+		refresh:      time.Duration(kclConfig.LeaseRefreshPeriodMillis) * time.Millisecond,
+		shards:       make(map[string]*par.ShardStatus),
+	}
+}
+
+// GetLease remembers the shard and calls the inner GetLease
+func (k *LeaseKeeper) GetLease(shard *par.ShardStatus, newAssignTo string) error {
+	k.mu.Lock()
+	k.shards[shard.ID] = shard
+	k.mu.Unlock()
+	return k.Checkpointer.GetLease(shard, newAssignTo)
+}
+
+// Renew renews this worker's lease on the shard if it is due, with the same
+// call KCL makes before each GetRecords
+func (k *LeaseKeeper) Renew(shardID string) error {
+	if k == nil {
+		return nil
+	}
+	k.mu.Lock()
+	shard, ok := k.shards[shardID]
+	k.mu.Unlock()
+	if !ok || time.Now().Before(shard.GetLeaseTimeout().Add(-k.refresh)) {
+		return nil
+	}
+	return k.Checkpointer.GetLease(shard, k.workerID)
+}
+
+// waitForSink holds a KCL shard's batch while polling is paused, since KCL
+// calls GetRecords again as soon as ProcessRecords returns, renewing the
+// shard's lease meanwhile. It returns false when the worker is shutting down
+// or the lease was lost, leaving the batch unhandled to be read again.
+func (rp *RecordProcessor) waitForSink(records int) bool {
+	if !rp.pc.SinkHealth.Paused() {
+		return true
+	}
+	log.Printf("[%s] Holding %d records until the sink recovers", rp.label, records)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), sinkPauseLeaseCheck)
+		err := rp.pc.SinkHealth.Wait(ctx)
+		cancel()
+		switch {
+		case err == nil:
+			return true
+		case errors.Is(err, errSinkHealthReleased):
+			return false
+		}
+		if err := rp.pc.LeaseKeeper.Renew(rp.shardID); err != nil {
+			log.Printf("[%s] Lease renewal during the sink pause failed, leaving the batch to be read again: %v", rp.label, err)
+			return false
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
+)
+
+// probedSink is a collecting sink whose probe fails while it is down
+type probedSink struct {
+	collectingSink
+	down atomic.Bool
+}
+
+func (s *probedSink) Probe(ctx context.Context) error {
+	if s.down.Load() {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+// newTestSinkHealth probes sink every millisecond, pausing after two failures
+func newTestSinkHealth(t *testing.T, sink Sink) *SinkHealth {
+	t.Helper()
+	cfg := &Config{}
+	cfg.Consumer.SinkHealth.ProbeIntervalMs = 1
+	cfg.Consumer.SinkHealth.FailureThreshold = 2
+	health, err := NewSinkHealth(cfg, sink)
+	if err != nil {
+		t.Fatalf("NewSinkHealth() = %v", err)
+	}
+	t.Cleanup(health.Close)
+	return health
+}
+
+func TestSinkHealthPausesPolling(t *testing.T) {
+	client := &pollCountingKinesis{fakeKinesis: newFakeKinesis(testStream, testShard), polls: make(map[string]int)}
+	sink := &probedSink{}
+	msp := newTestProcessor(client, &Config{})
+	msp.pc.Sink = sink
+	msp.pc.SinkHealth = newTestSinkHealth(t, sink)
+	polls := func() int {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return client.polls[testShard]
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go msp.ProcessShard(ctx, &wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	waitFor(t, func() bool { return polls() > 0 })
+
+	sink.down.Store(true)
+	waitFor(t, msp.pc.SinkHealth.Paused)
+	// A GetRecords call already waiting for its poll interval may still be made
+	time.Sleep(10 * time.Millisecond)
+	paused := polls()
+	seq := client.AddRecords(t, testShard, "user_1", testEvents(0, 3)...)
+	time.Sleep(50 * time.Millisecond)
+	if got := polls(); got != paused {
+		t.Errorf("made %d GetRecords calls while paused, want none", got-paused)
+	}
+
+	sink.down.Store(false)
+	waitFor(t, func() bool { return !msp.pc.SinkHealth.Paused() })
+	waitFor(t, func() bool { return len(sink.records()) == len(seq) })
+	if got := polls(); got <= paused {
+		t.Error("polling did not resume with the sink")
+	}
+}
+
+func TestSinkHealthHoldsKCLBatch(t *testing.T) {
+	client := newFakeKinesis(testStream, testShard)
+	client.AddRecords(t, testShard, "user_1", testEvents(0, 3)...)
+	sink := &probedSink{}
+	cfg := &Config{}
+	cfg.Kinesis.StreamName = testStream
+	rp := &RecordProcessor{pc: &ProcessorContext{Config: cfg, Sink: sink, Kinesis: client, SinkHealth: newTestSinkHealth(t, sink)}}
+	rp.Initialize(&interfaces.InitializationInput{ShardId: testShard})
+
+	sink.down.Store(true)
+	waitFor(t, rp.pc.SinkHealth.Paused)
+	checkpointer := &recordingCheckpointer{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rp.ProcessRecords(&interfaces.ProcessRecordsInput{Records: testKinesisRecords(t, client, 0, 1, 2), Checkpointer: checkpointer})
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("ProcessRecords returned while the sink was down")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := sink.records(); len(got) != 0 {
+		t.Errorf("wrote %v while the sink was down, want the batch held", got)
+	}
+
+	sink.down.Store(false)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ProcessRecords still held after the sink recovered")
+	}
+	if got := len(sink.records()); got != 3 || len(checkpointer.checkpoints) != 1 {
+		t.Errorf("wrote %d records and made %d checkpoints after recovery, want 3 and 1", got, len(checkpointer.checkpoints))
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// SpillBuffer is a FIFO of records that keeps at most memLimit bytes in
+// memory and spills the overflow to a temp file on disk. Once anything has
+// spilled, new records also go to disk until the disk backlog drains, so the
+// order records are popped in always matches the order they were pushed.
+//
+// The disk backlog is unbounded unless spillLimit is set. Once it would grow
+// past spillLimit the buffer is full: Push blocks until records are popped,
+// or with shedWhenFull drops the oldest records to make room instead.
+type SpillBuffer struct {
+	mu           sync.Mutex
+	notEmpty     *sync.Cond
+	notFull      *sync.Cond
+	memLimit     int64
+	memBytes     int64
+	mem          []bufferedRecord
+	spillLimit   int64 // 0 is unbounded
+	spillBytes   int64 // size of the spilled records not read back yet
+	spilled      int
+	shedWhenFull bool
+	shedding     bool // the last Push shed records
+	writer       *os.File
+	reader       *bufio.Reader
+	readFile     *os.File
+	closed       bool
+	labels       shardLabeler
+}
+
+type bufferedRecord struct {
+	record *SinkRecord
+	size   int64
+}
+
+// NewSpillBuffer creates a buffer backed by a temp file in the default temp directory
+func NewSpillBuffer(memLimit, spillLimit int64, shedWhenFull bool, labels shardLabeler) (*SpillBuffer, error) {
+	writer, err := os.CreateTemp("", "kds-spill-*.jsonl")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spill file: %w", err)
+	}
+	readFile, err := os.Open(writer.Name())
+	if err != nil {
+		writer.Close()
+		os.Remove(writer.Name())
+		return nil, fmt.Errorf("failed to open spill file for reading: %w", err)
+	}
+
+	sb := &SpillBuffer{
+		memLimit:     memLimit,
+		spillLimit:   spillLimit,
+		shedWhenFull: shedWhenFull,
+		labels:       labels,
+		writer:       writer,
+		readFile:     readFile,
+		reader:       bufio.NewReader(readFile),
+	}
+	sb.notEmpty = sync.NewCond(&sb.mu)
+	sb.notFull = sync.NewCond(&sb.mu)
+	return sb, nil
+}
+
+// Push appends a record, spilling it to disk if the memory budget is
+// exhausted. When the buffer is full it waits for room, or sheds the oldest
+// records and returns how many it dropped.
+func (sb *SpillBuffer) Push(record *SinkRecord) (int, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode record for buffering: %w", err)
+	}
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	size := int64(len(data))
+	shed := 0
+	for !sb.closed && sb.full(size) {
+		if !sb.shedWhenFull {
+			sb.notFull.Wait()
+			continue
+		}
+		if _, err := sb.popLocked(); err != nil {
+			return shed, err
+		}
+		shed++
+	}
+	if sb.closed {
+		return shed, fmt.Errorf("buffer is closed")
+	}
+	if shed > 0 && !sb.shedding {
+		log.Printf("[%s] Buffer full (%d bytes spilled), shedding the oldest records", sb.labels.logLabel(record.ShardID), sb.spillBytes)
+	}
+	sb.shedding = shed > 0
+
+	if sb.spilled == 0 && sb.memBytes+size <= sb.memLimit {
+		sb.mem = append(sb.mem, bufferedRecord{record: record, size: size})
+		sb.memBytes += size
+	} else {
+		if _, err := sb.writer.Write(append(data, '\n')); err != nil {
+			return shed, fmt.Errorf("failed to spill record to disk: %w", err)
+		}
+		if sb.spilled == 0 {
+			log.Printf("[%s] Buffer exceeded %d bytes in memory, spilling to %s",
+				sb.labels.logLabel(record.ShardID), sb.memLimit, sb.writer.Name())
+		}
+		sb.spilled++
+		sb.spillBytes += size + 1
+	}
+
+	sb.notEmpty.Signal()
+	return shed, nil
+}
+
+// full reports whether a record of size bytes would take the disk backlog
+// past spillLimit. An empty buffer always takes the record.
+func (sb *SpillBuffer) full(size int64) bool {
+	if sb.spillLimit <= 0 || len(sb.mem)+sb.spilled == 0 {
+		return false
+	}
+	if sb.spilled == 0 && sb.memBytes+size <= sb.memLimit {
+		return false
+	}
+	return sb.spillBytes+size+1 > sb.spillLimit
+}
+
+// Pop removes and returns the oldest record, blocking until one is available.
+// It returns false once the buffer has been closed.
+func (sb *SpillBuffer) Pop() (*SinkRecord, bool, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	for len(sb.mem) == 0 && sb.spilled == 0 && !sb.closed {
+		sb.notEmpty.Wait()
+	}
+	if sb.closed {
+		return nil, false, nil
+	}
+
+	record, err := sb.popLocked()
+	if err != nil {
+		return nil, false, err
+	}
+	sb.notFull.Broadcast()
+	return record, true, nil
+}
+
+// popLocked removes and returns the oldest record of a non-empty buffer
+func (sb *SpillBuffer) popLocked() (*SinkRecord, error) {
+	if len(sb.mem) > 0 {
+		next := sb.mem[0]
+		sb.mem[0] = bufferedRecord{}
+		sb.mem = sb.mem[1:]
+		sb.memBytes -= next.size
+		return next.record, nil
+	}
+
+	line, err := sb.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spilled record: %w", err)
+	}
+	var record SinkRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return nil, fmt.Errorf("failed to decode spilled record: %w", err)
+	}
+
+	sb.spilled--
+	sb.spillBytes -= int64(len(line))
+	if sb.spilled == 0 {
+		sb.spillBytes = 0
+		if err := sb.resetSpillFile(); err != nil {
+			return nil, err
+		}
+	}
+	return &record, nil
+}
+
+// resetSpillFile truncates the spill file once everything on it has been read back
+func (sb *SpillBuffer) resetSpillFile() error {
+	if err := sb.writer.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate spill file: %w", err)
+	}
+	if _, err := sb.writer.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind spill file: %w", err)
+	}
+	if _, err := sb.readFile.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind spill reader: %w", err)
+	}
+	sb.reader.Reset(sb.readFile)
+	return nil
+}
+
+// Len returns the number of records held in memory and on disk
+func (sb *SpillBuffer) Len() int {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return len(sb.mem) + sb.spilled
+}
+
+// Closed reports whether Close has been called
+func (sb *SpillBuffer) Closed() bool {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.closed
+}
+
+// Close discards any remaining records, wakes blocked readers and removes the spill file
+func (sb *SpillBuffer) Close() error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	if sb.closed {
+		return nil
+	}
+	sb.closed = true
+	sb.notEmpty.Broadcast()
+	sb.notFull.Broadcast()
+
+	sb.readFile.Close()
+	sb.writer.Close()
+	return os.Remove(sb.writer.Name())
+}
+
+// validateBuffer checks the buffer limits only come with buffering, and that
+// shedding has a limit to shed at
+func validateBuffer(cfg *Config) error {
+	if cfg.Consumer.BufferSpillBytes > 0 && cfg.Consumer.BufferMemoryBytes <= 0 {
+		return fmt.Errorf("consumer.buffer_spill_bytes requires buffer_memory_bytes")
+	}
+	if cfg.Consumer.ShedWhenFull && cfg.Consumer.BufferSpillBytes <= 0 {
+		return fmt.Errorf("consumer.shed_when_full requires buffer_spill_bytes")
+	}
+	return nil
+}
+
+// BufferedSink decouples a shard's processor from a slow sink through a
+// SpillBuffer. Records are delivered to the wrapped sink in order by a
+// background goroutine, and Delivered reports how far delivery has got so
+// the processor never checkpoints past a record that is still buffered.
+// Records shed from a full buffer are never delivered: the next delivered
+// record moves the checkpoint past them, so they are not read again.
+type BufferedSink struct {
+	next      Sink
+	buffer    *SpillBuffer
+	metrics   *Metrics
+	mu        sync.Mutex
+	delivered string
+	accepted  int
+	written   int
+	shed      int
+	done      chan struct{}
+}
+
+const (
+	// sinkRetryInterval is how long the delivery loop waits before retrying a failed write
+	sinkRetryInterval = time.Second
+
+	// bufferDrainTimeout bounds how long a closing shard waits for its buffer to reach the sink
+	bufferDrainTimeout = 30 * time.Second
+)
+
+// NewBufferedSink starts delivering buffered records to next, within the
+// consumer.buffer_memory_bytes and buffer_spill_bytes limits
+func NewBufferedSink(next Sink, cfg *Config, metrics *Metrics) (*BufferedSink, error) {
+	buffer, err := NewSpillBuffer(cfg.Consumer.BufferMemoryBytes, cfg.Consumer.BufferSpillBytes, cfg.Consumer.ShedWhenFull, newShardLabeler(cfg))
+	if err != nil {
+		return nil, err
+	}
+
+	bs := &BufferedSink{next: next, buffer: buffer, metrics: metrics, done: make(chan struct{})}
+	go bs.deliver()
+	return bs, nil
+}
+
+func (bs *BufferedSink) deliver() {
+	defer close(bs.done)
+	for {
+		record, ok, err := bs.buffer.Pop()
+		if err != nil {
+			log.Printf("Buffered sink stopped: %v", err)
+			return
+		}
+		if !ok {
+			return
+		}
+
+		// Keep retrying so a sink outage stalls delivery (and checkpoints) instead of losing records
+		for {
+			if err := bs.next.Write(record); err == nil {
+				break
+			} else {
+				log.Printf("[%s] Sink write failed, retrying in %v: %v", bs.buffer.labels.logLabel(record.ShardID), sinkRetryInterval, err)
+			}
+			time.Sleep(sinkRetryInterval)
+			if bs.buffer.Closed() {
+				return
+			}
+		}
+
+		bs.mu.Lock()
+		bs.delivered = record.SequenceNumber
+		bs.written++
+		bs.mu.Unlock()
+	}
+}
+
+// Write enqueues the record for delivery. It only blocks on local disk I/O,
+// or on a full buffer that doesn't shed.
+func (bs *BufferedSink) Write(record *SinkRecord) error {
+	shed, err := bs.buffer.Push(record)
+	if shed > 0 {
+		bs.metrics.RecordsShed(record.ShardID, shed)
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.shed += shed
+	if err != nil {
+		return err
+	}
+	bs.accepted++
+	return nil
+}
+
+// Delivered returns the sequence number of the last record accepted by the wrapped sink
+func (bs *BufferedSink) Delivered() string {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.delivered
+}
+
+// Pending returns the number of records still waiting to be delivered
+func (bs *BufferedSink) Pending() int {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.accepted - bs.written - bs.shed
+}
+
+// WaitDrained blocks until every buffered record is delivered or the timeout expires
+func (bs *BufferedSink) WaitDrained(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for bs.Pending() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+// Close stops delivery and discards undelivered records, which were never
+// checkpointed and will be re-read by whoever owns the shard next. The
+// wrapped sink is shared between shards and is not closed.
+func (bs *BufferedSink) Close() error {
+	err := bs.buffer.Close()
+	<-bs.done
+	return err
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSinkRecords returns n records of the test shard, numbered from first
+func testSinkRecords(first, n int) []*SinkRecord {
+	records := make([]*SinkRecord, n)
+	for i := range records {
+		records[i] = &SinkRecord{
+			Stream:         testStream,
+			ShardID:        testShard,
+			SequenceNumber: fmt.Sprint(first + i),
+			PartitionKey:   "user_1",
+			Event:          Event{EventID: fmt.Sprintf("evt_%d", first+i), Action: "view"},
+		}
+	}
+	return records
+}
+
+func TestSpillBuffer(t *testing.T) {
+	recordSize := func() int64 {
+		sb, err := NewSpillBuffer(1<<20, 0, false, shardLabeler{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sb.Close()
+		sb.Push(testSinkRecords(0, 1)[0])
+		return sb.memBytes
+	}()
+
+	tests := []struct {
+		name       string
+		memLimit   int64
+		spillLimit int64
+		push       int
+		wantShed   int
+		wantFirst  int // sequence number of the first record popped
+	}{
+		{name: "all in memory", memLimit: 1 << 20, push: 5},
+		{name: "spills past the memory limit", memLimit: 2 * recordSize, push: 5},
+		{name: "all spilled", memLimit: 1, push: 5},
+		// Memory is only refilled once the spill file is read back, so
+		// making room for the fifth and sixth records sheds four
+		{name: "sheds the oldest when full", memLimit: 2 * recordSize, spillLimit: 2 * (recordSize + 1), push: 6, wantShed: 4, wantFirst: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sb, err := NewSpillBuffer(tt.memLimit, tt.spillLimit, tt.spillLimit > 0, shardLabeler{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sb.Close()
+
+			shed := 0
+			for _, record := range testSinkRecords(0, tt.push) {
+				n, err := sb.Push(record)
+				if err != nil {
+					t.Fatalf("Push: %v", err)
+				}
+				shed += n
+			}
+			if shed != tt.wantShed {
+				t.Errorf("shed %d records, want %d", shed, tt.wantShed)
+			}
+			if want := tt.push - tt.wantShed; sb.Len() != want {
+				t.Fatalf("holds %d records, want %d", sb.Len(), want)
+			}
+
+			// Records come back in order whether they were kept in memory or spilled
+			for want := tt.wantFirst; want < tt.push; want++ {
+				record, ok, err := sb.Pop()
+				if err != nil || !ok {
+					t.Fatalf("Pop = %v, %t", err, ok)
+				}
+				if record.SequenceNumber != fmt.Sprint(want) || record.Event.EventID != fmt.Sprintf("evt_%d", want) {
+					t.Errorf("popped record %s (%s), want %d", record.SequenceNumber, record.Event.EventID, want)
+				}
+			}
+			if sb.Len() != 0 || sb.spillBytes != 0 {
+				t.Errorf("drained buffer holds %d records, %d spilled bytes", sb.Len(), sb.spillBytes)
+			}
+
+			// The emptied spill file is reused
+			sb.Push(testSinkRecords(100, 1)[0])
+			if record, _, err := sb.Pop(); err != nil || record.SequenceNumber != "100" {
+				t.Errorf("Pop after reuse = %v, %v", record, err)
+			}
+		})
+	}
+}
+
+func TestSpillBufferClose(t *testing.T) {
+	sb, err := NewSpillBuffer(1, 0, false, shardLabeler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb.Push(testSinkRecords(0, 1)[0])
+
+	popped := make(chan bool)
+	go func() {
+		sb.Pop()
+		_, ok, _ := sb.Pop()
+		popped <- ok
+	}()
+	if err := sb.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if <-popped {
+		t.Error("Pop on a closed buffer returned a record")
+	}
+	if _, err := sb.Push(testSinkRecords(1, 1)[0]); err == nil {
+		t.Error("Push on a closed buffer succeeded")
+	}
+}
+
+func TestValidateBuffer(t *testing.T) {
+	tests := []struct {
+		name    string
+		mem     int64
+		spill   int64
+		shed    bool
+		wantErr bool
+	}{
+		{name: "no buffering"},
+		{name: "memory only", mem: 1024},
+		{name: "bounded", mem: 1024, spill: 4096},
+		{name: "shedding", mem: 1024, spill: 4096, shed: true},
+		{name: "spill limit without buffering", spill: 4096, wantErr: true},
+		{name: "shedding without a spill limit", mem: 1024, shed: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.BufferMemoryBytes = tt.mem
+			cfg.Consumer.BufferSpillBytes = tt.spill
+			cfg.Consumer.ShedWhenFull = tt.shed
+			if err := validateBuffer(cfg); (err != nil) != tt.wantErr {
+				t.Errorf("validateBuffer() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// gatedSink holds its first write until released
+type gatedSink struct {
+	collectingSink
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (s *gatedSink) Write(record *SinkRecord) error {
+	s.once.Do(func() {
+		close(s.started)
+		<-s.release
+	})
+	return s.collectingSink.Write(record)
+}
+
+func TestBufferedSinkShedding(t *testing.T) {
+	const push = 10
+	recordSize := func() int64 {
+		sb, err := NewSpillBuffer(1<<20, 0, false, shardLabeler{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sb.Close()
+		sb.Push(testSinkRecords(0, 1)[0])
+		return sb.memBytes
+	}()
+	cfg := &Config{}
+	cfg.Consumer.BufferMemoryBytes = 2 * recordSize
+	cfg.Consumer.BufferSpillBytes = 2 * (recordSize + 1)
+	cfg.Consumer.ShedWhenFull = true
+	metrics := NewMetrics()
+	next := &gatedSink{started: make(chan struct{}), release: make(chan struct{})}
+	bs, err := NewBufferedSink(next, cfg, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	// The sink stalls on the first record while the rest overflow the buffer
+	records := testSinkRecords(0, push)
+	bs.Write(records[0])
+	<-next.started
+	for _, record := range records[1:] {
+		if err := bs.Write(record); err != nil {
+			t.Fatalf("Write() = %v, want the oldest records shed instead", err)
+		}
+	}
+	if delivered := bs.Delivered(); delivered != "" {
+		t.Errorf("Delivered() = %q while the sink is stalled, want none", delivered)
+	}
+	shed := metrics.Snapshot()[ShardKey{ShardID: testShard}].Shed
+	if shed == 0 {
+		t.Fatal("shed no records from a full buffer")
+	}
+
+	close(next.release)
+	if !bs.WaitDrained(5 * time.Second) {
+		t.Fatalf("WaitDrained() timed out with %d pending", bs.Pending())
+	}
+	if got := len(next.records()); int64(got) != push-shed {
+		t.Errorf("sink received %d records with %d shed, want %d", got, shed, push-int(shed))
+	}
+	// The checkpoint moves past the shed records, so they are not read again
+	if delivered := bs.Delivered(); delivered != records[push-1].SequenceNumber {
+		t.Errorf("Delivered() = %q, want the last record %s", delivered, records[push-1].SequenceNumber)
+	}
+}
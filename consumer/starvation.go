@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// latencyProbeInterval is how often the scheduler latency probe wakes up
+	latencyProbeInterval = 100 * time.Millisecond
+
+	// latencyRecoverySamples is how many consecutive on-time wake-ups clear a degraded state
+	latencyRecoverySamples = 10
+
+	// healthCheckLatency names the scheduler latency readiness check
+	healthCheckLatency = "scheduling_latency"
+)
+
+// LatencyMonitor detects CPU starvation by measuring how late a periodic
+// timer fires. When the process is starved, every goroutine (including the
+// record processors and the KCL lease renewer) is delayed by about as much
+// as the probe, so a late probe is an early warning that leases may lapse.
+type LatencyMonitor struct {
+	threshold time.Duration
+	health    *Health
+	degraded  bool
+	healthy   int
+}
+
+// NewLatencyMonitor creates a monitor flipping readiness when wake-ups are later than threshold
+func NewLatencyMonitor(threshold time.Duration, health *Health) *LatencyMonitor {
+	return &LatencyMonitor{threshold: threshold, health: health}
+}
+
+// Observe records one wake-up delay and updates readiness
+func (lm *LatencyMonitor) Observe(delay time.Duration) {
+	if delay > lm.threshold {
+		lm.healthy = 0
+		if !lm.degraded {
+			lm.degraded = true
+			log.Printf("WARNING: processing loop delayed %v (threshold %v), process looks CPU-starved; marking not ready",
+				delay, lm.threshold)
+		}
+		lm.health.Set(healthCheckLatency, fmt.Errorf("loop delayed %v, threshold %v", delay.Round(time.Millisecond), lm.threshold))
+		return
+	}
+
+	if lm.degraded {
+		lm.healthy++
+		if lm.healthy >= latencyRecoverySamples {
+			lm.degraded = false
+			lm.health.Set(healthCheckLatency, nil)
+			log.Printf("Processing loop latency back under %v, marking ready", lm.threshold)
+		}
+	}
+}
+
+// Run probes until ctx is cancelled
+func (lm *LatencyMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(latencyProbeInterval)
+	defer ticker.Stop()
+
+	expected := time.Now().Add(latencyProbeInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// The ticker drops ticks a slow receiver misses, so measure
+			// against the wall clock rather than the tick time
+			now := time.Now()
+			lm.Observe(now.Sub(expected))
+			expected = now.Add(latencyProbeInterval)
+		}
+	}
+}
+
+// startLatencyMonitor runs a LatencyMonitor when consumer.health_degraded_ms
+// is set and returns a function that stops it
+func startLatencyMonitor(cfg *Config, health *Health) func() {
+	if cfg.Consumer.HealthDegradedMs <= 0 {
+		return func() {}
+	}
+
+	threshold := time.Duration(cfg.Consumer.HealthDegradedMs) * time.Millisecond
+	log.Printf("Monitoring processing loop latency, not ready above %v", threshold)
+	ctx, cancel := context.WithCancel(context.Background())
+	go NewLatencyMonitor(threshold, health).Run(ctx)
+	return cancel
+}
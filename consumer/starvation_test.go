@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyMonitorReadiness(t *testing.T) {
+	const threshold = 50 * time.Millisecond
+	onTime := func(n int) []time.Duration {
+		return make([]time.Duration, n)
+	}
+	tests := []struct {
+		name      string
+		delays    []time.Duration // wake-up delays observed in order
+		wantReady bool
+	}{
+		{name: "on time", delays: onTime(3), wantReady: true},
+		{name: "delay at the threshold", delays: []time.Duration{threshold}, wantReady: true},
+		{name: "delayed", delays: []time.Duration{0, 2 * threshold}, wantReady: false},
+		{name: "not yet recovered", delays: append([]time.Duration{2 * threshold}, onTime(latencyRecoverySamples-1)...), wantReady: false},
+		{name: "recovered", delays: append([]time.Duration{2 * threshold}, onTime(latencyRecoverySamples)...), wantReady: true},
+		{name: "delayed again while recovering", delays: append(append([]time.Duration{2 * threshold}, onTime(latencyRecoverySamples-1)...), 2*threshold), wantReady: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			health := NewHealth()
+			monitor := NewLatencyMonitor(threshold, health)
+			server := httptest.NewServer(newHTTPMux(&Config{}, health, NewMetrics(), nil, nil, nil))
+			defer server.Close()
+
+			for _, delay := range tt.delays {
+				monitor.Observe(delay)
+			}
+
+			resp, err := http.Get(server.URL + "/readyz")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			wantStatus := http.StatusOK
+			if !tt.wantReady {
+				wantStatus = http.StatusServiceUnavailable
+			}
+			if resp.StatusCode != wantStatus {
+				t.Errorf("/readyz answered %d, want %d", resp.StatusCode, wantStatus)
+			}
+			if _, reason := health.Ready(); !tt.wantReady && !strings.Contains(reason, healthCheckLatency) {
+				t.Errorf("not ready because %q, want the %s check", reason, healthCheckLatency)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// Behaviors for consumer.on_stream_deleted
+const (
+	OnStreamDeletedExit            = "exit"
+	OnStreamDeletedWaitForRecreate = "wait_for_recreate"
+)
+
+// streamWatchInterval is how often KCL mode checks that the stream still exists
+const streamWatchInterval = 10 * time.Second
+
+// streamDeletedPolicy returns the configured on_stream_deleted behavior, defaulting to exit
+func streamDeletedPolicy(cfg *Config) (string, error) {
+	switch cfg.Consumer.OnStreamDeleted {
+	case "", OnStreamDeletedExit:
+		return OnStreamDeletedExit, nil
+	case OnStreamDeletedWaitForRecreate:
+		return OnStreamDeletedWaitForRecreate, nil
+	default:
+		return "", fmt.Errorf("invalid on_stream_deleted: %s. Must be '%s' or '%s'",
+			cfg.Consumer.OnStreamDeleted, OnStreamDeletedExit, OnStreamDeletedWaitForRecreate)
+	}
+}
+
+// isStreamNotFound reports whether err means the stream (or shard) no longer exists
+func isStreamNotFound(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == kinesis.ErrCodeResourceNotFoundException
+	}
+	return false
+}
+
+// streamExists checks whether the stream is currently present
+func streamExists(client KinesisAPI, streamName string) (bool, error) {
+	_, err := client.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(streamName),
+	})
+	if err == nil {
+		return true, nil
+	}
+	if isStreamNotFound(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// waitForStream blocks until the stream exists and is ACTIVE or the context is cancelled
+func waitForStream(ctx context.Context, client KinesisAPI, streamName string, interval time.Duration) error {
+	log.Printf("Waiting for stream %s to be recreated...", streamName)
+	for {
+		output, err := client.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{
+			StreamName: aws.String(streamName),
+		})
+		if err == nil && aws.StringValue(output.StreamDescriptionSummary.StreamStatus) == kinesis.StreamStatusActive {
+			log.Printf("Stream %s is active again", streamName)
+			return nil
+		}
+		if err != nil && !isStreamNotFound(err) {
+			log.Printf("Failed to describe stream %s while waiting: %v", streamName, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// watchStream signals on the returned channel once the stream is found to be deleted
+func watchStream(ctx context.Context, client KinesisAPI, streamName string, interval time.Duration) <-chan struct{} {
+	deleted := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				exists, err := streamExists(client, streamName)
+				if err != nil {
+					log.Printf("Failed to check stream %s: %v", streamName, err)
+					continue
+				}
+				if !exists {
+					close(deleted)
+					return
+				}
+			}
+		}
+	}()
+	return deleted
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestStreamDeletedPolicy(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "", want: OnStreamDeletedExit},
+		{value: OnStreamDeletedExit, want: OnStreamDeletedExit},
+		{value: OnStreamDeletedWaitForRecreate, want: OnStreamDeletedWaitForRecreate},
+		{value: "restart", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Consumer.OnStreamDeleted = tt.value
+			got, err := streamDeletedPolicy(cfg)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("streamDeletedPolicy() = %q, %v; want %q, error %t", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsStreamNotFound(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "resource not found", err: awserr.New(kinesis.ErrCodeResourceNotFoundException, "gone", nil), want: true},
+		{name: "other AWS error", err: awserr.New(kinesis.ErrCodeLimitExceededException, "slow down", nil)},
+		{name: "plain error", err: errors.New("boom")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isStreamNotFound(tt.err); got != tt.want {
+				t.Errorf("isStreamNotFound() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamWatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		stream      string
+		wantDeleted bool
+	}{
+		{name: "existing stream", stream: testStream},
+		{name: "deleted stream", stream: "deleted-stream", wantDeleted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeKinesis(testStream, testShard)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			deleted := watchStream(ctx, fake, tt.stream, time.Millisecond)
+			select {
+			case <-deleted:
+				if !tt.wantDeleted {
+					t.Error("watch reported an existing stream deleted")
+				}
+			case <-time.After(50 * time.Millisecond):
+				if tt.wantDeleted {
+					t.Error("watch did not report the deleted stream")
+				}
+			}
+
+			waitCtx, stopWait := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer stopWait()
+			err := waitForStream(waitCtx, fake, tt.stream, time.Millisecond)
+			if tt.wantDeleted != (err != nil) {
+				t.Errorf("waitForStream() = %v, want an error %t", err, tt.wantDeleted)
+			}
+		})
+	}
+}
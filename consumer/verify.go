@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ProducedRecord is one line of the producer's tee_file
+type ProducedRecord struct {
+	ShardID        string          `json:"shard_id"`
+	SequenceNumber string          `json:"sequence_number"`
+	PartitionKey   string          `json:"partition_key"`
+	Event          json.RawMessage `json:"event"`
+}
+
+// recordPosition identifies a record by where Kinesis stored it, which
+// unlike the event ID is unique
+type recordPosition struct {
+	shardID        string
+	sequenceNumber string
+}
+
+// VerifySample is an offending record in the verify report
+type VerifySample struct {
+	EventID        string `json:"event_id,omitempty"`
+	PartitionKey   string `json:"partition_key"`
+	ShardID        string `json:"shard_id"`
+	SequenceNumber string `json:"sequence_number"`
+}
+
+// VerifyReport compares what the producer sent with what the consumer wrote
+type VerifyReport struct {
+	Produced   int `json:"produced"`
+	Consumed   int `json:"consumed"`   // sink lines, duplicates included
+	Lost       int `json:"lost"`       // produced but never consumed
+	Duplicates int `json:"duplicates"` // consumptions beyond the first of a record
+	OutOfOrder int `json:"out_of_order"`
+	Unexpected int `json:"unexpected"` // consumed but not in the tee file, e.g. from an earlier run
+
+	LostSamples       []VerifySample `json:"lost_samples,omitempty"`
+	DuplicateSamples  []VerifySample `json:"duplicate_samples,omitempty"`
+	OutOfOrderSamples []VerifySample `json:"out_of_order_samples,omitempty"`
+}
+
+// OK reports whether nothing was lost, duplicated or reordered
+func (r *VerifyReport) OK() bool {
+	return r.Lost == 0 && r.Duplicates == 0 && r.OutOfOrder == 0
+}
+
+// verifier checks consumer output against the producer's tee file
+type verifier struct {
+	samples  int
+	produced map[recordPosition]*ProducedRecord
+	consumed map[recordPosition]int
+	report   VerifyReport
+}
+
+func newVerifier(produced []*ProducedRecord, samples int) *verifier {
+	v := &verifier{
+		samples:  samples,
+		produced: make(map[recordPosition]*ProducedRecord, len(produced)),
+		consumed: make(map[recordPosition]int, len(produced)),
+	}
+	for _, record := range produced {
+		v.produced[recordPosition{record.ShardID, record.SequenceNumber}] = record
+	}
+	v.report.Produced = len(v.produced)
+	return v
+}
+
+// consume checks the records of one consumer output file in the order they
+// were written. Kinesis sequence numbers of a partition key increase over
+// time, across a reshard too, so a record consumed after one of the same key
+// with a higher sequence number was delivered out of order. Only the first
+// consumption of a record counts toward order; replays count as duplicates.
+func (v *verifier) consume(records []*SinkRecord) {
+	latest := make(map[string]*big.Int)
+	for _, record := range records {
+		v.report.Consumed++
+		pos := recordPosition{record.ShardID, record.SequenceNumber}
+		sample := VerifySample{
+			EventID:        record.Event.EventID,
+			PartitionKey:   record.PartitionKey,
+			ShardID:        record.ShardID,
+			SequenceNumber: record.SequenceNumber,
+		}
+		if _, ok := v.produced[pos]; !ok {
+			v.report.Unexpected++
+			continue
+		}
+		v.consumed[pos]++
+		if v.consumed[pos] > 1 {
+			v.report.Duplicates++
+			v.report.DuplicateSamples = v.sample(v.report.DuplicateSamples, sample)
+			continue
+		}
+
+		seq, ok := new(big.Int).SetString(record.SequenceNumber, 10)
+		if !ok {
+			continue
+		}
+		if prev := latest[record.PartitionKey]; prev != nil && seq.Cmp(prev) < 0 {
+			v.report.OutOfOrder++
+			v.report.OutOfOrderSamples = v.sample(v.report.OutOfOrderSamples, sample)
+			continue
+		}
+		latest[record.PartitionKey] = seq
+	}
+}
+
+// finish counts the produced records never consumed
+func (v *verifier) finish() *VerifyReport {
+	var lost []VerifySample
+	for pos, record := range v.produced {
+		if v.consumed[pos] > 0 {
+			continue
+		}
+		var event Event
+		// A field-mapped event leaves the ID empty; the position still identifies it
+		_ = json.Unmarshal(record.Event, &event)
+		lost = append(lost, VerifySample{
+			EventID:        event.EventID,
+			PartitionKey:   record.PartitionKey,
+			ShardID:        record.ShardID,
+			SequenceNumber: record.SequenceNumber,
+		})
+	}
+	v.report.Lost = len(lost)
+	sort.Slice(lost, func(i, j int) bool {
+		if lost[i].ShardID != lost[j].ShardID {
+			return lost[i].ShardID < lost[j].ShardID
+		}
+		return lost[i].SequenceNumber < lost[j].SequenceNumber
+	})
+	v.report.LostSamples = lost[:min(v.samples, len(lost))]
+	return &v.report
+}
+
+func (v *verifier) sample(samples []VerifySample, sample VerifySample) []VerifySample {
+	if len(samples) >= v.samples {
+		return samples
+	}
+	return append(samples, sample)
+}
+
+// readJSONLines decodes every line of a JSON-lines file with decode
+func readJSONLines(path string, decode func(line []byte) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := decode(scanner.Bytes()); err != nil {
+			return fmt.Errorf("%s line %d: %w", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func readProducedRecords(path string) ([]*ProducedRecord, error) {
+	var records []*ProducedRecord
+	err := readJSONLines(path, func(line []byte) error {
+		var record ProducedRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		records = append(records, &record)
+		return nil
+	})
+	return records, err
+}
+
+// readSinkRecords reads the records of a file sink, skipping the window
+// aggregates and dead letters it may also hold
+func readSinkRecords(path string) ([]*SinkRecord, error) {
+	var records []*SinkRecord
+	err := readJSONLines(path, func(line []byte) error {
+		var record SinkRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		if record.ShardID != "" && record.SequenceNumber != "" {
+			records = append(records, &record)
+		}
+		return nil
+	})
+	return records, err
+}
+
+func printVerifyReport(report *VerifyReport) {
+	fmt.Printf("Produced:     %d\n", report.Produced)
+	fmt.Printf("Consumed:     %d\n", report.Consumed)
+	fmt.Printf("Lost:         %d\n", report.Lost)
+	fmt.Printf("Duplicates:   %d\n", report.Duplicates)
+	fmt.Printf("Out of order: %d\n", report.OutOfOrder)
+	fmt.Printf("Unexpected:   %d\n", report.Unexpected)
+	for _, group := range []struct {
+		name    string
+		samples []VerifySample
+	}{
+		{"Lost", report.LostSamples},
+		{"Duplicated", report.DuplicateSamples},
+		{"Out of order", report.OutOfOrderSamples},
+	} {
+		if len(group.samples) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s (sample):\n", group.name)
+		for _, s := range group.samples {
+			fmt.Printf("  %s key=%s %s/%s\n", s.EventID, s.PartitionKey, s.ShardID, s.SequenceNumber)
+		}
+	}
+}
+
+// runVerifyCommand implements the verify subcommand
+func runVerifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	tee := fs.String("tee", "../producer-tee.jsonl", "the producer's tee_file")
+	output := fs.String("output", "../consumer-output.jsonl", "consumer file sink output; comma-separated for several workers")
+	samples := fs.Int("samples", 10, "offending records listed per kind")
+	jsonOut := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	produced, err := readProducedRecords(*tee)
+	if err != nil {
+		return fmt.Errorf("failed to read tee file: %w", err)
+	}
+	v := newVerifier(produced, *samples)
+	// Each worker writes its own file in the order it handled records, so
+	// order is only comparable within a file
+	for _, path := range strings.Split(*output, ",") {
+		records, err := readSinkRecords(strings.TrimSpace(path))
+		if err != nil {
+			return fmt.Errorf("failed to read consumer output: %w", err)
+		}
+		v.consume(records)
+	}
+	report := v.finish()
+
+	if *jsonOut {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	} else {
+		printVerifyReport(report)
+	}
+	if !report.OK() {
+		return errors.New("consumer output doesn't match what was produced")
+	}
+	return nil
+}
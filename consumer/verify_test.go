@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testProducedRecords returns the tee file records of testSinkRecords(0, n)
+func testProducedRecords(t *testing.T, n int) []*ProducedRecord {
+	t.Helper()
+	var produced []*ProducedRecord
+	for _, record := range testSinkRecords(0, n) {
+		event, err := json.Marshal(record.Event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		produced = append(produced, &ProducedRecord{
+			ShardID:        record.ShardID,
+			SequenceNumber: record.SequenceNumber,
+			PartitionKey:   record.PartitionKey,
+			Event:          event,
+		})
+	}
+	return produced
+}
+
+func TestVerifier(t *testing.T) {
+	tests := []struct {
+		name     string
+		samples  int
+		files    [][]int // the records each output file holds, in order
+		want     VerifyReport
+		wantLost []string
+	}{
+		{
+			name:  "everything consumed in order",
+			files: [][]int{{0, 1, 2, 3, 4}},
+			want:  VerifyReport{Produced: 5, Consumed: 5},
+		},
+		{
+			name:     "lost record",
+			files:    [][]int{{0, 1, 2, 4}},
+			want:     VerifyReport{Produced: 5, Consumed: 4, Lost: 1},
+			wantLost: []string{"evt_3"},
+		},
+		{
+			name:  "replayed record",
+			files: [][]int{{0, 1, 2, 1, 2, 3, 4}},
+			want:  VerifyReport{Produced: 5, Consumed: 7, Duplicates: 2},
+		},
+		{
+			name:  "out of order record",
+			files: [][]int{{0, 2, 1, 3, 4}},
+			want:  VerifyReport{Produced: 5, Consumed: 5, OutOfOrder: 1},
+		},
+		{
+			name:  "order only compared within a file",
+			files: [][]int{{0, 2, 4}, {1, 3}},
+			want:  VerifyReport{Produced: 5, Consumed: 5},
+		},
+		{
+			name:  "record from an earlier run",
+			files: [][]int{{0, 1, 2, 3, 4, 9}},
+			want:  VerifyReport{Produced: 5, Consumed: 6, Unexpected: 1},
+		},
+		{
+			name:     "samples limited",
+			samples:  1,
+			files:    [][]int{{0, 4}},
+			want:     VerifyReport{Produced: 5, Consumed: 2, Lost: 3},
+			wantLost: []string{"evt_1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := tt.samples
+			if samples == 0 {
+				samples = 10
+			}
+			v := newVerifier(testProducedRecords(t, 5), samples)
+			for _, file := range tt.files {
+				var records []*SinkRecord
+				for _, i := range file {
+					records = append(records, testSinkRecords(i, 1)[0])
+				}
+				v.consume(records)
+			}
+			report := v.finish()
+
+			var lost []string
+			for _, sample := range report.LostSamples {
+				lost = append(lost, sample.EventID)
+			}
+			if fmt.Sprint(lost) != fmt.Sprint(tt.wantLost) {
+				t.Errorf("lost samples %v, want %v", lost, tt.wantLost)
+			}
+			got := VerifyReport{Produced: report.Produced, Consumed: report.Consumed, Lost: report.Lost,
+				Duplicates: report.Duplicates, OutOfOrder: report.OutOfOrder, Unexpected: report.Unexpected}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("report %+v, want %+v", got, tt.want)
+			}
+			if report.OK() != (tt.want.Lost == 0 && tt.want.Duplicates == 0 && tt.want.OutOfOrder == 0) {
+				t.Errorf("OK() = %t for %+v", report.OK(), got)
+			}
+		})
+	}
+}
+
+func TestRunVerifyCommand(t *testing.T) {
+	dir := t.TempDir()
+	writeLines := func(name string, lines []any) string {
+		var b strings.Builder
+		for _, line := range lines {
+			data, err := json.Marshal(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.Write(data)
+			b.WriteString("\n\n")
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	var produced []any
+	for _, record := range testProducedRecords(t, 4) {
+		produced = append(produced, record)
+	}
+	tee := writeLines("tee.jsonl", produced)
+	records := testSinkRecords(0, 4)
+	// Window aggregates in the sink file are not records
+	first := writeLines("worker-1.jsonl", []any{records[0], map[string]any{"window_start": "2024-01-01T00:00:00Z"}, records[2]})
+	second := writeLines("worker-2.jsonl", []any{records[1]})
+	third := writeLines("worker-3.jsonl", []any{records[3]})
+
+	tests := []struct {
+		name    string
+		output  string
+		wantErr string
+	}{
+		{name: "every worker's output", output: first + ", " + second + "," + third},
+		{name: "a worker's output missing", output: first + "," + second, wantErr: "doesn't match"},
+		{name: "unreadable output", output: filepath.Join(dir, "missing.jsonl"), wantErr: "failed to read consumer output"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := runVerifyCommand([]string{"-tee", tee, "-output", tt.output, "-json"})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("runVerifyCommand() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("runVerifyCommand() = %v, want an error with %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// EventVersion is the schema version of Event. The producer stamps it on
+// every event; events without one predate versioning and decode as the
+// current version.
+const EventVersion = 1
+
+// ErrUnknownVersion is returned for events of a schema version without a
+// registered decoder
+var ErrUnknownVersion = errors.New("unknown event version")
+
+// Actions for events of an unknown version, the values of consumer.unknown_version_action
+const (
+	UnknownVersionSkip    = "skip"
+	UnknownVersionCurrent = "current"
+	UnknownVersionDLQ     = "dlq"
+)
+
+// eventDecoder decodes the payload of one schema version into the current Event
+type eventDecoder func(fields *FieldMapping, payload []byte, event *Event) error
+
+// eventDecoders holds the decoder of every known schema version. When Event
+// changes incompatibly, bump EventVersion in both binaries and register a
+// decoder here that converts the old layout into the new struct.
+var eventDecoders = map[int]eventDecoder{
+	EventVersion: decodeCurrentEvent,
+}
+
+func decodeCurrentEvent(fields *FieldMapping, payload []byte, event *Event) error {
+	return fields.Unmarshal(payload, event)
+}
+
+// peekVersion reads only the version of an event
+func peekVersion(fields *FieldMapping, payload []byte) (int, error) {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &values); err != nil {
+		return 0, err
+	}
+	raw, ok := values[fields.Key("version")]
+	if !ok {
+		return 0, nil
+	}
+	var version int
+	err := json.Unmarshal(raw, &version)
+	return version, err
+}
+
+// EventVersions decodes every event with the decoder of the schema version
+// it carries and applies consumer.unknown_version_action to versions
+// without one, such as events of a newer producer. A nil *EventVersions
+// skips events of unknown versions.
+type EventVersions struct {
+	action string
+	dlq    *FileSink
+}
+
+// NewEventVersions returns the handling of unknown versions, or nil when
+// consumer.unknown_version_action is skip
+func NewEventVersions(cfg *Config) (*EventVersions, error) {
+	action := cfg.Consumer.UnknownVersionAction
+	path := cfg.Consumer.UnknownVersionDLQPath
+	switch action {
+	case UnknownVersionSkip, UnknownVersionCurrent:
+		if path != "" {
+			return nil, fmt.Errorf("consumer.unknown_version_dlq_path requires unknown_version_action dlq")
+		}
+		if action == UnknownVersionSkip {
+			return nil, nil
+		}
+		return &EventVersions{action: action}, nil
+	case UnknownVersionDLQ:
+		if path == "" {
+			return nil, fmt.Errorf("consumer.unknown_version_action dlq requires unknown_version_dlq_path")
+		}
+		dlq, err := NewFileSink(path)
+		if err != nil {
+			return nil, err
+		}
+		return &EventVersions{action: action, dlq: dlq}, nil
+	default:
+		return nil, fmt.Errorf("invalid unknown_version_action: %s. Must be 'skip', 'current' or 'dlq'", action)
+	}
+}
+
+// Decode decodes payload into event with the decoder of its version. An
+// unknown version returns ErrUnknownVersion, unless the action is current
+// and the event fits the current struct, which then decodes it with the
+// fields it doesn't know dropped.
+func (v *EventVersions) Decode(fields *FieldMapping, payload []byte, event *Event) error {
+	// Nearly every event is of the current version, so decode it as one and
+	// only look for another decoder when it isn't
+	err := decodeCurrentEvent(fields, payload, event)
+	version := event.Version
+	if err != nil {
+		// An older layout may not fit the current struct at all
+		var peekErr error
+		if version, peekErr = peekVersion(fields, payload); peekErr != nil {
+			return err
+		}
+	}
+	if version == 0 || version == EventVersion {
+		return err
+	}
+
+	if decode, ok := eventDecoders[version]; ok {
+		*event = Event{}
+		return decode(fields, payload, event)
+	}
+	if v != nil && v.action == UnknownVersionCurrent && err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w %d", ErrUnknownVersion, version)
+}
+
+// DeadLetter writes an event of an unknown version to unknown_version_dlq_path, if set
+func (v *EventVersions) DeadLetter(shardID string, record *kinesis.Record, err error) {
+	if v == nil || v.dlq == nil {
+		return
+	}
+	deadLetterRecord(v.dlq, shardID, record, err)
+}
+
+// Close closes the dead-letter file
+func (v *EventVersions) Close() error {
+	if v == nil || v.dlq == nil {
+		return nil
+	}
+	return v.dlq.Close()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// decodeTestEventV2 decodes a hypothetical version 2 layout, which renamed
+// event_id and action and carries the value as a string
+func decodeTestEventV2(fields *FieldMapping, payload []byte, event *Event) error {
+	var v2 struct {
+		Version int    `json:"version"`
+		ID      string `json:"id"`
+		UserID  string `json:"user_id"`
+		Kind    string `json:"kind"`
+		Value   string `json:"value"`
+	}
+	if err := json.Unmarshal(payload, &v2); err != nil {
+		return err
+	}
+	value, err := strconv.ParseFloat(v2.Value, 64)
+	if err != nil {
+		return err
+	}
+	*event = Event{Version: v2.Version, EventID: v2.ID, UserID: v2.UserID, Action: v2.Kind, Value: value}
+	return nil
+}
+
+func TestEventVersionsDecode(t *testing.T) {
+	eventDecoders[2] = decodeTestEventV2
+	defer delete(eventDecoders, 2)
+
+	tests := []struct {
+		name    string
+		action  string
+		payload string
+		want    Event
+		wantErr error
+	}{
+		{
+			name:    "version 1",
+			payload: `{"version":1,"event_id":"evt_1","user_id":"user_1","action":"view","value":1.5}`,
+			want:    Event{Version: 1, EventID: "evt_1", UserID: "user_1", Action: "view", Value: 1.5},
+		},
+		{
+			name:    "version 2 through its decoder",
+			payload: `{"version":2,"id":"evt_2","user_id":"user_2","kind":"purchase","value":"9.5"}`,
+			want:    Event{Version: 2, EventID: "evt_2", UserID: "user_2", Action: "purchase", Value: 9.5},
+		},
+		{
+			name:    "no version decodes as the current one",
+			payload: `{"event_id":"evt_0","action":"view"}`,
+			want:    Event{EventID: "evt_0", Action: "view"},
+		},
+		{
+			name:    "unknown version",
+			payload: `{"version":3,"event_id":"evt_3","action":"view"}`,
+			wantErr: ErrUnknownVersion,
+		},
+		{
+			name:    "unknown version decoded as the current one",
+			action:  UnknownVersionCurrent,
+			payload: `{"version":3,"event_id":"evt_3","action":"view","extra":true}`,
+			want:    Event{Version: 3, EventID: "evt_3", Action: "view"},
+		},
+		{
+			name:    "unknown version not fitting the current one",
+			action:  UnknownVersionCurrent,
+			payload: `{"version":3,"event_id":"evt_3","value":"high"}`,
+			wantErr: ErrUnknownVersion,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var versions *EventVersions
+			if tt.action != "" {
+				versions = &EventVersions{action: tt.action}
+			}
+			var event Event
+			err := versions.Decode(nil, []byte(tt.payload), &event)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Decode() = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && (event.Version != tt.want.Version || event.EventID != tt.want.EventID ||
+				event.UserID != tt.want.UserID || event.Action != tt.want.Action || event.Value != tt.want.Value) {
+				t.Errorf("Decode() = %+v, want %+v", event, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewEventVersions(t *testing.T) {
+	dlq := filepath.Join(t.TempDir(), "unknown.jsonl")
+	tests := []struct {
+		action  string
+		path    string
+		wantNil bool
+		wantErr bool
+	}{
+		{action: UnknownVersionSkip, wantNil: true},
+		{action: UnknownVersionSkip, path: dlq, wantErr: true},
+		{action: UnknownVersionCurrent},
+		{action: UnknownVersionDLQ, path: dlq},
+		{action: UnknownVersionDLQ, wantErr: true},
+		{action: "drop", wantErr: true},
+	}
+	for _, tt := range tests {
+		cfg := &Config{}
+		cfg.Consumer.UnknownVersionAction = tt.action
+		cfg.Consumer.UnknownVersionDLQPath = tt.path
+		versions, err := NewEventVersions(cfg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewEventVersions(%s, %q) error = %v, want error %t", tt.action, tt.path, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (versions == nil) != tt.wantNil {
+			t.Errorf("NewEventVersions(%s, %q) = %v, want nil %t", tt.action, tt.path, versions, tt.wantNil)
+		}
+		versions.Close()
+	}
+}
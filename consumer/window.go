@@ -0,0 +1,419 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
+)
+
+// WindowedProcessorName is the consumer.processor value selecting windowed aggregation
+const WindowedProcessorName = "windowed"
+
+// DefaultWindowMs is the tumbling window size when consumer.window_ms is unset
+const DefaultWindowMs = 60000
+
+// ActionAggregate is the per-action total within one window
+type ActionAggregate struct {
+	Count    int     `json:"count"`
+	ValueSum float64 `json:"value_sum"`
+}
+
+// WindowAggregate is the result emitted when a tumbling window closes.
+// LateRecords counts records that arrived after the window they belonged to
+// had already been emitted; they are reported with the window that was
+// open when they arrived rather than being dropped silently.
+type WindowAggregate struct {
+	ShardID     string                      `json:"shard_id"`
+	WindowStart time.Time                   `json:"window_start"`
+	WindowEnd   time.Time                   `json:"window_end"`
+	Actions     map[string]*ActionAggregate `json:"actions"`
+	LateRecords int                         `json:"late_records"`
+}
+
+// AggregateSink is implemented by sinks that can also store window aggregates
+type AggregateSink interface {
+	WriteAggregate(aggregate *WindowAggregate) error
+}
+
+// windowPosition remembers which window a record was counted in, so the
+// checkpoint only moves past records whose window has been emitted
+type windowPosition struct {
+	sequenceNumber string
+	windowStart    time.Time
+}
+
+// TumblingWindows groups a shard's events into fixed, non-overlapping event-time
+// windows. A window closes once the watermark (the latest event time seen)
+// reaches its end; records for an already closed window are counted as late.
+type TumblingWindows struct {
+	shardID       string
+	size          time.Duration
+	open          map[time.Time]*WindowAggregate
+	watermark     time.Time
+	closedThrough time.Time
+	positions     []windowPosition
+}
+
+// NewTumblingWindows creates an empty aggregator for one shard
+func NewTumblingWindows(shardID string, size time.Duration) *TumblingWindows {
+	return &TumblingWindows{
+		shardID: shardID,
+		size:    size,
+		open:    make(map[time.Time]*WindowAggregate),
+	}
+}
+
+// Add counts an event and reports whether it arrived late
+func (tw *TumblingWindows) Add(sequenceNumber string, event Event) bool {
+	eventTime := event.Timestamp
+	if eventTime.IsZero() {
+		eventTime = time.Now()
+	}
+	if eventTime.After(tw.watermark) {
+		tw.watermark = eventTime
+	}
+
+	start := eventTime.Truncate(tw.size)
+	late := start.Before(tw.closedThrough)
+	if late {
+		// Attribute the late record to the window the watermark is in,
+		// which is still open by definition
+		start = tw.watermark.Truncate(tw.size)
+	}
+
+	window := tw.window(start)
+	if late {
+		window.LateRecords++
+	} else {
+		action := window.Actions[event.Action]
+		if action == nil {
+			action = &ActionAggregate{}
+			window.Actions[event.Action] = action
+		}
+		action.Count++
+		action.ValueSum += event.Value
+	}
+
+	tw.positions = append(tw.positions, windowPosition{sequenceNumber: sequenceNumber, windowStart: start})
+	return late
+}
+
+func (tw *TumblingWindows) window(start time.Time) *WindowAggregate {
+	window, ok := tw.open[start]
+	if !ok {
+		window = &WindowAggregate{
+			ShardID:     tw.shardID,
+			WindowStart: start,
+			WindowEnd:   start.Add(tw.size),
+			Actions:     make(map[string]*ActionAggregate),
+		}
+		tw.open[start] = window
+	}
+	return window
+}
+
+// Advance closes every window the watermark has passed, oldest first
+func (tw *TumblingWindows) Advance() []*WindowAggregate {
+	return tw.closeThrough(tw.watermark)
+}
+
+// AdvanceIdle moves the watermark up to now and closes the windows it passes.
+// It is used when the shard has no new records, so the last window still
+// closes on time instead of waiting for the next record.
+func (tw *TumblingWindows) AdvanceIdle(now time.Time) []*WindowAggregate {
+	if now.After(tw.watermark) {
+		tw.watermark = now
+	}
+	return tw.Advance()
+}
+
+// Flush closes every open window regardless of the watermark
+func (tw *TumblingWindows) Flush() []*WindowAggregate {
+	var latest time.Time
+	for start := range tw.open {
+		if end := start.Add(tw.size); end.After(latest) {
+			latest = end
+		}
+	}
+	return tw.closeThrough(latest)
+}
+
+func (tw *TumblingWindows) closeThrough(t time.Time) []*WindowAggregate {
+	var closed []*WindowAggregate
+	for start, window := range tw.open {
+		if !window.WindowEnd.After(t) {
+			closed = append(closed, window)
+			delete(tw.open, start)
+		}
+	}
+	sort.Slice(closed, func(i, j int) bool { return closed[i].WindowStart.Before(closed[j].WindowStart) })
+
+	if len(closed) > 0 {
+		if end := closed[len(closed)-1].WindowEnd; end.After(tw.closedThrough) {
+			tw.closedThrough = end
+		}
+	}
+	return closed
+}
+
+// Open returns the number of windows still accumulating
+func (tw *TumblingWindows) Open() int {
+	return len(tw.open)
+}
+
+// Committable returns the sequence number up to which every record belongs
+// to a window that ended at or before emittedThrough, and forgets those
+// records. It returns "" if the checkpoint cannot move.
+func (tw *TumblingWindows) Committable(emittedThrough time.Time) string {
+	var sequenceNumber string
+	n := 0
+	for _, pos := range tw.positions {
+		if pos.windowStart.Add(tw.size).After(emittedThrough) {
+			break
+		}
+		sequenceNumber = pos.sequenceNumber
+		n++
+	}
+	tw.positions = tw.positions[n:]
+	return sequenceNumber
+}
+
+// DiscardPositions forgets the per-record window positions once a saved
+// state covers every record added so far
+func (tw *TumblingWindows) DiscardPositions() {
+	tw.positions = nil
+}
+
+// Snapshot captures the open windows and progress markers for persistence.
+// The returned aggregates are shared with the live windows and must be
+// serialized before the next Add.
+func (tw *TumblingWindows) Snapshot() *WindowState {
+	state := &WindowState{
+		ShardID:       tw.shardID,
+		Watermark:     tw.watermark,
+		ClosedThrough: tw.closedThrough,
+	}
+	for _, window := range tw.open {
+		state.Open = append(state.Open, window)
+	}
+	sort.Slice(state.Open, func(i, j int) bool { return state.Open[i].WindowStart.Before(state.Open[j].WindowStart) })
+	return state
+}
+
+// Restore replaces the aggregator's windows with a saved state
+func (tw *TumblingWindows) Restore(state *WindowState) {
+	tw.watermark = state.Watermark
+	tw.closedThrough = state.ClosedThrough
+	tw.open = make(map[time.Time]*WindowAggregate, len(state.Open))
+	for _, window := range state.Open {
+		tw.open[window.WindowStart] = window
+	}
+	tw.positions = nil
+}
+
+// WindowedProcessor aggregates records into tumbling windows by action and
+// emits each window's counts and value sums when it closes.
+//
+// Without a state store the checkpoint only advances past records whose
+// window has been emitted, so a crash replays any partially aggregated
+// window instead of losing it. With consumer.window_state_table set, the
+// open windows are saved after every batch and the whole batch is
+// checkpointed, so whichever worker picks the shard up next resumes the
+// windows where this one left off.
+type WindowedProcessor struct {
+	pc             *ProcessorContext
+	shardID        string
+	label          string // shardID as logged
+	windows        *TumblingWindows
+	pending        []*WindowAggregate
+	emittedThrough time.Time
+	savedThrough   string
+	recordCount    int
+	lateCount      int
+}
+
+// Initialize is called once when the processor starts processing a shard
+func (wp *WindowedProcessor) Initialize(input *interfaces.InitializationInput) {
+	wp.shardID = input.ShardId
+	wp.label = wp.pc.logLabel(wp.shardID)
+	size := time.Duration(wp.pc.Config.Consumer.WindowMs) * time.Millisecond
+	wp.windows = NewTumblingWindows(wp.shardID, size)
+	log.Printf("[%s] Initializing windowed processor (window %v)", wp.label, size)
+	wp.pc.ShardAssigned(wp.shardID)
+
+	if wp.pc.WindowState != nil {
+		wp.restoreState()
+	}
+}
+
+// restoreState resumes the windows saved by the shard's previous owner
+func (wp *WindowedProcessor) restoreState() {
+	state, err := wp.pc.WindowState.Load(wp.shardID)
+	if err != nil {
+		log.Printf("[%s] Failed to load window state, starting with empty windows: %v", wp.label, err)
+		return
+	}
+	if state == nil {
+		return
+	}
+
+	wp.windows.Restore(state)
+	wp.pending = state.Pending
+	wp.emittedThrough = state.EmittedThrough
+	wp.savedThrough = state.LastSequenceNumber
+	log.Printf("[%s] Restored %d open windows and %d unemitted windows through sequence %s",
+		wp.label, len(state.Open), len(state.Pending), state.LastSequenceNumber)
+}
+
+// saveState persists the current windows as covering everything through sequenceNumber
+func (wp *WindowedProcessor) saveState(sequenceNumber string) error {
+	state := wp.windows.Snapshot()
+	state.LastSequenceNumber = sequenceNumber
+	state.EmittedThrough = wp.emittedThrough
+	state.Pending = wp.pending
+	return wp.pc.WindowState.Save(state)
+}
+
+// ProcessRecords adds the batch to the open windows, emits any that closed
+// and checkpoints up to the last record covered by an emitted window
+func (wp *WindowedProcessor) ProcessRecords(input *interfaces.ProcessRecordsInput) {
+	wp.pc.Metrics.SetMillisBehindLatest(wp.shardID, input.MillisBehindLatest)
+
+	for _, record := range input.Records {
+		// Records already folded into the restored state can be replayed if
+		// the previous owner saved its state but did not get to checkpoint
+		if wp.savedThrough != "" && sequenceAtOrBefore(aws.StringValue(record.SequenceNumber), wp.savedThrough) {
+			continue
+		}
+
+		event, err := wp.pc.DecodeEvent(wp.shardID, record)
+		if err != nil {
+			if !errors.Is(err, ErrFutureTimestamp) && !errors.Is(err, ErrInvalidSignature) && !errors.Is(err, ErrUnknownVersion) {
+				log.Printf("[%s] Failed to unmarshal record: %v", wp.label, err)
+			}
+			continue
+		}
+		if wp.pc.Backfill.Covers(event) || wp.pc.EndMarker(wp.shardID, event) || wp.pc.KeyFilter.Skips(record) || wp.pc.Sampler.Skips(event) {
+			continue
+		}
+		wp.recordCount++
+		wp.pc.Metrics.RecordsProcessed(wp.shardID, 1)
+		wp.pc.Metrics.SetLastAction(wp.shardID, event.Action)
+		if wp.windows.Add(aws.StringValue(record.SequenceNumber), event) {
+			wp.lateCount++
+		}
+	}
+
+	var closed []*WindowAggregate
+	if len(input.Records) == 0 {
+		closed = wp.windows.AdvanceIdle(time.Now())
+	} else {
+		closed = wp.windows.Advance()
+	}
+	wp.pending = append(wp.pending, closed...)
+	emitted := wp.emitPending()
+
+	if wp.pc.WindowState != nil {
+		wp.saveAndCheckpoint(input, len(closed) > 0)
+		return
+	}
+
+	if !emitted {
+		return
+	}
+	if sequenceNumber := wp.windows.Committable(wp.emittedThrough); sequenceNumber != "" {
+		if err := wp.pc.Checkpoint(wp.shardID, input.Checkpointer, &sequenceNumber); err != nil {
+			log.Printf("[%s] Failed to checkpoint: %v", wp.label, err)
+		}
+	}
+}
+
+// saveAndCheckpoint persists the windows and then checkpoints the whole
+// batch. The checkpoint is skipped if the save fails, so the batch is
+// replayed against the previous saved state.
+func (wp *WindowedProcessor) saveAndCheckpoint(input *interfaces.ProcessRecordsInput, changed bool) {
+	if len(input.Records) == 0 {
+		// Nothing new to checkpoint, but windows closed while idle must not
+		// be restored (and emitted again) by the next owner
+		if changed {
+			if err := wp.saveState(wp.savedThrough); err != nil {
+				log.Printf("[%s] %v", wp.label, err)
+			}
+		}
+		return
+	}
+
+	sequenceNumber := aws.StringValue(input.Records[len(input.Records)-1].SequenceNumber)
+	if err := wp.saveState(sequenceNumber); err != nil {
+		log.Printf("[%s] %v, not checkpointing", wp.label, err)
+		return
+	}
+	wp.savedThrough = sequenceNumber
+	wp.windows.DiscardPositions()
+	if err := wp.pc.Checkpoint(wp.shardID, input.Checkpointer, &sequenceNumber); err != nil {
+		log.Printf("[%s] Failed to checkpoint: %v", wp.label, err)
+	}
+}
+
+// emitPending writes closed windows to the sink in order, stopping at the
+// first failure so it can be retried with the next batch. It returns true
+// once nothing is left to emit.
+func (wp *WindowedProcessor) emitPending() bool {
+	for len(wp.pending) > 0 {
+		window := wp.pending[0]
+		if err := wp.emit(window); err != nil {
+			log.Printf("[%s] Failed to emit window %s, will retry: %v",
+				wp.label, window.WindowStart.Format(time.RFC3339), err)
+			return false
+		}
+		wp.pending[0] = nil
+		wp.pending = wp.pending[1:]
+		wp.emittedThrough = window.WindowEnd
+	}
+	return true
+}
+
+func (wp *WindowedProcessor) emit(window *WindowAggregate) error {
+	total := 0
+	for _, action := range window.Actions {
+		total += action.Count
+	}
+	log.Printf("[%s] Window %s - %s | Records: %d | Actions: %d | Late: %d",
+		wp.label, window.WindowStart.Format(time.RFC3339), window.WindowEnd.Format(time.RFC3339),
+		total, len(window.Actions), window.LateRecords)
+
+	if sink, ok := wp.pc.Sink.(AggregateSink); ok {
+		return sink.WriteAggregate(window)
+	}
+	return nil
+}
+
+// Shutdown is called when the processor is shutting down
+func (wp *WindowedProcessor) Shutdown(input *interfaces.ShutdownInput) {
+	log.Printf("[%s] Shutting down. Reason: %v. Aggregated %d records (%d late), %d windows open",
+		wp.label, input.ShutdownReason, wp.recordCount, wp.lateCount, wp.windows.Open())
+	wp.pc.ShardReleased(wp.shardID, aws.StringValue(interfaces.ShutdownReasonMessage(input.ShutdownReason)))
+
+	// Only a finished shard flushes its open windows; otherwise the next
+	// owner replays them from the last checkpoint
+	if input.ShutdownReason == interfaces.TERMINATE {
+		wp.pending = append(wp.pending, wp.windows.Flush()...)
+		if !wp.emitPending() {
+			log.Printf("[%s] %d windows not emitted, leaving shard unfinished", wp.label, len(wp.pending))
+			return
+		}
+		if err := wp.pc.Checkpoint(wp.shardID, input.Checkpointer, nil); err != nil {
+			log.Printf("[%s] Failed to checkpoint on shutdown: %v", wp.label, err)
+			return
+		}
+		if wp.pc.WindowState != nil {
+			if err := wp.pc.WindowState.Delete(wp.shardID); err != nil {
+				log.Printf("[%s] %v", wp.label, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
+)
+
+// flakyAggregateSink fails to store aggregates while fail is set
+type flakyAggregateSink struct {
+	aggregateSink
+	fail bool
+}
+
+func (s *flakyAggregateSink) WriteAggregate(aggregate *WindowAggregate) error {
+	if s.fail {
+		return errors.New("sink unavailable")
+	}
+	return s.aggregateSink.WriteAggregate(aggregate)
+}
+
+// formatAggregate renders a window as "15:04 action:count/sum ... late:n"
+func formatAggregate(window *WindowAggregate) string {
+	parts := []string{window.WindowStart.Format("15:04")}
+	for action, total := range window.Actions {
+		parts = append(parts, fmt.Sprintf("%s:%d/%g", action, total.Count, total.ValueSum))
+	}
+	sort.Strings(parts[1:])
+	return strings.Join(append(parts, fmt.Sprintf("late:%d", window.LateRecords)), " ")
+}
+
+func TestWindowedProcessor(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	events := []struct {
+		action string
+		at     time.Duration // event time after start
+	}{
+		{"view", 0},
+		{"click", 10 * time.Second},
+		{"view", 30 * time.Second},
+		{"view", 65 * time.Second},  // opens the 12:01 window, closing 12:00
+		{"view", 50 * time.Second},  // late for 12:00, counted with 12:01
+		{"click", 90 * time.Second}, // still in 12:01
+		{"view", 120 * time.Second}, // closes 12:01
+		{"view", 125 * time.Second},
+	}
+	data := make([][]byte, len(events))
+	for i, e := range events {
+		data[i] = []byte(fmt.Sprintf(`{"version":1,"event_id":"evt_%d","action":%q,"value":%d,"timestamp":%q}`,
+			i, e.action, i+1, start.Add(e.at).Format(time.RFC3339)))
+	}
+	client := newFakeKinesis(testStream, testShard)
+	sequenceNumbers := client.AddRecords(t, testShard, "user_1", data...)
+
+	cfg := &Config{}
+	cfg.Kinesis.StreamName = testStream
+	cfg.Consumer.WindowMs = int(time.Minute / time.Millisecond)
+	sink := &flakyAggregateSink{}
+	wp := &WindowedProcessor{pc: &ProcessorContext{Config: cfg, Sink: sink, Metrics: NewMetrics()}}
+	wp.Initialize(&interfaces.InitializationInput{ShardId: testShard})
+
+	batches := []struct {
+		name           string
+		positions      []int
+		failEmit       bool
+		wantEmitted    []string
+		wantCheckpoint int // position checkpointed after the batch, -1 for none
+	}{
+		{name: "window still open", positions: []int{0, 1, 2}, wantCheckpoint: -1},
+		{name: "window closes", positions: []int{3}, wantEmitted: []string{"12:00 click:1/2 view:2/4 late:0"}, wantCheckpoint: 2},
+		{name: "late record", positions: []int{4, 5}, wantCheckpoint: -1},
+		{name: "emit fails", positions: []int{6}, failEmit: true, wantCheckpoint: -1},
+		{name: "emit retried with the next batch", positions: []int{7}, wantEmitted: []string{"12:01 click:1/6 view:1/4 late:1"}, wantCheckpoint: 5},
+	}
+	for _, batch := range batches {
+		sink.fail = batch.failEmit
+		sink.aggregates = nil
+		checkpointer := &recordingCheckpointer{}
+		wp.ProcessRecords(&interfaces.ProcessRecordsInput{Records: testKinesisRecords(t, client, batch.positions...), Checkpointer: checkpointer})
+
+		var emitted []string
+		for _, window := range sink.aggregates {
+			emitted = append(emitted, formatAggregate(window))
+		}
+		if fmt.Sprint(emitted) != fmt.Sprint(batch.wantEmitted) {
+			t.Errorf("%s: emitted %q, want %q", batch.name, emitted, batch.wantEmitted)
+		}
+		var want []string
+		if batch.wantCheckpoint >= 0 {
+			want = []string{sequenceNumbers[batch.wantCheckpoint]}
+		}
+		if fmt.Sprint(checkpointer.checkpoints) != fmt.Sprint(want) {
+			t.Errorf("%s: checkpointed %v, want %v", batch.name, checkpointer.checkpoints, want)
+		}
+	}
+
+	// A finished shard flushes the window still open
+	sink.aggregates = nil
+	checkpointer := &recordingCheckpointer{}
+	wp.Shutdown(&interfaces.ShutdownInput{ShutdownReason: interfaces.TERMINATE, Checkpointer: checkpointer})
+	if len(sink.aggregates) != 1 || formatAggregate(sink.aggregates[0]) != "12:02 view:2/15 late:0" {
+		t.Errorf("shutdown emitted %d windows, want the 12:02 window", len(sink.aggregates))
+	}
+	if len(checkpointer.checkpoints) != 1 || checkpointer.checkpoints[0] != "" {
+		t.Errorf("shutdown checkpointed %q, want the shard end", checkpointer.checkpoints)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// Attributes of a window state row
+const (
+	windowStateShardKey   = "ShardID"
+	windowStateDataKey    = "State"
+	windowStateUpdatedKey = "UpdatedAt"
+)
+
+// WindowState is the in-progress aggregation of one shard, persisted so the
+// next owner of the shard can carry on after a rebalance. LastSequenceNumber
+// is the last record folded into the state; the owner checkpoints it right
+// after saving, and records at or before it are skipped when replayed.
+type WindowState struct {
+	ShardID            string             `json:"shard_id"`
+	LastSequenceNumber string             `json:"last_sequence_number"`
+	Watermark          time.Time          `json:"watermark"`
+	ClosedThrough      time.Time          `json:"closed_through"`
+	EmittedThrough     time.Time          `json:"emitted_through"`
+	Open               []*WindowAggregate `json:"open"`
+	Pending            []*WindowAggregate `json:"pending,omitempty"`
+}
+
+// WindowStateStore keeps one WindowState row per shard in a DynamoDB side
+// table. The KCL lease table is not used because the KCL rewrites whole
+// lease rows and would drop the extra attribute.
+type WindowStateStore struct {
+	client     dynamodbiface.DynamoDBAPI
+	tableName  string
+	streamName string
+}
+
+// NewWindowStateStore creates the store, creating the table if it does not exist yet
+func NewWindowStateStore(client dynamodbiface.DynamoDBAPI, tableName, streamName string) (*WindowStateStore, error) {
+	if err := ensureTable(client, tableName, windowStateShardKey); err != nil {
+		return nil, err
+	}
+	return &WindowStateStore{client: client, tableName: tableName, streamName: streamName}, nil
+}
+
+// key scopes a shard ID to the stream, since shard IDs repeat across streams
+func (s *WindowStateStore) key(shardID string) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{S: aws.String(s.streamName + "/" + shardID)}
+}
+
+// Load returns the saved state for a shard, or nil if none was saved
+func (s *WindowStateStore) Load(shardID string) (*WindowState, error) {
+	output, err := s.client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.tableName),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			windowStateShardKey: s.key(shardID),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read window state: %w", err)
+	}
+	data := stringAttr(output.Item, windowStateDataKey)
+	if data == "" {
+		return nil, nil
+	}
+
+	var state WindowState
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return nil, fmt.Errorf("failed to decode window state: %w", err)
+	}
+	return &state, nil
+}
+
+// Save replaces the saved state for the shard
+func (s *WindowStateStore) Save(state *WindowState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode window state: %w", err)
+	}
+	_, err = s.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			windowStateShardKey:   s.key(state.ShardID),
+			windowStateDataKey:    {S: aws.String(string(data))},
+			windowStateUpdatedKey: {S: aws.String(time.Now().UTC().Format(time.RFC3339))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save window state: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the saved state once a shard has been fully processed
+func (s *WindowStateStore) Delete(shardID string) error {
+	_, err := s.client.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			windowStateShardKey: s.key(shardID),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete window state: %w", err)
+	}
+	return nil
+}
+
+// sequenceAtOrBefore reports whether sequence number a is at or before b.
+// Kinesis sequence numbers are decimal integers too large for uint64.
+func sequenceAtOrBefore(a, b string) bool {
+	x, okA := new(big.Int).SetString(a, 10)
+	y, okB := new(big.Int).SetString(b, 10)
+	if !okA || !okB {
+		return false
+	}
+	return x.Cmp(y) <= 0
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
+)
+
+// fakeWindowStateTable keeps window state rows in memory
+type fakeWindowStateTable struct {
+	dynamodbiface.DynamoDBAPI
+	mu   sync.Mutex
+	rows map[string]map[string]*dynamodb.AttributeValue
+}
+
+func (f *fakeWindowStateTable) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &dynamodb.GetItemOutput{Item: f.rows[aws.StringValue(input.Key[windowStateShardKey].S)]}, nil
+}
+
+func (f *fakeWindowStateTable) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rows[aws.StringValue(input.Item[windowStateShardKey].S)] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeWindowStateTable) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.rows, aws.StringValue(input.Key[windowStateShardKey].S))
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// recordingCheckpointer records the checkpoints written through it
+type recordingCheckpointer struct {
+	interfaces.IRecordProcessorCheckpointer
+	checkpoints []string
+}
+
+func (c *recordingCheckpointer) Checkpoint(sequenceNumber *string) error {
+	c.checkpoints = append(c.checkpoints, aws.StringValue(sequenceNumber))
+	return nil
+}
+
+// aggregateSink collects the window aggregates emitted to it
+type aggregateSink struct {
+	discardSink
+	aggregates []*WindowAggregate
+}
+
+func (s *aggregateSink) WriteAggregate(aggregate *WindowAggregate) error {
+	s.aggregates = append(s.aggregates, aggregate)
+	return nil
+}
+
+func TestWindowStateAcrossRebalance(t *testing.T) {
+	windowStart := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	events := make([][]byte, 6)
+	for i := range events {
+		timestamp := windowStart.Add(time.Duration(i) * time.Second)
+		if i == len(events)-1 {
+			// The first event of the next window closes the first one
+			timestamp = windowStart.Add(time.Minute)
+		}
+		events[i] = []byte(fmt.Sprintf(`{"version":1,"event_id":"evt_%d","action":"view","value":%d,"timestamp":%q}`,
+			i, i+1, timestamp.Format(time.RFC3339)))
+	}
+	client := newFakeKinesis(testStream, testShard)
+	sequenceNumbers := client.AddRecords(t, testShard, "user_1", events...)
+
+	table := &fakeWindowStateTable{rows: make(map[string]map[string]*dynamodb.AttributeValue)}
+	store := &WindowStateStore{client: table, tableName: "window-state", streamName: testStream}
+	newWorker := func(sink Sink) *WindowedProcessor {
+		cfg := &Config{}
+		cfg.Kinesis.StreamName = testStream
+		cfg.Consumer.WindowMs = int(time.Minute / time.Millisecond)
+		return &WindowedProcessor{pc: &ProcessorContext{Config: cfg, Sink: sink, WindowState: store}}
+	}
+
+	// The first worker aggregates three records, then loses the shard
+	first := newWorker(&aggregateSink{})
+	first.Initialize(&interfaces.InitializationInput{ShardId: testShard})
+	firstCheckpoints := &recordingCheckpointer{}
+	first.ProcessRecords(&interfaces.ProcessRecordsInput{Records: testKinesisRecords(t, client, 0, 1, 2), Checkpointer: firstCheckpoints})
+	first.Shutdown(&interfaces.ShutdownInput{ShutdownReason: interfaces.REQUESTED, Checkpointer: firstCheckpoints})
+	if fmt.Sprint(firstCheckpoints.checkpoints) != fmt.Sprint([]string{sequenceNumbers[2]}) {
+		t.Errorf("first worker checkpointed %v, want %s", firstCheckpoints.checkpoints, sequenceNumbers[2])
+	}
+
+	// The second worker is handed the last saved record again, as if the
+	// checkpoint had not been written, and closes the window
+	sink := &aggregateSink{}
+	second := newWorker(sink)
+	second.Initialize(&interfaces.InitializationInput{ShardId: testShard})
+	second.ProcessRecords(&interfaces.ProcessRecordsInput{Records: testKinesisRecords(t, client, 2, 3, 4, 5), Checkpointer: &recordingCheckpointer{}})
+
+	if len(sink.aggregates) != 1 {
+		t.Fatalf("second worker emitted %d windows, want 1", len(sink.aggregates))
+	}
+	window := sink.aggregates[0]
+	if !window.WindowStart.Equal(windowStart) {
+		t.Errorf("emitted the window starting %v, want %v", window.WindowStart, windowStart)
+	}
+	// Records 0-4 with values 1-5, each counted once
+	if view := window.Actions["view"]; view == nil || view.Count != 5 || view.ValueSum != 15 {
+		t.Errorf("window total %+v, want 5 records summing to 15", view)
+	}
+}
+
+func TestWindowStateStore(t *testing.T) {
+	table := &fakeWindowStateTable{rows: make(map[string]map[string]*dynamodb.AttributeValue)}
+	orders := &WindowStateStore{client: table, tableName: "window-state", streamName: "orders"}
+	payments := &WindowStateStore{client: table, tableName: "window-state", streamName: "payments"}
+
+	state := &WindowState{ShardID: testShard, LastSequenceNumber: "42", Open: []*WindowAggregate{{ShardID: testShard}}}
+	if err := orders.Save(state); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := orders.Load(testShard); err != nil || loaded == nil || loaded.LastSequenceNumber != "42" || len(loaded.Open) != 1 {
+		t.Errorf("Load() = %+v, %v; want the saved state", loaded, err)
+	}
+	if loaded, err := payments.Load(testShard); err != nil || loaded != nil {
+		t.Errorf("Load() of the same shard ID in another stream = %+v, %v; want none", loaded, err)
+	}
+	if err := orders.Delete(testShard); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := orders.Load(testShard); err != nil || loaded != nil {
+		t.Errorf("Load() after Delete = %+v, %v; want none", loaded, err)
+	}
+}
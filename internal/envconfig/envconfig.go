@@ -0,0 +1,78 @@
+// Package envconfig reads the config file location and config overrides
+// from the environment, the same way for the producer and the consumer.
+package envconfig
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// DefaultConfigFile is the config file read when CONFIG_FILE is unset,
+// relative to the producer or consumer directory
+const DefaultConfigFile = "../config.yaml"
+
+// ConfigFile returns the config file path from CONFIG_FILE, or DefaultConfigFile
+func ConfigFile() string {
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		return path
+	}
+	return DefaultConfigFile
+}
+
+// Override maps an environment variable onto a config field. Field must
+// be a *string, *int, *float64 or, for an int the config tells apart from
+// unset, **int.
+type Override struct {
+	Env   string
+	Field interface{}
+}
+
+// Apply sets every field whose environment variable is set and not empty,
+// taking precedence over the config file, and returns the names of the
+// variables it applied. A value that doesn't parse as the field's type is
+// an error naming the variable; no field is set then.
+func Apply(overrides []Override) ([]string, error) {
+	type assignment struct {
+		apply func()
+		env   string
+	}
+	var assignments []assignment
+	for _, override := range overrides {
+		value := os.Getenv(override.Env)
+		if value == "" {
+			continue
+		}
+		switch field := override.Field.(type) {
+		case *string:
+			assignments = append(assignments, assignment{func() { *field = value }, override.Env})
+		case *int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %q is not an integer", override.Env, value)
+			}
+			assignments = append(assignments, assignment{func() { *field = n }, override.Env})
+		case **int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %q is not an integer", override.Env, value)
+			}
+			assignments = append(assignments, assignment{func() { *field = &n }, override.Env})
+		case *float64:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %q is not a number", override.Env, value)
+			}
+			assignments = append(assignments, assignment{func() { *field = f }, override.Env})
+		default:
+			return nil, fmt.Errorf("%s overrides a field of unsupported type %T", override.Env, override.Field)
+		}
+	}
+
+	applied := make([]string, 0, len(assignments))
+	for _, a := range assignments {
+		a.apply()
+		applied = append(applied, a.env)
+	}
+	return applied, nil
+}
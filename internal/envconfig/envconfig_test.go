@@ -0,0 +1,120 @@
+package envconfig
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestConfigFile(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	if got := ConfigFile(); got != DefaultConfigFile {
+		t.Errorf("ConfigFile() = %q without CONFIG_FILE, want %q", got, DefaultConfigFile)
+	}
+	t.Setenv("CONFIG_FILE", "/etc/worker.yaml")
+	if got := ConfigFile(); got != "/etc/worker.yaml" {
+		t.Errorf("ConfigFile() = %q, want CONFIG_FILE", got)
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		wantApplied []string
+		want        string // the fields afterwards, as stream/workers/rate
+		wantErr     string
+	}{
+		{
+			name: "nothing set",
+			want: "orders/2/1.5",
+		},
+		{
+			name:        "every type",
+			env:         map[string]string{"TEST_STREAM": "payments", "TEST_WORKERS": "4", "TEST_RATE": "0.25"},
+			wantApplied: []string{"TEST_STREAM", "TEST_WORKERS", "TEST_RATE"},
+			want:        "payments/4/0.25",
+		},
+		{
+			name:        "empty variable ignored",
+			env:         map[string]string{"TEST_STREAM": "", "TEST_WORKERS": "3"},
+			wantApplied: []string{"TEST_WORKERS"},
+			want:        "orders/3/1.5",
+		},
+		{
+			name:    "invalid integer sets nothing",
+			env:     map[string]string{"TEST_STREAM": "payments", "TEST_WORKERS": "four"},
+			want:    "orders/2/1.5",
+			wantErr: `invalid TEST_WORKERS: "four" is not an integer`,
+		},
+		{
+			name:    "invalid number",
+			env:     map[string]string{"TEST_RATE": "fast"},
+			want:    "orders/2/1.5",
+			wantErr: `invalid TEST_RATE: "fast" is not a number`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, env := range []string{"TEST_STREAM", "TEST_WORKERS", "TEST_RATE"} {
+				t.Setenv(env, tt.env[env])
+			}
+			stream, workers, rate := "orders", 2, 1.5
+			applied, err := Apply([]Override{
+				{Env: "TEST_STREAM", Field: &stream},
+				{Env: "TEST_WORKERS", Field: &workers},
+				{Env: "TEST_RATE", Field: &rate},
+			})
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("Apply() = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("Apply() = %v", err)
+			}
+			if got := fmt.Sprintf("%s/%d/%g", stream, workers, rate); got != tt.want {
+				t.Errorf("fields %s, want %s", got, tt.want)
+			}
+			if fmt.Sprint(applied) != fmt.Sprint(tt.wantApplied) {
+				t.Errorf("applied %v, want %v", applied, tt.wantApplied)
+			}
+		})
+	}
+}
+
+func TestApplyUnsupportedField(t *testing.T) {
+	t.Setenv("TEST_ENABLED", "true")
+	enabled := false
+	_, err := Apply([]Override{{Env: "TEST_ENABLED", Field: &enabled}})
+	if err == nil || !strings.Contains(err.Error(), "unsupported type *bool") {
+		t.Errorf("Apply() = %v, want an unsupported type error", err)
+	}
+}
+
+func TestApplyOptionalInt(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "unset stays unset", want: "<nil>"},
+		{name: "zero is set", value: "0", want: "0"},
+		{name: "set", value: "250", want: "250"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_DELAY", tt.value)
+			var delay *int
+			if _, err := Apply([]Override{{Env: "TEST_DELAY", Field: &delay}}); err != nil {
+				t.Fatal(err)
+			}
+			got := "<nil>"
+			if delay != nil {
+				got = fmt.Sprint(*delay)
+			}
+			if got != tt.want {
+				t.Errorf("field %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
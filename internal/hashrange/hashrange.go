@@ -0,0 +1,62 @@
+// Package hashrange maps partition keys to shards the way Kinesis does, the
+// same way for the producer and the consumer: the key's MD5 digest read as a
+// 128-bit integer falls inside exactly one open shard's hash key range.
+package hashrange
+
+import (
+	"crypto/md5"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// HashKey returns the hash key Kinesis derives from a partition key
+func HashKey(partitionKey string) *big.Int {
+	digest := md5.Sum([]byte(partitionKey))
+	return new(big.Int).SetBytes(digest[:])
+}
+
+// Shard is an open shard's ID and hash key range, in decimal as ListShards returns it
+type Shard struct {
+	ShardID         string
+	StartingHashKey string
+	EndingHashKey   string
+}
+
+// Range is the hash key range of one open shard
+type Range struct {
+	Start, End *big.Int
+	ShardID    string
+}
+
+// Ranges is the hash key ranges of a stream's open shards, sorted by start
+type Ranges []Range
+
+// New parses the hash key ranges of the open shards
+func New(shards []Shard) (Ranges, error) {
+	ranges := make(Ranges, 0, len(shards))
+	for _, shard := range shards {
+		start, ok := new(big.Int).SetString(shard.StartingHashKey, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid starting hash key of %s", shard.ShardID)
+		}
+		end, ok := new(big.Int).SetString(shard.EndingHashKey, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid ending hash key of %s", shard.ShardID)
+		}
+		ranges = append(ranges, Range{Start: start, End: end, ShardID: shard.ShardID})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start.Cmp(ranges[j].Start) < 0 })
+	return ranges, nil
+}
+
+// Lookup finds the range containing the hash key. It reports false for a
+// hash key in a gap, as when the ranges were listed mid-reshard.
+func (r Ranges) Lookup(hash *big.Int) (string, bool) {
+	// The first range starting after the hash key follows the one containing it
+	i := sort.Search(len(r), func(i int) bool { return r[i].Start.Cmp(hash) > 0 })
+	if i == 0 || r[i-1].End.Cmp(hash) < 0 {
+		return "", false
+	}
+	return r[i-1].ShardID, true
+}
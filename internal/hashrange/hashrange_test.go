@@ -0,0 +1,92 @@
+package hashrange
+
+import (
+	"math/big"
+	"testing"
+)
+
+// testShards splits the hash key space evenly over four shards, listed out of order
+var testShards = []Shard{
+	{ShardID: "shardId-000000000002", StartingHashKey: "170141183460469231731687303715884105728", EndingHashKey: "255211775190703847597530955573826158591"},
+	{ShardID: "shardId-000000000000", StartingHashKey: "0", EndingHashKey: "85070591730234615865843651857942052863"},
+	{ShardID: "shardId-000000000003", StartingHashKey: "255211775190703847597530955573826158592", EndingHashKey: "340282366920938463463374607431768211455"},
+	{ShardID: "shardId-000000000001", StartingHashKey: "85070591730234615865843651857942052864", EndingHashKey: "170141183460469231731687303715884105727"},
+}
+
+func TestHashKey(t *testing.T) {
+	tests := []struct {
+		partitionKey string
+		want         string
+	}{
+		{partitionKey: "user_1", want: "84120488562419083359745203979416242753"},
+		{partitionKey: "user_3", want: "221929187170659709766161561396802381760"},
+		{partitionKey: "", want: "281949768489412648962353822266799178366"},
+	}
+	for _, tt := range tests {
+		if got := HashKey(tt.partitionKey).String(); got != tt.want {
+			t.Errorf("HashKey(%q) = %s, want %s", tt.partitionKey, got, tt.want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	ranges, err := New(testShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		partitionKey string
+		want         string
+	}{
+		{partitionKey: "user_1", want: "shardId-000000000000"},
+		{partitionKey: "user_2", want: "shardId-000000000000"},
+		{partitionKey: "order-42", want: "shardId-000000000001"},
+		{partitionKey: "user_3", want: "shardId-000000000002"},
+		{partitionKey: "user_4", want: "shardId-000000000002"},
+		{partitionKey: "", want: "shardId-000000000003"},
+	}
+	for _, tt := range tests {
+		if got, ok := ranges.Lookup(HashKey(tt.partitionKey)); !ok || got != tt.want {
+			t.Errorf("Lookup(%q) = %s, %t, want %s", tt.partitionKey, got, ok, tt.want)
+		}
+	}
+
+	// Range bounds are inclusive
+	for _, shard := range testShards {
+		for _, key := range []string{shard.StartingHashKey, shard.EndingHashKey} {
+			hash, _ := new(big.Int).SetString(key, 10)
+			if got, _ := ranges.Lookup(hash); got != shard.ShardID {
+				t.Errorf("Lookup(%s) = %s, want %s", key, got, shard.ShardID)
+			}
+		}
+	}
+}
+
+func TestLookupGap(t *testing.T) {
+	// Listed mid-reshard: shard 1 closed before its children were open
+	ranges, err := New([]Shard{testShards[0], testShards[1], testShards[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := ranges.Lookup(HashKey("order-42")); ok {
+		t.Errorf("Lookup() in a gap = %s, want no shard", got)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		shard Shard
+		want  string
+	}{
+		{name: "starting hash key", shard: Shard{ShardID: "shardId-000000000000", StartingHashKey: "x", EndingHashKey: "1"}, want: "invalid starting hash key of shardId-000000000000"},
+		{name: "ending hash key", shard: Shard{ShardID: "shardId-000000000000", StartingHashKey: "0", EndingHashKey: ""}, want: "invalid ending hash key of shardId-000000000000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New([]Shard{tt.shard}); err == nil || err.Error() != tt.want {
+				t.Errorf("New() = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// Defaults of producer.adaptive_batch
+const (
+	DefaultAdaptiveBatchMinSize = 10
+	DefaultAdaptiveBatchMaxSize = maxPutRecordsEntries
+)
+
+// adaptiveBatch sizes batches by how PutRecords responds: each call answered
+// within half the target latency grows the size by a tenth, each call slower
+// than the target or throttled halves it, within min_size and max_size.
+// Writers share it, since they share the network and the stream's limits. A
+// nil *adaptiveBatch keeps producer.batch_size.
+type adaptiveBatch struct {
+	target  time.Duration
+	minSize int
+	maxSize int
+
+	mu   sync.Mutex
+	size int
+}
+
+// newAdaptiveBatch starts at producer.batch_size within the bounds, and
+// returns nil when producer.adaptive_batch.target_latency_ms is unset
+func newAdaptiveBatch(cfg *Config) (*adaptiveBatch, error) {
+	adaptive := cfg.Producer.AdaptiveBatch
+	if adaptive.TargetLatencyMs <= 0 {
+		return nil, nil
+	}
+	if adaptive.MinSize > adaptive.MaxSize {
+		return nil, fmt.Errorf("producer.adaptive_batch.min_size %d is above max_size %d", adaptive.MinSize, adaptive.MaxSize)
+	}
+	if adaptive.MaxSize > maxPutRecordsEntries {
+		return nil, fmt.Errorf("producer.adaptive_batch.max_size %d is above the PutRecords limit of %d", adaptive.MaxSize, maxPutRecordsEntries)
+	}
+	return &adaptiveBatch{
+		target:  time.Duration(adaptive.TargetLatencyMs) * time.Millisecond,
+		minSize: adaptive.MinSize,
+		maxSize: adaptive.MaxSize,
+		size:    min(max(cfg.Producer.BatchSize, adaptive.MinSize), adaptive.MaxSize),
+	}, nil
+}
+
+// current returns the batch size to use, fixed when not adapting
+func (a *adaptiveBatch) current(fixed int) int {
+	if a == nil {
+		return fixed
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.size
+}
+
+// observe adapts the size to the latency of a PutRecords call and whether
+// it was throttled
+func (a *adaptiveBatch) observe(latency time.Duration, throttled bool) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	previous := a.size
+	switch {
+	case throttled || latency > a.target:
+		a.size = max(a.size/2, a.minSize)
+	case latency < a.target/2:
+		a.size = min(a.size+max(a.size/10, 1), a.maxSize)
+	}
+	if a.size == previous {
+		return
+	}
+	reason := fmt.Sprintf("latency %v", latency.Round(time.Millisecond))
+	if throttled {
+		reason += ", throttled"
+	}
+	log.Printf("Adaptive batch size %d -> %d (%s, target %v)", previous, a.size, reason, a.target)
+}
+
+// putThrottled reports whether a PutRecords call, or any entry of it, was throttled
+func putThrottled(err error, results []types.PutRecordsResultEntry) bool {
+	var throughput *types.ProvisionedThroughputExceededException
+	if errors.As(err, &throughput) {
+		return true
+	}
+	for _, result := range results {
+		if aws.ToString(result.ErrorCode) == "ProvisionedThroughputExceededException" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+)
+
+func TestAdaptiveBatchObserve(t *testing.T) {
+	const target = 100 * time.Millisecond
+	tests := []struct {
+		name      string
+		size      int
+		latency   time.Duration
+		throttled bool
+		want      int
+	}{
+		{name: "fast call grows by a tenth", size: 100, latency: 10 * time.Millisecond, want: 110},
+		{name: "small size grows by one", size: 5, latency: 10 * time.Millisecond, want: 6},
+		{name: "growth stops at max", size: 195, latency: 10 * time.Millisecond, want: 200},
+		{name: "call near the target keeps the size", size: 100, latency: 80 * time.Millisecond, want: 100},
+		{name: "slow call halves", size: 100, latency: 150 * time.Millisecond, want: 50},
+		{name: "throttled fast call halves", size: 100, latency: 10 * time.Millisecond, throttled: true, want: 50},
+		{name: "shrinking stops at min", size: 6, latency: 150 * time.Millisecond, want: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &adaptiveBatch{target: target, minSize: 5, maxSize: 200, size: tt.size}
+			a.observe(tt.latency, tt.throttled)
+			if got := a.current(0); got != tt.want {
+				t.Errorf("size %d after a %v call (throttled %t) is %d, want %d", tt.size, tt.latency, tt.throttled, got, tt.want)
+			}
+		})
+	}
+}
+
+// latencyPutter answers each PutRecords call after the delay for its index,
+// recording the size of every batch
+type latencyPutter struct {
+	*fakePutter
+	delay func(call int) time.Duration
+	sizes []int
+}
+
+func (l *latencyPutter) PutRecords(ctx context.Context, params *kinesis.PutRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error) {
+	l.mu.Lock()
+	call := len(l.sizes)
+	l.sizes = append(l.sizes, len(params.Records))
+	l.mu.Unlock()
+	time.Sleep(l.delay(call))
+	return l.fakePutter.PutRecords(ctx, params, optFns...)
+}
+
+func TestAdaptiveBatchWriter(t *testing.T) {
+	const fast, slow = 30, 3 // calls answered at once, then calls slower than the target
+	cfg := &Config{}
+	cfg.Producer.BatchSize = 10
+	cfg.Producer.AdaptiveBatch.TargetLatencyMs = 20
+	cfg.Producer.AdaptiveBatch.MinSize = 10
+	cfg.Producer.AdaptiveBatch.MaxSize = 50
+	adaptive, err := newAdaptiveBatch(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &latencyPutter{fakePutter: &fakePutter{}, delay: func(call int) time.Duration {
+		if call >= fast && call < fast+slow {
+			return 30 * time.Millisecond
+		}
+		return 0
+	}}
+	events := make(chan *Event, 3000)
+	for _, event := range testEvents(cap(events)) {
+		events <- event
+	}
+	close(events)
+	w := newTestWriter(client, true)
+	w.adaptive = adaptive
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.run(context.Background(), events)
+	}()
+	wg.Wait()
+
+	sizes := client.sizes
+	if len(sizes) < fast+slow+10 {
+		t.Fatalf("made %d calls, want at least %d", len(sizes), fast+slow+10)
+	}
+	for i, size := range sizes[:len(sizes)-1] { // the last batch takes what is left
+		if size < 10 || size > 50 {
+			t.Errorf("call %d sent %d records, outside 10 to 50", i, size)
+		}
+	}
+	if sizes[0] != 10 || sizes[fast-1] != 50 {
+		t.Errorf("fast calls grew the batch from %d to %d, want 10 to 50", sizes[0], sizes[fast-1])
+	}
+	if got := sizes[fast+slow]; got != 10 {
+		t.Errorf("batch after %d slow calls is %d, want it back at 10", slow, got)
+	}
+	if got := sizes[fast+slow+9]; got <= 10 {
+		t.Errorf("batch is %d once calls are fast again, want it growing", got)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/md5"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// DefaultAggregateMaxRecords is the default of producer.aggregate_max_records
+	DefaultAggregateMaxRecords = 100
+
+	// kplMagic starts the data of a KPL aggregated record, followed by the
+	// AggregatedRecord protobuf and its MD5 digest
+	kplMagic = "\xf3\x89\x9a\xc2"
+
+	// maxAggregateBytes keeps an aggregated record within the 1 MiB record
+	// limit, which also counts the partition key of up to 256 bytes
+	maxAggregateBytes = 1<<20 - 256
+)
+
+// Field numbers of the KPL AggregatedRecord and Record messages
+const (
+	aggregatePartitionKeyTable    protowire.Number = 1
+	aggregateExplicitHashKeyTable protowire.Number = 2
+	aggregateRecords              protowire.Number = 3
+
+	recordPartitionKeyIndex    protowire.Number = 1
+	recordExplicitHashKeyIndex protowire.Number = 2
+	recordData                 protowire.Number = 3
+)
+
+// aggregator packs the events of a batch bound for the same shard into KPL
+// aggregated records, the format the KPL writes and the KCL and the
+// consumer unpack, so a shard takes many events per Kinesis record. Events
+// are grouped by the shard the shard map puts them on, so every event still
+// lands on the shard its own key maps to. A nil *aggregator packs nothing.
+type aggregator struct {
+	maxRecords int
+	shards     *ShardMap
+}
+
+// newAggregator returns nil unless producer.aggregate is set
+func newAggregator(cfg *Config, shards *ShardMap) *aggregator {
+	if !cfg.Producer.Aggregate {
+		return nil
+	}
+	return &aggregator{maxRecords: cfg.Producer.AggregateMaxRecords, shards: shards}
+}
+
+// pack replaces entries of one event each with aggregated entries of up to
+// maxRecords events and maxAggregateBytes. An event alone on its shard is
+// left as it is.
+func (a *aggregator) pack(entries []*putEntry) []*putEntry {
+	if a == nil {
+		return entries
+	}
+	var packed []*putEntry
+	var shardOrder []string
+	open := make(map[string]*aggregateRecord)
+	mapFailed := false
+	for _, entry := range entries {
+		shardID, err := a.shardOf(entry)
+		if err != nil {
+			// Without the shard, only events of the same key are known to land together
+			if !mapFailed {
+				log.Printf("Failed to map events to shards, aggregating by partition key: %v", err)
+				mapFailed = true
+			}
+			shardID = "key:" + aws.ToString(entry.entry.PartitionKey) + "/" + aws.ToString(entry.entry.ExplicitHashKey)
+		}
+		record, ok := open[shardID]
+		if !ok {
+			shardOrder = append(shardOrder, shardID)
+		}
+		if record != nil && !record.fits(entry, a.maxRecords) {
+			packed = append(packed, record.entry())
+			record = nil
+		}
+		if record == nil {
+			record = newAggregateRecord()
+			open[shardID] = record
+		}
+		record.add(entry)
+	}
+	for _, shardID := range shardOrder {
+		packed = append(packed, open[shardID].entry())
+	}
+	return packed
+}
+
+// shardOf returns the shard the event of a single-event entry lands on
+func (a *aggregator) shardOf(entry *putEntry) (string, error) {
+	if hashKey := aws.ToString(entry.entry.ExplicitHashKey); hashKey != "" {
+		return a.shards.ShardForHashKey(hashKey)
+	}
+	return a.shards.ShardForKey(aws.ToString(entry.entry.PartitionKey))
+}
+
+// aggregateRecord is an AggregatedRecord being filled
+type aggregateRecord struct {
+	keys         map[string]uint64
+	keyTable     []string
+	hashKeys     map[string]uint64
+	hashKeyTable []string
+	records      []byte // the encoded records field of every event added
+	size         int    // the encoded AggregatedRecord
+	members      []*putEntry
+}
+
+func newAggregateRecord() *aggregateRecord {
+	return &aggregateRecord{keys: make(map[string]uint64), hashKeys: make(map[string]uint64)}
+}
+
+// encode returns the records field for the event of a single-event entry,
+// and how much the key tables grow by adding it
+func (r *aggregateRecord) encode(entry *putEntry) (field []byte, tableBytes int) {
+	var record []byte
+	key := aws.ToString(entry.entry.PartitionKey)
+	keyIndex, ok := r.keys[key]
+	if !ok {
+		keyIndex = uint64(len(r.keyTable))
+		tableBytes += stringFieldSize(aggregatePartitionKeyTable, key)
+	}
+	record = protowire.AppendTag(record, recordPartitionKeyIndex, protowire.VarintType)
+	record = protowire.AppendVarint(record, keyIndex)
+	if hashKey := aws.ToString(entry.entry.ExplicitHashKey); hashKey != "" {
+		hashIndex, ok := r.hashKeys[hashKey]
+		if !ok {
+			hashIndex = uint64(len(r.hashKeyTable))
+			tableBytes += stringFieldSize(aggregateExplicitHashKeyTable, hashKey)
+		}
+		record = protowire.AppendTag(record, recordExplicitHashKeyIndex, protowire.VarintType)
+		record = protowire.AppendVarint(record, hashIndex)
+	}
+	record = protowire.AppendTag(record, recordData, protowire.BytesType)
+	record = protowire.AppendBytes(record, entry.entry.Data)
+
+	field = protowire.AppendTag(nil, aggregateRecords, protowire.BytesType)
+	return protowire.AppendBytes(field, record), tableBytes
+}
+
+// fits reports whether the event of a single-event entry can be added
+// without going over maxRecords events or maxAggregateBytes
+func (r *aggregateRecord) fits(entry *putEntry, maxRecords int) bool {
+	if len(r.members) >= maxRecords {
+		return false
+	}
+	field, tableBytes := r.encode(entry)
+	return len(kplMagic)+r.size+len(field)+tableBytes+md5.Size <= maxAggregateBytes
+}
+
+// add adds the event of a single-event entry
+func (r *aggregateRecord) add(entry *putEntry) {
+	field, tableBytes := r.encode(entry)
+	if key := aws.ToString(entry.entry.PartitionKey); !hasKey(r.keys, key) {
+		r.keys[key] = uint64(len(r.keyTable))
+		r.keyTable = append(r.keyTable, key)
+	}
+	if hashKey := aws.ToString(entry.entry.ExplicitHashKey); hashKey != "" && !hasKey(r.hashKeys, hashKey) {
+		r.hashKeys[hashKey] = uint64(len(r.hashKeyTable))
+		r.hashKeyTable = append(r.hashKeyTable, hashKey)
+	}
+	r.records = append(r.records, field...)
+	r.size += len(field) + tableBytes
+	r.members = append(r.members, entry)
+}
+
+// entry returns the aggregated entry, put with the partition key and hash
+// key of its first event, which lands it on the shard of all of them. A
+// single event is returned unaggregated.
+func (r *aggregateRecord) entry() *putEntry {
+	if len(r.members) == 1 {
+		return r.members[0]
+	}
+	message := make([]byte, 0, r.size)
+	for _, key := range r.keyTable {
+		message = protowire.AppendTag(message, aggregatePartitionKeyTable, protowire.BytesType)
+		message = protowire.AppendString(message, key)
+	}
+	for _, hashKey := range r.hashKeyTable {
+		message = protowire.AppendTag(message, aggregateExplicitHashKeyTable, protowire.BytesType)
+		message = protowire.AppendString(message, hashKey)
+	}
+	message = append(message, r.records...)
+	digest := md5.Sum(message)
+
+	data := make([]byte, 0, len(kplMagic)+len(message)+md5.Size)
+	data = append(data, kplMagic...)
+	data = append(data, message...)
+	data = append(data, digest[:]...)
+
+	first := r.members[0]
+	aggregated := &putEntry{}
+	aggregated.entry.Data = data
+	aggregated.entry.PartitionKey = first.entry.PartitionKey
+	aggregated.entry.ExplicitHashKey = first.entry.ExplicitHashKey
+	for _, member := range r.members {
+		aggregated.events = append(aggregated.events, member.events...)
+		aggregated.payloads = append(aggregated.payloads, member.payloads...)
+		aggregated.sizes = append(aggregated.sizes, member.sizes...)
+	}
+	return aggregated
+}
+
+func hasKey(keys map[string]uint64, key string) bool {
+	_, ok := keys[key]
+	return ok
+}
+
+// stringFieldSize is the encoded size of a string field
+func stringFieldSize(num protowire.Number, s string) int {
+	return protowire.SizeTag(num) + protowire.SizeBytes(len(s))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	kinesisv1 "github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/awslabs/kinesis-aggregation/go/deaggregator"
+	"github.com/kds-rebalance/internal/hashrange"
+)
+
+// testShardMap returns a map of two shards splitting the hash key space in half
+func testShardMap() *ShardMap {
+	half := new(big.Int).Lsh(big.NewInt(1), 127)
+	last := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 128), big.NewInt(1))
+	return &ShardMap{ranges: hashrange.Ranges{
+		{Start: big.NewInt(0), End: new(big.Int).Sub(half, big.NewInt(1)), ShardID: "shardId-000000000000"},
+		{Start: half, End: last, ShardID: "shardId-000000000001"},
+	}}
+}
+
+// failingLister fails to list shards
+type failingLister struct {
+	kinesisAPI
+}
+
+func (failingLister) ListShards(ctx context.Context, params *kinesis.ListShardsInput, optFns ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error) {
+	return nil, errors.New("access denied")
+}
+
+// testPutEntries returns single-event entries for events keyed by partition key
+func testPutEntries(keys ...string) []*putEntry {
+	entries := make([]*putEntry, len(keys))
+	for i, key := range keys {
+		data := []byte(fmt.Sprintf("event_%d", i))
+		entries[i] = &putEntry{
+			entry:    types.PutRecordsRequestEntry{Data: data, PartitionKey: aws.String(key)},
+			events:   []*Event{{EventID: fmt.Sprintf("evt_%d", i)}},
+			payloads: [][]byte{data},
+			sizes:    []int{len(data)},
+		}
+	}
+	return entries
+}
+
+// unpack returns the events of an entry as the consumer sees them, data@key
+func unpack(t *testing.T, entry *putEntry) []string {
+	t.Helper()
+	records, err := deaggregator.DeaggregateRecords([]*kinesisv1.Record{{
+		Data:         entry.entry.Data,
+		PartitionKey: entry.entry.PartitionKey,
+	}})
+	if err != nil {
+		t.Fatalf("DeaggregateRecords: %v", err)
+	}
+	var events []string
+	for _, record := range records {
+		events = append(events, fmt.Sprintf("%s@%s", record.Data, *record.PartitionKey))
+	}
+	if len(events) != len(entry.events) {
+		t.Errorf("entry carries %d events but unpacks to %d", len(entry.events), len(events))
+	}
+	return events
+}
+
+func TestAggregatorPack(t *testing.T) {
+	// user_1 and user_2 land on the first shard, user_3 and user_4 on the second
+	shards := testShardMap()
+	for key, want := range map[string]string{"user_1": "shardId-000000000000", "user_2": "shardId-000000000000",
+		"user_3": "shardId-000000000001", "user_4": "shardId-000000000001"} {
+		if got, _ := shards.ShardForKey(key); got != want {
+			t.Fatalf("%s maps to %s, want %s", key, got, want)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		shards     *ShardMap
+		maxRecords int
+		keys       []string
+		want       []string // the events of each entry put
+	}{
+		{
+			name:       "one shard",
+			shards:     shards,
+			maxRecords: 100,
+			keys:       []string{"user_1", "user_2", "user_1"},
+			want:       []string{"[event_0@user_1 event_1@user_2 event_2@user_1]"},
+		},
+		{
+			name:       "grouped by shard",
+			shards:     shards,
+			maxRecords: 100,
+			keys:       []string{"user_1", "user_3", "user_2", "user_4"},
+			want:       []string{"[event_0@user_1 event_2@user_2]", "[event_1@user_3 event_3@user_4]"},
+		},
+		{
+			name:       "event alone on its shard left unaggregated",
+			shards:     shards,
+			maxRecords: 100,
+			keys:       []string{"user_1", "user_3", "user_2"},
+			want:       []string{"[event_0@user_1 event_2@user_2]", "event_1"},
+		},
+		{
+			name:       "max records",
+			shards:     shards,
+			maxRecords: 2,
+			keys:       []string{"user_1", "user_2", "user_1", "user_2", "user_1"},
+			want:       []string{"[event_0@user_1 event_1@user_2]", "[event_2@user_1 event_3@user_2]", "event_4"},
+		},
+		{
+			name:       "grouped by key when shards can't be mapped",
+			shards:     NewShardMap(failingLister{}, "test-stream", 0),
+			maxRecords: 100,
+			keys:       []string{"user_1", "user_2", "user_1"},
+			want:       []string{"[event_0@user_1 event_2@user_1]", "event_1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Producer.Aggregate = true
+			cfg.Producer.AggregateMaxRecords = tt.maxRecords
+			var got []string
+			for _, entry := range newAggregator(cfg, tt.shards).pack(testPutEntries(tt.keys...)) {
+				if len(entry.events) == 1 {
+					got = append(got, string(entry.entry.Data))
+					continue
+				}
+				if !strings.HasPrefix(string(entry.entry.Data), kplMagic) {
+					t.Errorf("entry of %d events isn't aggregated", len(entry.events))
+				}
+				got = append(got, fmt.Sprint(unpack(t, entry)))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("pack() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	entries := testPutEntries("user_1", "user_2")
+	if packed := newAggregator(&Config{}, shards).pack(entries); len(packed) != 2 {
+		t.Errorf("packed %d entries without producer.aggregate, want them as they are", len(packed))
+	}
+}
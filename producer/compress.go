@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+)
+
+// producer.compress values
+const CompressGzip = "gzip"
+
+// gzipMagic starts the frame of a gzip-compressed record: the magic, then
+// the gzip stream of the JSON event. Like signatureMagic it leads with a
+// NUL byte, which JSON never starts with, so consumers tell compressed
+// records from plain ones by it. A signed record is compressed first, so
+// the signature covers the frame.
+const gzipMagic = "\x00GZ1"
+
+// compressor compresses record payloads with producer.compress. A nil
+// compressor leaves payloads as they are.
+type compressor struct{}
+
+// newCompressor returns the compressor of a producer.compress value, or nil
+// when it is empty
+func newCompressor(compress string) (*compressor, error) {
+	switch compress {
+	case "":
+		return nil, nil
+	case CompressGzip:
+		return &compressor{}, nil
+	default:
+		return nil, fmt.Errorf("invalid producer.compress: %s. Must be %s or empty", compress, CompressGzip)
+	}
+}
+
+// compress frames the gzip-compressed payload
+func (c *compressor) compress(payload []byte) ([]byte, error) {
+	if c == nil {
+		return payload, nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString(gzipMagic)
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCompressor(t *testing.T) {
+	payload := []byte(`{"version":1,"event_id":"evt_1","action":"view"}`)
+	tests := []struct {
+		name     string
+		compress string
+		wantGzip bool
+		wantErr  string
+	}{
+		{name: "off", compress: ""},
+		{name: "gzip", compress: CompressGzip, wantGzip: true},
+		{name: "unknown", compress: "zstd", wantErr: "invalid producer.compress: zstd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newCompressor(tt.compress)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("newCompressor() = %v, want an error with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := c.compress(payload)
+			if err != nil {
+				t.Fatalf("compress: %v", err)
+			}
+			if !tt.wantGzip {
+				if !bytes.Equal(data, payload) {
+					t.Errorf("compress() = %q, want the payload as is", data)
+				}
+				return
+			}
+			if !bytes.HasPrefix(data, []byte(gzipMagic)) {
+				t.Fatalf("compress() = %q, want the gzip frame magic first", data)
+			}
+			gz, err := gzip.NewReader(bytes.NewReader(data[len(gzipMagic):]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(gz)
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Errorf("decompressed %q, %v; want %q", got, err, payload)
+			}
+		})
+	}
+}
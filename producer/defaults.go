@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Defaults applied to unset producer configuration fields
+const (
+	DefaultRegion       = "us-east-1"
+	DefaultBatchSize    = 100
+	DefaultBatchDelayMs = 1000
+)
+
+// ApplyDefaults fills sensible values into optional fields left unset in the
+// config file and logs every default it applied. total_messages is left
+// alone because 0 already means "run forever", and batch_delay_ms is only
+// defaulted when absent because 0 means no delay.
+func (c *Config) ApplyDefaults() {
+	var applied []string
+	setString := func(field *string, name, value string) {
+		if *field == "" {
+			*field = value
+			applied = append(applied, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+	setInt := func(field *int, name string, value int) {
+		if *field <= 0 {
+			*field = value
+			applied = append(applied, fmt.Sprintf("%s=%d", name, value))
+		}
+	}
+
+	setString(&c.AWS.Region, "aws.region", DefaultRegion)
+	setInt(&c.Producer.BatchSize, "producer.batch_size", DefaultBatchSize)
+	if c.Producer.BatchDelayMs == nil {
+		batchDelayMs := DefaultBatchDelayMs
+		c.Producer.BatchDelayMs = &batchDelayMs
+		applied = append(applied, fmt.Sprintf("producer.batch_delay_ms=%d", DefaultBatchDelayMs))
+	}
+	setInt(&c.Producer.KeyCardinality, "producer.key_cardinality", defaultKeyCardinality)
+	setInt(&c.Producer.Concurrency, "producer.concurrency", 1)
+	setString(&c.Producer.PartitionKeyStrategy, "producer.partition_key_strategy", PartitionKeyUserID)
+	if c.Producer.UseBatchAPI == nil {
+		useBatchAPI := true
+		c.Producer.UseBatchAPI = &useBatchAPI
+		applied = append(applied, "producer.use_batch_api=true")
+	}
+	if c.Producer.PreviewShards || len(c.Producer.ShardTargetRPS) > 0 || c.Producer.Aggregate {
+		setInt(&c.Producer.ShardMapRefreshMs, "producer.shard_map_refresh_ms", DefaultShardMapRefreshMs)
+	}
+	if c.Producer.ProgressFile != "" {
+		setInt(&c.Producer.ProgressIntervalMs, "producer.progress_interval_ms", DefaultProgressIntervalMs)
+	}
+	if c.Producer.AdaptiveBatch.TargetLatencyMs > 0 {
+		setInt(&c.Producer.AdaptiveBatch.MinSize, "producer.adaptive_batch.min_size", DefaultAdaptiveBatchMinSize)
+		setInt(&c.Producer.AdaptiveBatch.MaxSize, "producer.adaptive_batch.max_size", DefaultAdaptiveBatchMaxSize)
+	}
+	if c.Producer.Aggregate {
+		setInt(&c.Producer.AggregateMaxRecords, "producer.aggregate_max_records", DefaultAggregateMaxRecords)
+	}
+	if c.Producer.ConcurrentSessions > 0 {
+		setInt(&c.Producer.SessionDwellMs, "producer.session_dwell_ms", DefaultSessionDwellMs)
+	}
+
+	// Values default to the historical uniform [0, 1000) range. min is only
+	// defaulted together with max because 0 is a meaningful lower bound.
+	dist := &c.Producer.ValueDistribution
+	setString(&dist.Type, "producer.value_distribution.type", ValueDistributionUniform)
+	if dist.Max == 0 && dist.Min == 0 {
+		dist.Max = DefaultValueMax
+		applied = append(applied, fmt.Sprintf("producer.value_distribution.max=%d", DefaultValueMax))
+	}
+	if dist.Mean == 0 && dist.Type != ValueDistributionUniform {
+		dist.Mean = (dist.Min + dist.Max) / 2
+		applied = append(applied, fmt.Sprintf("producer.value_distribution.mean=%g", dist.Mean))
+	}
+	if dist.StdDev == 0 && dist.Type == ValueDistributionNormal {
+		dist.StdDev = (dist.Max - dist.Min) / 6
+		applied = append(applied, fmt.Sprintf("producer.value_distribution.stddev=%g", dist.StdDev))
+	}
+
+	if len(applied) > 0 {
+		log.Printf("Applied config defaults: %s", strings.Join(applied, ", "))
+	}
+}
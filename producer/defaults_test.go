@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// loadTestConfig loads a config file holding yaml, as the producer does at startup
+func loadTestConfig(t *testing.T, yaml string) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	return cfg
+}
+
+func TestApplyDefaults(t *testing.T) {
+	for _, env := range []string{"AWS_REGION", "AWS_ENDPOINT", "KINESIS_STREAM_NAME", "PRODUCER_TOTAL_MESSAGES", "PRODUCER_BATCH_SIZE", "PRODUCER_BATCH_DELAY_MS"} {
+		t.Setenv(env, "")
+	}
+	cfg := loadTestConfig(t, "kinesis:\n  stream_name: test-stream\n")
+
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{name: "aws.region", got: cfg.AWS.Region, want: DefaultRegion},
+		{name: "producer.batch_size", got: cfg.Producer.BatchSize, want: DefaultBatchSize},
+		{name: "producer.batch_delay_ms", got: *cfg.Producer.BatchDelayMs, want: DefaultBatchDelayMs},
+		{name: "producer.key_cardinality", got: cfg.Producer.KeyCardinality, want: defaultKeyCardinality},
+		{name: "producer.concurrency", got: cfg.Producer.Concurrency, want: 1},
+		{name: "producer.partition_key_strategy", got: cfg.Producer.PartitionKeyStrategy, want: PartitionKeyUserID},
+		{name: "producer.use_batch_api", got: *cfg.Producer.UseBatchAPI, want: true},
+		{name: "producer.total_messages", got: cfg.Producer.TotalMessages, want: 0},
+		{name: "producer.value_distribution.type", got: cfg.Producer.ValueDistribution.Type, want: ValueDistributionUniform},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestBatchDelayZero(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  string
+		want int
+	}{
+		{name: "unset", yaml: "producer:\n  batch_size: 10\n", want: DefaultBatchDelayMs},
+		{name: "zero in the config file", yaml: "producer:\n  batch_delay_ms: 0\n", want: 0},
+		{name: "zero in the environment", yaml: "producer:\n  batch_delay_ms: 500\n", env: "0", want: 0},
+		{name: "set in the config file", yaml: "producer:\n  batch_delay_ms: 250\n", want: 250},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PRODUCER_BATCH_DELAY_MS", tt.env)
+			cfg := loadTestConfig(t, tt.yaml)
+			if got := *cfg.Producer.BatchDelayMs; got != tt.want {
+				t.Errorf("batch_delay_ms = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
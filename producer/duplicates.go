@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// duplicator picks sent events to send again with the same EventID, so
+// consumers' dedup cache and idempotency table see real duplicates: records
+// with new sequence numbers carrying an event already handled. Like the
+// injected errors, duplicates are spread evenly (0.1 resends every tenth
+// event) so runs are repeatable. A nil *duplicator sends no duplicates.
+type duplicator struct {
+	rate float64
+
+	mu     sync.Mutex
+	events int
+	picked int
+}
+
+// newDuplicator returns nil when producer.duplicate_rate is 0
+func newDuplicator(rate float64) (*duplicator, error) {
+	if rate == 0 {
+		return nil, nil
+	}
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("invalid producer.duplicate_rate: %g. Must be between 0 and 1", rate)
+	}
+	log.Printf("Resending %.0f%% of events as duplicates with the same event ID", rate*100)
+	return &duplicator{rate: rate}, nil
+}
+
+// pick returns copies of the sent events to resend, keeping the duplicated
+// fraction of events so far as close to the rate as possible. Duplicates
+// are never duplicated again.
+func (d *duplicator) pick(sent []*Event) []*Event {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var duplicates []*Event
+	for _, event := range sent {
+		if event.Duplicate {
+			continue
+		}
+		d.events++
+		if float64(d.picked+1) > d.rate*float64(d.events) {
+			continue
+		}
+		d.picked++
+		duplicate := *event
+		duplicate.Duplicate = true
+		duplicates = append(duplicates, &duplicate)
+	}
+	return duplicates
+}
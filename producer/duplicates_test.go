@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestDuplicateRate(t *testing.T) {
+	const total = 100
+	tests := []struct {
+		name     string
+		rate     float64
+		batchAPI bool
+	}{
+		{name: "batch puts", rate: 0.1, batchAPI: true},
+		{name: "single puts", rate: 0.25},
+		{name: "every event", rate: 1, batchAPI: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakePutter{}
+			w := newTestWriter(client, tt.batchAPI)
+			duplicates, err := newDuplicator(tt.rate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.duplicates = duplicates
+
+			events := make(chan *Event, total)
+			for _, event := range testEvents(total) {
+				events <- event
+			}
+			close(events)
+			w.run(context.Background(), events)
+
+			// Count the records in the stream carrying each event ID
+			seen := make(map[string]int)
+			for _, entry := range client.put {
+				var event Event
+				if err := json.Unmarshal(entry.Data, &event); err != nil {
+					t.Fatal(err)
+				}
+				seen[event.EventID]++
+			}
+			repeated := 0
+			for eventID, n := range seen {
+				if n > 2 {
+					t.Errorf("%s put %d times, want at most twice", eventID, n)
+				}
+				if n > 1 {
+					repeated++
+				}
+			}
+			want := int(tt.rate * total)
+			if len(seen) != total || repeated != want {
+				t.Errorf("%d of %d event IDs appear more than once, want %d of %d", repeated, len(seen), want, total)
+			}
+			sent, dropped := w.stats.totals()
+			if sent != total || dropped != 0 || w.stats.duplicates != want {
+				t.Errorf("stats %d sent, %d dropped, %d duplicates; want %d, 0, %d", sent, dropped, w.stats.duplicates, total, want)
+			}
+		})
+	}
+
+	for _, rate := range []float64{-0.1, 1.5} {
+		if _, err := newDuplicator(rate); err == nil {
+			t.Errorf("newDuplicator(%g) accepted the rate", rate)
+		}
+	}
+	if d, err := newDuplicator(0); d != nil || err != nil {
+		t.Errorf("newDuplicator(0) = %v, %v; want nil", d, err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// kinesisAPI is the part of the Kinesis client the producer uses
+type kinesisAPI interface {
+	PutRecord(ctx context.Context, params *kinesis.PutRecordInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordOutput, error)
+	PutRecords(ctx context.Context, params *kinesis.PutRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error)
+	ListShards(ctx context.Context, params *kinesis.ListShardsInput, optFns ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error)
+	DescribeStreamSummary(ctx context.Context, params *kinesis.DescribeStreamSummaryInput, optFns ...func(*kinesis.Options)) (*kinesis.DescribeStreamSummaryOutput, error)
+}
+
+// faultyKinesis fails a fraction of PutRecord and PutRecords calls with a
+// synthetic throttling error instead of sending them, to exercise the
+// producer's retry and backoff without a stream that actually throttles.
+// Failures are spread evenly rather than drawn at random: with a rate of
+// 0.25 exactly every fourth call fails, so runs are repeatable.
+type faultyKinesis struct {
+	kinesisAPI
+	rate float64
+
+	mu       sync.Mutex
+	calls    int
+	injected int
+}
+
+// withErrorInjection wraps client for producer.inject_error_rate, or returns
+// it unchanged when the rate is 0
+func withErrorInjection(client kinesisAPI, rate float64) (kinesisAPI, error) {
+	if rate == 0 {
+		return client, nil
+	}
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("invalid producer.inject_error_rate: %g. Must be between 0 and 1", rate)
+	}
+	log.Printf("WARNING: injecting throttling errors into %.0f%% of Kinesis put calls", rate*100)
+	return &faultyKinesis{kinesisAPI: client, rate: rate}, nil
+}
+
+// fail reports whether the next call should fail, keeping the failed
+// fraction of calls so far as close to the rate as possible
+func (f *faultyKinesis) fail() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if float64(f.injected+1) > f.rate*float64(f.calls) {
+		return false
+	}
+	f.injected++
+	return true
+}
+
+func (f *faultyKinesis) throttled() error {
+	return &types.ProvisionedThroughputExceededException{
+		Message: aws.String("injected by producer.inject_error_rate"),
+	}
+}
+
+// PutRecord fails with a throttling error at the configured rate
+func (f *faultyKinesis) PutRecord(ctx context.Context, params *kinesis.PutRecordInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordOutput, error) {
+	if f.fail() {
+		return nil, f.throttled()
+	}
+	return f.kinesisAPI.PutRecord(ctx, params, optFns...)
+}
+
+// PutRecords fails with a throttling error at the configured rate
+func (f *faultyKinesis) PutRecords(ctx context.Context, params *kinesis.PutRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error) {
+	if f.fail() {
+		return nil, f.throttled()
+	}
+	return f.kinesisAPI.PutRecords(ctx, params, optFns...)
+}
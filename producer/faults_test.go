@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestErrorInjection(t *testing.T) {
+	tests := []struct {
+		name         string
+		batchAPI     bool
+		batches      int // the 8 events are sent in this many equal batches
+		wantCalls    int // put calls made, injected failures included
+		wantInjected int
+	}{
+		// Every fourth PutRecord fails and is resent with the retries
+		{name: "single puts", batches: 1, wantCalls: 10, wantInjected: 2},
+		// The fourth PutRecords call fails and its batch is resent whole
+		{name: "batch puts", batchAPI: true, batches: 4, wantCalls: 5, wantInjected: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakePutter{}
+			faulty, err := withErrorInjection(client, 0.25)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := newTestWriter(faulty, tt.batchAPI)
+
+			events := testEvents(8)
+			size := len(events) / tt.batches
+			sent := 0
+			for i := 0; i < len(events); i += size {
+				sent += len(w.send(context.Background(), events[i:i+size]))
+			}
+
+			if sent != len(events) || len(client.put) != len(events) {
+				t.Errorf("sent %d events with %d reaching the stream, want %d", sent, len(client.put), len(events))
+			}
+			f := faulty.(*faultyKinesis)
+			if f.calls != tt.wantCalls || f.injected != tt.wantInjected {
+				t.Errorf("%d calls with %d failures injected, want %d with %d", f.calls, f.injected, tt.wantCalls, tt.wantInjected)
+			}
+			if _, dropped := w.stats.totals(); dropped != 0 {
+				t.Errorf("dropped %d events", dropped)
+			}
+		})
+	}
+}
+
+func TestWithErrorInjection(t *testing.T) {
+	client := &fakePutter{}
+	if wrapped, err := withErrorInjection(client, 0); err != nil || wrapped != kinesisAPI(client) {
+		t.Errorf("withErrorInjection(0) = %T, %v; want the client unchanged", wrapped, err)
+	}
+	for _, rate := range []float64{-0.1, 1.5} {
+		if _, err := withErrorInjection(client, rate); err == nil {
+			t.Errorf("withErrorInjection(%g) accepted the rate", rate)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// eventFields lists the JSON keys of Event in declaration order
+var eventFields = func() []string {
+	t := reflect.TypeOf(Event{})
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		if field, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); field != "-" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}()
+
+// fieldMapping renames Event JSON keys on output, so downstream consumers
+// expecting a different schema (uid instead of user_id) can be fed. A nil
+// mapping marshals events unchanged.
+type fieldMapping map[string]string
+
+// newFieldMapping validates producer.field_mapping: every key must be an
+// Event field and no two fields may end up with the same name
+func newFieldMapping(cfg *Config) (fieldMapping, error) {
+	mapping := cfg.Producer.FieldMapping
+	if len(mapping) == 0 {
+		return nil, nil
+	}
+
+	names := make(map[string]string, len(eventFields))
+	for _, field := range eventFields {
+		name := field
+		if renamed, ok := mapping[field]; ok {
+			if renamed == "" {
+				return nil, fmt.Errorf("field_mapping for %s is empty", field)
+			}
+			name = renamed
+		}
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("field_mapping maps both %s and %s to %s", other, field, name)
+		}
+		names[name] = field
+	}
+	for field := range mapping {
+		if !slices.Contains(eventFields, field) {
+			return nil, fmt.Errorf("invalid field_mapping key: %s. Must be one of %s", field, strings.Join(eventFields, ", "))
+		}
+	}
+	return fieldMapping(mapping), nil
+}
+
+// marshal encodes the event as JSON with its keys renamed, keeping the
+// field order of Event
+func (m fieldMapping) marshal(event *Event) ([]byte, error) {
+	data, err := json.Marshal(event)
+	if err != nil || len(m) == 0 {
+		return data, err
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range eventFields {
+		name := field
+		if renamed, ok := m[field]; ok {
+			name = renamed
+		}
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(values[field])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// mappedEvent is the event of TestFieldMappingMarshal as written with
+// user_id and event_id renamed. The consumer's fields_test.go decodes the
+// same bytes with the matching mapping.
+const mappedEvent = `{"version":1,"id":"evt_1","uid":"user_7","timestamp":"2026-01-01T12:00:00Z","action":"purchase","value":12.5,"metadata":{"source":"web"}}`
+
+func TestFieldMappingMarshal(t *testing.T) {
+	event := &Event{
+		Version:   EventVersion,
+		EventID:   "evt_1",
+		UserID:    "user_7",
+		Timestamp: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC),
+		Action:    "purchase",
+		Value:     12.5,
+		Metadata:  map[string]interface{}{"source": "web"},
+		HashKey:   "42",
+	}
+	cfg := &Config{}
+	cfg.Producer.FieldMapping = map[string]string{"user_id": "uid", "event_id": "id"}
+	fields, err := newFieldMapping(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := fields.marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != mappedEvent {
+		t.Errorf("marshal() = %s, want %s", data, mappedEvent)
+	}
+
+	// Without a mapping events are written as usual
+	data, err = fieldMapping(nil).marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"user_id":"user_7"`) {
+		t.Errorf("marshal() without a mapping = %s, want the original keys", data)
+	}
+}
+
+func TestNewFieldMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping map[string]string
+		wantErr string
+	}{
+		{name: "none"},
+		{name: "valid", mapping: map[string]string{"user_id": "uid"}},
+		{name: "unknown field", mapping: map[string]string{"hash_key": "hk"}, wantErr: "invalid field_mapping key: hash_key"},
+		{name: "empty name", mapping: map[string]string{"user_id": ""}, wantErr: "field_mapping for user_id is empty"},
+		{name: "clashes with a field", mapping: map[string]string{"user_id": "action"}, wantErr: "to action"},
+		{name: "two fields to one name", mapping: map[string]string{"user_id": "id", "event_id": "id"}, wantErr: "to id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Producer.FieldMapping = tt.mapping
+			_, err := newFieldMapping(cfg)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("newFieldMapping() = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("newFieldMapping() = %v, want an error with %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// TimestampGenerator draws the Timestamp field of generated events
+type TimestampGenerator func() time.Time
+
+// newTimestampGenerator builds the generator described by producer.historical,
+// or one returning the current time when historical mode is off.
+//
+// Timestamps fall in [start, end), spread uniformly or, with rate_profile,
+// in proportion to the relative rates of equal slices of the window. With
+// monotonic they increase from one event to the next, placing the i-th of
+// total_messages events at the (i+0.5)/total_messages quantile, starting
+// after the resumed events sent by earlier runs; otherwise each is drawn at
+// random.
+func newTimestampGenerator(cfg *Config, resumed int) (TimestampGenerator, error) {
+	hist := cfg.Producer.Historical
+	if hist.Start == "" {
+		return time.Now, nil
+	}
+
+	start, err := time.Parse(time.RFC3339, hist.Start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid producer.historical.start: %w", err)
+	}
+	end := time.Now()
+	if hist.End != "" {
+		if end, err = time.Parse(time.RFC3339, hist.End); err != nil {
+			return nil, fmt.Errorf("invalid producer.historical.end: %w", err)
+		}
+	}
+	if !end.After(start) {
+		return nil, fmt.Errorf("producer.historical.end (%s) must be after start (%s)", end.Format(time.RFC3339), hist.Start)
+	}
+	profile, err := newRateProfile(hist.RateProfile)
+	if err != nil {
+		return nil, err
+	}
+
+	span := end.Sub(start)
+	at := func(quantile float64) time.Time {
+		return start.Add(time.Duration(profile.position(quantile) * float64(span)))
+	}
+
+	if !hist.Monotonic {
+		var mu sync.Mutex
+		return func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return at(rand.Float64())
+		}, nil
+	}
+
+	total := cfg.Producer.TotalMessages
+	if total <= 0 {
+		return nil, fmt.Errorf("producer.historical.monotonic requires producer.total_messages")
+	}
+	// Sessions generate from several goroutines, so the position is shared
+	var mu sync.Mutex
+	next := resumed
+	return func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		quantile := (float64(min(next, total-1)) + 0.5) / float64(total)
+		next++
+		return at(quantile)
+	}, nil
+}
+
+// rateProfile maps a quantile of the events to a position in the window,
+// given the relative event rates of equal slices of the window
+type rateProfile struct {
+	weights    []float64
+	cumulative []float64 // cumulative[k] is the sum of weights[:k+1]
+}
+
+func newRateProfile(weights []float64) (*rateProfile, error) {
+	if len(weights) == 0 {
+		weights = []float64{1}
+	}
+	profile := &rateProfile{weights: weights, cumulative: make([]float64, len(weights))}
+	total := 0.0
+	for i, w := range weights {
+		if w < 0 {
+			return nil, fmt.Errorf("invalid producer.historical.rate_profile: weight %g is negative", w)
+		}
+		total += w
+		profile.cumulative[i] = total
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("invalid producer.historical.rate_profile: all weights are 0")
+	}
+	return profile, nil
+}
+
+// position returns where in the window, from 0 to 1, the given quantile of
+// the events falls
+func (p *rateProfile) position(quantile float64) float64 {
+	target := quantile * p.cumulative[len(p.cumulative)-1]
+	before := 0.0
+	for k, cumulative := range p.cumulative {
+		if target < cumulative {
+			within := (target - before) / p.weights[k]
+			return (float64(k) + within) / float64(len(p.weights))
+		}
+		before = cumulative
+	}
+	return 1
+}
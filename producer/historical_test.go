@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTimestampGenerator(t *testing.T) {
+	const total = 1000
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	tests := []struct {
+		name          string
+		profile       []float64
+		monotonic     bool
+		resumed       int
+		wantFirstHalf float64 // share of the events stamped in the first half of the window
+	}{
+		{name: "uniform", wantFirstHalf: 0.5},
+		{name: "uniform monotonic", monotonic: true, wantFirstHalf: 0.5},
+		{name: "rate profile", profile: []float64{3, 1}, wantFirstHalf: 0.75},
+		{name: "rate profile monotonic", profile: []float64{3, 1}, monotonic: true, wantFirstHalf: 0.75},
+		// Resuming after the first half carries on from the middle of the window
+		{name: "resumed monotonic", monotonic: true, resumed: total / 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Producer.TotalMessages = total
+			cfg.Producer.Historical.Start = start.Format(time.RFC3339)
+			cfg.Producer.Historical.End = end.Format(time.RFC3339)
+			cfg.Producer.Historical.RateProfile = tt.profile
+			cfg.Producer.Historical.Monotonic = tt.monotonic
+			next, err := newTimestampGenerator(cfg, tt.resumed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var prev time.Time
+			firstHalf := 0
+			for i := tt.resumed; i < total; i++ {
+				ts := next()
+				if ts.Before(start) || !ts.Before(end) {
+					t.Fatalf("event %d stamped %v, want within [%v, %v)", i, ts, start, end)
+				}
+				if tt.monotonic && !ts.After(prev) {
+					t.Fatalf("event %d stamped %v, not after the previous %v", i, ts, prev)
+				}
+				if ts.Before(start.Add(end.Sub(start) / 2)) {
+					firstHalf++
+				}
+				prev = ts
+			}
+			share := float64(firstHalf) / float64(total-tt.resumed)
+			if math.Abs(share-tt.wantFirstHalf) > 0.06 {
+				t.Errorf("%.2f of the events in the first half of the window, want %.2f", share, tt.wantFirstHalf)
+			}
+		})
+	}
+}
+
+func TestTimestampGeneratorErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end string
+		profile    []float64
+		monotonic  bool
+	}{
+		{name: "unparsable start", start: "yesterday"},
+		{name: "end before start", start: "2026-01-02T00:00:00Z", end: "2026-01-01T00:00:00Z"},
+		{name: "negative weight", start: "2026-01-01T00:00:00Z", profile: []float64{1, -1}},
+		{name: "all weights zero", start: "2026-01-01T00:00:00Z", profile: []float64{0, 0}},
+		{name: "monotonic without total_messages", start: "2026-01-01T00:00:00Z", monotonic: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Producer.Historical.Start = tt.start
+			cfg.Producer.Historical.End = tt.end
+			cfg.Producer.Historical.RateProfile = tt.profile
+			cfg.Producer.Historical.Monotonic = tt.monotonic
+			if _, err := newTimestampGenerator(cfg, 0); err == nil {
+				t.Error("newTimestampGenerator() accepted the config")
+			}
+		})
+	}
+}
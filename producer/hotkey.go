@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// hotKeyTick is how often a burst sends its share of records
+const hotKeyTick = 10 * time.Millisecond
+
+// errBurstsStopped is returned for bursts requested after generation ended
+var errBurstsStopped = errors.New("event generation has finished")
+
+// hotKeyRequest is the body of POST /hotkey
+type hotKeyRequest struct {
+	Key        string  `json:"key"`
+	RPS        float64 `json:"rps"`
+	DurationMs int     `json:"duration_ms"`
+}
+
+func (r hotKeyRequest) validate() error {
+	if r.Key == "" {
+		return fmt.Errorf("key is required")
+	}
+	if r.RPS <= 0 {
+		return fmt.Errorf("rps must be greater than 0")
+	}
+	if r.DurationMs <= 0 {
+		return fmt.Errorf("duration_ms must be greater than 0")
+	}
+	return nil
+}
+
+// hotKeyBursts sends bursts of extra events with a single partition key on
+// top of the normal load, to make one shard hot on demand. Burst events go
+// to the writer that owns the key, like the key's regular events, and are
+// not counted against total_messages. Only one burst runs at a time: a new
+// request replaces the running one.
+type hotKeyBursts struct {
+	writers    []chan *Event
+	values     ValueGenerator
+	timestamps TimestampGenerator
+
+	mu      sync.Mutex
+	cancel  context.CancelFunc // stops the running burst, if any
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+func newHotKeyBursts(writers []chan *Event, values ValueGenerator, timestamps TimestampGenerator) *hotKeyBursts {
+	return &hotKeyBursts{writers: writers, values: values, timestamps: timestamps}
+}
+
+// start begins a burst, replacing the running one
+func (h *hotKeyBursts) start(req hotKeyRequest) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopped {
+		return errBurstsStopped
+	}
+	if h.cancel != nil {
+		h.cancel()
+	}
+
+	duration := time.Duration(req.DurationMs) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	h.cancel = cancel
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		defer cancel()
+		start := time.Now()
+		sent := h.run(ctx, req)
+		log.Printf("Hot key burst for %s ended: %d records in %v", req.Key, sent, time.Since(start).Round(time.Millisecond))
+	}()
+	return nil
+}
+
+// stop ends the running burst and refuses new ones, once nothing else writes
+// to the writer channels
+func (h *hotKeyBursts) stop() {
+	h.mu.Lock()
+	h.stopped = true
+	if h.cancel != nil {
+		h.cancel()
+	}
+	h.mu.Unlock()
+	h.wg.Wait()
+}
+
+// run sends req.RPS events a second for req.Key until ctx is done and
+// returns how many it sent. If the writers can't keep up the burst runs
+// slower rather than queuing up.
+func (h *hotKeyBursts) run(ctx context.Context, req hotKeyRequest) int {
+	log.Printf("Hot key burst: %.0f records/sec for %s over %dms", req.RPS, req.Key, req.DurationMs)
+	events := h.writers[writerFor(req.Key, len(h.writers))]
+	start := time.Now()
+	ticker := time.NewTicker(hotKeyTick)
+	defer ticker.Stop()
+
+	sent := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return sent
+		case <-ticker.C:
+		}
+
+		// Catch up to the rate over the whole burst, so ticks lost to a
+		// busy writer don't lower it
+		due := int(req.RPS * time.Since(start).Seconds())
+		for ; sent < due; sent++ {
+			select {
+			case events <- h.event(req.Key):
+			case <-ctx.Done():
+				return sent
+			}
+		}
+	}
+}
+
+// event is a regular random event with the hot key as its user ID and
+// partition key, whatever producer.partition_key_strategy is
+func (h *hotKeyBursts) event(key string) *Event {
+	event := generateEvent(1, h.values, h.timestamps)
+	event.UserID = key
+	event.PartitionKey = key
+	event.Metadata["hot_key"] = true
+	return event
+}
+
+// handleHotKey starts a burst from POST /hotkey {"key", "rps", "duration_ms"}
+func (h *hotKeyBursts) handleHotKey(w http.ResponseWriter, r *http.Request) {
+	var req hotKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.start(req); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(req)
+}
+
+// startControlServer serves POST /hotkey on producer.control_addr and
+// returns a function that shuts the server down
+func startControlServer(cfg *Config, bursts *hotKeyBursts) (func(), error) {
+	if cfg.Producer.ControlAddr == "" {
+		return func() {}, nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /hotkey", bursts.handleHotKey)
+	server := &http.Server{Addr: cfg.Producer.ControlAddr, Handler: mux}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.ListenAndServe()
+	}()
+
+	// Surface bind errors immediately instead of from the background
+	select {
+	case err := <-errChan:
+		return nil, fmt.Errorf("failed to start control server on %s: %w", cfg.Producer.ControlAddr, err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	log.Printf("Serving POST /hotkey on %s", cfg.Producer.ControlAddr)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Control server shutdown: %v", err)
+		}
+	}, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHotKeyBurst(t *testing.T) {
+	const key, rps, duration = "user_42", 1000, 200 * time.Millisecond
+	writers := []chan *Event{make(chan *Event, 1000), make(chan *Event, 1000)}
+	bursts := newHotKeyBursts(writers, func() float64 { return 1 }, time.Now)
+	defer bursts.stop()
+
+	w := httptest.NewRecorder()
+	body := `{"key":"user_42","rps":1000,"duration_ms":200}`
+	bursts.handleHotKey(w, httptest.NewRequest(http.MethodPost, "/hotkey", strings.NewReader(body)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("POST /hotkey answered %d: %s", w.Code, w.Body.String())
+	}
+
+	// Once the burst is over nothing more is sent
+	time.Sleep(duration + 100*time.Millisecond)
+	hot := writers[writerFor(key, len(writers))]
+	sent := len(hot)
+	time.Sleep(100 * time.Millisecond)
+	if len(hot) != sent {
+		t.Errorf("%d more events sent after the burst ended", len(hot)-sent)
+	}
+
+	want := int(rps * duration.Seconds())
+	if sent < want*3/4 || sent > want*11/10 {
+		t.Errorf("burst sent %d events, want about %d", sent, want)
+	}
+	for range sent {
+		if event := <-hot; event.PartitionKey != key || event.UserID != key {
+			t.Fatalf("burst sent an event for %s with partition key %s, want %s", event.UserID, event.PartitionKey, key)
+		}
+	}
+	for i, events := range writers {
+		if len(events) != 0 {
+			t.Errorf("writer %d received %d events, want the burst on the key's writer only", i, len(events))
+		}
+	}
+}
+
+func TestHandleHotKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		stopped  bool
+		wantCode int
+	}{
+		{name: "not JSON", body: "user_42", wantCode: http.StatusBadRequest},
+		{name: "no key", body: `{"rps":10,"duration_ms":10}`, wantCode: http.StatusBadRequest},
+		{name: "no rate", body: `{"key":"user_42","duration_ms":10}`, wantCode: http.StatusBadRequest},
+		{name: "no duration", body: `{"key":"user_42","rps":10}`, wantCode: http.StatusBadRequest},
+		{name: "after generation ended", body: `{"key":"user_42","rps":10,"duration_ms":10}`, stopped: true, wantCode: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bursts := newHotKeyBursts([]chan *Event{make(chan *Event, 10)}, func() float64 { return 1 }, time.Now)
+			if tt.stopped {
+				bursts.stop()
+			}
+			w := httptest.NewRecorder()
+			bursts.handleHotKey(w, httptest.NewRequest(http.MethodPost, "/hotkey", strings.NewReader(tt.body)))
+			if w.Code != tt.wantCode {
+				t.Errorf("POST /hotkey %s answered %d, want %d", tt.body, w.Code, tt.wantCode)
+			}
+			bursts.stop()
+		})
+	}
+}
@@ -2,17 +2,23 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/kds-rebalance/internal/envconfig"
 	"gopkg.in/yaml.v3"
 )
 
@@ -28,45 +34,208 @@ type Config struct {
 		StreamName string `yaml:"stream_name"`
 	} `yaml:"kinesis"`
 	Producer struct {
-		BatchSize     int `yaml:"batch_size"`
-		BatchDelayMs  int `yaml:"batch_delay_ms"`
-		TotalMessages int `yaml:"total_messages"`
+		BatchSize      int  `yaml:"batch_size"`
+		BatchDelayMs   *int `yaml:"batch_delay_ms"` // pause between batches, 0 for none (default 1000)
+		TotalMessages  int  `yaml:"total_messages"`
+		KeyCardinality int  `yaml:"key_cardinality"` // number of distinct user IDs (0 uses the default of 1000)
+		Concurrency    int  `yaml:"concurrency"`     // number of writer goroutines sending in parallel
+
+		// PartitionKeyStrategy picks the partition key of every record:
+		// "user_id" (default), "event_id", "random" or "fixed:<key>"
+		PartitionKeyStrategy string `yaml:"partition_key_strategy"`
+
+		// Session model: simulated users walking login -> ... -> logout
+		ConcurrentSessions int `yaml:"concurrent_sessions"` // 0 uses independent random events
+		SessionDwellMs     int `yaml:"session_dwell_ms"`    // mean pause between a session's actions
+
+		EndMarker bool `yaml:"end_marker"` // send an end marker event to every shard once total_messages are sent
+
+		// UseBatchAPI sends each batch with one PutRecords call; false falls
+		// back to one PutRecord call per event, for comparison (default true)
+		UseBatchAPI *bool `yaml:"use_batch_api"`
+
+		// PreviewShards logs which shard each user ID maps to before sending
+		// and checks every sent record landed there
+		PreviewShards     bool `yaml:"preview_shards"`
+		ShardMapRefreshMs int  `yaml:"shard_map_refresh_ms"` // how often the shard map checks for resharding
+
+		// ProgressFile records how many messages were sent, so a restarted
+		// producer resumes towards total_messages instead of starting over
+		ProgressFile       string `yaml:"progress_file"`
+		ProgressIntervalMs int    `yaml:"progress_interval_ms"` // how often the progress file is written
+
+		// ControlAddr serves POST /hotkey to send a burst of records with one
+		// partition key mid-run (empty disables)
+		ControlAddr string `yaml:"control_addr"`
+
+		// FieldMapping renames Event JSON keys on output (user_id: uid);
+		// consumer.field_mapping reads them back
+		FieldMapping map[string]string `yaml:"field_mapping"`
+
+		// HMACSecret signs every record so consumers with the same
+		// consumer.hmac_secret detect tampering (empty sends unsigned records)
+		HMACSecret string `yaml:"hmac_secret"`
+
+		// Compress compresses the JSON of every record before it is put:
+		// "gzip", or empty (default) for plain JSON. Consumers read both.
+		Compress string `yaml:"compress"`
+
+		// AdaptiveBatch grows the batch size while PutRecords answers fast
+		// and shrinks it when calls slow down or are throttled (disabled
+		// unless target_latency_ms is set)
+		AdaptiveBatch struct {
+			TargetLatencyMs int `yaml:"target_latency_ms"`
+			MinSize         int `yaml:"min_size"` // default 10
+			MaxSize         int `yaml:"max_size"` // default 500, the PutRecords limit
+		} `yaml:"adaptive_batch"`
+
+		// Aggregate packs the events of a batch bound for the same shard
+		// into KPL aggregated records of up to aggregate_max_records events
+		// and 1 MiB, so a shard takes more events than its 1,000
+		// records/sec limit. Consumers unpack them in either mode.
+		Aggregate           bool `yaml:"aggregate"`
+		AggregateMaxRecords int  `yaml:"aggregate_max_records"` // default 100
+
+		// TeeFile appends every sent event, with the shard and sequence
+		// number Kinesis assigned it, as JSON lines (empty disables)
+		TeeFile string `yaml:"tee_file"`
+
+		// ShardTargetRPS maps shard IDs to the records/sec sent to each
+		// through explicit hash keys, replacing the random events (unset
+		// sends random events)
+		ShardTargetRPS map[string]float64 `yaml:"shard_target_rps"`
+
+		// InjectErrorRate fails this fraction of put calls with a synthetic
+		// throttling error to exercise retries (0 disables; test use only)
+		InjectErrorRate float64 `yaml:"inject_error_rate"`
+
+		// DuplicateRate resends this fraction of events with the same
+		// EventID right after they were sent, to exercise consumer dedup
+		// (0 disables; test use only)
+		DuplicateRate float64 `yaml:"duplicate_rate"`
+
+		// Historical stamps events with past timestamps instead of the
+		// current time, simulating a backlog (disabled unless start is set)
+		Historical struct {
+			Start       string    `yaml:"start"`        // RFC3339 start of the window
+			End         string    `yaml:"end"`          // RFC3339 end of the window (default now)
+			RateProfile []float64 `yaml:"rate_profile"` // relative event rates of equal slices of the window (default uniform)
+			Monotonic   bool      `yaml:"monotonic"`    // timestamps increase event by event (requires total_messages)
+		} `yaml:"historical"`
+
+		// ValueDistribution shapes the Value field of generated events
+		ValueDistribution struct {
+			Type   string  `yaml:"type"` // uniform, normal or exponential
+			Min    float64 `yaml:"min"`
+			Max    float64 `yaml:"max"`
+			Mean   float64 `yaml:"mean"`
+			StdDev float64 `yaml:"stddev"`
+		} `yaml:"value_distribution"`
 	} `yaml:"producer"`
 }
 
 // Event represents a sample data event
 type Event struct {
+	Version   int                    `json:"version"`
 	EventID   string                 `json:"event_id"`
 	UserID    string                 `json:"user_id"`
 	Timestamp time.Time              `json:"timestamp"`
 	Action    string                 `json:"action"`
 	Value     float64                `json:"value"`
 	Metadata  map[string]interface{} `json:"metadata"`
+
+	// HashKey routes the event to a shard through an explicit hash key
+	// instead of its partition key (empty uses the partition key)
+	HashKey string `json:"-"`
+
+	// PartitionKey is the key the event is put with, chosen by
+	// producer.partition_key_strategy when it is first sent unless already
+	// set, as for hot key bursts
+	PartitionKey string `json:"-"`
+
+	// Duplicate marks a resend for producer.duplicate_rate, which doesn't
+	// count toward total_messages
+	Duplicate bool `json:"-"`
 }
 
+// EventVersion is the schema version of Event stamped on every event, so
+// consumers can decode old and new layouts side by side. Bump it together
+// with the consumer's when Event changes incompatibly.
+const EventVersion = 1
+
 var actions = []string{"login", "purchase", "view", "click", "logout", "search", "add_to_cart", "checkout"}
 
+// defaultKeyCardinality is the number of distinct user IDs when key_cardinality is unset
+const defaultKeyCardinality = 1000
+
 func loadConfig() (*Config, error) {
-	data, err := os.ReadFile("../config.yaml")
+	configFile := envconfig.ConfigFile()
+	data, err := os.ReadFile(configFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+		return nil, fmt.Errorf("failed to read config file %s: %w", configFile, err)
 	}
 
 	var cfg Config
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
+	log.Printf("Loaded configuration from: %s", configFile)
 
+	applied, err := envconfig.Apply([]envconfig.Override{
+		{Env: "AWS_REGION", Field: &cfg.AWS.Region},
+		{Env: "AWS_ENDPOINT", Field: &cfg.AWS.Endpoint},
+		{Env: "KINESIS_STREAM_NAME", Field: &cfg.Kinesis.StreamName},
+		{Env: "PRODUCER_TOTAL_MESSAGES", Field: &cfg.Producer.TotalMessages},
+		{Env: "PRODUCER_BATCH_SIZE", Field: &cfg.Producer.BatchSize},
+		{Env: "PRODUCER_BATCH_DELAY_MS", Field: &cfg.Producer.BatchDelayMs},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(applied) > 0 {
+		log.Printf("Applied environment overrides: %s", strings.Join(applied, ", "))
+	}
+
+	cfg.ApplyDefaults()
+	if _, err := newPartitionKeyFunc(cfg.Producer.PartitionKeyStrategy); err != nil {
+		return nil, err
+	}
+	if _, err := newCompressor(cfg.Producer.Compress); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
 
-func generateEvent() *Event {
+// redactedSecret stands in for credentials in printed configuration
+const redactedSecret = "REDACTED"
+
+// printConfig writes the effective configuration, after defaults, as YAML
+// with credentials masked. The output can be used as a config file again.
+func printConfig(w io.Writer, cfg *Config) error {
+	redacted := *cfg
+	for _, secret := range []*string{&redacted.AWS.AccessKey, &redacted.AWS.SecretKey, &redacted.Producer.HMACSecret} {
+		if *secret != "" {
+			*secret = redactedSecret
+		}
+	}
+	data, err := yaml.Marshal(&redacted)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// generateEvent creates a random event whose UserID is drawn from keyCardinality
+// distinct values, whose Value is drawn from values and whose Timestamp from timestamps
+func generateEvent(keyCardinality int, values ValueGenerator, timestamps TimestampGenerator) *Event {
 	return &Event{
+		Version:   EventVersion,
 		EventID:   fmt.Sprintf("evt_%d", time.Now().UnixNano()),
-		UserID:    fmt.Sprintf("user_%d", rand.Intn(1000)),
-		Timestamp: time.Now(),
+		UserID:    fmt.Sprintf("user_%d", rand.Intn(keyCardinality)),
+		Timestamp: timestamps(),
 		Action:    actions[rand.Intn(len(actions))],
-		Value:     rand.Float64() * 1000,
+		Value:     values(),
 		Metadata: map[string]interface{}{
 			"source":  "web",
 			"version": "1.0",
@@ -76,6 +245,9 @@ func generateEvent() *Event {
 }
 
 func main() {
+	printConfigFlag := flag.Bool("print-config", false, "print the effective configuration as YAML, with secrets redacted, and exit")
+	flag.Parse()
+
 	log.Println("Starting Kinesis Producer...")
 
 	// Load configuration
@@ -83,6 +255,12 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
+	if *printConfigFlag {
+		if err := printConfig(os.Stdout, cfg); err != nil {
+			log.Fatalf("Failed to print config: %v", err)
+		}
+		return
+	}
 
 	// Initialize AWS Config
 	ctx := context.Background()
@@ -106,66 +284,237 @@ func main() {
 	}
 
 	// Create Kinesis client
-	client := kinesis.NewFromConfig(awsCfg)
+	kinesisClient := kinesis.NewFromConfig(awsCfg)
+	client, err := withErrorInjection(kinesisClient, cfg.Producer.InjectErrorRate)
+	if err != nil {
+		log.Fatalf("Invalid error injection: %v", err)
+	}
 
 	log.Printf("Connected to Kinesis stream: %s", cfg.Kinesis.StreamName)
-	log.Printf("Configuration: BatchSize=%d, BatchDelay=%dms, TotalMessages=%d",
-		cfg.Producer.BatchSize, cfg.Producer.BatchDelayMs, cfg.Producer.TotalMessages)
+	log.Printf("Configuration: BatchSize=%d, BatchDelay=%dms, TotalMessages=%d, KeyCardinality=%d, Concurrency=%d",
+		cfg.Producer.BatchSize, *cfg.Producer.BatchDelayMs, cfg.Producer.TotalMessages,
+		cfg.Producer.KeyCardinality, cfg.Producer.Concurrency)
+	if !*cfg.Producer.UseBatchAPI {
+		log.Println("Sending one PutRecord call per event (producer.use_batch_api is false)")
+	}
+
+	values, err := newValueGenerator(cfg)
+	if err != nil {
+		log.Fatalf("Invalid value distribution: %v", err)
+	}
+	dist := cfg.Producer.ValueDistribution
+	log.Printf("Value distribution: %s (min=%g, max=%g, mean=%g, stddev=%g)",
+		dist.Type, dist.Min, dist.Max, dist.Mean, dist.StdDev)
+
+	fields, err := newFieldMapping(cfg)
+	if err != nil {
+		log.Fatalf("Invalid field mapping: %v", err)
+	}
+	if fields != nil {
+		log.Printf("Field mapping: %v", cfg.Producer.FieldMapping)
+	}
+	keyFunc, err := newPartitionKeyFunc(cfg.Producer.PartitionKeyStrategy)
+	if err != nil {
+		log.Fatalf("Invalid partition key strategy: %v", err)
+	}
+	log.Printf("Partition keys: %s", cfg.Producer.PartitionKeyStrategy)
+	signer := newSigner(cfg)
+	if signer != nil {
+		log.Println("Signing records with producer.hmac_secret")
+	}
+	compressor, err := newCompressor(cfg.Producer.Compress)
+	if err != nil {
+		log.Fatalf("Invalid compression: %v", err)
+	}
+	if compressor != nil {
+		log.Printf("Compressing records with %s", cfg.Producer.Compress)
+	}
+
+	duplicates, err := newDuplicator(cfg.Producer.DuplicateRate)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 
-	messageCount := 0
-	startTime := time.Now()
+	adaptive, err := newAdaptiveBatch(cfg)
+	if err != nil {
+		log.Fatalf("Invalid adaptive batching: %v", err)
+	}
+	if adaptive != nil {
+		log.Printf("Adaptive batch size: starting at %d, between %d and %d, target PutRecords latency %v",
+			adaptive.current(0), adaptive.minSize, adaptive.maxSize, adaptive.target)
+	}
 
-	for {
-		// Check if we've reached the total message limit
-		if cfg.Producer.TotalMessages > 0 && messageCount >= cfg.Producer.TotalMessages {
-			log.Printf("Reached total message limit: %d messages", cfg.Producer.TotalMessages)
-			break
+	tee, err := newTeeFile(cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if tee != nil {
+		log.Printf("Writing sent events to %s", cfg.Producer.TeeFile)
+	}
+	defer func() {
+		if err := tee.Close(); err != nil {
+			log.Printf("Failed to close tee file: %v", err)
 		}
+	}()
 
-		// Send batch of messages
-		for i := 0; i < cfg.Producer.BatchSize; i++ {
-			event := generateEvent()
-			data, err := json.Marshal(event)
-			if err != nil {
-				log.Printf("Failed to marshal event: %v", err)
-				continue
-			}
+	resumed, err := loadProgress(cfg.Producer.ProgressFile)
+	if err != nil {
+		log.Fatalf("Failed to load progress: %v", err)
+	}
+	if resumed.Done() > 0 {
+		log.Printf("Resuming from %s: %d messages already sent, %d dropped (as of %s)",
+			cfg.Producer.ProgressFile, resumed.Sent, resumed.Dropped, resumed.UpdatedAt.Format(time.RFC3339))
+	}
 
-			// Use UserID as partition key for consistent shard assignment
-			input := &kinesis.PutRecordInput{
-				StreamName:   aws.String(cfg.Kinesis.StreamName),
-				Data:         data,
-				PartitionKey: aws.String(event.UserID),
-			}
+	timestamps, err := newTimestampGenerator(cfg, resumed.Done())
+	if err != nil {
+		log.Fatalf("Invalid historical window: %v", err)
+	}
+	if hist := cfg.Producer.Historical; hist.Start != "" {
+		end := hist.End
+		if end == "" {
+			end = "now"
+		}
+		log.Printf("Historical mode: timestamps from %s to %s (rate profile %v, monotonic %t)",
+			hist.Start, end, hist.RateProfile, hist.Monotonic)
+	}
 
-			output, err := client.PutRecord(ctx, input)
-			if err != nil {
-				log.Printf("Failed to put record: %v", err)
-				continue
-			}
+	stats := newProducerStats(cfg.Producer.KeyCardinality)
+	if cfg.Producer.PartitionKeyStrategy == PartitionKeyRandom {
+		// Every record has a key of its own, which would only grow the set
+		stats.distinctKeys = nil
+	}
+	stats.compressed = compressor != nil
+	stopProgress := startProgress(cfg, resumed, stats)
+
+	// On a shutdown signal stop generating and let the writers send what
+	// was already generated, so the saved progress loses nothing
+	genCtx, stopGenerating := context.WithCancel(ctx)
+	defer stopGenerating()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		// A second signal kills the process as before
+		signal.Stop(sigChan)
+		log.Println("Received shutdown signal, sending generated events before exiting...")
+		stopGenerating()
+	}()
 
-			messageCount++
-			log.Printf("[%d] Sent event %s | UserID: %s | Action: %s | ShardID: %s | SequenceNumber: %s",
-				messageCount, event.EventID, event.UserID, event.Action, *output.ShardId, *output.SequenceNumber)
+	// The map reads shards through the raw client so injected errors don't hit it
+	var shardMap *ShardMap
+	if cfg.Producer.PreviewShards {
+		shardMap = NewShardMap(kinesisClient, cfg.Kinesis.StreamName,
+			time.Duration(cfg.Producer.ShardMapRefreshMs)*time.Millisecond)
+		if err := previewShards(shardMap, cfg.Producer.KeyCardinality); err != nil {
+			log.Fatalf("Failed to preview shards: %v", err)
+		}
+	}
+	// Aggregated records are grouped by shard through the same map
+	aggregateMap := shardMap
+	if cfg.Producer.Aggregate {
+		if aggregateMap == nil {
+			aggregateMap = NewShardMap(kinesisClient, cfg.Kinesis.StreamName,
+				time.Duration(cfg.Producer.ShardMapRefreshMs)*time.Millisecond)
+		}
+		log.Printf("Aggregating up to %d events per record (producer.aggregate)", cfg.Producer.AggregateMaxRecords)
+	}
+	var targets []*shardTarget
+	targetMap := aggregateMap
+	if len(cfg.Producer.ShardTargetRPS) > 0 {
+		if targetMap == nil {
+			targetMap = NewShardMap(kinesisClient, cfg.Kinesis.StreamName,
+				time.Duration(cfg.Producer.ShardMapRefreshMs)*time.Millisecond)
+		}
+		if targets, err = newShardTargets(cfg, targetMap); err != nil {
+			log.Fatalf("Invalid shard targets: %v", err)
+		}
+	}
 
-			// Break if we've reached the limit mid-batch
-			if cfg.Producer.TotalMessages > 0 && messageCount >= cfg.Producer.TotalMessages {
-				break
+	// Writers share one channel, except in session mode where each writer
+	// gets its own so a session's events stay in order
+	writerEvents := make([]chan *Event, cfg.Producer.Concurrency)
+	var generate func()
+	if cfg.Producer.ConcurrentSessions > 0 {
+		log.Printf("Session model: %d concurrent sessions, mean dwell %dms",
+			cfg.Producer.ConcurrentSessions, cfg.Producer.SessionDwellMs)
+		for i := range writerEvents {
+			writerEvents[i] = make(chan *Event, cfg.Producer.BatchSize)
+		}
+		generate = func() { generateSessions(genCtx, cfg, values, timestamps, resumed.Done(), writerEvents) }
+	} else {
+		events := make(chan *Event, cfg.Producer.BatchSize*cfg.Producer.Concurrency)
+		for i := range writerEvents {
+			writerEvents[i] = events
+		}
+		if len(targets) > 0 {
+			generate = func() {
+				generateShardTargets(genCtx, cfg, targets, targetMap, values, timestamps, resumed.Done(), events)
 			}
+		} else {
+			generate = func() { generateEvents(genCtx, cfg, values, timestamps, resumed.Done(), events) }
 		}
+	}
 
-		// Calculate and display stats
-		elapsed := time.Since(startTime).Seconds()
-		rate := float64(messageCount) / elapsed
-		log.Printf("Stats: Total=%d, Rate=%.2f msgs/sec, Elapsed=%.2fs", messageCount, rate, elapsed)
+	bursts := newHotKeyBursts(writerEvents, values, timestamps)
+	stopControl, err := startControlServer(cfg, bursts)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer stopControl()
+	go func() {
+		generate()
+		// Bursts write to the same channels, so they end before the channels close
+		bursts.stop()
+		closed := make(map[chan *Event]bool)
+		for _, events := range writerEvents {
+			if !closed[events] {
+				close(events)
+				closed[events] = true
+			}
+		}
+	}()
 
-		// Wait before next batch
-		if cfg.Producer.TotalMessages == 0 || messageCount < cfg.Producer.TotalMessages {
-			time.Sleep(time.Duration(cfg.Producer.BatchDelayMs) * time.Millisecond)
+	// Each writer pulls events from its channel and sends independently
+	var wg sync.WaitGroup
+	for i := 1; i <= cfg.Producer.Concurrency; i++ {
+		wg.Add(1)
+		w := &writer{
+			id:         i,
+			client:     client,
+			streamName: cfg.Kinesis.StreamName,
+			batchSize:  cfg.Producer.BatchSize,
+			keyFunc:    keyFunc,
+			batchAPI:   *cfg.Producer.UseBatchAPI,
+			stats:      stats,
+			shardMap:   shardMap,
+			fields:     fields,
+			signer:     signer,
+			compressor: compressor,
+			tee:        tee,
+			adaptive:   adaptive,
+			duplicates: duplicates,
+			aggregator: newAggregator(cfg, aggregateMap),
 		}
+		events := writerEvents[i-1]
+		go func() {
+			defer wg.Done()
+			w.run(ctx, events)
+		}()
+	}
+
+	wg.Wait()
+	stopProgress()
+	stats.logSummary()
+	// An interrupted run is resumed later, and the markers wait for its end
+	if genCtx.Err() != nil {
+		return
 	}
 
-	elapsed := time.Since(startTime).Seconds()
-	log.Printf("Producer completed: %d messages in %.2f seconds (%.2f msgs/sec)",
-		messageCount, elapsed, float64(messageCount)/elapsed)
+	// End markers are not part of the load, so they bypass error injection
+	if cfg.Producer.EndMarker {
+		if err := sendEndMarkers(ctx, kinesisClient, cfg.Kinesis.StreamName, fields, compressor, signer); err != nil {
+			log.Fatalf("Failed to send end markers: %v", err)
+		}
+	}
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPrintConfig(t *testing.T) {
+	for _, env := range []string{"AWS_REGION", "AWS_ENDPOINT", "KINESIS_STREAM_NAME", "PRODUCER_TOTAL_MESSAGES", "PRODUCER_BATCH_SIZE", "PRODUCER_BATCH_DELAY_MS"} {
+		t.Setenv(env, "")
+	}
+	secrets := []string{"AKIDEXAMPLE", "wJalrXUtnFEMI", "hmac-signing-key"}
+	cfg := loadTestConfig(t, "aws:\n  access_key: "+secrets[0]+"\n  secret_key: "+secrets[1]+
+		"\nkinesis:\n  stream_name: test-stream\nproducer:\n  hmac_secret: "+secrets[2]+"\n")
+
+	var out bytes.Buffer
+	if err := printConfig(&out, cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range secrets {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("printed config shows secret %q", secret)
+		}
+	}
+	if cfg.AWS.SecretKey != secrets[1] {
+		t.Errorf("printConfig() changed the config it printed")
+	}
+
+	// Loading the printed config gives the same effective config, so it
+	// prints the same again
+	printed := loadTestConfig(t, out.String())
+	if printed.AWS.AccessKey != redactedSecret || printed.Producer.HMACSecret != redactedSecret {
+		t.Errorf("printed config loads with secrets %q and %q, want them redacted", printed.AWS.AccessKey, printed.Producer.HMACSecret)
+	}
+	var again bytes.Buffer
+	if err := printConfig(&again, printed); err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != out.String() {
+		t.Errorf("printed config loads as\n%s\nwant\n%s", again.String(), out.String())
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// EndMarkerAction is the action of the sentinel event sent to every shard
+// once all records are produced; consumers with consumer.stop_on_marker stop
+// after seeing it on each of their shards
+const EndMarkerAction = "__END__"
+
+// sendEndMarkers puts one end marker event on every open shard of the
+// stream, targeting each shard through an explicit hash key inside its range
+func sendEndMarkers(ctx context.Context, client kinesisAPI, streamName string, fields fieldMapping, compressor *compressor, signer signer) error {
+	shards, err := openShards(ctx, client, streamName)
+	if err != nil {
+		return err
+	}
+
+	for _, shard := range shards {
+		shardID := aws.ToString(shard.ShardId)
+		data, err := fields.marshal(&Event{
+			Version:   EventVersion,
+			EventID:   fmt.Sprintf("end_%s_%d", shardID, time.Now().UnixNano()),
+			Timestamp: time.Now(),
+			Action:    EndMarkerAction,
+			Metadata:  map[string]interface{}{"shard_id": shardID},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal end marker: %w", err)
+		}
+		if data, err = compressor.compress(data); err != nil {
+			return fmt.Errorf("failed to compress end marker: %w", err)
+		}
+
+		output, err := client.PutRecord(ctx, &kinesis.PutRecordInput{
+			StreamName:      aws.String(streamName),
+			Data:            signer.sign(data),
+			PartitionKey:    aws.String(EndMarkerAction),
+			ExplicitHashKey: shard.HashKeyRange.StartingHashKey,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to send end marker to %s: %w", shardID, err)
+		}
+		if got := aws.ToString(output.ShardId); got != shardID {
+			// The shard split or merged since it was listed
+			log.Printf("End marker for %s landed on %s", shardID, got)
+			continue
+		}
+		log.Printf("Sent end marker to %s | SequenceNumber: %s", shardID, aws.ToString(output.SequenceNumber))
+	}
+	return nil
+}
+
+// openShards lists the shards of the stream that still accept records
+func openShards(ctx context.Context, client kinesisAPI, streamName string) ([]types.Shard, error) {
+	var shards []types.Shard
+	input := &kinesis.ListShardsInput{StreamName: aws.String(streamName)}
+	for {
+		output, err := client.ListShards(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list shards: %w", err)
+		}
+		for _, shard := range output.Shards {
+			if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber == nil {
+				shards = append(shards, shard)
+			}
+		}
+		if output.NextToken == nil {
+			return shards, nil
+		}
+		// A paginated request carries only the token
+		input = &kinesis.ListShardsInput{NextToken: output.NextToken}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// shardedStream is a kinesisAPI listing shards one per page and routing
+// PutRecord by explicit hash key to the open shard whose range holds it
+type shardedStream struct {
+	kinesisAPI
+	shards []types.Shard
+	put    map[string][]*kinesis.PutRecordInput // by the shard each record landed on
+}
+
+func (s *shardedStream) ListShards(ctx context.Context, params *kinesis.ListShardsInput, optFns ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error) {
+	page := 0
+	if params.NextToken != nil {
+		if params.StreamName != nil {
+			return nil, fmt.Errorf("ListShards with both a token and a stream name")
+		}
+		fmt.Sscan(aws.ToString(params.NextToken), &page)
+	}
+	output := &kinesis.ListShardsOutput{Shards: s.shards[page : page+1]}
+	if page+1 < len(s.shards) {
+		output.NextToken = aws.String(fmt.Sprint(page + 1))
+	}
+	return output, nil
+}
+
+func (s *shardedStream) PutRecord(ctx context.Context, params *kinesis.PutRecordInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordOutput, error) {
+	key, _ := new(big.Int).SetString(aws.ToString(params.ExplicitHashKey), 10)
+	for _, shard := range s.shards {
+		start, _ := new(big.Int).SetString(aws.ToString(shard.HashKeyRange.StartingHashKey), 10)
+		end, _ := new(big.Int).SetString(aws.ToString(shard.HashKeyRange.EndingHashKey), 10)
+		if shard.SequenceNumberRange.EndingSequenceNumber == nil && key.Cmp(start) >= 0 && key.Cmp(end) <= 0 {
+			shardID := aws.ToString(shard.ShardId)
+			s.put[shardID] = append(s.put[shardID], params)
+			return &kinesis.PutRecordOutput{ShardId: shard.ShardId, SequenceNumber: aws.String("1")}, nil
+		}
+	}
+	return nil, fmt.Errorf("no open shard holds hash key %s", key)
+}
+
+// testStreamShard is a shard covering hash keys start to end, closed when closed is set
+func testStreamShard(id, start, end string, closed bool) types.Shard {
+	shard := types.Shard{
+		ShardId:             aws.String(id),
+		HashKeyRange:        &types.HashKeyRange{StartingHashKey: aws.String(start), EndingHashKey: aws.String(end)},
+		SequenceNumberRange: &types.SequenceNumberRange{StartingSequenceNumber: aws.String("1")},
+	}
+	if closed {
+		shard.SequenceNumberRange.EndingSequenceNumber = aws.String("9")
+	}
+	return shard
+}
+
+func TestSendEndMarkers(t *testing.T) {
+	const last = "340282366920938463463374607431768211455"
+	client := &shardedStream{
+		shards: []types.Shard{
+			// A parent split into the two shards after it
+			testStreamShard("shardId-000000000000", "0", last, true),
+			testStreamShard("shardId-000000000001", "0", "170141183460469231731687303715884105727", false),
+			testStreamShard("shardId-000000000002", "170141183460469231731687303715884105728", last, false),
+		},
+		put: make(map[string][]*kinesis.PutRecordInput),
+	}
+
+	if err := sendEndMarkers(context.Background(), client, "test-stream", nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.put) != 2 || len(client.put["shardId-000000000000"]) != 0 {
+		t.Fatalf("end markers sent to %v, want one per open shard", client.put)
+	}
+	for _, shardID := range []string{"shardId-000000000001", "shardId-000000000002"} {
+		if len(client.put[shardID]) != 1 {
+			t.Errorf("%s received %d end markers, want 1", shardID, len(client.put[shardID]))
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal(client.put[shardID][0].Data, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Action != EndMarkerAction || event.Metadata["shard_id"] != shardID {
+			t.Errorf("%s received %s for %v, want %s for itself", shardID, event.Action, event.Metadata["shard_id"], EndMarkerAction)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Values of producer.partition_key_strategy
+const (
+	PartitionKeyUserID      = "user_id"
+	PartitionKeyEventID     = "event_id"
+	PartitionKeyRandom      = "random"
+	PartitionKeyFixedPrefix = "fixed:"
+
+	// maxPartitionKeyLength is the longest partition key Kinesis accepts
+	maxPartitionKeyLength = 256
+)
+
+// PartitionKeyFunc returns the partition key an event is put with
+type PartitionKeyFunc func(event *Event) string
+
+// newPartitionKeyFunc returns the partition key function of a
+// producer.partition_key_strategy: "user_id" keeps a user's events on one
+// shard, "event_id" and "random" (a UUID per record) spread events evenly
+// over the shards, and "fixed:<key>" puts every event on the shard of key
+func newPartitionKeyFunc(strategy string) (PartitionKeyFunc, error) {
+	switch {
+	case strategy == PartitionKeyUserID:
+		return func(event *Event) string { return event.UserID }, nil
+	case strategy == PartitionKeyEventID:
+		return func(event *Event) string { return event.EventID }, nil
+	case strategy == PartitionKeyRandom:
+		return func(*Event) string { return uuid.NewString() }, nil
+	case strings.HasPrefix(strategy, PartitionKeyFixedPrefix):
+		key := strings.TrimPrefix(strategy, PartitionKeyFixedPrefix)
+		if key == "" || len(key) > maxPartitionKeyLength {
+			return nil, fmt.Errorf("invalid producer.partition_key_strategy: %s. The fixed key must be 1 to %d characters", strategy, maxPartitionKeyLength)
+		}
+		return func(*Event) string { return key }, nil
+	default:
+		return nil, fmt.Errorf("invalid producer.partition_key_strategy: %s. Must be '%s', '%s', '%s' or '%s<key>'",
+			strategy, PartitionKeyUserID, PartitionKeyEventID, PartitionKeyRandom, PartitionKeyFixedPrefix)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestNewPartitionKeyFunc(t *testing.T) {
+	event := &Event{EventID: "evt_1", UserID: "user_1"}
+	tests := []struct {
+		name     string
+		strategy string
+		want     string // the key of event, empty for an error
+		wantErr  string
+	}{
+		{name: "user ID", strategy: PartitionKeyUserID, want: "user_1"},
+		{name: "event ID", strategy: PartitionKeyEventID, want: "evt_1"},
+		{name: "fixed key", strategy: "fixed:hot", want: "hot"},
+		{name: "fixed key with a colon", strategy: "fixed:a:b", want: "a:b"},
+		{name: "longest fixed key", strategy: "fixed:" + strings.Repeat("k", maxPartitionKeyLength), want: strings.Repeat("k", maxPartitionKeyLength)},
+		{name: "empty fixed key", strategy: "fixed:", wantErr: "must be 1 to 256 characters"},
+		{name: "fixed key too long", strategy: "fixed:" + strings.Repeat("k", maxPartitionKeyLength+1), wantErr: "must be 1 to 256 characters"},
+		{name: "unknown", strategy: "session", wantErr: "invalid producer.partition_key_strategy: session"},
+		{name: "empty", strategy: "", wantErr: "invalid producer.partition_key_strategy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyFunc, err := newPartitionKeyFunc(tt.strategy)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("newPartitionKeyFunc() = %v, want an error with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := keyFunc(event); got != tt.want {
+				t.Errorf("key %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRandomPartitionKey(t *testing.T) {
+	keyFunc, err := newPartitionKeyFunc(PartitionKeyRandom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &Event{EventID: "evt_1", UserID: "user_1"}
+	seen := make(map[string]bool)
+	for range 100 {
+		key := keyFunc(event)
+		if _, err := uuid.Parse(key); err != nil {
+			t.Fatalf("key %q is not a UUID: %v", key, err)
+		}
+		if seen[key] {
+			t.Fatalf("key %q repeated", key)
+		}
+		seen[key] = true
+	}
+}
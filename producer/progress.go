@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+)
+
+// DefaultProgressIntervalMs is how often the progress file is written
+const DefaultProgressIntervalMs = 1000
+
+// Progress is what producer.progress_file records: the messages accounted
+// for by this and earlier runs, so a restarted producer generates only the
+// rest of total_messages
+type Progress struct {
+	Sent      int       `json:"sent"`
+	Dropped   int       `json:"dropped"` // failed every attempt; not regenerated on resume
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Done returns how many messages were sent or given up on
+func (p Progress) Done() int {
+	return p.Sent + p.Dropped
+}
+
+// loadProgress reads the progress file, returning zero progress when there is none yet
+func loadProgress(path string) (Progress, error) {
+	var progress Progress
+	if path == "" {
+		return progress, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return progress, nil
+	}
+	if err != nil {
+		return progress, fmt.Errorf("failed to read progress file %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &progress); err != nil {
+		return progress, fmt.Errorf("failed to parse progress file %s: %w", path, err)
+	}
+	return progress, nil
+}
+
+// saveProgress writes the progress file through a rename, so a crash leaves
+// either the previous or the new progress and never a partial file
+func saveProgress(path string, progress Progress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return fmt.Errorf("failed to encode progress: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write progress file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace progress file: %w", err)
+	}
+	return nil
+}
+
+// startProgress writes the progress of the earlier runs plus this one's
+// stats to producer.progress_file every interval, and returns a function
+// that stops and writes it a last time. Messages sent since the last write
+// before a crash are sent again after a restart; a graceful stop loses none.
+func startProgress(cfg *Config, resumed Progress, stats *producerStats) func() {
+	path := cfg.Producer.ProgressFile
+	if path == "" {
+		return func() {}
+	}
+
+	save := func() {
+		sent, dropped := stats.totals()
+		progress := Progress{Sent: resumed.Sent + sent, Dropped: resumed.Dropped + dropped, UpdatedAt: time.Now().UTC()}
+		if err := saveProgress(path, progress); err != nil {
+			log.Printf("Failed to save progress: %v", err)
+		}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(time.Duration(cfg.Producer.ProgressIntervalMs) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				save()
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		save()
+	}
+}
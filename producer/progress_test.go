@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runTestProducer sends toward cfg.Producer.TotalMessages like main does,
+// resuming from the progress file. With stopAfter above zero generation is
+// interrupted once that many events were generated, as a shutdown signal
+// does. It returns the timestamps of the events put.
+func runTestProducer(t *testing.T, cfg *Config, stopAfter int) []time.Time {
+	t.Helper()
+	resumed, err := loadProgress(cfg.Producer.ProgressFile)
+	if err != nil {
+		t.Fatalf("loadProgress() = %v", err)
+	}
+	timestamps, err := newTimestampGenerator(cfg, resumed.Done())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := newProducerStats(cfg.Producer.KeyCardinality)
+	stopProgress := startProgress(cfg, resumed, stats)
+
+	genCtx, stopGenerating := context.WithCancel(context.Background())
+	defer stopGenerating()
+	generated := 0
+	values := func() float64 {
+		if generated++; generated == stopAfter {
+			stopGenerating()
+		}
+		return 1
+	}
+	events := make(chan *Event, cfg.Producer.BatchSize)
+	go func() {
+		generateEvents(genCtx, cfg, values, timestamps, resumed.Done(), events)
+		close(events)
+	}()
+
+	client := &fakePutter{}
+	w := newTestWriter(client, true)
+	w.batchSize, w.stats = cfg.Producer.BatchSize, stats
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.run(context.Background(), events)
+	}()
+	wg.Wait()
+	stopProgress()
+
+	var put []time.Time
+	for _, entry := range client.put {
+		var event Event
+		if err := json.Unmarshal(entry.Data, &event); err != nil {
+			t.Fatalf("put undecodable data: %v", err)
+		}
+		put = append(put, event.Timestamp)
+	}
+	return put
+}
+
+func TestProgressResume(t *testing.T) {
+	const total = 50
+	noDelay := 0
+	cfg := &Config{}
+	cfg.Producer.BatchSize = 7
+	cfg.Producer.BatchDelayMs = &noDelay
+	cfg.Producer.TotalMessages = total
+	cfg.Producer.KeyCardinality = 10
+	cfg.Producer.ProgressFile = filepath.Join(t.TempDir(), "progress.json")
+	cfg.Producer.ProgressIntervalMs = 1
+	// Monotonic timestamps number the events, so a resent one shows up
+	cfg.Producer.Historical.Start = "2024-01-01T00:00:00Z"
+	cfg.Producer.Historical.End = "2024-01-02T00:00:00Z"
+	cfg.Producer.Historical.Monotonic = true
+
+	first := runTestProducer(t, cfg, 20)
+	if len(first) == 0 || len(first) >= total {
+		t.Fatalf("interrupted run put %d events, want some of %d", len(first), total)
+	}
+	progress, err := loadProgress(cfg.Producer.ProgressFile)
+	if err != nil || progress.Sent != len(first) {
+		t.Fatalf("progress after the interrupted run = %+v, %v; want %d sent", progress, err, len(first))
+	}
+
+	second := runTestProducer(t, cfg, 0)
+	if len(first)+len(second) != total {
+		t.Errorf("runs put %d and %d events, want %d in all", len(first), len(second), total)
+	}
+	all := append(first, second...)
+	sort.Slice(all, func(i, j int) bool { return all[i].Before(all[j]) })
+	for i := 1; i < len(all); i++ {
+		if all[i].Equal(all[i-1]) {
+			t.Errorf("event at %s put twice", all[i].Format(time.RFC3339Nano))
+		}
+	}
+	if progress, _ := loadProgress(cfg.Producer.ProgressFile); progress.Sent != total {
+		t.Errorf("progress after the resumed run = %+v, want %d sent", progress, total)
+	}
+
+	// Nothing is left to send once total_messages were
+	if third := runTestProducer(t, cfg, 0); len(third) != 0 {
+		t.Errorf("completed producer put %d more events on restart", len(third))
+	}
+}
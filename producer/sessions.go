@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultSessionDwellMs is the mean pause between two actions of a session
+const DefaultSessionDwellMs = 500
+
+// sessionStart and sessionEnd bound every session
+const (
+	sessionStart = "login"
+	sessionEnd   = "logout"
+)
+
+// sessionTransitions is the user behaviour state machine: each action lists
+// the actions that may follow it, picked uniformly. Every path starts at
+// login and ends at logout, with checkout always followed by purchase.
+var sessionTransitions = map[string][]string{
+	"login":       {"view", "search"},
+	"view":        {"view", "click", "search", "add_to_cart", "logout"},
+	"click":       {"view", "add_to_cart"},
+	"search":      {"view", "click"},
+	"add_to_cart": {"view", "checkout"},
+	"checkout":    {"purchase"},
+	"purchase":    {"view", "logout"},
+}
+
+// nextAction returns the action following current in a session
+func nextAction(current string, rng *rand.Rand) string {
+	next := sessionTransitions[current]
+	return next[rng.Intn(len(next))]
+}
+
+// eventBudget hands out the remaining total_messages to concurrent generators
+// so that exactly the configured number of events is produced
+type eventBudget struct {
+	mu        sync.Mutex
+	remaining int
+	unlimited bool
+}
+
+func newEventBudget(total int) *eventBudget {
+	return &eventBudget{remaining: total, unlimited: total <= 0}
+}
+
+// take reserves one event, returning false once the budget is spent
+func (b *eventBudget) take() bool {
+	if b.unlimited {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.remaining == 0 {
+		return false
+	}
+	b.remaining--
+	return true
+}
+
+// generateSessions runs producer.concurrent_sessions simulated users, each
+// walking the session state machine with random dwell times between
+// actions. Events are routed to a writer by partition key, so all events of
+// a session go through the same writer and reach the stream in order.
+// resumed events of total_messages were already sent by earlier runs.
+func generateSessions(ctx context.Context, cfg *Config, values ValueGenerator, timestamps TimestampGenerator, resumed int, writers []chan *Event) {
+	budget := newEventBudget(cfg.Producer.TotalMessages)
+	if !budget.unlimited {
+		budget.remaining = max(budget.remaining-resumed, 0)
+	}
+	dwell := time.Duration(cfg.Producer.SessionDwellMs) * time.Millisecond
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Producer.ConcurrentSessions; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(i)))
+			for runSession(ctx, cfg, values, timestamps, writers, budget, dwell, rng) {
+			}
+		}()
+	}
+	wg.Wait()
+	if cfg.Producer.TotalMessages > 0 {
+		log.Printf("Reached total message limit: %d messages", cfg.Producer.TotalMessages)
+	}
+}
+
+// runSession plays one session from login to logout. It returns false when
+// the producer should stop (budget spent or cancelled).
+func runSession(ctx context.Context, cfg *Config, values ValueGenerator, timestamps TimestampGenerator, writers []chan *Event,
+	budget *eventBudget, dwell time.Duration, rng *rand.Rand) bool {
+
+	userID := fmt.Sprintf("user_%d", rng.Intn(cfg.Producer.KeyCardinality))
+	sessionID := fmt.Sprintf("sess_%d", rng.Int63())
+	events := writers[writerFor(userID, len(writers))]
+
+	action := sessionStart
+	for seq := 1; ; seq++ {
+		if !budget.take() {
+			return false
+		}
+
+		event := &Event{
+			Version:   EventVersion,
+			EventID:   fmt.Sprintf("evt_%d", time.Now().UnixNano()),
+			UserID:    userID,
+			Timestamp: timestamps(),
+			Action:    action,
+			Value:     values(),
+			Metadata: map[string]interface{}{
+				"source":      "web",
+				"version":     "1.0",
+				"session":     sessionID,
+				"session_seq": seq,
+			},
+		}
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			return false
+		}
+
+		if action == sessionEnd {
+			return true
+		}
+		action = nextAction(action, rng)
+
+		select {
+		case <-time.After(time.Duration(rng.ExpFloat64() * float64(dwell))):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// writerFor picks the writer responsible for a partition key
+func writerFor(partitionKey string, writers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(partitionKey))
+	return int(h.Sum32() % uint32(writers))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGenerateSessions(t *testing.T) {
+	const total, sessions, writers = 500, 4, 3
+	cfg := &Config{}
+	cfg.Producer.TotalMessages = total
+	cfg.Producer.ConcurrentSessions = sessions
+	cfg.Producer.KeyCardinality = 5
+
+	// Collect what each writer receives, in order
+	channels := make([]chan *Event, writers)
+	received := make([][]*Event, writers)
+	var wg sync.WaitGroup
+	for i := range channels {
+		channels[i] = make(chan *Event)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for event := range channels[i] {
+				received[i] = append(received[i], event)
+			}
+		}()
+	}
+	generateSessions(context.Background(), cfg, func() float64 { return 1 }, time.Now, 0, channels)
+	for _, events := range channels {
+		close(events)
+	}
+	wg.Wait()
+
+	// Replay every session through the state machine
+	type session struct {
+		last string
+		seq  int
+	}
+	played := make(map[string]*session)
+	userWriters := make(map[string]int)
+	count := 0
+	for writer, events := range received {
+		for _, event := range events {
+			count++
+			if w, ok := userWriters[event.UserID]; ok && w != writer {
+				t.Fatalf("%s sent through writers %d and %d", event.UserID, w, writer)
+			}
+			userWriters[event.UserID] = writer
+
+			id, _ := event.Metadata["session"].(string)
+			s := played[id]
+			if s == nil {
+				if event.Action != sessionStart {
+					t.Fatalf("session %s starts with %s, want %s", id, event.Action, sessionStart)
+				}
+				played[id] = &session{last: event.Action, seq: 1}
+				continue
+			}
+			if s.last == sessionEnd {
+				t.Fatalf("session %s continues with %s after %s", id, event.Action, sessionEnd)
+			}
+			if !slices.Contains(sessionTransitions[s.last], event.Action) {
+				t.Errorf("session %s goes from %s to %s", id, s.last, event.Action)
+			}
+			s.seq++
+			if seq := event.Metadata["session_seq"]; seq != s.seq {
+				t.Errorf("session %s event %d has session_seq %v", id, s.seq, seq)
+			}
+			s.last = event.Action
+		}
+	}
+
+	if count != total {
+		t.Errorf("generated %d events, want %d", count, total)
+	}
+	// Only the sessions running when the budget ran out are cut short
+	unfinished := 0
+	for _, s := range played {
+		if s.last != sessionEnd {
+			unfinished++
+		}
+	}
+	if unfinished > sessions || len(played) <= sessions {
+		t.Errorf("%d of %d sessions unfinished, want at most %d of many", unfinished, len(played), sessions)
+	}
+}
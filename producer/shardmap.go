@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/kds-rebalance/internal/hashrange"
+)
+
+// DefaultShardMapRefreshMs is how often the shard map checks the stream's
+// open shard count when producer.shard_map_refresh_ms is unset
+const DefaultShardMapRefreshMs = 30000
+
+// ShardMap caches the hash key ranges of the stream's open shards to tell
+// which shard a partition key lands on, the way Kinesis does: the key's MD5
+// digest read as a 128-bit integer falls inside exactly one open shard's
+// range. At most every refresh interval the open shard count is compared
+// with the cached ranges, and the ranges are listed again after a split,
+// merge or scaling changed it. A nil *ShardMap maps nothing.
+type ShardMap struct {
+	client     kinesisAPI
+	streamName string
+	refresh    time.Duration // 0 never checks once loaded
+
+	mu      sync.Mutex
+	ranges  hashrange.Ranges
+	checked time.Time
+}
+
+// NewShardMap creates a map of the stream, loaded on first use
+func NewShardMap(client kinesisAPI, streamName string, refresh time.Duration) *ShardMap {
+	return &ShardMap{client: client, streamName: streamName, refresh: refresh}
+}
+
+// ShardForKey returns the ID of the open shard the partition key maps to
+func (m *ShardMap) ShardForKey(partitionKey string) (string, error) {
+	return m.shardFor(hashrange.HashKey(partitionKey))
+}
+
+// ShardForHashKey returns the ID of the open shard an explicit hash key, in
+// decimal, maps to
+func (m *ShardMap) ShardForHashKey(explicitHashKey string) (string, error) {
+	hash, ok := new(big.Int).SetString(explicitHashKey, 10)
+	if !ok {
+		return "", fmt.Errorf("invalid explicit hash key %q", explicitHashKey)
+	}
+	return m.shardFor(hash)
+}
+
+// shardFor returns the ID of the open shard whose range holds the hash key
+func (m *ShardMap) shardFor(hash *big.Int) (string, error) {
+	if m == nil {
+		return "", nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ctx := context.Background()
+	if err := m.check(ctx); err != nil {
+		return "", err
+	}
+	if shardID, ok := m.ranges.Lookup(hash); ok {
+		return shardID, nil
+	}
+	// A gap in the ranges means they were listed mid-reshard
+	if err := m.load(ctx); err != nil {
+		return "", err
+	}
+	if shardID, ok := m.ranges.Lookup(hash); ok {
+		return shardID, nil
+	}
+	return "", fmt.Errorf("no open shard of %s covers hash key %s", m.streamName, hash)
+}
+
+// Invalidate drops the cached ranges, for callers that saw a record land on
+// another shard than the map predicted
+func (m *ShardMap) Invalidate() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ranges = nil
+}
+
+// check loads the ranges if they are not cached, and reloads them when the
+// refresh interval passed and the open shard count changed
+func (m *ShardMap) check(ctx context.Context) error {
+	if m.ranges == nil {
+		return m.load(ctx)
+	}
+	if m.refresh <= 0 || time.Since(m.checked) < m.refresh {
+		return nil
+	}
+	output, err := m.client.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(m.streamName),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe stream: %w", err)
+	}
+	m.checked = time.Now()
+	if int(aws.ToInt32(output.StreamDescriptionSummary.OpenShardCount)) == len(m.ranges) {
+		return nil
+	}
+	return m.load(ctx)
+}
+
+// load lists the open shards and caches their ranges
+func (m *ShardMap) load(ctx context.Context) error {
+	shards, err := openShards(ctx, m.client, m.streamName)
+	if err != nil {
+		return err
+	}
+	open := make([]hashrange.Shard, 0, len(shards))
+	for _, shard := range shards {
+		if shard.HashKeyRange == nil {
+			continue
+		}
+		open = append(open, hashrange.Shard{
+			ShardID:         aws.ToString(shard.ShardId),
+			StartingHashKey: aws.ToString(shard.HashKeyRange.StartingHashKey),
+			EndingHashKey:   aws.ToString(shard.HashKeyRange.EndingHashKey),
+		})
+	}
+	ranges, err := hashrange.New(open)
+	if err != nil {
+		return err
+	}
+
+	m.ranges = ranges
+	m.checked = time.Now()
+	return nil
+}
+
+// Range returns the hash key range of an open shard
+func (m *ShardMap) Range(shardID string) (start, end *big.Int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.check(context.Background()); err != nil {
+		return nil, nil, err
+	}
+	for _, r := range m.ranges {
+		if r.ShardID == shardID {
+			return r.Start, r.End, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%s is not an open shard of %s", shardID, m.streamName)
+}
+
+// HashKeysIn returns one explicit hash key for each open shard overlapping
+// the hash key range [start, end], the middle of the overlap. A range that
+// was one shard maps to its children after a split, and to the merged shard
+// after a merge.
+func (m *ShardMap) HashKeysIn(start, end *big.Int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ctx := context.Background()
+	if err := m.check(ctx); err != nil {
+		return nil, err
+	}
+	if keys := m.overlaps(start, end); len(keys) > 0 {
+		return keys, nil
+	}
+	// No open shard covers the range while the ranges are listed mid-reshard
+	if err := m.load(ctx); err != nil {
+		return nil, err
+	}
+	if keys := m.overlaps(start, end); len(keys) > 0 {
+		return keys, nil
+	}
+	return nil, fmt.Errorf("no open shard of %s covers hash keys %s to %s", m.streamName, start, end)
+}
+
+// overlaps returns the middle hash key of each cached range's overlap with [start, end]
+func (m *ShardMap) overlaps(start, end *big.Int) []string {
+	var keys []string
+	for _, r := range m.ranges {
+		if r.End.Cmp(start) < 0 || r.Start.Cmp(end) > 0 {
+			continue
+		}
+		lo, hi := r.Start, r.End
+		if lo.Cmp(start) < 0 {
+			lo = start
+		}
+		if hi.Cmp(end) > 0 {
+			hi = end
+		}
+		mid := new(big.Int).Add(lo, hi)
+		keys = append(keys, mid.Rsh(mid, 1).String())
+	}
+	return keys
+}
+
+// previewShards logs how the user IDs the producer draws spread over the
+// open shards, which shows a skewed key space before any record is sent
+func previewShards(shardMap *ShardMap, keyCardinality int) error {
+	counts := make(map[string]int)
+	for i := 0; i < keyCardinality; i++ {
+		shardID, err := shardMap.ShardForKey(fmt.Sprintf("user_%d", i))
+		if err != nil {
+			return err
+		}
+		counts[shardID]++
+	}
+
+	shardIDs := make([]string, 0, len(counts))
+	for shardID := range counts {
+		shardIDs = append(shardIDs, shardID)
+	}
+	sort.Strings(shardIDs)
+	for _, shardID := range shardIDs {
+		log.Printf("Shard preview: %s receives %d of %d user IDs (%.1f%%)",
+			shardID, counts[shardID], keyCardinality, float64(counts[shardID])*100/float64(keyCardinality))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+// shardTargetTick is how often a shard target sends its share of records
+const shardTargetTick = 10 * time.Millisecond
+
+// shardTarget paces the records of one producer.shard_target_rps entry. It
+// keeps the hash key range the shard had when the producer started, so after
+// a split the target's rate is spread over the children, and after a merge
+// the merged shard receives it.
+type shardTarget struct {
+	shardID    string
+	rps        float64
+	start, end *big.Int
+}
+
+// newShardTargets resolves producer.shard_target_rps against the open shards
+func newShardTargets(cfg *Config, shardMap *ShardMap) ([]*shardTarget, error) {
+	if cfg.Producer.ConcurrentSessions > 0 {
+		return nil, fmt.Errorf("producer.shard_target_rps cannot be combined with concurrent_sessions")
+	}
+	shardIDs := make([]string, 0, len(cfg.Producer.ShardTargetRPS))
+	for shardID := range cfg.Producer.ShardTargetRPS {
+		shardIDs = append(shardIDs, shardID)
+	}
+	sort.Strings(shardIDs)
+
+	targets := make([]*shardTarget, 0, len(shardIDs))
+	for _, shardID := range shardIDs {
+		rps := cfg.Producer.ShardTargetRPS[shardID]
+		if rps <= 0 {
+			return nil, fmt.Errorf("invalid producer.shard_target_rps for %s: %g. Must be greater than 0", shardID, rps)
+		}
+		start, end, err := shardMap.Range(shardID)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, &shardTarget{shardID: shardID, rps: rps, start: start, end: end})
+	}
+	return targets, nil
+}
+
+// generateShardTargets sends every shard target's records at its own rate
+// until total_messages have been generated (or forever if 0), resumed of
+// which were already sent by earlier runs. Events go to any writer: records
+// of one shard are not ordered.
+func generateShardTargets(ctx context.Context, cfg *Config, targets []*shardTarget, shardMap *ShardMap,
+	values ValueGenerator, timestamps TimestampGenerator, resumed int, events chan<- *Event) {
+
+	budget := newEventBudget(cfg.Producer.TotalMessages)
+	if !budget.unlimited {
+		budget.remaining = max(budget.remaining-resumed, 0)
+	}
+	newEvent := func() *Event { return generateEvent(cfg.Producer.KeyCardinality, values, timestamps) }
+
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		log.Printf("Shard target: %.0f records/sec to %s", target.rps, target.shardID)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			sent := target.run(ctx, shardMap, budget, newEvent, events)
+			elapsed := time.Since(start)
+			log.Printf("Shard target %s: %d records in %v (%.1f/sec, target %.1f)",
+				target.shardID, sent, elapsed.Round(time.Millisecond), float64(sent)/elapsed.Seconds(), target.rps)
+		}()
+	}
+	wg.Wait()
+	if cfg.Producer.TotalMessages > 0 && ctx.Err() == nil {
+		log.Printf("Reached total message limit: %d messages", cfg.Producer.TotalMessages)
+	}
+}
+
+// run sends the target's records until ctx is done or the budget is spent
+// and returns how many it sent. The hash keys are looked up every tick, so
+// the records follow the target's range onto new shards after resharding.
+// If the writers can't keep up the target runs slower rather than queuing up.
+func (t *shardTarget) run(ctx context.Context, shardMap *ShardMap, budget *eventBudget, newEvent func() *Event, events chan<- *Event) int {
+	start := time.Now()
+	ticker := time.NewTicker(shardTargetTick)
+	defer ticker.Stop()
+
+	sent := 0
+	shards := 1
+	for {
+		select {
+		case <-ctx.Done():
+			return sent
+		case <-ticker.C:
+		}
+
+		keys, err := shardMap.HashKeysIn(t.start, t.end)
+		if err != nil {
+			log.Printf("Shard target %s: %v", t.shardID, err)
+			continue
+		}
+		if len(keys) != shards {
+			log.Printf("Shard target %s now spans %d open shards", t.shardID, len(keys))
+			shards = len(keys)
+		}
+
+		// Catch up to the rate over the whole run, so ticks lost to busy
+		// writers or a shard listing don't lower it
+		due := int(t.rps * time.Since(start).Seconds())
+		for ; sent < due; sent++ {
+			if !budget.take() {
+				return sent
+			}
+			event := newEvent()
+			event.HashKey = keys[sent%len(keys)]
+			event.Metadata["target_shard"] = t.shardID
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return sent
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+const (
+	maxHashKey  = "340282366920938463463374607431768211455"
+	halfHashKey = "170141183460469231731687303715884105727"
+	nextHashKey = "170141183460469231731687303715884105728"
+)
+
+func TestShardTargetRates(t *testing.T) {
+	const run = 500 * time.Millisecond
+	client := &shardedStream{shards: []types.Shard{
+		testStreamShard("shardId-000000000000", "0", halfHashKey, false),
+		testStreamShard("shardId-000000000001", nextHashKey, maxHashKey, false),
+	}}
+	cfg := &Config{}
+	cfg.Producer.KeyCardinality = 10
+	cfg.Producer.ShardTargetRPS = map[string]float64{"shardId-000000000000": 200, "shardId-000000000001": 40}
+	shardMap := NewShardMap(client, "test-stream", 0)
+	targets, err := newShardTargets(cfg, shardMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan *Event, 1000)
+	ctx, cancel := context.WithTimeout(context.Background(), run)
+	defer cancel()
+	generateShardTargets(ctx, cfg, targets, shardMap, func() float64 { return 1 }, time.Now, 0, events)
+	close(events)
+
+	counts := make(map[string]int)
+	for event := range events {
+		shardID, err := shardMap.ShardForHashKey(event.HashKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Metadata["target_shard"] != shardID {
+			t.Errorf("event for %v landed on %s", event.Metadata["target_shard"], shardID)
+		}
+		counts[shardID]++
+	}
+	for shardID, rps := range cfg.Producer.ShardTargetRPS {
+		rate := float64(counts[shardID]) / run.Seconds()
+		if math.Abs(rate-rps) > rps*0.2 {
+			t.Errorf("%s received %.1f records/sec, want about %g", shardID, rate, rps)
+		}
+	}
+}
+
+func TestShardTargetAfterSplit(t *testing.T) {
+	parent := testStreamShard("shardId-000000000000", "0", maxHashKey, false)
+	client := &shardedStream{shards: []types.Shard{parent}}
+	cfg := &Config{}
+	cfg.Producer.ShardTargetRPS = map[string]float64{"shardId-000000000000": 10}
+	shardMap := NewShardMap(client, "test-stream", 0)
+	targets, err := newShardTargets(cfg, shardMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The parent's range is now covered by its two children
+	client.shards = []types.Shard{
+		testStreamShard("shardId-000000000000", "0", maxHashKey, true),
+		testStreamShard("shardId-000000000001", "0", halfHashKey, false),
+		testStreamShard("shardId-000000000002", nextHashKey, maxHashKey, false),
+	}
+	shardMap.Invalidate()
+	keys, err := shardMap.HashKeysIn(targets[0].start, targets[0].end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		shardID, err := shardMap.ShardForHashKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[shardID] = true
+	}
+	if len(keys) != 2 || !seen["shardId-000000000001"] || !seen["shardId-000000000002"] {
+		t.Errorf("target keys %v land on %v, want one on each child", keys, seen)
+	}
+}
+
+func TestNewShardTargets(t *testing.T) {
+	client := &shardedStream{shards: []types.Shard{testStreamShard("shardId-000000000000", "0", maxHashKey, false)}}
+	tests := []struct {
+		name     string
+		targets  map[string]float64
+		sessions int
+	}{
+		{name: "unknown shard", targets: map[string]float64{"shardId-000000000009": 10}},
+		{name: "zero rate", targets: map[string]float64{"shardId-000000000000": 0}},
+		{name: "with sessions", targets: map[string]float64{"shardId-000000000000": 10}, sessions: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Producer.ShardTargetRPS = tt.targets
+			cfg.Producer.ConcurrentSessions = tt.sessions
+			if _, err := newShardTargets(cfg, NewShardMap(client, "test-stream", 0)); err == nil {
+				t.Error("newShardTargets() accepted the targets")
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// TeeRecord is one line of producer.tee_file: an event as it was put,
+// before signing, with where Kinesis stored it
+type TeeRecord struct {
+	ShardID        string          `json:"shard_id"`
+	SequenceNumber string          `json:"sequence_number"`
+	PartitionKey   string          `json:"partition_key"`
+	Duplicate      bool            `json:"duplicate,omitempty"` // resent by producer.duplicate_rate
+	Event          json.RawMessage `json:"event"`
+}
+
+// teeFile appends every event Kinesis accepted to producer.tee_file as JSON
+// lines, a ground truth of what was produced to diff the consumer's output
+// against. Dropped events are not written. A nil *teeFile writes nothing.
+type teeFile struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// newTeeFile opens producer.tee_file for appending, so a resumed run extends
+// it, and returns nil when it is unset
+func newTeeFile(cfg *Config) (*teeFile, error) {
+	path := cfg.Producer.TeeFile
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tee file: %w", err)
+	}
+	return &teeFile{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// write appends one sent event
+func (t *teeFile) write(record TeeRecord) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.enc.Encode(record)
+}
+
+// Close closes the file
+func (t *teeFile) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.file.Close()
+}
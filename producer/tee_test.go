@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// readTeeFile returns the records of a tee file
+func readTeeFile(t *testing.T, path string) []TeeRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []TeeRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record TeeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestTeeFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		batchAPI bool
+		failures map[string]int
+	}{
+		{name: "batch puts", batchAPI: true},
+		{name: "single puts", failures: map[string]int{"user_1": 1}},
+		// A resent entry is teed once, when accepted, and a dropped one never
+		{name: "resent and dropped", batchAPI: true, failures: map[string]int{"user_1": 1, "user_2": maxPutAttempts}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Producer.TeeFile = filepath.Join(t.TempDir(), "sent.jsonl")
+			client := &fakePutter{failures: tt.failures}
+			w := newTestWriter(client, tt.batchAPI)
+			// Each run appends, as a resumed run would
+			for _, events := range [][]*Event{testEvents(4)[:2], testEvents(4)[2:]} {
+				tee, err := newTeeFile(cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				w.tee = tee
+				w.send(context.Background(), events)
+				if err := tee.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The tee file matches what the stream accepted, line for line
+			records := readTeeFile(t, cfg.Producer.TeeFile)
+			if len(records) != len(client.put) {
+				t.Fatalf("tee file has %d records, the stream accepted %d", len(records), len(client.put))
+			}
+			for i, record := range records {
+				entry := client.put[i]
+				if record.ShardID != "shardId-000000000000" || record.SequenceNumber != fmt.Sprint(i+1) {
+					t.Errorf("record %d stored at %s %s, want shardId-000000000000 %d", i, record.ShardID, record.SequenceNumber, i+1)
+				}
+				if record.PartitionKey != aws.ToString(entry.PartitionKey) || !bytes.Equal(record.Event, entry.Data) {
+					t.Errorf("record %d is %s %s, want %s %s", i, record.PartitionKey, record.Event, aws.ToString(entry.PartitionKey), entry.Data)
+				}
+			}
+		})
+	}
+
+	if tee, err := newTeeFile(&Config{}); tee != nil || err != nil {
+		t.Errorf("newTeeFile() without tee_file = %v, %v; want nil", tee, err)
+	}
+}
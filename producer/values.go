@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Value distributions supported by producer.value_distribution.type
+const (
+	ValueDistributionUniform     = "uniform"
+	ValueDistributionNormal      = "normal"
+	ValueDistributionExponential = "exponential"
+)
+
+// DefaultValueMax is the upper bound used when neither min nor max is set,
+// matching the original rand.Float64() * 1000
+const DefaultValueMax = 1000
+
+// ValueGenerator draws the Value field of generated events
+type ValueGenerator func() float64
+
+// newValueGenerator builds the generator described by producer.value_distribution.
+//
+//   - uniform: evenly spread over [min, max)
+//   - normal: gaussian with mean/stddev, clamped to [min, max]
+//   - exponential: min plus an exponential offset whose mean is mean-min, capped at max
+func newValueGenerator(cfg *Config) (ValueGenerator, error) {
+	dist := cfg.Producer.ValueDistribution
+	if dist.Max <= dist.Min {
+		return nil, fmt.Errorf("producer.value_distribution.max (%g) must be greater than min (%g)", dist.Max, dist.Min)
+	}
+
+	switch dist.Type {
+	case ValueDistributionUniform:
+		return func() float64 {
+			return dist.Min + rand.Float64()*(dist.Max-dist.Min)
+		}, nil
+
+	case ValueDistributionNormal:
+		if dist.StdDev <= 0 {
+			return nil, fmt.Errorf("producer.value_distribution.stddev must be positive for the normal distribution")
+		}
+		return func() float64 {
+			return clamp(rand.NormFloat64()*dist.StdDev+dist.Mean, dist.Min, dist.Max)
+		}, nil
+
+	case ValueDistributionExponential:
+		scale := dist.Mean - dist.Min
+		if scale <= 0 {
+			return nil, fmt.Errorf("producer.value_distribution.mean (%g) must be greater than min (%g) for the exponential distribution", dist.Mean, dist.Min)
+		}
+		return func() float64 {
+			return math.Min(dist.Min+rand.ExpFloat64()*scale, dist.Max)
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("invalid value distribution: %s. Must be '%s', '%s' or '%s'",
+			dist.Type, ValueDistributionUniform, ValueDistributionNormal, ValueDistributionExponential)
+	}
+}
+
+func clamp(v, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(v, hi))
+}
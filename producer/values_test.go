@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestValueGenerator(t *testing.T) {
+	const samples = 20000
+	tests := []struct {
+		name           string
+		dist           string
+		min, max       float64
+		mean, stddev   float64
+		wantMean       float64
+		wantStdDev     float64 // 0 skips the check
+		tolerance      float64 // allowed distance of the sample mean and stddev
+		wantAtBoundary bool    // some values are clamped to min or max
+	}{
+		{name: "uniform", dist: ValueDistributionUniform, min: 100, max: 200, wantMean: 150, wantStdDev: 100 / math.Sqrt(12), tolerance: 2},
+		{name: "normal", dist: ValueDistributionNormal, min: 0, max: 1000, mean: 500, stddev: 50, wantMean: 500, wantStdDev: 50, tolerance: 3},
+		{name: "normal clamped", dist: ValueDistributionNormal, min: 450, max: 550, mean: 500, stddev: 100, wantMean: 500, tolerance: 3, wantAtBoundary: true},
+		{name: "exponential", dist: ValueDistributionExponential, min: 10, max: 1e9, mean: 60, wantMean: 60, wantStdDev: 50, tolerance: 3},
+		{name: "exponential capped", dist: ValueDistributionExponential, min: 0, max: 100, mean: 100, wantMean: 100 * (1 - 1/math.E), tolerance: 3, wantAtBoundary: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			dist := &cfg.Producer.ValueDistribution
+			dist.Type, dist.Min, dist.Max, dist.Mean, dist.StdDev = tt.dist, tt.min, tt.max, tt.mean, tt.stddev
+			values, err := newValueGenerator(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var sum, sumSquares float64
+			atBoundary := 0
+			for range samples {
+				v := values()
+				if v < tt.min || v > tt.max {
+					t.Fatalf("value %g outside [%g, %g]", v, tt.min, tt.max)
+				}
+				if v == tt.min || v == tt.max {
+					atBoundary++
+				}
+				sum += v
+				sumSquares += v * v
+			}
+			mean := sum / samples
+			stddev := math.Sqrt(sumSquares/samples - mean*mean)
+			if math.Abs(mean-tt.wantMean) > tt.tolerance {
+				t.Errorf("sample mean %.2f, want %g ± %g", mean, tt.wantMean, tt.tolerance)
+			}
+			if tt.wantStdDev > 0 && math.Abs(stddev-tt.wantStdDev) > tt.tolerance {
+				t.Errorf("sample stddev %.2f, want %.2f ± %g", stddev, tt.wantStdDev, tt.tolerance)
+			}
+			if (atBoundary > 0) != tt.wantAtBoundary {
+				t.Errorf("%d values at min or max, want some %t", atBoundary, tt.wantAtBoundary)
+			}
+		})
+	}
+}
+
+func TestValueGeneratorConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		dist     string
+		min, max float64
+		mean     float64
+		stddev   float64
+		wantErr  string
+	}{
+		{name: "max not above min", dist: ValueDistributionUniform, min: 10, max: 10, wantErr: "must be greater than min"},
+		{name: "normal without stddev", dist: ValueDistributionNormal, max: 10, mean: 5, wantErr: "stddev must be positive"},
+		{name: "exponential mean not above min", dist: ValueDistributionExponential, min: 5, max: 10, mean: 5, wantErr: "mean (5) must be greater than min"},
+		{name: "unknown", dist: "poisson", max: 10, wantErr: "invalid value distribution: poisson"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			dist := &cfg.Producer.ValueDistribution
+			dist.Type, dist.Min, dist.Max, dist.Mean, dist.StdDev = tt.dist, tt.min, tt.max, tt.mean, tt.stddev
+			if _, err := newValueGenerator(cfg); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("newValueGenerator() = %v, want an error with %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	// maxPutRecordsEntries is the PutRecords per-request record limit
+	maxPutRecordsEntries = 500
+
+	// maxPutAttempts bounds how many times a failed entry is resent before it is dropped
+	maxPutAttempts = 5
+
+	// putRetryBaseDelay is the backoff before the first resend of failed entries
+	putRetryBaseDelay = 100 * time.Millisecond
+)
+
+// producerStats aggregates send results from all writer goroutines
+type producerStats struct {
+	mu           sync.Mutex
+	startTime    time.Time
+	sent         int
+	dropped      int
+	distinctKeys map[string]struct{}
+	duplicates   int // resent by producer.duplicate_rate, not part of sent
+
+	// Payload sizes of the events sent, as marshaled JSON and as put after
+	// producer.compress, logged only when compressing
+	compressed bool
+	jsonBytes  int
+	putBytes   int
+}
+
+func newProducerStats(keyCardinality int) *producerStats {
+	return &producerStats{
+		startTime:    time.Now(),
+		distinctKeys: make(map[string]struct{}, keyCardinality),
+	}
+}
+
+// recordSent counts a successfully sent event of jsonBytes, put as
+// putBytes, and returns the running total
+func (s *producerStats) recordSent(partitionKey string, jsonBytes, putBytes int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent++
+	s.jsonBytes += jsonBytes
+	s.putBytes += putBytes
+	if s.distinctKeys != nil {
+		s.distinctKeys[partitionKey] = struct{}{}
+	}
+	return s.sent
+}
+
+// keyCount is the number of distinct partition keys sent; without a key
+// set, every event had a key of its own
+func (s *producerStats) keyCount() int {
+	if s.distinctKeys == nil {
+		return s.sent
+	}
+	return len(s.distinctKeys)
+}
+
+// recordDuplicate counts a sent duplicate of an earlier event
+func (s *producerStats) recordDuplicate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.duplicates++
+}
+
+func (s *producerStats) recordDropped(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped += n
+}
+
+// totals returns the messages sent and dropped so far
+func (s *producerStats) totals() (sent, dropped int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sent, s.dropped
+}
+
+// logStats prints the running totals
+func (s *producerStats) logStats() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elapsed := time.Since(s.startTime).Seconds()
+	compression := ""
+	if s.compressed {
+		compression = fmt.Sprintf(", JSONBytes=%d, CompressedBytes=%d (%s)", s.jsonBytes, s.putBytes, s.compressionRatio())
+	}
+	log.Printf("Stats: Total=%d, Dropped=%d, Rate=%.2f msgs/sec, Elapsed=%.2fs, DistinctKeys=%d%s",
+		s.sent, s.dropped, float64(s.sent)/elapsed, elapsed, s.keyCount(), compression)
+}
+
+// compressionRatio describes the compressed size as a share of the JSON
+func (s *producerStats) compressionRatio() string {
+	if s.jsonBytes == 0 {
+		return "nothing sent"
+	}
+	return fmt.Sprintf("%.1f%% of the JSON", float64(s.putBytes)*100/float64(s.jsonBytes))
+}
+
+// logSummary prints the final totals once all writers have finished
+func (s *producerStats) logSummary() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elapsed := time.Since(s.startTime).Seconds()
+	log.Printf("Producer completed: %d messages in %.2f seconds (%.2f msgs/sec), %d distinct partition keys, %d dropped",
+		s.sent, elapsed, float64(s.sent)/elapsed, s.keyCount(), s.dropped)
+	if s.duplicates > 0 {
+		log.Printf("Sent %d duplicates of those messages with the same event IDs", s.duplicates)
+	}
+	if s.compressed {
+		log.Printf("Compressed %d bytes of JSON events to %d bytes (%s)", s.jsonBytes, s.putBytes, s.compressionRatio())
+	}
+}
+
+// generateEvents emits batches of events onto the channel, pausing between
+// batches, until totalMessages have been generated (or forever if 0). It
+// generates exactly totalMessages events so concurrent writers can never
+// overshoot the limit; resumed of them were already sent by earlier runs.
+func generateEvents(ctx context.Context, cfg *Config, values ValueGenerator, timestamps TimestampGenerator, resumed int, events chan<- *Event) {
+	generated := resumed
+	for {
+		for i := 0; i < cfg.Producer.BatchSize; i++ {
+			if cfg.Producer.TotalMessages > 0 && generated >= cfg.Producer.TotalMessages {
+				log.Printf("Reached total message limit: %d messages", cfg.Producer.TotalMessages)
+				return
+			}
+			select {
+			case events <- generateEvent(cfg.Producer.KeyCardinality, values, timestamps):
+				generated++
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-time.After(time.Duration(*cfg.Producer.BatchDelayMs) * time.Millisecond):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// writer sends events from the shared channel to Kinesis with PutRecords
+type writer struct {
+	id         int
+	client     kinesisAPI
+	streamName string
+	batchSize  int
+	keyFunc    PartitionKeyFunc
+	batchAPI   bool // one PutRecords call per batch rather than a PutRecord call per event
+	stats      *producerStats
+	shardMap   *ShardMap      // nil unless producer.preview_shards is set
+	fields     fieldMapping   // nil unless producer.field_mapping is set
+	signer     signer         // nil unless producer.hmac_secret is set
+	compressor *compressor    // nil unless producer.compress is set
+	tee        *teeFile       // nil unless producer.tee_file is set
+	adaptive   *adaptiveBatch // nil unless producer.adaptive_batch.target_latency_ms is set
+	duplicates *duplicator    // nil unless producer.duplicate_rate is set
+	aggregator *aggregator    // nil unless producer.aggregate is set
+}
+
+// run sends batches until the events channel is closed and drained
+func (w *writer) run(ctx context.Context, events <-chan *Event) {
+	for {
+		batch := nextBatch(events, min(w.adaptive.current(w.batchSize), maxPutRecordsEntries))
+		if len(batch) == 0 {
+			return
+		}
+		sent := w.send(ctx, batch)
+		if duplicates := w.duplicates.pick(sent); len(duplicates) > 0 {
+			w.send(ctx, duplicates)
+		}
+		w.stats.logStats()
+	}
+}
+
+// nextBatch blocks for the first event and then takes whatever else is
+// immediately available, up to max. It returns nil once the channel is closed and empty.
+func nextBatch(events <-chan *Event, max int) []*Event {
+	event, ok := <-events
+	if !ok {
+		return nil
+	}
+	batch := []*Event{event}
+	for len(batch) < max {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, event)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// putEntry is one record put to Kinesis and the events it carries: a
+// single event, or with producer.aggregate every event packed into it
+type putEntry struct {
+	entry    types.PutRecordsRequestEntry
+	events   []*Event
+	payloads [][]byte // the events as marshaled, before compressing and signing
+	sizes    []int    // the size of each event as put, compressed and signed
+}
+
+// send puts a batch of events, resending only the entries that failed, and
+// returns the events that were sent
+func (w *writer) send(ctx context.Context, batch []*Event) []*Event {
+	var sent []*Event
+	pending := make([]*putEntry, 0, len(batch))
+	for _, event := range batch {
+		data, err := w.fields.marshal(event)
+		if err != nil {
+			log.Printf("Failed to marshal event: %v", err)
+			continue
+		}
+		compressed, err := w.compressor.compress(data)
+		if err != nil {
+			log.Printf("Failed to compress event: %v", err)
+			continue
+		}
+		// Chosen once, so retries and duplicates keep the key
+		if event.PartitionKey == "" {
+			event.PartitionKey = w.keyFunc(event)
+		}
+		entry := types.PutRecordsRequestEntry{
+			Data:         w.signer.sign(compressed),
+			PartitionKey: aws.String(event.PartitionKey),
+		}
+		if event.HashKey != "" {
+			entry.ExplicitHashKey = aws.String(event.HashKey)
+		}
+		pending = append(pending, &putEntry{entry: entry, events: []*Event{event}, payloads: [][]byte{data}, sizes: []int{len(entry.Data)}})
+	}
+	pending = w.aggregator.pack(pending)
+
+	for attempt := 1; len(pending) > 0; attempt++ {
+		entries := make([]types.PutRecordsRequestEntry, len(pending))
+		for i, p := range pending {
+			entries[i] = p.entry
+		}
+		start := time.Now()
+		output, err := w.put(ctx, entries)
+		var results []types.PutRecordsResultEntry
+		if err == nil {
+			results = output.Records
+		}
+		w.adaptive.observe(time.Since(start), putThrottled(err, results))
+		if err == nil {
+			var failed []*putEntry
+			for i, result := range output.Records {
+				if result.ErrorCode != nil {
+					failed = append(failed, pending[i])
+					continue
+				}
+				for j, event := range pending[i].events {
+					sent = append(sent, event)
+					w.recordSent(event, pending[i].payloads[j], pending[i].sizes[j], result)
+				}
+			}
+			if len(failed) > 0 {
+				log.Printf("[Writer %d] %d of %d records failed (first error: %s)",
+					w.id, len(failed), len(entries), failedErrorMessage(output.Records))
+			}
+			pending = failed
+		} else {
+			log.Printf("[Writer %d] Failed to put records: %v", w.id, err)
+		}
+
+		if len(pending) == 0 {
+			return sent
+		}
+		if attempt >= maxPutAttempts {
+			dropped := 0
+			for _, p := range pending {
+				dropped += len(p.events)
+			}
+			log.Printf("[Writer %d] Dropping %d records after %d attempts", w.id, dropped, attempt)
+			w.stats.recordDropped(dropped)
+			return sent
+		}
+		time.Sleep(putRetryBaseDelay << (attempt - 1))
+	}
+	return sent
+}
+
+// recordSent counts, logs and tees an event Kinesis accepted, put as size bytes
+func (w *writer) recordSent(event *Event, payload []byte, size int, result types.PutRecordsResultEntry) {
+	if event.Duplicate {
+		w.stats.recordDuplicate()
+		log.Printf("[Writer %d] Sent duplicate of event %s | ShardID: %s | SequenceNumber: %s",
+			w.id, event.EventID, *result.ShardId, *result.SequenceNumber)
+	} else {
+		total := w.stats.recordSent(event.PartitionKey, len(payload), size)
+		log.Printf("[%d] [Writer %d] Sent event %s | UserID: %s | Action: %s | ShardID: %s | SequenceNumber: %s",
+			total, w.id, event.EventID, event.UserID, event.Action, *result.ShardId, *result.SequenceNumber)
+	}
+	if err := w.tee.write(TeeRecord{
+		ShardID:        aws.ToString(result.ShardId),
+		SequenceNumber: aws.ToString(result.SequenceNumber),
+		PartitionKey:   event.PartitionKey,
+		Duplicate:      event.Duplicate,
+		Event:          payload,
+	}); err != nil {
+		log.Printf("[Writer %d] Failed to write event %s to the tee file: %v", w.id, event.EventID, err)
+	}
+	// The shard map predicts by partition key, which a hash key overrides
+	if event.HashKey == "" {
+		w.checkShard(event.PartitionKey, aws.ToString(result.ShardId))
+	}
+}
+
+// put sends the entries with one PutRecords call, or with
+// producer.use_batch_api off with one PutRecord call each, whose outcomes
+// are gathered into the per-entry results PutRecords would have returned
+func (w *writer) put(ctx context.Context, entries []types.PutRecordsRequestEntry) (*kinesis.PutRecordsOutput, error) {
+	if w.batchAPI {
+		return w.client.PutRecords(ctx, &kinesis.PutRecordsInput{
+			StreamName: aws.String(w.streamName),
+			Records:    entries,
+		})
+	}
+
+	output := &kinesis.PutRecordsOutput{Records: make([]types.PutRecordsResultEntry, len(entries))}
+	failed := int32(0)
+	for i, entry := range entries {
+		result, err := w.client.PutRecord(ctx, &kinesis.PutRecordInput{
+			StreamName:      aws.String(w.streamName),
+			Data:            entry.Data,
+			PartitionKey:    entry.PartitionKey,
+			ExplicitHashKey: entry.ExplicitHashKey,
+		})
+		if err != nil {
+			code, message := "InternalFailure", err.Error()
+			var apiErr smithy.APIError
+			if errors.As(err, &apiErr) {
+				code, message = apiErr.ErrorCode(), apiErr.ErrorMessage()
+			}
+			output.Records[i] = types.PutRecordsResultEntry{ErrorCode: aws.String(code), ErrorMessage: aws.String(message)}
+			failed++
+			continue
+		}
+		output.Records[i] = types.PutRecordsResultEntry{ShardId: result.ShardId, SequenceNumber: result.SequenceNumber}
+	}
+	output.FailedRecordCount = aws.Int32(failed)
+	return output, nil
+}
+
+// checkShard compares the shard a record landed on with the one the shard
+// map predicted, and drops the map's ranges when they disagree because the
+// stream was resharded since they were listed
+func (w *writer) checkShard(partitionKey, shardID string) {
+	if w.shardMap == nil {
+		return
+	}
+	expected, err := w.shardMap.ShardForKey(partitionKey)
+	if err != nil {
+		log.Printf("[Writer %d] Failed to map partition key %s: %v", w.id, partitionKey, err)
+		return
+	}
+	if expected != shardID {
+		log.Printf("[Writer %d] Partition key %s landed on %s, shard map expected %s; refreshing the map",
+			w.id, partitionKey, shardID, expected)
+		w.shardMap.Invalidate()
+	}
+}
+
+func failedErrorMessage(results []types.PutRecordsResultEntry) string {
+	for _, result := range results {
+		if result.ErrorCode != nil {
+			return aws.ToString(result.ErrorCode) + ": " + aws.ToString(result.ErrorMessage)
+		}
+	}
+	return ""
+}
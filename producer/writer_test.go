@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// fakePutter is a kinesisAPI accepting puts onto a single shard. Each
+// partition key in failures fails that many times before it is accepted.
+type fakePutter struct {
+	kinesisAPI
+	mu       sync.Mutex
+	failures map[string]int
+	calls    int
+	put      []types.PutRecordsRequestEntry // accepted entries, in order
+}
+
+func (f *fakePutter) accept(entry types.PutRecordsRequestEntry) types.PutRecordsResultEntry {
+	key := aws.ToString(entry.PartitionKey)
+	if f.failures[key] > 0 {
+		f.failures[key]--
+		return types.PutRecordsResultEntry{
+			ErrorCode:    aws.String("ProvisionedThroughputExceededException"),
+			ErrorMessage: aws.String("Rate exceeded for shard"),
+		}
+	}
+	f.put = append(f.put, entry)
+	return types.PutRecordsResultEntry{
+		ShardId:        aws.String("shardId-000000000000"),
+		SequenceNumber: aws.String(fmt.Sprint(len(f.put))),
+	}
+}
+
+func (f *fakePutter) PutRecords(ctx context.Context, params *kinesis.PutRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	output := &kinesis.PutRecordsOutput{}
+	failed := int32(0)
+	for _, entry := range params.Records {
+		result := f.accept(entry)
+		if result.ErrorCode != nil {
+			failed++
+		}
+		output.Records = append(output.Records, result)
+	}
+	output.FailedRecordCount = aws.Int32(failed)
+	return output, nil
+}
+
+func (f *fakePutter) PutRecord(ctx context.Context, params *kinesis.PutRecordInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	result := f.accept(types.PutRecordsRequestEntry{Data: params.Data, PartitionKey: params.PartitionKey, ExplicitHashKey: params.ExplicitHashKey})
+	if result.ErrorCode != nil {
+		return nil, fmt.Errorf("%s: %s", aws.ToString(result.ErrorCode), aws.ToString(result.ErrorMessage))
+	}
+	return &kinesis.PutRecordOutput{ShardId: result.ShardId, SequenceNumber: result.SequenceNumber}, nil
+}
+
+// testEvents returns n events keyed user_0 to user_<n-1>
+func testEvents(n int) []*Event {
+	events := make([]*Event, n)
+	for i := range events {
+		events[i] = &Event{Version: 1, EventID: fmt.Sprintf("evt_%d", i), UserID: fmt.Sprintf("user_%d", i), Action: "view"}
+	}
+	return events
+}
+
+// newTestWriter returns a writer putting to client, keyed by user ID
+func newTestWriter(client kinesisAPI, batchAPI bool) *writer {
+	return &writer{
+		client:     client,
+		streamName: "test-stream",
+		batchSize:  10,
+		keyFunc:    func(event *Event) string { return event.UserID },
+		batchAPI:   batchAPI,
+		stats:      newProducerStats(10),
+	}
+}
+
+func TestWriterSend(t *testing.T) {
+	tests := []struct {
+		name        string
+		batchAPI    bool
+		failures    map[string]int
+		wantCalls   int
+		wantSent    int
+		wantDropped int
+	}{
+		{name: "batch accepted", batchAPI: true, wantCalls: 1, wantSent: 3},
+		{name: "failed entries resent alone", batchAPI: true, failures: map[string]int{"user_1": 2}, wantCalls: 3, wantSent: 3},
+		{name: "dropped after the last attempt", batchAPI: true, failures: map[string]int{"user_2": maxPutAttempts}, wantCalls: maxPutAttempts, wantSent: 2, wantDropped: 1},
+		{name: "one call per event", wantCalls: 3, wantSent: 3},
+		{name: "failed event resent without the batch API", failures: map[string]int{"user_0": 1}, wantCalls: 4, wantSent: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakePutter{failures: tt.failures}
+			w := newTestWriter(client, tt.batchAPI)
+
+			sent := w.send(context.Background(), testEvents(3))
+			if len(sent) != tt.wantSent {
+				t.Errorf("sent %d events, want %d", len(sent), tt.wantSent)
+			}
+			if client.calls != tt.wantCalls {
+				t.Errorf("made %d calls, want %d", client.calls, tt.wantCalls)
+			}
+			gotSent, gotDropped := w.stats.totals()
+			if gotSent != tt.wantSent || gotDropped != tt.wantDropped {
+				t.Errorf("stats %d sent, %d dropped; want %d, %d", gotSent, gotDropped, tt.wantSent, tt.wantDropped)
+			}
+			for _, entry := range client.put {
+				if aws.ToString(entry.PartitionKey) == "" {
+					t.Error("put an entry without a partition key")
+				}
+			}
+		})
+	}
+}
+
+func TestNextBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		queued  int
+		max     int
+		closed  bool
+		wantLen int
+	}{
+		{name: "takes what is queued", queued: 3, max: 10, wantLen: 3},
+		{name: "stops at max", queued: 5, max: 2, wantLen: 2},
+		{name: "drains a closed channel", queued: 2, max: 10, closed: true, wantLen: 2},
+		{name: "closed and empty", max: 10, closed: true, wantLen: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := make(chan *Event, tt.queued)
+			for _, event := range testEvents(tt.queued) {
+				events <- event
+			}
+			if tt.closed {
+				close(events)
+			}
+			batch := nextBatch(events, tt.max)
+			if len(batch) != tt.wantLen {
+				t.Fatalf("batch of %d, want %d", len(batch), tt.wantLen)
+			}
+			for i, event := range batch {
+				if want := fmt.Sprintf("evt_%d", i); event.EventID != want {
+					t.Errorf("batch[%d] is %s, want %s", i, event.EventID, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentWritersTotal(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency int
+		batchSize   int
+		total       int
+		resumed     int
+	}{
+		{name: "one writer", concurrency: 1, batchSize: 7, total: 100},
+		{name: "several writers", concurrency: 4, batchSize: 7, total: 100},
+		{name: "more writers than batches", concurrency: 16, batchSize: 50, total: 120},
+		{name: "resumed run", concurrency: 4, batchSize: 7, total: 100, resumed: 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			noDelay := 0
+			cfg := &Config{}
+			cfg.Producer.BatchSize = tt.batchSize
+			cfg.Producer.BatchDelayMs = &noDelay
+			cfg.Producer.TotalMessages = tt.total
+			cfg.Producer.KeyCardinality = 10
+
+			client := &fakePutter{}
+			stats := newProducerStats(10)
+			events := make(chan *Event, tt.batchSize*tt.concurrency)
+			go func() {
+				generateEvents(context.Background(), cfg, func() float64 { return 1 }, time.Now, tt.resumed, events)
+				close(events)
+			}()
+			var wg sync.WaitGroup
+			for i := 1; i <= tt.concurrency; i++ {
+				w := newTestWriter(client, true)
+				w.id, w.batchSize, w.stats = i, tt.batchSize, stats
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					w.run(context.Background(), events)
+				}()
+			}
+			wg.Wait()
+
+			want := tt.total - tt.resumed
+			if len(client.put) != want {
+				t.Errorf("put %d records, want %d", len(client.put), want)
+			}
+			if sent, dropped := stats.totals(); sent != want || dropped != 0 {
+				t.Errorf("stats count %d sent, %d dropped; want %d sent", sent, dropped, want)
+			}
+		})
+	}
+}
+
+func TestKeyCardinality(t *testing.T) {
+	for _, cardinality := range []int{1, 5, 50} {
+		t.Run(fmt.Sprint(cardinality), func(t *testing.T) {
+			noDelay := 0
+			cfg := &Config{}
+			cfg.Producer.BatchSize = 100
+			cfg.Producer.BatchDelayMs = &noDelay
+			cfg.Producer.TotalMessages = 2000
+			cfg.Producer.KeyCardinality = cardinality
+
+			client := &fakePutter{}
+			events := make(chan *Event, cfg.Producer.BatchSize)
+			go func() {
+				generateEvents(context.Background(), cfg, func() float64 { return 1 }, time.Now, 0, events)
+				close(events)
+			}()
+			w := newTestWriter(client, true)
+			w.stats = newProducerStats(cardinality)
+			w.run(context.Background(), events)
+
+			keys := make(map[string]bool)
+			for _, entry := range client.put {
+				keys[aws.ToString(entry.PartitionKey)] = true
+			}
+			// 2000 events draw every one of 50 keys all but surely
+			if len(keys) != cardinality || w.stats.keyCount() != cardinality {
+				t.Errorf("put %d distinct keys, stats counted %d; want %d", len(keys), w.stats.keyCount(), cardinality)
+			}
+		})
+	}
+}